@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/actionscache"
+)
+
+var actionsTokenFlags struct {
+	Secret string        `json:"-" flag:"secret,default=$GOCACHE_ACTIONS_CACHE_SECRET,Secret of the actions cache service (--actions-cache-secret)"`
+	Ref    string        `flag:"ref,Ref the job may read and write entries for (e.g., refs/heads/feature)"`
+	Read   string        `flag:"read,Comma-separated refs the job may also read entries from (e.g., refs/heads/main)"`
+	TTL    time.Duration `flag:"ttl,default=6h,How long the token is valid"`
+}
+
+// runActionsToken prints a runtime token for the actions cache service,
+// scoped to the refs given by the flags.
+func runActionsToken(env *command.Env) error {
+	if actionsTokenFlags.Secret == "" {
+		return env.Usagef("you must provide a --secret")
+	} else if actionsTokenFlags.Ref == "" {
+		return env.Usagef("you must provide a --ref")
+	} else if actionsTokenFlags.TTL <= 0 {
+		return env.Usagef("--ttl must be positive")
+	}
+	scopes := []actionscache.Scope{{
+		Scope:      actionsTokenFlags.Ref,
+		Permission: actionscache.PermRead | actionscache.PermWrite,
+	}}
+	for ref := range strings.SplitSeq(actionsTokenFlags.Read, ",") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			scopes = append(scopes, actionscache.Scope{Scope: ref, Permission: actionscache.PermRead})
+		}
+	}
+	tok, err := actionscache.NewToken(actionsTokenFlags.Secret, scopes, time.Now().Add(actionsTokenFlags.TTL))
+	if err != nil {
+		return err
+	}
+	fmt.Println(tok)
+	return nil
+}
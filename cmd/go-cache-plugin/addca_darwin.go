@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/tlsutil"
+)
+
+// installSigningCert adds cert to the macOS trust settings, using the security
+// tool (compare https://github.com/FiloSottile/mkcert/blob/master/truststore_darwin.go).
+// As root, the cert is trusted by all users via the System keychain;
+// otherwise, it is trusted by the current user via the login keychain, which
+// may ask the user to confirm the change.
+func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
+	f, err := os.CreateTemp("", "revproxy-ca-*.crt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(cert.CertPEM()); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+
+	// A persistent signing cert may already have been trusted by an earlier
+	// run; don't add it again.
+	if exec.CommandContext(env.Context(), "security", "verify-cert", "-q", "-c", f.Name()).Run() == nil {
+		return nil
+	}
+
+	args := []string{"add-trusted-cert", "-r", "trustRoot"}
+	if os.Geteuid() == 0 {
+		args = append(args, "-d", "-k", "/Library/Keychains/System.keychain")
+	} else {
+		slog.Info("adding signing cert to the user trust settings; you may be asked to confirm")
+	}
+	out, err := exec.CommandContext(env.Context(), "security", append(args, f.Name())...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("security add-trusted-cert: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
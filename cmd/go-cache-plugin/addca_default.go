@@ -1,13 +1,13 @@
 // Copyright (c) Tailscale Inc & AUTHORS
 // SPDX-License-Identifier: BSD-3-Clause
 
-//go:build !linux
+//go:build !linux && !darwin && !windows
 
 package main
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 
 	"github.com/creachadair/atomicfile"
 	"github.com/creachadair/command"
@@ -17,13 +17,13 @@ import (
 func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
 	const certFile = "revproxy-ca.crt"
 	if err := atomicfile.WriteData(certFile, cert.CertPEM(), 0644); err != nil {
-		log.Printf("WARNING: Unable to write cert file: %v", err)
+		slog.Warn("unable to write cert file", "err", err)
 	} else {
-		log.Printf("Wrote signing cert to %s", certFile)
+		slog.Info("wrote signing cert", "path", certFile)
 	}
 	// TODO(creachadair): Maybe crib some other cases from mkcert, if we need
 	// them, for example:
-	// https://github.com/FiloSottile/mkcert/blob/master/truststore_darwin.go
+	// https://github.com/FiloSottile/mkcert/blob/master/truststore_nss.go
 
 	return errors.New("unable to install a certificate on this system")
 }
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -15,6 +16,12 @@ import (
 
 func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
 	const ubuntuCertFile = "/etc/ssl/certs/ca-certificates.crt"
+
+	// A persistent signing cert may already have been installed by an
+	// earlier run; don't append it again.
+	if data, err := os.ReadFile(ubuntuCertFile); err == nil && bytes.Contains(data, cert.CertPEM()) {
+		return nil
+	}
 	return lockAndAppend(ubuntuCertFile, cert.CertPEM())
 }
 
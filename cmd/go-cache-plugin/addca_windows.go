@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/tlsutil"
+	"golang.org/x/sys/windows"
+)
+
+// installSigningCert adds cert to the trusted root certificates of the Windows
+// cert store, using the certutil tool (compare
+// https://github.com/FiloSottile/mkcert/blob/master/truststore_windows.go).
+// In an elevated process, the cert is trusted by all users via the local
+// machine store; otherwise, it is trusted by the current user, which may ask
+// the user to confirm the change.
+func installSigningCert(env *command.Env, cert tlsutil.Certificate) error {
+	blk, _ := pem.Decode(cert.CertPEM())
+	if blk == nil {
+		return errors.New("invalid signing cert")
+	}
+	sum := sha1.Sum(blk.Bytes)
+	thumbprint := hex.EncodeToString(sum[:])
+
+	f, err := os.CreateTemp("", "revproxy-ca-*.crt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(cert.CertPEM()); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+
+	var args []string
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		args = append(args, "-user")
+	}
+
+	// A persistent signing cert may already have been trusted by an earlier
+	// run; don't add it again.
+	verify := append(args, "-verifystore", "ROOT", thumbprint)
+	if exec.CommandContext(env.Context(), "certutil", verify...).Run() == nil {
+		return nil
+	}
+
+	if len(args) != 0 {
+		slog.Info("adding signing cert to the user trust store; you may be asked to confirm")
+	}
+	add := append(args, "-f", "-addstore", "ROOT", f.Name())
+	out, err := exec.CommandContext(env.Context(), "certutil", add...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("certutil -addstore: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
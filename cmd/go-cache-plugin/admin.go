@@ -0,0 +1,242 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/admin"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"github.com/grafana/go-cache-plugin/lib/sbom"
+	"google.golang.org/grpc"
+)
+
+// newAdminService constructs an admin service for the given build cache. If sl
+// is non-nil, the service reports bills of materials from it. If uploads are
+// deferred (see --defer-uploads), the service commits and discards them.
+func newAdminService(cache *gobuild.S3Cache, sl *sbom.Log) *admin.Service {
+	svc := &admin.Service{
+		Stats: func(context.Context) (map[string]any, error) { return expvarSnapshot(), nil },
+		Flush: cache.Flush,
+		Purge: func(ctx context.Context, age time.Duration) (map[string]any, error) {
+			st, err := cache.Local.PruneEntries(ctx, age)
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil // no entries have been stored yet
+			}
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{
+				"actions":        st.Actions,
+				"actions_pruned": st.ActionsPruned,
+				"objects":        st.Objects,
+				"objects_pruned": st.ObjectsPruned,
+				"bytes_pruned":   st.BytesPruned,
+				"elapsed":        st.Elapsed.String(),
+			}, nil
+		},
+		Sync: func(ctx context.Context) (map[string]any, error) {
+			st, err := cache.Sync(ctx, flags.CacheDir)
+			if err != nil {
+				return nil, err
+			}
+			return syncStatsMap(st), nil
+		},
+		Config: func(context.Context) (map[string]any, error) {
+			return map[string]any{"global": flags, "serve": serveFlags, "cache": cacheConfig}, nil
+		},
+		Keys: func(ctx context.Context, params map[string]string) (map[string]any, error) {
+			return listKeys(ctx, cache.S3Client, params)
+		},
+		LogLevel: setLogLevel,
+		Token:    serveFlags.AdminToken,
+	}
+	if deferred != nil {
+		svc.Commit = func(ctx context.Context) (map[string]any, error) {
+			st, err := cache.Commit(ctx, flags.CacheDir, deferred)
+			if err != nil {
+				return nil, err
+			}
+			slog.Info("committed deferred uploads", "actions", st.Actions, "synced", st.Synced, "errors", st.Errors)
+			return syncStatsMap(st), nil
+		}
+		svc.Discard = func(context.Context) (map[string]any, error) {
+			n := deferred.Discard()
+			slog.Info("discarded deferred uploads", "actions", n)
+			return map[string]any{"discarded": n}, nil
+		}
+	}
+	if sl != nil {
+		svc.SBOM = func(_ context.Context, params map[string]string) (map[string]any, error) {
+			q, format, err := parseSBOMQuery(params)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", admin.ErrBadRequest, err)
+			}
+			evs, err := sl.Events(q)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := sbom.Generate(evs, format, cmp.Or(q.Namespace, "go-cache-plugin"))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", admin.ErrBadRequest, err)
+			}
+			return doc, nil
+		}
+	}
+	return svc
+}
+
+// syncStatsMap returns the admin API report of st.
+func syncStatsMap(st gobuild.SyncStats) map[string]any {
+	return map[string]any{
+		"actions": st.Actions,
+		"synced":  st.Synced,
+		"skipped": st.Skipped,
+		"errors":  st.Errors,
+		"elapsed": st.Elapsed.String(),
+	}
+}
+
+// errKeyLimit stops a listing of keys when the limit is reached.
+var errKeyLimit = errors.New("key limit reached")
+
+// listKeys lists the keys in S3 under the --prefix selected by params: the
+// "prefix" of the keys, relative to the --prefix, and the "limit" on the number
+// of keys reported (default 100, at most 1000).
+func listKeys(ctx context.Context, s3c *s3util.Client, params map[string]string) (map[string]any, error) {
+	var prefix string
+	limit := 100
+	for key, val := range params {
+		switch key {
+		case "prefix":
+			prefix = val
+		case "limit":
+			if val == "" {
+				continue
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%w: invalid limit %q", admin.ErrBadRequest, val)
+			}
+			limit = min(n, 1000)
+		default:
+			return nil, fmt.Errorf("%w: unknown parameter %q", admin.ErrBadRequest, key)
+		}
+	}
+	dir := keyPrefixDir()
+	keys := []any{}
+	var truncated bool
+	err := s3c.List(ctx, dir+prefix, func(obj s3util.ObjectInfo) error {
+		if len(keys) == limit {
+			truncated = true
+			return errKeyLimit
+		}
+		keys = append(keys, map[string]any{
+			"key":      strings.TrimPrefix(obj.Key, dir),
+			"size":     obj.Size,
+			"modified": obj.ModTime.UTC().Format(time.RFC3339),
+		})
+		return nil
+	})
+	if err != nil && !errors.Is(err, errKeyLimit) {
+		return nil, err
+	}
+	return map[string]any{"keys": keys, "truncated": truncated}, nil
+}
+
+// parseSBOMQuery parses the parameters of an SBOM request. The "since" and
+// "until" bounds may be RFC 3339 times, or durations before the present.
+func parseSBOMQuery(params map[string]string) (q sbom.Query, format string, _ error) {
+	parseTime := func(s string) (time.Time, error) {
+		if d, err := time.ParseDuration(s); err == nil {
+			return time.Now().Add(-d), nil
+		}
+		return time.Parse(time.RFC3339, s)
+	}
+	for key, val := range params {
+		var err error
+		switch key {
+		case "since":
+			q.Since, err = parseTime(val)
+		case "until":
+			q.Until, err = parseTime(val)
+		case "namespace":
+			q.Namespace = val
+		case "format":
+			format = val
+		case "artifacts":
+			q.Artifacts, err = strconv.ParseBool(val)
+		default:
+			return q, "", fmt.Errorf("unknown parameter %q", key)
+		}
+		if err != nil {
+			return q, "", fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return q, format, nil
+}
+
+// initAdminHTTP returns an HTTP handler for the admin REST API, if one is
+// enabled. The REST API is served on the --http listener alongside the
+// proxies, so it is enabled only if an --admin-token is set.
+func initAdminHTTP(cache *gobuild.S3Cache, sl *sbom.Log) http.Handler {
+	if serveFlags.AdminToken == "" {
+		return nil // OK, API is disabled
+	}
+	slog.Debug("enabling admin API at /admin/")
+	return newAdminService(cache, sl)
+}
+
+// initAdminGRPC starts the admin gRPC service if one is enabled, running in g
+// until the context of env ends.
+func initAdminGRPC(env *command.Env, cache *gobuild.S3Cache, sl *sbom.Log, g *taskgroup.Group) error {
+	if serveFlags.AdminGRPC == "" {
+		return nil // OK, service is disabled
+	}
+	lst, err := net.Listen("tcp", serveFlags.AdminGRPC)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	srv := grpc.NewServer()
+	newAdminService(cache, sl).RegisterGRPC(srv)
+	g.Go(func() error { return srv.Serve(lst) })
+	slog.Debug("admin gRPC service listening", "addr", lst.Addr().String())
+	g.Run(func() {
+		<-env.Context().Done()
+		slog.Debug("stopping admin gRPC service")
+		srv.GracefulStop()
+	})
+	return nil
+}
+
+// expvarSnapshot returns the current values of all published expvar metrics,
+// excluding the large runtime variables published by the standard library.
+func expvarSnapshot() map[string]any {
+	out := make(map[string]any)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+		var v any
+		if err := json.Unmarshal([]byte(kv.Value.String()), &v); err == nil {
+			out[kv.Key] = v
+		}
+	})
+	return out
+}
@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/cachetar"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var exportFlags struct {
+	Out   string        `flag:"out,Path of the archive to write (required; compressed if it ends in .zst)"`
+	S3    bool          `flag:"s3,Export the objects in the S3 bucket under the --prefix instead of the --cache-dir"`
+	Only  string        `flag:"only,Export only these subsystems (comma-separated, as reported by du)"`
+	Since time.Duration `flag:"since,Export only entries written within this long before present"`
+}
+
+// exportSkip are the top-level directories of the --cache-dir that hold
+// working state rather than cache entries, and are not exported.
+var exportSkip = []string{journalDir, indexDir, "modtmp"}
+
+// runExport writes the entries of the --cache-dir, or with --s3 the objects in
+// S3 under the --prefix, to an archive that "import" can unpack elsewhere.
+func runExport(env *command.Env) error {
+	if exportFlags.Out == "" {
+		return env.Usagef("you must provide an --out path for the archive")
+	}
+	var only []string
+	if exportFlags.Only != "" {
+		only = strings.Split(exportFlags.Only, ",")
+	}
+	var since time.Time
+	if exportFlags.Since > 0 {
+		since = time.Now().Add(-exportFlags.Since)
+	}
+	selected := func(rel string, modTime time.Time) bool {
+		area := cacheArea(rel)
+		return area != "other" && (only == nil || slices.Contains(only, area)) && !modTime.Before(since)
+	}
+
+	var client *s3util.Client
+	if exportFlags.S3 {
+		var err error
+		client, err = initS3Client(env)
+		if err != nil {
+			return err
+		}
+	} else if flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	}
+
+	var nentries, nbytes int64
+	compress := strings.HasSuffix(exportFlags.Out, ".zst")
+	err := atomicfile.Tx(exportFlags.Out, 0644, func(f *atomicfile.File) error {
+		w, err := cachetar.NewWriter(f, compress)
+		if err != nil {
+			return err
+		}
+		add := func(e cachetar.Entry, r io.Reader) error {
+			if err := w.Add(e, r); err != nil {
+				return err
+			}
+			nentries++
+			nbytes += e.Size
+			return nil
+		}
+		if client != nil {
+			err = exportS3(env, client, selected, add)
+		} else {
+			err = exportLocal(selected, add)
+		}
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	slog.Info("export complete", "out", exportFlags.Out, "entries", nentries, "bytes", nbytes)
+	return nil
+}
+
+// exportLocal calls add for each selected file in the --cache-dir.
+func exportLocal(selected func(string, time.Time) bool, add func(cachetar.Entry, io.Reader) error) error {
+	return filepath.WalkDir(flags.CacheDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(flags.CacheDir, path)
+		rel = filepath.ToSlash(rel)
+		if de.IsDir() {
+			if slices.Contains(exportSkip, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		} else if !selected(rel, fi.ModTime()) {
+			return nil
+		}
+		return add(cachetar.Entry{Tier: cachetar.TierLocal, Path: rel, Size: fi.Size(), ModTime: fi.ModTime()}, f)
+	})
+}
+
+// exportS3 calls add for each selected object in S3 under the --prefix.
+func exportS3(env *command.Env, client *s3util.Client, selected func(string, time.Time) bool, add func(cachetar.Entry, io.Reader) error) error {
+	ctx, dir := env.Context(), keyPrefixDir()
+	return client.List(ctx, dir, func(obj s3util.ObjectInfo) error {
+		rel := strings.TrimPrefix(obj.Key, dir)
+		if !selected(rel, obj.ModTime) {
+			return nil
+		}
+		rc, size, err := client.Get(ctx, obj.Key)
+		if s3util.IsNotExist(err) {
+			return nil // deleted since it was listed
+		} else if err != nil {
+			return fmt.Errorf("read %s: %w", obj.Key, err)
+		}
+		defer rc.Close()
+		return add(cachetar.Entry{Tier: cachetar.TierS3, Path: rel, Size: size, ModTime: obj.ModTime}, rc)
+	})
+}
+
+var importFlags struct {
+	Overwrite bool `flag:"overwrite,Replace entries that are already present"`
+	DryRun    bool `flag:"n,Report what would be imported without importing"`
+}
+
+// runImport unpacks an archive written by "export", storing its local entries
+// in the --cache-dir and its S3 entries in the bucket under the --prefix.
+func runImport(env *command.Env, archivePath string) error {
+	if flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	}
+	var client *s3util.Client
+	if flags.S3Bucket != "" && !importFlags.DryRun {
+		var err error
+		client, err = initS3Client(env)
+		if err != nil {
+			return err
+		}
+	}
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	ctx := env.Context()
+	var nimported, npresent, nskipped int64
+	err = cachetar.Read(in, func(e cachetar.Entry, r io.Reader) error {
+		if importFlags.DryRun {
+			fmt.Printf("%s\t%d\t%s\t%s\n", e.Tier, e.Size, e.ModTime.UTC().Format(time.RFC3339), e.Path)
+			return nil
+		}
+		var ok bool
+		var err error
+		switch e.Tier {
+		case cachetar.TierLocal:
+			ok, err = importLocal(e, r)
+		case cachetar.TierS3:
+			if client == nil {
+				nskipped++
+				return nil
+			}
+			ok, err = importS3(ctx, client, e, r)
+		}
+		if err != nil {
+			return fmt.Errorf("import %s %s: %w", e.Tier, e.Path, err)
+		} else if ok {
+			nimported++
+		} else {
+			npresent++
+		}
+		return nil
+	})
+	slog.Info("import complete", "archive", archivePath, "imported", nimported, "present", npresent, "skipped", nskipped)
+	if err != nil {
+		return err
+	} else if nskipped != 0 {
+		slog.Warn("S3 entries were not imported; set --bucket to import them", "skipped", nskipped)
+	}
+	return nil
+}
+
+// importLocal writes e to the --cache-dir, unless it is already present, and
+// reports whether it was written.
+func importLocal(e cachetar.Entry, r io.Reader) (bool, error) {
+	path := filepath.Join(flags.CacheDir, filepath.FromSlash(e.Path))
+	if _, err := os.Stat(path); err == nil && !importFlags.Overwrite {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	if _, err := atomicfile.WriteAll(path, r, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Chtimes(path, e.ModTime, e.ModTime)
+}
+
+// importS3 writes e to S3 under the --prefix, unless it is already present,
+// and reports whether it was written. The contents are staged in a temporary
+// file, so that their size is known for the upload.
+func importS3(ctx context.Context, client *s3util.Client, e cachetar.Entry, r io.Reader) (bool, error) {
+	key := keyPrefixDir() + e.Path
+	if !importFlags.Overwrite {
+		if ok, err := client.Exists(ctx, key); err != nil {
+			return false, err
+		} else if ok {
+			return false, nil
+		}
+	}
+	tmp, err := os.CreateTemp("", "go-cache-plugin-import-*")
+	if err != nil {
+		return false, err
+	}
+	defer func() { tmp.Close(); os.Remove(tmp.Name()) }()
+	if _, err := io.Copy(tmp, r); err != nil {
+		return false, err
+	} else if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return true, client.Put(ctx, key, tmp)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/auditlog"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// auditLog, if non-nil, records the activity of the cache and the proxies
+// served by this process (see --audit-log).
+var auditLog *auditlog.Log
+
+// initAuditLog opens the audit log if --audit-log is set, and if --audit-log-s3
+// is set, ships it to S3 in g every hour until ctx ends. The caller must defer
+// a call to cleanup, which ships what remains.
+func initAuditLog(ctx context.Context, env *command.Env, s3c *s3util.Client, g *taskgroup.Group) (cleanup func(), _ error) {
+	if serveFlags.AuditLog == "" {
+		if serveFlags.AuditShip {
+			return nil, env.Usagef("you must set --audit-log to enable --audit-log-s3")
+		}
+		return noop, nil // OK, auditing is disabled
+	}
+	al, err := auditlog.Open(serveFlags.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	al.Logger = slog.Default()
+	if serveFlags.AuditShip {
+		al.S3Client = s3c
+		al.KeyPrefix = path.Join(flags.KeyPrefix, "audit")
+		if err := al.Ship(ctx, false); err != nil {
+			slog.Warn("ship audit log failed", "err", err)
+		}
+		g.Run(func() { al.Run(ctx) })
+	}
+	auditLog = al
+	slog.Debug("recording audit log", "dir", serveFlags.AuditLog, "s3", serveFlags.AuditShip)
+	return func() {
+		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer cancel()
+		slog.Debug("close audit log", "err", al.Close(sctx))
+	}, nil
+}
+
+// auditRequests wraps h, a proxy handler for the named service, to record its
+// requests in the audit log, if there is one.
+func auditRequests(service string, h http.Handler) http.Handler {
+	if auditLog == nil {
+		return h
+	}
+	return auditLog.Requests(service, h)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// backfillFile is the name of the backfill manifest in the --cache-dir. It
+// lists the IDs of actions whose uploads to S3 did not complete, one per line.
+const backfillFile = "backfill-actions"
+
+// backfillPath returns the path of the backfill manifest.
+func backfillPath() string { return filepath.Join(flags.CacheDir, backfillFile) }
+
+// saveBackfill appends to the backfill manifest the actions of cache whose
+// uploads are still pending or have failed, along with the specified others,
+// so that the "backfill" command can complete them later. Several plugins may
+// share a cache directory, so each appends its list with a single write.
+func saveBackfill(cache *gobuild.S3Cache, others []string) error {
+	ids := slices.Concat(cache.PendingActions(), cache.FailedActions(), others)
+	if len(ids) == 0 {
+		return nil
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if err := appendLines(backfillPath(), ids); err != nil {
+		return err
+	}
+	slog.Info("recorded incomplete uploads for backfill", "count", len(ids), "path", backfillPath())
+	return nil
+}
+
+// appendLines appends each of lines to the file at path, creating it if
+// necessary.
+func appendLines(path string, lines []string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return errors.Join(err, f.Close())
+}
+
+// runBackfill completes the uploads listed in the backfill manifest. Actions
+// that still cannot be uploaded are recorded again for a later attempt.
+func runBackfill(env *command.Env) error {
+	s, cache, err := initCacheServer(env)
+	if err != nil {
+		return err
+	}
+
+	claim, ids, err := claimBackfill()
+	if err != nil || len(ids) == 0 {
+		s.Close(env.Context())
+		if err == nil {
+			os.Remove(claim)
+			slog.Info("backfill: no incomplete uploads recorded")
+		}
+		return err
+	}
+
+	// Closing the cache records the uploads that failed again.
+	st, serr := cache.SyncActions(env.Context(), flags.CacheDir, ids)
+	s.Close(env.Context())
+	os.Remove(claim)
+	slog.Info("backfill complete", "recorded", len(ids), "actions", st.Actions, "synced", st.Synced,
+		"skipped", st.Skipped, "errors", st.Errors, "elapsed", st.Elapsed)
+	if serr != nil {
+		return fmt.Errorf("backfill: %w", serr)
+	} else if st.Errors != 0 {
+		return errors.New("some uploads could not be completed")
+	}
+	return nil
+}
+
+// claimBackfill claims the current backfill manifest, so that plugins running
+// concurrently record their incomplete uploads in a new one, and returns the
+// path of the claimed manifest and the actions it lists. A claimed manifest
+// left by an earlier backfill that did not finish is resumed instead.
+func claimBackfill() (claim string, ids []string, _ error) {
+	path := backfillPath()
+	claim = path + ".claimed"
+	if _, err := os.Stat(claim); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Rename(path, claim); errors.Is(err, fs.ErrNotExist) {
+			return claim, nil, nil
+		} else if err != nil {
+			return "", nil, fmt.Errorf("claim backfill manifest: %w", err)
+		}
+	}
+	ids, err := readLines(claim)
+	if err != nil {
+		return "", nil, fmt.Errorf("read backfill manifest: %w", err)
+	}
+	slices.Sort(ids)
+	return claim, slices.Compact(ids), nil
+}
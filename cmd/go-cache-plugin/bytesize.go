@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A byteSize is a flag value for a size in bytes, written as an integer with
+// an optional binary or decimal unit suffix, such as "256MiB" or "1GB".
+type byteSize int64
+
+// byteUnits are the unit suffixes understood by byteSize, longest first so
+// that "MiB" is not mistaken for "B".
+var byteUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// Set implements part of the [flag.Value] interface.
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		*b = 0
+		return nil
+	}
+	num, scale := s, int64(1)
+	for _, u := range byteUnits {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			num, scale = strings.TrimSpace(v), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	} else if n > (1<<63-1)/scale {
+		return fmt.Errorf("size %q is too large", s)
+	}
+	*b = byteSize(n * scale)
+	return nil
+}
+
+// String implements part of the [flag.Value] interface.
+func (b *byteSize) String() string {
+	if b == nil || *b == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*b))
+}
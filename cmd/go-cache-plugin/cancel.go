@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/creachadair/gocache"
+)
+
+// errClientGone is the cause of the context of requests from a client that
+// stopped sending requests.
+var errClientGone = errors.New("client closed its request stream")
+
+// runClient runs s to serve the requests of one client, read from r, with the
+// responses written to w.
+//
+// The cache protocol does not carry deadlines or cancellations: when a build
+// is canceled, the go command simply exits, closing its end of the stream. A
+// go command that exits normally sends a "close" request first, and waits for
+// the reply. So once r reports EOF (or an error), no response will be read,
+// and runClient cancels the context of the requests still in progress, which
+// stops their reads from peers and S3. Uploads already started by the cache
+// are not canceled; they complete for the benefit of later builds.
+func runClient(ctx context.Context, s *gocache.Server, r io.Reader, w io.Writer) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	return s.Run(ctx, cancelReader{r: r, cancel: cancel}, w)
+}
+
+// cancelReader is an [io.Reader] that cancels a context when its underlying
+// reader reports an error, including io.EOF.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelCauseFunc
+}
+
+func (c cancelReader) Read(data []byte) (int, error) {
+	n, err := c.r.Read(data)
+	if err != nil {
+		c.cancel(errClientGone)
+	}
+	return n, err
+}
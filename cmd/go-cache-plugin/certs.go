@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/tlsutil"
+	"github.com/grafana/go-cache-plugin/lib/revproxy"
+)
+
+// serverCertValidity is how long each server certificate issued for the
+// reverse proxy is valid. Certificates are renewed before they expire.
+const serverCertValidity = 24 * time.Hour
+
+// loadSigningCert returns the signing certificate for the reverse proxy.
+//
+// If --revproxy-ca-file is set, the certificate is loaded from that file, and
+// its private key from --revproxy-ca-key (or from the same file, if that is
+// not set). If the file does not exist, a new certificate valid for
+// --revproxy-ca-validity is generated and saved there, so that later servers
+// present the same CA and clients need only trust it once.
+//
+// Otherwise, a certificate valid for 24 hours is generated, or taken over
+// from a previous server via the --handoff-dir.
+func loadSigningCert() (tlsutil.Certificate, error) {
+	mint := func(validFor time.Duration) func() (tlsutil.Certificate, error) {
+		return func() (tlsutil.Certificate, error) {
+			return tlsutil.NewSigningCert(validFor, &x509.Certificate{
+				Subject: pkix.Name{Organization: []string{"Tailscale build automation"}},
+			})
+		}
+	}
+	if serveFlags.RevCAFile == "" {
+		return loadHandoffCA(time.Hour, mint(24*time.Hour))
+	}
+
+	certPath := serveFlags.RevCAFile
+	keyPath := cmp.Or(serveFlags.RevCAKey, certPath)
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		ca, err := mint(cmp.Or(serveFlags.RevCAValidity, 365*24*time.Hour))()
+		if err != nil {
+			return ca, err
+		}
+		if err := saveSigningCert(ca, certPath, keyPath); err != nil {
+			return ca, fmt.Errorf("save signing cert: %w", err)
+		}
+		slog.Info("generated reverse proxy CA", "path", certPath, "expires", certExpiry(ca))
+		return ca, nil
+	} else if err != nil {
+		return tlsutil.Certificate{}, err
+	}
+
+	srcs := [][]byte{certPEM}
+	if keyPath != certPath {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return tlsutil.Certificate{}, err
+		}
+		srcs = append(srcs, keyPEM)
+	}
+	ca, err := tlsutil.LoadCertificate(srcs...)
+	if err != nil {
+		return ca, fmt.Errorf("load %q: %w", certPath, err)
+	}
+	if exp := certExpiry(ca); time.Now().After(exp) {
+		return ca, fmt.Errorf("signing cert %q expired at %v (remove it to generate a new one)",
+			certPath, exp.Format(time.RFC3339))
+	}
+	slog.Debug("loaded reverse proxy CA", "path", certPath, "expires", certExpiry(ca))
+	return ca, nil
+}
+
+// saveSigningCert writes the certificate and private key of ca to certPath
+// and keyPath, which may be the same file. The private key is written with
+// permissions that allow only the owner to read it.
+func saveSigningCert(ca tlsutil.Certificate, certPath, keyPath string) error {
+	for _, p := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+	}
+	if keyPath == certPath {
+		return atomicfile.WriteData(certPath, append(ca.CertPEM(), ca.PrivKeyPEM()...), 0600)
+	}
+	if err := atomicfile.WriteData(keyPath, ca.PrivKeyPEM(), 0600); err != nil {
+		return err
+	}
+	return atomicfile.WriteData(certPath, ca.CertPEM(), 0644)
+}
+
+// certRenewer issues TLS server certificates for a set of reverse proxy
+// targets, signed by a CA, and renews them before they expire. Its
+// GetCertificate method is suitable for use in a [tls.Config].
+//
+// The main certificate lists the targets as its DNS names, with wildcard and
+// suffix targets as wildcard names (see [certNames]). Since a wildcard name
+// covers only a single label, a client asking for a deeper subdomain of such a
+// target is issued a certificate for that name alone.
+type certRenewer struct {
+	ca    tlsutil.Certificate
+	hosts []string
+
+	mu    sync.Mutex
+	certs map[string]*issuedCert // by server name; "" for the main certificate
+}
+
+// An issuedCert is a server certificate and the time it expires.
+type issuedCert struct {
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+// GetCertificate returns the server certificate for the server name of hello,
+// issuing a new one if it is missing or will expire within a quarter of its
+// validity period.
+func (r *certRenewer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sans := certNames(r.hosts)
+	name := ""
+	if hello != nil && hello.ServerName != "" && !namesCover(sans, hello.ServerName) &&
+		revproxy.MatchTarget(hello.ServerName, r.hosts) != "" {
+		name = strings.ToLower(hello.ServerName)
+		sans = []string{name}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.certs[name]; ok && time.Until(c.expires) > serverCertValidity/4 {
+		return c.cert, nil
+	}
+
+	// Do not issue a certificate that outlives the CA.
+	validFor := min(serverCertValidity, time.Until(certExpiry(r.ca)))
+	if validFor <= 0 {
+		return nil, errors.New("reverse proxy signing cert has expired")
+	}
+	sc, err := tlsutil.NewServerCert(validFor, r.ca, &x509.Certificate{
+		Subject:  pkix.Name{Organization: []string{"Go cache plugin reverse proxy"}},
+		DNSNames: sans,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generate server cert: %w", err)
+	}
+	cert, err := sc.TLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if r.certs == nil {
+		r.certs = make(map[string]*issuedCert)
+	}
+	c := &issuedCert{cert: &cert, expires: certExpiry(sc)}
+	r.certs[name] = c
+	slog.Debug("issued reverse proxy server cert", "hosts", sans, "expires", c.expires)
+	return c.cert, nil
+}
+
+// certNames returns the DNS names of a server certificate for the given reverse
+// proxy targets. A wildcard target ("*.example.com") is its own name, and a
+// suffix target (".example.com") has both the domain and a wildcard name.
+func certNames(targets []string) []string {
+	var out []string
+	for _, t := range targets {
+		if d, ok := strings.CutPrefix(t, "."); ok {
+			out = append(out, d, "*."+d)
+		} else {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// namesCover reports whether one of the DNS names of a certificate matches the
+// server name, following the rule that a wildcard covers exactly one label.
+func namesCover(names []string, server string) bool {
+	server = strings.ToLower(strings.TrimSuffix(server, "."))
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if d, ok := strings.CutPrefix(n, "*."); ok {
+			if label, ok := strings.CutSuffix(server, "."+d); ok && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		} else if n == server {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+var checkFlags struct {
+	Verify bool          `flag:"verify,Read each object and check its digest against its output ID"`
+	MinAge time.Duration `flag:"min-age,Report unreferenced objects only if older than this (default 1h)"`
+	Repair bool          `flag:"repair,Delete the entries with problems"`
+	Force  bool          `flag:"force,Repair even if the bucket is not versioned (deletes are permanent)"`
+}
+
+// runCheck cross-checks the build cache entries in S3 under the --prefix, and
+// prints the problems found. It reports an error if there are any, so that a
+// periodic job fails visibly.
+func runCheck(env *command.Env) error {
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
+	if err != nil {
+		return env.Usagef("invalid --key-transform: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+	versioned, err := client.Versioned(ctx)
+	if err != nil {
+		return fmt.Errorf("check bucket versioning: %w", err)
+	}
+	if checkFlags.Repair && !versioned && !checkFlags.Force {
+		return errors.New("bucket versioning is not enabled, so a repair cannot be undone (use --force to repair anyway)")
+	}
+	cache := &gobuild.S3Cache{
+		S3Client:          client,
+		KeyPrefix:         flags.KeyPrefix,
+		KeyFunc:           keyFunc,
+		UploadConcurrency: flags.S3Concurrency,
+		Logger:            slog.Default(),
+	}
+	stats, err := cache.Check(ctx, gobuild.CheckOptions{
+		Verify: checkFlags.Verify,
+		MinAge: checkFlags.MinAge,
+		Repair: checkFlags.Repair,
+	}, func(p gobuild.Problem) {
+		fmt.Printf("%s\t%s\t%s\n", p.Kind, p.Key, p.Detail)
+	})
+	var nproblems int64
+	for _, n := range stats.Problems {
+		nproblems += n
+	}
+	slog.Info("check complete", "actions", stats.Actions, "objects", stats.Objects, "verified", stats.Verified,
+		"corrupt", stats.Problems[gobuild.ProblemCorrupt], "missing", stats.Problems[gobuild.ProblemMissing],
+		"mismatch", stats.Problems[gobuild.ProblemMismatch], "orphan", stats.Problems[gobuild.ProblemOrphan],
+		"repaired", stats.Repaired)
+	if err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	} else if nproblems != stats.Repaired {
+		return fmt.Errorf("found %d problems", nproblems)
+	}
+	return nil
+}
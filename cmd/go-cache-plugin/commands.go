@@ -4,15 +4,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,52 +25,256 @@ import (
 	"github.com/creachadair/command"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/atrest"
+	"github.com/grafana/go-cache-plugin/lib/auditlog"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/grafana/go-cache-plugin/lib/hmacconn"
 )
 
 var flags struct {
-	CacheDir      string        `flag:"cache-dir,default=$GOCACHE_DIR,Local cache directory (required)"`
-	S3Bucket      string        `flag:"bucket,default=$GOCACHE_S3_BUCKET,S3 bucket name (required)"`
+	CacheDir      string        `flag:"cache-dir,default=$GOCACHE_DIR,Local cache directory, or fast:<path>,slow:<path> for two tiers (default: go-cache-plugin in the user cache directory)"`
+	S3Bucket      string        `flag:"bucket,default=$GOCACHE_S3_BUCKET,S3 bucket name or access point ARN (required)"`
 	S3Region      string        `flag:"region,default=$GOCACHE_S3_REGION,S3 region"`
 	S3Endpoint    string        `flag:"s3-endpoint-url,default=$GOCACHE_S3_ENDPOINT_URL,S3 custom endpoint URL (if unset, use AWS default)"`
 	S3PathStyle   bool          `flag:"s3-path-style,default=$GOCACHE_S3_PATH_STYLE,S3 path-style URLs (optional)"`
+	S3CAFile      string        `flag:"s3-ca-file,default=$GOCACHE_S3_CA_FILE,PEM file of CA certificates to trust for the S3 endpoint, with those of the system (optional)"`
+	S3ClientCert  string        `flag:"s3-client-cert,default=$GOCACHE_S3_CLIENT_CERT,PEM file of a client certificate to present to the S3 endpoint (optional)"`
+	S3ClientKey   string        `flag:"s3-client-key,default=$GOCACHE_S3_CLIENT_KEY,PEM file of the private key of --s3-client-cert (default: --s3-client-cert)"`
+	S3Accelerate  bool          `flag:"s3-accelerate,default=$GOCACHE_S3_ACCELERATE,Use the S3 Transfer Acceleration endpoint of the bucket"`
+	S3DualStack   bool          `flag:"s3-dual-stack,default=$GOCACHE_S3_DUAL_STACK,Use dual-stack (IPv4 and IPv6) AWS endpoints"`
+	S3FIPS        bool          `flag:"s3-fips,default=$GOCACHE_S3_FIPS,Use FIPS 140 validated AWS endpoints"`
+	S3SSE         string        `flag:"s3-sse,default=$GOCACHE_S3_SSE,S3 server-side encryption (none, s3, kms, or dsse)"`
+	S3KMSKey      string        `flag:"s3-kms-key,default=$GOCACHE_S3_KMS_KEY,KMS key ID or ARN for S3 encryption (optional; implies --s3-sse=kms)"`
+	S3BucketKey   bool          `flag:"s3-bucket-key,default=$GOCACHE_S3_BUCKET_KEY,Use an S3 Bucket Key for KMS encryption"`
+	S3CSEKey      string        `flag:"s3-cse-kms-key,default=$GOCACHE_S3_CSE_KMS_KEY,KMS key ID, ARN, or alias to encrypt objects before upload (optional)"`
+	S3CSEPlain    bool          `flag:"s3-cse-allow-plaintext,default=$GOCACHE_S3_CSE_ALLOW_PLAINTEXT,Read objects not encrypted by --s3-cse-kms-key, while migrating a cache to it"`
+	S3Role        string        `flag:"s3-assume-role-arn,default=$GOCACHE_S3_ASSUME_ROLE_ARN,IAM role to assume for S3 access (optional)"`
+	S3ExtID       string        `flag:"s3-external-id,default=$GOCACHE_S3_EXTERNAL_ID,External ID for --s3-assume-role-arn (optional)"`
+	S3WebIdentity string        `flag:"s3-web-identity-file,default=$GOCACHE_S3_WEB_IDENTITY_FILE,OIDC token file to assume --s3-assume-role-arn with web identity (optional)"`
+	S3Session     string        `flag:"s3-session-name,default=$GOCACHE_S3_SESSION_NAME,Session name for --s3-assume-role-arn (default go-cache-plugin)"`
+	S3Class       string        `flag:"s3-storage-class,default=$GOCACHE_S3_STORAGE_CLASS,S3 storage class for uploads (e.g. STANDARD_IA; default STANDARD)"`
+	S3Checksum    string        `flag:"s3-checksum,default=$GOCACHE_S3_CHECKSUM,Checksum algorithm of objects written to S3 (crc32c, sha256, crc32, or sha1; default: SDK default)"`
+	S3Verify      bool          `flag:"s3-verify-checksums,default=$GOCACHE_S3_VERIFY_CHECKSUMS,Verify the checksums of objects read from S3, failing reads that do not match"`
+	S3Tags        string        `flag:"s3-tags,default=$GOCACHE_S3_TAGS,Tags of objects written to S3 (key=value,...; values may use {VAR}; optional)"`
+	S3Anonymous   bool          `flag:"s3-anonymous,default=$GOCACHE_S3_ANONYMOUS,Read a public bucket without credentials, and never write to it (requires --region)"`
+	S3Payer       bool          `flag:"s3-requester-pays,default=$GOCACHE_S3_REQUESTER_PAYS,Accept the charges for a requester-pays bucket"`
 	KeyPrefix     string        `flag:"prefix,default=$GOCACHE_KEY_PREFIX,S3 key prefix (optional)"`
+	ReadPrefixes  string        `flag:"read-prefixes,default=$GOCACHE_READ_PREFIXES,Build cache key prefixes to read in order, writing the first (prefix,...; optional)"`
+	FallbackBkt   string        `flag:"fallback-bucket,default=$GOCACHE_FALLBACK_BUCKET,Previous S3 bucket to read build cache misses from (optional; see help relocate)"`
+	FallbackPfx   string        `flag:"fallback-prefix,default=$GOCACHE_FALLBACK_PREFIX,Previous S3 key prefix to read build cache misses from (optional; see help relocate)"`
+	ReplicaBkt    string        `flag:"s3-replica-bucket,default=$GOCACHE_S3_REPLICA_BUCKET,S3 bucket to mirror build cache writes to and read from when the --bucket fails (optional; see help replica)"`
+	ReplicaRegion string        `flag:"s3-replica-region,default=$GOCACHE_S3_REPLICA_REGION,S3 region of the --s3-replica-bucket (default based on bucket)"`
+	ReplicaSlow   time.Duration `flag:"s3-replica-slow-read,default=$GOCACHE_S3_REPLICA_SLOW_READ,Read latency of the --bucket counted as a failure for failover to the replica (optional)"`
+	ReplicaPeriod time.Duration `flag:"s3-replica-failover,default=$GOCACHE_S3_REPLICA_FAILOVER,How long reads go to the replica first once the --bucket fails (default 30s)"`
+	KeyTransform  string        `flag:"key-transform,default=$GOCACHE_KEY_TRANSFORM,Build cache key transformation (optional; see help key-transform)"`
 	MinUploadSize int64         `flag:"min-upload-size,default=$GOCACHE_MIN_SIZE,Minimum object size to upload to S3 (in bytes)"`
+	MissTTL       time.Duration `flag:"miss-ttl,default=$GOCACHE_MISS_TTL,How long to remember actions missing from S3 (optional)"`
+	S3KeyIndex    time.Duration `flag:"s3-key-index,default=$GOCACHE_S3_KEY_INDEX,List the actions in S3 at startup and at this interval to skip lookups of absent ones (optional)"`
+	HostIndex     time.Duration `flag:"host-index,default=$GOCACHE_HOST_INDEX,Share an index of the local cache with other processes, rebuilt at this age (optional)"`
+	TestResults   string        `flag:"test-results,default=$GOCACHE_TEST_RESULTS,How to store go test results in S3 (shared, separate, or local)"`
+	TestTTL       time.Duration `flag:"test-ttl,default=$GOCACHE_TEST_TTL,Maximum age of test results read from S3 (with --test-results=separate)"`
+	Compression   string        `flag:"compression,default=$GOCACHE_COMPRESSION,Compression of objects written to S3 (none, zstd, or lz4)"`
+	CanaryRate    float64       `flag:"canary-rate,default=$GOCACHE_CANARY_RATE,Fraction of actions served with the --canary-* settings (optional; see help canary)"`
+	CanaryCodec   string        `flag:"canary-compression,default=$GOCACHE_CANARY_COMPRESSION,Compression of objects written by canary actions (default: --compression)"`
+	CanaryKeys    string        `flag:"canary-key-transform,default=$GOCACHE_CANARY_KEY_TRANSFORM,Key transformation for canary actions (default: --key-transform)"`
+	CanaryPrefix  string        `flag:"canary-prefix,default=$GOCACHE_CANARY_PREFIX,S3 key prefix for canary actions (default: --prefix)"`
 	Concurrency   int           `flag:"c,default=$GOCACHE_CONCURRENCY,Maximum number of concurrent requests"`
 	S3Concurrency int           `flag:"u,default=$GOCACHE_S3_CONCURRENCY,Maximum concurrency for upload to S3"`
+	AdaptiveUp    bool          `flag:"adaptive-uploads,default=$GOCACHE_ADAPTIVE_UPLOADS,Adjust the number of concurrent uploads to S3 latency and throttling, up to -u"`
+	UploadQueue   int           `flag:"upload-queue,default=$GOCACHE_UPLOAD_QUEUE,Maximum uploads to S3 waiting for a worker (0 means wait for a worker)"`
+	UploadDrop    string        `flag:"upload-drop,default=$GOCACHE_UPLOAD_DROP,Policy for a full --upload-queue (newest, oldest, or block)"`
+	CloseFlush    time.Duration `flag:"close-flush-timeout,default=$GOCACHE_CLOSE_FLUSH_TIMEOUT,How long to wait for pending uploads at exit (0 means no limit; negative means do not wait)"`
+	MultipartSize int64         `flag:"multipart-threshold,default=$GOCACHE_MULTIPART_THRESHOLD,Minimum object size to upload to S3 in parts (in bytes; optional)"`
+	PartSize      int64         `flag:"multipart-part-size,default=$GOCACHE_MULTIPART_PART_SIZE,Part size for multipart uploads (in bytes)"`
+	PartUploads   int           `flag:"multipart-concurrency,default=$GOCACHE_MULTIPART_CONCURRENCY,Maximum concurrent part uploads per object"`
+	S3RetryMode   string        `flag:"s3-retry-mode,default=$GOCACHE_S3_RETRY_MODE,Retry mode for S3 requests (standard or adaptive)"`
+	S3Attempts    int           `flag:"s3-max-attempts,default=$GOCACHE_S3_MAX_ATTEMPTS,Maximum attempts for each S3 request (default 3)"`
+	S3MaxBackoff  time.Duration `flag:"s3-max-backoff,default=$GOCACHE_S3_MAX_BACKOFF,Maximum delay between attempts of an S3 request (default 20s)"`
+	S3ReqTimeout  time.Duration `flag:"s3-request-timeout,default=$GOCACHE_S3_REQUEST_TIMEOUT,How long each attempt of an S3 request waits for a response (optional)"`
+	S3NoQuota     bool          `flag:"s3-no-retry-quota,default=$GOCACHE_S3_NO_RETRY_QUOTA,Retry every failed S3 request up to --s3-max-attempts"`
+	S3Hedge       float64       `flag:"s3-hedge-percentile,default=$GOCACHE_S3_HEDGE_PERCENTILE,Send a second S3 read when the first is slower than this percentile of recent reads (e.g. 0.95; optional)"`
+	S3HedgeMin    time.Duration `flag:"s3-hedge-min-delay,default=$GOCACHE_S3_HEDGE_MIN_DELAY,Least delay before a second S3 read is sent (default 10ms)"`
+	S3UpRate      int64         `flag:"s3-upload-bandwidth,default=$GOCACHE_S3_UPLOAD_BANDWIDTH,Maximum rate of uploads to S3 (in bytes per second; optional)"`
+	S3DownRate    int64         `flag:"s3-download-bandwidth,default=$GOCACHE_S3_DOWNLOAD_BANDWIDTH,Maximum rate of downloads from S3 (in bytes per second; optional)"`
 	PrintMetrics  bool          `flag:"metrics,default=$GOCACHE_METRICS,Print summary metrics to stderr at exit"`
+	SummaryFile   string        `flag:"summary-file,default=$GOCACHE_SUMMARY_FILE,Write a JSON report of cache activity and health to this file at exit (optional)"`
+	SummaryOut    string        `flag:"summary-out,default=$GOCACHE_SUMMARY_OUT,Alias for --summary-file (deprecated)"`
+	PrintSummary  bool          `flag:"print-summary,default=$GOCACHE_PRINT_SUMMARY,Print a one-line summary of hits, misses, and transfers to stderr at exit"`
+	StatsUpload   bool          `flag:"stats-upload,default=$GOCACHE_STATS_UPLOAD,Upload a JSON summary of each run with CI metadata to S3 under <prefix>/stats/"`
+	StatsdAddr    string        `flag:"statsd-addr,default=$GOCACHE_STATSD_ADDR,Send metrics to a StatsD or DogStatsD agent at this UDP address ([host]:port; optional)"`
+	StatsdPrefix  string        `flag:"statsd-prefix,default=$GOCACHE_STATSD_PREFIX,Prefix of the metric names sent to --statsd-addr (default: gocache)"`
+	StatsdTags    string        `flag:"statsd-tags,default=$GOCACHE_STATSD_TAGS,DogStatsD tags sent with each metric (key:value,...; optional)"`
+	StatsdEvery   time.Duration `flag:"statsd-interval,default=$GOCACHE_STATSD_INTERVAL,How often to send metrics to --statsd-addr (default 10s)"`
+	EMFOutput     string        `flag:"emf-output,default=$GOCACHE_EMF_OUTPUT,Write CloudWatch Embedded Metric Format records to this file (- for stderr; optional)"`
+	EMFNamespace  string        `flag:"emf-namespace,default=$GOCACHE_EMF_NAMESPACE,CloudWatch namespace of the --emf-output metrics (default: GoCachePlugin)"`
+	EMFDimensions string        `flag:"emf-dimensions,default=$GOCACHE_EMF_DIMENSIONS,Extra CloudWatch dimensions of the --emf-output metrics (name=value,...; optional)"`
+	EMFEvery      time.Duration `flag:"emf-interval,default=$GOCACHE_EMF_INTERVAL,How often to write metrics to --emf-output (default 1m)"`
 	Expiration    time.Duration `flag:"expiry,default=$GOCACHE_EXPIRY,Cache expiration period (optional)"`
+	BuildExpiry   time.Duration `flag:"build-expiration,default=$GOCACHE_BUILD_EXPIRATION,Build cache expiration period (default: --expiry)"`
+	SpillPromote  time.Duration `flag:"spill-promote-window,default=$GOCACHE_SPILL_PROMOTE_WINDOW,Promote an entry of the slow --cache-dir tier used twice within this period (default 1h)"`
+	SpillDemote   time.Duration `flag:"spill-demote-age,default=$GOCACHE_SPILL_DEMOTE_AGE,Demote an entry of the fast --cache-dir tier not used within this period (default 1h)"`
+	Diskless      bool          `flag:"diskless,default=$GOCACHE_DISKLESS,Keep no local cache across runs: stage entries in a temporary directory removed at exit"`
+	MinFree       byteSize      `flag:"min-free-space,default=$GOCACHE_MIN_FREE_SPACE,Evict local build cache entries when the free space of --cache-dir falls below this (e.g., 2GiB; optional)"`
 	Verbose       bool          `flag:"v,default=$GOCACHE_VERBOSE,Enable verbose logging"`
 	DebugLog      int           `flag:"debug,default=$GOCACHE_DEBUG,Enable detailed per-request debug logging (noisy)"`
+	LogFormat     string        `flag:"log-format,default=$GOCACHE_LOG_FORMAT,Log output format (text or json)"`
+	LogLevel      string        `flag:"log-level,default=$GOCACHE_LOG_LEVEL,Minimum log level (debug, info, warn, error)"`
+	LocalKeyFile  string        `flag:"local-key-file,default=$GOCACHE_LOCAL_KEY_FILE,File holding a key to encrypt module and reverse proxy entries in --cache-dir (optional)"`
+	PluginKeyFile string        `flag:"plugin-key-file,default=$GOCACHE_PLUGIN_KEY_FILE,Shared key file for authenticating plugin connections (optional)"`
+	Peers         string        `flag:"peers,default=$GOCACHE_PEERS,Peer cache servers to query before S3 (comma-separated; optional)"`
+	PeerKeyFile   string        `flag:"peer-key-file,default=$GOCACHE_PEER_KEY_FILE,Shared key file for authenticating --peers (required with --peers)"`
+	Profile       string        `flag:"profile,default=$GOCACHE_PROFILE,Tuning profile (ci or dev)"`
+	Audit         string        `flag:"audit,default=$GOCACHE_AUDIT,Record cache hits to a build manifest at this path (optional)"`
+	Namespace     string        `flag:"namespace,default=$GOCACHE_NAMESPACE,Namespace of this build for --read-tiers (optional)"`
+	ReadTiers     string        `flag:"read-tiers,default=$GOCACHE_READ_TIERS,Build cache read tiers by namespace ([namespace=]tier,...;...)"`
+	Chain         string        `flag:"namespace-chain,default=$GOCACHE_NAMESPACE_CHAIN,Remote cache namespaces to read in order, writing the first (ns,...; optional)"`
+	MemorySize    byteSize      `flag:"memory-cache-size,default=$GOCACHE_MEMORY_CACHE_SIZE,Memory for recently used module proxy entries (e.g., 256MiB; optional)"`
+	MemoryLookups int           `flag:"memory-lookups,default=$GOCACHE_MEMORY_LOOKUPS,Number of recent build cache lookups to keep in memory (optional)"`
+	SlowLog       int           `flag:"slowlog,default=$GOCACHE_SLOWLOG,Number of slowest build cache requests to retain (0 means 64; negative disables)"`
 }
 
 const (
 	debugBuildCache = 1 << iota
 	debugModProxy
 	debugRevProxy
+	debugPyPI
+	debugNPM
+	debugActionsCache
+	debugBlobCache
+	debugGradleCache
 )
 
 // runDirect runs a cache communicating on stdin/stdout, for use as a direct
 // GOCACHEPROG plugin.
 func runDirect(env *command.Env) error {
-	s, _, err := initCacheServer(env)
+	s, cache, err := initCacheServer(env)
 	if err != nil {
 		return err
 	}
-	if err := s.Run(env.Context(), os.Stdin, os.Stdout); err != nil {
+	tiers, err := parseReadTiers(flags.ReadTiers)
+	if err != nil {
+		return env.Usagef("invalid --read-tiers: %v", err)
+	}
+	chain, err := gobuild.ParseNamespaceChain(flags.Chain)
+	if err != nil {
+		return env.Usagef("invalid --namespace-chain: %v", err)
+	}
+	publishConfig(tiers)
+	ctx := gobuild.WithReadPolicy(env.Context(), tiers.policy(flags.Namespace))
+	if len(chain) != 0 {
+		nc := new(gobuild.NamespaceChain)
+		nc.SetNames(chain)
+		ctx = gobuild.WithNamespaceChain(ctx, nc)
+	}
+	if flags.Audit != "" {
+		m, closeManifest, err := openManifest(flags.Audit)
+		if err != nil {
+			return err
+		}
+		defer closeManifest()
+		ctx = gobuild.WithManifest(ctx, m)
+	}
+	stopEMF, err := startEMF(ctx, cache)
+	if err != nil {
+		return err
+	}
+
+	// The go command closes the cache when it exits; finish replaying the
+	// journals of earlier plugins first.
+	var replays taskgroup.Group
+	replayJournals(ctx, cache, &replays)
+	cacheClose := s.Close
+	s.Close = func(ctx context.Context) error {
+		replays.Wait()
+		return cacheClose(ctx)
+	}
+
+	stopStatsd := startStatsd(ctx)
+	err = runClient(ctx, s, os.Stdin, os.Stdout)
+	stopStatsd()
+	stopEMF()
+	if err != nil {
 		return fmt.Errorf("cache server exited with error: %w", err)
 	}
 	if flags.Verbose || flags.PrintMetrics {
-		fmt.Fprintln(os.Stderr, s.Metrics())
+		m := s.Metrics()
+		m.Set("config", expvar.Get("gocache_config"))
+		fmt.Fprintln(os.Stderr, m)
 	}
 	return nil
 }
 
 var serveFlags struct {
-	Plugin   string `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service addr (or port) (required)"`
-	HTTP     string `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
-	ModProxy bool   `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http)"`
-	RevProxy string `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts (comma-separated; requires --http)"`
-	SumDB    string `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
+	Plugin     string `flag:"plugin,default=$GOCACHE_PLUGIN,Plugin service addr, port, or Unix socket path (required)"`
+	HTTP       string `flag:"http,default=$GOCACHE_HTTP,HTTP service address ([host]:port)"`
+	ModProxy   bool   `flag:"modproxy,default=$GOCACHE_MODPROXY,Enable a Go module proxy (requires --http or --modproxy-addr)"`
+	ModAddr    string `flag:"modproxy-addr,default=$GOCACHE_MODPROXY_ADDR,Serve the module proxy on its own address, without the /mod prefix ([host]:port; optional)"`
+	ModOffln   bool   `flag:"modproxy-offline,default=$GOCACHE_MODPROXY_OFFLINE,Serve only cached modules without contacting upstream (requires --modproxy)"`
+	ModScan    string `flag:"modproxy-scan,default=$GOCACHE_MODPROXY_SCAN,Scan fetched module zips for binaries and large files (flag or block; requires --modproxy)"`
+	ModScanN   int64  `flag:"modproxy-scan-size,default=$GOCACHE_MODPROXY_SCAN_SIZE,Largest file in a module zip not reported by --modproxy-scan (in bytes; default 10 MiB)"`
+	ModAllow   string `flag:"modproxy-scan-allow,default=$GOCACHE_MODPROXY_SCAN_ALLOW,Module path patterns not scanned by --modproxy-scan (GOPRIVATE syntax)"`
+	ModPermit  string `flag:"modproxy-allow,default=$GOCACHE_MODPROXY_ALLOW,Module path patterns the module proxy serves; others are refused (GOPRIVATE syntax; optional)"`
+	ModBlock   string `flag:"modproxy-block,default=$GOCACHE_MODPROXY_BLOCK,Module path patterns the module proxy refuses to serve (GOPRIVATE syntax; optional)"`
+	ModTempMax int64  `flag:"modproxy-temp-limit,default=$GOCACHE_MODPROXY_TEMP_LIMIT,Size of module fetch temporary files beyond which fetches are refused (in bytes; optional)"`
+	RevProxy   string `flag:"revproxy,default=$GOCACHE_REVPROXY,Reverse proxy these hosts or *.domain patterns (comma-separated; requires --http)"`
+	SumDB      string `flag:"sumdb,default=$GOCACHE_SUMDB,SumDB servers to proxy for (comma-separated)"`
+	SumVerify  bool   `flag:"sumdb-verify,default=$GOCACHE_SUMDB_VERIFY,Verify sum DB proofs locally and cache its tiles in S3 (requires --modproxy)"`
+	SumKey     string `flag:"sumdb-key,default=$GOCACHE_SUMDB_KEY,Verifier key of the sum DB for --sumdb-verify (default: sum.golang.org)"`
+
+	RevStale      bool          `flag:"revproxy-serve-stale-on-error,default=$GOCACHE_REVPROXY_SERVE_STALE,Serve expired reverse proxy responses when the origin fails"`
+	RevStaleWait  time.Duration `flag:"revproxy-stale-timeout,default=$GOCACHE_REVPROXY_STALE_TIMEOUT,How long to wait for the origin before serving a stale response (optional)"`
+	RevRules      string        `flag:"revproxy-rules,default=$GOCACHE_REVPROXY_RULES,Reverse proxy cache policy rules file (JSON; optional; see help reverse-proxy)"`
+	RevMirror     string        `flag:"revproxy-mirror,default=$GOCACHE_REVPROXY_MIRROR,Mirror origins for shadow traffic ([host=]url,...; optional)"`
+	RevValidate   string        `flag:"revproxy-validate,default=$GOCACHE_REVPROXY_VALIDATE,Endpoint URL for shadow traffic reports (optional)"`
+	RevMirrorRate float64       `flag:"revproxy-mirror-rate,default=$GOCACHE_REVPROXY_MIRROR_RATE,Fraction of forwarded requests to mirror (0 means all)"`
+
+	RevCAFile     string        `flag:"revproxy-ca-file,default=$GOCACHE_REVPROXY_CA_FILE,Reverse proxy CA certificate file (created if missing; optional)"`
+	RevCAKey      string        `flag:"revproxy-ca-key,default=$GOCACHE_REVPROXY_CA_KEY,Reverse proxy CA private key file (default: --revproxy-ca-file)"`
+	RevCAValidity time.Duration `flag:"revproxy-ca-validity,default=$GOCACHE_REVPROXY_CA_VALIDITY,Validity period of a generated --revproxy-ca-file (default 1 year)"`
+
+	PyPI         bool   `flag:"pypi,default=$GOCACHE_PYPI,Enable a Python package index proxy (requires --http)"`
+	PyPIUpstream string `flag:"pypi-upstream,default=$GOCACHE_PYPI_UPSTREAM,Upstream simple index URL for --pypi"`
+
+	NPM         bool   `flag:"npm,default=$GOCACHE_NPM,Enable an npm registry proxy (requires --http)"`
+	NPMUpstream string `flag:"npm-upstream,default=$GOCACHE_NPM_UPSTREAM,Upstream registry URL for --npm"`
+
+	ActionsCache  bool   `flag:"actions-cache,default=$GOCACHE_ACTIONS_CACHE,Enable a GitHub Actions cache service (requires --http)"`
+	ActionsSecret string `json:"-" flag:"actions-cache-secret,default=$GOCACHE_ACTIONS_CACHE_SECRET,Secret to verify runtime tokens for --actions-cache"`
+
+	BlobCache   bool          `flag:"blob-cache,default=$GOCACHE_BLOB_CACHE,Enable a ccache/sccache blob store (requires --http)"`
+	BlobMaxSize int64         `flag:"blob-max-size,default=$GOCACHE_BLOB_MAX_SIZE,Largest blob accepted by --blob-cache (in bytes; 0 means no limit)"`
+	BlobExpiry  time.Duration `flag:"blob-expiration,default=$GOCACHE_BLOB_EXPIRATION,Blob store local cache expiration period (optional)"`
+	BlobToken   string        `json:"-" flag:"blob-token,default=$GOCACHE_BLOB_TOKEN,Token required to write to --blob-cache (read-only if unset)"`
+
+	GradleCache    bool          `flag:"gradle-cache,default=$GOCACHE_GRADLE_CACHE,Enable a Gradle remote build cache (requires --http)"`
+	GradleExpiry   time.Duration `flag:"gradle-expiration,default=$GOCACHE_GRADLE_EXPIRATION,Gradle build cache local expiration period (optional)"`
+	GradleUser     string        `flag:"gradle-user,default=$GOCACHE_GRADLE_USER,Basic-auth user name required to write to --gradle-cache"`
+	GradlePassword string        `json:"-" flag:"gradle-password,default=$GOCACHE_GRADLE_PASSWORD,Basic-auth password required to write to --gradle-cache (read-only if unset)"`
+
+	SBOMLog       string        `flag:"sbom-log,default=$GOCACHE_SBOM_LOG,Record components served by the proxies to this file (optional)"`
+	SBOMRetention time.Duration `flag:"sbom-retention,default=$GOCACHE_SBOM_RETENTION,How long to keep --sbom-log records (default 30 days)"`
+
+	AuditLog  string `flag:"audit-log,default=$GOCACHE_AUDIT_LOG,Record modules downloaded, URLs proxied, and actions written to hourly files in this directory (optional)"`
+	AuditShip bool   `flag:"audit-log-s3,default=$GOCACHE_AUDIT_LOG_S3,Ship the --audit-log files to S3 every hour"`
+
+	ModExpiry time.Duration `flag:"mod-expiration,default=$GOCACHE_MOD_EXPIRATION,Module proxy local cache expiration period (optional)"`
+	RevExpiry time.Duration `flag:"revproxy-expiration,default=$GOCACHE_REVPROXY_EXPIRATION,Reverse proxy local cache expiration period (optional)"`
+
+	Summary time.Duration `flag:"summary-interval,default=$GOCACHE_SUMMARY_INTERVAL,Log a summary of build cache hits and misses this often (optional)"`
+
+	NoCacheHeaders bool `flag:"no-cache-headers,default=$GOCACHE_NO_CACHE_HEADERS,Omit cache status headers (X-Cache, Age) from proxy responses"`
+
+	AdminGRPC  string `flag:"admin-grpc,default=$GOCACHE_ADMIN_GRPC,Admin gRPC service address ([host]:port; requires --admin-token)"`
+	AdminToken string `json:"-" flag:"admin-token,default=$GOCACHE_ADMIN_TOKEN,Bearer token required for admin requests (optional)"`
+
+	DeferUploads bool `flag:"defer-uploads,default=$GOCACHE_DEFER_UPLOADS,Hold uploads to S3 until committed by the admin API (requires --admin-token)"`
+
+	StandbyLock string `flag:"standby-lock,default=$GOCACHE_STANDBY_LOCK,Lock file for an active/standby server pair (optional)"`
+	HandoffDir  string `flag:"handoff-dir,default=$GOCACHE_HANDOFF_DIR,Directory for state handoff between active and standby servers (optional)"`
+
+	GoProxy   string `flag:"goproxy,default=$GOCACHE_GOPROXY,Upstream module proxy URLs for --modproxy (GOPROXY syntax)"`
+	GoNetrc   string `flag:"goproxy-netrc,default=$GOCACHE_GOPROXY_NETRC,Netrc file with credentials for upstream module proxies"`
+	GoPrivate string `flag:"goproxy-private,default=$GOCACHE_GOPROXY_PRIVATE,Module path patterns to fetch directly (GOPRIVATE syntax)"`
 }
 
 func noopClose(context.Context) error { return nil }
@@ -79,62 +287,181 @@ func runServe(env *command.Env) error {
 
 	// Initialize the cache server. Unlike a direct server, only close down and
 	// wait for cache cleanup when the whole process exits.
-	s, s3c, err := initCacheServer(env)
+	s, cache, err := initCacheServer(env)
 	if err != nil {
 		return err
 	}
+	s3c := cache.S3Client
 	closeHook := s.Close
 	s.Close = noopClose
 
-	pluginAddr := serveFlags.Plugin
-	if !strings.Contains(pluginAddr, ":") {
-		pluginAddr = fmt.Sprintf("127.0.0.1:%s", serveFlags.Plugin)
+	pluginKey, err := loadPluginKey()
+	if err != nil {
+		return err
+	}
+	tiers, err := parseReadTiers(flags.ReadTiers)
+	if err != nil {
+		return env.Usagef("invalid --read-tiers: %v", err)
+	}
+	publishConfig(tiers)
+	if serveFlags.AdminGRPC != "" && serveFlags.AdminToken == "" {
+		return env.Usagef("--admin-grpc requires --admin-token")
+	}
+	if serveFlags.DeferUploads {
+		if serveFlags.AdminToken == "" {
+			return env.Usagef("--defer-uploads requires --admin-token")
+		}
+		deferred = new(gobuild.Deferral)
 	}
 
-	// Listen for connections from the Go toolchain on the specified socket.
-	lst, err := net.Listen("tcp", pluginAddr)
+	network, pluginAddr, err := pluginNetwork(serveFlags.Plugin, "127.0.0.1")
 	if err != nil {
-		return fmt.Errorf("listen: %w", err)
+		return env.Usagef("invalid --plugin: %v", err)
 	}
-	log.Printf("plugin listening at %q", lst.Addr())
 
 	ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// In a standby pair, wait until the active server releases the lock.
+	releaseLock, err := initStandby(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseLock()
+
+	// Listen for connections from the Go toolchain on the specified socket.
+	lst, err := listenPlugin(network, pluginAddr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	slog.Info("plugin listening", "network", network, "addr", lst.Addr().String())
+
+	defer startStatsd(ctx)()
+	stopEMF, err := startEMF(ctx, cache)
+	if err != nil {
+		lst.Close()
+		return err
+	}
+	defer stopEMF()
+
 	var g taskgroup.Group
+	resumeHandoff(ctx, cache, &g)
+	replayJournals(ctx, cache, &g)
+	startSummary(ctx, &g, cache, serveFlags.Summary)
 	g.Run(func() {
 		<-ctx.Done()
-		log.Printf("closing plugin listener")
+		slog.Info("closing plugin listener")
 		lst.Close()
 	})
 
+	// If components served by the proxies are to be recorded, open the log.
+	sbomLog, sbomCleanup, err := initSBOMLog()
+	if err != nil {
+		lst.Close()
+		return err
+	}
+	defer sbomCleanup()
+
+	// If activity is to be audited, open the audit log.
+	auditCleanup, err := initAuditLog(ctx, env, s3c, &g)
+	if err != nil {
+		lst.Close()
+		return err
+	}
+	defer auditCleanup()
+
 	// If a module proxy is enabled, start it.
-	modProxy, modCleanup, err := initModProxy(env.SetContext(ctx), s3c)
+	modProxy, modCleanup, err := initModProxy(env.SetContext(ctx), s3c, sbomLog, &g)
 	if err != nil {
 		lst.Close()
 		return fmt.Errorf("module proxy: %w", err)
 	}
 	defer modCleanup()
 
+	if modProxy != nil {
+		startExpiry(ctx, &g, "module", filepath.Join(flags.CacheDir, "module"), serveFlags.ModExpiry)
+		if serveFlags.ModAddr != "" {
+			serveModProxy(ctx, &g, serveFlags.ModAddr, modProxy)
+			modProxy = nil // not also served by --http
+		} else {
+			modProxy = http.StripPrefix("/mod", modProxy)
+		}
+	}
+
+	// If a PyPI proxy is enabled, start it.
+	pypiProxy, pypiCleanup, err := initPyPIProxy(env.SetContext(ctx), s3c)
+	if err != nil {
+		lst.Close()
+		return fmt.Errorf("pypi proxy: %w", err)
+	}
+	defer pypiCleanup()
+
+	// If an npm proxy is enabled, start it.
+	npmProxy, npmCleanup, err := initNPMProxy(env.SetContext(ctx), s3c)
+	if err != nil {
+		lst.Close()
+		return fmt.Errorf("npm proxy: %w", err)
+	}
+	defer npmCleanup()
+
+	// If a GitHub Actions cache service is enabled, start it.
+	actionsCache, actionsCleanup, err := initActionsCache(env.SetContext(ctx), s3c)
+	if err != nil {
+		lst.Close()
+		return fmt.Errorf("actions cache: %w", err)
+	}
+	defer actionsCleanup()
+
+	// If a blob store for compiler caches is enabled, start it.
+	blobCache, blobCleanup, err := initBlobCache(env.SetContext(ctx), s3c)
+	if err != nil {
+		lst.Close()
+		return fmt.Errorf("blob cache: %w", err)
+	}
+	defer blobCleanup()
+	if blobCache != nil {
+		startExpiry(ctx, &g, "blob", filepath.Join(flags.CacheDir, "blob"), serveFlags.BlobExpiry)
+	}
+
+	// If a Gradle remote build cache is enabled, start it.
+	gradleCache, gradleCleanup, err := initGradleCache(env.SetContext(ctx), s3c)
+	if err != nil {
+		lst.Close()
+		return fmt.Errorf("gradle cache: %w", err)
+	}
+	defer gradleCleanup()
+	if gradleCache != nil {
+		startExpiry(ctx, &g, "gradle", filepath.Join(flags.CacheDir, "gradle"), serveFlags.GradleExpiry)
+	}
+
 	// If a reverse proxy is enabled, start it.
-	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, &g)
+	revProxy, err := initRevProxy(env.SetContext(ctx), s3c, sbomLog, &g)
 	if err != nil {
 		lst.Close()
 		return fmt.Errorf("reverse proxy: %w", err)
 	}
+	if revProxy != nil {
+		startExpiry(ctx, &g, "revproxy", filepath.Join(flags.CacheDir, "revproxy"), serveFlags.RevExpiry)
+	}
+
+	// If an admin gRPC service is enabled, start it.
+	if err := initAdminGRPC(env.SetContext(ctx), cache, sbomLog, &g); err != nil {
+		lst.Close()
+		return fmt.Errorf("admin service: %w", err)
+	}
 
 	// If an HTTP server is enabled, start it up with debug routes
 	// and whatever other services were requested.
 	if serveFlags.HTTP != "" {
 		srv := &http.Server{
 			Addr:    serveFlags.HTTP,
-			Handler: makeHandler(modProxy, revProxy),
+			Handler: makeHandler(modProxy, pypiProxy, npmProxy, actionsCache, blobCache, gradleCache, revProxy, initAdminHTTP(cache, sbomLog), initPeerHTTP(cache), cache.SlowLog),
 		}
 		g.Go(srv.ListenAndServe)
-		vprintf("HTTP server listening at %q", serveFlags.HTTP)
+		slog.Debug("HTTP server listening", "addr", serveFlags.HTTP)
 		g.Run(func() {
 			<-ctx.Done()
-			vprintf("stopping HTTP service")
+			slog.Debug("stopping HTTP service")
 			srv.Shutdown(context.Background())
 		})
 	}
@@ -143,25 +470,93 @@ func runServe(env *command.Env) error {
 		conn, err := lst.Accept()
 		if err != nil {
 			if !errors.Is(err, net.ErrClosed) {
-				log.Printf("accept failed: %v, exiting server loop", err)
+				slog.Error("accept failed, exiting server loop", "err", err)
 			}
 			break
 		}
-		log.Printf("new client connection")
+		slog.Info("new client connection", "client", conn.RemoteAddr().String())
 		g.Go(func() error {
+			// Count the uploads for this connection, which is one build.
+			// The server does not wait for uploads when a build ends, so
+			// those still in progress then are not reported.
+			stats := new(gobuild.UploadStats)
 			defer func() {
-				log.Printf("client connection closed")
+				c := stats.Counts()
+				slog.Info("client connection closed", "client", conn.RemoteAddr().String(),
+					"uploaded", c.Uploaded, "uploaded_bytes", c.UploadedBytes,
+					"found", c.Found, "found_bytes", c.FoundBytes, "dedup_ratio", c.DedupRatio())
 				conn.Close()
 			}()
-			return s.Run(ctx, conn, conn)
+			var rw io.ReadWriter = conn
+			if pluginKey != nil {
+				hc, err := hmacconn.Server(conn, pluginKey)
+				if err != nil {
+					slog.Warn("client error", "client", conn.RemoteAddr().String(), "err", err)
+					return nil
+				}
+				rw = hc
+			}
+
+			// The read tiers and namespace chain depend on the build, which
+			// the client may describe ahead of its first request.
+			policy := tiers.policy("")
+			chain := new(gobuild.NamespaceChain)
+			requester := &auditlog.Requester{Client: conn.RemoteAddr().String(), Auth: pluginKey != nil}
+			rw = newNamespaceConn(rw, func(pre clientPreamble) {
+				tiers.apply(policy, pre.Namespace)
+				chain.SetNames(pre.Chain)
+				requester.SetUser(pre.Namespace)
+			})
+			ctx := gobuild.WithUploadStats(ctx, stats)
+			ctx = gobuild.WithReadPolicy(ctx, policy)
+			ctx = gobuild.WithNamespaceChain(ctx, chain)
+			if deferred != nil {
+				ctx = gobuild.WithDeferral(ctx, deferred)
+			}
+			if auditLog != nil {
+				ctx = auditlog.NewContext(ctx, auditLog, requester)
+			}
+			if flags.Audit != "" {
+				m, closeManifest, err := openManifest(connManifestPath())
+				if err != nil {
+					slog.Warn("client error", "client", conn.RemoteAddr().String(), "err", err)
+					return nil
+				}
+				defer closeManifest()
+				ctx = gobuild.WithManifest(ctx, m)
+			}
+			err := runClient(ctx, s, rw, rw)
+			if errors.Is(err, hmacconn.ErrAuth) {
+				slog.Warn("client error", "client", conn.RemoteAddr().String(), "err", err)
+				return nil
+			}
+			return err
 		})
 	}
-	log.Printf("server loop exited, waiting for client exit")
+	slog.Info("server loop exited, waiting for client exit")
 	g.Wait()
+	if deferred != nil {
+		if n := deferred.Discard(); n != 0 {
+			slog.Warn("discarded uncommitted deferred uploads", "actions", n)
+		}
+	}
+
+	// Hand off to a standby server, if there is one, before waiting for our
+	// own uploads to complete.
+	if err := saveHandoff(cache); err != nil {
+		slog.Warn("save handoff failed", "err", err)
+	}
+	releaseLock()
+
 	if closeHook != nil {
-		ctx := gocache.WithLogf(context.Background(), log.Printf)
+		ctx := gocache.WithLogf(context.Background(), printfLogger(slog.Default(), slog.LevelInfo))
+		if flags.Profile == "dev" {
+			// The dev profile does not wait for uploads when a build ends,
+			// but the server can let them finish before it exits.
+			cache.Close(ctx)
+		}
 		if err := closeHook(ctx); err != nil {
-			log.Printf("server close: %v (ignored)", err)
+			slog.Warn("server close failed (ignored)", "err", err)
 		}
 	}
 	return nil
@@ -169,38 +564,164 @@ func runServe(env *command.Env) error {
 
 // runConnect implements a direct cache proxy by connecting to a remote server.
 func runConnect(env *command.Env, plugin string) error {
-	addr := plugin
-
-	// If the caller has not specified a host/port, then likely this is an older usage which only specifies port
-	if !strings.Contains(plugin, ":") {
-		port, err := strconv.Atoi(plugin)
-		if err != nil {
-			return fmt.Errorf("invalid plugin port: %w", err)
-		}
+	network, addr, err := pluginNetwork(plugin, "")
+	if err != nil {
+		return err
+	}
+	chain, err := gobuild.ParseNamespaceChain(flags.Chain)
+	if err != nil {
+		return env.Usagef("invalid --namespace-chain: %v", err)
+	}
 
-		addr = fmt.Sprintf(":%d", port)
+	pluginKey, err := loadPluginKey()
+	if err != nil {
+		return err
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 	start := time.Now()
-	vprintf("connected to %q", conn.RemoteAddr())
+	slog.Debug("connected", "addr", conn.RemoteAddr().String())
+
+	var rw halfCloser = conn.(halfCloser) // a TCP or Unix connection
+	if pluginKey != nil {
+		hc, err := hmacconn.Client(conn, pluginKey)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		rw = hc
+	}
+	if flags.Namespace != "" {
+		if err := writeNamespace(rw, flags.Namespace); err != nil {
+			conn.Close()
+			return fmt.Errorf("send namespace: %w", err)
+		}
+	}
+	if len(chain) != 0 {
+		if err := writeChain(rw, chain); err != nil {
+			conn.Close()
+			return fmt.Errorf("send namespace chain: %w", err)
+		}
+	}
 
 	out := taskgroup.Go(func() error {
-		defer conn.(*net.TCPConn).CloseWrite() // let the server finish
-		return copy(conn, os.Stdin)
+		defer rw.CloseWrite() // let the server finish
+		return copy(rw, os.Stdin)
 	})
-	if rerr := copy(os.Stdout, conn); rerr != nil {
-		vprintf("read responses: %v", err)
+	if rerr := copy(os.Stdout, rw); rerr != nil {
+		slog.Debug("read responses", "err", rerr)
 	}
 	out.Wait()
 	conn.Close()
-	vprintf("connection closed (%v elapsed)", time.Since(start))
+	slog.Debug("connection closed", "elapsed", time.Since(start))
 	return nil
 }
 
+// halfCloser is a bidirectional stream whose write side can be closed
+// separately, e.g., [net.TCPConn].
+type halfCloser interface {
+	io.ReadWriter
+	CloseWrite() error
+}
+
+// pluginNetwork reports the network and address of a plugin service address,
+// as given to --plugin or to the connect command. An address with the prefix
+// "unix:", or that contains a slash (or on Windows, a backslash), is the path
+// of a Unix-domain socket. An address with no colon is a TCP port on host (for
+// the connect command, older usage gives only a port). Otherwise, it is a TCP
+// host:port.
+func pluginNetwork(addr, host string) (network, address string, _ error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path, nil
+	} else if strings.Contains(addr, "/") || strings.ContainsRune(addr, filepath.Separator) {
+		return "unix", addr, nil
+	} else if strings.Contains(addr, ":") {
+		return "tcp", addr, nil
+	}
+	if _, err := strconv.Atoi(addr); err != nil {
+		return "", "", fmt.Errorf("invalid plugin port: %w", err)
+	}
+	return "tcp", net.JoinHostPort(host, addr), nil
+}
+
+// listenPlugin listens for plugin connections at addr on the given network.
+// For a Unix-domain socket, a stale socket file left by a server that did not
+// exit cleanly is removed first; the listener removes the file when closed.
+func listenPlugin(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			if c, err := net.Dial("unix", addr); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("socket %q is in use by another server", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// loadPluginKey reads the shared key for authenticating plugin connections
+// from the --plugin-key-file, if one is set. If not, it returns nil without
+// error. Leading and trailing whitespace in the file is ignored.
+func loadPluginKey() ([]byte, error) {
+	if flags.PluginKeyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(flags.PluginKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read plugin key: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("plugin key file %q is empty", flags.PluginKeyFile)
+	}
+	return key, nil
+}
+
+// loadPeerKey reads the shared key for authenticating requests between peers
+// from the --peer-key-file. Leading and trailing whitespace in the file is
+// ignored.
+func loadPeerKey() ([]byte, error) {
+	data, err := os.ReadFile(flags.PeerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read peer key: %w", err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("peer key file %q is empty", flags.PeerKeyFile)
+	}
+	return key, nil
+}
+
+// localKeyEnv is the environment variable that may hold the key to encrypt
+// entries in the --cache-dir, in place of the --local-key-file.
+const localKeyEnv = "GOCACHE_LOCAL_KEY"
+
+// loadLocalKey loads the key to encrypt entries in the --cache-dir from the
+// --local-key-file, or else from $GOCACHE_LOCAL_KEY. It returns nil if
+// neither is set.
+func loadLocalKey() (*atrest.Key, error) {
+	text, src := os.Getenv(localKeyEnv), "$"+localKeyEnv
+	if flags.LocalKeyFile != "" {
+		data, err := os.ReadFile(flags.LocalKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read local key: %w", err)
+		}
+		text, src = string(data), flags.LocalKeyFile
+	}
+	if text == "" {
+		return nil, nil
+	}
+	key, err := atrest.ParseKey(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local key in %s: %w", src, err)
+	}
+	return key, nil
+}
+
 // copy emulates the base case of io.Copy, but does not attempt to use the
 // io.ReaderFrom or io.WriterTo implementations.
 //
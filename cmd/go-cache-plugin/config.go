@@ -0,0 +1,76 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// configInfo describes the effective configuration of the build cache, which
+// determines what entries a plugin stores and reads.
+type configInfo struct {
+	Generation string   `json:"generation"`
+	Prefix     string   `json:"prefix"`
+	GoVersion  string   `json:"go_version"`
+	Namespaces []string `json:"namespaces"`
+	Chain      []string `json:"namespace_chain,omitempty"`
+	ReadFrom   []string `json:"read_prefixes,omitempty"`
+}
+
+// newConfigInfo returns the effective configuration of the build cache, given
+// the --read-tiers configuration, and the --read-prefixes, --namespace-chain,
+// and --canary-* settings, if any. The generation is a hash of the rest, so
+// that plugins with the same configuration report the same generation.
+func newConfigInfo(tiers readTierConfig) configInfo {
+	ci := configInfo{
+		Prefix:     flags.KeyPrefix,
+		ReadFrom:   readPrefixes,
+		GoVersion:  runtime.Version(),
+		Namespaces: slices.Sorted(maps.Keys(tiers)),
+	}
+	if flags.Namespace != "" && !slices.Contains(ci.Namespaces, flags.Namespace) {
+		ci.Namespaces = append(ci.Namespaces, flags.Namespace)
+		slices.Sort(ci.Namespaces)
+	}
+	ci.Chain, _ = gobuild.ParseNamespaceChain(flags.Chain) // checked by the caller
+
+	h := sha256.New()
+	fmt.Fprintf(h, "prefix %q\ntransform %q\ngo %q\n", ci.Prefix, flags.KeyTransform, ci.GoVersion)
+	for _, ns := range ci.Namespaces {
+		fmt.Fprintf(h, "namespace %q %q\n", ns, strings.Join(tiers[ns], ","))
+	}
+	if len(ci.ReadFrom) != 0 {
+		fmt.Fprintf(h, "read %q\n", strings.Join(ci.ReadFrom, ","))
+	}
+	if len(ci.Chain) != 0 {
+		fmt.Fprintf(h, "chain %q\n", strings.Join(ci.Chain, ","))
+	}
+	if flags.CanaryRate > 0 {
+		fmt.Fprintf(h, "canary %v %q %q %q\n", flags.CanaryRate, flags.CanaryCodec, flags.CanaryKeys, flags.CanaryPrefix)
+	}
+	ci.Generation = fmt.Sprintf("%x", h.Sum(nil))[:12]
+	return ci
+}
+
+// cacheConfig is the effective configuration set by publishConfig.
+var cacheConfig configInfo
+
+// publishConfig publishes the effective configuration as metrics, so that
+// dashboards can segment the metrics of a fleet by configuration generation.
+// The "gocache_config" metric reports the configuration, and the generation
+// alone is reported as "gocache_config_version", which /debug/varz exports as
+// a label of a Prometheus info metric.
+func publishConfig(tiers readTierConfig) {
+	cacheConfig = newConfigInfo(tiers)
+	expvar.Publish("gocache_config", expvar.Func(func() any { return cacheConfig }))
+	expvar.Publish("gocache_config_version", expvar.Func(func() any { return cacheConfig.Generation }))
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/dirindex"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var duFlags struct {
+	S3   bool `flag:"s3,Report usage of the S3 bucket under the --prefix instead of the --cache-dir"`
+	Top  int  `flag:"top,default=5,Number of largest entries to report for each subsystem"`
+	JSON bool `flag:"json,Print the usage as JSON"`
+}
+
+// cacheAreas maps the first component of a path in the --cache-dir, or of a
+// key under the --prefix, to the subsystem that stores it. Components not
+// listed here are the names of their subsystems.
+var cacheAreas = map[string]string{
+	"action": "build",
+	"output": "build",
+	"test":   "build",
+	"modtmp": "module",
+}
+
+// cacheArea returns the name of the subsystem that stores the file or object
+// at rel, a slash-separated path relative to the --cache-dir or --prefix.
+// Files at the top level belong to no subsystem, and are reported as "other".
+func cacheArea(rel string) string {
+	first, _, ok := strings.Cut(rel, "/")
+	if area, known := cacheAreas[first]; known {
+		return area
+	} else if !ok {
+		return "other"
+	}
+	return first
+}
+
+// duAges are the upper bounds of the age ranges reported by du.
+var duAges = []struct {
+	label string
+	max   time.Duration
+}{
+	{"<1h", time.Hour},
+	{"<1d", 24 * time.Hour},
+	{"<7d", 7 * 24 * time.Hour},
+	{"<30d", 30 * 24 * time.Hour},
+	{">30d", 1<<63 - 1},
+}
+
+// duEntry is a single file or object reported by du.
+type duEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// duUsage is the usage of one subsystem.
+type duUsage struct {
+	Name    string           `json:"name"`
+	Entries int64            `json:"entries"`
+	Bytes   int64            `json:"bytes"`
+	Ages    map[string]int64 `json:"ages"` // entries by age range
+	Largest []duEntry        `json:"largest"`
+}
+
+// add records e in u, keeping at most top of the largest entries.
+func (u *duUsage) add(e duEntry, now time.Time, top int) {
+	u.Entries++
+	u.Bytes += e.Size
+	age := now.Sub(e.ModTime)
+	for _, a := range duAges {
+		if age < a.max {
+			u.Ages[a.label]++
+			break
+		}
+	}
+	if top <= 0 {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(u.Largest, e, func(a, b duEntry) int { return cmp.Compare(b.Size, a.Size) })
+	if i < top {
+		u.Largest = slices.Insert(u.Largest, i, e)
+		if len(u.Largest) > top {
+			u.Largest = u.Largest[:top]
+		}
+	}
+}
+
+// runDU reports the disk usage of the local cache directory, or with --s3,
+// the storage used in the bucket, broken down by subsystem.
+func runDU(env *command.Env) error {
+	now := time.Now()
+	usage := make(map[string]*duUsage)
+	add := func(rel string, e duEntry) {
+		name := cacheArea(rel)
+		u, ok := usage[name]
+		if !ok {
+			u = &duUsage{Name: name, Ages: make(map[string]int64)}
+			usage[name] = u
+		}
+		u.add(e, now, duFlags.Top)
+	}
+
+	if duFlags.S3 {
+		client, err := initS3Client(env)
+		if err != nil {
+			return err
+		}
+		dir := keyPrefixDir()
+		if err := client.List(env.Context(), dir, func(obj s3util.ObjectInfo) error {
+			add(strings.TrimPrefix(obj.Key, dir), duEntry{Path: obj.Key, Size: obj.Size, ModTime: obj.ModTime})
+			return nil
+		}); err != nil {
+			return fmt.Errorf("list bucket: %w", err)
+		}
+	} else {
+		if flags.CacheDir == "" {
+			return env.Usagef("you must provide a --cache-dir")
+		}
+		idx := cacheIndex("all", flags.CacheDir)
+		idx.Skip = func(rel string) bool { return rel == indexDir }
+		if _, err := idx.Walk(func(e dirindex.Entry) error {
+			path := filepath.Join(flags.CacheDir, filepath.FromSlash(e.Path))
+			add(e.Path, duEntry{Path: path, Size: e.Size, ModTime: e.ModTime})
+			return nil
+		}); err != nil {
+			return fmt.Errorf("scan cache directory: %w", err)
+		}
+	}
+
+	all := slices.SortedFunc(maps.Values(usage), func(a, b *duUsage) int {
+		return cmp.Compare(b.Bytes, a.Bytes)
+	})
+	if duFlags.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(all)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "SUBSYSTEM\tENTRIES\tBYTES")
+	for _, a := range duAges {
+		fmt.Fprintf(tw, "\t%s", strings.ToUpper(a.label))
+	}
+	fmt.Fprintln(tw)
+	var total duUsage
+	for _, u := range all {
+		fmt.Fprintf(tw, "%s\t%d\t%s", u.Name, u.Entries, formatBytes(u.Bytes))
+		for _, a := range duAges {
+			fmt.Fprintf(tw, "\t%d", u.Ages[a.label])
+		}
+		fmt.Fprintln(tw)
+		total.Entries += u.Entries
+		total.Bytes += u.Bytes
+	}
+	fmt.Fprintf(tw, "total\t%d\t%s\n", total.Entries, formatBytes(total.Bytes))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, u := range all {
+		if len(u.Largest) == 0 {
+			continue
+		}
+		fmt.Printf("\nLargest %s entries:\n", u.Name)
+		for _, e := range u.Largest {
+			fmt.Printf("  %10s  %s  %s\n", formatBytes(e.Size), e.ModTime.Format(time.RFC3339), e.Path)
+		}
+	}
+	return nil
+}
+
+// formatBytes renders n as a human-readable size in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
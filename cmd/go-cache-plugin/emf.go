@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/emf"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// emfCounters are the build cache counters reported in EMF, by metric name,
+// as the sums of the named metrics of the "gocache_host" map.
+var emfCounters = []struct {
+	name, unit string
+	vars       []string
+}{
+	{"S3GetRequests", emf.Count, []string{"get_fault_hit", "get_fault_miss"}},
+	{"S3PutRequests", emf.Count, []string{"put_s3_action", "put_s3_object"}},
+	{"S3PutErrors", emf.Count, []string{"put_s3_error"}},
+	{"UploadBytes", emf.Bytes, []string{"put_s3_object_bytes"}},
+}
+
+// startEMF starts writing build cache metrics in the CloudWatch Embedded
+// Metric Format to the --emf-output, if it is set, until ctx ends. The caller
+// must call stop before exiting, which writes the metrics for the final
+// interval.
+func startEMF(ctx context.Context, cache *gobuild.S3Cache) (stop func(), _ error) {
+	if flags.EMFOutput == "" {
+		return noop, nil
+	}
+	var out io.Writer = os.Stderr
+	closeOut := noop
+	if flags.EMFOutput != "-" {
+		f, err := os.OpenFile(flags.EMFOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open EMF output: %w", err)
+		}
+		out, closeOut = f, func() { f.Close() }
+	}
+	w := &emf.Writer{
+		W:          out,
+		Namespace:  cmp.Or(flags.EMFNamespace, "GoCachePlugin"),
+		Dimensions: map[string]string{"Bucket": flags.S3Bucket},
+	}
+	if flags.EMFDimensions != "" {
+		for _, kv := range strings.Split(flags.EMFDimensions, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				closeOut()
+				return nil, fmt.Errorf("invalid --emf-dimensions entry %q (want name=value)", kv)
+			}
+			w.Dimensions[k] = v
+		}
+	}
+	host, _ := expvar.Get("gocache_host").(*expvar.Map)
+
+	// sample returns the current values of the counters in emfCounters.
+	sample := func() []int64 {
+		vs := make([]int64, len(emfCounters))
+		for i, c := range emfCounters {
+			for _, name := range c.vars {
+				if v, ok := host.Get(name).(*expvar.Int); ok {
+					vs[i] += v.Value()
+				}
+			}
+		}
+		return vs
+	}
+	lastGet, lastVals := cache.GetStats(), sample()
+	flush := func() {
+		curGet, curVals := cache.GetStats(), sample()
+		d := curGet.Sub(lastGet)
+		ms := []emf.Metric{
+			{Name: "CacheRequests", Unit: emf.Count, Value: float64(d.Total())},
+			{Name: "CacheHits", Unit: emf.Count, Value: float64(d.Hits)},
+		}
+		if d.Total() != 0 {
+			ms = append(ms, emf.Metric{Name: "CacheHitRatio", Unit: emf.Percent, Value: 100 * d.HitRatio()})
+		}
+		for i, c := range emfCounters {
+			ms = append(ms, emf.Metric{Name: c.name, Unit: c.unit, Value: float64(curVals[i] - lastVals[i])})
+		}
+		lastGet, lastVals = curGet, curVals
+		if err := w.Write(time.Now(), ms); err != nil {
+			slog.Warn("write EMF metrics failed", "err", err)
+		}
+	}
+
+	slog.Debug("writing EMF metrics", "output", flags.EMFOutput, "namespace", w.Namespace, "dimensions", w.Dimensions)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer closeOut()
+		t := time.NewTicker(cmp.Or(flags.EMFEvery, time.Minute))
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				flush()
+				return
+			case <-t.C:
+				flush()
+			}
+		}
+	}()
+	return func() { cancel(); <-done }, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/dirindex"
+)
+
+// indexDir is the directory in the --cache-dir holding the indexes of the
+// cache directories, which let expiry and du skip directories that have not
+// changed since their last pass.
+const indexDir = "dirindex"
+
+// cacheIndex returns the index of the directory at root, stored under the
+// given name in the --cache-dir.
+func cacheIndex(name, root string) *dirindex.Index {
+	return &dirindex.Index{
+		Root: root,
+		File: filepath.Join(flags.CacheDir, indexDir, name+".idx"),
+	}
+}
+
+// startExpiry prunes files from the proxy cache directory at root that were
+// stored more than age before present. It prunes once at startup, and then
+// periodically in g until ctx ends. If age <= 0, startExpiry does nothing.
+func startExpiry(ctx context.Context, g *taskgroup.Group, name, root string, age time.Duration) {
+	if age <= 0 {
+		return
+	}
+	// Check often enough that entries do not outlive their age by much, but
+	// not so often that walking a large cache is a burden.
+	every := min(max(age/4, time.Minute), time.Hour)
+	slog.Debug("enabling cache expiry", "cache", name, "age", age, "every", every)
+	idx := cacheIndex(name, root)
+	g.Run(func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			files, bytes, err := pruneFiles(idx, age)
+			if err != nil {
+				slog.Warn("cache expiry failed", "cache", name, "err", err)
+			} else if files != 0 {
+				slog.Info("expired cache entries", "cache", name, "files", files, "bytes", bytes)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	})
+}
+
+// pruneFiles removes regular files under the root of idx that were last
+// modified more than age before present, and reports the number of files and
+// bytes removed. The index may be stale for files modified in place, so each
+// candidate is checked before it is removed. Files that vanish while pruning
+// is in progress are ignored.
+func pruneFiles(idx *dirindex.Index, age time.Duration) (files int, bytes int64, _ error) {
+	cutoff := time.Now().Add(-age)
+	st, err := idx.Walk(func(e dirindex.Entry) error {
+		if !e.ModTime.Before(cutoff) {
+			return nil
+		}
+		path := filepath.Join(idx.Root, filepath.FromSlash(e.Path))
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() || !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			files++
+			bytes += fi.Size()
+		}
+		return nil
+	})
+	slog.Debug("scanned cache directory", "root", idx.Root,
+		"dirs", st.Dirs, "dirs_read", st.DirsRead, "files", st.Files)
+	return files, bytes, err
+}
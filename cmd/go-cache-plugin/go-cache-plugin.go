@@ -6,17 +6,22 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/creachadair/command"
 	"github.com/creachadair/flax"
+	"github.com/grafana/go-cache-plugin/lib/admin"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
 )
 
 func main() {
-	log.SetFlags(log.Ltime | log.Lmicroseconds)
 	root := &command.C{
 		Name:  command.ProgramName(),
 		Usage: "--cache-dir d --bucket b [options]\nhelp",
@@ -31,25 +36,42 @@ For example:
 Note that Go toolchains prior to 1.24 must be built with GOEXPERIMENT=cacheprog
 to enable this integration. Go 1.24 and later have it enabled by default.
 
-You must provide --cache-dir, --bucket, and --region, or the corresponding
-environment variables (see "help environment").  Entries in the cache are
-stored in the specified S3 bucket, and staged in a local directory specified by
-the --cache-dir flag or GOCACHE_DIR environment.`,
+You must provide --bucket and --region, or the corresponding environment
+variables (see "help environment").  Entries in the cache are stored in the
+specified S3 bucket, and staged in a local directory specified by the
+--cache-dir flag or GOCACHE_DIR environment. By default, this is the directory
+go-cache-plugin in the user cache directory of the platform: for example,
+~/.cache on Linux, ~/Library/Caches on macOS, and %LocalAppData% on Windows.`,
 
 		SetFlags: command.Flags(flax.MustBind, &flags),
-		Run:      command.Adapt(runDirect),
+		Init: func(env *command.Env) error {
+			logLevel.verbose.Store(flags.Verbose)
+			logLevel.debug.Store(int64(flags.DebugLog))
+			if err := initLogging(env); err != nil {
+				return err
+			}
+			flags.SummaryFile = cmp.Or(flags.SummaryFile, flags.SummaryOut)
+			if flags.CacheDir == "" {
+				flags.CacheDir = defaultCacheDir()
+			} else if err := splitCacheDir(env); err != nil {
+				return err
+			}
+			return expandPrefixFlags(env)
+		},
+		Run: command.Adapt(runDirect),
 
 		Commands: []*command.C{
 			{
 				Name:  "serve",
-				Usage: "--plugin <port>",
+				Usage: "--plugin <port|addr|path>",
 				Help: `Run a cache server.
 
 In this mode, the cache server listens for connections on a socket instead of
 serving directly over stdin/stdout. The "connect" command adapts the direct
 interface to this one.
 
-By default, only the build cache is exported via the --plugin port.
+By default, only the build cache is exported via the --plugin socket, which
+is a TCP port or address, or the path of a Unix-domain socket.
 
 If --http is set, the server also exports an HTTP server at that address.
 By default, this exports only /debug endpoints, including metrics.
@@ -58,28 +80,491 @@ When --http is enabled, the following options are available:
 - When --modcache is true, the server also exports a caching module proxy at
   http://<host>:<port>/mod/.
 
+- When --pypi is true, the server also exports a caching Python package index
+  proxy at http://<host>:<port>/pypi/simple/ (see "help pypi-proxy").
+
+- When --npm is true, the server also exports a caching npm registry proxy at
+  http://<host>:<port>/npm/ (see "help npm-proxy").
+
+- When --actions-cache is true, the server also exports a GitHub Actions cache
+  service at http://<host>:<port>/gha/ (see "help actions-cache").
+
+- When --blob-cache is true, the server also exports a ccache/sccache blob
+  store at http://<host>:<port>/blob/ (see "help blob-cache").
+
+- When --gradle-cache is true, the server also exports a Gradle remote build
+  cache at http://<host>:<port>/cache/ (see "help gradle-cache").
+
 - When --revproxy is set, the server also hosts a caching reverse proxy for the
   specified hosts at http://<host>:<port>. The reverse proxy handles both HTTP
-  and HTTPS requests, and caches immutable successful responses.`,
+  and HTTPS requests, and caches immutable successful responses.
+
+- When --admin-token is set, the server also exports an authenticated admin
+  API at http://<host>:<port>/admin/ (see "help admin").
+
+If --admin-grpc is set, the server also exports an administrative gRPC service
+at that address, authenticated by the --admin-token (see "help admin").`,
 
 				SetFlags: command.Flags(flax.MustBind, &serveFlags),
 				Run:      command.Adapt(runServe),
 			},
 			{
 				Name:  "connect",
-				Usage: "<port>",
+				Usage: "<port|addr|path>",
 				Help: `Connect to a remote cache server.
 
 This mode bridges stdin/stdout to a cache server (see the "serve" command)
-listening on the specified port.`,
+listening on the specified port, address, or Unix-domain socket path.`,
 
 				Run: command.Adapt(runConnect),
 			},
+			{
+				Name:  "wrap",
+				Usage: "-- <command> [args...]",
+				Help: `Run a command, uploading its build outputs only if it succeeds.
+
+This mode runs a cache server for the builds of the given command, which finds
+it via GOCACHEPROG, as it would in direct mode. Entries the builds store are
+kept in the --cache-dir, and their uploads to S3 are deferred until the command
+exits. If it exits successfully, the deferred entries are uploaded; otherwise
+they are discarded, so that outputs of failed or aborted builds do not enter
+the shared cache. The exit status is that of the command. For example:
+
+   go-cache-plugin --cache-dir=/tmp/gocache --bucket=$B wrap -- go test ./...
+
+See also "help defer-uploads".`,
+
+				Run: command.Adapt(runWrap),
+			},
+			{
+				Name:  "purge",
+				Usage: "--older-than <duration> [-n] [--force]",
+				Help: `Purge old entries from the remote cache.
+
+Delete all entries in the S3 bucket under the --prefix that were last written
+longer than --older-than before present. This affects only the remote cache;
+local cache directories are not modified.
+
+If versioning is enabled on the bucket, deleted entries are replaced by delete
+markers, and can be restored with the "undelete" command until the bucket's
+lifecycle rules expire the old versions. If versioning is not enabled, the
+purge is permanent, and you must pass --force to proceed.
+
+With -n, the entries that would be purged are printed but not deleted.`,
+
+				SetFlags: command.Flags(flax.MustBind, &purgeFlags),
+				Run:      command.Adapt(runPurge),
+			},
+			{
+				Name:  "prune",
+				Usage: "--older-than <age> [-n] [--force] [--progress <interval>]",
+				Help: `Prune stale entries from the remote cache in batches.
+
+Delete the entries in the S3 bucket under the --prefix that were last written
+longer than --older-than before present. The age is a duration such as "36h",
+or a number of days such as "30d". Entries are deleted up to 1000 at a time,
+which makes this suitable for large buckets, in place of a lifecycle rule.
+
+Unlike a lifecycle rule, prune knows the layout of the bucket: it keeps the
+audit log (see --audit-log-s3), the latest tree head of each checksum
+database (see --sumdb-verify), and the zstd dictionaries the build outputs are
+compressed with (see "train-dict"), which are not cache entries, and it reports
+the number of entries pruned from each area of the cache, such as "action",
+"output", or "module". Every --progress interval (default 10s), it logs the
+number of entries scanned and deleted so far.
+
+Since a build output already in the bucket is not written again when another
+action produces it, an output may be older than the actions that refer to it.
+Prune therefore deletes the stale action records first, and then only the
+stale outputs that no remaining action refers to. Set --key-transform as for
+the server, so that prune finds the actions and outputs.
+
+As for "purge", entries deleted from a versioned bucket can be restored with
+"undelete", and pruning a bucket without versioning requires --force.
+
+With -n, the entries that would be pruned are printed but not deleted.`,
+
+				SetFlags: command.Flags(flax.MustBind, &pruneFlags),
+				Run:      command.Adapt(runPrune),
+			},
+			{
+				Name:  "undelete",
+				Usage: "--since <duration> [-n]",
+				Help: `Restore entries purged from the remote cache.
+
+Restore all entries in the S3 bucket under the --prefix that were deleted
+within --since before present, by removing their delete markers. This requires
+that versioning be enabled on the bucket.
+
+With -n, the entries that would be restored are printed but not restored.`,
+
+				SetFlags: command.Flags(flax.MustBind, &undeleteFlags),
+				Run:      command.Adapt(runUndelete),
+			},
+			{
+				Name:  "migrate-prefix",
+				Usage: "[--fallback-bucket <bucket>] [--fallback-prefix <prefix>] [--dest-bucket <bucket>] [--checkpoint <file>] [-n]",
+				Help: `Copy the remote cache to a new bucket or key prefix.
+
+Copy all entries in S3 under the --fallback-bucket and --fallback-prefix (the
+previous location of the cache) to the --bucket and --prefix (its new
+location). With --dest-bucket, copy to that bucket instead of the --bucket,
+and if neither fallback flag is set, copy from the --bucket and --prefix, as
+to move the cache to a bucket in another region. Entries already present at
+the destination are not copied. Build cache actions are copied after the
+objects they refer to. The copies are made by S3, as many at a time as the -u
+flag allows, and credentials must permit reading the source and writing the
+destination.
+
+With --checkpoint, the progress of the copy is recorded in the given file as
+it runs. If the copy is interrupted, or some entries fail to copy, running
+the same command again resumes the copy where it stopped, rather than listing
+the source from the beginning. Once an entry fails to copy, no more are
+started, since the copy cannot resume past it. The file is removed when the
+copy is complete.
+
+With -n, the entries that would be copied are printed but not copied.
+
+See "help relocate" for how to move the cache without a cold start.`,
+
+				SetFlags: command.Flags(flax.MustBind, &migrateFlags),
+				Run:      command.Adapt(runMigratePrefix),
+			},
+			{
+				Name:  "migrate",
+				Usage: "--from-prefix <prefix> --to-prefix <prefix> [--dest-bucket <bucket>] [--checkpoint <file>] [-n]",
+				Help: `Copy the remote cache from one key prefix to another.
+
+This is an alias for "migrate-prefix" that copies the entries in the --bucket
+under --from-prefix to --to-prefix, in the --dest-bucket if it is set, or else
+in the same bucket. It is the same as
+
+   go-cache-plugin --prefix=<to> --fallback-bucket=<bucket> \
+      --fallback-prefix=<from> migrate-prefix
+
+and takes the same --dest-bucket, --checkpoint, and -n flags.`,
+
+				SetFlags: command.Flags(flax.MustBind, &migrateFlags, &migrateAliasFlags),
+				Run:      command.Adapt(runMigrate),
+			},
+			{
+				Name:  "du",
+				Usage: "[--s3] [--top <n>] [--json]",
+				Help: `Report the storage used by the cache.
+
+Scan the --cache-dir and report its disk usage broken down by subsystem: the
+build cache ("build"), the module proxy ("module"), the reverse proxy
+("revproxy"), and so on. For each, print the number of entries, their total
+size, and the number of entries in each age range, by the time they were last
+written. Then list the --top (default 5) largest entries of each subsystem.
+
+With --s3, report the same for the objects in the S3 bucket under the
+--prefix instead, by listing the bucket. With --json, print the usage as a
+JSON array, ordered by size.`,
+
+				SetFlags: command.Flags(flax.MustBind, &duFlags),
+				Run:      command.Adapt(runDU),
+			},
+			{
+				Name:  "ls",
+				Usage: "[--local | --s3] [<prefix>...]",
+				Help: `List entries in the local and remote caches.
+
+List the files in the --cache-dir and the objects in S3 under the --prefix
+whose paths, relative to those locations, begin with one of the given
+prefixes, or all of them if none are given. Each is printed on one line, as
+the tier ("local" or "s3"), its size in bytes, when it was last written, and
+its path or key. For example, to list the build cache actions whose IDs begin
+with "ab" in both tiers:
+
+   go-cache-plugin --cache-dir=/tmp/gocache --bucket=$B ls action/ab/
+
+With --local or --s3, only that tier is listed. If --bucket is not set, only
+the --cache-dir is listed. Keys in S3 are as stored, including any
+--key-transform.`,
+
+				SetFlags: command.Flags(flax.MustBind, &lsFlags),
+				Run:      command.Adapt(runLs),
+			},
+			{
+				Name:  "get",
+				Usage: "<action-id>",
+				Help: `Report where a build cache entry is stored.
+
+Look up the build cache action with the given ID (in hex, as the go command
+reports with GODEBUG=gocachehash=1) in the --cache-dir and in S3 under the
+--prefix and --key-transform, and print what each tier holds for it: the
+output ID, the location, size, and age of its object, and for S3, the action
+record and the kind and compression of the object.
+
+The entry is not faulted in or otherwise changed. The command reports an
+error if the action is in neither tier.`,
+
+				Run: command.Adapt(runGet),
+			},
+			{
+				Name:  "cat",
+				Usage: "[--s3] <action-id>",
+				Help: `Print the output of a build cache entry.
+
+Copy the output of the build cache action with the given ID to stdout, from
+the --cache-dir if it is present there, or otherwise from S3, decompressed if
+necessary. With --s3, the output is read from S3 even if it is local.`,
+
+				SetFlags: command.Flags(flax.MustBind, &catFlags),
+				Run:      command.Adapt(runCat),
+			},
+			{
+				Name:  "export",
+				Usage: "--out <archive> [--s3] [--only <subsystems>] [--since <duration>]",
+				Help: `Write cache entries to an archive.
+
+Write the entries in the --cache-dir to a tar archive at the --out path, for
+transfer to hosts that cannot reach the bucket, such as in an air-gapped
+network; use "import" to unpack it there. If the path ends in ".zst", the
+archive is compressed with Zstandard. With --s3, the objects in the S3 bucket
+under the --prefix are written instead of the local files.
+
+Each entry keeps its path relative to the --cache-dir, or its key relative to
+the --prefix, so unpacking the archive reproduces the same layout. With --only,
+only the entries of the named subsystems (as reported by "du", for example
+"build,module") are written. With --since, only entries written within that
+long before present are written, so that an archive can carry just the changes
+since the last transfer. Working files, such as upload journals and partial
+module downloads, are never exported.
+
+For example:
+
+   go-cache-plugin --cache-dir=/tmp/gocache export --only=build,module --out=cache.tar.zst`,
+
+				SetFlags: command.Flags(flax.MustBind, &exportFlags),
+				Run:      command.Adapt(runExport),
+			},
+			{
+				Name:  "import",
+				Usage: "[-n] [--overwrite] <archive>",
+				Help: `Unpack an archive of cache entries.
+
+Unpack an archive written by "export", compressed or not. Entries exported
+from a cache directory are written to the --cache-dir, and entries exported
+from S3 are written to the --bucket under the --prefix, each at the same
+relative path they were exported from. If --bucket is not set, entries from
+S3 are skipped, and a warning reports how many.
+
+Entries already present are left alone, since cache entries are named by
+their contents; use --overwrite to replace them. With -n, the entries in the
+archive are printed but not imported.`,
+
+				SetFlags: command.Flags(flax.MustBind, &importFlags),
+				Run:      command.Adapt(runImport),
+			},
+			{
+				Name:  "check",
+				Usage: "[--verify] [--min-age <duration>] [--repair [--force]]",
+				Help: `Check the consistency of the remote build cache.
+
+Cross-check the build cache entries in the S3 bucket under the --prefix (and
+--key-transform), and print each problem found, one per line, as the kind of
+problem, the key, and a description. The kinds are:
+
+   corrupt   -- an action record that cannot be parsed
+   missing   -- an action whose object is not in S3
+   mismatch  -- an object whose contents do not match its output ID
+   orphan    -- an object not referenced by any action
+
+Objects written within --min-age (default 1 hour) are not reported as
+orphans, since their actions may not be written yet. With --verify, each
+object referenced by an action is read to check its digest; otherwise only
+its presence is checked. The check is safe to run while servers write to the
+cache, and reports an error if any problems remain, so it can run periodically
+to keep a bucket shared by many writers healthy.
+
+With --repair, the entries with problems are deleted. An action deleted this
+way is a plain miss, and is written again the next time it is stored. As for
+"purge", --force is required to repair a bucket without versioning.`,
+
+				SetFlags: command.Flags(flax.MustBind, &checkFlags),
+				Run:      command.Adapt(runCheck),
+			},
+			{
+				Name:  "verify",
+				Usage: "[--sample <n>] [--digest] [--orphans [--min-age <duration>]]",
+				Help: `Compare the local cache directory with the remote build cache.
+
+Compare each action in the --cache-dir with its record in the S3 bucket under
+the --prefix (and --key-transform), and print each difference found, one per
+line, as the kind of difference, the S3 key, and a description. The kinds are:
+
+   unsynced  -- a local action that was never uploaded to S3
+   drift     -- an action whose output ID in S3 differs from the local one
+   corrupt   -- an action record in S3 that cannot be parsed
+   missing   -- an action in S3 whose object is not in S3
+   mismatch  -- an object in S3 whose size or contents do not match
+   orphan    -- an object in S3 not referenced by any action (with --orphans)
+
+Actions that are not uploaded by policy, because they are smaller than
+--min-upload-size or are test results kept local by --test-results, are
+skipped. With --sample, only that many local actions, chosen at random, are
+compared, for a quick check of a large cache. By default, the size of each
+remote object is compared with the local one, except where S3 stores it
+compressed or encrypted; with --digest, each remote object is read to check
+its digest against its output ID. With --orphans, every action in S3 is read
+to find the objects that none refers to, as by "check".
+
+Nothing is changed. The command reports an error if any differences are found,
+so it can gate release builds on the health of the shared cache. Uploads
+that failed are reported as unsynced until they are completed, as by
+"backfill" or by the sync operation of the admin API (see "help admin").`,
+
+				SetFlags: command.Flags(flax.MustBind, &verifyFlags),
+				Run:      command.Adapt(runVerify),
+			},
+			{
+				Name:  "scrub",
+				Usage: "[--refetch] [-n]",
+				Help: `Verify the entries of the local cache directory.
+
+Re-hash each object in the --cache-dir that is referred to by an action, and
+compare it with the output ID and size the action records. This is useful
+after an unclean shutdown or a disk error, which may leave files truncated or
+damaged. Each problem found is printed, one per line, as the kind of problem,
+the local path of the file, and a description. The kinds are:
+
+   corrupt   -- an action file that cannot be parsed
+   missing   -- an action whose object is not in the cache directory
+   mismatch  -- an object whose contents do not match its output ID, or an
+                action that records the wrong size for its object
+
+The actions with problems are removed, along with their corrupt objects, so
+that the go tool treats them as misses rather than reading wrong results.
+With --refetch, each action removed is read again from S3 (which requires the
+--bucket and key settings of the plugin), and the copy read is verified.
+A summary of the entries scrubbed is logged at the end.
+
+The scrub is safe to run while plugins use the cache directory. It reports an
+error if any entry could not be removed or read again. With -n, the problems
+are printed but nothing is changed, and any problem is reported as an error.`,
+
+				SetFlags: command.Flags(flax.MustBind, &scrubFlags),
+				Run:      command.Adapt(runScrub),
+			},
+			{
+				Name:  "train-dict",
+				Usage: "[--samples <n>] [--max-object-size <size>] [--dict-size <size>] [-n]",
+				Help: `Train a zstd dictionary for the remote build cache.
+
+Sample up to --samples (default 2000) of the build outputs in the S3 bucket
+under the --prefix (and --key-transform) that are no larger than
+--max-object-size (default 64KiB), train a zstd dictionary of up to
+--dict-size (default 112KiB) on their contents, and store it beside them as
+the current dictionary of the prefix. Many Go build outputs are small and
+alike, and compress much better with a shared dictionary than alone.
+
+Servers writing with --compression=zstd under the prefix compress new objects
+with the current dictionary, checking for a new one each hour. Each object
+records the ID of its dictionary, so objects written with an earlier one, or
+with none, are still read. Objects already stored are not rewritten.
+
+The sizes of the samples compressed with and without the new dictionary are
+logged, as an estimate of its benefit. With -n, the dictionary is trained and
+measured but not stored. Retrain as the code being built changes.`,
+
+				SetFlags: command.Flags(flax.MustBind, &trainDictFlags),
+				Run:      command.Adapt(runTrainDict),
+			},
+			{
+				Name: "stats",
+				Help: `Work with snapshots of server metrics.`,
+
+				Commands: []*command.C{
+					{
+						Name:  "diff",
+						Usage: "[--all] [--json] <before.json> <after.json>",
+						Help: `Compare two snapshots of metrics.
+
+Each snapshot is a JSON object of metrics, as reported by the stats operation
+of the admin API, by /debug/vars, or by --metrics at exit; "-" reads one from
+standard input. Nested objects are flattened to dotted names, such as
+"gocache.get_hit". For each metric that differs, print its value before and
+after, the difference, and the percentage change:
+
+   curl -sH "Authorization: Bearer $TOKEN" $ADMIN/admin/stats > before.json
+   # ... run the builds under test ...
+   curl -sH "Authorization: Bearer $TOKEN" $ADMIN/admin/stats > after.json
+   go-cache-plugin stats diff before.json after.json
+
+Numeric metrics missing from a snapshot count as zero, as for a counter that
+was not yet published; other values, such as the configuration generation,
+are reported if they differ. Counters (such as hits, misses, and bytes) give
+the activity between the snapshots, and gauges their change. With --all,
+metrics that did not change are included too. With --json, the differences
+are printed as a JSON object keyed by metric name, for further processing.`,
+
+						SetFlags: command.Flags(flax.MustBind, &statsDiffFlags),
+						Run:      command.Adapt(runStatsDiff),
+					},
+				},
+			},
+			{
+				Name: "backfill",
+				Help: `Complete uploads that did not reach the remote cache.
+
+When the plugin or server exits, it records the build cache entries whose
+uploads to S3 failed, or were still in progress and abandoned (as with
+--profile=dev), in a backfill manifest in the --cache-dir. This command
+uploads the entries listed in the manifest from the local cache directory,
+skipping any that have since been removed from it, and records those that
+still fail for another attempt.
+
+Run it with the same --cache-dir, --bucket, and key settings as the plugin,
+for example as a final CI step or from cron:
+
+   go-cache-plugin --cache-dir=/tmp/gocache --bucket=$B backfill
+
+It is safe to run while plugins are using the cache directory.
+
+Each plugin also keeps a journal of its uploads in the "journal" directory of
+the --cache-dir while it runs. If a plugin exits without closing the cache,
+as when a CI step is killed or crashes, the next plugin to start with the same
+--cache-dir completes the uploads left in its journal before it exits. The
+journal relies on file locks, which are supported on Unix and Windows; on
+other systems it is disabled with a warning, and only the backfill manifest
+records incomplete uploads.`,
+
+				Run: command.Adapt(runBackfill),
+			},
+			{
+				Name:  "actions-token",
+				Usage: "--ref <ref> [--read <ref>,...] [--ttl <duration>]",
+				Help: `Print a runtime token for the actions cache service.
+
+The token permits a job to read and write cache entries for --ref, the ref
+the job runs on, and to read the entries of the refs listed by --read, such
+as the default branch of the repository, as the tokens GitHub issues to jobs
+do. Refs are tried in that order when the job restores a cache. The token is
+signed with --secret (default $GOCACHE_ACTIONS_CACHE_SECRET), which must be
+the --actions-cache-secret of the server, and expires after --ttl (default
+6h):
+
+   ACTIONS_RUNTIME_TOKEN=$(go-cache-plugin actions-token \
+      --ref=refs/heads/feature --read=refs/heads/main)
+
+See "help actions-cache".`,
+
+				SetFlags: command.Flags(flax.MustBind, &actionsTokenFlags),
+				Run:      command.Adapt(runActionsToken),
+			},
 			command.HelpCommand(helpTopics),
 			command.VersionCommand(),
 		},
 	}
-	command.RunOrFail(root.NewEnv(nil), os.Args[1:])
+	// Flags may follow the subcommand, so the command line of "wrap" is set
+	// apart by "--" before the arguments are parsed.
+	args := os.Args[1:]
+	if i := slices.Index(args, "--"); i >= 0 && slices.Contains(args[:i], "wrap") {
+		args, wrapArgs = args[:i], args[i+1:]
+	}
+	command.RunOrFail(root.NewEnv(nil), args)
 }
 
 // getBucketRegion reports the specified region for the given bucket.
@@ -92,10 +577,116 @@ func getBucketRegion(ctx context.Context, bucket string) (string, error) {
 	return s3util.BucketRegion(ctx, bucket)
 }
 
-// vprintf acts as log.Printf if the --verbose flag is set; otherwise it
-// discards its input.
-func vprintf(msg string, args ...any) {
-	if flags.Verbose || flags.DebugLog != 0 {
-		log.Printf(msg, args...)
+// logLevel holds the current logging settings. These are initialized from
+// the -v, --debug, and --log-level flags, and may be updated at runtime by the
+// admin API.
+var logLevel struct {
+	verbose atomic.Bool
+	debug   atomic.Int64
+	level   slog.LevelVar
+}
+
+// logBase is the handler to which all log records are written, after
+// filtering by logHandler.
+var logBase slog.Handler
+
+// initLogging sets up the default logger from the --log-format and
+// --log-level flags. Log records are written to stderr.
+func initLogging(env *command.Env) error {
+	if err := logLevel.level.UnmarshalText([]byte(cmp.Or(flags.LogLevel, "info"))); err != nil {
+		return env.Usagef("invalid --log-level: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug} // filtered by logHandler
+	switch flags.LogFormat {
+	case "", "text":
+		logBase = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		logBase = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return env.Usagef("invalid --log-format %q (want text or json)", flags.LogFormat)
+	}
+	slog.SetDefault(slog.New(logHandler{Handler: logBase}))
+	return nil
+}
+
+// componentLogger returns a logger for a component whose per-request debug
+// logging is controlled by the specified --debug mask bit. Records from the
+// component carry a "component" attribute with the given name.
+//
+// Components log each request at debug level, and these records are logged
+// only if the mask bit is currently set, so that the mask can be changed at
+// runtime. Other records are filtered by the current log level.
+func componentLogger(bit int64, name string) *slog.Logger {
+	return slog.New(logHandler{Handler: logBase.WithAttrs([]slog.Attr{slog.String("component", name)}), bit: bit})
+}
+
+// printfLogger returns a printf-style log function that writes messages to
+// logger at the given level, for packages that do not accept a logger.
+func printfLogger(logger *slog.Logger, level slog.Level) func(string, ...any) {
+	return func(msg string, args ...any) {
+		if logger.Enabled(context.Background(), level) {
+			logger.Log(context.Background(), level, fmt.Sprintf(msg, args...))
+		}
+	}
+}
+
+// logHandler filters log records according to the current log settings.
+type logHandler struct {
+	slog.Handler
+	bit int64 // --debug mask bit for per-request records, or 0
+}
+
+// Enabled reports whether records at level are logged. Debug records from a
+// component are enabled by its --debug mask bit; other records are enabled at
+// or above the --log-level, or at debug level if -v or --debug is set.
+func (h logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if h.bit != 0 && level < slog.LevelInfo {
+		return logLevel.debug.Load()&h.bit != 0
+	}
+	floor := logLevel.level.Level()
+	if logLevel.verbose.Load() || logLevel.debug.Load() != 0 {
+		floor = min(floor, slog.LevelDebug)
+	}
+	return level >= floor
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{Handler: h.Handler.WithAttrs(attrs), bit: h.bit}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{Handler: h.Handler.WithGroup(name), bit: h.bit}
+}
+
+// setLogLevel updates the logging settings from set, which may contain the
+// keys "verbose" (bool), "debug" (int), and "level" (a level name), and
+// returns the resulting settings.
+func setLogLevel(_ context.Context, set map[string]string) (map[string]any, error) {
+	for key, val := range set {
+		switch key {
+		case "verbose":
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid verbose: %v", admin.ErrBadRequest, err)
+			}
+			logLevel.verbose.Store(v)
+		case "debug":
+			v, err := strconv.ParseInt(val, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid debug: %v", admin.ErrBadRequest, err)
+			}
+			logLevel.debug.Store(v)
+		case "level":
+			if err := logLevel.level.UnmarshalText([]byte(val)); err != nil {
+				return nil, fmt.Errorf("%w: invalid level: %v", admin.ErrBadRequest, err)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown log setting %q", admin.ErrBadRequest, key)
+		}
 	}
+	return map[string]any{
+		"verbose": logLevel.verbose.Load(),
+		"debug":   logLevel.debug.Load(),
+		"level":   logLevel.level.Level().String(),
+	}, nil
 }
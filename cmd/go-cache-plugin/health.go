@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// A degradation records a subsystem of the cache that did not fully do its
+// job during a run, although the run itself succeeded.
+type degradation struct {
+	Subsystem string `json:"subsystem"`
+	Detail    string `json:"detail"`
+	Count     int    `json:"count,omitempty"`
+}
+
+// A runReport is the end-of-run report of what the cache did and whether it
+// was degraded. It is written to --summary-file, summarized by --print-summary,
+// and uploaded by --stats-upload (see statsRecord).
+type runReport struct {
+	Status     string        `json:"status"` // "ok" or "warning"
+	Time       time.Time     `json:"time"`
+	Requests   int64         `json:"requests"`
+	Hits       int64         `json:"hits"`
+	Misses     int64         `json:"misses"`
+	HitRatio   float64       `json:"hit_ratio"`
+	Downloaded int64         `json:"downloaded_bytes"`
+	Uploaded   int64         `json:"uploaded_bytes"`
+	FetchMS    int64         `json:"fetch_ms"`
+	Built      int64         `json:"built"`
+	BuildMS    int64         `json:"build_ms"`
+	SavedMS    int64         `json:"time_saved_ms"`
+	Degraded   []degradation `json:"degraded,omitempty"`
+}
+
+// newRunReport returns the report of a run whose cache did the work in st,
+// and was degraded as described by deg.
+func newRunReport(st gobuild.SessionStats, deg []degradation) runReport {
+	rpt := runReport{
+		Status:     "ok",
+		Time:       time.Now().UTC(),
+		Requests:   st.Hits + st.Misses,
+		Hits:       st.Hits,
+		Misses:     st.Misses,
+		Downloaded: st.Downloaded,
+		Uploaded:   st.Uploaded,
+		FetchMS:    st.FetchTime.Milliseconds(),
+		Built:      st.Built,
+		BuildMS:    st.BuildTime.Milliseconds(),
+		SavedMS:    st.TimeSaved().Milliseconds(),
+		Degraded:   deg,
+	}
+	if rpt.Requests > 0 {
+		rpt.HitRatio = float64(st.Hits) / float64(rpt.Requests)
+	}
+	if len(deg) != 0 {
+		rpt.Status = "warning"
+	}
+	return rpt
+}
+
+// cacheDegradations reports the ways in which cache degraded during the run.
+// It must be called after the cache is closed, when the uploads that remain
+// pending were abandoned. backfillErr is the error, if any, from recording
+// those uploads for the "backfill" command.
+func cacheDegradations(cache *gobuild.S3Cache, backfillErr error) []degradation {
+	var out []degradation
+	add := func(sub, detail string, n int) {
+		out = append(out, degradation{Subsystem: sub, Detail: detail, Count: n})
+	}
+	if n := len(cache.FailedActions()); n != 0 {
+		add("upload", "uploads to S3 failed", n)
+	}
+	if n := len(cache.PendingActions()); n != 0 {
+		add("upload", "uploads abandoned at exit", n)
+	}
+	if n := cache.GetStats().Misses[gobuild.MissError]; n != 0 {
+		add("lookup", "lookups failed with an error", int(n))
+	}
+	if cache.Journal != nil {
+		if err := cache.Journal.Err(); err != nil {
+			add("journal", "upload journal failed: "+err.Error(), 0)
+		}
+	}
+	if backfillErr != nil {
+		add("backfill", "save backfill manifest failed: "+backfillErr.Error(), 0)
+	}
+	return out
+}
+
+// reportRun logs the degradations of cache during the run, if any, and
+// reports the run: as one line on stderr with --print-summary, to the
+// --summary-file if one is set, and to S3 with --stats-upload. A report with
+// any degradations has a status of "warning", so that CI can flag it even
+// though the build succeeded. It must be called after the cache is closed.
+func reportRun(ctx context.Context, cache *gobuild.S3Cache, backfillErr error) {
+	deg := cacheDegradations(cache, backfillErr)
+	for _, d := range deg {
+		slog.Warn("cache degraded", "subsystem", d.Subsystem, "detail", d.Detail, "count", d.Count)
+	}
+	if !flags.PrintSummary && flags.SummaryFile == "" && !flags.StatsUpload {
+		return
+	}
+	st := cache.SessionStats()
+	rpt := newRunReport(st, deg)
+	if flags.PrintSummary {
+		fmt.Fprintf(os.Stderr, "go-cache-plugin: %d hits, %d misses (%.1f%% hit), %s downloaded, %s uploaded, ~%v saved\n",
+			st.Hits, st.Misses, 100*rpt.HitRatio, formatBytes(st.Downloaded), formatBytes(st.Uploaded),
+			st.TimeSaved().Round(time.Second))
+	}
+	if flags.StatsUpload {
+		uploadSession(ctx, cache, rpt)
+	}
+	if flags.SummaryFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(rpt, "", "  ")
+	if err != nil {
+		slog.Warn("encode summary file failed", "err", err)
+		return
+	}
+	if err := atomicfile.WriteData(flags.SummaryFile, append(data, '\n'), 0644); err != nil {
+		slog.Warn("write summary file failed", "path", flags.SummaryFile, "err", err)
+	}
+}
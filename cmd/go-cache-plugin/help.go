@@ -22,8 +22,331 @@ get credentials from the instance metadata service; otherwise you will need to
 plumb AWS environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
 AWS_ENDPOINT_URL) or set up a configuration file.
 
+The --bucket may be either a plain bucket name or the ARN of an S3 Access Point
+or Object Lambda Access Point, for example:
+
+   --bucket=arn:aws:s3:us-west-2:123456789012:accesspoint/build-cache
+
+When an ARN is given, the region is taken from the ARN unless --region is set,
+and --s3-path-style is not permitted. Note that Object Lambda Access Points
+only serve reads, so uploads through them fail and are counted as S3 errors.
+
+An S3-compatible service at an --s3-endpoint-url (such as MinIO) may present a
+certificate issued by a private CA, or require clients to present one. Set
+--s3-ca-file to a PEM file of the CA certificates to trust, in addition to
+those of the system, and --s3-client-cert (and --s3-client-key, if the key is
+in a separate file) to the PEM certificate for the plugin to present:
+
+   --s3-endpoint-url=https://minio.internal:9000 --s3-path-style \
+   --s3-ca-file=/etc/ssl/internal-ca.pem --s3-client-cert=/etc/gocache/client.pem
+
+Runners far from the region of the bucket can set --s3-accelerate to send
+requests through the Transfer Acceleration endpoint, which must be enabled on
+the bucket, and which is not available for access points or for bucket names
+containing dots. Networks that require it can set --s3-dual-stack to reach
+AWS over IPv6 as well as IPv4, and --s3-fips to use endpoints validated under
+FIPS 140. These two apply to all requests made to AWS for the cache,
+including those to STS and KMS.
+
+To read a bucket owned by another account that is configured so that the
+requester pays for requests and transfer, set --s3-requester-pays to accept
+those charges in the account of the plugin's credentials. Without it, every
+request to such a bucket is denied.
+
+A project can publish its cache in a public bucket, for contributors to read
+without any AWS account or configuration. Set --s3-anonymous, with the
+--region of the bucket, to send requests without credentials and never write
+to the bucket: entries built locally stay in the --cache-dir, and are counted
+by the put_skip_readonly metric. The bucket policy must allow s3:GetObject
+(and for --s3-key-index, s3:ListBucket) to everyone. For example:
+
+   GOCACHEPROG="go-cache-plugin --bucket=example-go-cache --region=us-east-1 --s3-anonymous"
+
+Large build outputs (such as test binaries) can be written to S3 in parts with
+a multipart upload, which is faster and more robust than a single request. Set
+--multipart-threshold to the minimum object size in bytes to upload this way;
+--multipart-part-size and --multipart-concurrency control the size of each
+part and how many are sent at once. Servers writing to the same bucket should
+use the same part size, since it determines the ETag used to recognize objects
+that are already stored.
+
+To keep cache traffic from saturating a link it shares with other traffic (such
+as a NAT gateway), set --s3-upload-bandwidth and --s3-download-bandwidth to the
+maximum rate in bytes per second of data sent to and received from S3. Each
+limit applies to the total for the process, shared by all concurrent requests:
+
+   --s3-upload-bandwidth=20000000 --s3-download-bandwidth=50000000
+
+By default, a failed S3 request is attempted at most 3 times, and retries stop
+altogether when many requests fail at once, so a brief brownout of S3 can fail
+builds. To ride one out, raise --s3-max-attempts and --s3-max-backoff, and set
+--s3-no-retry-quota so that every request gets all of its attempts. Set
+--s3-request-timeout to retry an attempt that S3 has not begun to answer in
+that long. With --s3-retry-mode=adaptive, the plugin also slows its request
+rate while S3 throttles it. The retries are counted in the gocache_s3_retry
+metrics: retries, retries_throttled, and retry_delay_ms.
+
+   --s3-max-attempts=8 --s3-max-backoff=1m --s3-no-retry-quota
+
+A few reads from S3 take far longer than the rest, and each one holds up the
+build waiting for it. Set --s3-hedge-percentile to send a second request for
+a read that has not been answered within that percentile of the latencies of
+recent reads (but at least --s3-hedge-min-delay), and use whichever request
+answers first. At 0.95, about 1 read in 20 is sent twice. The gocache_s3_hedge
+metrics count the reads hedged (get_hedged) and those the second request won
+(get_hedge_won), and report the current delay (get_hedge_delay_ms).
+
+On a cold cache, most build cache lookups miss in S3, and the same actions
+are often requested again (for example, by several builds sharing a server).
+Set --miss-ttl to remember each miss in memory for that long, so repeated
+lookups report a miss without reading S3. A miss is forgotten when the action
+is stored; an action stored by another plugin in the meantime is found once
+the period ends. The get_miss_cached metric counts the lookups saved.
+
+Alternatively, set --s3-key-index to list the actions under the --prefix once
+at startup, and again at that interval, so that a lookup of an action not in
+the listing reports a miss without reading S3: one listing replaces thousands
+of failed requests on a cold cache. Lookups read S3 as usual until the first
+listing completes. Actions stored by this plugin are added as they are
+stored; those stored by another plugin are found after the next listing.
+The listing covers only actions outside any namespace (see "help
+namespace-chain"), and costs about 16 bytes of memory per action. The
+get_key_absent metric counts the lookups saved.
+
+Uploads to S3 run in the background, at most -u at a time. Rather than pick
+-u for each host, set --adaptive-uploads to adjust the number to S3 as it
+runs: it starts at 4, grows while the latency of uploads stays near the
+lowest seen, shrinks as latency climbs, and halves when S3 throttles uploads
+("SlowDown"). With --adaptive-uploads, -u is the most allowed (default 64).
+The put_upload_limit metric reports the current number.
+
+When all of the upload workers are busy, a build storing more entries waits
+for one, so a slow S3 region slows the build. Set --upload-queue to let that
+many uploads wait for a worker instead; when the queue is full, --upload-drop
+chooses what happens:
+
+   newest  -- drop the upload being added (the default)
+   oldest  -- drop the upload that has waited longest
+   block   -- wait for room in the queue
+
+Dropped uploads are counted by the put_dropped metric, and are recorded for
+the "backfill" command like other uploads that failed. The depth of the queue
+and the wait of its oldest upload are reported as put_queue_depth and
+put_queue_lag_seconds, and as the Prometheus gauges gocache_upload_queue_depth
+and gocache_upload_queue_lag_seconds by /debug/varz.
+
+Concurrent lookups of the same action that miss locally share one remote
+lookup, so that when many builds on a server miss on it at once, it is read
+from S3 (or a peer) only once; the get_joined metric counts the lookups that
+waited for another. Likewise, the module proxy shares faults from S3, and the
+reverse proxy shares both faults from S3 and fetches from the origin, among
+concurrent requests for the same entry.
+
+When many plugin processes share a cache directory on one host (as in direct
+mode, with one process per go command), set --host-index to share an index
+of the local cache among them. The index is a snapshot of the actions in the
+directory, stored there as "hostindex" and mapped into memory read-only by
+each process, so that a lookup found in it need not read the action file.
+The first process to find the index missing, or older than the given age,
+rebuilds it in the background; actions stored since are still found in the
+directory itself. The get_index_hit metric counts the local hits it served.
+
+Besides build outputs, the build cache holds the results of "go test": the
+output of each test, and a log of its inputs. These change with every change
+to the code under test, so they are seldom reused by other builds, and can
+dilute a shared bucket. The plugin recognizes them by their contents, counts
+them in the put_test and put_test_bytes metrics (and their hits from S3 as
+get_test_hit), and stores them as --test-results selects:
+
+   shared    -- like other entries (the default)
+   separate  -- objects under <prefix>/test/ in place of output/, so that a
+                lifecycle rule on the bucket can expire them sooner
+   local     -- only in the local cache directory, never in S3
+
+With "separate", --test-ttl also bounds the age of test results read from S3;
+older ones are misses (counted as get_test_stale). Action records of separate
+test results are marked, and servers older than this setting report them as
+invalid, so upgrade all the servers sharing a bucket before enabling it.
+
+Objects are written to S3 uncompressed by default. Set --compression to trade
+CPU for bandwidth and storage: "zstd" saves the most, and "lz4" costs the least
+CPU, for small runners. Compressed objects are stored under keys with a suffix
+naming the codec (as ".zst"), and their action records name the codec, so a
+plugin reads each object in the codec it was written with, whatever its own
+setting. Plugins with different settings can share a --prefix, though each
+codec stores its own copy of an object; choose a codec per prefix to avoid
+that. The put_s3_encoded_bytes metric reports the bytes written after
+compression. As with --test-results, servers older than this setting report
+compressed entries as invalid, so upgrade the readers first. With "zstd", new
+objects are compressed with the dictionary trained for the --prefix by the
+"train-dict" command, if any, which helps most for small outputs.
+
+Objects written to S3 use the default encryption of the bucket, unless the
+--s3-sse flag selects server-side encryption explicitly: "s3" for SSE-S3, "kms"
+for SSE-KMS, or "dsse" for dual-layer DSSE-KMS. Set --s3-kms-key to the ID or
+ARN of the KMS key to use (this implies "kms"), and --s3-bucket-key to reduce
+KMS request costs with an S3 Bucket Key. The settings are sent with every
+upload, so they satisfy bucket policies that deny unencrypted writes:
+
+   --s3-sse=kms --s3-kms-key=arn:aws:kms:us-west-2:123456789012:key/...
+
+With KMS encryption, S3 does not report ETags derived from object contents, so
+the plugin records its own digest in the object metadata to recognize objects
+that are already stored. Objects written before KMS was enabled are written
+once more, with the new settings, when next stored.
+
+To keep the contents of the cache from principals that can read the bucket but
+not use a KMS key, set --s3-cse-kms-key to the ID, ARN, or alias of the key.
+Each object is then encrypted by the plugin with AES-256-GCM before it is
+uploaded, under a data key from KMS that is stored, wrapped by the KMS key,
+with the ID of the key in the object metadata. The ciphertext is bound to the
+object key, so an object copied to another key cannot be read, and the digest
+recorded to recognize stored objects is encrypted too. Writers need
+kms:GenerateDataKey on the key, and readers kms:Decrypt on every key that
+wrapped the objects they read. A data key is used for an hour of uploads, and
+data keys are remembered once unwrapped, so most requests need no call to KMS.
+To rotate the key, set the new one: objects are decrypted with the key named in
+their metadata, so older objects remain readable while the old key is usable.
+Objects written without --s3-cse-kms-key are rejected as undecryptable, so that
+a principal that can write to the bucket but not use the key cannot plant
+objects in the cache. To enable the setting on an existing cache, also set
+--s3-cse-allow-plaintext while migrating, so that unencrypted objects are read
+as they are; remove it once the old objects have been rewritten or have
+expired. Readers without --s3-cse-kms-key cannot read the objects written with
+it: enable it on every reader first. Objects are encrypted and decrypted in
+memory.
+
+S3 requests use the credentials of the default AWS chain (environment, shared
+config, or instance role). To write to a bucket owned by another account
+without static keys, set --s3-assume-role-arn to a role in that account. The
+plugin assumes the role with the default credentials, passing --s3-external-id
+if the role requires one, or with the OIDC token in --s3-web-identity-file (as
+issued by a CI system), and refreshes the credentials before they expire:
+
+   --s3-assume-role-arn=arn:aws:iam::123456789012:role/gocache-writer \
+   --s3-web-identity-file=$CI_OIDC_TOKEN_FILE
+
+The --region of the bucket is still looked up with the default credentials,
+so set it explicitly if they cannot read the bucket location.
+
+Set --s3-storage-class to store uploads in a class other than STANDARD, such as
+STANDARD_IA, ONEZONE_IA, GLACIER_IR, or INTELLIGENT_TIERING. The class applies
+to everything the plugin writes: build cache entries and the caches of each
+proxy. The infrequent-access classes cost less to store but more to read, and
+bill each object for at least 128 KiB and 30 days, so they suit caches whose
+entries are large and read a few times soon after they are written (consider
+--min-upload-size). Archive classes (GLACIER and DEEP_ARCHIVE) are rejected,
+since their objects cannot be read without a restore. Objects already stored
+keep their class; a lifecycle rule on the bucket can move them.
+
+Set --s3-checksum to the algorithm of the checksum sent with each object the
+plugin writes, crc32c or sha256 (or crc32 or sha1), which S3 verifies and
+stores with the object. Set --s3-verify-checksums to check the contents of
+each object read against its stored checksum, so that contents corrupted on
+the way from S3 (as by a proxy) fail the read rather than enter the cache.
+The gocache_s3_checksum metrics count the reads verified, those of objects
+without a checksum to verify (written before the checksum was set, or in
+parts, whose checksum the SDK does not verify), and the corrupt reads.
+
+Set --s3-tags to tag the objects the plugin writes, so that lifecycle rules
+and cost allocation reports can tell apart the objects written by different
+jobs, repositories, or toolchains. It is a comma-separated list of key=value
+tags, at most 10, whose values may refer to environment variables as for the
+--prefix (below); a variable that is unset expands to its default, or to
+nothing:
+
+   --s3-tags='ci-job={CI_JOB_ID:-local},repo={GITHUB_REPOSITORY},go={GOVERSION}'
+
+Writing tags requires the s3:PutObjectTagging permission. Objects already
+stored keep their tags.
+
+The --prefix and --fallback-prefix may refer to environment variables as
+"{NAME}", or "{NAME:-default}" to use the default when NAME is unset, so that
+builds of each branch, toolchain, or platform can be kept apart without a
+script to compute the prefix:
+
+   --prefix='gocache/{GIT_BRANCH:-main}/{GOVERSION}/{GOOS}-{GOARCH}' \
+   --fallback-prefix='gocache/main/{GOVERSION}/{GOOS}-{GOARCH}'
+
+Here a branch build reads the entries of main when it misses its own; for main
+itself, the fallback is the same as the --prefix, and is ignored. GOOS and
+GOARCH default to those of the plugin, and GOVERSION to the version reported by
+"go env GOVERSION" (using $GOROOT/bin/go if GOROOT is set), the version of the
+toolchain running the build, not the one the plugin was built with. Set
+GOVERSION in the environment to avoid running the go command. Each value is
+used as a single key component: characters other than letters, digits, ".",
+"_", and "-" (such as the "/" of "feature/x") are replaced with "-". A variable
+that is unset and has no default is an error, rather than an empty component.
+
+To read the build cache of other prefixes without writing there, set
+--read-prefixes to the list of prefixes to read, in order. The first is the
+--prefix, where entries are written; the others are consulted in turn for
+actions missing from it, before any --fallback-bucket:
+
+   --read-prefixes='gocache/pr-{PR_NUMBER},gocache/main'
+
+Here a pull request build reads its own entries and those of main, but stores
+its own only, so untrusted builds cannot change what main builds read. Each
+prefix holds a complete cache, objects included; for namespaces that share
+the objects of one prefix, see "help namespace-chain". The prefixes may use
+the same variables as --prefix, and the get_prefix_hit metric counts the hits
+found under them.
+
+Entries in the local cache directory can be expired separately for each kind
+of cache. The --build-expiration setting (which defaults to --expiry) removes
+build cache entries unused for that long when the plugin exits. In serve mode,
+--mod-expiration, --revproxy-expiration, --blob-expiration, and
+--gradle-expiration periodically remove module proxy, reverse proxy, blob
+store, and Gradle cache entries stored longer ago than the given period;
+module zips never change and can be kept long, while proxied responses may
+warrant a shorter period. Expired entries are fetched again from S3 when next
+needed.
+
+With --min-free-space (such as "2GiB"), the plugin checks the free space of
+the filesystem holding the --cache-dir every 10 seconds, and whenever a write
+to it fails. Below that much, it evicts the build cache entries written least
+recently, oldest first, until twice that much is free, rather than let the go
+command fail for lack of space. Until the space recovers, remote hits are
+not copied in to the --cache-dir (they are reported as misses with the reason
+"low_disk"), and new entries are uploaded to S3 before the go command is told
+they are stored, so that they can be evicted at once. The gocache_disk metrics
+report the free space, how often it ran low, and what was evicted. This is
+supported on Linux, macOS, and FreeBSD.
+
+With --diskless, nothing is kept on local disk across runs, for ephemeral
+containers whose scratch disks are too small for a cache, and which would
+not reuse it anyway. In place of the --cache-dir, entries are staged in a new
+temporary directory (under $TMPDIR), which the go command needs to read them,
+and which is removed when the plugin exits. Every lookup not made before in
+the same run is read from S3, and the entries stored are uploaded before the
+directory is removed.
+The host index (--host-index) and the expiration of the --cache-dir do not
+apply, and uploads that fail cannot be completed later by "backfill". In
+serve mode, the other caches also keep their entries in the temporary
+directory. Combine it with --min-free-space to bound the use of the scratch
+disk by a long run.
+
+The --cache-dir may have two tiers, a small fast one (such as tmpfs or NVMe)
+and a larger slow one (such as an HDD or EBS volume), given as
+
+  --cache-dir=fast:/dev/shm/gocache,slow:/var/cache/gocache
+
+New entries are written to the fast tier, and lookups try the fast tier, then
+the slow tier, before any remote tier. An entry found in the slow tier twice
+within --spill-promote-window (default 1h) is copied back to the fast tier.
+Every --spill-demote-age (default 1h), and when the plugin exits, the entries
+of the fast tier not used within that period are moved to the slow tier. Use
+--min-free-space to bound the fast tier between demotions; the expiration of
+the --cache-dir applies to both tiers. The gocache_spill metrics report the
+hits, promotions, and demotions. Tiers cannot be combined with --diskless.
+
 See also: "help environment".
-Related:  "direct-mode", "serve-mode", "module-proxy", "reverse-proxy".`,
+Related:  "direct-mode", "serve-mode", "module-proxy", "pypi-proxy",
+          "npm-proxy", "actions-cache", "blob-cache", "gradle-cache",
+          "reverse-proxy", "admin", "standby", "peers", "audit", "audit-log",
+          "profile", "slowlog", "sbom", "key-transform", "dedup", "misses",
+          "read-tiers", "namespace-chain", "relocate", "replica",
+          "statsd", "cloudwatch", "encryption".`,
 	},
 	{
 		Name: "environment",
@@ -32,31 +355,167 @@ Related:  "direct-mode", "serve-mode", "module-proxy", "reverse-proxy".`,
 To make it easier to configure this tool for multiple workflows, most of the
 settings can be set via environment variables as well as flags.
 
-   --------------------------------------------------------------------
-   Flag (global)        Variable                 Format      Default
-   --------------------------------------------------------------------
-    --cache-dir         GOCACHE_DIR              path        (required)
-    --bucket            GOCACHE_S3_BUCKET        string      (required)
-    --region            GOCACHE_S3_REGION        string      based on bucket
-    --s3-path-style     GOCACHE_S3_PATH_STYLE    bool        false
-    --s3-endpoint-url   GOCACHE_S3_ENDPOINT_URL  string      ""
-    --prefix            GOCACHE_KEY_PREFIX       string      ""
-    --min-upload-size   GOCACHE_MIN_SIZE         int64       0
-    --metrics           GOCACHE_METRICS          bool        false
-    --expiry            GOCACHE_EXPIRY           duration    0
-    -c                  GOCACHE_CONCURRENCY      int         runtime.NumCPU
-    -u                  GOCACHE_S3_CONCURRENCY   duration    runtime.NumCPU
-    -v                  GOCACHE_VERBOSE          bool        false
-    --debug             GOCACHE_DEBUG            int         0 (see "help debug")
-
-   --------------------------------------------------------------------
-   Flag (serve)         Variable                 Format      Default
-   --------------------------------------------------------------------
-    --plugin            GOCACHE_PLUGIN           port        (required)
-    --http              GOCACHE_HTTP             [host]:port ""
-    --modproxy          GOCACHE_MODPROXY         bool        false
-    --revproxy          GOCACHE_REVPROXY         host,...    ""
-    --sumdb             GOCACHE_SUMDB            host,...    ""
+   --------------------------------------------------------------------------------
+   Flag (global)             Variable                       Format       Default
+   --------------------------------------------------------------------------------
+    --cache-dir              GOCACHE_DIR                    path         user cache dir
+    --bucket                 GOCACHE_S3_BUCKET              name|ARN     (required)
+    --region                 GOCACHE_S3_REGION              string       based on bucket
+    --s3-path-style          GOCACHE_S3_PATH_STYLE          bool         false
+    --s3-endpoint-url        GOCACHE_S3_ENDPOINT_URL        string       ""
+    --s3-ca-file             GOCACHE_S3_CA_FILE             path         ""
+    --s3-client-cert         GOCACHE_S3_CLIENT_CERT         path         ""
+    --s3-client-key          GOCACHE_S3_CLIENT_KEY          path         --s3-client-cert
+    --s3-accelerate          GOCACHE_S3_ACCELERATE          bool         false
+    --s3-dual-stack          GOCACHE_S3_DUAL_STACK          bool         false
+    --s3-fips                GOCACHE_S3_FIPS                bool         false
+    --s3-sse                 GOCACHE_S3_SSE                 mode         none
+    --s3-kms-key             GOCACHE_S3_KMS_KEY             key|ARN      ""
+    --s3-cse-kms-key         GOCACHE_S3_CSE_KMS_KEY         key|ARN      ""
+    --s3-cse-allow-plaintext GOCACHE_S3_CSE_ALLOW_PLAINTEXT bool         false
+    --s3-bucket-key          GOCACHE_S3_BUCKET_KEY          bool         false
+    --s3-assume-role-arn     GOCACHE_S3_ASSUME_ROLE_ARN     ARN          ""
+    --s3-external-id         GOCACHE_S3_EXTERNAL_ID         string       ""
+    --s3-web-identity-file   GOCACHE_S3_WEB_IDENTITY_FILE   path         ""
+    --s3-session-name        GOCACHE_S3_SESSION_NAME        string       go-cache-plugin
+    --s3-storage-class       GOCACHE_S3_STORAGE_CLASS       class        STANDARD
+    --s3-checksum            GOCACHE_S3_CHECKSUM            algorithm    SDK default
+    --s3-verify-checksums    GOCACHE_S3_VERIFY_CHECKSUMS    bool         false
+    --s3-tags                GOCACHE_S3_TAGS                tag,...      ""
+    --s3-requester-pays      GOCACHE_S3_REQUESTER_PAYS      bool         false
+    --s3-anonymous           GOCACHE_S3_ANONYMOUS           bool         false
+    --prefix                 GOCACHE_KEY_PREFIX             string       ""
+    --read-prefixes          GOCACHE_READ_PREFIXES          prefix,...   ""
+    --fallback-bucket        GOCACHE_FALLBACK_BUCKET        name|ARN     ""
+    --fallback-prefix        GOCACHE_FALLBACK_PREFIX        string       ""
+    --s3-replica-bucket      GOCACHE_S3_REPLICA_BUCKET      name|ARN     ""
+    --s3-replica-region      GOCACHE_S3_REPLICA_REGION      string       based on bucket
+    --s3-replica-slow-read   GOCACHE_S3_REPLICA_SLOW_READ   duration     0 (errors only)
+    --s3-replica-failover    GOCACHE_S3_REPLICA_FAILOVER    duration     30s
+    --key-transform          GOCACHE_KEY_TRANSFORM          step,...     ""
+    --min-upload-size        GOCACHE_MIN_SIZE               int64        0
+    --miss-ttl               GOCACHE_MISS_TTL               duration     0 (disabled)
+    --host-index             GOCACHE_HOST_INDEX             duration     0 (disabled)
+    --s3-key-index           GOCACHE_S3_KEY_INDEX           duration     0 (disabled)
+    --test-results           GOCACHE_TEST_RESULTS           policy       shared
+    --test-ttl               GOCACHE_TEST_TTL               duration     0 (no limit)
+    --compression            GOCACHE_COMPRESSION            codec        none
+    --canary-rate            GOCACHE_CANARY_RATE            float64      0 (disabled)
+    --canary-compression     GOCACHE_CANARY_COMPRESSION     codec        --compression
+    --canary-key-transform   GOCACHE_CANARY_KEY_TRANSFORM   step,...     --key-transform
+    --canary-prefix          GOCACHE_CANARY_PREFIX          string       --prefix
+    --metrics                GOCACHE_METRICS                bool         false
+    --summary-file           GOCACHE_SUMMARY_FILE           path         ""
+    --summary-out            GOCACHE_SUMMARY_OUT            path         ""
+    --print-summary          GOCACHE_PRINT_SUMMARY          bool         false
+    --stats-upload           GOCACHE_STATS_UPLOAD           bool         false
+    --statsd-addr            GOCACHE_STATSD_ADDR            host:port    ""
+    --statsd-prefix          GOCACHE_STATSD_PREFIX          string       gocache
+    --statsd-tags            GOCACHE_STATSD_TAGS            key:value,.. ""
+    --statsd-interval        GOCACHE_STATSD_INTERVAL        duration     10s
+    --emf-output             GOCACHE_EMF_OUTPUT             path|-       ""
+    --emf-namespace          GOCACHE_EMF_NAMESPACE          string       GoCachePlugin
+    --emf-dimensions         GOCACHE_EMF_DIMENSIONS         k=v,...      ""
+    --emf-interval           GOCACHE_EMF_INTERVAL           duration     1m
+    --expiry                 GOCACHE_EXPIRY                 duration     0
+    --build-expiration       GOCACHE_BUILD_EXPIRATION       duration     --expiry
+    --min-free-space         GOCACHE_MIN_FREE_SPACE         size         0 (disabled)
+    --diskless               GOCACHE_DISKLESS               bool         false
+    --spill-promote-window   GOCACHE_SPILL_PROMOTE_WINDOW   duration     1h
+    --spill-demote-age       GOCACHE_SPILL_DEMOTE_AGE       duration     1h
+    -c                       GOCACHE_CONCURRENCY            int          runtime.NumCPU
+    -u                       GOCACHE_S3_CONCURRENCY         int          runtime.NumCPU
+    --adaptive-uploads       GOCACHE_ADAPTIVE_UPLOADS       bool         false
+    --upload-queue           GOCACHE_UPLOAD_QUEUE           int          0 (no queue)
+    --upload-drop            GOCACHE_UPLOAD_DROP            policy       newest
+    --close-flush-timeout    GOCACHE_CLOSE_FLUSH_TIMEOUT    duration     0 (no limit)
+    --multipart-threshold    GOCACHE_MULTIPART_THRESHOLD    int64        0 (disabled)
+    --multipart-part-size    GOCACHE_MULTIPART_PART_SIZE    int64        16777216
+    --multipart-concurrency  GOCACHE_MULTIPART_CONCURRENCY  int          4
+    --s3-retry-mode          GOCACHE_S3_RETRY_MODE          mode         standard
+    --s3-max-attempts        GOCACHE_S3_MAX_ATTEMPTS        int          3
+    --s3-max-backoff         GOCACHE_S3_MAX_BACKOFF         duration     20s
+    --s3-request-timeout     GOCACHE_S3_REQUEST_TIMEOUT     duration     0 (no limit)
+    --s3-no-retry-quota      GOCACHE_S3_NO_RETRY_QUOTA      bool         false
+    --s3-hedge-percentile    GOCACHE_S3_HEDGE_PERCENTILE    float64      0 (disabled)
+    --s3-hedge-min-delay     GOCACHE_S3_HEDGE_MIN_DELAY     duration     10ms
+    --s3-upload-bandwidth    GOCACHE_S3_UPLOAD_BANDWIDTH    int64        0 (no limit)
+    --s3-download-bandwidth  GOCACHE_S3_DOWNLOAD_BANDWIDTH  int64        0 (no limit)
+    -v                       GOCACHE_VERBOSE                bool         false
+    --debug                  GOCACHE_DEBUG                  int          0 (see "help debug")
+    --log-format             GOCACHE_LOG_FORMAT             text|json    text
+    --log-level              GOCACHE_LOG_LEVEL              level        info
+    --plugin-key-file        GOCACHE_PLUGIN_KEY_FILE        path         ""
+    --local-key-file         GOCACHE_LOCAL_KEY_FILE         path         ""
+    --peers                  GOCACHE_PEERS                  addr,...     ""
+    --peer-key-file          GOCACHE_PEER_KEY_FILE          path         ""
+    --profile                GOCACHE_PROFILE                ci|dev       ci
+    --audit                  GOCACHE_AUDIT                  path         ""
+    --slowlog                GOCACHE_SLOWLOG                int          64
+    --memory-cache-size      GOCACHE_MEMORY_CACHE_SIZE      size         0 (disabled)
+    --memory-lookups         GOCACHE_MEMORY_LOOKUPS         int          0 (disabled)
+    --namespace              GOCACHE_NAMESPACE              string       ""
+    --read-tiers             GOCACHE_READ_TIERS             [ns=]tier,.. all tiers
+    --namespace-chain        GOCACHE_NAMESPACE_CHAIN        ns,...       "" (shared)
+
+   --------------------------------------------------------------------------------
+   Flag (serve)              Variable                       Format       Default
+   --------------------------------------------------------------------------------
+    --plugin                 GOCACHE_PLUGIN                 port|path    (required)
+    --http                   GOCACHE_HTTP                   [host]:port  ""
+    --modproxy               GOCACHE_MODPROXY               bool         false
+    --modproxy-addr          GOCACHE_MODPROXY_ADDR          [host]:port  "" (under --http)
+    --modproxy-offline       GOCACHE_MODPROXY_OFFLINE       bool         false
+    --modproxy-scan          GOCACHE_MODPROXY_SCAN          flag|block   ""
+    --modproxy-scan-size     GOCACHE_MODPROXY_SCAN_SIZE     int64        10485760
+    --modproxy-scan-allow    GOCACHE_MODPROXY_SCAN_ALLOW    glob,...     ""
+    --modproxy-allow         GOCACHE_MODPROXY_ALLOW         glob,...     "" (all)
+    --modproxy-block         GOCACHE_MODPROXY_BLOCK         glob,...     ""
+    --modproxy-temp-limit    GOCACHE_MODPROXY_TEMP_LIMIT    int64        0 (no limit)
+    --revproxy               GOCACHE_REVPROXY               host,...     ""
+    --sumdb                  GOCACHE_SUMDB                  host,...     ""
+    --sumdb-verify           GOCACHE_SUMDB_VERIFY           bool         false
+    --sumdb-key              GOCACHE_SUMDB_KEY              key          sum.golang.org
+    --pypi                   GOCACHE_PYPI                   bool         false
+    --pypi-upstream          GOCACHE_PYPI_UPSTREAM          url          https://pypi.org/simple
+    --npm                    GOCACHE_NPM                    bool         false
+    --npm-upstream           GOCACHE_NPM_UPSTREAM           url          https://registry.npmjs.org
+    --actions-cache          GOCACHE_ACTIONS_CACHE          bool         false
+    --actions-cache-secret   GOCACHE_ACTIONS_CACHE_SECRET   string       ""
+    --blob-cache             GOCACHE_BLOB_CACHE             bool         false
+    --blob-max-size          GOCACHE_BLOB_MAX_SIZE          int64        0 (no limit)
+    --blob-expiration        GOCACHE_BLOB_EXPIRATION        duration     0 (never)
+    --blob-token             GOCACHE_BLOB_TOKEN             string       "" (read-only)
+    --gradle-cache           GOCACHE_GRADLE_CACHE           bool         false
+    --gradle-expiration      GOCACHE_GRADLE_EXPIRATION      duration     0 (never)
+    --gradle-user            GOCACHE_GRADLE_USER            string       "" (any user)
+    --gradle-password        GOCACHE_GRADLE_PASSWORD        string       "" (read-only)
+    --sbom-log               GOCACHE_SBOM_LOG               path         ""
+    --sbom-retention         GOCACHE_SBOM_RETENTION         duration     720h
+    --audit-log              GOCACHE_AUDIT_LOG              path         ""
+    --audit-log-s3           GOCACHE_AUDIT_LOG_S3           bool         false
+    --revproxy-rules         GOCACHE_REVPROXY_RULES         path         ""
+    --revproxy-serve-stale-on-error
+                             GOCACHE_REVPROXY_SERVE_STALE   bool         false
+    --revproxy-stale-timeout GOCACHE_REVPROXY_STALE_TIMEOUT duration     0 (none)
+    --revproxy-mirror        GOCACHE_REVPROXY_MIRROR        [host=]url   ""
+    --revproxy-validate      GOCACHE_REVPROXY_VALIDATE      url          ""
+    --revproxy-mirror-rate   GOCACHE_REVPROXY_MIRROR_RATE   float64      0 (all)
+    --revproxy-ca-file       GOCACHE_REVPROXY_CA_FILE       path         ""
+    --revproxy-ca-key        GOCACHE_REVPROXY_CA_KEY        path         --revproxy-ca-file
+    --revproxy-ca-validity   GOCACHE_REVPROXY_CA_VALIDITY   duration     1 year
+    --mod-expiration         GOCACHE_MOD_EXPIRATION         duration     0 (never)
+    --revproxy-expiration    GOCACHE_REVPROXY_EXPIRATION    duration     0 (never)
+    --summary-interval       GOCACHE_SUMMARY_INTERVAL       duration     0 (never)
+    --no-cache-headers       GOCACHE_NO_CACHE_HEADERS       bool         false
+    --standby-lock           GOCACHE_STANDBY_LOCK           path         ""
+    --handoff-dir            GOCACHE_HANDOFF_DIR            path         ""
+    --admin-grpc             GOCACHE_ADMIN_GRPC             [host]:port  ""
+    --admin-token            GOCACHE_ADMIN_TOKEN            string       ""
+    --defer-uploads          GOCACHE_DEFER_UPLOADS          bool         false
+    --goproxy                GOCACHE_GOPROXY                url,...      https://proxy.golang.org
+    --goproxy-netrc          GOCACHE_GOPROXY_NETRC          path         ""
+    --goproxy-private        GOCACHE_GOPROXY_PRIVATE        glob,...     ""
 
 See also: "help configure".`,
 	},
@@ -74,7 +533,24 @@ Alternatively:
   export GOCACHEPROG=go-cache-plugin
   go build ...
 
-In this mode, you must specify the --cache-dir and --bucket settings.`,
+In this mode, you must specify the --bucket setting. If --cache-dir is not set,
+the plugin uses a go-cache-plugin directory in the user cache directory.
+
+On Windows, set the same variables in PowerShell (or with "setx" to keep them):
+
+  $env:GOCACHE_S3_BUCKET = "cache-bucket-name"
+  $env:GOCACHEPROG = "go-cache-plugin"
+  go build ...
+
+Key prefixes such as --prefix may be written with backslashes, which are read
+as slashes, so builds on every platform share the same entries.
+
+When the go command exits, the plugin waits for its uploads to S3 to finish
+before it exits in turn. To bound that wait (as for a CI step with a time
+limit), set --close-flush-timeout to the longest it may take, e.g. 30s; give
+a negative value (e.g. -1s) not to wait at all, as the dev profile does. The
+plugin logs how many uploads were flushed and how many abandoned ("uploads
+flushed"), and records those abandoned for the "backfill" command.`,
 	},
 	{
 		Name: "serve-mode",
@@ -91,7 +567,37 @@ You can then use the "connect" subcommand to wire up the toolchain:
   export GOCACHEPROG="go-cache-plugin connect $PORT"
 
 In this mode, the server must have credentials to access to S3, but the
-toolchain process does not need AWS credentials.`,
+toolchain process does not need AWS credentials.
+
+The server can instead listen on a Unix-domain socket, given by a path (or any
+address with the prefix "unix:"), so that builds on the same host share one
+process, with its memory cache, metrics, and upload queue:
+
+  go-cache-plugin serve ... --plugin=/run/gocache/plugin.sock
+  export GOCACHEPROG="go-cache-plugin connect /run/gocache/plugin.sock"
+
+Access to the socket is governed by the permissions of the file and of its
+directory. A stale socket left by a server that did not exit cleanly is
+replaced at startup, but the server will not take over a socket in use.
+
+When a build is canceled, the go command exits without waiting for its cache
+requests, and the connection closes. The server then stops the lookups still
+in progress for that build, including reads from peers and S3, rather than
+letting them run to completion. Uploads already started are not canceled, so
+that later builds can use what the canceled build produced.
+
+By default, the server accepts any client that can reach the plugin port.  To
+require clients to authenticate, provision the same secret key file on the
+server and on each client, and set --plugin-key-file (or the environment
+variable GOCACHE_PLUGIN_KEY_FILE) for both "serve" and "connect":
+
+  export GOCACHE_PLUGIN_KEY_FILE=/etc/gocache/plugin.key
+  export GOCACHEPROG="go-cache-plugin connect $PORT"
+
+With a key, each connection begins with a handshake exchanging fresh nonces,
+and every message is signed with HMAC-SHA256 under a per-session key, so the
+server rejects clients without the key, and messages cannot be replayed or
+modified. Messages are not encrypted.`,
 	},
 	{
 		Name: "module-proxy",
@@ -115,7 +621,256 @@ The proxy path for a given sumdb (e.g., sum.golang.org) has this format:
 
    export GOSUMDB="sum.golang.org http://localhost:5970/mod/sumdb/sum.golang.org"
 
+To serve the module proxy on its own address instead, set --modproxy-addr. It
+then serves at the root of that address, without the "/mod/" prefix, and not
+under --http at all, so that firewall rules can treat it separately from the
+other services (--http is then not required):
+
+   go-cache-plugin serve ... --modproxy --modproxy-addr=:5971
+
+   export GOPROXY=http://buildhost:5971
+   export GOSUMDB="sum.golang.org http://buildhost:5971/sumdb/sum.golang.org"
+
+By default, the module proxy fetches only from proxy.golang.org. To use a
+different upstream (for example, a private Artifactory proxy), set --goproxy
+using the same syntax as GOPROXY. To authenticate to upstream proxies, use
+--goproxy-netrc to name a .netrc file whose credentials are sent to matching
+hosts. As with the go command, only "machine" entries are used, the "default"
+entry is ignored, and credentials are sent only over HTTPS:
+
+   go-cache-plugin serve ... --modproxy \
+      --goproxy=https://artifactory.example.com/api/go/go,https://proxy.golang.org \
+      --goproxy-netrc=$HOME/.netrc
+
+Modules matching the --goproxy-private patterns (GOPRIVATE syntax) bypass the
+upstream proxies and are fetched directly from version control using the go
+tool, which must be installed and configured with access to those repositories.
+Such modules are not checked against the sum database.
+
+Responses from the module proxy include an "X-Cache" header reporting "HIT"
+if the file was served from the cache, "MISS" if it was fetched from the
+upstream, or "STALE" if the upstream could not be reached and a cached copy
+was served instead. Cached responses also include an "Age" header in seconds.
+Use --no-cache-headers to omit these headers.
+
+For air-gapped build environments, --modproxy-offline serves only modules that
+are already cached (locally or in S3), and never contacts an upstream. Fill the
+cache first with a prefetch run, for example by running "go mod download" with
+GOPROXY set to the proxy while it is online. Offline, requests for uncached
+modules, and for version lists and queries not cached by an earlier run,
+report 404 Not Found. The sum database is not proxied offline, so builds need
+complete go.sum files, or GOSUMDB=off for modules missing from them, unless
+--sumdb-verify is set (see below).
+
+With --sumdb-verify, the proxy does not simply pass sum DB requests through,
+but checks them itself: each signed tree head must carry a valid signature
+from the database key, and must be consistent with the last tree accepted;
+each lookup record must be included in the tree it was signed with; and each
+tile must match the latest tree. Records and tiles that pass are cached
+locally under the "sumdb" directory of the cache, and in S3 under the "sumdb"
+key prefix, in the same layout as the database serves them, since they never
+change. A response that fails these checks is logged as an error ("sumdb
+verification failed") and reported to the client as 502 Bad Gateway.
+
+By default, --sumdb-verify checks sum.golang.org with the key built into the
+go command. To use a different database, set --sumdb-key to its verifier key
+(in the format of GOSUMDB), and point GOSUMDB at the proxy path for its name.
+
+Together with --modproxy-offline, --sumdb-verify serves the sum DB from the
+cache, so air-gapped builds still have its integrity checks. The proxy then
+serves the last tree accepted while online, and any records looked up then:
+
+   go-cache-plugin serve ... --modproxy --modproxy-offline --sumdb-verify
+
+To harden the supply chain, --modproxy-scan inspects each module zip fetched
+from the upstream before it is cached, and reports files that may hide code
+from review: executables and object files (ELF, Mach-O, PE, WebAssembly, and
+archive libraries), and files larger than --modproxy-scan-size. With "flag",
+such zips are logged with the message "module zip flagged" and counted in the
+scan_flagged metric, but served as usual. With "block", they are also rejected,
+so the proxy reports an error for the module and does not cache it. Modules
+matching the --modproxy-scan-allow patterns (GOPRIVATE syntax) are not
+scanned. Entries already in the cache, locally or in S3, are not scanned.
+
+   go-cache-plugin serve ... --modproxy --modproxy-scan=block \
+      --modproxy-scan-allow=github.com/trusted-org
+
+To keep modules out of every build that uses the proxy, for example because
+they are known to be malicious or their licenses are not acceptable, list them
+in --modproxy-block (GOPRIVATE syntax). To serve only approved modules, list
+those in --modproxy-allow instead; --modproxy-block still applies to modules
+that match both. The proxy refuses requests for other modules with 403
+Forbidden and the message "module <path> is blocked by proxy policy", which
+the go command reports to the user, and logs them with the message "module
+blocked by policy". Requests refused are counted in the "modpolicy" metrics.
+Modules already in the cache are refused as well.
+
+   go-cache-plugin serve ... --modproxy \
+      --modproxy-allow=github.com/grafana,golang.org/x \
+      --modproxy-block=github.com/grafana/unvetted
+
+Modules fetched from upstream are downloaded and verified in temporary files
+under the "modtmp" directory of the cache. The server removes whatever is left
+there when it starts, and every 30 seconds prunes the files of fetches idle for
+over an hour. Their size is reported in the temp_bytes metric of "modtemp".
+With --modproxy-temp-limit, while the temporary files exceed that many bytes,
+the proxy serves only cached modules, and reports 503 Service Unavailable for
+the rest, so that a burst of large fetches cannot fill the disk.
+
 See also: https://proxy.golang.org/`,
+	},
+	{
+		Name: "pypi-proxy",
+		Help: `Run a Python package index proxy.
+
+With the --pypi flag, the server will also export a caching proxy for the
+Python Package Index (PyPI) at the given address:
+
+   go-cache-plugin serve ... --http=localhost:5970 --pypi
+
+The proxy implements the PEP 503 "simple" repository API under the path
+"/pypi/simple/". To use it, set the index URL for pip (or another installer):
+
+   export PIP_INDEX_URL=http://localhost:5970/pypi/simple/
+   pip install ...
+
+Project indexes are cached locally for 5 minutes, and the links they contain
+are rewritten so that package files are also fetched through the proxy.
+Package files are cached locally and in S3. If the upstream index cannot be
+reached, the proxy serves the last copy it fetched.
+
+To proxy a different PEP 503 index (e.g., a private mirror), set --pypi-upstream
+to its simple index URL. Package files are fetched from the host of that URL,
+or from files.pythonhosted.org.`,
+	},
+	{
+		Name: "npm-proxy",
+		Help: `Run an npm registry proxy.
+
+With the --npm flag, the server will also export a caching proxy for the npm
+package registry at the given address:
+
+   go-cache-plugin serve ... --http=localhost:5970 --npm
+
+The proxy serves the npm registry API under the path "/npm/". To use it, set
+the registry URL for npm (or another compatible client):
+
+   npm config set registry http://localhost:5970/npm/
+   npm install ...
+
+Package metadata documents are cached locally for 5 minutes, and the tarball
+URLs they contain are rewritten so that tarballs are also fetched through the
+proxy. Tarballs are immutable, and are cached locally and in S3. If the
+upstream registry cannot be reached, the proxy serves the last copy of the
+metadata it fetched. Other requests (for example, "npm audit" and "npm search")
+are forwarded to the upstream without caching.
+
+To proxy a different registry (e.g., a private mirror), set --npm-upstream to
+its base URL.`,
+	},
+	{
+		Name: "actions-cache",
+		Help: `Run a GitHub Actions cache service.
+
+With the --actions-cache flag, the server will also export an implementation
+of the GitHub Actions cache service, backed by S3, at the given address:
+
+   go-cache-plugin serve ... --http=localhost:5970 \
+      --actions-cache --actions-cache-secret=$SECRET
+
+The service is exported under the path "/gha/". On a self-hosted runner, point
+the actions/cache action (and other tools that use the cache service) at it by
+setting ACTIONS_CACHE_URL in the environment of the runner, along with a
+runtime token for the job made by the "actions-token" command:
+
+   ACTIONS_CACHE_URL=http://localhost:5970/gha/
+   ACTIONS_RUNTIME_TOKEN=$(go-cache-plugin actions-token \
+      --secret=$SECRET --ref=$GITHUB_REF --read=refs/heads/main)
+
+As in the GitHub service, every request must carry a runtime token, and cache
+entries are scoped by ref. A token signed with the --actions-cache-secret
+lists the refs the job may read, and the ref it may write, which is usually
+the ref the job runs on. A job restores from its own ref first, then from the
+other refs in the order the token lists them, such as the default branch;
+it saves new entries under its own ref only, so a job on one branch cannot
+change the caches restored by jobs on another. Archive download URLs are
+signed by the service, since clients do not send the token with them.
+
+This implements the original cache service protocol (reserve, upload, commit,
+and query), so the client must use it rather than the newer results service.
+Cache entries are stored in S3 with no size limit, and are matched by key and
+version as GitHub does: keys are tried in order, preferring an exact match,
+then the most recent entry whose key has the given key as a prefix. Entries are
+immutable once committed. Archives are also cached locally, and large archives
+are written to S3 in parts if --multipart-threshold is set.`,
+	},
+	{
+		Name: "blob-cache",
+		Help: `Run a blob store for compiler caches.
+
+With the --blob-cache flag, the server will also export a simple HTTP blob
+store, backed by S3, at the given address:
+
+   go-cache-plugin serve ... --http=localhost:5970 \
+      --blob-cache --blob-token=$TOKEN
+
+The store is exported under the path "/blob/". It is compatible with the HTTP
+remote storage of ccache, and with the WebDAV storage of sccache, so C, C++,
+and Rust builds can share a cache in the same bucket as Go builds. For ccache,
+set the remote storage in ccache.conf (or CCACHE_REMOTE_STORAGE):
+
+   remote_storage = http://localhost:5970/blob/|bearer-token=$TOKEN
+
+For sccache, set the WebDAV endpoint and token in the environment:
+
+   SCCACHE_WEBDAV_ENDPOINT=http://localhost:5970/blob/
+   SCCACHE_WEBDAV_TOKEN=$TOKEN
+
+Anyone may read blobs, but a PUT must present the --blob-token, either as a
+bearer token ("Authorization: Bearer <token>") or as the password of HTTP
+basic authentication, with any user name. Without --blob-token, the store is
+read-only: it serves blobs already in the cache, and rejects every PUT.
+
+Blobs written by PUT are stored locally and written to S3 in the background;
+blobs missing locally are read from S3. Set --blob-max-size to reject blobs
+larger than the given size, and --blob-expiration to prune blobs from the
+local cache that have not been written for the given period.`,
+	},
+	{
+		Name: "gradle-cache",
+		Help: `Run a Gradle remote build cache.
+
+With the --gradle-cache flag, the server will also export a Gradle HTTP build
+cache, backed by S3, at the given address:
+
+   go-cache-plugin serve ... --http=localhost:5970 \
+      --gradle-cache --gradle-user=gradle --gradle-password=$PASSWORD
+
+The cache is exported under the path "/cache/". Point Gradle at it in the
+settings.gradle(.kts) of the build:
+
+   buildCache {
+       remote<HttpBuildCache> {
+           url = uri("http://localhost:5970/cache/")
+           isPush = true
+           isAllowInsecureProtocol = true
+           credentials {
+               username = "gradle"
+               password = System.getenv("GRADLE_CACHE_PASSWORD")
+           }
+       }
+   }
+
+Anyone may read entries, but a PUT must present HTTP basic authentication
+with the --gradle-password, and the --gradle-user if one is set (otherwise
+any user name is accepted). Without --gradle-password, the cache is read-only:
+it serves entries already in the cache, and rejects every PUT, so builds that
+should only read the cache can leave isPush false and omit the credentials.
+
+Entries written by PUT are stored locally and written to S3 in the background;
+entries missing locally are read from S3. Gradle entries are kept apart from
+the --blob-cache. Set --gradle-expiration to prune entries from the local cache
+that have not been written for the given period.`,
 	},
 	{
 		Name: "reverse-proxy",
@@ -132,10 +887,899 @@ When this is enabled, you can configure this address as an HTTP proxy:
 
    HTTPS_PROXY=localhost:5970 curl https://api.example.com/foo
 
+A host may also be a pattern, to cache services (such as content-addressed
+CDNs) that use many host names without listing each of them. A wildcard
+"*.example.com" matches every subdomain of example.com, at any depth, and a
+suffix ".example.com" matches example.com itself as well as its subdomains.
+The server certificate includes a wildcard name for each pattern; since a
+wildcard name covers only one label, a client connecting to a deeper
+subdomain is given a certificate for that name alone.
+
 The proxy supports both HTTP and HTTPS backends. For HTTPS proxy targets, the
 server generates its own TLS certificate, and tries to install a custom signing
 cert so that other tools will validate it. The ability to do this varies by
-system and configuration, however.`,
+system and configuration, however. On Linux, the cert is added to the system
+bundle (/etc/ssl/certs/ca-certificates.crt), which requires write access. On
+macOS, it is added to the trust settings with the "security" tool: for all
+users via the System keychain when run as root, or else for the current user
+via the login keychain, which may ask to confirm the change. On Windows, it is
+added to the trusted root certificates with the "certutil" tool: for all users
+via the local machine store when run elevated, or else for the current user.
+With a persistent --revproxy-ca-file, this happens only once.
+
+By default the signing cert is generated fresh at startup and is valid for 24
+hours, so clients must trust a new one each time the server restarts. To keep
+the same signing cert across restarts, set --revproxy-ca-file (and optionally
+--revproxy-ca-key, if the private key is stored separately). If the file
+exists, the certificate and key are loaded from it; otherwise a new signing
+cert valid for --revproxy-ca-validity (default 1 year) is generated and saved
+there. Server certificates are issued from the signing cert for 24 hours at a
+time, and renewed automatically before they expire.
+
+Responses from the reverse proxy include an "X-Cache" header reporting "HIT"
+or "MISS", with an "X-Cache-Detail" header describing where a hit was found
+(memory, local, remote) or whether a fetched response was cached. Hits also
+include an "Age" header in seconds. Use --no-cache-headers to omit these.
+
+By default, a 200 (OK) response is cached on disk and in S3 if its
+Cache-Control header marks it "immutable", and in memory if it has a max-age
+below an hour. To set a different policy for some targets, give a rules file
+with --revproxy-rules. The file is a JSON array of rules; the first rule that
+matches a request governs it, and other requests use the default policy:
+
+   [
+     {"host": "deb.debian.org", "path": "^/debian/pool/",
+      "ttl": "720h", "max_size": 1073741824},
+     {"host": "api.example.com", "ttl": "5m",
+      "status": [200, 404], "ignore_query": true}
+   ]
+
+The fields of each rule, all optional, are:
+
+   host          -- a target (wildcards allowed); default all targets
+   path          -- a regular expression matched against the URL path
+   ttl           -- how long to cache responses, whatever their Cache-Control
+                    says (except "no-store"); below an hour, in memory only
+   max_size      -- the largest response body cached, in bytes
+   status        -- the status codes cached; default [200]
+   ignore_query  -- if true, the query string is not part of the cache key
+
+Requests with a Range header (as from tools that download large artifacts in
+parallel parts) are served from the whole cached object. On a miss, the proxy
+fetches the whole object once, caches it under the policy above, and serves
+each requested range from it; concurrent ranged requests for the same URL wait
+for the same fetch. The req_range and req_range_join metrics count these. If
+the object cannot be cached, ranged requests are forwarded unchanged, and
+partial (206) responses are never cached.
+
+So that a transient outage of an origin does not fail every build that needs
+it, set --revproxy-serve-stale-on-error. Responses that expire (by the ttl of
+a rule, or the max-age of a response cached in memory) are then kept, and if
+the origin fails to respond or reports a server error (5xx), the expired
+response is served in its place, with "X-Cache-Detail: stale" and a
+"Warning: 110" header; the req_stale_hit metric counts these. To bound how
+long a request waits on an unresponsive origin when a stale response is
+available, set --revproxy-stale-timeout (e.g., 10s).
+
+To check a new origin before moving clients to it, the reverse proxy can mirror
+a sample of the requests it forwards. With --revproxy-mirror, each sampled
+request is repeated in the background against a mirror origin, and the status
+and SHA256 of the two responses are compared; mismatches are logged and
+counted in the metrics. Give either one URL for all targets, or a list of
+host=url pairs:
+
+   --revproxy-mirror='api.example.com=https://api-new.example.com'
+
+With --revproxy-validate, a JSON report of each sampled request (its URL,
+status, size, and SHA256, and the mirror result if any) is posted to the given
+endpoint. Use --revproxy-mirror-rate to set the fraction of requests sampled
+(e.g., 0.1); the default is all of them. Shadow requests never affect the
+response to the client or the contents of the cache.`,
+	},
+	{
+		Name: "standby",
+		Help: `Run an active/standby pair of servers.
+
+Two "serve" daemons can run as an active/standby pair, so that one can be
+restarted (e.g., for a kernel upgrade) without a cold period for its clients.
+Both servers must share the same --cache-dir and settings, and have access to
+a shared lock file and handoff directory:
+
+   go-cache-plugin serve ... \
+      --standby-lock=/shared/gocache/standby.lock \
+      --handoff-dir=/shared/gocache/handoff
+
+The first server to acquire the --standby-lock becomes active, and the other
+waits on the lock before listening. When the active server exits, it writes
+the list of its uploads that have not yet reached S3 to the --handoff-dir and
+releases the lock before waiting for those uploads to finish. The standby then
+becomes active, and completes the pending uploads listed in the handoff.
+
+The signing certificate for the reverse proxy is also saved in the handoff
+directory, so that the standby presents the same CA that clients have already
+been configured to trust. The handoff directory contains private key
+material, and should be readable only by the user running the server.
+
+The lock uses advisory file locking (flock), so for servers on different hosts
+the shared filesystem must support it (e.g., NFSv4).`,
+	},
+	{
+		Name: "peers",
+		Help: `Share build cache entries between servers.
+
+A group of servers can share their local build caches with each other, so that
+an entry written by one can be read by the others without a round trip to S3.
+With --peers set, a cache miss in the local directory is first looked up on
+each of the peers concurrently, and the first peer to report a hit serves the
+object. If no peer has it, the lookup falls back to S3 as usual.
+
+The --peers flag is a comma-separated list of entries, each one of:
+
+   host:port                  -- a literal peer address
+   dns://name:port            -- the A/AAAA records for name, at port
+   dns+srv://_svc._tcp.name   -- the targets of the SRV records for name
+
+DNS entries are re-resolved every 30 seconds. Each peer address must be the
+--http address of a "serve" daemon; when --peers and --http are both set, the
+server exports its own cache to peers under /peer/ on that listener:
+
+   go-cache-plugin serve ... --http=:5970 --peers=dns://gocache.internal:5970 \
+      --peer-key-file=/etc/gocache/peer.key
+
+An address equal to this server's own --http is skipped. A "direct" mode
+plugin can also set --peers to read from peers, but does not serve to them.
+
+Peers authenticate each other with a secret key shared by all of them, read
+from --peer-key-file, which is required with --peers. Each request is signed
+with HMAC-SHA256 over the action ID, the time, and a fresh nonce, and a peer
+rejects requests without a valid signature, or more than a minute old. A peer
+signs its response in turn, binding the output ID and size of the object to
+the nonce of the request, and the object received is checked against its
+output ID (the SHA-256 digest of its contents) before it is stored. Requests
+and objects are not encrypted. Peers that fail to respond, or whose responses
+do not verify, are treated as misses.`,
+	},
+	{
+		Name: "admin",
+		Help: `Run an administrative API.
+
+The server can export an API for inspecting and controlling the running server
+without a restart. The API is available over HTTP (REST) and gRPC.
+
+With --http and --admin-token both set, the REST API is served under /admin/
+on the HTTP listener. Each request must carry the token as a bearer token:
+
+   go-cache-plugin serve ... --http=localhost:5970 --admin-token=$TOKEN
+   curl -H "Authorization: Bearer $TOKEN" http://localhost:5970/admin/stats
+
+The REST API provides these endpoints:
+
+   GET  /admin/stats                -- report a snapshot of server metrics
+   POST /admin/flush                -- wait for pending uploads to S3
+   POST /admin/purge?older_than=24h -- purge local build cache entries
+   POST /admin/sync                 -- upload local entries missing from S3
+   POST /admin/commit               -- upload deferred entries (--defer-uploads)
+   POST /admin/discard              -- forget deferred entries (--defer-uploads)
+   GET  /admin/config               -- report the effective configuration
+   GET  /admin/log                  -- report the log settings
+   POST /admin/log?verbose=true     -- update the log settings
+   GET  /admin/sbom?since=24h       -- report a bill of materials
+   GET  /admin/keys?prefix=action/  -- list keys in S3 under the --prefix
+   GET  /admin/ui                   -- a web page for operators
+
+The config endpoint reports the flag settings, and as "cache" the settings that
+determine which build cache entries are stored and read: the key prefix (and
+--read-prefixes), the Go version of the plugin, the --read-tiers namespaces,
+and the --namespace-chain of direct mode, along with a hash of these (and of
+--key-transform) as "generation". The same is published as the
+"gocache_config" metric, so stats reports it too, and the generation alone as
+"gocache_config_version"; /debug/varz reports that as a Prometheus info
+metric gocache_config_version{version="<generation>"} for dashboards to
+segment hit rates by configuration during a rollout.
+
+The log settings are "verbose" (as -v), "debug" (as --debug), and "level"
+(as --log-level). The older_than parameter of purge is required, and must be
+a positive duration. For the parameters of sbom, see "help sbom". The keys endpoint
+lists up to "limit" keys (default 100, at most 1000) whose names begin with
+the given prefix, relative to the --prefix.
+
+The web page at /admin/ui shows the metrics of each component (such as the
+build cache and each proxy), the namespaces of the configuration with the
+components served to each, and a search of the keys in S3. It can also purge,
+flush, and sync the cache. The page asks for the --admin-token, and sends it
+with each request to the REST API, so the token is still required:
+
+   open http://localhost:5970/admin/ui
+
+With the --admin-grpc flag, the server exports a gRPC service at the given
+address with the same operations. Like the REST API, it requires a token:
+
+   go-cache-plugin serve ... --admin-grpc=localhost:5971 --admin-token=$TOKEN
+
+Callers must send "authorization: Bearer <token>" metadata with each request.
+The service definition (gocacheplugin.admin.v1.Admin) is in the file
+lib/admin/admin.proto, and uses only well-known protobuf types. Go programs
+can use the client in the lib/admin package, which wraps the stubs generated
+from it; clients in other languages can be generated from the same file.`,
+	},
+	{
+		Name: "profile",
+		Help: `Tune the build cache for CI or for local development.
+
+The --profile flag selects how the build cache trades completeness for
+latency. The default profile, "ci", suits builders and CI workers: on a local
+miss, the cache looks for the entry on peers and in S3 before reporting a miss,
+and in direct mode the plugin waits for its uploads to S3 to finish before it
+exits.
+
+The "dev" profile suits interactive local development, where a language server
+such as gopls runs the go command many times for small changes:
+
+   go-cache-plugin --profile=dev serve --plugin=5930 ...
+
+With --profile=dev:
+
+- Recent action lookups are kept in memory, so repeated lookups of the same
+  actions do not read the local cache directory (as with
+  --memory-lookups=65536, unless it is set).
+
+- The local cache directory is indexed for all plugin processes on the host
+  (as with --host-index=10m, unless it is set), so that a new process need
+  not read each action it looks up.
+
+- No request waits for S3 or peers. On a local miss, the cache reports a miss
+  at once and fetches the entry in the background, so that a later request
+  can find it locally.
+
+- Uploads happen only in the background. The go command does not wait for
+  them when it exits (as with --close-flush-timeout=-1s, unless it is set); in direct mode, uploads not yet finished when the
+  plugin exits are abandoned, and recorded for the "backfill" command to
+  complete later (see "help backfill"). In serve mode, the server lets them
+  finish before it exits. Uploads wait in a queue of 4096 (as with
+  --upload-queue=4096, unless it is set), so a slow S3 does not slow builds.
+
+On a busy shared build host, with many compiles at once, set --memory-lookups
+(such as 100000) under either profile to keep that many recent build cache
+lookups in memory. Each maps an action to its output ID and the path of its
+file, and costs a few hundred bytes. Build outputs themselves are read by the
+go command from the local cache directory, so they are not kept in memory by
+the plugin; the page cache of the host serves that purpose.
+
+Set --memory-cache-size (such as "256MiB") to keep the most recently used
+module proxy entries, such as the .info and .mod files of common modules, in
+that much memory, so they are served without reading the disk. Entries larger
+than 1/8 of the size are not kept.
+
+To choose which tiers the cache consults for each build, see "help read-tiers".`,
+	},
+	{
+		Name: "read-tiers",
+		Help: `Choose where the build cache looks for entries.
+
+On each lookup, the build cache consults a series of tiers until it finds the
+entry: recent lookups kept in memory (with --profile=dev), the local cache
+directory, peer servers (with --peers), and S3. The --read-tiers flag selects
+which of these tiers are consulted, and in what order, for builds in each
+namespace. The value is a semicolon-separated list of entries, each of the
+form "[namespace=]tier,...", where the tiers are "memory", "local", "peer",
+and "s3". An entry without a namespace applies to builds with no other match.
+For example:
+
+   --read-tiers='memory,local,peer,s3;fast=memory,local;batch=local,s3'
+
+Here builds in the "fast" namespace never wait for the network, and builds in
+the "batch" namespace skip the peers. Other builds use all the tiers. The
+memory and local tiers must precede the peer and s3 tiers, since entries found
+remotely are stored locally.
+
+A build names its namespace with --namespace (GOCACHE_NAMESPACE). In direct
+mode, this selects the tiers the plugin uses. In serve mode, set it for the
+"connect" subcommand, which sends it to the server when it connects:
+
+   export GOCACHE_NAMESPACE=fast
+   export GOCACHEPROG="go-cache-plugin connect $PORT"
+
+The build cache metrics report how many lookups skipped each tier (as
+get_skip_memory, get_skip_local, get_skip_peer, and get_skip_s3), and the total
+time lookups spent on each tier in microseconds (get_local_us, get_peer_us,
+and get_s3_us), along with the hits and misses for each tier.
+
+To keep the entries of some builds apart from others, see "help namespace-chain".`,
+	},
+	{
+		Name: "namespace-chain",
+		Help: `Read from and write to namespaces of the remote build cache.
+
+By default, every build shares the actions stored in S3. The --namespace-chain
+flag gives a build an ordered list of namespaces instead: each lookup tries
+the namespaces in order, and the actions the build stores are written only to
+the first. For example, a pull request build might use
+
+   --namespace-chain=pr-1234,main,release-1.22
+
+to reuse what was built for main and the release branch, without changing the
+entries those builds use. Namespace names may contain letters, digits, "-",
+"_", and "."; the name "." is the shared space used by builds without a chain,
+so "pr-1234,." reads the shared entries but writes its own.
+
+Namespaced actions are stored under <prefix>/ns/<name>/. Objects are stored by
+content, and remain shared by all namespaces, so the same output is uploaded
+only once. The local cache directory, the peers, and the --fallback-bucket are
+also shared: an entry found by one build is a local hit for the next, in any
+namespace. The fallback is always read as the shared space.
+
+In direct mode, the flag applies to the plugin. In serve mode, set it for the
+"connect" subcommand, which sends it to the server when it connects, so each
+client may use its own chain:
+
+   export GOCACHE_NAMESPACE_CHAIN=pr-1234,main
+   export GOCACHEPROG="go-cache-plugin connect $PORT"
+
+The server must be of a version that supports chains; an unrecognized or
+invalid chain ends the connection rather than writing to the shared space.
+
+Uploads to a namespace other than "." are not recorded in the upload journal,
+nor saved for the "backfill" command or a standby server, since those write
+to the shared space. The "check" command checks the actions of every
+namespace.`,
+	},
+	{
+		Name: "defer-uploads",
+		Help: `Upload build outputs only when the build succeeds.
+
+By default, each entry a build stores is uploaded to S3 as soon as it is
+written, so a build that fails, or is canceled, leaves its outputs in the
+shared cache. To keep those out, defer the uploads until the build is known to
+have succeeded. Deferred entries are stored in the --cache-dir as usual, so the
+build itself is not affected; only their uploads wait.
+
+The "wrap" command runs a command and decides by its exit status:
+
+   go-cache-plugin ... wrap -- make test
+
+With "serve", the --defer-uploads flag defers the uploads of all clients until
+the admin API is told the outcome (see "help admin"). Since commit and discard
+change what other builds see, the flag requires an --admin-token, whichever
+transport of the admin API is used:
+
+   go-cache-plugin serve ... --defer-uploads --admin-token=$TOKEN
+   ... run the builds ...
+   curl -X POST -H "Authorization: Bearer $TOKEN" http://$HOST/admin/commit
+
+The commit operation uploads the deferred entries still in the local cache,
+and discard forgets them. Either applies to everything deferred since the last
+one, so a server with --defer-uploads should serve one build (or pipeline) at
+a time. Each entry is written to the first namespace of the client that
+stored it (see "help namespace-chain").
+
+Deferred uploads are not recorded in the upload journal: if the process exits
+before they are committed, they are lost, as if the build had failed. The
+put_deferred metric of the build cache counts them.`,
+	},
+	{
+		Name: "relocate",
+		Help: `Move the remote cache to a new bucket or key prefix.
+
+To rename the --prefix of the cache, or move it to another --bucket, without
+every build starting over with a cold cache, configure the plugins and servers
+with the new location, and set --fallback-bucket and --fallback-prefix to the
+old one:
+
+   go-cache-plugin --bucket=$NEW --prefix=team-a \
+      --fallback-bucket=$OLD --fallback-prefix=gocache ...
+
+If only one of the two fallback flags is set, the other is the same as for
+the new location; to move entries stored with no prefix within the same
+bucket, set --fallback-bucket to that bucket.
+
+With a fallback, the build cache looks for entries missing from the new
+location in the old one (dual-read), and writes new entries only to the new
+location. Meanwhile, copy the existing entries from the old location to the
+new one with the "migrate-prefix" command, using the same flags:
+
+   go-cache-plugin --bucket=$NEW --prefix=team-a \
+      --fallback-bucket=$OLD --fallback-prefix=gocache migrate-prefix
+
+Once the copy is complete, remove the fallback flags. The metric
+get_fallback_hit counts the entries found in the old location, and should
+fall to zero once the copy is done.
+
+Only the build cache reads from the fallback. The module and package proxies
+fetch entries missing from the new location from their upstream sources, and
+the copy covers their entries as well. Both locations must use the same
+--key-transform.`,
+	},
+	{
+		Name: "replica",
+		Help: `Mirror the build cache to a bucket in another region.
+
+To keep the build cache available during an outage of S3 in the region of the
+--bucket, set --s3-replica-bucket to a second bucket, usually in another
+region, and --s3-replica-region to its region if --region is set:
+
+   go-cache-plugin --bucket=gocache-us --region=us-east-1 \
+      --s3-replica-bucket=gocache-eu --s3-replica-region=eu-west-1 ...
+
+Each entry written to the --bucket is then copied to the replica in the
+background, under the same --prefix. The copy is made by S3, so the contents
+are not uploaded twice, but the credentials used must be able to read the
+--bucket and write the replica. When a read from the --bucket fails, rather
+than reporting a miss, the build cache reads the entry from the replica.
+
+When several reads from the --bucket in a row fail, the build cache stops
+waiting for it: for the --s3-replica-failover period (30s by default), reads
+go to the replica first, and to the --bucket only if the replica fails. Then
+the --bucket is tried again. To fail over when the --bucket is slow as well as
+when it fails, set --s3-replica-slow-read to the time to read an action beyond
+which a read counts as failed:
+
+   go-cache-plugin --bucket=gocache-us --region=us-east-1 \
+      --s3-replica-bucket=gocache-eu --s3-replica-region=eu-west-1 \
+      --s3-replica-slow-read=2s --s3-replica-failover=1m ...
+
+The counter_labelmap_region_gocache_s3_hit metric counts the hits read from
+S3 by the region that served them, so that a dashboard shows when and how
+much of the cache is served by the replica.
+
+Mirroring is best-effort: a copy that fails, or that finds too many copies
+waiting, is dropped, and the entry is missing from the replica until it is
+written again. The metrics put_replica, put_replica_dropped, and
+put_replica_error count the copies made, dropped, and failed; get_failover
+counts the reads sent to the replica, and get_replica_hit those it answered.
+
+Entries written while the --bucket is unavailable are not written to either
+bucket. Only the build cache uses the replica.`,
+	},
+	{
+		Name: "audit",
+		Help: `Record the cache hits that contributed to a build.
+
+With the --audit flag, the cache records each hit it serves to the go command
+in a manifest, so that the cached artifacts used by a build can be accounted
+for later. Misses are not recorded, since the go command rebuilds those
+outputs itself.
+
+In direct mode, --audit names the manifest file, and entries are appended to
+it. Set it in the environment of the build:
+
+   export GOCACHE_AUDIT=/tmp/release-1.2.3.jsonl
+   go build ./...
+
+In serve mode, --audit names a directory, and the server writes a separate
+manifest for each client connection (one per invocation of the go command),
+named by the time the connection was opened.
+
+Each line of a manifest is a JSON object describing one hit:
+
+   time    -- when the hit was served (RFC 3339)
+   action  -- the action ID requested by the go command
+   output  -- the output ID served
+   size    -- the size of the object in bytes
+   sha256  -- the SHA256 digest of the object served, hex encoded
+   mtime   -- when the entry was written to the cache
+   source  -- where the entry was found: "local", "peer", or "s3"
+   origin  -- the peer address or S3 object URL, if not "local"
+
+The digest is computed from the file the go command reads, so it reflects the
+bytes that actually contributed to the build.
+
+For a record of the activity of the whole server, see "help audit-log".`,
+	},
+	{
+		Name: "audit-log",
+		Help: `Keep an audit log of cache and proxy activity.
+
+With the --audit-log flag, the server records its activity to an append-only
+log in the given directory, for security review:
+
+   go-cache-plugin serve ... --modproxy --audit-log=/var/lib/gocache/audit
+
+The log records each module zip downloaded through the module proxy, each GET
+request to the reverse proxy and the PyPI and npm proxies, and each action
+written to S3 by the build cache. Entries are written to one file per hour
+(UTC), named like 2026-10-15T13.jsonl, and files are never rewritten.
+
+Each line is a JSON object describing one event:
+
+   time     -- when it happened (RFC 3339)
+   kind     -- "module", "proxy", or "write"
+   service  -- the proxy that served it ("modproxy", "revproxy", "pypi",
+               "npm"), for modules and proxy requests
+   name     -- the module path, the URL requested, or the action ID written
+   version  -- the module version, for modules
+   object   -- the output ID written, for writes
+   status   -- the HTTP status of the response, for modules and proxy requests
+   client   -- the address of the requester
+   user     -- the user name of the requester, if known
+   auth     -- true if the requester was authenticated
+
+For the proxies, the user is the user name of the HTTP basic authentication,
+as in "help sbom". For the build cache, it is the --namespace of the build,
+and auth is set when clients must present the --plugin-key-file.
+
+With --audit-log-s3, the server also ships the log to S3, under the "audit"
+key prefix, shortly after the end of each hour and when it exits:
+
+   <prefix>/audit/2026-10-15T13/<hostname>.jsonl
+
+Files shipped for a past hour are renamed with the suffix ".shipped", and are
+not removed. The file of the current hour is shipped again when the hour ends,
+replacing the copy shipped at exit.`,
+	},
+	{
+		Name: "slowlog",
+		Help: `Report the slowest build cache requests.
+
+The build cache keeps a record of the slowest Get and Put requests it has
+handled, to help investigate tail latency without tracing infrastructure. Set
+--slowlog to the number of requests to keep (default 64), or to a negative
+value to disable it.
+
+In serve mode with --http, the record is served as JSON at /debug/slowlog. It
+is also published as the "gocache_slowlog" metric, so it is reported by
+/debug/vars and by the stats operation of the admin API.
+
+Each request is reported slowest first, as an object with the fields:
+
+   time        -- when the request started (RFC 3339)
+   op          -- "get" or "put"
+   action      -- the action ID
+   output      -- the output ID, if known
+   source      -- for a get, where it was found ("memory", "local", "peer",
+                  "s3"; omitted for a miss)
+   size        -- for a put, the size of the object in bytes
+   elapsed_ms  -- the total time taken, in milliseconds
+   queue_ms    -- for a put, how long the upload to S3 waited to start
+   disk_ms     -- time spent on the local cache directory
+   peer_ms     -- for a get, time spent fetching from peers
+   s3_ms       -- time spent reading from or writing to S3
+   err         -- the error reported, if any
+
+The time of a Put includes its upload to S3, which happens after the go
+command has been told the Put succeeded. For a get, time spent fetching from a
+peer or S3 includes writing the result to the local cache.
+
+For the distribution of latencies rather than the outliers, the build cache
+metrics include a histogram for each of get_local_latency (memory and the
+local cache), get_remote_latency (peers and S3), put_local_latency, and
+put_remote_latency (the upload to S3, from when it starts). Each is broken
+down by the size of the object: "tiny" (up to 1KiB), "small" (64KiB),
+"medium" (1MiB), "large" (16MiB), "huge", and "miss" for lookups that found
+nothing. Each size class reports the cumulative count of operations that
+took at most 1ms, 5ms, 25ms, 100ms, 500ms, 2500ms, and 10s (le_1ms ...
+le_10s), the total count, and the total time in microseconds (sum_us), so a
+slow S3 shows in every class, while many huge uploads show in one.`,
+	},
+	{
+		Name: "sbom",
+		Help: `Generate a bill of materials from proxy traffic.
+
+With the --sbom-log flag, the server records each Go module version served by
+the module proxy (and each file served by the reverse proxy) to the given
+file, so that a software bill of materials (SBOM) can be generated for the
+components used by a build or a group of builds:
+
+   go-cache-plugin serve ... --modproxy --sbom-log=/var/lib/gocache/sbom.jsonl
+
+Records are kept for --sbom-retention (default 30 days). A module is recorded
+when its zip file is served, since the go command fetches the .mod and .info
+files of modules that it does not build.
+
+To label the components used by a build, give it a namespace as the user name
+of the proxy URL. The go command sends this as HTTP basic authentication:
+
+   GOPROXY=http://build-1234@localhost:5970/mod
+
+The SBOM is served by the admin API (see "help admin"), at /admin/sbom over
+HTTP or by the SBOM method over gRPC, with these optional parameters:
+
+   since      -- include components served since this time (RFC 3339, or a
+                 duration before the present, e.g., "24h")
+   until      -- include components served before this time (same format)
+   namespace  -- include only components served to this namespace
+   format     -- "cyclonedx" (CycloneDX 1.5 JSON, the default) or "spdx"
+                 (SPDX 2.3 JSON)
+   artifacts  -- if true, also include files served by the reverse proxy
+
+For example:
+
+   curl -H "Authorization: Bearer $TOKEN" \
+      'http://localhost:5970/admin/sbom?namespace=build-1234&format=spdx'
+
+Modules are identified by package URL (for example,
+pkg:golang/golang.org/x/mod@v0.20.0), and reverse proxy files by their URL.`,
+	},
+	{
+		Name: "key-transform",
+		Help: `Transform build cache keys before they are stored in S3.
+
+By default, build cache actions and outputs are stored in S3 under their IDs
+(see "help configure"). The --key-transform flag changes how these keys are
+formed, so that an organization can enforce its own key policy. The value is a
+comma-separated list of steps, applied in order:
+
+   prefix=P  -- store keys under the additional path P (below --prefix)
+   salt=S    -- replace each ID with the SHA-256 digest of S and the ID
+   hash      -- replace each ID with the SHA-256 digest of the ID
+
+For example, to keep the entries of one team apart from others sharing the
+same bucket, so that neither can read nor overwrite those of the other:
+
+   --key-transform=prefix=team-a,salt=$TEAM_A_SALT
+
+Servers (and direct-mode plugins) sharing a bucket must use the same
+transformation to share entries. Changing the transformation does not move
+existing entries; they are simply no longer found, and age out as usual.
+
+The transformation applies only to the build cache. The local cache directory
+is not affected.`,
+	},
+	{
+		Name: "canary",
+		Help: `Try a build cache configuration change on a fraction of actions.
+
+Changes such as a new --compression or --key-transform affect every entry a
+server writes, and are hard to undo once a fleet has adopted them. To try one
+on live traffic first, set --canary-rate to the fraction of actions (from 0 to
+1) to serve with an alternate configuration, and the --canary-* flags to the
+settings under trial:
+
+   --canary-compression    -- in place of --compression
+   --canary-key-transform  -- in place of --key-transform
+   --canary-prefix         -- in place of --prefix
+
+For example, to store 5% of actions compressed with zstd under a new prefix:
+
+   --canary-rate=0.05 --canary-compression=zstd --canary-prefix=ci-zstd
+
+Actions are chosen by a hash of their IDs, so each action is always served by
+the same configuration, and servers with the same --canary-rate choose the
+same actions. Other settings are shared, and both configurations use the same
+local cache directory. An alternate key transformation or prefix starts with
+no entries in S3, so expect its hit rate to lag while it fills.
+
+The alternate configuration keeps its own build cache metrics, which are
+reported as "gocache_canary" beside "gocache_host", so that hit rates, upload
+sizes, and latencies can be compared. Remove the --canary-* flags to roll the
+trial back, or move the settings to the main flags to roll it out.`,
+	},
+	{
+		Name: "dedup",
+		Help: `Report how often uploads are skipped as duplicates.
+
+Build outputs are stored in S3 by content address, and before the cache writes
+an object it checks whether S3 already has one with the same contents. When
+many builds share a bucket, most of the objects they produce are often already
+stored by another build, so these writes are skipped.
+
+The build cache metrics count the outcome of each upload for all builds:
+
+   put_s3_object        -- objects written to S3
+   put_s3_object_bytes  -- total bytes of objects written to S3
+   put_s3_found         -- objects skipped because S3 already had them
+   put_s3_found_bytes   -- total bytes of objects skipped
+   put_s3_dedup_ratio   -- the fraction of objects that were skipped
+
+These are printed at exit in direct mode with --metrics (each run of the
+plugin is a single build), and reported as "gocache_host" by /debug/vars and
+by the stats operation of the admin API in serve mode. Adding up the metrics
+of each server gives totals for the fleet.
+
+In serve mode, the totals for each build are logged when its connection
+closes, with the message "client connection closed" and the attributes
+uploaded, uploaded_bytes, found, found_bytes, and dedup_ratio. The server does
+not hold up a build waiting for its uploads, so uploads still in progress when
+the connection closes are counted only in the metrics.`,
+	},
+	{
+		Name: "misses",
+		Help: `Report why build cache lookups miss.
+
+The build cache metrics count the hits of all lookups, and their misses by
+reason, to show where tuning --min-upload-size, --miss-ttl, and the expiration
+periods would help:
+
+   get_hit              -- lookups found in any tier
+   get_hit_ratio        -- the fraction of lookups that were hits
+   get_miss_not_local   -- misses in the local cache, when no remote tier was
+                           consulted (as with the dev profile)
+   get_miss_not_remote  -- misses in every tier consulted
+   get_miss_expired     -- actions whose object was gone from S3, as when a
+                           bucket lifecycle rule removed it
+   get_miss_error       -- lookups that failed with an error
+   get_miss_low_disk    -- misses in the local cache, when no remote tier was
+                           consulted for lack of space (see --min-free-space)
+   get_miss_small       -- remote misses whose object was then stored below
+                           --min-upload-size, so other builds miss it too
+
+The small misses are also counted under not_remote or expired. A large share
+of them means --min-upload-size is set too high for the fleet.
+
+These are printed at exit in direct mode with --metrics, and reported as
+"gocache_host" by /debug/vars and by the stats operation of the admin API in
+serve mode. The misses are also reported as "gocache_miss" with a "reason"
+label by /debug/varz, for Prometheus.
+
+In serve mode, set --summary-interval to log the hits and misses of each
+period, with the message "cache summary":
+
+   go-cache-plugin serve ... --summary-interval=10m`,
+	},
+	{
+		Name: "session-summary",
+		Help: `Summarize what the cache did for a run.
+
+When the cache is closed (at the end of the build in direct mode, or when the
+"serve" or "wrap" command exits), --print-summary prints one line to stderr,
+so that a CI log shows whether the cache helped the job:
+
+   go-cache-plugin: 1311 hits, 209 misses (86.2% hit), 412.5MiB downloaded, 38.0MiB uploaded, ~6m41s saved
+
+Set --summary-file to also write a report of the run to a JSON file, which a
+CI job can inspect after the build:
+
+   go-cache-plugin ... --summary-file=cache-summary.json
+
+   {
+     "status": "ok",
+     "time": "2024-05-01T12:00:00Z",
+     "requests": 1520,
+     "hits": 1311,
+     "misses": 209,
+     "hit_ratio": 0.8625,
+     "downloaded_bytes": 432537600,
+     "uploaded_bytes": 39845888,
+     "fetch_ms": 18231,
+     "built": 198,
+     "build_ms": 63014,
+     "time_saved_ms": 401029
+   }
+
+Downloaded bytes are the objects fetched from peers and S3; uploaded bytes are
+the objects written to S3, not counting those already present. The time saved
+is an estimate: the go command does not report how long an action would have
+taken to build, so the plugin measures the time between each miss and the
+store of its result ("built" and "build_ms"), and charges each hit the mean of
+those, less the time spent fetching hits from peers and S3 ("fetch_ms"). It
+is zero if nothing was built. The status, and the problems listed under
+"degraded" if any, are described by "help health". The older --summary-out
+flag is an alias for --summary-file, which takes precedence if both are set.
+
+With --stats-upload, the same report is also written to the bucket, as a
+single line of JSON under
+
+   <prefix>/stats/dt=<yyyy-mm-dd>/<time>-<random>.json
+
+along with the host, GOOS, GOARCH, and Go version, the --namespace, and the
+details of the CI job taken from the environment of GitHub Actions, GitLab,
+Buildkite, CircleCI, or Jenkins (ci_provider, ci_repository, ci_branch,
+ci_commit, ci_workflow, ci_job, and ci_run_id). Runs that made no requests
+are not recorded. The objects are small, and can be queried across a fleet
+as a table partitioned by dt, as with Athena, for example:
+
+   CREATE EXTERNAL TABLE gocache_stats (
+     status string, time string, hits bigint, misses bigint, hit_ratio double,
+     downloaded_bytes bigint, uploaded_bytes bigint, time_saved_ms bigint,
+     ci_repository string, ci_branch string, ci_job string)
+   PARTITIONED BY (dt string)
+   ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe'
+   LOCATION 's3://<bucket>/<prefix>/stats/';
+
+For problems with the cache during the run, see "help health".`,
+	},
+	{
+		Name: "health",
+		Help: `Report cache health problems at the end of a run.
+
+A build can succeed while the cache behind it is degraded: uploads to S3 fail
+or are abandoned, lookups fail with errors, or the upload journal cannot be
+written. When the cache is closed (at the end of the build in direct mode, or
+when the "serve" or "wrap" command exits), each such problem is logged as a
+warning with the message "cache degraded":
+
+   subsystem=upload detail="uploads to S3 failed" count=3
+
+The problems are also listed in the report of the run written to the
+--summary-file (see "help session-summary"), whose status is then "warning":
+
+   go-cache-plugin ... --summary-file=cache-summary.json
+
+The older --summary-out flag (GOCACHE_SUMMARY_OUT) is an alias for
+--summary-file, which takes precedence if both are set.
+
+   {
+     "status": "warning",
+     "time": "2024-05-01T12:00:00Z",
+     "requests": 1520,
+     "hits": 1311,
+     ...
+     "degraded": [
+       {
+         "subsystem": "upload",
+         "detail": "uploads to S3 failed",
+         "count": 3
+       }
+     ]
+   }
+
+The status is "ok" if nothing was degraded, and "warning" otherwise. The exit
+status of the plugin is not affected, so a degraded cache never fails a build.
+The subsystems reported are:
+
+   upload    -- uploads to S3 that failed, or were still pending at exit (as
+                with the dev profile); these are recorded for "backfill"
+   lookup    -- build cache lookups that failed with an error
+   journal   -- the upload journal could not be written
+   backfill  -- the backfill manifest could not be saved`,
+	},
+	{
+		Name: "statsd",
+		Help: `Send metrics to a StatsD or DogStatsD agent.
+
+Set --statsd-addr to the UDP address of an agent, such as a local Datadog
+agent, to send it the metrics reported by /debug/vars every --statsd-interval
+(default 10s), and once more at exit. This works in direct and serve mode,
+and covers every subsystem enabled: the build cache, the proxies, and so on.
+
+   go-cache-plugin serve ... --statsd-addr=127.0.0.1:8125 --statsd-tags=team:infra
+
+Nested metrics are flattened into dotted names under --statsd-prefix (default
+"gocache"), so that the build cache hits are "gocache.gocache_host.get_hit".
+Counts, such as hits, misses, bytes, and the time spent in each tier (in
+microseconds, as "_us"), are sent as counters of their change since the
+previous flush. Levels, such as queue depths and hit ratios, are sent as
+gauges of their current values.
+
+Tags in --statsd-tags are sent with every metric in the DogStatsD format. Set
+them only if the agent understands DogStatsD.`,
+	},
+	{
+		Name: "cloudwatch",
+		Help: `Write build cache metrics for Amazon CloudWatch.
+
+Set --emf-output to write the build cache metrics every --emf-interval
+(default 1m), and once more at exit, as records in the CloudWatch Embedded
+Metric Format (EMF). Use "-" to write them to stderr beside the logs, as when
+the logs of a Lambda function or an ECS task are sent to CloudWatch Logs, or a
+path for the CloudWatch agent to follow. CloudWatch Logs extracts the metrics
+from the records, so that alarms on them can live next to the bucket.
+
+   go-cache-plugin serve ... --emf-output=- --emf-dimensions=Cluster=ci
+
+Each record reports, for the interval since the previous one:
+
+   CacheRequests  -- build cache lookups (Count)
+   CacheHits      -- build cache lookups that hit in any tier (Count)
+   CacheHitRatio  -- hits as a fraction of lookups, if any (Percent)
+   S3GetRequests  -- actions looked up in S3 (Count)
+   S3PutRequests  -- actions and objects written to S3 (Count)
+   S3PutErrors    -- writes to S3 that failed (Count)
+   UploadBytes    -- bytes of objects written to S3, before compression (Bytes)
+
+The metrics are in the --emf-namespace (default "GoCachePlugin"), with a
+"Bucket" dimension naming the --bucket, and any --emf-dimensions.`,
+	},
+	{
+		Name: "encryption",
+		Help: `Encrypt local cache entries at rest.
+
+On a build host whose disk is not encrypted, set --local-key-file to a file
+holding a 32-byte key, encoded as hex or base64, to encrypt the entries of the
+module proxy and the reverse proxy that are written to the --cache-dir. If the
+flag is not set, the key may instead be given by the GOCACHE_LOCAL_KEY
+environment variable, as when a CI job decrypts a data key from AWS KMS or a
+secrets manager before starting the plugin:
+
+   export GOCACHE_LOCAL_KEY="$(aws kms decrypt --ciphertext-blob fileb://key.enc \
+      --query Plaintext --output text)"
+
+Each entry is encrypted separately with AES-256-GCM. Entries written before a
+key was set remain readable, so a key can be added to an existing cache; to
+change the key, remove the module and revproxy directories of the cache. The
+copies of the entries in S3 are not affected; use --s3-sse to encrypt those.
+
+Build cache entries are not encrypted, since the go command reads their
+outputs directly from the --cache-dir.`,
 	},
 	{
 		Name: "debug",
@@ -147,7 +1791,25 @@ cache plugin. The value of the flag is a bit mask of:
    1:  Go build cache
    2:  Go module proxy and sum database
    4:  HTTP reverse proxy
+   8:  Python package index proxy
+  16:  npm registry proxy
+  32:  GitHub Actions cache service
+  64:  ccache/sccache blob store
+ 128:  Gradle remote build cache
+
+The default is 0 (no debug logging).
+
+Logs are written to stderr as structured records, one per line. The
+--log-format flag selects "text" (key=value pairs, the default) or "json"
+(one JSON object per line). Each record has "time", "level", and "msg" fields,
+and records from a component carry a "component" field naming it ("gobuild",
+"modproxy", "revproxy", "pypiproxy", "npmproxy", "actionscache", "blobcache", or "gradlecache").
+Per-request records are logged at debug level with the details of the request
+as separate fields.
 
-The default is 0 (no debug logging).`,
+The --log-level flag sets the minimum level of records logged: "debug",
+"info" (the default), "warn", or "error". Setting -v or --debug also enables
+general debug records. Per-request records from a component are logged only
+when its --debug bit is set, regardless of --log-level.`,
 	},
 }
@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var lsFlags struct {
+	Local bool `flag:"local,List only the --cache-dir"`
+	S3    bool `flag:"s3,List only the S3 bucket"`
+}
+
+// runLs lists the files in the --cache-dir and the objects in S3 whose paths,
+// relative to the cache directory and the --prefix, begin with one of the
+// given prefixes, or all of them if none are given.
+func runLs(env *command.Env, prefixes ...string) error {
+	local, remote := !lsFlags.S3 || lsFlags.Local, !lsFlags.Local || lsFlags.S3
+	if remote && flags.S3Bucket == "" && !lsFlags.S3 {
+		remote = false // no bucket, so list only what is local
+	}
+	if local && flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	}
+	var client *s3util.Client
+	if remote {
+		var err error
+		client, err = initS3Client(env)
+		if err != nil {
+			return err
+		}
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimLeft(prefix, "/")
+		if local {
+			if err := listLocal(prefix); err != nil {
+				return fmt.Errorf("list cache directory: %w", err)
+			}
+		}
+		if remote {
+			if err := client.List(env.Context(), keyPrefixDir()+prefix, func(obj s3util.ObjectInfo) error {
+				fmt.Printf("s3\t%d\t%s\t%s\n", obj.Size, obj.ModTime.UTC().Format(time.RFC3339), obj.Key)
+				return nil
+			}); err != nil {
+				return fmt.Errorf("list bucket: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// listLocal prints the files in the --cache-dir whose paths relative to it
+// begin with prefix.
+func listLocal(prefix string) error {
+	// Walk only the directory that can contain matches.
+	start := flags.CacheDir
+	if dir, _ := path.Split(prefix); dir != "" {
+		start = filepath.Join(flags.CacheDir, filepath.FromSlash(dir))
+	}
+	return filepath.WalkDir(start, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(flags.CacheDir, p)
+		if !strings.HasPrefix(filepath.ToSlash(rel), prefix) {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		fmt.Printf("local\t%d\t%s\t%s\n", fi.Size(), fi.ModTime().UTC().Format(time.RFC3339), p)
+		return nil
+	})
+}
+
+// runGet reports how the build cache entry for actionID is stored in the
+// --cache-dir and in S3, and reports an error if it is in neither.
+func runGet(env *command.Env, actionID string) error {
+	cache, err := initInspectCache(env, actionID)
+	if err != nil {
+		return err
+	}
+	local, remote, err := cache.Lookup(env.Context(), actionID)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	field := func(name string, value any) { fmt.Fprintf(tw, "  %s\t%v\n", name, value) }
+	formatTime := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+	if local != nil {
+		fmt.Fprintln(tw, "local:")
+		field("output", local.OutputID)
+		field("object", local.Object)
+		field("size", local.Size)
+		field("modified", formatTime(local.ModTime))
+	} else {
+		fmt.Fprintln(tw, "local:\tnot found")
+	}
+	if remote != nil {
+		fmt.Fprintln(tw, "s3:")
+		field("action", remote.ActionKey)
+		field("written", formatTime(remote.Written))
+		field("output", remote.OutputID)
+		field("kind", remote.Kind)
+		if remote.Codec != "" {
+			field("codec", remote.Codec)
+		}
+		if remote.Missing {
+			field("object", remote.Object+" (missing)")
+		} else {
+			field("object", remote.Object)
+			field("size", remote.Size)
+			field("modified", formatTime(remote.ModTime))
+		}
+	} else {
+		fmt.Fprintln(tw, "s3:\tnot found")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if local == nil && remote == nil {
+		return fmt.Errorf("action %s not found", actionID)
+	}
+	return nil
+}
+
+var catFlags struct {
+	S3 bool `flag:"s3,Read the output from S3 even if it is in the --cache-dir"`
+}
+
+// runCat copies the output of actionID to stdout, from the --cache-dir if it
+// is present there, or otherwise from S3.
+func runCat(env *command.Env, actionID string) error {
+	cache, err := initInspectCache(env, actionID)
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+	var rc io.ReadCloser
+	if !catFlags.S3 {
+		if _, diskPath, err := cache.Local.Get(ctx, actionID); err != nil {
+			return err
+		} else if diskPath != "" {
+			if rc, err = os.Open(diskPath); err != nil {
+				return err
+			}
+		}
+	}
+	if rc == nil {
+		rc, err = cache.OpenRemote(ctx, actionID)
+		if err != nil {
+			return fmt.Errorf("read action %s: %w", actionID, err)
+		}
+	}
+	defer rc.Close()
+	_, err = io.Copy(os.Stdout, rc)
+	return err
+}
+
+// initInspectCache checks that actionID is a valid action ID, and returns a
+// build cache for the --cache-dir and --bucket, for inspecting entries
+// without serving them.
+func initInspectCache(env *command.Env, actionID string) (*gobuild.S3Cache, error) {
+	if id, err := hex.DecodeString(actionID); err != nil || len(id) == 0 {
+		return nil, env.Usagef("invalid action ID %q", actionID)
+	}
+	if flags.CacheDir == "" {
+		return nil, env.Usagef("you must provide a --cache-dir")
+	}
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
+	if err != nil {
+		return nil, env.Usagef("invalid --key-transform: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := cachedir.New(flags.CacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("open local cache: %w", err)
+	}
+	return &gobuild.S3Cache{
+		Local:     dir,
+		S3Client:  client,
+		KeyPrefix: flags.KeyPrefix,
+		KeyFunc:   keyFunc,
+	}, nil
+}
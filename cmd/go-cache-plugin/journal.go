@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// journalDir is the directory in the --cache-dir holding the upload journals
+// of plugin processes, one per process. Each process holds a lock on its own
+// journal while it runs, so a journal that can be locked was left by a process
+// that exited without completing its uploads.
+const journalDir = "journal"
+
+// initJournal creates an upload journal for this process in the --cache-dir,
+// and attaches it to cache. The journals left by earlier processes are
+// replayed separately, by replayJournals.
+//
+// The caller must call closeJournal when the cache is closed. It returns the
+// IDs of actions whose uploads did not complete, and removes the journal.
+// If the journal cannot be created, as on systems without file locks, a
+// warning is logged and the cache runs without one.
+func initJournal(cache *gobuild.S3Cache) (closeJournal func() []string) {
+	dir := filepath.Join(flags.CacheDir, journalDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Warn("create upload journal failed (ignored)", "err", err)
+		return func() []string { return nil }
+	}
+	f, err := os.CreateTemp(dir, "*.journal")
+	if err == nil {
+		var ok bool
+		if ok, err = tryLock(f); !ok && err == nil {
+			err = os.ErrExist // should not happen: the file is new
+		}
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		slog.Warn("upload journal disabled", "err", err)
+		return func() []string { return nil }
+	}
+	cache.Journal = gobuild.NewJournal(f)
+	if cache.Canary != nil {
+		cache.Canary.Cache.Journal = cache.Journal
+	}
+	slog.Debug("upload journal", "path", f.Name())
+
+	var once sync.Once
+	var ids []string
+	return func() []string {
+		once.Do(func() {
+			if err := cache.Journal.Err(); err != nil {
+				slog.Warn("upload journal failed", "path", f.Name(), "err", err)
+			}
+			f.Seek(0, 0)
+			ids, _ = gobuild.ReadJournal(f)
+			f.Close()
+			os.Remove(f.Name())
+		})
+		return ids
+	}
+}
+
+// replayJournals completes, in the background using g, the uploads left in
+// the journals of earlier processes that exited before their uploads
+// completed. Journals still locked by a running process, including our own,
+// are skipped.
+func replayJournals(ctx context.Context, cache *gobuild.S3Cache, g *taskgroup.Group) {
+	old, _ := filepath.Glob(filepath.Join(flags.CacheDir, journalDir, "*.journal"))
+	if len(old) == 0 {
+		return
+	}
+	g.Run(func() {
+		for _, path := range old {
+			replayJournal(ctx, cache, path)
+		}
+	})
+}
+
+// replayJournal completes the uploads recorded in the journal at path, unless
+// the process that wrote it is still running.
+func replayJournal(ctx context.Context, cache *gobuild.S3Cache, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return // removed by another process
+	}
+	defer f.Close()
+	if ok, err := tryLock(f); err != nil || !ok {
+		return // still in use, or replayed by another process
+	}
+	st, err := cache.Replay(ctx, flags.CacheDir, f)
+	// N.B. the replayed uploads are now in our own journal.
+	if os.Remove(path) != nil {
+		f.Close() // Windows does not remove open files
+		os.Remove(path)
+	}
+	slog.Info("replayed upload journal", "path", path, "actions", st.Actions,
+		"synced", st.Synced, "errors", st.Errors, "err", err)
+}
@@ -0,0 +1,24 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix && !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// acquireLock reports an error: this system has no file locks, so standby
+// pairs are not supported.
+func acquireLock(ctx context.Context, path string) (release func(), _ error) {
+	return nil, errors.New("standby locks are not supported on this system")
+}
+
+// tryLock reports an error: this system has no file locks, so the upload
+// journal is disabled.
+func tryLock(f *os.File) (bool, error) {
+	return false, errors.New("file locks are not supported on this system")
+}
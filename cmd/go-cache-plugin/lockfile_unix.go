@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// acquireLock acquires an exclusive advisory lock on the file at path,
+// creating it if necessary, and blocks until the lock is held or ctx ends.
+// The caller must call release to release the lock; release is idempotent.
+func acquireLock(ctx context.Context, path string) (release func(), _ error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	for waiting := false; ; {
+		err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		} else if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+		if !waiting {
+			slog.Info("standby: waiting for lock", "path", path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unix.Flock(fd, unix.LOCK_UN)
+			f.Close()
+		})
+	}, nil
+}
+
+// tryLock acquires an exclusive advisory lock on f without blocking. It
+// reports false if another process holds the lock. The lock is released when
+// f is closed.
+func tryLock(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
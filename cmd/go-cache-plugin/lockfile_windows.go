@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// allBytes is the length of a lock on the whole of a file.
+const allBytes = ^uint32(0)
+
+// acquireLock acquires an exclusive lock on the file at path, creating it if
+// necessary, and blocks until the lock is held or ctx ends. The caller must
+// call release to release the lock; release is idempotent.
+func acquireLock(ctx context.Context, path string) (release func(), _ error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for waiting := false; ; {
+		ok, err := tryLock(f)
+		if ok {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !waiting {
+			slog.Info("standby: waiting for lock", "path", path)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			windows.UnlockFileEx(windows.Handle(f.Fd()), 0, allBytes, allBytes, new(windows.Overlapped))
+			f.Close()
+		})
+	}, nil
+}
+
+// tryLock acquires an exclusive lock on f without blocking. It reports false
+// if another process holds the lock. The lock is released when f is closed.
+func tryLock(f *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, allBytes, allBytes, new(windows.Overlapped))
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
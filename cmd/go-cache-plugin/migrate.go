@@ -0,0 +1,345 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var migrateFlags struct {
+	DestBucket string `flag:"dest-bucket,S3 bucket to copy to (default: --bucket)"`
+	Checkpoint string `flag:"checkpoint,File recording the progress of the copy, to resume it if interrupted"`
+	DryRun     bool   `flag:"n,Report what would be copied without copying"`
+}
+
+// runMigratePrefix copies the entries stored under the --fallback-bucket and
+// --fallback-prefix, or else under the --bucket and --prefix, to the
+// --dest-bucket (by default, the --bucket) under the --prefix. Entries already
+// present at the destination are not copied, since they were written more
+// recently.
+func runMigratePrefix(env *command.Env) error {
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	fb, err := initFallback(env, client)
+	if err != nil {
+		return err
+	}
+	src, srcPrefix := client, flags.KeyPrefix
+	if fb != nil {
+		src, srcPrefix = fb.S3Client, fb.KeyPrefix
+	} else if migrateFlags.DestBucket == "" {
+		return env.Usagef("you must set --fallback-bucket, --fallback-prefix, or --dest-bucket to migrate")
+	}
+	dst := client
+	if b := migrateFlags.DestBucket; b != "" && b != client.Bucket {
+		dst, err = newS3Client(env, b)
+		if err != nil {
+			return err
+		}
+	}
+	pc := &prefixCopy{
+		src:        src,
+		srcDir:     prefixDir(srcPrefix),
+		dst:        dst,
+		dstDir:     keyPrefixDir(),
+		dryRun:     migrateFlags.DryRun,
+		checkpoint: migrateFlags.Checkpoint,
+	}
+	if src.Bucket == dst.Bucket && pc.srcDir == pc.dstDir {
+		return env.Usagef("the destination must differ from the source")
+	}
+	return pc.run(env.Context())
+}
+
+var migrateAliasFlags struct {
+	FromPrefix string `flag:"from-prefix,Key prefix in the --bucket to copy from"`
+	ToPrefix   string `flag:"to-prefix,Key prefix to copy to"`
+}
+
+// runMigrate copies the entries stored in the --bucket under --from-prefix to
+// --to-prefix, by running "migrate-prefix" with the --bucket and
+// --from-prefix as the fallback, and --to-prefix as the --prefix.
+func runMigrate(env *command.Env) error {
+	from, to := migrateAliasFlags.FromPrefix, migrateAliasFlags.ToPrefix
+	flags.KeyPrefix = to
+	flags.FallbackBkt, flags.FallbackPfx = "", ""
+	if prefixDir(from) != prefixDir(to) {
+		flags.FallbackBkt, flags.FallbackPfx = flags.S3Bucket, from
+	} else if migrateFlags.DestBucket == "" {
+		return env.Usagef("you must set --from-prefix and --to-prefix to different prefixes, or set --dest-bucket")
+	}
+	return runMigratePrefix(env)
+}
+
+// prefixDir returns prefix with any leading and trailing slashes removed, and
+// a single trailing slash added if the result is non-empty.
+func prefixDir(prefix string) string {
+	if p := strings.Trim(prefix, "/"); p != "" {
+		return p + "/"
+	}
+	return ""
+}
+
+// A prefixCopy copies the objects under one key prefix to another, possibly
+// in a different bucket. The copies are made by S3. Objects already present at
+// the destination are not copied, since they were written more recently.
+type prefixCopy struct {
+	src, dst       *s3util.Client
+	srcDir, dstDir string // key prefixes, with a trailing slash if non-empty
+	dryRun         bool
+	checkpoint     string // if non-empty, a file recording progress
+
+	nfound, ncopied, nskipped, nerrors atomic.Int64
+}
+
+// A copyCheckpoint records the progress of a prefixCopy, so that the copy can
+// resume where it stopped.
+type copyCheckpoint struct {
+	From  string `json:"from"`  // the source, as s3://bucket/prefix
+	To    string `json:"to"`    // the destination, as s3://bucket/prefix
+	Phase string `json:"phase"` // the phase in progress
+	After string `json:"after"` // the last key of the phase that is complete
+}
+
+// Phases of a prefixCopy. The build cache actions are copied after everything
+// else, so that a reader of the destination does not find an action whose
+// object is not yet there.
+const (
+	phaseObjects = "objects"
+	phaseActions = "actions"
+)
+
+func (pc *prefixCopy) run(ctx context.Context) error {
+	cp := copyCheckpoint{
+		From:  "s3://" + pc.src.Bucket + "/" + pc.srcDir,
+		To:    "s3://" + pc.dst.Bucket + "/" + pc.dstDir,
+		Phase: phaseObjects,
+	}
+	if pc.checkpoint != "" && !pc.dryRun {
+		if err := pc.loadCheckpoint(&cp); err != nil {
+			return err
+		}
+	}
+
+	// If the destination is nested within the source, do not copy what is
+	// already there.
+	inDst := func(key string) bool {
+		return pc.src.Bucket == pc.dst.Bucket && pc.dstDir != "" && strings.HasPrefix(key, pc.dstDir)
+	}
+	// With a --key-transform prefix, actions are not at the top level.
+	isAction := func(key string) bool {
+		rel := strings.TrimPrefix(key, pc.srcDir)
+		return strings.HasPrefix(rel, "action/") || strings.Contains(rel, "/action/")
+	}
+
+	var lerr error
+	if cp.Phase == phaseObjects {
+		lerr = pc.copyPhase(ctx, &cp, func(key string) bool { return inDst(key) || isAction(key) })
+		if lerr == nil && pc.nerrors.Load() == 0 {
+			cp.Phase, cp.After = phaseActions, ""
+		}
+	}
+	if cp.Phase == phaseActions && lerr == nil && pc.nerrors.Load() == 0 {
+		lerr = pc.copyPhase(ctx, &cp, func(key string) bool { return inDst(key) || !isAction(key) })
+	}
+	slog.Info("migrate complete", "from", cp.From, "to", cp.To,
+		"found", pc.nfound.Load(), "copied", pc.ncopied.Load(), "skipped", pc.nskipped.Load(), "errors", pc.nerrors.Load())
+	if lerr != nil {
+		return fmt.Errorf("list bucket: %w", lerr)
+	} else if pc.nerrors.Load() != 0 {
+		return errors.New("some entries could not be copied")
+	}
+	if pc.checkpoint != "" && !pc.dryRun {
+		if err := os.Remove(pc.checkpoint); err != nil && !os.IsNotExist(err) {
+			slog.Warn("remove checkpoint failed", "path", pc.checkpoint, "err", err)
+		}
+	}
+	return nil
+}
+
+// copyPhase copies the objects under the source prefix that sort after
+// cp.After and are not skipped. On return, cp.After is the last key of the
+// listing whose copy, and those of all keys before it, succeeded; if there is
+// a checkpoint file, that progress is recorded there, as it is periodically
+// while the copy runs.
+//
+// Once a copy fails, the progress cannot pass its key, so the listing stops
+// rather than track ever more keys behind it; the copies already started are
+// finished, and the failure is reported by the caller.
+func (pc *prefixCopy) copyPhase(ctx context.Context, cp *copyCheckpoint, skip func(string) bool) error {
+	if cp.After != "" {
+		slog.Info("resuming migration", "phase", cp.Phase, "after", cp.After)
+	}
+	var wm watermark
+	wm.last = cp.After
+	save := func() {
+		if pc.checkpoint == "" || pc.dryRun {
+			return
+		}
+		cp.After = wm.Last()
+		if err := pc.saveCheckpoint(cp); err != nil {
+			slog.Warn("save checkpoint failed", "path", pc.checkpoint, "err", err)
+		}
+	}
+	stop := pc.saveEvery(ctx, 30*time.Second, save)
+
+	var failed atomic.Bool
+	g, start := taskgroup.New(nil).Limit(cmp.Or(flags.S3Concurrency, runtime.NumCPU()))
+	lerr := pc.src.ListAfter(ctx, pc.srcDir, cp.After, func(obj s3util.ObjectInfo) error {
+		if failed.Load() {
+			return errCopyFailed
+		}
+		mark := wm.Add(obj.Key)
+		if skip(obj.Key) {
+			wm.Done(mark)
+			return nil
+		}
+		pc.nfound.Add(1)
+		key := pc.dstDir + strings.TrimPrefix(obj.Key, pc.srcDir)
+		if pc.dryRun {
+			fmt.Printf("%d\t%s\t%s\n", obj.Size, obj.Key, key)
+			wm.Done(mark)
+			return nil
+		}
+		start(func() error {
+			if ok, err := pc.dst.Exists(ctx, key); err == nil && ok {
+				pc.nskipped.Add(1)
+			} else if err := pc.dst.CopyFrom(ctx, pc.src, obj.Key, key); err != nil {
+				pc.nerrors.Add(1)
+				failed.Store(true)
+				slog.Warn("copy failed", "key", obj.Key, "err", err)
+				return nil // the watermark stops here, so a resume retries it
+			} else {
+				pc.ncopied.Add(1)
+			}
+			wm.Done(mark)
+			return nil
+		})
+		return nil
+	})
+	g.Wait()
+	stop()
+	save()
+	if errors.Is(lerr, errCopyFailed) {
+		return nil // reported by the caller
+	}
+	return lerr
+}
+
+// errCopyFailed stops the listing of a copyPhase once a copy has failed.
+var errCopyFailed = errors.New("copy failed")
+
+// saveEvery calls save every interval until the returned function is called
+// or ctx ends.
+func (pc *prefixCopy) saveEvery(ctx context.Context, interval time.Duration, save func()) (stop func()) {
+	if pc.checkpoint == "" || pc.dryRun {
+		return noop
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				save()
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
+
+// loadCheckpoint reads the checkpoint file into cp, if it exists. It reports
+// an error if the file records a copy between other locations.
+func (pc *prefixCopy) loadCheckpoint(cp *copyCheckpoint) error {
+	data, err := os.ReadFile(pc.checkpoint)
+	if os.IsNotExist(err) {
+		return nil // a new copy
+	} else if err != nil {
+		return err
+	}
+	var saved copyCheckpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid checkpoint %q: %w", pc.checkpoint, err)
+	}
+	if saved.From != cp.From || saved.To != cp.To {
+		return fmt.Errorf("checkpoint %q is for a copy from %s to %s", pc.checkpoint, saved.From, saved.To)
+	} else if saved.Phase != phaseObjects && saved.Phase != phaseActions {
+		return fmt.Errorf("checkpoint %q has unknown phase %q", pc.checkpoint, saved.Phase)
+	}
+	*cp = saved
+	return nil
+}
+
+// saveCheckpoint writes cp to the checkpoint file.
+func (pc *prefixCopy) saveCheckpoint(cp *copyCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteData(pc.checkpoint, data, 0644)
+}
+
+// A watermark tracks the keys of a listing whose tasks complete out of order,
+// and reports the last key such that the tasks of it and all the keys before
+// it are done.
+type watermark struct {
+	mu      sync.Mutex
+	pending []*watermarkKey // in listing order
+	last    string
+}
+
+type watermarkKey struct {
+	key  string
+	done bool
+}
+
+// Add records the next key of the listing, and returns a mark for it.
+func (w *watermark) Add(key string) *watermarkKey {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := &watermarkKey{key: key}
+	w.pending = append(w.pending, k)
+	return k
+}
+
+// Done records that the task for the key of k is done.
+func (w *watermark) Done(k *watermarkKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k.done = true
+	for len(w.pending) != 0 && w.pending[0].done {
+		w.last = w.pending[0].key
+		w.pending = w.pending[1:]
+	}
+}
+
+// Last returns the last key such that it and all the keys before it are done.
+func (w *watermark) Last() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/creachadair/command"
+)
+
+// prefixVar matches a template variable in a key prefix, "{NAME}" or
+// "{NAME:-default}".
+var prefixVar = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^{}]*))?\}`)
+
+// prefixDefault returns the value of a variable not set in the environment,
+// or "" if it has none.
+func prefixDefault(name string) string {
+	switch name {
+	case "GOOS":
+		return runtime.GOOS
+	case "GOARCH":
+		return runtime.GOARCH
+	case "GOVERSION":
+		return toolchainVersion()
+	}
+	return ""
+}
+
+// toolchainVersion reports the version of the Go toolchain that runs the
+// plugin, as printed by "go env GOVERSION", or "" if it cannot be run. This
+// may differ from the version the plugin was built with. The toolchain is
+// the one in $GOROOT, if set, and otherwise the one in $PATH.
+var toolchainVersion = sync.OnceValue(func() string {
+	gocmd := "go"
+	if root := os.Getenv("GOROOT"); root != "" {
+		gocmd = filepath.Join(root, "bin", "go")
+	}
+	out, err := exec.Command(gocmd, "env", "GOVERSION").Output()
+	if err != nil {
+		slog.Debug("go env GOVERSION failed", "err", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+})
+
+// expandPrefix expands the template variables in a key prefix from the
+// environment. The value of each variable is made safe for use as a single
+// component of an S3 key, by replacing each character other than letters,
+// digits, ".", "_", and "-" with "-". It is an error for a variable without a
+// default to be unset or empty.
+//
+// Backslashes in the prefix, as in one written as a Windows path, are replaced
+// by slashes, so that builds on every platform use the same keys.
+func expandPrefix(prefix string) (string, error) {
+	prefix = strings.ReplaceAll(prefix, `\`, "/")
+	var errs []error
+	out := prefixVar.ReplaceAllStringFunc(prefix, func(m string) string {
+		sub := prefixVar.FindStringSubmatch(m)
+		name, def := sub[1], sub[2]
+		val := os.Getenv(name)
+		if val == "" {
+			val = prefixDefault(name)
+		}
+		if val == "" {
+			val = def
+		}
+		val = strings.Map(func(r rune) rune {
+			if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("._-", r) {
+				return r
+			}
+			return '-'
+		}, val)
+		if val == "" {
+			errs = append(errs, fmt.Errorf("variable %s is not set", name))
+		} else if strings.Trim(val, ".") == "" {
+			errs = append(errs, fmt.Errorf("variable %s has invalid value %q", name, val))
+		}
+		return val
+	})
+	if strings.ContainsAny(out, "{}") {
+		errs = append(errs, fmt.Errorf("invalid template %q", prefix))
+	}
+	return out, errors.Join(errs...)
+}
+
+// expandTags expands the template variables in the values of the object tags
+// given by --s3-tags from the environment, as for a key prefix. The value of
+// each variable is made safe for use in a tag, by replacing each character S3
+// does not allow in tags with "-". Unlike in a key prefix, a variable may be
+// unset, and then expands to its default, if any, or else to nothing.
+func expandTags(tags string) string {
+	return prefixVar.ReplaceAllStringFunc(tags, func(m string) string {
+		sub := prefixVar.FindStringSubmatch(m)
+		name, def := sub[1], sub[2]
+		val := cmp.Or(os.Getenv(name), prefixDefault(name), def)
+		return strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" +-=._:/@", r) {
+				return r
+			}
+			return '-'
+		}, val)
+	})
+}
+
+// expandPrefixFlags expands the template variables of the --prefix,
+// --fallback-prefix, and --canary-prefix flags in place. A templated fallback
+// that expands to the location of the cache itself, as for a build of the
+// branch it names, is dropped, since there is nothing else to read.
+func expandPrefixFlags(env *command.Env) error {
+	templated := prefixVar.MatchString(flags.FallbackPfx)
+	for _, f := range []struct {
+		name string
+		val  *string
+	}{
+		{"--prefix", &flags.KeyPrefix},
+		{"--fallback-prefix", &flags.FallbackPfx},
+		{"--canary-prefix", &flags.CanaryPrefix},
+	} {
+		out, err := expandPrefix(*f.val)
+		if err != nil {
+			return env.Usagef("invalid %s: %v", f.name, err)
+		}
+		*f.val = out
+	}
+	if flags.ReadPrefixes != "" {
+		if err := initReadPrefixes(); err != nil {
+			return env.Usagef("invalid --read-prefixes: %v", err)
+		}
+	}
+	if templated && flags.FallbackPfx == flags.KeyPrefix && (flags.FallbackBkt == "" || flags.FallbackBkt == flags.S3Bucket) {
+		flags.FallbackBkt, flags.FallbackPfx = "", ""
+	}
+	return nil
+}
+
+// readPrefixes are the key prefixes of the build cache given by --read-prefixes
+// after the first, which are read but not written.
+var readPrefixes []string
+
+// initReadPrefixes expands the template variables of --read-prefixes, and sets
+// --prefix to the first of them, which it must match if it is also set.
+func initReadPrefixes() error {
+	var all []string
+	for _, pfx := range strings.Split(flags.ReadPrefixes, ",") {
+		pfx, err := expandPrefix(strings.Trim(strings.TrimSpace(pfx), "/"))
+		if err != nil {
+			return err
+		} else if pfx == "" {
+			return errors.New("empty prefix")
+		} else if slices.Contains(all, pfx) {
+			return fmt.Errorf("duplicate prefix %q", pfx)
+		}
+		all = append(all, pfx)
+	}
+	if flags.KeyPrefix != "" && flags.KeyPrefix != all[0] {
+		return fmt.Errorf("first prefix %q does not match --prefix %q", all[0], flags.KeyPrefix)
+	}
+	flags.KeyPrefix, readPrefixes = all[0], all[1:]
+	return nil
+}
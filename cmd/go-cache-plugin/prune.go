@@ -0,0 +1,245 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var pruneFlags struct {
+	OlderThan string        `flag:"older-than,Prune entries last written longer ago than this, as a duration or a number of days like 30d (required)"`
+	Force     bool          `flag:"force,Prune even if the bucket is not versioned (deletes are permanent)"`
+	DryRun    bool          `flag:"n,Report what would be pruned without deleting"`
+	Progress  time.Duration `flag:"progress,default=10s,Interval between progress reports (0 to disable)"`
+}
+
+// runPrune deletes stale entries from the remote cache in batches. Unlike
+// "purge", it knows the key layout of the bucket: it leaves alone the records
+// kept under the key prefix that are not cache entries, keeps the build
+// outputs that surviving actions still refer to, and reports what it pruned
+// from each part of the cache.
+func runPrune(env *command.Env) error {
+	age, err := parseAge(pruneFlags.OlderThan)
+	if err != nil {
+		return env.Usagef("invalid --older-than: %v", err)
+	} else if age <= 0 {
+		return env.Usagef("you must provide a positive --older-than duration")
+	}
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
+	if err != nil {
+		return env.Usagef("invalid --key-transform: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+	versioned, err := client.Versioned(ctx)
+	if err != nil {
+		return fmt.Errorf("check bucket versioning: %w", err)
+	}
+	if !versioned && !pruneFlags.Force && !pruneFlags.DryRun {
+		return errors.New("bucket versioning is not enabled, so a prune cannot be undone (use --force to prune anyway)")
+	}
+
+	p := &pruner{
+		client: client,
+		cache: &gobuild.S3Cache{
+			S3Client:          client,
+			KeyPrefix:         flags.KeyPrefix,
+			KeyFunc:           keyFunc,
+			UploadConcurrency: flags.S3Concurrency,
+			Logger:            slog.Default(),
+		},
+		dir:    keyPrefixDir(),
+		cutoff: time.Now().Add(-age),
+		byArea: make(map[string]int64),
+	}
+	p.g, p.start = taskgroup.New(nil).Limit(cmp.Or(flags.S3Concurrency, runtime.NumCPU()))
+	stop := p.reportProgress(ctx, pruneFlags.Progress)
+
+	// Prune the stale actions before the objects: an object may be older
+	// than the actions that refer to it, so only the objects that no
+	// surviving action refers to can be pruned by age.
+	var lerr error
+	p.live, lerr = p.cache.ScanActions(ctx, p.cutoff, p.visitAction)
+	p.flush()
+	p.g.Wait()
+	if lerr == nil {
+		lerr = client.List(ctx, p.dir, p.visit)
+		p.flush()
+		p.g.Wait()
+	}
+	stop()
+
+	for area, n := range p.byArea {
+		slog.Info("pruned area", "area", area, "entries", n)
+	}
+	slog.Info("prune complete", "scanned", p.nscanned.Load(), "found", p.nfound.Load(), "older_than", age,
+		"bytes", p.nbytes.Load(), "deleted", p.ndeleted.Load(), "kept", p.nkept.Load(),
+		"errors", p.nerrors.Load(), "versioned", versioned, "dry_run", pruneFlags.DryRun)
+	if lerr != nil {
+		return fmt.Errorf("list bucket: %w", lerr)
+	} else if p.nerrors.Load() != 0 {
+		return errors.New("some entries could not be deleted")
+	}
+	return nil
+}
+
+// A pruner collects stale keys from a listing of the bucket and deletes them
+// in batches.
+type pruner struct {
+	client *s3util.Client
+	cache  *gobuild.S3Cache // the layout of the build cache in the bucket
+	dir    string           // the key prefix, with a trailing slash if non-empty
+	cutoff time.Time        // entries last written before this are stale
+	live   map[string]bool  // keys of objects referenced by surviving actions
+
+	g     *taskgroup.Group
+	start taskgroup.StartFunc
+	batch []string // stale keys not yet deleted
+
+	byArea map[string]int64 // stale entries by area of the cache
+
+	nscanned, nfound, nkept, nbytes atomic.Int64
+	ndeleted, nerrors               atomic.Int64
+}
+
+// visitAction is the callback for the stale action records found by a scan
+// of the build cache, which are scanned before the rest of the bucket.
+func (p *pruner) visitAction(obj s3util.ObjectInfo) {
+	p.nscanned.Add(1)
+	p.prune(obj)
+}
+
+// visit is the callback for a listing of the bucket. The listing calls it
+// serially, so only the deletions run concurrently.
+func (p *pruner) visit(obj s3util.ObjectInfo) error {
+	kind := p.cache.EntryKind(obj.Key)
+	if kind == "action" {
+		return nil // already scanned
+	}
+	p.nscanned.Add(1)
+	if !obj.ModTime.Before(p.cutoff) {
+		return nil
+	}
+	rel := strings.TrimPrefix(obj.Key, p.dir)
+	if keepOnPrune(rel) || (kind != "" && p.live[obj.Key]) {
+		p.nkept.Add(1)
+		return nil
+	}
+	p.prune(obj)
+	return nil
+}
+
+// prune adds the stale entry obj to the pending batch, or prints it in a dry
+// run.
+func (p *pruner) prune(obj s3util.ObjectInfo) {
+	rel := strings.TrimPrefix(obj.Key, p.dir)
+	p.nfound.Add(1)
+	p.nbytes.Add(obj.Size)
+	area, _, _ := strings.Cut(rel, "/")
+	p.byArea[area]++
+	if pruneFlags.DryRun {
+		fmt.Printf("%s\t%d\t%s\n", obj.ModTime.Format(time.RFC3339), obj.Size, obj.Key)
+		return
+	}
+	p.batch = append(p.batch, obj.Key)
+	if len(p.batch) >= s3util.MaxDeleteBatch {
+		p.flush()
+	}
+}
+
+// flush starts the deletion of the pending batch of keys, if any.
+func (p *pruner) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+	keys := p.batch
+	p.batch = nil
+	p.start(func() error {
+		// Use a context that outlives an interrupt, so that a batch in
+		// flight is either deleted or reported, not abandoned.
+		failed, err := p.client.DeleteBatch(context.Background(), keys)
+		if err != nil {
+			p.nerrors.Add(int64(len(keys)))
+			slog.Warn("batch delete failed", "keys", len(keys), "first", keys[0], "err", err)
+			return nil
+		}
+		for key, err := range failed {
+			slog.Warn("delete failed", "key", key, "err", err)
+		}
+		p.nerrors.Add(int64(len(failed)))
+		p.ndeleted.Add(int64(len(keys) - len(failed)))
+		return nil
+	})
+}
+
+// reportProgress logs the progress of p every interval until the returned
+// function is called or ctx ends. If interval <= 0, it does nothing.
+func (p *pruner) reportProgress(ctx context.Context, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return noop
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				slog.Info("prune progress", "scanned", p.nscanned.Load(), "found", p.nfound.Load(),
+					"deleted", p.ndeleted.Load(), "errors", p.nerrors.Load())
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
+
+// keepOnPrune reports whether the object at rel, a key relative to the key
+// prefix, should survive a prune regardless of its age because it is not a
+// cache entry: the audit log, the zstd dictionaries that objects may still be
+// compressed with, and the latest tree head accepted from each checksum
+// database, which later tree heads are checked against.
+func keepOnPrune(rel string) bool {
+	if strings.HasPrefix(rel, "audit/") || strings.HasPrefix(rel, "dict/") {
+		return true
+	}
+	if rest, ok := strings.CutPrefix(rel, "sumdb/"); ok {
+		_, name, _ := strings.Cut(rest, "/")
+		return name == "latest"
+	}
+	return false
+}
+
+// parseAge parses an age given as a Go duration such as "36h", or as a whole
+// number of days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
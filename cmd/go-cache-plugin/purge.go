@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+var purgeFlags struct {
+	OlderThan time.Duration `flag:"older-than,Purge entries last written longer ago than this (required)"`
+	Force     bool          `flag:"force,Purge even if the bucket is not versioned (deletes are permanent)"`
+	DryRun    bool          `flag:"n,Report what would be purged without deleting"`
+}
+
+// runPurge deletes entries from the remote cache that were last written more
+// than --older-than ago. On a versioned bucket, this leaves delete markers so
+// the entries can be restored by "undelete".
+func runPurge(env *command.Env) error {
+	if purgeFlags.OlderThan <= 0 {
+		return env.Usagef("you must provide a positive --older-than duration")
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+	versioned, err := client.Versioned(ctx)
+	if err != nil {
+		return fmt.Errorf("check bucket versioning: %w", err)
+	}
+	if !versioned && !purgeFlags.Force && !purgeFlags.DryRun {
+		return errors.New("bucket versioning is not enabled, so a purge cannot be undone (use --force to purge anyway)")
+	}
+
+	cutoff := time.Now().Add(-purgeFlags.OlderThan)
+	var nfound, ndeleted, nerrors atomic.Int64
+	g, start := taskgroup.New(nil).Limit(cmp.Or(flags.S3Concurrency, runtime.NumCPU()))
+	lerr := client.List(ctx, keyPrefixDir(), func(obj s3util.ObjectInfo) error {
+		if !obj.ModTime.Before(cutoff) {
+			return nil
+		}
+		nfound.Add(1)
+		if purgeFlags.DryRun {
+			fmt.Printf("%s\t%d\t%s\n", obj.ModTime.Format(time.RFC3339), obj.Size, obj.Key)
+			return nil
+		}
+		start(func() error {
+			if err := client.Delete(ctx, obj.Key); err != nil {
+				nerrors.Add(1)
+				slog.Warn("delete failed", "key", obj.Key, "err", err)
+			} else {
+				ndeleted.Add(1)
+			}
+			return nil
+		})
+		return nil
+	})
+	g.Wait()
+	slog.Info("purge complete", "found", nfound.Load(), "older_than", purgeFlags.OlderThan,
+		"deleted", ndeleted.Load(), "errors", nerrors.Load(), "versioned", versioned)
+	if lerr != nil {
+		return fmt.Errorf("list bucket: %w", lerr)
+	} else if nerrors.Load() != 0 {
+		return errors.New("some entries could not be deleted")
+	}
+	return nil
+}
+
+var undeleteFlags struct {
+	Since  time.Duration `flag:"since,Restore entries deleted within this long before present (required)"`
+	DryRun bool          `flag:"n,Report what would be restored without restoring"`
+}
+
+// runUndelete restores entries in the remote cache that were deleted within
+// --since before present, by removing their delete markers. This requires
+// that versioning be enabled on the bucket.
+func runUndelete(env *command.Env) error {
+	if undeleteFlags.Since <= 0 {
+		return env.Usagef("you must provide a positive --since duration")
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+	if versioned, err := client.Versioned(ctx); err != nil {
+		return fmt.Errorf("check bucket versioning: %w", err)
+	} else if !versioned {
+		return errors.New("bucket versioning is not enabled, so deleted entries cannot be restored")
+	}
+
+	cutoff := time.Now().Add(-undeleteFlags.Since)
+	var nfound, nrestored, nerrors atomic.Int64
+	g, start := taskgroup.New(nil).Limit(cmp.Or(flags.S3Concurrency, runtime.NumCPU()))
+	lerr := client.ListDeleteMarkers(ctx, keyPrefixDir(), func(dm s3util.ObjectInfo) error {
+		if dm.ModTime.Before(cutoff) {
+			return nil
+		}
+		nfound.Add(1)
+		if undeleteFlags.DryRun {
+			fmt.Printf("%s\t%s\n", dm.ModTime.Format(time.RFC3339), dm.Key)
+			return nil
+		}
+		start(func() error {
+			if err := client.DeleteVersion(ctx, dm.Key, dm.VersionID); err != nil {
+				nerrors.Add(1)
+				slog.Warn("restore failed", "key", dm.Key, "err", err)
+			} else {
+				nrestored.Add(1)
+			}
+			return nil
+		})
+		return nil
+	})
+	g.Wait()
+	slog.Info("undelete complete", "found", nfound.Load(), "since", undeleteFlags.Since,
+		"restored", nrestored.Load(), "errors", nerrors.Load())
+	if lerr != nil {
+		return fmt.Errorf("list bucket versions: %w", lerr)
+	} else if nerrors.Load() != 0 {
+		return errors.New("some entries could not be restored")
+	}
+	return nil
+}
+
+// keyPrefixDir returns the S3 key prefix under which all cache entries are
+// stored, including a trailing slash if --prefix is set.
+func keyPrefixDir() string {
+	if flags.KeyPrefix == "" {
+		return ""
+	}
+	return flags.KeyPrefix + "/"
+}
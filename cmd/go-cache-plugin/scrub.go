@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+var scrubFlags struct {
+	Refetch bool `flag:"refetch,Read the entries removed again from S3"`
+	DryRun  bool `flag:"n,Report the problems found without removing entries"`
+}
+
+// runScrub verifies the entries of the local cache directory against their
+// output IDs, removes those that are corrupt, and prints the problems found.
+// It reports an error if any problems remain.
+func runScrub(env *command.Env) error {
+	if flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	}
+	cache := &gobuild.S3Cache{Logger: slog.Default()}
+	if scrubFlags.Refetch && !scrubFlags.DryRun {
+		s, c, err := initCacheServer(env)
+		if err != nil {
+			return err
+		}
+		defer s.Close(env.Context())
+		cache = c
+	}
+	stats, err := cache.Scrub(env.Context(), flags.CacheDir, gobuild.ScrubOptions{
+		Refetch: scrubFlags.Refetch,
+		DryRun:  scrubFlags.DryRun,
+	}, func(p gobuild.Problem) {
+		fmt.Printf("%s\t%s\t%s\n", p.Kind, p.Key, p.Detail)
+	})
+	var nproblems int64
+	for _, n := range stats.Problems {
+		nproblems += n
+	}
+	slog.Info("scrub complete", "actions", stats.Actions, "objects", stats.Objects,
+		"corrupt", stats.Problems[gobuild.ProblemCorrupt], "missing", stats.Problems[gobuild.ProblemMissing],
+		"mismatch", stats.Problems[gobuild.ProblemMismatch], "removed", stats.Removed,
+		"refetched", stats.Refetched, "errors", stats.Errors, "elapsed", stats.Elapsed, "dry_run", scrubFlags.DryRun)
+	if err != nil {
+		return fmt.Errorf("scrub failed: %w", err)
+	} else if stats.Errors != 0 {
+		return errors.New("some entries could not be removed or read again")
+	} else if scrubFlags.DryRun && nproblems != 0 {
+		return fmt.Errorf("found %d problems", nproblems)
+	}
+	return nil
+}
@@ -4,89 +4,304 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
 	"errors"
 	"expvar"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/creachadair/command"
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
 	"github.com/creachadair/mhttp/proxyconn"
 	"github.com/creachadair/taskgroup"
-	"github.com/creachadair/tlsutil"
 	"github.com/goproxy/goproxy"
+	"github.com/grafana/go-cache-plugin/lib/actionscache"
+	"github.com/grafana/go-cache-plugin/lib/blobcache"
 	"github.com/grafana/go-cache-plugin/lib/gobuild"
 	"github.com/grafana/go-cache-plugin/lib/modproxy"
+	"github.com/grafana/go-cache-plugin/lib/npmproxy"
+	"github.com/grafana/go-cache-plugin/lib/peer"
+	"github.com/grafana/go-cache-plugin/lib/pypiproxy"
 	"github.com/grafana/go-cache-plugin/lib/revproxy"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"github.com/grafana/go-cache-plugin/lib/sbom"
+	"golang.org/x/mod/sumdb/note"
 	"tailscale.com/tsweb"
 )
 
-func initCacheServer(env *command.Env) (*gocache.Server, *s3util.Client, error) {
-	switch {
-	case flags.CacheDir == "":
+// defaultCacheDir returns the local cache directory used if --cache-dir is not
+// set, or "" if the platform has no user cache directory (see
+// [os.UserCacheDir]).
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-cache-plugin")
+}
+
+// spillDir is the slow tier of the local build cache given by --cache-dir, or
+// "" if it has only one tier (see splitCacheDir).
+var spillDir string
+
+// splitCacheDir parses a --cache-dir of the form "fast:<path>,slow:<path>",
+// setting --cache-dir to the fast tier and spillDir to the slow tier. Any
+// other --cache-dir is a single directory, and is left as it is.
+func splitCacheDir(env *command.Env) error {
+	if !strings.HasPrefix(flags.CacheDir, "fast:") && !strings.HasPrefix(flags.CacheDir, "slow:") {
+		return nil
+	}
+	var fast, slow string
+	for _, tier := range strings.Split(flags.CacheDir, ",") {
+		name, path, _ := strings.Cut(tier, ":")
+		switch {
+		case path == "":
+			return env.Usagef("invalid --cache-dir tier %q (want fast:<path> or slow:<path>)", tier)
+		case name == "fast" && fast == "":
+			fast = path
+		case name == "slow" && slow == "":
+			slow = path
+		default:
+			return env.Usagef("invalid --cache-dir tier %q (want one fast:<path> and one slow:<path>)", tier)
+		}
+	}
+	if fast == "" || slow == "" {
+		return env.Usagef("a tiered --cache-dir needs both fast:<path> and slow:<path>")
+	} else if filepath.Clean(fast) == filepath.Clean(slow) {
+		return env.Usagef("the fast and slow --cache-dir tiers must differ")
+	}
+	flags.CacheDir, spillDir = fast, slow
+	return nil
+}
+
+func initCacheServer(env *command.Env) (*gocache.Server, *gobuild.S3Cache, error) {
+	if flags.CacheDir == "" && !flags.Diskless {
 		return nil, nil, env.Usagef("you must provide a --cache-dir")
-	case flags.S3Bucket == "":
-		return nil, nil, env.Usagef("you must provide an S3 --bucket name")
 	}
-	region, err := getBucketRegion(env.Context(), flags.S3Bucket)
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
 	if err != nil {
-		return nil, nil, env.Usagef("you must provide an S3 --region name")
+		return nil, nil, env.Usagef("invalid --key-transform: %v", err)
 	}
-
-	dir, err := cachedir.New(flags.CacheDir)
+	testPolicy, err := gobuild.ParseTestPolicy(flags.TestResults)
 	if err != nil {
-		return nil, nil, fmt.Errorf("create local cache: %w", err)
+		return nil, nil, env.Usagef("invalid --test-results: %v", err)
 	}
-
-	opts := []func(*config.LoadOptions) error{
-		config.WithRegion(region),
-		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	codec, err := gobuild.ParseCodec(flags.Compression)
+	if err != nil {
+		return nil, nil, env.Usagef("invalid --compression: %v", err)
 	}
-	if flags.S3Endpoint != "" {
-		vprintf("S3 endpoint URL: %s", flags.S3Endpoint)
-		opts = append(opts, config.WithBaseEndpoint(flags.S3Endpoint))
+	dropPolicy, err := gobuild.ParseDropPolicy(flags.UploadDrop)
+	if err != nil {
+		return nil, nil, env.Usagef("invalid --upload-drop: %v", err)
 	}
-	cfg, err := config.LoadDefaultConfig(env.Context(), opts...)
+	client, err := initS3Client(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	fallback, err := initFallback(env, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	replica, err := initReplica(env, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	peers, err := initPeerClient(env)
 	if err != nil {
-		return nil, nil, fmt.Errorf("load AWS config: %w", err)
+		return nil, nil, err
 	}
 
-	vprintf("local cache directory: %s", flags.CacheDir)
-	vprintf("S3 cache bucket %q (%s)", flags.S3Bucket, region)
-	client := &s3util.Client{
-		Client: s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.UsePathStyle = flags.S3PathStyle
-		}),
-		Bucket: flags.S3Bucket,
+	if flags.Diskless && spillDir != "" {
+		return nil, nil, env.Usagef("--diskless cannot be used with a tiered --cache-dir")
+	}
+	if flags.Diskless {
+		// Nothing is kept across runs, so stage entries where the go command
+		// can read them only for as long as this process lives.
+		tmp, err := os.MkdirTemp("", "go-cache-plugin-")
+		if err != nil {
+			return nil, nil, fmt.Errorf("create temporary cache: %w", err)
+		}
+		flags.CacheDir = tmp
+	}
+	dir, err := cachedir.New(flags.CacheDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create local cache: %w", err)
 	}
+	slog.Debug("local cache directory", "path", flags.CacheDir, "diskless", flags.Diskless)
+
 	cache := &gobuild.S3Cache{
 		Local:             dir,
 		S3Client:          client,
 		KeyPrefix:         flags.KeyPrefix,
+		Fallback:          fallback,
+		Replica:           replica,
+		ReadPrefixes:      readPrefixes,
+		KeyFunc:           keyFunc,
 		MinUploadSize:     flags.MinUploadSize,
+		MissTTL:           flags.MissTTL,
+		TestResults:       testPolicy,
+		TestTTL:           flags.TestTTL,
+		Compression:       codec,
 		UploadConcurrency: flags.S3Concurrency,
+		AdaptiveUploads:   flags.AdaptiveUp,
+		UploadQueue:       flags.UploadQueue,
+		UploadDrop:        dropPolicy,
+		Peers:             peers,
+		Logger:            componentLogger(debugBuildCache, "gobuild"),
+
+		MultipartThreshold: flags.MultipartSize,
+		Multipart: s3util.MultipartOptions{
+			PartSize:    flags.PartSize,
+			Concurrency: flags.PartUploads,
+		},
 	}
 	cache.SetMetrics(env.Context(), expvar.NewMap("gocache_host"))
+	expvar.Publish("counter_labelmap_reason_gocache_miss", cache.MissMetrics())
+	expvar.Publish("counter_labelmap_region_gocache_s3_hit", cache.RegionMetrics())
+	expvar.Publish("gauge_gocache_upload_queue_depth", cache.QueueDepth())
+	expvar.Publish("gauge_gocache_upload_queue_lag_seconds", cache.QueueLag())
+	if flags.SlowLog >= 0 {
+		cache.SlowLog = gobuild.NewSlowLog(cmp.Or(flags.SlowLog, 64))
+		expvar.Publish("gocache_slowlog", cache.SlowLog)
+	}
 
 	close := cache.Close
-	if flags.Expiration > 0 {
-		dirClose := dir.Cleanup(flags.Expiration)
+	switch flags.Profile {
+	case "", "ci":
+		// Use the defaults.
+	case "dev":
+		// Favor latency over completeness: serve repeated lookups from memory,
+		// never wait for S3 on a request, and do not hold up the go command
+		// waiting for uploads when it exits.
+		cache.MemoryEntries = 1 << 16
+		cache.BackgroundFault = true
+		if flags.HostIndex == 0 {
+			flags.HostIndex = 10 * time.Minute
+		}
+		if cache.UploadQueue == 0 {
+			cache.UploadQueue = 4096
+		}
+		if flags.CloseFlush == 0 {
+			flags.CloseFlush = -1 // don't wait
+		}
+		slog.Debug("using dev profile")
+	default:
+		return nil, nil, env.Usagef("invalid --profile %q (want ci or dev)", flags.Profile)
+	}
+	if flags.MemoryLookups > 0 {
+		cache.MemoryEntries = flags.MemoryLookups
+	}
+	close = flushOnClose(cache, close, flags.CloseFlush)
+	if flags.HostIndex > 0 && !flags.Diskless {
+		idx, err := gobuild.OpenHostIndex(flags.CacheDir, flags.HostIndex, componentLogger(debugBuildCache, "hostindex"))
+		if err != nil {
+			return nil, nil, err
+		}
+		cache.HostIndex = idx
+		indexClose := close
 		close = func(ctx context.Context) error {
-			return errors.Join(cache.Close(ctx), dirClose(ctx))
+			return errors.Join(indexClose(ctx), idx.Close())
+		}
+	}
+	if flags.S3KeyIndex > 0 {
+		cache.KeyIndex = new(gobuild.KeyIndex)
+		stop, indexClose := startKeyIndex(cache, flags.S3KeyIndex), close
+		close = func(ctx context.Context) error {
+			stop()
+			return indexClose(ctx)
+		}
+	}
+	if flags.MinFree > 0 {
+		w := &gobuild.DiskWatch{MinFree: int64(flags.MinFree), Logger: componentLogger(debugBuildCache, "diskwatch")}
+		if err := w.Start(dir, flags.CacheDir); err != nil {
+			return nil, nil, env.Usagef("--min-free-space: %v", err)
+		}
+		cache.DiskWatch = w
+		expvar.Publish("gocache_disk", w.Metrics())
+		watchClose := close
+		close = func(ctx context.Context) error {
+			w.Stop()
+			return watchClose(ctx)
+		}
+	}
+	if err := initCanary(env, cache); err != nil {
+		return nil, nil, err
+	}
+	// Record uploads that did not complete by the time the cache is closed,
+	// so that the "backfill" command can finish them. Until then, the journal
+	// preserves them in case the process exits without closing the cache.
+	closeJournal := initJournal(cache)
+	cacheClose := close
+	close = func(ctx context.Context) error {
+		err := cacheClose(ctx)
+		berr := saveBackfill(cache, closeJournal())
+		if berr != nil {
+			slog.Warn("save backfill manifest failed", "err", berr)
+		}
+		reportRun(ctx, cache, berr)
+		return err
+	}
+	if spillDir != "" {
+		sdir, err := cachedir.New(spillDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create spill cache: %w", err)
+		}
+		cache.Spill = &gobuild.Spill{
+			Dir:           sdir,
+			Root:          spillDir,
+			LocalRoot:     flags.CacheDir,
+			PromoteWindow: flags.SpillPromote,
+			DemoteAge:     flags.SpillDemote,
+		}
+		expvar.Publish("gocache_spill", cache.Spill.Metrics())
+		slog.Debug("local spill directory", "path", spillDir)
+
+		// Demote periodically, and once more when the cache is closed, after
+		// its uploads are complete.
+		stop, spillClose := startDemote(cache, cmp.Or(flags.SpillDemote, time.Hour)), close
+		close = func(ctx context.Context) error {
+			stop()
+			err := spillClose(ctx)
+			st, derr := cache.Demote(ctx)
+			slog.Debug("demoted local entries", "actions", st.Actions, "demoted", st.Demoted,
+				"bytes", st.Bytes, "errors", st.Errors, "elapsed", st.Elapsed, "err", derr)
+			return errors.Join(err, derr)
+		}
+		if age := cmp.Or(flags.BuildExpiry, flags.Expiration); age > 0 {
+			dirClose, cacheClose := sdir.Cleanup(age), close
+			close = func(ctx context.Context) error {
+				return errors.Join(cacheClose(ctx), dirClose(ctx))
+			}
+		}
+	}
+	if age := cmp.Or(flags.BuildExpiry, flags.Expiration); age > 0 && !flags.Diskless {
+		dirClose, cacheClose := dir.Cleanup(age), close
+		close = func(ctx context.Context) error {
+			return errors.Join(cacheClose(ctx), dirClose(ctx))
+		}
+	}
+	if flags.Diskless {
+		tmp, cacheClose := flags.CacheDir, close
+		close = func(ctx context.Context) error {
+			return errors.Join(cacheClose(ctx), os.RemoveAll(tmp))
 		}
 	}
 	s := &gocache.Server{
@@ -95,55 +310,663 @@ func initCacheServer(env *command.Env) (*gocache.Server, *s3util.Client, error)
 		Close:       close,
 		SetMetrics:  cache.SetMetrics,
 		MaxRequests: flags.Concurrency,
-		Logf:        vprintf,
-		LogRequests: flags.DebugLog&debugBuildCache != 0,
+		Logf:        printfLogger(slog.Default(), slog.LevelDebug),
 	}
 	expvar.Publish("gocache_server", s.Metrics().Get("server"))
-	return s, client, nil
+	return s, cache, nil
+}
+
+// initCanary attaches to cache an alternate cache with the --canary-* settings,
+// if --canary-rate is set, and publishes its metrics.
+func initCanary(env *command.Env, cache *gobuild.S3Cache) error {
+	if flags.CanaryRate == 0 {
+		return nil
+	} else if flags.CanaryRate < 0 || flags.CanaryRate > 1 {
+		return env.Usagef("invalid --canary-rate %v (want 0 to 1)", flags.CanaryRate)
+	}
+	alt := cache.Derive()
+	if flags.CanaryCodec != "" {
+		codec, err := gobuild.ParseCodec(flags.CanaryCodec)
+		if err != nil {
+			return env.Usagef("invalid --canary-compression: %v", err)
+		}
+		alt.Compression = codec
+	}
+	if flags.CanaryKeys != "" {
+		keyFunc, err := gobuild.ParseKeyFunc(flags.CanaryKeys)
+		if err != nil {
+			return env.Usagef("invalid --canary-key-transform: %v", err)
+		}
+		alt.KeyFunc = keyFunc
+	}
+	if flags.CanaryPrefix != "" {
+		alt.KeyPrefix = flags.CanaryPrefix // expanded by expandPrefixFlags
+	}
+	alt.Logger = componentLogger(debugBuildCache, "gobuild-canary")
+	alt.SetMetrics(env.Context(), expvar.NewMap("gocache_canary"))
+	cache.Canary = &gobuild.Canary{Cache: alt, Rate: flags.CanaryRate}
+	slog.Debug("enabling build cache canary", "rate", flags.CanaryRate, "compression", alt.Compression,
+		"prefix", alt.KeyPrefix, "key_transform", flags.CanaryKeys)
+	return nil
+}
+
+// openManifest opens an audit manifest that appends to the file at path.
+// The caller must call closeManifest when the build is complete.
+func openManifest(path string) (_ *gobuild.Manifest, closeManifest func() error, _ error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, fmt.Errorf("create audit directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open audit manifest: %w", err)
+	}
+	m := gobuild.NewManifest(f)
+	return m, func() error {
+		err := errors.Join(m.Err(), f.Close())
+		if err != nil {
+			slog.Warn("audit manifest failed", "path", path, "err", err)
+		}
+		slog.Debug("audit manifest closed", "path", path, "hits", m.Len())
+		return err
+	}, nil
+}
+
+var connSeq atomic.Int64
+
+// connManifestPath returns the path of the audit manifest for a client
+// connection in serve mode. Each connection corresponds to one invocation of
+// the go command, and gets its own manifest in the --audit directory.
+func connManifestPath() string {
+	name := fmt.Sprintf("%s-%d.jsonl", time.Now().UTC().Format("20060102T150405Z"), connSeq.Add(1))
+	return filepath.Join(flags.Audit, name)
+}
+
+// initS3Client constructs an S3 client for the bucket named by --bucket.
+func initS3Client(env *command.Env) (*s3util.Client, error) {
+	if flags.S3Bucket == "" {
+		return nil, env.Usagef("you must provide an S3 --bucket name")
+	}
+	return newS3Client(env, flags.S3Bucket)
+}
+
+// initFallback returns the previous location of the build cache given by the
+// --fallback-bucket and --fallback-prefix flags, or nil if neither is set.
+// The client is used if the fallback is in the same bucket.
+func initFallback(env *command.Env, client *s3util.Client) (*gobuild.Fallback, error) {
+	if flags.FallbackBkt == "" && flags.FallbackPfx == "" {
+		return nil, nil
+	}
+	fb := &gobuild.Fallback{S3Client: client, KeyPrefix: flags.FallbackPfx}
+	if bucket := cmp.Or(flags.FallbackBkt, client.Bucket); bucket != client.Bucket {
+		fc, err := newS3Client(env, bucket)
+		if err != nil {
+			return nil, err
+		}
+		fb.S3Client = fc
+	} else if fb.KeyPrefix == flags.KeyPrefix {
+		return nil, env.Usagef("the fallback must differ from the --bucket and --prefix")
+	}
+	slog.Debug("S3 fallback", "bucket", fb.S3Client.Bucket, "prefix", fb.KeyPrefix)
+	return fb, nil
+}
+
+// initReplica returns the replica of the build cache given by the
+// --s3-replica-bucket and --s3-replica-region flags, or nil if it is not set.
+func initReplica(env *command.Env, client *s3util.Client) (*gobuild.Replica, error) {
+	if flags.ReplicaBkt == "" {
+		if flags.ReplicaRegion != "" || flags.ReplicaSlow != 0 || flags.ReplicaPeriod != 0 {
+			return nil, env.Usagef("the --s3-replica-* flags require --s3-replica-bucket")
+		}
+		return nil, nil
+	} else if flags.ReplicaBkt == client.Bucket {
+		return nil, env.Usagef("the --s3-replica-bucket must differ from the --bucket")
+	} else if client.ReadOnly {
+		return nil, env.Usagef("--s3-replica-bucket cannot be used with --s3-anonymous")
+	}
+	rc, err := newS3ClientIn(env, flags.ReplicaBkt, flags.ReplicaRegion)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("S3 replica", "bucket", rc.Bucket)
+	return &gobuild.Replica{
+		S3Client:       rc,
+		Concurrency:    flags.S3Concurrency,
+		SlowRead:       flags.ReplicaSlow,
+		FailoverPeriod: flags.ReplicaPeriod,
+	}, nil
+}
+
+// newS3Client constructs an S3 client for the specified bucket.
+func newS3Client(env *command.Env, bucket string) (*s3util.Client, error) {
+	return newS3ClientIn(env, bucket, "")
+}
+
+// newS3ClientIn constructs an S3 client for the specified bucket in the given
+// region. If region is empty, the region is the --region, if set, or else
+// that of the bucket.
+func newS3ClientIn(env *command.Env, bucket, region string) (*s3util.Client, error) {
+	isARN := s3util.IsARN(bucket)
+	if isARN && flags.S3PathStyle {
+		return nil, env.Usagef("--s3-path-style cannot be used with an access point ARN")
+	}
+	sse, err := s3util.ParseEncryption(flags.S3SSE, flags.S3KMSKey, flags.S3BucketKey)
+	if err != nil {
+		return nil, env.Usagef("invalid S3 encryption settings: %v", err)
+	}
+	class, err := s3util.ParseStorageClass(flags.S3Class)
+	if err != nil {
+		return nil, env.Usagef("invalid --s3-storage-class: %v", err)
+	}
+	if flags.S3Accelerate {
+		switch {
+		case isARN:
+			return nil, env.Usagef("--s3-accelerate cannot be used with an access point ARN")
+		case flags.S3PathStyle || flags.S3Endpoint != "":
+			return nil, env.Usagef("--s3-accelerate cannot be used with --s3-path-style or --s3-endpoint-url")
+		case flags.S3FIPS:
+			return nil, env.Usagef("--s3-accelerate cannot be used with --s3-fips")
+		case strings.Contains(bucket, "."):
+			return nil, env.Usagef("--s3-accelerate requires a bucket name without dots")
+		}
+	}
+	if flags.S3Anonymous {
+		if flags.S3Region == "" && !isARN {
+			return nil, env.Usagef("--s3-anonymous requires a --region")
+		} else if flags.S3Role != "" || flags.S3CSEKey != "" {
+			return nil, env.Usagef("--s3-anonymous cannot be used with --s3-assume-role-arn or --s3-cse-kms-key")
+		}
+	}
+	if flags.S3Hedge >= 1 {
+		return nil, env.Usagef("--s3-hedge-percentile must be less than 1")
+	}
+	checksum, err := s3util.ParseChecksum(flags.S3Checksum)
+	if err != nil {
+		return nil, env.Usagef("invalid --s3-checksum: %v", err)
+	}
+	tags, err := s3util.ParseTags(expandTags(flags.S3Tags))
+	if err != nil {
+		return nil, env.Usagef("invalid --s3-tags: %v", err)
+	}
+	tlsConfig, err := s3util.TLSFiles{
+		CAFile:   flags.S3CAFile,
+		CertFile: flags.S3ClientCert,
+		KeyFile:  flags.S3ClientKey,
+	}.Config()
+	if err != nil {
+		return nil, env.Usagef("invalid S3 TLS settings: %v", err)
+	}
+	retryMode, err := s3util.ParseRetryMode(flags.S3RetryMode)
+	if err != nil {
+		return nil, env.Usagef("invalid --s3-retry-mode: %v", err)
+	}
+	if region == "" {
+		region, err = getBucketRegion(env.Context(), bucket)
+		if err != nil {
+			return nil, env.Usagef("you must provide an S3 --region name")
+		}
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	}
+	if flags.S3Endpoint != "" {
+		slog.Debug("S3 endpoint", "url", flags.S3Endpoint)
+		opts = append(opts, config.WithBaseEndpoint(flags.S3Endpoint))
+	}
+	if flags.S3DualStack {
+		opts = append(opts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	if flags.S3FIPS {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if flags.S3Anonymous {
+		slog.Debug("S3 anonymous read-only access")
+		opts = append(opts, config.WithCredentialsProvider(aws.AnonymousCredentials{}))
+	}
+	cfg, err := config.LoadDefaultConfig(env.Context(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	if err := assumeS3Role(env, &cfg); err != nil {
+		return nil, err
+	}
+
+	slog.Debug("S3 cache bucket", "bucket", bucket, "region", region, "sse", sse.Mode)
+	up, down := s3Throttles()
+	retry := s3util.RetryPolicy{
+		Mode:        retryMode,
+		MaxAttempts: cmp.Or(flags.S3Attempts, cfg.RetryMaxAttempts),
+		MaxBackoff:  flags.S3MaxBackoff,
+		Timeout:     flags.S3ReqTimeout,
+		NoQuota:     flags.S3NoQuota,
+		Stats:       s3RetryStats(),
+	}
+	if flags.S3RetryMode == "" && cfg.RetryMode == aws.RetryModeAdaptive {
+		retry.Mode = s3util.RetryAdaptive // from the AWS config
+	}
+	var envelope *s3util.Envelope
+	if flags.S3CSEKey != "" {
+		// A key given by ARN may be in another region than the bucket.
+		kcfg := cfg.Copy()
+		if a, err := arn.Parse(flags.S3CSEKey); err == nil && a.Region != "" {
+			kcfg.Region = a.Region
+		}
+		envelope = &s3util.Envelope{
+			Keys:           &s3util.KMSKeys{KeyID: flags.S3CSEKey, Config: kcfg},
+			AllowPlaintext: flags.S3CSEPlain,
+		}
+	} else if flags.S3CSEPlain {
+		return nil, env.Usagef("--s3-cse-allow-plaintext requires --s3-cse-kms-key")
+	}
+	return &s3util.Client{
+		Client: s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.UsePathStyle = flags.S3PathStyle
+			o.UseAccelerate = flags.S3Accelerate
+			s3util.UseTLS(o, tlsConfig)
+			retry.Apply(o)
+			o.HTTPClient = s3util.ThrottleClient(o.HTTPClient, up, down)
+
+			// Route requests for an access point ARN to the region named by
+			// the ARN, even if it differs from the client region.
+			o.UseARNRegion = isARN
+		}),
+		Bucket:        bucket,
+		Encryption:    sse,
+		StorageClass:  class,
+		Tags:          tags,
+		Checksum:      checksum,
+		Envelope:      envelope,
+		Hedge:         s3Hedge(),
+		RequesterPays: flags.S3Payer,
+		ReadOnly:      flags.S3Anonymous,
+
+		VerifyChecksums: flags.S3Verify,
+		ChecksumStats:   s3ChecksumStats(),
+	}, nil
+}
+
+// assumeS3Role updates cfg to use the credentials of the IAM role given by
+// --s3-assume-role-arn, if it is set. The role is assumed with a web identity
+// token if --s3-web-identity-file is set, and otherwise with the credentials
+// from the default chain. The credentials are refreshed before they expire.
+func assumeS3Role(env *command.Env, cfg *aws.Config) error {
+	if flags.S3Role == "" {
+		if flags.S3ExtID != "" || flags.S3WebIdentity != "" {
+			return env.Usagef("you must set --s3-assume-role-arn to use --s3-external-id or --s3-web-identity-file")
+		}
+		return nil // OK, use the default credentials
+	} else if flags.S3ExtID != "" && flags.S3WebIdentity != "" {
+		return env.Usagef("--s3-external-id cannot be used with --s3-web-identity-file")
+	}
+
+	// The STS client uses the AWS endpoint even if S3 does not.
+	stsc := sts.NewFromConfig(*cfg, func(o *sts.Options) { o.BaseEndpoint = nil })
+	session := cmp.Or(flags.S3Session, "go-cache-plugin")
+	var provider aws.CredentialsProvider
+	if flags.S3WebIdentity != "" {
+		provider = stscreds.NewWebIdentityRoleProvider(stsc, flags.S3Role,
+			stscreds.IdentityTokenFile(flags.S3WebIdentity),
+			func(o *stscreds.WebIdentityRoleOptions) { o.RoleSessionName = session })
+	} else {
+		provider = stscreds.NewAssumeRoleProvider(stsc, flags.S3Role, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = session
+			if flags.S3ExtID != "" {
+				o.ExternalID = &flags.S3ExtID
+			}
+		})
+	}
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	slog.Debug("S3 assume role", "role", flags.S3Role, "session", session, "web_identity", flags.S3WebIdentity != "")
+	return nil
+}
+
+// s3RetryStats returns the retry counts of requests to S3, shared by the S3
+// clients of the process.
+var s3RetryStats = sync.OnceValue(func() *s3util.RetryStats {
+	stats := new(s3util.RetryStats)
+	expvar.Publish("gocache_s3_retry", stats.Metrics())
+	return stats
+})
+
+// s3ChecksumStats returns the counts of checksums verified on reads from S3,
+// shared by the S3 clients of the process, or nil if they are not verified.
+var s3ChecksumStats = sync.OnceValue(func() *s3util.ChecksumStats {
+	if !flags.S3Verify {
+		return nil
+	}
+	stats := new(s3util.ChecksumStats)
+	expvar.Publish("gocache_s3_checksum", stats.Metrics())
+	return stats
+})
+
+// s3Hedge returns the hedging policy for reads from S3, shared by the S3
+// clients of the process, or nil if reads are not hedged.
+var s3Hedge = sync.OnceValue(func() *s3util.Hedge {
+	if flags.S3Hedge <= 0 {
+		return nil
+	}
+	h := &s3util.Hedge{Percentile: flags.S3Hedge, MinDelay: flags.S3HedgeMin}
+	expvar.Publish("gocache_s3_hedge", h.Metrics())
+	slog.Debug("hedging S3 reads", "percentile", flags.S3Hedge, "min_delay", flags.S3HedgeMin)
+	return h
+})
+
+// s3Throttles returns the bandwidth limits for S3 traffic. The S3 clients of
+// the process share them, so the limits apply to the total of their traffic.
+var s3Throttles = sync.OnceValues(func() (up, down *s3util.Throttle) {
+	if flags.S3UpRate > 0 || flags.S3DownRate > 0 {
+		slog.Debug("S3 bandwidth limits", "upload", flags.S3UpRate, "download", flags.S3DownRate)
+	}
+	return s3util.NewThrottle(flags.S3UpRate), s3util.NewThrottle(flags.S3DownRate)
+})
+
+// initModScanner returns a scanner for module zips if --modproxy-scan is set,
+// or nil if not.
+func initModScanner(env *command.Env) (*modproxy.ZipScanner, error) {
+	var block bool
+	switch serveFlags.ModScan {
+	case "":
+		return nil, nil // OK, scanning is disabled
+	case "flag":
+	case "block":
+		block = true
+	default:
+		return nil, env.Usagef("invalid --modproxy-scan %q (want flag or block)", serveFlags.ModScan)
+	}
+	slog.Debug("enabling module zip scanning", "block", block)
+	return &modproxy.ZipScanner{
+		MaxFileSize: cmp.Or(serveFlags.ModScanN, 10<<20),
+		Block:       block,
+		Allow:       serveFlags.ModAllow,
+	}, nil
 }
 
 // initModProxy initializes a Go module proxy if one is enabled. If not, it
-// returns a nil handler without error. The caller must defer a call to the
-// cleanup function unless an error is reported.
-func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+// returns a nil handler without error. The handler serves the proxy at the
+// root of its paths. The caller must defer a call to the cleanup function
+// unless an error is reported.
+func initModProxy(env *command.Env, s3c *s3util.Client, sl *sbom.Log, g *taskgroup.Group) (_ http.Handler, cleanup func(), _ error) {
 	if !serveFlags.ModProxy {
+		if serveFlags.ModOffln {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --modproxy-offline")
+		} else if serveFlags.ModScan != "" {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --modproxy-scan")
+		} else if serveFlags.ModTempMax != 0 {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --modproxy-temp-limit")
+		} else if serveFlags.ModAddr != "" {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --modproxy-addr")
+		} else if serveFlags.SumVerify {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --sumdb-verify")
+		} else if serveFlags.ModPermit != "" || serveFlags.ModBlock != "" {
+			return nil, nil, env.Usagef("you must set --modproxy to enable --modproxy-allow or --modproxy-block")
+		}
 		return nil, noop, nil // OK, proxy is disabled
-	} else if serveFlags.HTTP == "" {
-		return nil, nil, env.Usagef("you must set --http to enable --modproxy")
+	} else if serveFlags.HTTP == "" && serveFlags.ModAddr == "" {
+		return nil, nil, env.Usagef("you must set --http or --modproxy-addr to enable --modproxy")
+	} else if serveFlags.ModOffln && serveFlags.SumDB != "" {
+		return nil, nil, env.Usagef("--sumdb cannot be used with --modproxy-offline")
+	}
+	scanner, err := initModScanner(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	sumDB, err := initSumDB(env, s3c)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	localKey, err := loadLocalKey()
+	if err != nil {
+		return nil, nil, err
+	}
 	modCachePath := filepath.Join(flags.CacheDir, "module")
 	if err := os.MkdirAll(modCachePath, 0755); err != nil {
 		return nil, nil, fmt.Errorf("create module cache: %w", err)
 	}
+
+	// Fetches in progress when the server last stopped leave their temporary
+	// files behind. No fetches are running yet, so discard them all.
+	temp := &modproxy.TempSpace{
+		Dir:      filepath.Join(flags.CacheDir, "modtmp"),
+		MaxBytes: serveFlags.ModTempMax,
+		Logger:   componentLogger(debugModProxy, "modproxy"),
+	}
+	if n, err := temp.Reset(); err != nil {
+		return nil, nil, fmt.Errorf("reset module fetch space: %w", err)
+	} else if n != 0 {
+		slog.Info("removed orphaned module fetch files", "dir", temp.Dir, "bytes", n)
+	}
+
 	cacher := &modproxy.S3Cacher{
 		Local:       modCachePath,
 		S3Client:    s3c,
 		KeyPrefix:   path.Join(flags.KeyPrefix, "module"),
 		MaxTasks:    flags.S3Concurrency,
-		Logf:        vprintf,
-		LogRequests: flags.DebugLog&debugModProxy != 0,
+		Scanner:     scanner,
+		MemoryBytes: int64(flags.MemorySize),
+		Encrypt:     localKey,
+		Logger:      componentLogger(debugModProxy, "modproxy"),
+	}
+	cleanup = func() {
+		slog.Debug("close cacher", "err", cacher.Close())
+		if sumDB != nil {
+			slog.Debug("close sum DB", "err", sumDB.Close())
+		}
 	}
-	cleanup = func() { vprintf("close cacher (err=%v)", cacher.Close()) }
 	proxy := &goproxy.Goproxy{
-		Fetcher: &goproxy.GoFetcher{
-			// As configured, the fetcher should never shell out to the go
-			// tool. Specifically, because we set GOPROXY and do not set any
-			// bypass via GONOPROXY, GOPRIVATE, etc., we will only attempt to
-			// proxy for the specific server(s) listed in Env.
-			GoBin: "/bin/false",
-			Env:   []string{"GOPROXY=https://proxy.golang.org"},
-		},
 		Cacher:        cacher,
 		ProxiedSumDBs: []string{"sum.golang.org"}, // default, see below
+		TempDir:       temp.Dir,
+	}
+	slog.Debug("enabling Go module proxy")
+	if serveFlags.ModOffln {
+		// Nothing is fetched, so there is no need for a fetcher, and the
+		// checksum database is not proxied.
+		proxy.ProxiedSumDBs = nil
+		slog.Debug("module proxy is offline")
+	} else if fetcher, err := initModFetcher(); err != nil {
+		cleanup()
+		return nil, nil, err
+	} else {
+		fetcher.TempDir = temp.Dir
+		proxy.Fetcher = fetcher
 	}
-	vprintf("enabling Go module proxy")
 	if serveFlags.SumDB != "" {
 		proxy.ProxiedSumDBs = strings.Split(serveFlags.SumDB, ",")
-		vprintf("enabling sum DB proxy for %s", strings.Join(proxy.ProxiedSumDBs, ", "))
+		slog.Debug("enabling sum DB proxy", "sumdbs", proxy.ProxiedSumDBs)
 	}
 	expvar.Publish("modcache", cacher.Metrics())
-	return http.StripPrefix("/mod", proxy), cleanup, nil
+	expvar.Publish("modtemp", temp.Metrics())
+	g.Run(func() { temp.Run(env.Context()) })
+	var h http.Handler = temp.Limit(proxy)
+	if !serveFlags.NoCacheHeaders {
+		h = modproxy.CacheHeaders(h)
+	}
+	if serveFlags.ModOffln {
+		h = modproxy.Offline(h)
+	}
+	if serveFlags.ModPermit != "" || serveFlags.ModBlock != "" {
+		policy := &modproxy.Policy{
+			Allow:  serveFlags.ModPermit,
+			Block:  serveFlags.ModBlock,
+			Logger: componentLogger(debugModProxy, "modproxy"),
+		}
+		slog.Debug("enforcing module policy", "allow", policy.Allow, "block", policy.Block)
+		expvar.Publish("modpolicy", policy.Metrics())
+		h = policy.Enforce(h)
+	}
+	if sumDB != nil {
+		// Requests for the verified database bypass the module proxy, which
+		// would otherwise pass them through (or, offline, refuse them).
+		prefix := "/sumdb/" + sumDB.Name()
+		mux := http.NewServeMux()
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, sumDB))
+		mux.Handle("/", h)
+		h = mux
+	}
+	if sl != nil {
+		h = sl.Modules(h)
+	}
+	if auditLog != nil {
+		h = auditLog.Modules(h)
+	}
+	return h, cleanup, nil
+}
+
+// initSumDB returns a verifying proxy for the checksum database if
+// --sumdb-verify is set, or nil if not.
+func initSumDB(env *command.Env, s3c *s3util.Client) (*modproxy.SumDB, error) {
+	if !serveFlags.SumVerify {
+		if serveFlags.SumKey != "" {
+			return nil, env.Usagef("you must set --sumdb-verify to enable --sumdb-key")
+		}
+		return nil, nil // OK, verification is disabled
+	}
+	verifier, err := note.NewVerifier(cmp.Or(serveFlags.SumKey, modproxy.DefaultSumDBKey))
+	if err != nil {
+		return nil, env.Usagef("invalid --sumdb-key: %v", err)
+	}
+	sumDBPath := filepath.Join(flags.CacheDir, "sumdb", verifier.Name())
+	if err := os.MkdirAll(sumDBPath, 0755); err != nil {
+		return nil, fmt.Errorf("create sum DB cache: %w", err)
+	}
+	db := &modproxy.SumDB{
+		Verifier:  verifier,
+		Offline:   serveFlags.ModOffln,
+		Local:     sumDBPath,
+		S3Client:  s3c,
+		KeyPrefix: path.Join(flags.KeyPrefix, "sumdb", verifier.Name()),
+		Logger:    componentLogger(debugModProxy, "sumdb"),
+	}
+	slog.Debug("enabling verified sum DB proxy", "name", db.Name(), "offline", db.Offline)
+	expvar.Publish("sumdb", db.Metrics())
+	return db, nil
+}
+
+// serveModProxy starts an HTTP server in g for the module proxy h at addr,
+// which stops when ctx ends.
+func serveModProxy(ctx context.Context, g *taskgroup.Group, addr string, h http.Handler) {
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			h.ServeHTTP(w, r)
+		}),
+	}
+	g.Go(srv.ListenAndServe)
+	slog.Debug("module proxy listening", "addr", addr)
+	g.Run(func() {
+		<-ctx.Done()
+		slog.Debug("stopping module proxy service")
+		srv.Shutdown(context.Background())
+	})
+}
+
+// initSBOMLog opens the log of components served by the proxies, if one is
+// enabled. If not, it returns nil without error. The caller must defer a call
+// to cleanup in either case.
+func initSBOMLog() (_ *sbom.Log, cleanup func(), _ error) {
+	if serveFlags.SBOMLog == "" {
+		return nil, noop, nil // OK, recording is disabled
+	}
+	sl, err := sbom.Open(serveFlags.SBOMLog, cmp.Or(serveFlags.SBOMRetention, 30*24*time.Hour))
+	if err != nil {
+		return nil, nil, fmt.Errorf("open sbom log: %w", err)
+	}
+	sl.Logger = slog.Default()
+	cleanup = func() { slog.Debug("close sbom log", "err", sl.Close()) }
+	slog.Debug("recording served components", "path", serveFlags.SBOMLog)
+	return sl, cleanup, nil
+}
+
+// initPyPIProxy initializes a Python package index proxy if one is enabled.
+// If not, it returns a nil handler without error. The caller must defer a call
+// to cleanup in either case.
+func initPyPIProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+	if !serveFlags.PyPI {
+		return nil, noop, nil // OK, proxy is disabled
+	} else if serveFlags.HTTP == "" {
+		return nil, nil, env.Usagef("you must set --http to enable --pypi")
+	}
+
+	pypiCachePath := filepath.Join(flags.CacheDir, "pypi")
+	if err := os.MkdirAll(pypiCachePath, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create pypi cache: %w", err)
+	}
+	proxy := &pypiproxy.Server{
+		Upstream:  serveFlags.PyPIUpstream,
+		Local:     pypiCachePath,
+		S3Client:  s3c,
+		KeyPrefix: path.Join(flags.KeyPrefix, "pypi"),
+		Logger:    componentLogger(debugPyPI, "pypiproxy"),
+	}
+	cleanup = func() { slog.Debug("close pypi proxy", "err", proxy.Close()) }
+	slog.Debug("enabling PyPI proxy", "upstream", cmp.Or(serveFlags.PyPIUpstream, pypiproxy.DefaultUpstream))
+	expvar.Publish("pypicache", proxy.Metrics())
+	return auditRequests("pypi", http.StripPrefix("/pypi", proxy)), cleanup, nil
+}
+
+// initNPMProxy initializes an npm registry proxy if one is enabled.
+// If not, it returns a nil handler without error. The caller must defer a call
+// to cleanup in either case.
+func initNPMProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+	if !serveFlags.NPM {
+		return nil, noop, nil // OK, proxy is disabled
+	} else if serveFlags.HTTP == "" {
+		return nil, nil, env.Usagef("you must set --http to enable --npm")
+	}
+
+	npmCachePath := filepath.Join(flags.CacheDir, "npm")
+	if err := os.MkdirAll(npmCachePath, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create npm cache: %w", err)
+	}
+	proxy := &npmproxy.Server{
+		Upstream:  serveFlags.NPMUpstream,
+		MountPath: "/npm",
+		Local:     npmCachePath,
+		S3Client:  s3c,
+		KeyPrefix: path.Join(flags.KeyPrefix, "npm"),
+		Logger:    componentLogger(debugNPM, "npmproxy"),
+	}
+	cleanup = func() { slog.Debug("close npm proxy", "err", proxy.Close()) }
+	slog.Debug("enabling npm proxy", "upstream", cmp.Or(serveFlags.NPMUpstream, npmproxy.DefaultUpstream))
+	expvar.Publish("npmcache", proxy.Metrics())
+	return auditRequests("npm", http.StripPrefix("/npm", proxy)), cleanup, nil
+}
+
+// initModFetcher constructs the upstream fetcher for the module proxy.
+//
+// By default, the fetcher should never shell out to the go tool. Specifically,
+// because we set GOPROXY and do not set any bypass via GONOPROXY, GOPRIVATE,
+// etc., we will only attempt to proxy for the specific server(s) listed in
+// --goproxy. If --goproxy-private is set, modules matching those patterns are
+// fetched directly from version control using the go tool.
+func initModFetcher() (*goproxy.GoFetcher, error) {
+	f := &goproxy.GoFetcher{
+		GoBin: "/bin/false",
+		Env:   []string{"GOPROXY=" + cmp.Or(serveFlags.GoProxy, "https://proxy.golang.org")},
+	}
+	if serveFlags.GoPrivate != "" {
+		// Direct fetches need the ambient environment (PATH, HOME, git
+		// configuration) to reach version control.
+		f.GoBin = "" // use "go" from $PATH
+		f.Env = append(os.Environ(), f.Env[0], "GOPRIVATE="+serveFlags.GoPrivate)
+		slog.Debug("module proxy direct fetch", "private", serveFlags.GoPrivate)
+	}
+	if serveFlags.GoNetrc != "" {
+		entries, err := modproxy.ReadNetrc(serveFlags.GoNetrc)
+		if err != nil {
+			return nil, fmt.Errorf("read netrc: %w", err)
+		}
+		f.Env = append(f.Env, "NETRC="+serveFlags.GoNetrc)
+		f.Transport = &modproxy.NetrcTransport{Entries: entries}
+		slog.Debug("module proxy credentials", "path", serveFlags.GoNetrc, "entries", len(entries))
+	}
+	return f, nil
 }
 
 // initRevProxy initializes a reverse proxy if one is enabled.  If not, it
@@ -178,13 +1001,17 @@ func initModProxy(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup
 // To the main HTTP listener, the bridge is an [http.Handler] that serves
 // requests routed to it. To the inner server, the bridge is a [net.Listener],
 // a source of client connections (with TLS terminated).
-func initRevProxy(env *command.Env, s3c *s3util.Client, g *taskgroup.Group) (http.Handler, error) {
+func initRevProxy(env *command.Env, s3c *s3util.Client, sl *sbom.Log, g *taskgroup.Group) (http.Handler, error) {
 	if serveFlags.RevProxy == "" {
 		return nil, nil // OK, proxy is disabled
 	} else if serveFlags.HTTP == "" {
 		return nil, env.Usagef("you must set --http to enable --revproxy")
 	}
 
+	localKey, err := loadLocalKey()
+	if err != nil {
+		return nil, err
+	}
 	revCachePath := filepath.Join(flags.CacheDir, "revproxy")
 	if err := os.MkdirAll(revCachePath, 0755); err != nil {
 		return nil, fmt.Errorf("create revproxy cache: %w", err)
@@ -192,23 +1019,56 @@ func initRevProxy(env *command.Env, s3c *s3util.Client, g *taskgroup.Group) (htt
 	hosts := strings.Split(serveFlags.RevProxy, ",")
 
 	// Issue a server certificate so we can proxy HTTPS requests.
-	cert, err := initServerCert(env, hosts)
+	tlsConfig, err := initServerCert(env, hosts)
 	if err != nil {
 		return nil, err
 	}
 
 	proxy := &revproxy.Server{
-		Targets:     hosts,
-		Local:       revCachePath,
-		S3Client:    s3c,
-		KeyPrefix:   path.Join(flags.KeyPrefix, "revproxy"),
-		Logf:        vprintf,
-		LogRequests: flags.DebugLog&debugRevProxy != 0,
+		Targets:   hosts,
+		Local:     revCachePath,
+		S3Client:  s3c,
+		KeyPrefix: path.Join(flags.KeyPrefix, "revproxy"),
+		Encrypt:   localKey,
+		Logger:    componentLogger(debugRevProxy, "revproxy"),
+
+		ServeStaleOnError:   serveFlags.RevStale,
+		StaleTimeout:        serveFlags.RevStaleWait,
+		DisableCacheHeaders: serveFlags.NoCacheHeaders,
 	}
+	if serveFlags.RevRules != "" {
+		data, err := os.ReadFile(serveFlags.RevRules)
+		if err != nil {
+			return nil, fmt.Errorf("read revproxy rules: %w", err)
+		}
+		proxy.Rules, err = revproxy.ParseRules(data)
+		if err != nil {
+			return nil, fmt.Errorf("--revproxy-rules: %w", err)
+		}
+		slog.Debug("loaded reverse proxy rules", "path", serveFlags.RevRules, "count", len(proxy.Rules))
+	}
+	if serveFlags.RevMirror != "" || serveFlags.RevValidate != "" {
+		origins, err := revproxy.ParseMirrorOrigins(serveFlags.RevMirror)
+		if err != nil {
+			return nil, env.Usagef("--revproxy-mirror: %v", err)
+		}
+		proxy.Mirror = &revproxy.Mirror{
+			Origins:  origins,
+			Validate: serveFlags.RevValidate,
+			Rate:     serveFlags.RevMirrorRate,
+		}
+		slog.Debug("enabling reverse proxy shadow traffic", "rate", cmp.Or(serveFlags.RevMirrorRate, 1))
+		expvar.Publish("revcache_mirror", proxy.Mirror.Metrics())
+	}
+	var handler http.Handler = proxy
+	if sl != nil {
+		handler = sl.Artifacts(proxy)
+	}
+	handler = auditRequests("revproxy", handler)
 	bridge := &proxyconn.Bridge{
 		Addrs:   hosts,
-		Handler: proxy, // forward HTTP requests unencrypted to the proxy
-		Logf:    vprintf,
+		Handler: handler, // forward HTTP requests unencrypted to the proxy
+		Logf:    printfLogger(slog.Default(), slog.LevelDebug),
 
 		// Forward connections not matching Addrs directly to their targets.
 		ForwardConnect: true,
@@ -219,58 +1079,70 @@ func initRevProxy(env *command.Env, s3c *s3util.Client, g *taskgroup.Group) (htt
 	// does not listen on a real network; it receives connections forwarded by
 	// the bridge internally from successful CONNECT requests.
 	psrv := &http.Server{
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSConfig: tlsConfig,
 
 		// Ordinarly HTTP proxy requests are delegated directly.
-		Handler: proxy,
+		Handler: handler,
 	}
 	g.Go(func() error { return psrv.ServeTLS(bridge, "", "") })
 
 	g.Run(func() {
 		<-env.Context().Done()
-		vprintf("stopping proxy bridge")
+		slog.Debug("stopping proxy bridge")
 		psrv.Shutdown(context.Background())
 	})
 
 	expvar.Publish("revcache", proxy.Metrics())
-	vprintf("enabling reverse proxy for %s", strings.Join(proxy.Targets, ", "))
-	return bridge, nil
+	slog.Debug("enabling reverse proxy", "targets", proxy.Targets)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The bridge accepts only CONNECT requests for one of its Addrs; point
+		// those matching a wildcard or suffix target at the target itself.
+		if r.Method == http.MethodConnect {
+			if h, port, err := net.SplitHostPort(r.URL.Host); err == nil && port == "443" {
+				if t := revproxy.MatchTarget(h, hosts); t != "" && t != h {
+					r = r.Clone(r.Context())
+					r.URL.Host = t
+				}
+			}
+		}
+		bridge.ServeHTTP(w, r)
+	}), nil
 }
 
-// initServerCert creates a signed certificate advertising the specified host
-// names, for use in creating a TLS server.
-func initServerCert(env *command.Env, hosts []string) (tls.Certificate, error) {
-	ca, err := tlsutil.NewSigningCert(24*time.Hour, &x509.Certificate{
-		Subject: pkix.Name{Organization: []string{"Tailscale build automation"}},
-	})
+// initServerCert returns a TLS configuration that presents certificates
+// advertising the specified hosts, signed by the reverse proxy CA. Server
+// certificates are renewed automatically before they expire.
+func initServerCert(env *command.Env, hosts []string) (*tls.Config, error) {
+	ca, err := loadSigningCert()
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("generate signing cert: %w", err)
+		return nil, fmt.Errorf("generate signing cert: %w", err)
 	}
 	if err := installSigningCert(env, ca); err != nil {
-		vprintf("WARNING: %v", err)
+		slog.Debug("install signing cert failed", "err", err)
 	} else {
-		vprintf("installed signing cert in system store")
+		slog.Debug("installed signing cert in system store")
 
 		// TODO(creachadair): We should probably clean up old expired certs.
 		// This is OK for ephemeral build/CI workers, though.
 	}
 
-	sc, err := tlsutil.NewServerCert(24*time.Hour, ca, &x509.Certificate{
-		Subject:  pkix.Name{Organization: []string{"Go cache plugin reverse proxy"}},
-		DNSNames: hosts,
-	})
-	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("generate server cert: %w", err)
+	// Issue the first certificate eagerly, so that errors are reported at startup.
+	r := &certRenewer{ca: ca, hosts: hosts}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
 	}
-
-	return sc.TLSCertificate()
+	return &tls.Config{GetCertificate: r.GetCertificate}, nil
 }
 
 // makeHandler returns an HTTP handler that dispatches requests to debug
-// handlers or to the specified proxies, if they are defined.
-func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
+// handlers, the admin API, or to the specified proxies, if they are defined.
+// If slowLog is non-nil, it is served at /debug/slowlog.
+func makeHandler(modProxy, pypiProxy, npmProxy, actionsCache, blobCache, gradleCache, revProxy, adminAPI, peerAPI http.Handler, slowLog *gobuild.SlowLog) http.HandlerFunc {
 	mux := http.NewServeMux()
-	tsweb.Debugger(mux)
+	dbg := tsweb.Debugger(mux)
+	if slowLog != nil {
+		dbg.Handle("slowlog", "Slowest build cache requests (JSON)", slowLog)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Host != "" && r.URL.Host == r.Host {
 			// The caller wants us to proxy for them.
@@ -288,13 +1160,249 @@ func makeHandler(modProxy, revProxy http.Handler) http.HandlerFunc {
 			mux.ServeHTTP(w, r)
 			return
 		}
+		if adminAPI != nil && strings.HasPrefix(path, "/admin/") {
+			adminAPI.ServeHTTP(w, r)
+			return
+		}
+		if peerAPI != nil && strings.HasPrefix(path, "/peer/") {
+			peerAPI.ServeHTTP(w, r)
+			return
+		}
 		if modProxy != nil && r.Method == http.MethodGet && strings.HasPrefix(path, "/mod/") {
 			modProxy.ServeHTTP(w, r)
 			return
 		}
+		if pypiProxy != nil && strings.HasPrefix(path, "/pypi/") {
+			pypiProxy.ServeHTTP(w, r)
+			return
+		}
+		if npmProxy != nil && strings.HasPrefix(path, "/npm/") {
+			npmProxy.ServeHTTP(w, r)
+			return
+		}
+		if actionsCache != nil && strings.HasPrefix(path, "/gha/") {
+			actionsCache.ServeHTTP(w, r)
+			return
+		}
+		if blobCache != nil && strings.HasPrefix(path, "/blob/") {
+			blobCache.ServeHTTP(w, r)
+			return
+		}
+		if gradleCache != nil && strings.HasPrefix(path, "/cache/") {
+			gradleCache.ServeHTTP(w, r)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	}
 }
 
+// initActionsCache initializes a GitHub Actions cache service if one is
+// enabled. If not, it returns a nil handler without error. The caller must
+// defer a call to cleanup in either case.
+func initActionsCache(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+	if !serveFlags.ActionsCache {
+		return nil, noop, nil // OK, service is disabled
+	} else if serveFlags.HTTP == "" {
+		return nil, nil, env.Usagef("you must set --http to enable --actions-cache")
+	} else if serveFlags.ActionsSecret == "" {
+		return nil, nil, env.Usagef("you must set --actions-cache-secret to enable --actions-cache")
+	}
+
+	ghaCachePath := filepath.Join(flags.CacheDir, "gha")
+	if err := os.MkdirAll(ghaCachePath, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create actions cache: %w", err)
+	}
+	svc := &actionscache.Server{
+		MountPath: "/gha",
+		Local:     ghaCachePath,
+		S3Client:  s3c,
+		KeyPrefix: path.Join(flags.KeyPrefix, "gha"),
+		Secret:    serveFlags.ActionsSecret,
+		Logger:    componentLogger(debugActionsCache, "actionscache"),
+
+		MultipartThreshold: flags.MultipartSize,
+		Multipart: s3util.MultipartOptions{
+			PartSize:    flags.PartSize,
+			Concurrency: flags.PartUploads,
+		},
+	}
+	cleanup = func() { slog.Debug("close actions cache", "err", svc.Close()) }
+	slog.Debug("enabling actions cache service")
+	expvar.Publish("ghacache", svc.Metrics())
+	return http.StripPrefix("/gha", svc), cleanup, nil
+}
+
+// initBlobCache initializes a blob store for compiler caches if one is
+// enabled. If not, it returns a nil handler without error. The caller must
+// defer a call to cleanup in either case.
+func initBlobCache(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+	if !serveFlags.BlobCache {
+		return nil, noop, nil // OK, store is disabled
+	} else if serveFlags.HTTP == "" {
+		return nil, nil, env.Usagef("you must set --http to enable --blob-cache")
+	}
+
+	blobCachePath := filepath.Join(flags.CacheDir, "blob")
+	if err := os.MkdirAll(blobCachePath, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create blob cache: %w", err)
+	}
+	svc := &blobcache.Server{
+		Local:      blobCachePath,
+		S3Client:   s3c,
+		KeyPrefix:  path.Join(flags.KeyPrefix, "blob"),
+		MaxSize:    serveFlags.BlobMaxSize,
+		WriteToken: serveFlags.BlobToken,
+		Logger:     componentLogger(debugBlobCache, "blobcache"),
+	}
+	cleanup = func() { slog.Debug("close blob cache", "err", svc.Close()) }
+	slog.Debug("enabling blob cache", "readOnly", svc.WriteToken == "")
+	expvar.Publish("blobcache", svc.Metrics())
+	return http.StripPrefix("/blob", svc), cleanup, nil
+}
+
+// initGradleCache initializes a Gradle remote build cache if one is enabled.
+// If not, it returns a nil handler without error. The caller must defer a call
+// to cleanup in either case.
+//
+// The Gradle protocol is a subset of what the blob store serves, so the cache
+// is a blob store of its own, kept apart from the --blob-cache.
+func initGradleCache(env *command.Env, s3c *s3util.Client) (_ http.Handler, cleanup func(), _ error) {
+	if !serveFlags.GradleCache {
+		return nil, noop, nil // OK, cache is disabled
+	} else if serveFlags.HTTP == "" {
+		return nil, nil, env.Usagef("you must set --http to enable --gradle-cache")
+	} else if serveFlags.GradleUser != "" && serveFlags.GradlePassword == "" {
+		return nil, nil, env.Usagef("--gradle-user requires --gradle-password")
+	}
+
+	gradleCachePath := filepath.Join(flags.CacheDir, "gradle")
+	if err := os.MkdirAll(gradleCachePath, 0755); err != nil {
+		return nil, nil, fmt.Errorf("create gradle cache: %w", err)
+	}
+	svc := &blobcache.Server{
+		Local:      gradleCachePath,
+		S3Client:   s3c,
+		KeyPrefix:  path.Join(flags.KeyPrefix, "gradle"),
+		WriteToken: serveFlags.GradlePassword,
+		WriteUser:  serveFlags.GradleUser,
+		Logger:     componentLogger(debugGradleCache, "gradlecache"),
+	}
+	cleanup = func() { slog.Debug("close gradle cache", "err", svc.Close()) }
+	slog.Debug("enabling gradle cache", "readOnly", svc.WriteToken == "")
+	expvar.Publish("gradlecache", svc.Metrics())
+	return http.StripPrefix("/cache", svc), cleanup, nil
+}
+
+// initPeerClient returns a client for the peers named by --peers, or nil if
+// no peers are configured.
+func initPeerClient(env *command.Env) (*peer.Client, error) {
+	if flags.Peers == "" {
+		return nil, nil
+	} else if flags.PeerKeyFile == "" {
+		return nil, env.Usagef("--peers requires --peer-key-file")
+	}
+	key, err := loadPeerKey()
+	if err != nil {
+		return nil, err
+	}
+	r := &peer.Resolver{
+		Spec:   flags.Peers,
+		Self:   serveFlags.HTTP,
+		Logger: slog.Default(),
+	}
+	slog.Debug("peer caches", "peers", flags.Peers)
+	return &peer.Client{Peers: r.Peers, Key: key}, nil
+}
+
+// initPeerHTTP returns a handler exporting the local cache to peers, or nil if
+// no peers are configured. Peers authenticate with the key of cache.Peers.
+func initPeerHTTP(cache *gobuild.S3Cache) http.Handler {
+	if cache.Peers == nil {
+		return nil
+	}
+	return peer.Handler{Local: cache.Local, Key: cache.Peers.Key}
+}
+
 // noop is a cleanup function that does nothing, used as a default.
 func noop() {}
+
+// startKeyIndex loads the KeyIndex of cache in the background, and again
+// every interval, until the returned stop function is called.
+func startKeyIndex(cache *gobuild.S3Cache, every time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			start := time.Now()
+			n, err := cache.LoadKeyIndex(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("list S3 key index failed", "err", err)
+			} else if err == nil {
+				slog.Debug("listed S3 key index", "keys", n, "elapsed", time.Since(start))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
+
+// startDemote starts a goroutine that moves the entries of the fast tier of
+// cache not used recently to its spill tier at the given interval. The caller
+// must call stop when the cache is closed.
+func startDemote(cache *gobuild.S3Cache, every time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			st, err := cache.Demote(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("demote local entries failed", "err", err)
+			} else if err == nil {
+				slog.Debug("demoted local entries", "actions", st.Actions, "demoted", st.Demoted,
+					"bytes", st.Bytes, "errors", st.Errors, "elapsed", st.Elapsed)
+			}
+		}
+	}()
+	return func() { cancel(); <-done }
+}
+
+// flushOnClose returns a close function for cache that calls close, waiting
+// at most timeout for pending uploads to complete. If timeout is zero, there
+// is no limit; if it is negative, close is not called, and the uploads are
+// abandoned. It logs how many uploads were flushed and abandoned.
+func flushOnClose(cache *gobuild.S3Cache, close func(context.Context) error, timeout time.Duration) func(context.Context) error {
+	return func(ctx context.Context) error {
+		pending := len(cache.PendingActions())
+		var err error
+		start := time.Now()
+		if timeout >= 0 {
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			err = close(ctx)
+		}
+		if pending != 0 {
+			left := len(cache.PendingActions())
+			slog.Info("uploads flushed", "flushed", max(pending-left, 0), "abandoned", left,
+				"elapsed", time.Since(start).Round(time.Millisecond))
+		}
+		return err
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/taskgroup"
+	"github.com/creachadair/tlsutil"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// Files stored in the --handoff-dir.
+const (
+	handoffPendingFile = "pending-uploads"
+	handoffCAFile      = "revproxy-ca.pem"
+)
+
+// initStandby acquires the --standby-lock, if one is set, blocking until any
+// active server holding the lock releases it. If no lock is configured it
+// returns a no-op release function.
+func initStandby(ctx context.Context) (release func(), _ error) {
+	if serveFlags.StandbyLock == "" {
+		return noop, nil
+	}
+	release, err := acquireLock(ctx, serveFlags.StandbyLock)
+	if err != nil {
+		return nil, fmt.Errorf("standby lock: %w", err)
+	}
+	slog.Debug("standby: acquired lock, now active", "path", serveFlags.StandbyLock)
+	return release, nil
+}
+
+// resumeHandoff reads the list of pending uploads left in the --handoff-dir
+// by a previous active server, if any, and completes them in the background
+// using g. Any error reading the list is logged and otherwise ignored.
+func resumeHandoff(ctx context.Context, cache *gobuild.S3Cache, g *taskgroup.Group) {
+	if serveFlags.HandoffDir == "" {
+		return
+	}
+	path := filepath.Join(serveFlags.HandoffDir, handoffPendingFile)
+	ids, err := readLines(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return // nothing to resume
+	} else if err != nil {
+		slog.Debug("read handoff failed (ignored)", "err", err)
+		return
+	}
+	os.Remove(path)
+	slog.Debug("handoff: resuming pending uploads", "count", len(ids))
+	g.Run(func() {
+		st, err := cache.SyncActions(ctx, flags.CacheDir, ids)
+		slog.Debug("handoff: resumed uploads", "actions", st.Actions, "synced", st.Synced, "errors", st.Errors, "err", err)
+	})
+}
+
+// saveHandoff records the pending uploads of cache in the --handoff-dir, so
+// that a standby server can complete them if this server exits before they
+// finish. It does nothing if no handoff directory is configured.
+func saveHandoff(cache *gobuild.S3Cache) error {
+	if serveFlags.HandoffDir == "" {
+		return nil
+	}
+	ids := cache.PendingActions()
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(serveFlags.HandoffDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(serveFlags.HandoffDir, handoffPendingFile)
+	if err := atomicfile.WriteData(path, []byte(strings.Join(ids, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	slog.Debug("handoff: saved pending uploads", "count", len(ids))
+	return nil
+}
+
+// loadHandoffCA loads a signing certificate saved in the --handoff-dir by a
+// previous server, if one exists and remains valid for at least minValid.
+// Otherwise, it calls mint to create a new certificate, and saves the result
+// for use by a successor. If no handoff directory is configured, loadHandoffCA
+// simply returns the result of mint.
+func loadHandoffCA(minValid time.Duration, mint func() (tlsutil.Certificate, error)) (tlsutil.Certificate, error) {
+	if serveFlags.HandoffDir == "" {
+		return mint()
+	}
+	path := filepath.Join(serveFlags.HandoffDir, handoffCAFile)
+	if data, err := os.ReadFile(path); err == nil {
+		ca, err := tlsutil.LoadCertificate(data)
+		if err == nil && time.Until(certExpiry(ca)) >= minValid {
+			slog.Debug("handoff: loaded signing cert", "path", path)
+			return ca, nil
+		}
+	}
+	ca, err := mint()
+	if err != nil {
+		return ca, err
+	}
+	if err := os.MkdirAll(serveFlags.HandoffDir, 0700); err != nil {
+		return ca, err
+	}
+	data := append(ca.CertPEM(), ca.PrivKeyPEM()...)
+	if err := atomicfile.WriteData(path, data, 0600); err != nil {
+		slog.Debug("save signing cert failed", "err", err)
+	}
+	return ca, nil
+}
+
+// certExpiry returns the expiration time of the certificate in c, or the zero
+// time if the certificate cannot be parsed.
+func certExpiry(c tlsutil.Certificate) time.Time {
+	blk, _ := pem.Decode(c.CertPEM())
+	if blk == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// readLines reads the non-empty lines of the file at path.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, sc.Err()
+}
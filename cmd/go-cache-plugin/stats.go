@@ -0,0 +1,189 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/creachadair/command"
+)
+
+var statsDiffFlags struct {
+	All  bool `flag:"all,Include metrics that did not change"`
+	JSON bool `flag:"json,Print the differences as a JSON object"`
+}
+
+// runStatsDiff compares two snapshots of metrics, and prints the metrics that
+// differ between them.
+func runStatsDiff(env *command.Env, beforePath, afterPath string) error {
+	before, err := loadSnapshot(beforePath)
+	if err != nil {
+		return err
+	}
+	after, err := loadSnapshot(afterPath)
+	if err != nil {
+		return err
+	}
+
+	names := maps.Clone(before)
+	maps.Copy(names, after)
+	var diffs []statDiff
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		d := diffStat(name, before[name], after[name])
+		if d.changed || statsDiffFlags.All {
+			diffs = append(diffs, d)
+		}
+	}
+	if statsDiffFlags.JSON {
+		out := make(map[string]any)
+		for _, d := range diffs {
+			out[d.name] = d.toJSON()
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tBEFORE\tAFTER\tDELTA\tCHANGE")
+	for _, d := range diffs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.name, d.before, d.after, d.delta, d.percent())
+	}
+	return tw.Flush()
+}
+
+// loadSnapshot reads a JSON object of metrics from the file at path, as
+// reported by the stats operation of the admin API, /debug/vars, or --metrics,
+// and flattens it to a map from dotted metric names to values. Numbers are
+// kept as [json.Number], strings and booleans as themselves; other values
+// (such as lists) are not compared. A path of "-" reads standard input.
+func loadSnapshot(path string) (map[string]any, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("read snapshot %s: %w", path, err)
+	}
+	out := make(map[string]any)
+	flattenStats(out, "", obj)
+	return out, nil
+}
+
+func flattenStats(out map[string]any, prefix string, obj map[string]any) {
+	for key, val := range obj {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := val.(type) {
+		case map[string]any:
+			flattenStats(out, name, v)
+		case json.Number, string, bool:
+			out[name] = v
+		}
+	}
+}
+
+// statDiff is the comparison of one metric in two snapshots.
+type statDiff struct {
+	name          string
+	before, after string // formatted values, or "-" if absent
+	delta         string // formatted difference, or "" if not numeric
+	changed       bool
+
+	numeric  bool
+	old, new float64
+}
+
+// diffStat compares the values of a metric, either of which may be nil if the
+// metric is absent from that snapshot. Absent numbers are treated as zero, as
+// for a counter that has not yet been published.
+func diffStat(name string, before, after any) statDiff {
+	d := statDiff{name: name, before: formatStat(before), after: formatStat(after)}
+	bn, bok := asNumber(before)
+	an, aok := asNumber(after)
+	if (bok || before == nil) && (aok || after == nil) {
+		d.numeric = true
+		d.old, d.new = bn.f, an.f
+		d.delta = an.sub(bn)
+		d.changed = d.old != d.new
+		return d
+	}
+	d.changed = d.before != d.after
+	return d
+}
+
+func (d statDiff) percent() string {
+	if !d.numeric || d.old == 0 || !d.changed {
+		return ""
+	}
+	return fmt.Sprintf("%+.1f%%", 100*(d.new-d.old)/d.old)
+}
+
+func (d statDiff) toJSON() map[string]any {
+	v := map[string]any{"before": d.before, "after": d.after}
+	if d.numeric {
+		v["before"], v["after"] = d.old, d.new
+		v["delta"] = d.new - d.old
+	}
+	return v
+}
+
+func formatStat(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// statNumber is a numeric metric value, kept as an integer if possible so
+// that large counters are compared exactly.
+type statNumber struct {
+	i     int64
+	f     float64
+	isInt bool
+}
+
+func asNumber(v any) (statNumber, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return statNumber{isInt: true}, false
+	}
+	if i, err := n.Int64(); err == nil {
+		return statNumber{i: i, f: float64(i), isInt: true}, true
+	}
+	f, err := n.Float64()
+	return statNumber{f: f}, err == nil
+}
+
+// sub formats the difference n - m.
+func (n statNumber) sub(m statNumber) string {
+	if n.isInt && m.isInt {
+		return fmt.Sprintf("%+d", n.i-m.i)
+	}
+	return fmt.Sprintf("%+g", n.f-m.f)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/grafana/go-cache-plugin/lib/statsd"
+)
+
+// statsdGauges are the integer metrics published by this program that report
+// a current level rather than a running count, in addition to those
+// recognized by [statsd.DefaultGauge].
+var statsdGauges = []string{
+	"gocache_config_version",
+	"modtemp.temp_bytes",
+	"modtemp.temp_entries",
+}
+
+// isStatsdGauge reports whether the metric with the given flattened name is
+// sent to StatsD as a gauge.
+func isStatsdGauge(name string) bool {
+	return statsd.DefaultGauge(name) || slices.Contains(statsdGauges, name) ||
+		strings.HasSuffix(name, "_depth") || strings.HasSuffix(name, "_lag_seconds")
+}
+
+// startStatsd starts sending metrics to the --statsd-addr, if it is set, until
+// ctx ends. The caller must call stop before exiting, which sends the final
+// values of the metrics.
+func startStatsd(ctx context.Context) (stop func()) {
+	if flags.StatsdAddr == "" {
+		return noop
+	}
+	e := &statsd.Exporter{
+		Addr:     flags.StatsdAddr,
+		Prefix:   cmp.Or(flags.StatsdPrefix, "gocache"),
+		Interval: flags.StatsdEvery,
+		IsGauge:  isStatsdGauge,
+		Logger:   slog.Default(),
+	}
+	if flags.StatsdTags != "" {
+		e.Tags = strings.Split(flags.StatsdTags, ",")
+	}
+	slog.Debug("sending metrics to statsd", "addr", e.Addr, "prefix", e.Prefix, "tags", e.Tags)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := e.Run(ctx); err != nil {
+			slog.Warn("statsd export failed", "addr", e.Addr, "err", err)
+		}
+	}()
+	return func() { cancel(); <-done }
+}
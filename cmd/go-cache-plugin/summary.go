@@ -0,0 +1,163 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// startSummary logs a summary of the build cache hits and misses every period
+// in g until ctx ends, covering the requests since the previous summary. If
+// period <= 0, startSummary does nothing.
+func startSummary(ctx context.Context, g *taskgroup.Group, cache *gobuild.S3Cache, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	g.Run(func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+		last := cache.GetStats()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			cur := cache.GetStats()
+			d := cur.Sub(last)
+			last = cur
+			if d.Total() == 0 {
+				continue // nothing to report
+			}
+			slog.Info("cache summary", "requests", d.Total(), "hits", d.Hits,
+				"hit_ratio", d.HitRatio(), "total_hit_ratio", cur.HitRatio(),
+				"miss_not_local", d.Misses[gobuild.MissNotLocal],
+				"miss_not_remote", d.Misses[gobuild.MissNotRemote],
+				"miss_expired", d.Misses[gobuild.MissExpired],
+				"miss_small", d.Misses[gobuild.MissSmall],
+				"miss_error", d.Misses[gobuild.MissError],
+				"miss_low_disk", d.Misses[gobuild.MissLowDisk])
+		}
+	})
+}
+
+// A statsRecord is the end-of-run report uploaded by --stats-upload, with
+// the details of the host and the CI job that ran the build.
+type statsRecord struct {
+	runReport
+	Host      string `json:"host,omitempty"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+	GoVersion string `json:"go_version"`
+	Namespace string `json:"namespace,omitempty"`
+	ciMetadata
+}
+
+// ciMetadata describes the CI job that ran the build, as reported by the
+// environment variables of common CI systems.
+type ciMetadata struct {
+	Provider   string `json:"ci_provider,omitempty"`
+	Repository string `json:"ci_repository,omitempty"`
+	Branch     string `json:"ci_branch,omitempty"`
+	Commit     string `json:"ci_commit,omitempty"`
+	Workflow   string `json:"ci_workflow,omitempty"`
+	Job        string `json:"ci_job,omitempty"`
+	RunID      string `json:"ci_run_id,omitempty"`
+}
+
+// ciProviders are the CI systems recognized by ciFromEnv, each with a
+// variable set in its jobs.
+var ciProviders = []struct{ name, env string }{
+	{"github", "GITHUB_ACTIONS"},
+	{"gitlab", "GITLAB_CI"},
+	{"buildkite", "BUILDKITE"},
+	{"circleci", "CIRCLECI"},
+	{"jenkins", "JENKINS_URL"},
+}
+
+// ciFromEnv returns the metadata of the CI job in which the plugin runs, from
+// the first of the variables for each field that is set.
+func ciFromEnv() ciMetadata {
+	first := func(names ...string) string {
+		for _, name := range names {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	var md ciMetadata
+	for _, p := range ciProviders {
+		if os.Getenv(p.env) != "" {
+			md.Provider = p.name
+			break
+		}
+	}
+	if md.Provider == "" && os.Getenv("CI") != "" {
+		md.Provider = "unknown"
+	}
+	md.Repository = first("GITHUB_REPOSITORY", "CI_PROJECT_PATH", "BUILDKITE_REPO", "CIRCLE_PROJECT_REPONAME", "GIT_URL")
+	md.Branch = first("GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_REF_NAME", "BUILDKITE_BRANCH", "CIRCLE_BRANCH", "GIT_BRANCH")
+	md.Commit = first("GITHUB_SHA", "CI_COMMIT_SHA", "BUILDKITE_COMMIT", "CIRCLE_SHA1", "GIT_COMMIT")
+	md.Workflow = first("GITHUB_WORKFLOW", "CI_PIPELINE_NAME", "BUILDKITE_PIPELINE_SLUG", "CIRCLE_WORKFLOW_ID")
+	md.Job = first("GITHUB_JOB", "CI_JOB_NAME", "BUILDKITE_LABEL", "CIRCLE_JOB", "JOB_NAME")
+	md.RunID = first("GITHUB_RUN_ID", "CI_PIPELINE_ID", "BUILDKITE_BUILD_ID", "CIRCLE_BUILD_NUM", "BUILD_NUMBER")
+	return md
+}
+
+// uploadSession writes rpt, with the details of the host and CI job, to the
+// bucket of cache as a single line of JSON, under the key
+//
+//	<prefix>/stats/dt=<yyyy-mm-dd>/<time>-<random>.json
+//
+// so that the runs of a fleet can be queried as a table partitioned by date,
+// as with Athena. A run that made no requests is not recorded. Errors are
+// logged, and do not affect the run.
+func uploadSession(ctx context.Context, cache *gobuild.S3Cache, rpt runReport) {
+	if rpt.Requests == 0 {
+		return
+	} else if cache.S3Client.ReadOnly {
+		slog.Debug("not uploading session stats to a read-only bucket")
+		return
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(statsRecord{
+		runReport:  rpt,
+		Host:       host,
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		GoVersion:  runtime.Version(),
+		Namespace:  flags.Namespace,
+		ciMetadata: ciFromEnv(),
+	})
+	if err != nil {
+		slog.Warn("encode session stats failed", "err", err)
+		return
+	}
+	var tag [4]byte
+	rand.Read(tag[:])
+	key := path.Join(flags.KeyPrefix, "stats", "dt="+rpt.Time.Format(time.DateOnly),
+		rpt.Time.Format("20060102T150405Z")+"-"+hex.EncodeToString(tag[:])+".json")
+
+	// The run is over, so its context may already have ended.
+	uctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	if err := cache.S3Client.Put(uctx, key, bytes.NewReader(append(data, '\n'))); err != nil {
+		slog.Warn("upload session stats failed", "key", key, "err", err)
+		return
+	}
+	slog.Debug("uploaded session stats", "key", key)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// readTierConfig maps namespaces to the build cache read tiers they use.
+// The empty namespace gives the tiers for builds with no other match.
+type readTierConfig map[string][]string
+
+// parseReadTiers parses the --read-tiers flag. The value is a semicolon-
+// separated list of entries of the form "[namespace=]tier,...".
+func parseReadTiers(s string) (readTierConfig, error) {
+	cfg := make(readTierConfig)
+	for entry := range strings.SplitSeq(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ns, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			ns, list = "", ns
+		}
+		if _, dup := cfg[ns]; dup {
+			return nil, fmt.Errorf("duplicate read tiers for namespace %q", ns)
+		}
+		tiers, err := gobuild.ParseReadTiers(list)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %w", ns, err)
+		}
+		cfg[ns] = tiers
+	}
+	return cfg, nil
+}
+
+// policy returns a read policy for a build in the given namespace.
+func (c readTierConfig) policy(ns string) *gobuild.ReadPolicy {
+	p := new(gobuild.ReadPolicy)
+	c.apply(p, ns)
+	return p
+}
+
+// apply sets the tiers of p for a build in the given namespace.
+func (c readTierConfig) apply(p *gobuild.ReadPolicy, ns string) {
+	tiers, ok := c[ns]
+	if !ok {
+		tiers = c[""]
+	}
+	p.SetTiers(tiers)
+}
+
+// namespacePreamble begins the line sent by the connect command to name the
+// namespace of a build, ahead of the cache protocol. It cannot be confused
+// with the protocol, whose messages are JSON objects.
+const namespacePreamble = "GOCACHE-NAMESPACE "
+
+// chainPreamble begins the line sent by the connect command to give the
+// --namespace-chain of a build. It follows the namespace line, if any.
+const chainPreamble = "GOCACHE-CHAIN "
+
+// writeNamespace sends the preamble for namespace ns to w.
+func writeNamespace(w io.Writer, ns string) error {
+	_, err := fmt.Fprintf(w, "%s%s\n", namespacePreamble, ns)
+	return err
+}
+
+// writeChain sends the preamble for the namespace chain to w.
+func writeChain(w io.Writer, chain []string) error {
+	_, err := fmt.Fprintf(w, "%s%s\n", chainPreamble, strings.Join(chain, ","))
+	return err
+}
+
+// clientPreamble is the information sent by the connect command ahead of the
+// cache protocol.
+type clientPreamble struct {
+	Namespace string   // the --namespace of the build, or ""
+	Chain     []string // the --namespace-chain of the build, or nil
+}
+
+// namespaceConn wraps a plugin connection to consume the preamble sent by the
+// connect command, if there is one. Since the go command does not send a
+// request until the server has announced its capabilities, the preamble is
+// not read until the server first reads a request, and then set is called
+// with its contents, before any request is delivered.
+type namespaceConn struct {
+	io.ReadWriter
+	br   *bufio.Reader
+	once sync.Once
+	err  error // an invalid preamble, reported by each Read
+	set  func(clientPreamble)
+}
+
+func newNamespaceConn(rw io.ReadWriter, set func(clientPreamble)) *namespaceConn {
+	return &namespaceConn{ReadWriter: rw, br: bufio.NewReader(rw), set: set}
+}
+
+func (c *namespaceConn) Read(data []byte) (int, error) {
+	c.once.Do(func() {
+		var pre clientPreamble
+		for {
+			tag, err := c.br.Peek(len("GOCACHE-"))
+			if err != nil || string(tag) != "GOCACHE-" {
+				break // no more preamble; the protocol begins here
+			}
+			line, err := c.br.ReadString('\n')
+			if err != nil {
+				return // let the protocol reader see the error
+			}
+			line = strings.TrimSpace(line)
+			if ns, ok := strings.CutPrefix(line, namespacePreamble); ok {
+				pre.Namespace = strings.TrimSpace(ns)
+			} else if chain, ok := strings.CutPrefix(line, chainPreamble); ok {
+				pre.Chain, c.err = gobuild.ParseNamespaceChain(chain)
+				if c.err != nil {
+					c.err = fmt.Errorf("invalid namespace chain: %w", c.err)
+					return
+				}
+			} else {
+				c.err = fmt.Errorf("unknown preamble %q", line)
+				return
+			}
+		}
+		slog.Debug("client namespace", "namespace", pre.Namespace, "chain", pre.Chain)
+		c.set(pre)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(data)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+var trainDictFlags struct {
+	MaxObjectSize int64 `flag:"max-object-size,Sample only objects up to this size (in bytes; default 64KiB)"`
+	Samples       int   `flag:"samples,Maximum number of objects to sample (default 2000)"`
+	DictSize      int   `flag:"dict-size,Maximum size of the dictionary (in bytes; default 112KiB)"`
+	DryRun        bool  `flag:"n,Train and measure the dictionary without storing it"`
+}
+
+// runTrainDict trains a zstd dictionary on a sample of the small objects in
+// the remote build cache under the --prefix, and stores it as the current
+// dictionary for the prefix.
+func runTrainDict(env *command.Env) error {
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
+	if err != nil {
+		return env.Usagef("invalid --key-transform: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	cache := &gobuild.S3Cache{
+		S3Client:          client,
+		KeyPrefix:         flags.KeyPrefix,
+		KeyFunc:           keyFunc,
+		UploadConcurrency: flags.S3Concurrency,
+		Logger:            slog.Default(),
+	}
+	stats, err := cache.TrainDictionary(env.Context(), gobuild.TrainOptions{
+		MaxObjectSize: trainDictFlags.MaxObjectSize,
+		Samples:       trainDictFlags.Samples,
+		DictSize:      trainDictFlags.DictSize,
+		DryRun:        trainDictFlags.DryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("train dictionary: %w", err)
+	}
+	var ratio float64
+	if stats.Plain > 0 {
+		ratio = float64(stats.Trained) / float64(stats.Plain)
+	}
+	slog.Info("dictionary trained", "id", stats.ID, "size", stats.Size, "listed", stats.Listed,
+		"sampled", stats.Sampled, "sample_bytes", stats.SampleBytes, "plain_bytes", stats.Plain,
+		"trained_bytes", stats.Trained, "ratio", fmt.Sprintf("%.3f", ratio),
+		"elapsed", stats.Elapsed, "dry_run", trainDictFlags.DryRun)
+	return nil
+}
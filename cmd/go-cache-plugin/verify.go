@@ -0,0 +1,75 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+var verifyFlags struct {
+	Sample  int           `flag:"sample,Compare this many local actions chosen at random (default all)"`
+	Digest  bool          `flag:"digest,Read each remote object and check its digest against its output ID"`
+	Orphans bool          `flag:"orphans,Also report remote objects not referenced by any remote action"`
+	MinAge  time.Duration `flag:"min-age,Report unreferenced objects only if older than this (default 1h)"`
+}
+
+// runVerify compares the local cache directory with the remote cache in S3,
+// and prints the differences found. It reports an error if there are any, so
+// that a job gating on the shared cache fails visibly.
+func runVerify(env *command.Env) error {
+	if flags.CacheDir == "" {
+		return env.Usagef("you must provide a --cache-dir")
+	} else if verifyFlags.Sample < 0 {
+		return env.Usagef("--sample must not be negative")
+	}
+	keyFunc, err := gobuild.ParseKeyFunc(flags.KeyTransform)
+	if err != nil {
+		return env.Usagef("invalid --key-transform: %v", err)
+	}
+	testPolicy, err := gobuild.ParseTestPolicy(flags.TestResults)
+	if err != nil {
+		return env.Usagef("invalid --test-results: %v", err)
+	}
+	client, err := initS3Client(env)
+	if err != nil {
+		return err
+	}
+	cache := &gobuild.S3Cache{
+		S3Client:          client,
+		KeyPrefix:         flags.KeyPrefix,
+		KeyFunc:           keyFunc,
+		MinUploadSize:     flags.MinUploadSize,
+		TestResults:       testPolicy,
+		UploadConcurrency: flags.S3Concurrency,
+		Logger:            slog.Default(),
+	}
+	stats, err := cache.Verify(env.Context(), flags.CacheDir, gobuild.VerifyOptions{
+		Sample:  verifyFlags.Sample,
+		Digest:  verifyFlags.Digest,
+		Orphans: verifyFlags.Orphans,
+		MinAge:  verifyFlags.MinAge,
+	}, func(p gobuild.Problem) {
+		fmt.Printf("%s\t%s\t%s\n", p.Kind, p.Key, p.Detail)
+	})
+	var nproblems int64
+	for _, n := range stats.Problems {
+		nproblems += n
+	}
+	slog.Info("verify complete", "local", stats.Local, "compared", stats.Compared, "matched", stats.Matched,
+		"skipped", stats.Skipped, "verified", stats.Verified,
+		"unsynced", stats.Problems[gobuild.ProblemUnsynced], "drift", stats.Problems[gobuild.ProblemDrift],
+		"corrupt", stats.Problems[gobuild.ProblemCorrupt], "missing", stats.Problems[gobuild.ProblemMissing],
+		"mismatch", stats.Problems[gobuild.ProblemMismatch], "orphan", stats.Problems[gobuild.ProblemOrphan])
+	if err != nil {
+		return fmt.Errorf("verify failed: %w", err)
+	} else if nproblems != 0 {
+		return fmt.Errorf("found %d problems", nproblems)
+	}
+	return nil
+}
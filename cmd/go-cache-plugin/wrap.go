@@ -0,0 +1,183 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/creachadair/command"
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// deferred, if non-nil, holds the uploads to S3 of the builds served by this
+// process until they are committed or discarded (see --defer-uploads and the
+// "wrap" command).
+var deferred *gobuild.Deferral
+
+// wrapArgs are the arguments following "--" on the command line, which give
+// the command run by "wrap".
+var wrapArgs []string
+
+// runWrap runs the command given by args (and wrapArgs) with a cache server for
+// the builds it runs, and defers their uploads to S3 until the command exits.
+// If the command succeeds, the deferred uploads are committed; otherwise they
+// are discarded. The exit status of runWrap is that of the command.
+func runWrap(env *command.Env, args ...string) error {
+	args = append(args, wrapArgs...)
+	if len(args) == 0 {
+		return env.Usagef("you must provide a command to run")
+	}
+	s, cache, err := initCacheServer(env)
+	if err != nil {
+		return err
+	}
+	// The command may run many builds, each of which closes its connection;
+	// close the cache only when the command exits, as the "serve" command does.
+	closeHook := s.Close
+	s.Close = noopClose
+
+	tiers, err := parseReadTiers(flags.ReadTiers)
+	if err != nil {
+		return env.Usagef("invalid --read-tiers: %v", err)
+	}
+	if _, err := gobuild.ParseNamespaceChain(flags.Chain); err != nil {
+		return env.Usagef("invalid --namespace-chain: %v", err)
+	}
+	publishConfig(tiers)
+	deferred = new(gobuild.Deferral)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Serve the builds of the command on a Unix-domain socket in a private
+	// directory, so that connections need not be authenticated.
+	dir, err := os.MkdirTemp("", "gocache-wrap-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "plugin.sock")
+	lst, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	slog.Debug("plugin listening", "network", "unix", "addr", sock)
+
+	ctx, cancel := signal.NotifyContext(env.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var replays taskgroup.Group
+	replayJournals(ctx, cache, &replays)
+
+	var conns taskgroup.Group
+	accept := taskgroup.Go(func() error {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return nil // listener closed
+			}
+			conns.Go(func() error {
+				defer conn.Close()
+				if err := serveWrapped(ctx, s, tiers, conn); err != nil {
+					slog.Warn("client error", "err", err)
+				}
+				return nil
+			})
+		}
+	})
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GOCACHEPROG="+quoteArgs(exe, "connect", sock),
+		"GOCACHE_PLUGIN_KEY_FILE=", // the socket is private
+		"GOCACHE_NAMESPACE="+flags.Namespace,
+		"GOCACHE_NAMESPACE_CHAIN="+flags.Chain,
+	)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	runErr := cmd.Run()
+
+	lst.Close()
+	accept.Wait()
+	conns.Wait()
+	replays.Wait()
+
+	cctx := gocache.WithLogf(env.Context(), printfLogger(slog.Default(), slog.LevelInfo))
+	if runErr == nil {
+		st, err := cache.Commit(cctx, flags.CacheDir, deferred)
+		if err != nil {
+			slog.Warn("commit deferred uploads failed", "err", err)
+		}
+		slog.Info("committed deferred uploads", "actions", st.Actions, "synced", st.Synced,
+			"skipped", st.Skipped, "errors", st.Errors, "elapsed", st.Elapsed)
+	} else {
+		n := deferred.Discard()
+		slog.Info("command failed, discarded deferred uploads", "actions", n, "err", runErr)
+	}
+	if err := closeHook(cctx); err != nil {
+		slog.Warn("server close failed (ignored)", "err", err)
+	}
+
+	var xerr *exec.ExitError
+	if errors.As(runErr, &xerr) {
+		os.RemoveAll(dir)
+		os.Exit(max(xerr.ExitCode(), 1)) // -1 if killed by a signal
+	}
+	return runErr
+}
+
+// serveWrapped serves the requests of one build of a wrapped command on conn,
+// deferring its uploads.
+func serveWrapped(ctx context.Context, s *gocache.Server, tiers readTierConfig, conn io.ReadWriter) error {
+	policy := tiers.policy("")
+	chain := new(gobuild.NamespaceChain)
+	rw := newNamespaceConn(conn, func(pre clientPreamble) {
+		tiers.apply(policy, pre.Namespace)
+		chain.SetNames(pre.Chain)
+	})
+	ctx = gobuild.WithReadPolicy(ctx, policy)
+	ctx = gobuild.WithNamespaceChain(ctx, chain)
+	ctx = gobuild.WithDeferral(ctx, deferred)
+	if flags.Audit != "" {
+		m, closeManifest, err := openManifest(connManifestPath())
+		if err != nil {
+			return err
+		}
+		defer closeManifest()
+		ctx = gobuild.WithManifest(ctx, m)
+	}
+	return runClient(ctx, s, rw, rw)
+}
+
+// quoteArgs joins args into a command line for GOCACHEPROG, quoting those that
+// contain spaces or quotes, as the go command splits it into fields.
+func quoteArgs(args ...string) string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case !strings.ContainsAny(arg, " \t\n'\""):
+			out[i] = arg
+		case strings.Contains(arg, "'"):
+			out[i] = `"` + arg + `"`
+		default:
+			out[i] = "'" + arg + "'"
+		}
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,700 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package actionscache implements the GitHub Actions cache service protocol,
+// backed by objects in an S3 bucket, so that the actions/cache action and
+// other tools that use ACTIONS_CACHE_URL can store their caches in S3 on
+// self-hosted runners.
+//
+// The protocol has four operations, relative to the service URL:
+//
+//   - Query (GET _apis/artifactcache/cache?keys=k1,k2,...&version=v) looks up
+//     the best entry matching the keys, and reports a URL to download it from.
+//   - Reserve (POST _apis/artifactcache/caches) reserves a new entry for a key
+//     and version, and returns an ID for the upload.
+//   - Upload (PATCH _apis/artifactcache/caches/<id>) writes a chunk of the
+//     archive for a reserved entry, at the offset given by Content-Range.
+//   - Commit (POST _apis/artifactcache/caches/<id>) completes the upload, and
+//     makes the entry visible to queries.
+//
+// Archives are also served by the proxy, under _apis/artifactcache/artifacts.
+//
+// As in the GitHub service, each request to the API must carry a runtime token
+// as a bearer token, and the entries of the cache are scoped by ref: the
+// token lists the refs whose entries the job may read, and the ref under
+// which it may write new entries (see [NewToken]). Archive downloads do not
+// carry a token, so their URLs are signed instead.
+package actionscache
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// Server is an implementation of the GitHub Actions cache service.
+//
+// # Cache Layout
+//
+// Each committed cache entry is stored in S3 under the ref that wrote it, its
+// version, and its key, path-escaped so that keys sharing a prefix share an
+// S3 prefix:
+//
+//	<prefix>/entry/<escaped-ref>/<version>/<escaped-key>
+//
+// A copy of each archive uploaded or downloaded is kept in the local cache
+// directory under the same name, and uploads in progress are staged in
+// <local>/upload.
+//
+// Entries are matched by the rules of the GitHub service: the refs the token
+// may read are tried in the order it lists them, and for each ref, keys are
+// tried in order. For each key, an entry with exactly that key is preferred,
+// otherwise the most recently created entry whose key has it as a prefix.
+// Only entries with the requested version are considered. New entries are
+// written under the first ref the token may write.
+type Server struct {
+	// BaseURL, if non-empty, is the external base URL of the service, used to
+	// construct archive download URLs (for example,
+	// "http://cache.example.com:5970/gha"). If empty, it is derived from the
+	// Host of each request and MountPath.
+	BaseURL string
+
+	// MountPath is the path prefix at which the service is mounted (e.g.,
+	// "/gha"), used to derive the base URL when BaseURL is empty.
+	MountPath string
+
+	// Local is the path of a local cache directory where archives are cached
+	// and uploads are staged. It must be non-empty.
+	Local string
+
+	// S3Client is the S3 client used to read and write cache entries to the
+	// backing store. It must be non-nil.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
+	// intervening slash.
+	KeyPrefix string
+
+	// MultipartThreshold, if positive, defines a minimum archive size in bytes
+	// at or above which archives are written to S3 by a multipart upload, using
+	// the settings in Multipart.
+	MultipartThreshold int64
+
+	// Multipart are the settings used for multipart uploads.
+	Multipart s3util.MultipartOptions
+
+	// Secret is the key used to verify the runtime tokens of requests, and to
+	// sign archive URLs. If it is empty, every request is rejected.
+	Secret string
+
+	// UploadTimeout is how long a reserved entry may go without activity
+	// before its upload is abandoned. If zero, a default of 1 hour is used.
+	UploadTimeout time.Duration
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each request handled by the service is logged at [slog.LevelDebug] when
+	// it is finished, with the message "query", "reserve", "upload", "commit",
+	// or "download", and attributes describing the request.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	nextID  int
+	uploads map[int]*upload
+
+	queryRequest   expvar.Int // query requests
+	queryHit       expvar.Int // queries that matched an entry
+	queryMiss      expvar.Int // queries that matched no entry
+	reserveRequest expvar.Int // reserve requests
+	reserveExists  expvar.Int // reserve requests for an existing entry
+	uploadBytes    expvar.Int // bytes of archive chunks received
+	commitRequest  expvar.Int // commit requests
+	commitError    expvar.Int // commits that failed
+	denied         expvar.Int // requests rejected for a missing or invalid token
+	abandoned      expvar.Int // reservations abandoned without a commit
+	getRequest     expvar.Int // archive download requests
+	getLocalHit    expvar.Int // archives served from the local cache
+	getFaultHit    expvar.Int // archives faulted in from S3
+	getError       expvar.Int // archive downloads that failed
+	pushBytes      expvar.Int // bytes written to S3
+}
+
+// An upload is an entry reserved but not yet committed.
+type upload struct {
+	scope        string // the ref the entry is written under
+	key, version string
+	path         string // the staging file
+	lastActive   time.Time
+
+	mu sync.Mutex // serializes writes to f
+	f  *os.File
+}
+
+// Metrics returns a map of service metrics for s. The caller is responsible to
+// publish these metrics as desired.
+func (s *Server) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("query_request", &s.queryRequest)
+	m.Set("query_hit", &s.queryHit)
+	m.Set("query_miss", &s.queryMiss)
+	m.Set("reserve_request", &s.reserveRequest)
+	m.Set("reserve_exists", &s.reserveExists)
+	m.Set("upload_bytes", &s.uploadBytes)
+	m.Set("commit_request", &s.commitRequest)
+	m.Set("commit_error", &s.commitError)
+	m.Set("denied", &s.denied)
+	m.Set("upload_abandoned", &s.abandoned)
+	m.Set("get_request", &s.getRequest)
+	m.Set("get_local_hit", &s.getLocalHit)
+	m.Set("get_fault_hit", &s.getFaultHit)
+	m.Set("get_error", &s.getError)
+	m.Set("push_bytes", &s.pushBytes)
+	return m
+}
+
+// Close abandons any uploads that have not been committed, and removes their
+// staging files.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for id, u := range s.uploads {
+		errs = append(errs, u.discard())
+		delete(s.uploads, id)
+		s.abandoned.Add(1)
+	}
+	return errors.Join(errs...)
+}
+
+const apiPrefix = "/_apis/artifactcache/"
+
+// ServeHTTP implements the [http.Handler] interface for the service.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, apiPrefix)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	op, arg, _ := strings.Cut(rest, "/")
+	if op == "artifacts" && arg != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		// Refs and keys are path-escaped in archive URLs, so use the raw path.
+		arg = strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix+"artifacts/")
+		s.serveArchive(w, r, arg)
+		return
+	}
+	scopes, err := s.authorize(r)
+	if err != nil {
+		s.denied.Add(1)
+		s.logger().Debug("denied", "op", op, "err", err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="actionscache"`)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	switch {
+	case op == "cache" && arg == "" && r.Method == http.MethodGet:
+		s.serveQuery(w, r, scopes)
+	case op == "caches" && arg == "" && r.Method == http.MethodPost:
+		s.serveReserve(w, r, scopes)
+	case op == "caches" && arg != "" && r.Method == http.MethodPatch:
+		s.serveUpload(w, r, arg, scopes)
+	case op == "caches" && arg != "" && r.Method == http.MethodPost:
+		s.serveCommit(w, r, arg, scopes)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorize verifies the runtime token of r, and returns the scopes it
+// grants.
+func (s *Server) authorize(r *http.Request) ([]Scope, error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errUnauthorized
+	}
+	return parseToken(s.Secret, tok, time.Now())
+}
+
+// writeScope returns the ref under which scopes permit new entries to be
+// written, or "" if they permit none.
+func writeScope(scopes []Scope) string {
+	for _, sc := range scopes {
+		if sc.Permission&PermWrite != 0 && validKey(sc.Scope) {
+			return sc.Scope
+		}
+	}
+	return ""
+}
+
+// canWrite reports whether scopes permit writing entries under ref.
+func canWrite(scopes []Scope, ref string) bool {
+	for _, sc := range scopes {
+		if sc.Scope == ref && sc.Permission&PermWrite != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// queryResult is the response to a successful query.
+type queryResult struct {
+	Key             string    `json:"cacheKey"`
+	CreationTime    time.Time `json:"creationTime"`
+	ArchiveLocation string    `json:"archiveLocation"`
+}
+
+// serveQuery handles a query for the best entry matching a list of keys,
+// among the refs that scopes permit reading.
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request, scopes []Scope) {
+	s.queryRequest.Add(1)
+	start := time.Now()
+	keys := strings.Split(r.URL.Query().Get("keys"), ",")
+	version := r.URL.Query().Get("version")
+	if !validVersion(version) {
+		writeError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+	for _, sc := range scopes {
+		if sc.Permission&PermRead == 0 || !validKey(sc.Scope) {
+			continue
+		}
+		for _, key := range keys {
+			if key == "" {
+				continue
+			}
+			obj, err := s.findEntry(r.Context(), sc.Scope, version, key, false)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				s.logger().Debug("query", "keys", keys, "result", "error", "elapsed", time.Since(start), "err", err)
+				writeError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			ekey := path.Base(obj.Key)
+			found, _ := url.PathUnescape(ekey)
+			s.queryHit.Add(1)
+			s.logger().Debug("query", "keys", keys, "result", "hit", "ref", sc.Scope, "match", found, "elapsed", time.Since(start))
+			apath := url.PathEscape(sc.Scope) + "/" + version + "/" + url.PathEscape(ekey)
+			writeJSON(w, http.StatusOK, queryResult{
+				Key:             found,
+				CreationTime:    obj.ModTime.UTC(),
+				ArchiveLocation: s.baseURL(r) + apiPrefix + "artifacts/" + apath + "?sig=" + signArchive(s.Secret, apath),
+			})
+			return
+		}
+	}
+	s.queryMiss.Add(1)
+	s.logger().Debug("query", "keys", keys, "result", "miss", "elapsed", time.Since(start))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findEntry returns the S3 object of the best entry for key and version under
+// ref. If exact is true, only an entry with exactly that key is considered.
+// If there is none, the error satisfies [fs.ErrNotExist].
+func (s *Server) findEntry(ctx context.Context, ref, version, key string, exact bool) (s3util.ObjectInfo, error) {
+	want := s.makeKey(url.PathEscape(ref), version, url.PathEscape(key))
+	var best s3util.ObjectInfo
+	err := s.S3Client.List(ctx, want, func(obj s3util.ObjectInfo) error {
+		if obj.Key == want {
+			best = obj
+			return errStop
+		}
+		if !exact && obj.ModTime.After(best.ModTime) {
+			best = obj
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return best, err
+	}
+	if best.Key == "" {
+		return best, fs.ErrNotExist
+	}
+	return best, nil
+}
+
+var errStop = errors.New("stop listing")
+
+// reserveRequest is the body of a request to reserve an entry.
+type reserveRequest struct {
+	Key       string `json:"key"`
+	Version   string `json:"version"`
+	CacheSize int64  `json:"cacheSize"`
+}
+
+// serveReserve handles a request to reserve a new entry, under the ref that
+// scopes permit writing.
+func (s *Server) serveReserve(w http.ResponseWriter, r *http.Request, scopes []Scope) {
+	s.reserveRequest.Add(1)
+	ref := writeScope(scopes)
+	if ref == "" {
+		writeError(w, http.StatusForbidden, "token does not permit writing")
+		return
+	}
+	var req reserveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	} else if !validKey(req.Key) || !validVersion(req.Version) {
+		writeError(w, http.StatusBadRequest, "invalid key or version")
+		return
+	}
+
+	// Entries are immutable, so a key that already exists cannot be reserved.
+	if _, err := s.findEntry(r.Context(), ref, req.Version, req.Key, true); err == nil {
+		s.checkExists(w, req)
+		return
+	}
+
+	id, err := s.reserve(ref, req)
+	if err != nil {
+		s.logger().Debug("reserve", "key", req.Key, "result", "error", "err", err)
+		if errors.Is(err, fs.ErrExist) {
+			s.checkExists(w, req)
+		} else {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	s.logger().Debug("reserve", "key", req.Key, "ref", ref, "id", id, "size", req.CacheSize)
+	writeJSON(w, http.StatusCreated, map[string]int{"cacheId": id})
+}
+
+func (s *Server) checkExists(w http.ResponseWriter, req reserveRequest) {
+	s.reserveExists.Add(1)
+	s.logger().Debug("reserve", "key", req.Key, "result", "exists")
+	writeError(w, http.StatusConflict, fmt.Sprintf("cache entry for key %q already exists", req.Key))
+}
+
+// reserve creates an upload for req under ref and returns its ID. If another
+// upload for the same ref, key, and version is in progress, the error
+// satisfies [fs.ErrExist].
+func (s *Server) reserve(ref string, req reserveRequest) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploads == nil {
+		s.uploads = make(map[int]*upload)
+	}
+
+	// Clean up any uploads that have been abandoned.
+	for id, u := range s.uploads {
+		if time.Since(u.lastActive) > s.uploadTimeout() {
+			u.discard()
+			delete(s.uploads, id)
+			s.abandoned.Add(1)
+			s.logger().Debug("upload abandoned", "key", u.key, "id", id)
+		} else if u.scope == ref && u.key == req.Key && u.version == req.Version {
+			return 0, fmt.Errorf("key %q: upload in progress: %w", req.Key, fs.ErrExist)
+		}
+	}
+
+	dir := filepath.Join(s.Local, "upload")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, "archive-*")
+	if err != nil {
+		return 0, err
+	}
+	s.nextID++
+	s.uploads[s.nextID] = &upload{
+		scope:      ref,
+		key:        req.Key,
+		version:    req.Version,
+		path:       f.Name(),
+		lastActive: time.Now(),
+		f:          f,
+	}
+	return s.nextID, nil
+}
+
+// lookup returns the upload with the given ID, or nil. Uploads under a ref
+// that scopes do not permit writing are not found.
+func (s *Server) lookup(arg string, scopes []Scope) (int, *upload) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[id]
+	if u == nil || !canWrite(scopes, u.scope) {
+		return id, nil
+	}
+	u.lastActive = time.Now()
+	return id, u
+}
+
+// serveUpload handles a request to write a chunk of an archive.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, arg string, scopes []Scope) {
+	id, u := s.lookup(arg, scopes)
+	if u == nil {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	offset, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.f == nil {
+		writeError(w, http.StatusNotFound, "upload is closed")
+		return
+	}
+	nw, err := io.Copy(io.NewOffsetWriter(u.f, offset), r.Body)
+	s.uploadBytes.Add(nw)
+	if err != nil {
+		s.logger().Debug("upload", "key", u.key, "id", id, "offset", offset, "result", "error", "err", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger().Debug("upload", "key", u.key, "id", id, "offset", offset, "size", nw)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseContentRange parses the starting offset from a Content-Range header of
+// the form "bytes <start>-<end>/*".
+func parseContentRange(s string) (int64, error) {
+	rest, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	start, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	v, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return v, nil
+}
+
+// serveCommit handles a request to complete an upload.
+func (s *Server) serveCommit(w http.ResponseWriter, r *http.Request, arg string, scopes []Scope) {
+	s.commitRequest.Add(1)
+	start := time.Now()
+	id, u := s.lookup(arg, scopes)
+	if u == nil {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+	var req struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	// Remove the upload from the table, so no more chunks are accepted.
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.discard()
+
+	if err := s.commit(r.Context(), u, req.Size); err != nil {
+		s.commitError.Add(1)
+		s.logger().Debug("commit", "key", u.key, "id", id, "result", "error", "elapsed", time.Since(start), "err", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.logger().Debug("commit", "key", u.key, "id", id, "size", req.Size, "elapsed", time.Since(start))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commit writes the archive staged for u to S3, and moves it into the local
+// cache. The caller must hold u.mu.
+func (s *Server) commit(ctx context.Context, u *upload, size int64) error {
+	fi, err := u.f.Stat()
+	if err != nil {
+		return err
+	} else if fi.Size() != size {
+		return fmt.Errorf("archive size is %d bytes, want %d", fi.Size(), size)
+	}
+	eref, ekey := url.PathEscape(u.scope), url.PathEscape(u.key)
+	skey := s.makeKey(eref, u.version, ekey)
+	if s.MultipartThreshold > 0 && size >= s.MultipartThreshold {
+		err = s.S3Client.PutMultipart(ctx, skey, u.f, size, s.Multipart)
+	} else {
+		err = s.S3Client.Put(ctx, skey, io.NewSectionReader(u.f, 0, size))
+	}
+	if err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	s.pushBytes.Add(size)
+
+	// Keep a local copy, since the archive is likely to be wanted again soon.
+	// If this fails, the archive will be faulted in from S3 when needed.
+	path := s.makePath(eref, u.version, ekey)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		if err := os.Rename(u.path, path); err == nil {
+			u.path = "" // so discard doesn't remove it
+		}
+	}
+	return nil
+}
+
+// discard closes the staging file for u, if it is open, and removes it.
+func (u *upload) discard() error {
+	var err error
+	if u.f != nil {
+		err = u.f.Close()
+		u.f = nil
+	}
+	if u.path != "" {
+		err = errors.Join(err, os.Remove(u.path))
+		u.path = ""
+	}
+	return err
+}
+
+// serveArchive serves the archive for an entry, named by escaped ref,
+// version, and escaped key. The URL must be signed, as reported by a query.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, arg string) {
+	s.getRequest.Add(1)
+	start := time.Now()
+	sig := r.URL.Query().Get("sig")
+	if s.Secret == "" || !hmac.Equal([]byte(sig), []byte(signArchive(s.Secret, arg))) {
+		s.denied.Add(1)
+		writeError(w, http.StatusForbidden, "invalid signature")
+		return
+	}
+	parts := strings.Split(arg, "/")
+	if len(parts) != 3 || !validKey(parts[0]) || !validVersion(parts[1]) || !validKey(parts[2]) {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	eref, version, ekey := parts[0], parts[1], parts[2]
+	path := s.makePath(eref, version, ekey)
+	if _, err := os.Stat(path); err == nil {
+		s.getLocalHit.Add(1)
+		s.logger().Debug("download", "key", ekey, "result", "hit", "elapsed", time.Since(start))
+		serveArchiveFile(w, r, path)
+		return
+	}
+
+	obj, _, err := s.S3Client.Get(r.Context(), s.makeKey(eref, version, ekey))
+	if err == nil {
+		err = s.storeLocal(path, obj)
+		obj.Close()
+	}
+	if err != nil {
+		s.getError.Add(1)
+		s.logger().Debug("download", "key", ekey, "result", "error", "elapsed", time.Since(start), "err", err)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "not found")
+		} else {
+			writeError(w, http.StatusBadGateway, err.Error())
+		}
+		return
+	}
+	s.getFaultHit.Add(1)
+	s.logger().Debug("download", "key", ekey, "result", "hit S3", "elapsed", time.Since(start))
+	serveArchiveFile(w, r, path)
+}
+
+// storeLocal writes the contents of r atomically to path in the local cache.
+func (s *Server) storeLocal(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_, err := atomicfile.WriteAll(path, r, 0644)
+	return err
+}
+
+// baseURL returns the external base URL of the service for r.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(s.MountPath, "/")
+}
+
+func (s *Server) uploadTimeout() time.Duration {
+	if s.UploadTimeout > 0 {
+		return s.UploadTimeout
+	}
+	return time.Hour
+}
+
+// makePath returns the local cache path for the specified escaped ref,
+// version, and escaped key.
+func (s *Server) makePath(eref, version, ekey string) string {
+	return filepath.Join(s.Local, "entry", eref, version, ekey)
+}
+
+// makeKey returns the S3 object key for the specified escaped ref, version,
+// and escaped key.
+func (s *Server) makeKey(eref, version, ekey string) string {
+	return path.Join(s.KeyPrefix, "entry", eref, version) + "/" + ekey
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// validVersion reports whether v is a plausible cache version. The toolkit
+// sends a hex digest; this also guards against path traversal.
+func validVersion(v string) bool {
+	if v == "" || len(v) > 128 {
+		return false
+	}
+	for _, c := range v {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validKey reports whether k is a usable cache key. Keys are stored path
+// escaped, which does not protect the names "." and "..".
+func validKey(k string) bool { return k != "" && k != "." && k != ".." }
+
+func serveArchiveFile(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"message": msg})
+}
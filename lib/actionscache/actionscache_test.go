@@ -0,0 +1,270 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package actionscache_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/actionscache"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// fakeS3 is a minimal in-memory S3 bucket supporting put, get, and list.
+type fakeS3 struct {
+	mu   sync.Mutex
+	objs map[string]string
+	mod  map[string]time.Time
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/test/")
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objs[key] = string(data)
+		f.mod[key] = time.Now()
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		type content struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k, v := range f.objs {
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, content{k, int64(len(v)), f.mod[k]})
+			}
+		}
+		slices.SortFunc(res.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet:
+		v, ok := f.objs[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		io.WriteString(w, v)
+	}
+}
+
+func TestServer(t *testing.T) {
+	bucket := &fakeS3{objs: make(map[string]string), mod: make(map[string]time.Time)}
+	s3srv := httptest.NewServer(bucket)
+	defer s3srv.Close()
+
+	const secret = "s3kr1t"
+	s := &actionscache.Server{
+		MountPath: "/gha",
+		Secret:    secret,
+		Local:     t.TempDir(),
+		S3Client: &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:       "us-east-1",
+				BaseEndpoint: aws.String(s3srv.URL),
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket: "test",
+		},
+	}
+	defer s.Close()
+	srv := httptest.NewServer(http.StripPrefix("/gha", s))
+	defer srv.Close()
+	base := srv.URL + "/gha/_apis/artifactcache/"
+
+	newToken := func(t *testing.T, scopes ...actionscache.Scope) string {
+		t.Helper()
+		tok, err := actionscache.NewToken(secret, scopes, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("NewToken: %v", err)
+		}
+		return tok
+	}
+	const main, feature = "refs/heads/main", "refs/heads/feature"
+	mainToken := newToken(t, actionscache.Scope{Scope: main, Permission: actionscache.PermRead | actionscache.PermWrite})
+	featureToken := newToken(t,
+		actionscache.Scope{Scope: feature, Permission: actionscache.PermRead | actionscache.PermWrite},
+		actionscache.Scope{Scope: main, Permission: actionscache.PermRead},
+	)
+	token := mainToken
+
+	call := func(t *testing.T, method, u, body string, hdr ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if token != "" && !strings.Contains(u, "/artifacts/") {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %q: %v", method, u, err)
+		}
+		defer rsp.Body.Close()
+		data, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(data)
+	}
+	query := func(t *testing.T, keys string) (int, map[string]string) {
+		t.Helper()
+		code, body := call(t, "GET", base+"cache?version=v1&keys="+keys, "")
+		var res map[string]string
+		if code == http.StatusOK {
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatalf("Invalid query result: %v\n%s", err, body)
+			}
+		}
+		return code, res
+	}
+	save := func(t *testing.T, key string, chunks ...string) {
+		t.Helper()
+		code, body := call(t, "POST", base+"caches", fmt.Sprintf(`{"key":%q,"version":"v1"}`, key))
+		if code != http.StatusCreated {
+			t.Fatalf("Reserve %q: got %d %s", key, code, body)
+		}
+		var res struct {
+			ID int `json:"cacheId"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("Invalid reserve result: %v", err)
+		}
+		u := fmt.Sprint(base, "caches/", res.ID)
+
+		// Upload the chunks in reverse order, to check offsets are respected.
+		var off, size int
+		var ranges []string
+		for _, c := range chunks {
+			ranges = append(ranges, fmt.Sprintf("bytes %d-%d/*", off, off+len(c)-1))
+			off += len(c)
+		}
+		size = off
+		for i := len(chunks) - 1; i >= 0; i-- {
+			if code, body := call(t, "PATCH", u, chunks[i], "Content-Range", ranges[i]); code != http.StatusNoContent {
+				t.Fatalf("Upload %q: got %d %s", ranges[i], code, body)
+			}
+		}
+		if code, body := call(t, "POST", u, fmt.Sprintf(`{"size":%d}`, size)); code != http.StatusNoContent {
+			t.Fatalf("Commit %q: got %d %s", key, code, body)
+		}
+	}
+
+	// Initially there are no entries.
+	if code, _ := query(t, "linux-go-abc"); code != http.StatusNoContent {
+		t.Errorf("Query empty: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	save(t, "linux-go-abc", "hello, ", "world")
+	time.Sleep(10 * time.Millisecond)
+	save(t, "linux-go-def", "newer")
+
+	// An exact match is preferred, and its archive can be downloaded.
+	code, res := query(t, "linux-go-abc,linux-go-")
+	if code != http.StatusOK || res["cacheKey"] != "linux-go-abc" {
+		t.Fatalf("Query exact: got %d %v", code, res)
+	}
+	if code, body := call(t, "GET", res["archiveLocation"], ""); code != http.StatusOK || body != "hello, world" {
+		t.Errorf("Download: got %d %q, want %q", code, body, "hello, world")
+	}
+
+	// A restore key matches the most recent entry with that prefix.
+	if code, res := query(t, "linux-go-xyz,linux-go-"); code != http.StatusOK || res["cacheKey"] != "linux-go-def" {
+		t.Errorf("Query prefix: got %d %v, want linux-go-def", code, res)
+	}
+
+	// Existing entries cannot be reserved again.
+	if code, _ := call(t, "POST", base+"caches", `{"key":"linux-go-abc","version":"v1"}`); code != http.StatusConflict {
+		t.Errorf("Reserve existing: got %d, want %d", code, http.StatusConflict)
+	}
+
+	// Other versions do not match.
+	if code, _ := call(t, "GET", base+"cache?version=v2&keys=linux-go-abc", ""); code != http.StatusNoContent {
+		t.Errorf("Query other version: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	// Archive URLs must carry their signature.
+	unsigned, _, _ := strings.Cut(res["archiveLocation"], "?")
+	if code, _ := call(t, "GET", unsigned, ""); code != http.StatusForbidden {
+		t.Errorf("Download unsigned: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	// A branch reads the entries of the default branch, but writes its own.
+	token = featureToken
+	if code, res := query(t, "linux-go-abc"); code != http.StatusOK || res["cacheKey"] != "linux-go-abc" {
+		t.Errorf("Query from branch: got %d %v, want linux-go-abc", code, res)
+	}
+	save(t, "linux-go-abc", "branch")
+	if code, res := query(t, "linux-go-abc"); code != http.StatusOK {
+		t.Errorf("Query branch entry: got %d %v", code, res)
+	} else if code, body := call(t, "GET", res["archiveLocation"], ""); code != http.StatusOK || body != "branch" {
+		t.Errorf("Download branch entry: got %d %q, want %q", code, body, "branch")
+	}
+
+	// The default branch does not see the entries of other branches.
+	token = mainToken
+	if code, res := query(t, "linux-go-abc"); code != http.StatusOK {
+		t.Errorf("Query from main: got %d %v", code, res)
+	} else if code, body := call(t, "GET", res["archiveLocation"], ""); code != http.StatusOK || body != "hello, world" {
+		t.Errorf("Download from main: got %d %q, want %q", code, body, "hello, world")
+	}
+
+	// An upload cannot be committed by a token for another branch.
+	code, body := call(t, "POST", base+"caches", `{"key":"linux-go-ghi","version":"v1"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Reserve: got %d %s", code, body)
+	}
+	var rsv struct {
+		ID int `json:"cacheId"`
+	}
+	json.Unmarshal([]byte(body), &rsv)
+	token = featureToken
+	if code, _ := call(t, "POST", fmt.Sprint(base, "caches/", rsv.ID), `{"size":0}`); code != http.StatusNotFound {
+		t.Errorf("Commit from other branch: got %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Requests without a valid token are rejected, and a token without write
+	// permission cannot reserve entries.
+	for _, tc := range []struct {
+		name, token string
+		want        int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"bad signature", mainToken[:len(mainToken)-2] + "xx", http.StatusUnauthorized},
+		{"wrong secret", func() string {
+			tok, _ := actionscache.NewToken("other", []actionscache.Scope{{Scope: main, Permission: 3}}, time.Now().Add(time.Hour))
+			return tok
+		}(), http.StatusUnauthorized},
+		{"expired", func() string {
+			tok, _ := actionscache.NewToken(secret, []actionscache.Scope{{Scope: main, Permission: 3}}, time.Now().Add(-time.Minute))
+			return tok
+		}(), http.StatusUnauthorized},
+		{"read only", newToken(t, actionscache.Scope{Scope: main, Permission: actionscache.PermRead}), http.StatusForbidden},
+	} {
+		token = tc.token
+		if code, _ := call(t, "POST", base+"caches", `{"key":"linux-go-jkl","version":"v1"}`); code != tc.want {
+			t.Errorf("Reserve with %s: got %d, want %d", tc.name, code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package actionscache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Permission bits of a [Scope].
+const (
+	PermRead  = 1
+	PermWrite = 2
+)
+
+// A Scope grants access to the cache entries of one ref, in the form of the
+// "ac" claim of the runtime tokens GitHub issues to workflow jobs.
+type Scope struct {
+	Scope      string // the ref, for example "refs/heads/main"
+	Permission int    // a combination of PermRead and PermWrite
+}
+
+// NewToken returns a runtime token granting scopes until exp, signed with
+// secret. The token is a JWT like the ACTIONS_RUNTIME_TOKEN GitHub issues to
+// a job, with the scopes in its "ac" claim, but it is signed with HS256 so
+// that a server holding the same secret can verify it.
+//
+// As GitHub does for a job, grant read and write permission for the ref the
+// job runs on, listed first, and read permission only for the refs whose
+// caches it may restore from, such as the default branch.
+func NewToken(secret string, scopes []Scope, exp time.Time) (string, error) {
+	if secret == "" {
+		return "", errors.New("empty secret")
+	}
+	ac, err := json.Marshal(scopes)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(tokenClaims{AC: string(ac), Exp: exp.Unix()})
+	if err != nil {
+		return "", err
+	}
+	msg := b64(tokenHeader) + "." + b64(claims)
+	return msg + "." + b64(sign(secret, msg)), nil
+}
+
+// tokenHeader is the only JWT header accepted for runtime tokens.
+var tokenHeader = []byte(`{"alg":"HS256","typ":"JWT"}`)
+
+// tokenClaims are the claims of a runtime token used by the service.
+type tokenClaims struct {
+	AC  string `json:"ac"`  // JSON array of scopes
+	Exp int64  `json:"exp"` // expiration, seconds since the epoch
+}
+
+// errUnauthorized is reported for requests with a missing or invalid token.
+var errUnauthorized = errors.New("unauthorized")
+
+// parseToken verifies that tok is a runtime token signed with secret that has
+// not expired at now, and returns the scopes it grants.
+func parseToken(secret, tok string, now time.Time) ([]Scope, error) {
+	parts := strings.Split(tok, ".")
+	if secret == "" || len(parts) != 3 {
+		return nil, errUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, sign(secret, parts[0]+"."+parts[1])) {
+		return nil, errUnauthorized
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, errUnauthorized
+	} else if json.Unmarshal(data, &hdr) != nil || hdr.Alg != "HS256" {
+		return nil, errUnauthorized
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	var claims tokenClaims
+	var scopes []Scope
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid claims: %v", errUnauthorized, err)
+	} else if now.Unix() >= claims.Exp {
+		return nil, fmt.Errorf("%w: token expired", errUnauthorized)
+	} else if err := json.Unmarshal([]byte(claims.AC), &scopes); err != nil {
+		return nil, fmt.Errorf("%w: invalid scopes: %v", errUnauthorized, err)
+	}
+	return scopes, nil
+}
+
+// signArchive returns the signature that authorizes a download of the archive
+// at the given path, relative to the artifacts directory of the service.
+func signArchive(secret, path string) string {
+	return hex.EncodeToString(sign(secret, "artifacts/"+path))
+}
+
+func sign(secret, msg string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
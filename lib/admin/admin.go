@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package admin implements an administrative control surface for a running
+// cache server, for reporting statistics, purging and flushing the cache, and
+// inspecting its configuration.
+//
+// The [Service] type defines the operations. It is exported over HTTP as a
+// REST API by [Service.ServeHTTP], and over gRPC by [Service.RegisterGRPC].
+// A matching gRPC client is provided by [Client]. A web page for operators,
+// which calls the REST API, is served alongside it.
+//
+// The gRPC service is defined by admin.proto in this directory, from which
+// the stubs in admin.pb.go and admin_grpc.pb.go are generated (see go
+// generate). Clients in other languages can be generated from the same file.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Service implements the operations of the admin API. Each operation is
+// defined by an optional callback; if a callback is nil, the corresponding
+// operation reports an error indicating that it is not supported.
+type Service struct {
+	// Stats, if non-nil, returns a snapshot of server metrics.
+	Stats func(context.Context) (map[string]any, error)
+
+	// Flush, if non-nil, blocks until pending writes to the remote store have
+	// completed, or until the context ends.
+	Flush func(context.Context) error
+
+	// Purge, if non-nil, removes entries from the local cache that have not
+	// been used within the specified age before present, which is always
+	// positive. It returns a summary of what was removed.
+	Purge func(_ context.Context, olderThan time.Duration) (map[string]any, error)
+
+	// Sync, if non-nil, writes to the remote store any entries in the local
+	// cache that are missing there, and returns a summary of the results.
+	Sync func(context.Context) (map[string]any, error)
+
+	// Commit, if non-nil, writes to the remote store the entries whose uploads
+	// were deferred until the build succeeded, and returns a summary of the
+	// results.
+	Commit func(context.Context) (map[string]any, error)
+
+	// Discard, if non-nil, forgets the entries whose uploads were deferred,
+	// without writing them to the remote store, and returns a summary.
+	Discard func(context.Context) (map[string]any, error)
+
+	// Config, if non-nil, returns a description of the effective server
+	// configuration.
+	Config func(context.Context) (map[string]any, error)
+
+	// LogLevel, if non-nil, updates the logging settings named by the keys of
+	// set to the corresponding values, and returns the resulting settings.
+	// If set is empty, LogLevel reports the current settings unmodified.
+	LogLevel func(_ context.Context, set map[string]string) (map[string]any, error)
+
+	// SBOM, if non-nil, returns a software bill of materials for the
+	// components served by the proxies, selected by the given parameters (for
+	// example, a namespace and a time window).
+	SBOM func(_ context.Context, params map[string]string) (map[string]any, error)
+
+	// Keys, if non-nil, lists the keys of entries in the remote store selected
+	// by the given parameters (for example, a key prefix and a limit).
+	Keys func(_ context.Context, params map[string]string) (map[string]any, error)
+
+	// Token, if non-empty, is a shared secret that callers must present as a
+	// bearer token to use the API. If empty, no authentication is required.
+	Token string
+}
+
+// errUnsupported is reported for operations whose callbacks are not set.
+var errUnsupported = errors.New("operation not supported")
+
+// ErrBadRequest may be wrapped by errors returned from callbacks to report
+// that the request parameters were invalid.
+var ErrBadRequest = errors.New("bad request")
+
+// errUnauthorized is reported for requests with a missing or invalid token.
+var errUnauthorized = errors.New("unauthorized")
+
+// checkAuth reports whether auth, the value of an Authorization header (or
+// equivalent), is valid for s.
+func (s *Service) checkAuth(auth string) bool {
+	if s.Token == "" {
+		return true
+	}
+	tok, ok := strings.CutPrefix(auth, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(tok), []byte(s.Token)) == 1
+}
+
+func (s *Service) stats(ctx context.Context) (map[string]any, error) {
+	if s.Stats == nil {
+		return nil, errUnsupported
+	}
+	return s.Stats(ctx)
+}
+
+func (s *Service) flush(ctx context.Context) (map[string]any, error) {
+	if s.Flush == nil {
+		return nil, errUnsupported
+	}
+	start := time.Now()
+	if err := s.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return map[string]any{"elapsed": time.Since(start).String()}, nil
+}
+
+func (s *Service) purge(ctx context.Context, olderThan time.Duration) (map[string]any, error) {
+	if s.Purge == nil {
+		return nil, errUnsupported
+	}
+	return s.Purge(ctx, olderThan)
+}
+
+func (s *Service) sync(ctx context.Context) (map[string]any, error) {
+	if s.Sync == nil {
+		return nil, errUnsupported
+	}
+	return s.Sync(ctx)
+}
+
+func (s *Service) commit(ctx context.Context) (map[string]any, error) {
+	if s.Commit == nil {
+		return nil, errUnsupported
+	}
+	return s.Commit(ctx)
+}
+
+func (s *Service) discard(ctx context.Context) (map[string]any, error) {
+	if s.Discard == nil {
+		return nil, errUnsupported
+	}
+	return s.Discard(ctx)
+}
+
+func (s *Service) logLevel(ctx context.Context, set map[string]string) (map[string]any, error) {
+	if s.LogLevel == nil {
+		return nil, errUnsupported
+	}
+	return s.LogLevel(ctx, set)
+}
+
+func (s *Service) sbom(ctx context.Context, params map[string]string) (map[string]any, error) {
+	if s.SBOM == nil {
+		return nil, errUnsupported
+	}
+	return s.SBOM(ctx, params)
+}
+
+func (s *Service) keys(ctx context.Context, params map[string]string) (map[string]any, error) {
+	if s.Keys == nil {
+		return nil, errUnsupported
+	}
+	return s.Keys(ctx, params)
+}
+
+func (s *Service) config(ctx context.Context) (map[string]any, error) {
+	if s.Config == nil {
+		return nil, errUnsupported
+	}
+	return s.Config(ctx)
+}
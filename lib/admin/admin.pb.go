@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Service definition for the go-cache-plugin admin API.
+//
+// The service uses only well-known message types, so clients can be generated
+// from this file alone. Results are returned as free-form Structs, with the
+// same contents as the JSON served by the corresponding REST endpoints.
+//
+// If the server is configured with an admin token, each call must carry an
+// "authorization" metadata entry of the form "Bearer <token>".
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: admin.proto
+
+package admin
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	reflect "reflect"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+var File_admin_proto protoreflect.FileDescriptor
+
+const file_admin_proto_rawDesc = "" +
+	"\n" +
+	"\vadmin.proto\x12\x16gocacheplugin.admin.v1\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1cgoogle/protobuf/struct.proto2\xd3\x04\n" +
+	"\x05Admin\x128\n" +
+	"\x05Stats\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x128\n" +
+	"\x05Flush\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x129\n" +
+	"\x05Purge\x12\x17.google.protobuf.Struct\x1a\x17.google.protobuf.Struct\x127\n" +
+	"\x04Sync\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x129\n" +
+	"\x06Commit\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x12:\n" +
+	"\aDiscard\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x12<\n" +
+	"\bLogLevel\x12\x17.google.protobuf.Struct\x1a\x17.google.protobuf.Struct\x129\n" +
+	"\x06Config\x12\x16.google.protobuf.Empty\x1a\x17.google.protobuf.Struct\x128\n" +
+	"\x04SBOM\x12\x17.google.protobuf.Struct\x1a\x17.google.protobuf.Struct\x128\n" +
+	"\x04Keys\x12\x17.google.protobuf.Struct\x1a\x17.google.protobuf.StructB.Z,github.com/grafana/go-cache-plugin/lib/adminb\x06proto3"
+
+var file_admin_proto_goTypes = []any{
+	(*emptypb.Empty)(nil),   // 0: google.protobuf.Empty
+	(*structpb.Struct)(nil), // 1: google.protobuf.Struct
+}
+var file_admin_proto_depIdxs = []int32{
+	0,  // 0: gocacheplugin.admin.v1.Admin.Stats:input_type -> google.protobuf.Empty
+	0,  // 1: gocacheplugin.admin.v1.Admin.Flush:input_type -> google.protobuf.Empty
+	1,  // 2: gocacheplugin.admin.v1.Admin.Purge:input_type -> google.protobuf.Struct
+	0,  // 3: gocacheplugin.admin.v1.Admin.Sync:input_type -> google.protobuf.Empty
+	0,  // 4: gocacheplugin.admin.v1.Admin.Commit:input_type -> google.protobuf.Empty
+	0,  // 5: gocacheplugin.admin.v1.Admin.Discard:input_type -> google.protobuf.Empty
+	1,  // 6: gocacheplugin.admin.v1.Admin.LogLevel:input_type -> google.protobuf.Struct
+	0,  // 7: gocacheplugin.admin.v1.Admin.Config:input_type -> google.protobuf.Empty
+	1,  // 8: gocacheplugin.admin.v1.Admin.SBOM:input_type -> google.protobuf.Struct
+	1,  // 9: gocacheplugin.admin.v1.Admin.Keys:input_type -> google.protobuf.Struct
+	1,  // 10: gocacheplugin.admin.v1.Admin.Stats:output_type -> google.protobuf.Struct
+	1,  // 11: gocacheplugin.admin.v1.Admin.Flush:output_type -> google.protobuf.Struct
+	1,  // 12: gocacheplugin.admin.v1.Admin.Purge:output_type -> google.protobuf.Struct
+	1,  // 13: gocacheplugin.admin.v1.Admin.Sync:output_type -> google.protobuf.Struct
+	1,  // 14: gocacheplugin.admin.v1.Admin.Commit:output_type -> google.protobuf.Struct
+	1,  // 15: gocacheplugin.admin.v1.Admin.Discard:output_type -> google.protobuf.Struct
+	1,  // 16: gocacheplugin.admin.v1.Admin.LogLevel:output_type -> google.protobuf.Struct
+	1,  // 17: gocacheplugin.admin.v1.Admin.Config:output_type -> google.protobuf.Struct
+	1,  // 18: gocacheplugin.admin.v1.Admin.SBOM:output_type -> google.protobuf.Struct
+	1,  // 19: gocacheplugin.admin.v1.Admin.Keys:output_type -> google.protobuf.Struct
+	10, // [10:20] is the sub-list for method output_type
+	0,  // [0:10] is the sub-list for method input_type
+	0,  // [0:0] is the sub-list for extension type_name
+	0,  // [0:0] is the sub-list for extension extendee
+	0,  // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_admin_proto_init() }
+func file_admin_proto_init() {
+	if File_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   0,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_admin_proto_goTypes,
+		DependencyIndexes: file_admin_proto_depIdxs,
+	}.Build()
+	File_admin_proto = out.File
+	file_admin_proto_goTypes = nil
+	file_admin_proto_depIdxs = nil
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
+
+// ServiceName is the fully-qualified gRPC service name of the admin API.
+const ServiceName = "gocacheplugin.admin.v1.Admin"
+
+// RegisterGRPC registers s as the implementation of the admin service on srv.
+// If s has a Token, every call must present it (see admin.proto).
+func (s *Service) RegisterGRPC(srv grpc.ServiceRegistrar) { RegisterAdminServer(srv, grpcServer{s: s}) }
+
+// grpcServer implements the generated [AdminServer] interface for a Service.
+type grpcServer struct {
+	UnimplementedAdminServer
+	s *Service
+}
+
+// call checks the authorization of the request in ctx, and then reports the
+// result of f as a Struct.
+func (g grpcServer) call(ctx context.Context, f func() (map[string]any, error)) (*structpb.Struct, error) {
+	if !g.s.checkAuth(authFromContext(ctx)) {
+		return nil, status.Error(codes.Unauthenticated, errUnauthorized.Error())
+	}
+	out, err := f()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toStruct(out)
+}
+
+func (g grpcServer) Stats(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.stats(ctx) })
+}
+
+func (g grpcServer) Flush(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.flush(ctx) })
+}
+
+func (g grpcServer) Purge(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) {
+		age, err := parseAge(req.GetFields()["older_than"].GetStringValue())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid older_than: %v", err)
+		}
+		return g.s.purge(ctx, age)
+	})
+}
+
+func (g grpcServer) Sync(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.sync(ctx) })
+}
+
+func (g grpcServer) Commit(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.commit(ctx) })
+}
+
+func (g grpcServer) Discard(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.discard(ctx) })
+}
+
+func (g grpcServer) LogLevel(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.logLevel(ctx, stringFields(req)) })
+}
+
+func (g grpcServer) Config(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.config(ctx) })
+}
+
+func (g grpcServer) SBOM(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.sbom(ctx, stringFields(req)) })
+}
+
+func (g grpcServer) Keys(ctx context.Context, req *structpb.Struct) (*structpb.Struct, error) {
+	return g.call(ctx, func() (map[string]any, error) { return g.s.keys(ctx, stringFields(req)) })
+}
+
+// stringFields returns the string values of the fields of req.
+func stringFields(req *structpb.Struct) map[string]string {
+	out := make(map[string]string)
+	for key, val := range req.GetFields() {
+		out[key] = val.GetStringValue()
+	}
+	return out
+}
+
+// authFromContext returns the authorization metadata from an incoming gRPC
+// request context, or "" if there is none.
+func authFromContext(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) != 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcError converts err to a gRPC status error.
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	} else if errors.Is(err, errUnsupported) {
+		return status.Error(codes.Unimplemented, err.Error())
+	} else if errors.Is(err, ErrBadRequest) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// toStruct converts m to a Struct message. Values are converted via their JSON
+// encoding, so m may contain any JSON-marshalable values.
+func toStruct(m map[string]any) (*structpb.Struct, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encode result: %v", err)
+	}
+	out := new(structpb.Struct)
+	if err := protojson.Unmarshal(data, out); err != nil {
+		return nil, status.Errorf(codes.Internal, "encode result: %v", err)
+	}
+	return out, nil
+}
+
+// parseAge parses a duration string for a purge request. The age is required
+// and must be positive, so that a request missing it does not purge the whole
+// cache.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("missing duration")
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	} else if age <= 0 {
+		return 0, fmt.Errorf("duration %v is not positive", age)
+	}
+	return age, nil
+}
+
+// Client is a client for the gRPC admin API. It wraps the generated
+// [AdminClient], and reports results as maps.
+type Client struct {
+	ac    AdminClient
+	token string
+}
+
+// NewClient constructs a client for the admin service reachable via cc.  If
+// token != "", it is sent as a bearer token with each request.
+func NewClient(cc grpc.ClientConnInterface, token string) *Client {
+	return &Client{ac: NewAdminClient(cc), token: token}
+}
+
+// Stats returns a snapshot of server metrics.
+func (c *Client) Stats(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Stats, new(emptypb.Empty))
+}
+
+// Flush blocks until pending remote writes on the server have completed.
+func (c *Client) Flush(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Flush, new(emptypb.Empty))
+}
+
+// Purge removes local cache entries on the server not used within olderThan.
+func (c *Client) Purge(ctx context.Context, olderThan time.Duration) (map[string]any, error) {
+	req, _ := structpb.NewStruct(map[string]any{"older_than": olderThan.String()})
+	return call(c, ctx, c.ac.Purge, req)
+}
+
+// Sync writes local cache entries missing from S3 on the server.
+func (c *Client) Sync(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Sync, new(emptypb.Empty))
+}
+
+// Commit writes the uploads deferred on the server to S3.
+func (c *Client) Commit(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Commit, new(emptypb.Empty))
+}
+
+// Discard forgets the uploads deferred on the server.
+func (c *Client) Discard(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Discard, new(emptypb.Empty))
+}
+
+// LogLevel updates the logging settings named in set on the server, and
+// returns the resulting settings. If set is empty, no settings are changed.
+func (c *Client) LogLevel(ctx context.Context, set map[string]string) (map[string]any, error) {
+	return call(c, ctx, c.ac.LogLevel, stringStruct(set))
+}
+
+// Config returns the effective server configuration.
+func (c *Client) Config(ctx context.Context) (map[string]any, error) {
+	return call(c, ctx, c.ac.Config, new(emptypb.Empty))
+}
+
+// SBOM returns a bill of materials for the components served by the proxies
+// on the server, selected by params.
+func (c *Client) SBOM(ctx context.Context, params map[string]string) (map[string]any, error) {
+	return call(c, ctx, c.ac.SBOM, stringStruct(params))
+}
+
+// Keys lists the keys of entries in the remote store of the server, selected
+// by params.
+func (c *Client) Keys(ctx context.Context, params map[string]string) (map[string]any, error) {
+	return call(c, ctx, c.ac.Keys, stringStruct(params))
+}
+
+// stringStruct returns a Struct with the string fields of m.
+func stringStruct(m map[string]string) *structpb.Struct {
+	out := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(m))}
+	for key, val := range m {
+		out.Fields[key] = structpb.NewStringValue(val)
+	}
+	return out
+}
+
+// call invokes the generated method with in, adding the token of c.
+func call[Req proto.Message](c *Client, ctx context.Context, method func(context.Context, Req, ...grpc.CallOption) (*structpb.Struct, error), in Req) (map[string]any, error) {
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+	out, err := method(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out.AsMap(), nil
+}
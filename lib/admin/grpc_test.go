@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package admin_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/admin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGRPC(t *testing.T) {
+	var gotAge time.Duration
+	svc := &admin.Service{
+		Stats: func(context.Context) (map[string]any, error) {
+			return map[string]any{"hits": 25, "names": []string{"a", "b"}}, nil
+		},
+		Purge: func(_ context.Context, age time.Duration) (map[string]any, error) {
+			gotAge = age
+			return map[string]any{"removed": 3}, nil
+		},
+		Token: "hunter2",
+	}
+
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	svc.RegisterGRPC(srv)
+	go srv.Serve(lst)
+	defer srv.Stop()
+
+	cc, err := grpc.NewClient(lst.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer cc.Close()
+	ctx := context.Background()
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, err := admin.NewClient(cc, "wrong").Stats(ctx)
+		if got := status.Code(err); got != codes.Unauthenticated {
+			t.Errorf("Stats: got %v (%v), want %v", got, err, codes.Unauthenticated)
+		}
+
+		// Every method of the generated client requires the token, including
+		// those the service does not support.
+		ac := admin.NewAdminClient(cc)
+		empty, args := new(emptypb.Empty), new(structpb.Struct)
+		for name, call := range map[string]func() error{
+			"Stats":    func() error { _, err := ac.Stats(ctx, empty); return err },
+			"Flush":    func() error { _, err := ac.Flush(ctx, empty); return err },
+			"Purge":    func() error { _, err := ac.Purge(ctx, args); return err },
+			"Sync":     func() error { _, err := ac.Sync(ctx, empty); return err },
+			"Commit":   func() error { _, err := ac.Commit(ctx, empty); return err },
+			"Discard":  func() error { _, err := ac.Discard(ctx, empty); return err },
+			"LogLevel": func() error { _, err := ac.LogLevel(ctx, args); return err },
+			"Config":   func() error { _, err := ac.Config(ctx, empty); return err },
+			"SBOM":     func() error { _, err := ac.SBOM(ctx, args); return err },
+			"Keys":     func() error { _, err := ac.Keys(ctx, args); return err },
+		} {
+			if got := status.Code(call()); got != codes.Unauthenticated {
+				t.Errorf("%s: got %v, want %v", name, got, codes.Unauthenticated)
+			}
+		}
+	})
+
+	cli := admin.NewClient(cc, "hunter2")
+	t.Run("Stats", func(t *testing.T) {
+		m, err := cli.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if got := m["hits"]; got != float64(25) {
+			t.Errorf("Stats hits: got %v, want 25", got)
+		}
+	})
+	t.Run("Purge", func(t *testing.T) {
+		m, err := cli.Purge(ctx, 90*time.Minute)
+		if err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		if gotAge != 90*time.Minute {
+			t.Errorf("Purge age: got %v, want 90m", gotAge)
+		}
+		if got := m["removed"]; got != float64(3) {
+			t.Errorf("Purge removed: got %v, want 3", got)
+		}
+
+		// The age is required, and must be positive.
+		gotAge = 0
+		authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer hunter2")
+		for _, age := range []string{"", "0s", "-1h", "bogus"} {
+			req, _ := structpb.NewStruct(map[string]any{"older_than": age})
+			if age == "" {
+				req = new(structpb.Struct)
+			}
+			if _, err := admin.NewAdminClient(cc).Purge(authCtx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("Purge %q: got %v, want %v", age, err, codes.InvalidArgument)
+			}
+		}
+		if gotAge != 0 {
+			t.Errorf("Purge called with age %v after invalid requests", gotAge)
+		}
+	})
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := cli.Flush(ctx)
+		if got := status.Code(err); got != codes.Unimplemented {
+			t.Errorf("Flush: got %v (%v), want %v", got, err, codes.Unimplemented)
+		}
+	})
+}
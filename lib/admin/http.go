@@ -0,0 +1,144 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package admin
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ServeHTTP implements the [http.Handler] interface for the REST API.
+// The handler expects to be mounted at "/admin/", and serves:
+//
+//	GET  /admin/stats                -- report server metrics
+//	POST /admin/flush                -- wait for pending remote writes
+//	POST /admin/purge?older_than=24h -- purge local cache entries
+//	POST /admin/sync                 -- write missing local entries to S3
+//	POST /admin/commit               -- write deferred uploads to S3
+//	POST /admin/discard              -- forget deferred uploads
+//	GET  /admin/config               -- report the effective configuration
+//	GET  /admin/log                  -- report log settings
+//	POST /admin/log?name=value&...   -- update log settings
+//	GET  /admin/sbom?name=value&...  -- report a bill of materials
+//	GET  /admin/keys?name=value&...  -- list keys in the remote store
+//	GET  /admin/ui                   -- a web page for the operations above
+//
+// All responses other than the web page are JSON objects. Errors are reported
+// as an object with an "error" field and a suitable HTTP status.
+//
+// The web page itself holds no data, so it is served to any caller. It asks
+// the operator for the token, and sends it with each request it makes.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	if op == "ui" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write(uiPage)
+		return
+	}
+	if !s.checkAuth(r.Header.Get("Authorization")) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": errUnauthorized.Error()})
+		return
+	}
+	method := http.MethodPost
+	var call func(context.Context) (map[string]any, error)
+	switch op {
+	case "stats":
+		method, call = http.MethodGet, s.stats
+	case "config":
+		method, call = http.MethodGet, s.config
+	case "flush":
+		call = s.flush
+	case "sync":
+		call = s.sync
+	case "commit":
+		call = s.commit
+	case "discard":
+		call = s.discard
+	case "purge":
+		age, err := parseAge(r.FormValue("older_than"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid older_than: " + err.Error()})
+			return
+		}
+		call = func(ctx context.Context) (map[string]any, error) { return s.purge(ctx, age) }
+	case "log":
+		set := make(map[string]string)
+		if r.Method == http.MethodPost {
+			r.ParseForm()
+			for key := range r.Form {
+				set[key] = r.Form.Get(key)
+			}
+		} else {
+			method = http.MethodGet
+		}
+		call = func(ctx context.Context) (map[string]any, error) { return s.logLevel(ctx, set) }
+	case "sbom":
+		method = http.MethodGet
+		params := make(map[string]string)
+		for key := range r.URL.Query() {
+			params[key] = r.URL.Query().Get(key)
+		}
+		call = func(ctx context.Context) (map[string]any, error) { return s.sbom(ctx, params) }
+	case "keys":
+		method = http.MethodGet
+		params := make(map[string]string)
+		for key := range r.URL.Query() {
+			params[key] = r.URL.Query().Get(key)
+		}
+		call = func(ctx context.Context) (map[string]any, error) { return s.keys(ctx, params) }
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]any{"error": "unknown admin operation"})
+		return
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	out, err := call(r.Context())
+	if err != nil {
+		writeJSON(w, httpStatus(err), map[string]any{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// uiPage is the web page served at /admin/ui.
+//
+//go:embed ui.html
+var uiPage []byte
+
+// httpStatus returns an HTTP status code for err.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
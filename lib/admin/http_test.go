@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/admin"
+)
+
+func TestHTTP(t *testing.T) {
+	level := map[string]string{"verbose": "false"}
+	svc := &admin.Service{
+		Stats: func(context.Context) (map[string]any, error) {
+			return map[string]any{"hits": 5}, nil
+		},
+		LogLevel: func(_ context.Context, set map[string]string) (map[string]any, error) {
+			for k, v := range set {
+				level[k] = v
+			}
+			return map[string]any{"verbose": level["verbose"]}, nil
+		},
+		Token: "hunter2",
+	}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	do := func(method, path, token string) (int, map[string]any) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer rsp.Body.Close()
+		var out map[string]any
+		if err := json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+			t.Fatalf("Decode response: %v", err)
+		}
+		return rsp.StatusCode, out
+	}
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/admin/stats", "", http.StatusUnauthorized},
+		{"GET", "/admin/stats", "wrong", http.StatusUnauthorized},
+		{"GET", "/admin/stats", "hunter2", http.StatusOK},
+		{"POST", "/admin/stats", "hunter2", http.StatusMethodNotAllowed},
+		{"POST", "/admin/flush", "hunter2", http.StatusNotImplemented},
+		{"POST", "/admin/commit", "hunter2", http.StatusNotImplemented},
+		{"GET", "/admin/discard", "hunter2", http.StatusMethodNotAllowed},
+		{"POST", "/admin/purge?older_than=bogus", "hunter2", http.StatusBadRequest},
+		{"POST", "/admin/purge", "hunter2", http.StatusBadRequest},
+		{"POST", "/admin/purge?older_than=0s", "hunter2", http.StatusBadRequest},
+		{"GET", "/admin/keys?prefix=action/", "hunter2", http.StatusNotImplemented},
+		{"GET", "/admin/nonesuch", "hunter2", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if got, _ := do(tc.method, tc.path, tc.token); got != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, got, tc.want)
+		}
+	}
+
+	if code, out := do("POST", "/admin/log?verbose=true", "hunter2"); code != http.StatusOK {
+		t.Errorf("POST /admin/log: got status %d, want OK", code)
+	} else if got := out["verbose"]; got != "true" {
+		t.Errorf("POST /admin/log: got verbose=%v, want true", got)
+	}
+
+	// The web page is served without a token, since it holds no data.
+	rsp, err := http.Get(srv.URL + "/admin/ui")
+	if err != nil {
+		t.Fatalf("GET /admin/ui: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Errorf("GET /admin/ui: got status %d, want OK", rsp.StatusCode)
+	} else if ct := rsp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("GET /admin/ui: got content type %q, want text/html", ct)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package atrest encrypts the contents of local cache files at rest.
+//
+// Each file is sealed separately with AES-256-GCM under a key shared by the
+// processes using the cache directory. A sealed file begins with a fixed
+// header, so that files written before encryption was enabled are still read
+// as plaintext.
+package atrest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size in bytes of an encryption key.
+const KeySize = 32
+
+// header marks the beginning of a sealed file, and identifies the version of
+// its format.
+var header = []byte("\x00gcp-seal1\x00")
+
+// ErrUnsealed is reported by [Key.Open] for data that was sealed, but could
+// not be decrypted, as when it was sealed under another key or has been
+// modified.
+var ErrUnsealed = errors.New("cannot decrypt sealed data")
+
+// A Key seals and opens the contents of files. A nil *Key is valid, and leaves
+// the contents unchanged.
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKey returns a Key that encrypts under secret, which must be KeySize
+// bytes long.
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(secret), KeySize)
+	}
+	blk, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+// ParseKey returns a Key that encrypts under the secret encoded in s, as hex
+// or standard base64. Leading and trailing whitespace is ignored.
+func ParseKey(s string) (*Key, error) {
+	s = strings.TrimSpace(s)
+	if secret, err := hex.DecodeString(s); err == nil {
+		return NewKey(secret)
+	}
+	if secret, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return NewKey(secret)
+	}
+	return nil, errors.New("key is not valid hex or base64")
+}
+
+// Seal returns the contents of a file holding plain, encrypted under k. If k
+// is nil, Seal returns plain.
+func (k *Key) Seal(plain []byte) []byte {
+	if k == nil {
+		return plain
+	}
+	ns := k.aead.NonceSize()
+	out := make([]byte, len(header)+ns, len(header)+ns+len(plain)+k.aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	rand.Read(nonce)
+	return k.aead.Seal(out, nonce, plain, header)
+}
+
+// Open returns the plaintext of the contents of a file written by Seal. Data
+// that is not sealed are returned unchanged, so that files written without a
+// key remain readable. If k is nil, sealed data are reported as errors.
+func (k *Key) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	} else if k == nil {
+		return nil, fmt.Errorf("%w: no key is set", ErrUnsealed)
+	}
+	rest := data[len(header):]
+	ns := k.aead.NonceSize()
+	if len(rest) < ns {
+		return nil, ErrUnsealed
+	}
+	plain, err := k.aead.Open(nil, rest[:ns], rest[ns:], header)
+	if err != nil {
+		return nil, ErrUnsealed
+	}
+	return plain, nil
+}
+
+// IsSealed reports whether data are the contents of a file written by Seal
+// with a non-nil key.
+func IsSealed(data []byte) bool { return bytes.HasPrefix(data, header) }
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package atrest_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/atrest"
+)
+
+func TestSealOpen(t *testing.T) {
+	k, err := atrest.ParseKey(strings.Repeat("ab", atrest.KeySize))
+	if err != nil {
+		t.Fatalf("ParseKey: %v", err)
+	}
+	plain := []byte("proprietary module contents")
+	sealed := k.Seal(plain)
+	if !atrest.IsSealed(sealed) {
+		t.Error("Seal: result is not sealed")
+	} else if bytes.Contains(sealed, plain) {
+		t.Error("Seal: result contains the plaintext")
+	}
+	if got, err := k.Open(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("Open: got %q, %v; want %q", got, err, plain)
+	}
+
+	// Each seal uses a fresh nonce.
+	if bytes.Equal(sealed, k.Seal(plain)) {
+		t.Error("Seal: repeated result for the same plaintext")
+	}
+
+	// Plaintext written before the key was set is read unchanged.
+	if got, err := k.Open(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("Open plain: got %q, %v; want %q", got, err, plain)
+	}
+
+	// A nil key does not encrypt, and cannot open sealed data.
+	var nk *atrest.Key
+	if got := nk.Seal(plain); !bytes.Equal(got, plain) {
+		t.Errorf("nil Seal: got %q, want %q", got, plain)
+	}
+	if _, err := nk.Open(sealed); !errors.Is(err, atrest.ErrUnsealed) {
+		t.Errorf("nil Open: got %v, want %v", err, atrest.ErrUnsealed)
+	}
+
+	// Another key, or modified data, cannot be opened.
+	other, err := atrest.ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("ParseKey base64: %v", err)
+	}
+	if _, err := other.Open(sealed); !errors.Is(err, atrest.ErrUnsealed) {
+		t.Errorf("Open other key: got %v, want %v", err, atrest.ErrUnsealed)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := k.Open(sealed); !errors.Is(err, atrest.ErrUnsealed) {
+		t.Errorf("Open modified: got %v, want %v", err, atrest.ErrUnsealed)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, s := range []string{"", "xyz", "abcd", strings.Repeat("a", 2*atrest.KeySize+2)} {
+		if k, err := atrest.ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q): got %v, want error", s, k)
+		}
+	}
+}
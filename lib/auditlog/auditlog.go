@@ -0,0 +1,422 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package auditlog keeps an append-only record of the activity of the cache
+// and its proxies, for security review.
+//
+// A [Log] writes an [Entry] for each module downloaded through the module
+// proxy, each URL fetched through the other proxies, and each action written
+// by the build cache. Entries are stored as one JSON object per line, in one
+// file per hour (UTC). The files of a log may also be shipped to S3, where
+// each host has one object per hour.
+//
+// # Requesters
+//
+// Each entry identifies the client that caused it, by address, and by user
+// name if the client supplied one. For the proxies, the user name is that of
+// the request's HTTP basic authentication. For the build cache, it is the
+// namespace of the build, and the connection is marked authenticated when
+// clients must present the plugin key.
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"golang.org/x/mod/module"
+)
+
+// Kinds of activity recorded in a [Log].
+const (
+	KindModule = "module" // a module zip served by the module proxy
+	KindProxy  = "proxy"  // a URL served by another proxy
+	KindWrite  = "write"  // an action written by the build cache
+)
+
+// An Entry records one event in a [Log].
+type Entry struct {
+	Time    time.Time `json:"time"`              // when it happened
+	Kind    string    `json:"kind"`              // what happened
+	Service string    `json:"service,omitempty"` // the proxy that served it, if any
+	Name    string    `json:"name"`              // the module path, URL, or action ID
+	Version string    `json:"version,omitempty"` // the module version, if any
+	Object  string    `json:"object,omitempty"`  // the output ID written, if any
+	Status  int       `json:"status,omitempty"`  // the HTTP status of the response, if any
+	Client  string    `json:"client,omitempty"`  // the address of the requester
+	User    string    `json:"user,omitempty"`    // the user name of the requester, if known
+	Auth    bool      `json:"auth,omitempty"`    // whether the requester was authenticated
+}
+
+// A Requester describes the client on whose behalf the cache is working.
+// It is attached to a context with [NewContext].
+type Requester struct {
+	Client string // the address of the client
+	Auth   bool   // whether the client authenticated itself
+
+	mu   sync.Mutex
+	user string
+}
+
+// SetUser sets the user name of r. It is safe to call concurrently with the
+// recording of entries.
+func (r *Requester) SetUser(user string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.user = user
+}
+
+func (r *Requester) fill(e *Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Client, e.User, e.Auth = r.Client, r.user, r.Auth
+}
+
+type contextKey struct{}
+
+type contextValue struct {
+	log *Log
+	req *Requester
+}
+
+// NewContext returns a child of ctx that records entries to l on behalf of
+// req, which may be nil.
+func NewContext(ctx context.Context, l *Log, req *Requester) context.Context {
+	return context.WithValue(ctx, contextKey{}, contextValue{log: l, req: req})
+}
+
+// Record adds e to the log attached to ctx by [NewContext], if any, filling
+// in its time and its requester if they are not set.
+func Record(ctx context.Context, e Entry) {
+	v, ok := ctx.Value(contextKey{}).(contextValue)
+	if !ok || v.log == nil {
+		return
+	}
+	if v.req != nil && e.Client == "" {
+		v.req.fill(&e)
+	}
+	v.log.Record(e)
+}
+
+// A Log is an append-only record of entries, stored in a directory with one
+// file per hour. A Log is safe for concurrent use.
+type Log struct {
+	// S3Client, if non-nil, is the client used by [Log.Ship] to copy the files
+	// of the log to S3.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to the key of each file shipped
+	// to S3, with an intervening slash.
+	KeyPrefix string
+
+	// Host names the host that wrote the log, in the keys of shipped files.
+	// If empty, the name reported by [os.Hostname] is used.
+	Host string
+
+	// Logger, if non-nil, is used to report errors recording and shipping
+	// entries. If nil, errors are discarded.
+	Logger *slog.Logger
+
+	dir string
+
+	mu   sync.Mutex
+	f    *os.File
+	hour string // the hour of f
+	err  error  // the last error writing an entry, if any
+}
+
+// hourFormat is the layout of the hours that name the files of a log.
+const hourFormat = "2006-01-02T15"
+
+// Open opens or creates a log in dir.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Log{dir: dir}, nil
+}
+
+// Record adds e to the log. If e has no time, the current time is used.
+// Errors are logged, and otherwise ignored, so that auditing does not affect
+// the service.
+func (l *Log) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		l.warn("record audit entry failed", "name", e.Name, "err", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.rotate(e.Time.Format(hourFormat)); err != nil {
+		l.warn("record audit entry failed", "name", e.Name, "err", err)
+		return
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		l.err = err
+		l.warn("record audit entry failed", "name", e.Name, "err", err)
+	}
+}
+
+// rotate makes f the file for the given hour. The caller must hold l.mu.
+func (l *Log) rotate(hour string) error {
+	if l.f != nil && l.hour == hour {
+		return nil
+	} else if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	f, err := os.OpenFile(l.filePath(hour), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.f, l.hour = f, hour
+	return nil
+}
+
+// Ship copies the files of the log to S3, under the key
+//
+//	<prefix>/<yyyy-mm-ddThh>/<host>.jsonl
+//
+// The files of past hours are shipped once, after which they are renamed with
+// the suffix ".shipped". The file of the current hour is shipped as well, if
+// current is true; since a file only grows, shipping it again later replaces
+// the object with a superset of its contents. If l has no S3 client, Ship does
+// nothing.
+func (l *Log) Ship(ctx context.Context, current bool) error {
+	if l.S3Client == nil {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(l.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(hourFormat)
+	var errs []error
+	for _, name := range names {
+		hour := strings.TrimSuffix(filepath.Base(name), ".jsonl")
+		if hour == now && !current {
+			continue
+		}
+		if err := l.shipFile(ctx, name, hour); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if hour != now {
+			l.mu.Lock()
+			if l.hour == hour && l.f != nil {
+				l.f.Close()
+				l.f = nil
+			}
+			err := os.Rename(name, name+".shipped")
+			l.mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Log) shipFile(ctx context.Context, name, hour string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	key := path.Join(l.KeyPrefix, hour, l.host()+".jsonl")
+	if err := l.S3Client.Put(ctx, key, f); err != nil {
+		return fmt.Errorf("ship %q: %w", name, err)
+	}
+	return nil
+}
+
+// Run ships the files of the log to S3 (see [Log.Ship]) every hour, shortly
+// after the hour ends, until ctx ends.
+func (l *Log) Run(ctx context.Context) {
+	for {
+		next := time.Now().UTC().Truncate(time.Hour).Add(time.Hour + time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if err := l.Ship(ctx, false); err != nil {
+			l.warn("ship audit log failed", "err", err)
+		}
+	}
+}
+
+// Err reports the last error that occurred writing an entry to l, if any.
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Close closes the log, after shipping all its files (including that of the
+// current hour) to S3 if l has an S3 client. Further entries reopen the file
+// of their hour.
+func (l *Log) Close(ctx context.Context) error {
+	l.mu.Lock()
+	var err error
+	if l.f != nil {
+		err = l.f.Close()
+		l.f = nil
+	}
+	l.mu.Unlock()
+	return errors.Join(err, l.Ship(ctx, true))
+}
+
+// Modules returns a handler that serves requests with h, which must be a Go
+// module proxy mounted at the root, and records each module zip file that h
+// serves. Other files (such as .info and .mod) are not recorded, since the go
+// command fetches them for modules it does not build.
+func (l *Log) Modules(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mod, ver, ok := parseZipPath(r.URL.Path)
+		if !ok || r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		l.Record(Entry{
+			Kind:    KindModule,
+			Service: "modproxy",
+			Name:    mod,
+			Version: ver,
+			Status:  sw.status(),
+			Client:  r.RemoteAddr,
+			User:    requestUser(r),
+		})
+	})
+}
+
+// Requests returns a handler that serves requests with h, which should be a
+// proxy, and records the URL of each GET request. The service names the proxy
+// in the entries.
+func (l *Log) Requests(service string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		l.Record(Entry{
+			Kind:    KindProxy,
+			Service: service,
+			Name:    requestURL(r),
+			Status:  sw.status(),
+			Client:  r.RemoteAddr,
+			User:    requestUser(r),
+		})
+	})
+}
+
+func (l *Log) filePath(hour string) string { return filepath.Join(l.dir, hour+".jsonl") }
+
+func (l *Log) host() string {
+	if l.Host != "" {
+		return l.Host
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "unknown"
+}
+
+func (l *Log) warn(msg string, args ...any) {
+	if l.Logger != nil {
+		l.Logger.Warn(msg, args...)
+	}
+}
+
+// parseZipPath parses a module proxy request path of the form
+// "/<module>/@v/<version>.zip", and reports the unescaped module path and
+// version.
+func parseZipPath(p string) (mod, ver string, ok bool) {
+	emod, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/@v/")
+	if !ok {
+		return "", "", false
+	}
+	ever, ok := strings.CutSuffix(rest, ".zip")
+	if !ok {
+		return "", "", false
+	}
+	mod, err := module.UnescapePath(emod)
+	if err != nil {
+		return "", "", false
+	}
+	ver, err = module.UnescapeVersion(ever)
+	if err != nil {
+		return "", "", false
+	}
+	return mod, ver, true
+}
+
+// requestURL returns the URL of the target of r, without its query.
+func requestURL(r *http.Request) string {
+	u := url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host, Path: r.URL.Path}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	return u.String()
+}
+
+// requestUser returns the user name of the basic authentication of r, or "".
+func requestUser(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// statusWriter is an [http.ResponseWriter] that remembers the status code of
+// the response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package auditlog_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/auditlog"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func readEntries(t *testing.T, path string) []auditlog.Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []auditlog.Entry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditlog.Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid entry %q: %v", sc.Text(), err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestLog(t *testing.T) {
+	var mu sync.Mutex
+	objs := make(map[string]string)
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			data, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			objs[r.URL.Path] = string(data)
+			mu.Unlock()
+		}
+	}))
+	defer fakeS3.Close()
+
+	dir := t.TempDir()
+	l, err := auditlog.Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	l.Host = "testhost"
+	l.KeyPrefix = "audit"
+	l.S3Client = &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(fakeS3.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test",
+	}
+
+	// Entries from the module proxy, another proxy, and the build cache.
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	mods := l.Modules(ok)
+	req := httptest.NewRequest("GET", "/example.com/!foo/@v/v1.0.0.zip", nil)
+	req.SetBasicAuth("build-1", "")
+	mods.ServeHTTP(httptest.NewRecorder(), req)
+	mods.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	l.Requests("revproxy", ok).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://cdn.example.com/a.tgz?x=1", nil))
+
+	rq := &auditlog.Requester{Client: "10.0.0.1:1234", Auth: true}
+	rq.SetUser("ns")
+	ctx := auditlog.NewContext(context.Background(), l, rq)
+	auditlog.Record(ctx, auditlog.Entry{Kind: auditlog.KindWrite, Name: "act", Object: "out"})
+	auditlog.Record(context.Background(), auditlog.Entry{Kind: auditlog.KindWrite, Name: "dropped"})
+
+	hour := time.Now().UTC().Format("2006-01-02T15")
+	got := readEntries(t, filepath.Join(dir, hour+".jsonl"))
+	if len(got) != 3 {
+		t.Fatalf("Got %d entries, want 3: %+v", len(got), got)
+	}
+	if e := got[0]; e.Kind != auditlog.KindModule || e.Name != "example.com/Foo" || e.Version != "v1.0.0" ||
+		e.User != "build-1" || e.Status != http.StatusOK {
+		t.Errorf("Module entry: got %+v", e)
+	}
+	if e := got[1]; e.Kind != auditlog.KindProxy || e.Service != "revproxy" || e.Name != "http://cdn.example.com/a.tgz" {
+		t.Errorf("Proxy entry: got %+v", e)
+	}
+	if e := got[2]; e.Kind != auditlog.KindWrite || e.Object != "out" || e.Client != "10.0.0.1:1234" ||
+		e.User != "ns" || !e.Auth {
+		t.Errorf("Write entry: got %+v", e)
+	}
+
+	// An entry from an earlier hour is shipped and marked, the current hour
+	// only on close.
+	l.Record(auditlog.Entry{Time: time.Now().Add(-2 * time.Hour), Kind: auditlog.KindWrite, Name: "old"})
+	if err := l.Ship(context.Background(), false); err != nil {
+		t.Fatalf("Ship: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour).UTC().Format("2006-01-02T15")
+	if _, err := os.Stat(filepath.Join(dir, old+".jsonl.shipped")); err != nil {
+		t.Errorf("Shipped file: %v", err)
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, h := range []string{old, hour} {
+		key := "/test/audit/" + h + "/testhost.jsonl"
+		if _, ok := objs[key]; !ok {
+			t.Errorf("Missing object %q", key)
+		}
+	}
+	if n := strings.Count(objs["/test/audit/"+hour+"/testhost.jsonl"], "\n"); n != 3 {
+		t.Errorf("Current hour object has %d entries, want 3", n)
+	}
+}
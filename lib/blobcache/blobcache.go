@@ -0,0 +1,368 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package blobcache implements a simple HTTP blob store for compiler caches,
+// caching blobs locally on disk, backed by objects in an S3 bucket.
+//
+// The store is compatible with the HTTP remote storage of ccache, the WebDAV
+// storage of sccache, and the Gradle HTTP build cache, which uses only GET and
+// PUT. Each blob is named by its request path:
+//
+//   - GET and HEAD read the blob, and report 404 if it does not exist.
+//   - PUT writes the blob, replacing any previous contents. Writes require a
+//     credential; see [Server.WriteToken].
+//   - MKCOL succeeds without effect, since directories are implicit.
+//   - PROPFIND reports whether the blob exists, as the WebDAV clients used by
+//     sccache expect.
+//
+// Other methods are rejected.
+package blobcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// Server is an HTTP blob store.
+//
+// # Cache Layout
+//
+// Blobs are stored under a SHA256 digest of their name, encoded as hex and
+// partitioned by the first two bytes of the digest:
+//
+//	<local>/blob/<xx>/<digest>
+//
+// Blobs are also stored in S3 under the same names, relative to the key
+// prefix. A blob written by PUT is stored locally before the request
+// completes, and written to S3 in the background.
+type Server struct {
+	// Local is the path of a local cache directory where blobs are cached.
+	// It must be non-empty.
+	Local string
+
+	// S3Client is the S3 client used to read and write blobs to the backing
+	// store. It must be non-nil.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
+	// intervening slash.
+	KeyPrefix string
+
+	// MaxSize, if positive, is the largest blob in bytes accepted by PUT.
+	MaxSize int64
+
+	// WriteToken is the credential a client must present to write blobs,
+	// either as a bearer token or as the password of HTTP basic
+	// authentication. If it is empty, the store is read-only, and every PUT
+	// is rejected.
+	WriteToken string
+
+	// WriteUser, if non-empty, is the user name a client must present with
+	// the WriteToken when it uses basic authentication. If it is empty, any
+	// user name is accepted.
+	WriteUser string
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each GET, HEAD, and PUT request handled by the store is logged at
+	// [slog.LevelDebug] when it is finished, with the message "get" or "put"
+	// and the attributes:
+	//
+	//    name    -- the name of the blob
+	//    result  -- the disposition of the request (see below)
+	//    size    -- for a put, the size of the blob in bytes
+	//    elapsed -- how long the request took
+	//    err     -- the error reported, if any
+	//
+	// The disposition of a get is one of "hit" (served from the local cache),
+	// "hit S3" (faulted in from S3), "miss", or "error".
+	Logger *slog.Logger
+
+	initOnce sync.Once
+	tasks    *taskgroup.Group
+	start    func(taskgroup.Task)
+
+	getRequest  expvar.Int // get and head requests
+	getLocalHit expvar.Int // blobs served from the local cache
+	getFaultHit expvar.Int // blobs faulted in from S3
+	getMiss     expvar.Int // blobs not found
+	getError    expvar.Int // get requests that failed
+	putRequest  expvar.Int // put requests
+	putBytes    expvar.Int // bytes of blobs received
+	putError    expvar.Int // put requests that failed
+	putDenied   expvar.Int // put requests rejected for lack of a credential
+	pushError   expvar.Int // errors writing blobs to S3
+	pushBytes   expvar.Int // bytes written to S3
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.tasks, s.start = taskgroup.New(nil).Limit(runtime.NumCPU())
+	})
+}
+
+// Metrics returns a map of store metrics for s. The caller is responsible to
+// publish these metrics as desired.
+func (s *Server) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("get_request", &s.getRequest)
+	m.Set("get_local_hit", &s.getLocalHit)
+	m.Set("get_fault_hit", &s.getFaultHit)
+	m.Set("get_miss", &s.getMiss)
+	m.Set("get_error", &s.getError)
+	m.Set("put_request", &s.putRequest)
+	m.Set("put_bytes", &s.putBytes)
+	m.Set("put_error", &s.putError)
+	m.Set("put_denied", &s.putDenied)
+	m.Set("push_error", &s.pushError)
+	m.Set("push_bytes", &s.pushBytes)
+	return m
+}
+
+// Close waits until all background writes to S3 are complete.
+func (s *Server) Close() error {
+	s.init()
+	return s.tasks.Wait()
+}
+
+// ServeHTTP implements the [http.Handler] interface for the store.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	isDir := name == "" || strings.HasSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == "MKCOL":
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PROPFIND":
+		s.servePropfind(w, r, name, isDir)
+	case isDir:
+		http.Error(w, "not found", http.StatusNotFound)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.serveGet(w, r, name)
+	case r.Method == http.MethodPut:
+		s.servePut(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, MKCOL, PROPFIND")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveGet serves the contents of the named blob.
+func (s *Server) serveGet(w http.ResponseWriter, r *http.Request, name string) {
+	s.getRequest.Add(1)
+	start := time.Now()
+	hash := hashName(name)
+	path := s.makePath(hash)
+
+	// Check for a hit in the local cache.
+	if _, err := os.Stat(path); err == nil {
+		s.getLocalHit.Add(1)
+		s.logger().Debug("get", "name", name, "result", "hit", "elapsed", time.Since(start))
+		serveBlobFile(w, r, path)
+		return
+	}
+
+	// Fault in from S3.
+	obj, _, err := s.S3Client.Get(r.Context(), s.makeKey(hash))
+	if err == nil {
+		err = s.storeLocal(path, obj)
+		obj.Close()
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		s.getMiss.Add(1)
+		s.logger().Debug("get", "name", name, "result", "miss", "elapsed", time.Since(start))
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.getError.Add(1)
+		s.logger().Debug("get", "name", name, "result", "error", "elapsed", time.Since(start), "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	s.getFaultHit.Add(1)
+	s.logger().Debug("get", "name", name, "result", "hit S3", "elapsed", time.Since(start))
+	serveBlobFile(w, r, path)
+}
+
+// servePut stores the contents of the named blob.
+func (s *Server) servePut(w http.ResponseWriter, r *http.Request, name string) {
+	s.putRequest.Add(1)
+	start := time.Now()
+	if s.WriteToken == "" {
+		s.putDenied.Add(1)
+		http.Error(w, "store is read-only", http.StatusForbidden)
+		return
+	} else if !s.checkAuth(r) {
+		s.putDenied.Add(1)
+		w.Header().Set("WWW-Authenticate", `Basic realm="blobcache"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.MaxSize > 0 && r.ContentLength > s.MaxSize {
+		s.putError.Add(1)
+		http.Error(w, "blob too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := io.Reader(r.Body)
+	if s.MaxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.MaxSize)
+	}
+	hash := hashName(name)
+	path := s.makePath(hash)
+	if err := s.storeLocal(path, body); err != nil {
+		s.putError.Add(1)
+		s.logger().Debug("put", "name", name, "result", "error", "elapsed", time.Since(start), "err", err)
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			http.Error(w, "blob too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		s.putError.Add(1)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.putBytes.Add(fi.Size())
+	s.logger().Debug("put", "name", name, "size", fi.Size(), "elapsed", time.Since(start))
+	if !s.S3Client.ReadOnly {
+		s.start(s.pushS3(path, s.makeKey(hash), fi.Size()))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkAuth reports whether r carries the credential required to write.
+func (s *Server) checkAuth(r *http.Request) bool {
+	if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(tok), []byte(s.WriteToken)) == 1
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok || (s.WriteUser != "" && subtle.ConstantTimeCompare([]byte(user), []byte(s.WriteUser)) != 1) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(s.WriteToken)) == 1
+}
+
+// servePropfind reports the properties of the named blob or directory, in
+// the form expected by WebDAV clients. Only a depth of 0 is supported, which
+// is all that clients need to check whether a blob exists.
+func (s *Server) servePropfind(w http.ResponseWriter, r *http.Request, name string, isDir bool) {
+	prop := "<D:resourcetype><D:collection/></D:resourcetype>"
+	if !isDir {
+		size, err := s.blobSize(r.Context(), name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		prop = fmt.Sprintf("<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>", size)
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<D:multistatus xmlns:D="DAV:"><D:response><D:href>%s</D:href>`+
+		`<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>`+
+		`</D:response></D:multistatus>`, xmlEscape(r.URL.Path), prop)
+}
+
+// blobSize reports the size of the named blob, from the local cache or S3.
+// If the blob does not exist, the error satisfies [fs.ErrNotExist].
+func (s *Server) blobSize(ctx context.Context, name string) (int64, error) {
+	hash := hashName(name)
+	if fi, err := os.Stat(s.makePath(hash)); err == nil {
+		return fi.Size(), nil
+	}
+	obj, size, err := s.S3Client.Get(ctx, s.makeKey(hash))
+	if err != nil {
+		return 0, err
+	}
+	obj.Close()
+	return size, nil
+}
+
+// pushS3 returns a task that writes the local file at path to S3 under key.
+func (s *Server) pushS3(path, key string, size int64) taskgroup.Task {
+	return func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil // the file was pruned in the meantime
+		}
+		defer f.Close()
+
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := s.S3Client.Put(sctx, key, f); err != nil {
+			s.pushError.Add(1)
+			s.logger().Warn("s3 put failed", "name", key, "err", err)
+		} else {
+			s.pushBytes.Add(size)
+		}
+		return nil
+	}
+}
+
+// storeLocal writes the contents of r atomically to path in the local cache.
+func (s *Server) storeLocal(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_, err := atomicfile.WriteAll(path, r, 0644)
+	return err
+}
+
+// makePath returns the local cache path for the specified hash.
+func (s *Server) makePath(hash string) string {
+	return filepath.Join(s.Local, "blob", hash[:2], hash)
+}
+
+// makeKey returns the S3 object key for the specified hash.
+func (s *Server) makeKey(hash string) string {
+	return path.Join(s.KeyPrefix, "blob", hash[:2], hash)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func serveBlobFile(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
+
+func hashName(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func xmlEscape(s string) string { return xmlEscaper.Replace(s) }
@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blobcache_test
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/blobcache"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestServer(t *testing.T) {
+	// A stand-in for S3 that keeps objects in memory.
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(data)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			io.WriteString(w, data)
+		}
+	}))
+	defer fakeS3.Close()
+	client := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(fakeS3.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test",
+	}
+
+	const token = "s3kr1t"
+	newStore := func(t *testing.T, token, user string) (*blobcache.Server, string) {
+		s := &blobcache.Server{
+			Local:      t.TempDir(),
+			S3Client:   client,
+			KeyPrefix:  "ccache",
+			WriteToken: token,
+			WriteUser:  user,
+		}
+		srv := httptest.NewServer(http.StripPrefix("/blob", s))
+		t.Cleanup(func() { srv.Close(); s.Close() })
+		return s, srv.URL + "/blob"
+	}
+	auth := "Bearer " + token
+	do := func(t *testing.T, method, u, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %q: %v", method, u, err)
+		}
+		defer rsp.Body.Close()
+		data, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(data)
+	}
+
+	const blob = "compiled object"
+	s, base := newStore(t, token, "")
+	if code, _ := do(t, "GET", base+"/ab/cdef", ""); code != http.StatusNotFound {
+		t.Errorf("GET missing blob: got %d, want 404", code)
+	}
+	if code, _ := do(t, "MKCOL", base+"/ab/", ""); code != http.StatusCreated {
+		t.Errorf("MKCOL: got %d, want 201", code)
+	}
+	if code, _ := do(t, "PUT", base+"/ab/cdef", blob); code != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", code)
+	}
+	if code, got := do(t, "GET", base+"/ab/cdef", ""); code != http.StatusOK || got != blob {
+		t.Errorf("GET: got %d %q, want 200 %q", code, got, blob)
+	}
+	if code, _ := do(t, "HEAD", base+"/ab/cdef", ""); code != http.StatusOK {
+		t.Errorf("HEAD: got %d, want 200", code)
+	}
+	if code, _ := do(t, "PROPFIND", base+"/ab/cdef", ""); code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND: got %d, want 207", code)
+	}
+	if code, _ := do(t, "PROPFIND", base+"/ab/nonesuch", ""); code != http.StatusNotFound {
+		t.Errorf("PROPFIND missing blob: got %d, want 404", code)
+	}
+	if code, _ := do(t, "DELETE", base+"/ab/cdef", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got %d, want 405", code)
+	}
+
+	// Once the upload is complete, another store with an empty local cache
+	// faults the blob in from S3.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	_, other := newStore(t, "", "")
+	if code, got := do(t, "GET", other+"/ab/cdef", ""); code != http.StatusOK || got != blob {
+		t.Errorf("GET from S3: got %d %q, want 200 %q", code, got, blob)
+	}
+
+	// A store without a token is read-only.
+	if code, _ := do(t, "PUT", other+"/ab/cdef", "poison"); code != http.StatusForbidden {
+		t.Errorf("PUT to read-only store: got %d, want 403", code)
+	}
+
+	// Writes require the token, as a bearer token or a basic-auth password.
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")), http.StatusUnauthorized},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:"+token)), http.StatusCreated},
+	} {
+		auth = tc.auth
+		if code, _ := do(t, "PUT", base+"/ab/cdef", blob); code != tc.want {
+			t.Errorf("PUT with %q: got %d, want %d", tc.auth, code, tc.want)
+		}
+	}
+
+	// With a user name, basic authentication must present it.
+	_, gradle := newStore(t, token, "gradle")
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"other", http.StatusUnauthorized},
+		{"gradle", http.StatusCreated},
+	} {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(tc.user+":"+token))
+		if code, _ := do(t, "PUT", gradle+"/ab/cdef", blob); code != tc.want {
+			t.Errorf("PUT as %q: got %d, want %d", tc.user, code, tc.want)
+		}
+	}
+}
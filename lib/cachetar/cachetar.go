@@ -0,0 +1,148 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package cachetar packs cache entries into tar archives and unpacks them, to
+// carry the contents of a cache to hosts that cannot reach its storage.
+//
+// Each entry in an archive is named by its tier and its path within that tier:
+//
+//	local/<path>   a file, relative to the local cache directory
+//	s3/<key>       an object, relative to the S3 key prefix
+//
+// so that unpacking an archive reproduces the layout it was packed from. An
+// archive may be compressed with Zstandard; [Read] detects this.
+package cachetar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Tiers of the entries in an archive.
+const (
+	TierLocal = "local" // files in the local cache directory
+	TierS3    = "s3"    // objects in S3
+)
+
+// An Entry is a single file or object in an archive.
+type Entry struct {
+	Tier    string    // one of the Tier* constants
+	Path    string    // the slash-separated path within the tier
+	Size    int64     // the size of the contents in bytes
+	ModTime time.Time // when the contents were last written
+}
+
+// name returns the name of e in an archive.
+func (e Entry) name() string { return e.Tier + "/" + e.Path }
+
+// A Writer writes entries to an archive. Call [Writer.Close] to finish it.
+type Writer struct {
+	tw *tar.Writer
+	zw io.WriteCloser // nil if uncompressed
+}
+
+// NewWriter constructs a Writer that writes an archive to w, compressed with
+// Zstandard if compress is true.
+func NewWriter(w io.Writer, compress bool) (*Writer, error) {
+	if !compress {
+		return &Writer{tw: tar.NewWriter(w)}, nil
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{tw: tar.NewWriter(zw), zw: zw}, nil
+}
+
+// Add writes e to the archive, with exactly e.Size bytes of contents from r.
+func (w *Writer) Add(e Entry, r io.Reader) error {
+	if err := checkEntry(e); err != nil {
+		return err
+	}
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.name(),
+		Size:     e.Size,
+		Mode:     0644,
+		ModTime:  e.ModTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.tw, r, e.Size); err != nil {
+		return fmt.Errorf("write %s: %w", e.name(), err)
+	}
+	return nil
+}
+
+// Close finishes the archive. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	err := w.tw.Close()
+	if w.zw != nil {
+		err = errors.Join(err, w.zw.Close())
+	}
+	return err
+}
+
+// zstdMagic is the frame header that begins a Zstandard stream.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Read reads an archive from r, decompressing it if necessary, and calls f
+// with each entry and a reader for its contents, in the order they were
+// written. If f reports an error, Read stops and returns that error. Entries
+// whose names are not valid, such as paths that escape their tier, are
+// reported as errors.
+func Read(r io.Reader, f func(Entry, io.Reader) error) error {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(zstdMagic)); bytes.Equal(head, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue // directories and the like carry no entries
+		}
+		tier, rest, _ := strings.Cut(hdr.Name, "/")
+		e := Entry{Tier: tier, Path: rest, Size: hdr.Size, ModTime: hdr.ModTime}
+		if err := checkEntry(e); err != nil {
+			return err
+		}
+		if err := f(e, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEntry reports an error if e does not name a valid entry.
+func checkEntry(e Entry) error {
+	if e.Tier != TierLocal && e.Tier != TierS3 {
+		return fmt.Errorf("entry %q: unknown tier %q", e.name(), e.Tier)
+	}
+	if e.Path == "" || path.Clean(e.Path) != e.Path || path.IsAbs(e.Path) ||
+		e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+		return fmt.Errorf("entry %q: invalid path", e.name())
+	}
+	return nil
+}
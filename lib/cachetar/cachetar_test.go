@@ -0,0 +1,96 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cachetar_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/cachetar"
+)
+
+func TestRoundTrip(t *testing.T) {
+	when := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := []struct {
+		cachetar.Entry
+		data string
+	}{
+		{cachetar.Entry{Tier: cachetar.TierLocal, Path: "action/ab/abcd", ModTime: when}, "output 12 34"},
+		{cachetar.Entry{Tier: cachetar.TierLocal, Path: "output/12/1234", ModTime: when}, "the object"},
+		{cachetar.Entry{Tier: cachetar.TierS3, Path: "module/ff/ffee", ModTime: when.Add(time.Hour)}, "a module zip"},
+		{cachetar.Entry{Tier: cachetar.TierS3, Path: "empty", ModTime: when}, ""},
+	}
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, err := cachetar.NewWriter(&buf, compress)
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+		for _, e := range entries {
+			e.Size = int64(len(e.data))
+			if err := w.Add(e.Entry, strings.NewReader(e.data)); err != nil {
+				t.Fatalf("Add %s: %v", e.Path, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		var got []string
+		if err := cachetar.Read(&buf, func(e cachetar.Entry, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			got = append(got, e.Tier+" "+e.Path+" "+e.ModTime.UTC().Format(time.RFC3339)+" "+string(data))
+			return nil
+		}); err != nil {
+			t.Fatalf("Read (compress=%v): %v", compress, err)
+		}
+		want := []string{
+			"local action/ab/abcd 2025-03-01T12:00:00Z output 12 34",
+			"local output/12/1234 2025-03-01T12:00:00Z the object",
+			"s3 module/ff/ffee 2025-03-01T13:00:00Z a module zip",
+			"s3 empty 2025-03-01T12:00:00Z ",
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Entries (compress=%v):\n got %q\nwant %q", compress, got, want)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	w, err := cachetar.NewWriter(io.Discard, false)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, e := range []cachetar.Entry{
+		{Tier: "other", Path: "x"},
+		{Tier: cachetar.TierLocal, Path: ""},
+		{Tier: cachetar.TierLocal, Path: "../x"},
+		{Tier: cachetar.TierS3, Path: "/x"},
+		{Tier: cachetar.TierS3, Path: "a/../../x"},
+	} {
+		if err := w.Add(e, strings.NewReader("")); err == nil {
+			t.Errorf("Add %+v: got nil error", e)
+		}
+	}
+
+	// An archive written by another tool must not escape its tier.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "local/../../etc/passwd"})
+	tw.Close()
+	if err := cachetar.Read(&buf, func(cachetar.Entry, io.Reader) error {
+		t.Error("Read: unexpected entry")
+		return nil
+	}); err == nil {
+		t.Error("Read: got nil error for escaping path")
+	}
+}
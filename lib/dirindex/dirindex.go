@@ -0,0 +1,202 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package dirindex maintains an index of the files in a cache directory, so
+// that a pass over the directory reads only the subdirectories that changed
+// since the previous pass.
+//
+// The caches in this module store their entries in many subdirectories (such
+// as one per leading byte of a digest), and add or remove entries far more
+// often than they change existing ones. Adding or removing a file changes the
+// modification time of its directory, so a directory whose time has not
+// changed since it was indexed still holds the files recorded for it. A pass
+// stats each directory, but lists only those that changed.
+//
+// The index records the size and modification time of each file. Changing a
+// file in place, or changing its times, does not change its directory, so
+// these records may be stale: callers that act on them, as by removing old
+// files, should check the file itself first.
+package dirindex
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// settle is how recently a directory may have changed for its listing to be
+// reused by the next pass. Changes to a directory within the resolution of its
+// modification time would otherwise go unnoticed.
+const settle = 2 * time.Second
+
+// An Index is an index of the regular files under a directory, stored in a
+// file.
+type Index struct {
+	// Root is the directory indexed. It must be non-empty.
+	Root string
+
+	// File is the path of the index file. It must be non-empty, and should
+	// not be under Root, unless Skip excludes it.
+	File string
+
+	// Skip, if non-nil, reports whether to exclude the subdirectory of Root at
+	// the given slash-separated relative path, and everything under it.
+	Skip func(rel string) bool
+}
+
+// An Entry describes a file in the index.
+type Entry struct {
+	Path    string    // the slash-separated path of the file relative to Root
+	Size    int64     // the size of the file in bytes
+	ModTime time.Time // the modification time of the file
+}
+
+// Stats are statistics about a pass over an index.
+type Stats struct {
+	Dirs     int // the number of directories examined
+	DirsRead int // the number of directories listed, because they changed
+	Files    int // the number of files visited
+}
+
+// dirRecord is the stored record of one directory.
+type dirRecord struct {
+	ModTime int64      // of the directory when listed, in Unix nanoseconds
+	Files   []fileInfo // the regular files in the directory
+	Subdirs []string   // the names of the subdirectories, not skipped
+}
+
+type fileInfo struct {
+	Name    string
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+}
+
+// Walk calls f for each regular file under Root, updating the index to match
+// the directory as it does, and then saves the index. If f reports an error,
+// Walk stops and reports that error without saving. If the index file is
+// missing or invalid, Walk lists every directory. If Root does not exist,
+// Walk visits nothing and does not save.
+func (x *Index) Walk(f func(Entry) error) (Stats, error) {
+	old := x.load()
+	cur := make(map[string]*dirRecord)
+	var st Stats
+	now := time.Now()
+
+	var visit func(rel string) error
+	visit = func(rel string) error {
+		dir := filepath.Join(x.Root, filepath.FromSlash(rel))
+		fi, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed while walking
+		} else if err != nil {
+			return err
+		}
+		st.Dirs++
+		mtime := fi.ModTime()
+		rec, ok := old[rel]
+		if !ok || rec.ModTime == 0 || rec.ModTime != mtime.UnixNano() {
+			st.DirsRead++
+			rec, err = x.readDir(rel, dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if now.Sub(mtime) >= settle {
+				rec.ModTime = mtime.UnixNano()
+			}
+		}
+		cur[rel] = rec
+		for _, fe := range rec.Files {
+			st.Files++
+			if err := f(Entry{
+				Path:    path.Join(rel, fe.Name),
+				Size:    fe.Size,
+				ModTime: time.Unix(0, fe.ModTime),
+			}); err != nil {
+				return err
+			}
+		}
+		for _, sub := range rec.Subdirs {
+			if err := visit(path.Join(rel, sub)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(""); err != nil {
+		return st, err
+	} else if st.Dirs == 0 {
+		return st, nil // Root does not exist
+	}
+	return st, x.save(cur)
+}
+
+// readDir lists the directory at path dir, whose relative path is rel.
+func (x *Index) readDir(rel, dir string) (*dirRecord, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	rec := new(dirRecord)
+	for _, de := range des {
+		switch {
+		case de.IsDir():
+			if x.Skip == nil || !x.Skip(path.Join(rel, de.Name())) {
+				rec.Subdirs = append(rec.Subdirs, de.Name())
+			}
+		case de.Type().IsRegular():
+			fi, err := de.Info()
+			if err != nil {
+				continue // removed while listing
+			}
+			rec.Files = append(rec.Files, fileInfo{
+				Name:    de.Name(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime().UnixNano(),
+			})
+		}
+	}
+	return rec, nil
+}
+
+// indexMagic identifies the format of an index file.
+const indexMagic = "dirindex1"
+
+type indexFile struct {
+	Magic string
+	Root  string
+	Dirs  map[string]*dirRecord
+}
+
+// load returns the directory records of the index file, or nil if it is
+// missing, invalid, or for another directory.
+func (x *Index) load() map[string]*dirRecord {
+	data, err := os.ReadFile(x.File)
+	if err != nil {
+		return nil
+	}
+	var idx indexFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&idx); err != nil ||
+		idx.Magic != indexMagic || idx.Root != x.Root {
+		return nil
+	}
+	return idx.Dirs
+}
+
+// save writes dirs to the index file.
+func (x *Index) save(dirs map[string]*dirRecord) error {
+	if err := os.MkdirAll(filepath.Dir(x.File), 0755); err != nil {
+		return err
+	}
+	return atomicfile.Tx(x.File, 0644, func(f *atomicfile.File) error {
+		return gob.NewEncoder(f).Encode(indexFile{Magic: indexMagic, Root: x.Root, Dirs: dirs})
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dirindex_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/dirindex"
+)
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+	x := &dirindex.Index{
+		Root: root,
+		File: filepath.Join(t.TempDir(), "test.idx"),
+		Skip: func(rel string) bool { return rel == "skip" },
+	}
+	old := time.Now().Add(-time.Hour)
+	write := func(rel, data string) {
+		t.Helper()
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Age the directories, so that the index trusts their listings. Each
+	// call sets a distinct time, as a change would.
+	settle := func(dirs ...string) {
+		t.Helper()
+		old = old.Add(time.Minute)
+		for _, dir := range dirs {
+			if err := os.Chtimes(filepath.Join(root, dir), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	walk := func(wantRead int, want ...string) {
+		t.Helper()
+		var got []string
+		st, err := x.Walk(func(e dirindex.Entry) error {
+			got = append(got, e.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("Walk: got %q, want %q", got, want)
+		}
+		if st.DirsRead != wantRead {
+			t.Errorf("Walk: read %d directories, want %d", st.DirsRead, wantRead)
+		}
+	}
+
+	write("a/1", "one")
+	write("a/2", "two")
+	write("b/3", "three")
+	write("skip/4", "four")
+	settle(".", "a", "b", "skip")
+
+	// The first pass lists every directory not skipped, and the second
+	// lists none.
+	walk(3, "a/1", "a/2", "b/3")
+	walk(0, "a/1", "a/2", "b/3")
+
+	// Only the directories that changed are listed again.
+	write("b/5", "five")
+	os.Remove(filepath.Join(root, "a", "1"))
+	settle("a", "b")
+	write("c/6", "six")
+	walk(4, "a/2", "b/3", "b/5", "c/6")
+
+	// The directories changed recently, the root and c, are listed again on
+	// the next pass.
+	walk(2, "a/2", "b/3", "b/5", "c/6")
+
+	// A missing root visits nothing.
+	x.Root = filepath.Join(root, "nonesuch")
+	walk(0)
+}
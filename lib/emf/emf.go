@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package emf writes metrics in the CloudWatch Embedded Metric Format (EMF).
+//
+// Each record is a line of JSON that CloudWatch Logs extracts metrics from
+// when it is ingested, as from the output of a Lambda function, an ECS task
+// using the awslogs driver, or a file followed by the CloudWatch agent. See
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+package emf
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Units of metrics understood by CloudWatch.
+const (
+	Count   = "Count"
+	Bytes   = "Bytes"
+	Percent = "Percent"
+	Seconds = "Seconds"
+	None    = "None"
+)
+
+// MaxMetrics is the most metrics CloudWatch accepts in one record.
+const MaxMetrics = 100
+
+// A Metric is a single value reported in a record.
+type Metric struct {
+	Name  string  // the name of the metric, unique within the record
+	Unit  string  // the unit of Value; if empty, None is used
+	Value float64 // the value of the metric
+}
+
+// A Writer writes records of metrics to an output in EMF.
+type Writer struct {
+	// W is where the records are written, one per line. It must be set.
+	W io.Writer
+
+	// Namespace is the CloudWatch namespace of the metrics. It must be set.
+	Namespace string
+
+	// Dimensions, if non-empty, are the dimensions of each metric, as names
+	// and values. CloudWatch accepts at most 30.
+	Dimensions map[string]string
+
+	mu sync.Mutex
+}
+
+// Write writes a record of the given metrics as of the given time. Metrics
+// with duplicate names are reported as errors, as are more than MaxMetrics.
+// If there are no metrics, Write does nothing.
+func (w *Writer) Write(when time.Time, metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	} else if len(metrics) > MaxMetrics {
+		return errors.New("too many metrics in one record")
+	}
+	dims := slices.Sorted(maps.Keys(w.Dimensions))
+	if dims == nil {
+		dims = []string{} // CloudWatch requires a set, though it may be empty
+	}
+	type metricDef struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	}
+	defs := make([]metricDef, len(metrics))
+
+	// The metric values and the dimension values are siblings of the
+	// metadata at the top level of the record.
+	rec := make(map[string]any, 1+len(dims)+len(metrics))
+	for _, d := range dims {
+		rec[d] = w.Dimensions[d]
+	}
+	for i, m := range metrics {
+		if _, ok := rec[m.Name]; ok || m.Name == "_aws" {
+			return errors.New("duplicate metric name " + m.Name)
+		}
+		rec[m.Name] = m.Value
+		defs[i] = metricDef{Name: m.Name, Unit: m.Unit}
+		if defs[i].Unit == "" {
+			defs[i].Unit = None
+		}
+	}
+	rec["_aws"] = map[string]any{
+		"Timestamp": when.UnixMilli(),
+		"CloudWatchMetrics": []any{map[string]any{
+			"Namespace":  w.Namespace,
+			"Dimensions": [][]string{dims},
+			"Metrics":    defs,
+		}},
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.W.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package emf_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/emf"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &emf.Writer{
+		W:          &buf,
+		Namespace:  "GoCache",
+		Dimensions: map[string]string{"Bucket": "my-bucket", "Host": "ci-1"},
+	}
+	when := time.UnixMilli(1700000000123)
+	if err := w.Write(when, []emf.Metric{
+		{Name: "Hits", Unit: emf.Count, Value: 3},
+		{Name: "HitRatio", Value: 0.75},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	const want = `{"Bucket":"my-bucket","HitRatio":0.75,"Hits":3,"Host":"ci-1",` +
+		`"_aws":{"CloudWatchMetrics":[{"Dimensions":[["Bucket","Host"]],` +
+		`"Metrics":[{"Name":"Hits","Unit":"Count"},{"Name":"HitRatio","Unit":"None"}],` +
+		`"Namespace":"GoCache"}],"Timestamp":1700000000123}}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Record:\n got %s\nwant %s", got, want)
+	}
+
+	// An empty record is not written.
+	buf.Reset()
+	if err := w.Write(when, nil); err != nil {
+		t.Errorf("Write empty: %v", err)
+	} else if buf.Len() != 0 {
+		t.Errorf("Write empty: got %q, want no output", buf.String())
+	}
+
+	// A metric may not collide with another metric or a dimension.
+	for _, name := range []string{"Hits", "Bucket", "_aws"} {
+		err := w.Write(when, []emf.Metric{{Name: "Hits", Value: 1}, {Name: name, Value: 2}})
+		if err == nil || !strings.Contains(err.Error(), "duplicate") {
+			t.Errorf("Write %q: got %v, want duplicate error", name, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+)
+
+const (
+	// maxAdaptiveUploads bounds the concurrency of adaptive uploads when no
+	// UploadConcurrency is set.
+	maxAdaptiveUploads = 64
+
+	// initAdaptiveUploads is the concurrency of adaptive uploads at start.
+	initAdaptiveUploads = 4
+
+	// minAdaptiveWindow is the fewest uploads observed before the concurrency
+	// of adaptive uploads is adjusted.
+	minAdaptiveWindow = 4
+)
+
+// An adaptiveLimit bounds the number of S3 tasks in progress, adjusting the
+// bound to their latency and to throttling by S3 (see
+// [S3Cache.AdaptiveUploads]).
+//
+// It observes the tasks in windows of at least as many tasks as the limit.
+// A window with a throttled task halves the limit. Otherwise, the mean latency
+// of the window is compared to a baseline, the lowest mean seen, which drifts
+// up slowly so that it follows a change in conditions: near the baseline, S3
+// is keeping up, and the limit grows by one; at twice the baseline or more,
+// tasks are queueing in S3 or on the network, and the limit shrinks by one.
+type adaptiveLimit struct {
+	max int
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled when a task ends or the limit changes
+	limit  int
+	active int
+
+	n         int           // tasks completed in the current window
+	throttled int           // tasks throttled in the current window
+	total     time.Duration // the total latency of the tasks in the window
+	base      time.Duration // the baseline mean latency, or 0 if none yet
+}
+
+func newAdaptiveLimit(max int) *adaptiveLimit {
+	a := &adaptiveLimit{max: max, limit: min(initAdaptiveUploads, max)}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// current reports the current limit of a.
+func (a *adaptiveLimit) current() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// start starts task in g once fewer tasks than the limit are running,
+// blocking until then.
+func (a *adaptiveLimit) start(g *taskgroup.Group, task taskgroup.Task) {
+	a.mu.Lock()
+	for a.active >= a.limit {
+		a.cond.Wait()
+	}
+	a.active++
+	a.mu.Unlock()
+
+	g.Go(func() error {
+		start := time.Now()
+		err := task()
+		a.done(time.Since(start), isThrottled(err))
+		return err
+	})
+}
+
+// done records the end of a task with the given latency.
+func (a *adaptiveLimit) done(elapsed time.Duration, throttled bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	defer a.cond.Broadcast()
+	a.active--
+	a.n++
+	a.total += elapsed
+	if throttled {
+		a.throttled++
+	}
+	if a.n < max(a.limit, minAdaptiveWindow) {
+		return
+	}
+
+	mean := a.total / time.Duration(a.n)
+	switch {
+	case a.throttled > 0:
+		a.limit = max(a.limit/2, 1)
+	case a.base == 0 || mean < a.base:
+		a.base = mean
+		a.limit = min(a.limit+1, a.max)
+	case mean <= a.base*3/2:
+		a.limit = min(a.limit+1, a.max)
+	case mean >= a.base*2:
+		a.limit = max(a.limit-1, 1)
+	}
+	if a.throttled == 0 && mean > a.base {
+		a.base += (mean - a.base) / 16
+	}
+	a.n, a.throttled, a.total = 0, 0, 0
+}
+
+// isThrottled reports whether err reports that S3 throttled a request, as by
+// the "SlowDown" error or a 503 status.
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	var api interface{ ErrorCode() string }
+	if errors.As(err, &api) {
+		switch api.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return true
+		}
+	}
+	var rsp interface{ HTTPStatusCode() int }
+	return errors.As(err, &rsp) && rsp.HTTPStatusCode() == 503
+}
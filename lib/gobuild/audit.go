@@ -0,0 +1,113 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Manifest records the cache hits served to a single build, so that the
+// artifacts that contributed to its outputs can be accounted for later.
+//
+// A manifest is attached to the context of a cache server with [WithManifest].
+// Each hit served by an [S3Cache] with that context is written to the manifest
+// as a JSON object on a single line (see [ManifestEntry]). Misses are not
+// recorded, since the toolchain rebuilds those outputs itself.
+type Manifest struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	n   int
+	err error
+}
+
+// NewManifest constructs a manifest that writes entries to w.
+func NewManifest(w io.Writer) *Manifest { return &Manifest{enc: json.NewEncoder(w)} }
+
+// ManifestEntry is a single cache hit recorded in a [Manifest].
+type ManifestEntry struct {
+	Time     time.Time `json:"time"`             // when the hit was served
+	ActionID string    `json:"action"`           // the action ID requested
+	OutputID string    `json:"output"`           // the output ID served
+	Size     int64     `json:"size"`             // the size of the object in bytes
+	SHA256   string    `json:"sha256"`           // the digest of the object served, hex encoded
+	ModTime  time.Time `json:"mtime"`            // when the entry was written to the cache
+	Source   string    `json:"source"`           // "local", "peer", or "s3"
+	Origin   string    `json:"origin,omitempty"` // the peer address or S3 URL, if not local
+}
+
+// Len reports the number of entries written to m.
+func (m *Manifest) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.n
+}
+
+// Err reports the first error that occurred writing to m, if any.
+// Once an error has occurred, no further entries are written.
+func (m *Manifest) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *Manifest) add(e ManifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	if err := m.enc.Encode(e); err != nil {
+		m.err = err
+	} else {
+		m.n++
+	}
+}
+
+type manifestKey struct{}
+
+// WithManifest returns a child of ctx with the specified manifest attached.
+func WithManifest(ctx context.Context, m *Manifest) context.Context {
+	return context.WithValue(ctx, manifestKey{}, m)
+}
+
+// audit records a hit for actionID in the manifest attached to ctx, if any.
+// The digest of the object is computed from the file at diskPath, which is what
+// the toolchain will read. Failures are logged and otherwise ignored, so that
+// auditing does not affect the build.
+func (s *S3Cache) audit(ctx context.Context, actionID, outputID, diskPath, source, origin string) {
+	m, ok := ctx.Value(manifestKey{}).(*Manifest)
+	if !ok || m == nil {
+		return
+	}
+	e := ManifestEntry{
+		Time:     time.Now().UTC(),
+		ActionID: actionID,
+		OutputID: outputID,
+		Source:   source,
+		Origin:   origin,
+	}
+	f, err := os.Open(diskPath)
+	if err == nil {
+		defer f.Close()
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			h := sha256.New()
+			e.Size, err = io.Copy(h, f)
+			e.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+			e.ModTime = fi.ModTime().UTC()
+		}
+	}
+	if err != nil {
+		s.logger().Warn("audit failed", "action", actionID, "err", err)
+		return
+	}
+	m.add(e)
+}
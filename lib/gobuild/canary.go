@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// A Canary routes a fraction of the actions of an [S3Cache] to an alternate
+// cache with a different configuration (such as a new Compression or
+// KeyFunc), so that the change can be tried on live traffic before it is
+// rolled out. Actions are chosen by a hash of their IDs, so each action is
+// always served by the same cache, and every server with the same Rate
+// chooses the same actions.
+//
+// The alternate cache keeps its own metrics (see [S3Cache.SetMetrics]), which
+// can be compared with those of the primary cache. With a different KeyPrefix
+// or KeyFunc, the alternate cache starts empty in S3.
+type Canary struct {
+	// Cache is the alternate cache. It must be non-nil, and must share the
+	// Local directory of the primary cache. See [S3Cache.Derive].
+	Cache *S3Cache
+
+	// Rate is the fraction of actions, from 0 to 1, routed to Cache.
+	Rate float64
+}
+
+// selects reports whether actionID is routed to the alternate cache.
+func (c *Canary) selects(actionID string) bool {
+	if c == nil || c.Rate <= 0 {
+		return false
+	} else if c.Rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(actionID))
+	return float64(h.Sum64()) < c.Rate*math.MaxUint64
+}
+
+// route returns the cache that serves actionID: the alternate cache of the
+// Canary, if it selects the action, or else s itself.
+func (s *S3Cache) route(actionID string) *S3Cache {
+	if !s.Canary.selects(actionID) {
+		return s
+	}
+	c := s.Canary.Cache
+	c.init()
+	return c
+}
+
+// Derive returns a new cache with the same settings as s, other than its
+// Canary, for use as the alternate cache of a [Canary]. The caller may then
+// change the settings under trial.
+func (s *S3Cache) Derive() *S3Cache {
+	return &S3Cache{
+		Local:              s.Local,
+		S3Client:           s.S3Client,
+		KeyPrefix:          s.KeyPrefix,
+		Fallback:           s.Fallback,
+		ReadPrefixes:       s.ReadPrefixes,
+		KeyFunc:            s.KeyFunc,
+		MinUploadSize:      s.MinUploadSize,
+		UploadConcurrency:  s.UploadConcurrency,
+		UploadQueue:        s.UploadQueue,
+		UploadDrop:         s.UploadDrop,
+		MultipartThreshold: s.MultipartThreshold,
+		Multipart:          s.Multipart,
+		Peers:              s.Peers,
+		MemoryEntries:      s.MemoryEntries,
+		HostIndex:          s.HostIndex,
+		Spill:              s.Spill,
+		DiskWatch:          s.DiskWatch,
+		MissTTL:            s.MissTTL,
+		BackgroundFault:    s.BackgroundFault,
+		Journal:            s.Journal,
+		TestResults:        s.TestResults,
+		TestTTL:            s.TestTTL,
+		Compression:        s.Compression,
+		SlowLog:            s.SlowLog,
+		Logger:             s.Logger,
+	}
+}
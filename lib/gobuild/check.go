@@ -0,0 +1,224 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// Kinds of problems reported by [S3Cache.Check] and [S3Cache.Scrub].
+const (
+	ProblemCorrupt  = "corrupt"  // an action record that cannot be parsed
+	ProblemMissing  = "missing"  // an action whose object is not in S3
+	ProblemMismatch = "mismatch" // an object whose contents do not match its output ID
+	ProblemOrphan   = "orphan"   // an object not referenced by any action
+)
+
+// A Problem is an inconsistency in the remote cache found by [S3Cache.Check],
+// or in the local cache found by [S3Cache.Scrub].
+type Problem struct {
+	Kind   string // one of the Problem* constants
+	Key    string // the S3 key (or local path) of the entry with the problem
+	Detail string // a human-readable description
+}
+
+// CheckOptions are the settings for [S3Cache.Check].
+type CheckOptions struct {
+	// Verify, if true, means each object referenced by an action is read, and
+	// its SHA-256 digest compared with its output ID. Otherwise, only the
+	// presence of objects is checked.
+	Verify bool
+
+	// MinAge is the age below which an object not referenced by any action
+	// is not reported as an orphan, since its action may not be written yet.
+	// If zero, the default is one hour.
+	MinAge time.Duration
+
+	// Repair, if true, means problem entries are deleted from S3: corrupt
+	// actions, actions whose objects are missing, mismatched objects, and
+	// orphans. An action whose object was deleted is treated as a miss, and
+	// both are written again the next time the action is stored.
+	Repair bool
+}
+
+// CheckStats are the totals reported by [S3Cache.Check].
+type CheckStats struct {
+	Actions  int64            // the number of action records checked
+	Objects  int64            // the number of objects listed
+	Verified int64            // the number of objects whose digests were checked
+	Repaired int64            // the number of problem entries deleted
+	Problems map[string]int64 // the number of problems found, by kind
+}
+
+// Check cross-checks the action records and objects stored in S3 under the
+// key prefix of s, including the actions of every namespace (see
+// [NamespaceChain]), and calls report for each problem found. It is safe to run
+// while other servers write to the cache. Check reports an error only if it
+// cannot list or read the cache; problems are reported via report.
+func (s *S3Cache) Check(ctx context.Context, opts CheckOptions, report func(Problem)) (CheckStats, error) {
+	stats := CheckStats{Problems: make(map[string]int64)}
+	var mu sync.Mutex // protects stats and calls to report
+	problem := func(p Problem) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Problems[p.Kind]++
+		report(p)
+	}
+	repair := func(key string) {
+		if !opts.Repair {
+			return
+		}
+		if err := s.S3Client.Delete(ctx, key); err != nil {
+			s.logger().Warn("repair delete failed", "key", key, "err", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Repaired++
+	}
+
+	// List the objects before the actions. Since objects are written before
+	// the actions that refer to them, an object missing from the listing
+	// is either missing, or written after the listing began; the latter is
+	// confirmed before reporting the former.
+	objects := make(map[string]s3util.ObjectInfo)
+	for _, kind := range []string{"output", "test"} {
+		if err := s.S3Client.List(ctx, s.kindDir(kind), func(obj s3util.ObjectInfo) error {
+			objects[obj.Key] = obj
+			return nil
+		}); err != nil {
+			return stats, fmt.Errorf("list objects: %w", err)
+		}
+	}
+	stats.Objects = int64(len(objects))
+
+	var refMu sync.Mutex
+	referenced := make(map[string]string) // object key → output ID
+	g, start := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	checkAction := func(obj s3util.ObjectInfo) error {
+		mu.Lock()
+		stats.Actions++
+		mu.Unlock()
+		start(func() error {
+			data, err := s.S3Client.GetData(ctx, obj.Key)
+			if s3util.IsNotExist(err) {
+				return nil // deleted since it was listed
+			} else if err != nil {
+				return fmt.Errorf("read action %s: %w", obj.Key, err)
+			}
+			rec, err := parseAction(data)
+			outputID := rec.outputID
+			if err == nil && !isHexDigest(outputID) {
+				err = fmt.Errorf("invalid output ID %q", outputID)
+			}
+			if err != nil {
+				problem(Problem{Kind: ProblemCorrupt, Key: obj.Key, Detail: err.Error()})
+				repair(obj.Key)
+				return nil
+			}
+			okey := s.recordKey(s.KeyPrefix, rec)
+			refMu.Lock()
+			referenced[okey] = outputID
+			refMu.Unlock()
+			if _, ok := objects[okey]; ok {
+				return nil
+			}
+			if ok, err := s.S3Client.Exists(ctx, okey); err != nil {
+				return fmt.Errorf("check object %s: %w", okey, err)
+			} else if !ok {
+				problem(Problem{Kind: ProblemMissing, Key: obj.Key, Detail: "object " + okey + " not found"})
+				repair(obj.Key)
+			}
+			return nil
+		})
+		return nil
+	}
+	lerr := s.S3Client.List(ctx, s.kindDir("action"), checkAction)
+	if lerr == nil {
+		// Only actions are stored in namespaces.
+		lerr = s.S3Client.List(ctx, s.namespaceDir(), checkAction)
+	}
+	if err := g.Wait(); err != nil {
+		return stats, err
+	} else if lerr != nil {
+		return stats, fmt.Errorf("list actions: %w", lerr)
+	}
+
+	cutoff := time.Now().Add(-cmp.Or(opts.MinAge, time.Hour))
+	for key, obj := range objects {
+		outputID, ok := referenced[key]
+		if !ok {
+			if obj.ModTime.Before(cutoff) {
+				problem(Problem{Kind: ProblemOrphan, Key: key, Detail: "not referenced by any action"})
+				repair(key)
+			}
+			continue
+		}
+		if !opts.Verify {
+			continue
+		}
+		start(func() error {
+			sum, err := s.objectDigest(ctx, key)
+			if s3util.IsNotExist(err) {
+				return nil // deleted since it was listed
+			} else if err != nil {
+				return fmt.Errorf("read object %s: %w", key, err)
+			}
+			mu.Lock()
+			stats.Verified++
+			mu.Unlock()
+			if sum != outputID {
+				problem(Problem{Kind: ProblemMismatch, Key: key, Detail: "content digest is " + sum})
+				repair(key)
+			}
+			return nil
+		})
+	}
+	return stats, g.Wait()
+}
+
+// kindDir returns the key prefix under which entries of the given kind are
+// stored in S3, ending in a slash.
+func (s *S3Cache) kindDir(kind string) string {
+	// The last two components of a key are the ID and its two-digit shard.
+	key := s.keyIn(s.KeyPrefix, kind, strings.Repeat("0", 64))
+	return path.Dir(path.Dir(key)) + "/"
+}
+
+// objectDigest returns the hex-encoded SHA-256 digest of the object at key,
+// decompressed if its key names a codec.
+func (s *S3Cache) objectDigest(ctx context.Context, key string) (string, error) {
+	rc, _, err := s.S3Client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	rc, err = s.decodeObject(ctx, rc, keyCodec(key))
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isHexDigest reports whether id is a hex-encoded SHA-256 digest.
+func isHexDigest(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 2*sha256.Size
+}
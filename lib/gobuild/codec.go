@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression codecs for the objects stored in S3 (see [S3Cache.Compression]).
+const (
+	// CodecNone stores objects uncompressed, byte for byte as the go command
+	// wrote them.
+	CodecNone = "none"
+
+	// CodecZstd compresses objects with Zstandard, which saves the most
+	// bandwidth and storage, at a moderate cost in CPU.
+	CodecZstd = "zstd"
+
+	// CodecLZ4 compresses objects with LZ4, which saves less than zstd, but is
+	// cheap enough in CPU for small runners.
+	CodecLZ4 = "lz4"
+)
+
+// A codec compresses and decompresses the objects stored in S3. The dict
+// argument of its constructors is a trained dictionary, or nil; codecs that
+// do not support dictionaries ignore it.
+type codec struct {
+	ext       string // the suffix of the keys of objects in this codec
+	newWriter func(w io.Writer, dict []byte) (io.WriteCloser, error)
+	newReader func(r io.Reader, dict []byte) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	CodecZstd: {
+		ext: ".zst",
+		newWriter: func(w io.Writer, dict []byte) (io.WriteCloser, error) {
+			if dict != nil {
+				return zstd.NewWriter(w, zstd.WithEncoderDict(dict))
+			}
+			return zstd.NewWriter(w)
+		},
+		newReader: func(r io.Reader, dict []byte) (io.ReadCloser, error) {
+			var opts []zstd.DOption
+			if dict != nil {
+				opts = append(opts, zstd.WithDecoderDicts(dict))
+			}
+			d, err := zstd.NewReader(r, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	CodecLZ4: {
+		ext:       ".lz4",
+		newWriter: func(w io.Writer, _ []byte) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+		newReader: func(r io.Reader, _ []byte) (io.ReadCloser, error) { return io.NopCloser(lz4.NewReader(r)), nil },
+	},
+}
+
+// ParseCodec checks that name is a valid compression codec, and returns it.
+// An empty name is [CodecNone].
+func ParseCodec(name string) (string, error) {
+	switch name {
+	case "", CodecNone:
+		return CodecNone, nil
+	case CodecZstd, CodecLZ4:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown compression codec %q (want %s, %s, or %s)", name, CodecNone, CodecZstd, CodecLZ4)
+}
+
+// writeCodec returns the codec of the objects written by s, or "" to write
+// them uncompressed.
+func (s *S3Cache) writeCodec() string {
+	if _, ok := codecs[s.Compression]; ok {
+		return s.Compression
+	}
+	return ""
+}
+
+// codecKey returns the key of an object in the given codec, whose key when
+// uncompressed is key.
+func codecKey(key, name string) string { return key + codecs[name].ext }
+
+// keyCodec returns the codec of the object at key, or "" if it is not
+// compressed.
+func keyCodec(key string) string {
+	for name, c := range codecs {
+		if strings.HasSuffix(key, c.ext) {
+			return name
+		}
+	}
+	return ""
+}
+
+// decodeObject returns a reader for the uncompressed contents of an object in
+// the given codec, read from r. A zstd object compressed with a dictionary is
+// decoded with the dictionary its frame names (see [S3Cache.TrainDictionary]).
+// Closing the reader closes r.
+func (s *S3Cache) decodeObject(ctx context.Context, r io.ReadCloser, name string) (io.ReadCloser, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return r, nil
+	}
+	var src io.Reader = r
+	var dict []byte
+	if name == CodecZstd {
+		br := bufio.NewReader(r)
+		src = br
+		if id := frameDictID(br); id != 0 {
+			var err error
+			dict, err = s.dictionary(ctx, id)
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("load dictionary %d: %w", id, err)
+			}
+		}
+	}
+	dr, err := c.newReader(src, dict)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return decodedReader{ReadCloser: dr, src: r}, nil
+}
+
+// decodedReader is the reader of an object in a codec, which closes both the
+// decompressor and the underlying reader.
+type decodedReader struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (d decodedReader) Close() error {
+	d.ReadCloser.Close()
+	return d.src.Close()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+func TestCodecs(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	data := strings.Repeat("compressible build output\n", 100)
+
+	ext := map[string]string{gobuild.CodecNone: "", gobuild.CodecZstd: ".zst", gobuild.CodecLZ4: ".lz4"}
+	var entries []testEntry
+	for name, suffix := range ext {
+		t.Run(name, func(t *testing.T) {
+			c := newTestCache(t, f)
+			c.Compression = name
+			e := newEntry("codec-"+name, name+" "+data)
+			e.put(t, ctx, c)
+			if err := c.Close(ctx); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			key := "output/" + e.outputID[:2] + "/" + e.outputID + suffix
+			stored, ok := f.get(key)
+			if !ok {
+				t.Fatalf("Object %s not found in %q", key, f.keys("output/"))
+			}
+			if name != gobuild.CodecNone && len(stored) >= len(e.data) {
+				t.Errorf("Stored size: got %d, want less than %d", len(stored), len(e.data))
+			}
+			e.checkGet(t, ctx, newTestCache(t, f))
+			entries = append(entries, e)
+		})
+	}
+
+	// A reader with any setting reads the objects of every codec.
+	for name := range ext {
+		c := newTestCache(t, f)
+		c.Compression = name
+		for _, e := range entries {
+			e.checkGet(t, ctx, c)
+		}
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for in, want := range map[string]string{"": gobuild.CodecNone, "none": gobuild.CodecNone, "zstd": gobuild.CodecZstd, "lz4": gobuild.CodecLZ4} {
+		if got, err := gobuild.ParseCodec(in); err != nil || got != want {
+			t.Errorf("ParseCodec(%q): got %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if got, err := gobuild.ParseCodec("gzip"); err == nil {
+		t.Errorf("ParseCodec(gzip): got %q, want error", got)
+	}
+}
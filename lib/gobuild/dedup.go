@@ -0,0 +1,66 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"sync"
+)
+
+// UploadStats accumulates the outcomes of the uploads to S3 made on behalf of
+// a single build, to show how often a build produces objects that are already
+// stored in S3 by other builds.
+//
+// UploadStats are attached to the context of a cache server with
+// [WithUploadStats]. Each object an [S3Cache] is asked to store with that
+// context is counted when its upload is complete. The totals for all builds
+// are reported by the metrics of the cache (see [S3Cache.SetMetrics]).
+type UploadStats struct {
+	mu sync.Mutex
+	c  UploadCounts
+}
+
+// UploadCounts are the totals reported by [UploadStats].
+type UploadCounts struct {
+	Uploaded      int   // the number of objects written to S3
+	UploadedBytes int64 // the total size of objects written to S3
+	Found         int   // the number of objects already present in S3
+	FoundBytes    int64 // the total size of objects already present in S3
+	Small         int   // the number of objects too small to upload
+	Errors        int   // the number of objects that could not be written
+}
+
+// DedupRatio reports the fraction of objects considered for upload that were
+// already present in S3, or 0 if none were considered.
+func (c UploadCounts) DedupRatio() float64 {
+	if n := c.Found + c.Uploaded; n > 0 {
+		return float64(c.Found) / float64(n)
+	}
+	return 0
+}
+
+// Counts returns the current totals recorded by u.
+func (u *UploadStats) Counts() UploadCounts {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.c
+}
+
+type uploadStatsKey struct{}
+
+// WithUploadStats returns a child of ctx with the specified stats attached.
+func WithUploadStats(ctx context.Context, u *UploadStats) context.Context {
+	return context.WithValue(ctx, uploadStatsKey{}, u)
+}
+
+// countUpload applies f to the upload stats attached to ctx, if any.
+func countUpload(ctx context.Context, f func(*UploadCounts)) {
+	u, ok := ctx.Value(uploadStatsKey{}).(*UploadStats)
+	if !ok || u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f(&u.c)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/creachadair/mds/mapset"
+)
+
+// A Deferral holds the uploads to S3 of a single build until it is known to
+// have succeeded, so that the outputs of failed or aborted builds do not
+// enter the shared cache.
+//
+// A Deferral is attached to the context of a cache server with
+// [WithDeferral]. Each object an [S3Cache] is asked to store with that context
+// is stored in the local cache only, and its action is recorded in the
+// Deferral. When the build succeeds, [S3Cache.Commit] uploads the recorded
+// actions from the local cache; otherwise [Deferral.Discard] forgets them.
+// Deferred uploads are not written to the Journal, so they are not replayed
+// if the process exits before they are committed.
+//
+// A Deferral may be shared by several connections, each with its own
+// [NamespaceChain]; the actions of each are committed to its namespace.
+type Deferral struct {
+	mu      sync.Mutex
+	actions map[*NamespaceChain]mapset.Set[string] // nil key: no chain
+}
+
+// Len reports the number of actions whose uploads are deferred.
+func (d *Deferral) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var n int
+	for _, ids := range d.actions {
+		n += ids.Len()
+	}
+	return n
+}
+
+// Discard forgets the actions whose uploads are deferred, and reports how
+// many there were. Their entries remain in the local cache.
+func (d *Deferral) Discard() int {
+	n := 0
+	for _, ids := range d.take() {
+		n += len(ids)
+	}
+	return n
+}
+
+// add records that the upload of actionID for a request with the given
+// context is deferred.
+func (d *Deferral) add(ctx context.Context, actionID string) {
+	chain, _ := ctx.Value(namespaceChainKey{}).(*NamespaceChain)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.actions == nil {
+		d.actions = make(map[*NamespaceChain]mapset.Set[string])
+	}
+	ids := d.actions[chain]
+	ids.Add(actionID)
+	d.actions[chain] = ids
+}
+
+// take removes and returns the deferred actions, grouped by the namespace
+// chain of the requests that deferred them, in sorted order.
+func (d *Deferral) take() map[*NamespaceChain][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[*NamespaceChain][]string, len(d.actions))
+	for chain, ids := range d.actions {
+		out[chain] = slices.Sorted(maps.Keys(ids))
+	}
+	d.actions = nil
+	return out
+}
+
+type deferralKey struct{}
+
+// WithDeferral returns a child of ctx with the specified deferral attached.
+func WithDeferral(ctx context.Context, d *Deferral) context.Context {
+	return context.WithValue(ctx, deferralKey{}, d)
+}
+
+// deferral returns the deferral attached to ctx, or nil.
+func deferral(ctx context.Context) *Deferral {
+	d, _ := ctx.Value(deferralKey{}).(*Deferral)
+	return d
+}
+
+// Commit uploads the actions deferred by d, and their objects, from the local
+// cache directory rooted at root, which must be the directory managed by
+// s.Local, as [S3Cache.SyncActions] does. Actions are written to the first
+// namespace of the connection that deferred them. Actions removed from the
+// local cache since they were deferred are skipped. After Commit, d is empty.
+func (s *S3Cache) Commit(ctx context.Context, root string, d *Deferral) (SyncStats, error) {
+	start := time.Now()
+	var total SyncStats
+	for chain, ids := range d.take() {
+		cctx := ctx
+		if chain != nil {
+			cctx = WithNamespaceChain(ctx, chain)
+		}
+		st, err := s.SyncActions(cctx, root, ids)
+		total.Actions += st.Actions
+		total.Synced += st.Synced
+		total.Skipped += st.Skipped
+		total.Errors += st.Errors
+		if err != nil {
+			return total, err
+		}
+	}
+	total.Elapsed = time.Since(start)
+	return total, nil
+}
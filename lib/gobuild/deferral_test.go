@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+func TestDeferral(t *testing.T) {
+	f := newFakeS3(t)
+	root := t.TempDir()
+	c := newTestCacheIn(t, f, root)
+	d := new(gobuild.Deferral)
+	ctx := gobuild.WithDeferral(context.Background(), d)
+
+	// Deferred entries are stored locally, but not uploaded.
+	e1 := newEntry("deferred-1", "first build output")
+	e2 := newEntry("deferred-2", "second build output")
+	e1.put(t, ctx, c)
+	e2.put(t, ctx, c)
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	e1.checkGet(t, ctx, c)
+	if got := f.keys(""); len(got) != 0 {
+		t.Errorf("Keys before commit: got %q, want none", got)
+	}
+	if got := d.Len(); got != 2 {
+		t.Errorf("Deferred: got %d, want 2", got)
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		st, err := c.Commit(context.Background(), root, d)
+		if err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		if st.Actions != 2 || st.Synced != 2 {
+			t.Errorf("Commit: got %+v, want 2 actions synced", st)
+		}
+		if got := f.keys("action/"); len(got) != 2 {
+			t.Errorf("Action keys: got %q, want 2", got)
+		}
+		if got := d.Len(); got != 0 {
+			t.Errorf("Deferred after commit: got %d, want 0", got)
+		}
+		e2.checkGet(t, context.Background(), newTestCache(t, f))
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		e3 := newEntry("deferred-3", "output of a failed build")
+		e3.put(t, ctx, c)
+		if got := d.Discard(); got != 1 {
+			t.Errorf("Discard: got %d, want 1", got)
+		}
+		if st, err := c.Commit(context.Background(), root, d); err != nil {
+			t.Fatalf("Commit: %v", err)
+		} else if st.Actions != 0 {
+			t.Errorf("Commit after discard: got %+v, want no actions", st)
+		}
+		if err := c.Close(ctx); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		e3.checkGet(t, ctx, c) // still local
+		e3.checkMiss(t, context.Background(), newTestCache(t, f))
+	})
+}
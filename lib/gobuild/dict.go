@@ -0,0 +1,326 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Trained zstd dictionaries are stored under the key prefix as
+// "dict/zstd/<id>", where the ID is the decimal dictionary ID recorded in the
+// frames compressed with it. The key "dict/zstd/current" holds the ID of the
+// dictionary used for new objects. Dictionaries are never replaced, so that
+// the objects compressed with each remain readable.
+const (
+	dictDir     = "dict/zstd"
+	dictCurrent = "current"
+
+	// dictRefresh is how often a writer checks for a newly trained dictionary.
+	dictRefresh = time.Hour
+)
+
+// A dictSet holds the zstd dictionaries loaded by a cache. The zero value is
+// ready for use.
+type dictSet struct {
+	mu      sync.Mutex
+	byID    map[uint32][]byte
+	current uint32    // the ID of the dictionary for writes, or 0 for none
+	checked time.Time // when current was last read
+}
+
+// dictKey returns the S3 key of the dictionary with the given ID, or of the
+// current dictionary if id == 0.
+func (s *S3Cache) dictKey(id uint32) string {
+	name := dictCurrent
+	if id != 0 {
+		name = strconv.FormatUint(uint64(id), 10)
+	}
+	return path.Join(s.KeyPrefix, dictDir, name)
+}
+
+// dictionary returns the dictionary with the given ID, reading it from S3 if
+// it is not already loaded.
+func (s *S3Cache) dictionary(ctx context.Context, id uint32) ([]byte, error) {
+	d := &s.dicts
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return s.loadDictLocked(ctx, id)
+}
+
+func (s *S3Cache) loadDictLocked(ctx context.Context, id uint32) ([]byte, error) {
+	d := &s.dicts
+	if data, ok := d.byID[id]; ok {
+		return data, nil
+	}
+	data, err := s.S3Client.GetData(ctx, s.dictKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if d.byID == nil {
+		d.byID = make(map[uint32][]byte)
+	}
+	d.byID[id] = data
+	return data, nil
+}
+
+// encoderDict returns the current dictionary for objects written with zstd,
+// or nil if none has been trained. It checks for a new dictionary at most
+// once per dictRefresh; if the check fails, the last one found is used.
+func (s *S3Cache) encoderDict(ctx context.Context) []byte {
+	d := &s.dicts
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.checked) >= dictRefresh {
+		d.checked = time.Now()
+		id, err := s.currentDictID(ctx)
+		if err == nil && id != 0 {
+			_, err = s.loadDictLocked(ctx, id)
+		}
+		if err != nil {
+			s.logger().Warn("load zstd dictionary failed", "err", err)
+		} else if id != d.current {
+			s.logger().Info("using zstd dictionary", "id", id)
+			d.current = id
+		}
+	}
+	if d.current == 0 {
+		return nil
+	}
+	return d.byID[d.current]
+}
+
+// currentDictID returns the ID of the current dictionary, or 0 if there is
+// none.
+func (s *S3Cache) currentDictID(ctx context.Context) (uint32, error) {
+	data, err := s.S3Client.GetData(ctx, s.dictKey(0))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dictionary ID: %w", err)
+	}
+	return uint32(id), nil
+}
+
+// frameDictID returns the dictionary ID recorded in the header of the zstd
+// frame at the start of r, without consuming it, or 0 if there is none or
+// the header cannot be read. In the latter case, the decoder reports the
+// error.
+func frameDictID(r *bufio.Reader) uint32 {
+	buf, _ := r.Peek(zstd.HeaderMaxSize)
+	var h zstd.Header
+	if err := h.Decode(buf); err != nil {
+		return 0
+	}
+	return h.DictionaryID
+}
+
+// TrainOptions are the settings for [S3Cache.TrainDictionary].
+type TrainOptions struct {
+	// MaxObjectSize is the size in bytes of the largest object sampled, as
+	// stored in S3. Dictionaries help most with small objects, whose frames
+	// have too little history of their own to compress well. If zero, the
+	// default is 64KiB.
+	MaxObjectSize int64
+
+	// Samples is the maximum number of objects sampled, chosen at random from
+	// those no larger than MaxObjectSize. If zero, the default is 2000.
+	Samples int
+
+	// DictSize is the maximum size in bytes of the dictionary. If zero, the
+	// default is 112KiB, as for the zstd command.
+	DictSize int
+
+	// DryRun, if true, means the dictionary is trained and measured, but not
+	// stored.
+	DryRun bool
+}
+
+// TrainStats are the totals reported by [S3Cache.TrainDictionary].
+type TrainStats struct {
+	Listed      int64         // the number of objects listed
+	Sampled     int64         // the number of objects read as samples
+	SampleBytes int64         // the total uncompressed size of the samples
+	ID          uint32        // the ID of the new dictionary
+	Size        int64         // the size of the new dictionary in bytes
+	Plain       int64         // the total size of the samples compressed without the dictionary
+	Trained     int64         // the total size of the samples compressed with the dictionary
+	Elapsed     time.Duration // how long the training took
+}
+
+// TrainDictionary samples the small objects stored in S3 under the key prefix
+// of s, trains a zstd dictionary on them, and stores it beside them as the
+// current dictionary. Servers that write with [CodecZstd] under the same
+// prefix compress new objects with the current dictionary, checking for a new
+// one hourly. Readers find the dictionary of each object by the ID in its
+// frame header, so objects compressed with earlier dictionaries, or none, are
+// still read. Objects already stored are not rewritten.
+//
+// The totals report the size of the samples compressed with and without the
+// dictionary, as an estimate of its benefit.
+func (s *S3Cache) TrainDictionary(ctx context.Context, opts TrainOptions) (TrainStats, error) {
+	start := time.Now()
+	maxSize := cmp.Or(opts.MaxObjectSize, 64<<10)
+	nsamples := cmp.Or(opts.Samples, 2000)
+
+	// Choose the samples by reservoir sampling, so that the choice is uniform
+	// without holding the whole listing.
+	var stats TrainStats
+	var keys []string
+	for _, kind := range []string{"output", "test"} {
+		if err := s.S3Client.List(ctx, s.kindDir(kind), func(obj s3util.ObjectInfo) error {
+			if obj.Size > maxSize {
+				return nil
+			}
+			stats.Listed++
+			if len(keys) < nsamples {
+				keys = append(keys, obj.Key)
+			} else if i := rand.Int64N(stats.Listed); i < int64(nsamples) {
+				keys[i] = obj.Key
+			}
+			return nil
+		}); err != nil {
+			return stats, fmt.Errorf("list objects: %w", err)
+		}
+	}
+	if len(keys) == 0 {
+		return stats, errors.New("no objects to sample")
+	}
+
+	samples := make([][]byte, len(keys))
+	g, run := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	for i, key := range keys {
+		run(func() error {
+			data, err := s.readObject(ctx, key)
+			if s3util.IsNotExist(err) {
+				return nil // deleted since it was listed
+			} else if err != nil {
+				return fmt.Errorf("read object %s: %w", key, err)
+			}
+			samples[i] = data
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return stats, err
+	}
+	samples = compactSamples(samples)
+	for _, data := range samples {
+		stats.Sampled++
+		stats.SampleBytes += int64(len(data))
+	}
+
+	id, err := s.newDictID(ctx)
+	if err != nil {
+		return stats, err
+	}
+	data, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: cmp.Or(opts.DictSize, 112<<10),
+		HashBytes:   6,
+		ZstdDictID:  id,
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+	if err != nil {
+		return stats, fmt.Errorf("train dictionary: %w", err)
+	}
+	stats.ID, stats.Size = id, int64(len(data))
+	if stats.Plain, stats.Trained, err = measureDict(samples, data); err != nil {
+		return stats, err
+	}
+
+	if !opts.DryRun {
+		// Write the dictionary before naming it current, so that no writer
+		// can use a dictionary readers cannot find.
+		if err := s.S3Client.Put(ctx, s.dictKey(id), bytes.NewReader(data)); err != nil {
+			return stats, fmt.Errorf("write dictionary: %w", err)
+		}
+		if err := s.S3Client.Put(ctx, s.dictKey(0), strings.NewReader(strconv.FormatUint(uint64(id), 10))); err != nil {
+			return stats, fmt.Errorf("write current dictionary: %w", err)
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	return stats, nil
+}
+
+// readObject returns the uncompressed contents of the object at key.
+func (s *S3Cache) readObject(ctx context.Context, key string) ([]byte, error) {
+	rc, _, err := s.S3Client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err = s.decodeObject(ctx, rc, keyCodec(key))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// compactSamples returns the non-empty samples, in place.
+func compactSamples(samples [][]byte) [][]byte {
+	out := samples[:0]
+	for _, data := range samples {
+		if len(data) != 0 {
+			out = append(out, data)
+		}
+	}
+	return out
+}
+
+// newDictID returns a random dictionary ID not used by an existing dictionary.
+// IDs below 32768 and from 2^31 are reserved by the zstd format.
+func (s *S3Cache) newDictID(ctx context.Context) (uint32, error) {
+	for {
+		id := 32768 + rand.Uint32N(1<<31-32768)
+		if ok, err := s.S3Client.Exists(ctx, s.dictKey(id)); err != nil {
+			return 0, fmt.Errorf("check dictionary ID: %w", err)
+		} else if !ok {
+			return id, nil
+		}
+	}
+}
+
+// measureDict reports the total size of samples compressed one at a time
+// without and with dict.
+func measureDict(samples [][]byte, dict []byte) (plain, trained int64, _ error) {
+	pe, err := zstd.NewWriter(nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer pe.Close()
+	de, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return 0, 0, fmt.Errorf("load dictionary: %w", err)
+	}
+	defer de.Close()
+	var buf []byte
+	for _, data := range samples {
+		buf = pe.EncodeAll(data, buf[:0])
+		plain += int64(len(buf))
+		buf = de.EncodeAll(data, buf[:0])
+		trained += int64(len(buf))
+	}
+	return plain, trained, nil
+}
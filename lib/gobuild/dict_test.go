@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestTrainDictionary(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+
+	// Store a batch of small, similar objects compressed without a dictionary.
+	var old []testEntry
+	c1 := newTestCache(t, f)
+	c1.Compression = gobuild.CodecZstd
+	for i := range 50 {
+		e := newEntry(fmt.Sprint("old", i), fmt.Sprintf("package p%d\n\nfunc F%d() int { return %d }\n%s", i, i, i,
+			strings.Repeat("// generated by the test of dictionary training\n", 3)))
+		e.put(t, ctx, c1)
+		old = append(old, e)
+	}
+	if err := c1.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	trainer := &gobuild.S3Cache{S3Client: f.client()}
+	if _, err := trainer.TrainDictionary(ctx, gobuild.TrainOptions{DryRun: true}); err != nil {
+		t.Fatalf("TrainDictionary (dry run): %v", err)
+	}
+	if got := f.keys("dict/"); len(got) != 0 {
+		t.Errorf("Dry run stored %q, want nothing", got)
+	}
+	stats, err := trainer.TrainDictionary(ctx, gobuild.TrainOptions{})
+	if err != nil {
+		t.Fatalf("TrainDictionary: %v", err)
+	}
+	if stats.Sampled != 50 || stats.ID == 0 || stats.Size == 0 {
+		t.Errorf("Stats: got %+v, want 50 samples and a dictionary", stats)
+	}
+	if stats.Trained >= stats.Plain {
+		t.Errorf("Trained size %d, want less than plain size %d", stats.Trained, stats.Plain)
+	}
+	if cur, ok := f.get("dict/zstd/current"); !ok || string(cur) != strconv.FormatUint(uint64(stats.ID), 10) {
+		t.Errorf("Current dictionary: got %q, want %d", cur, stats.ID)
+	}
+
+	// A new writer compresses with the dictionary.
+	c2 := newTestCache(t, f)
+	c2.Compression = gobuild.CodecZstd
+	e := newEntry("new", "package q\n\nfunc F() int { return 1 }\n")
+	e.put(t, ctx, c2)
+	if err := c2.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data, ok := f.get("output/" + e.outputID[:2] + "/" + e.outputID + ".zst")
+	if !ok {
+		t.Fatalf("Object %s not found in %q", e.outputID, f.keys("output/"))
+	}
+	var h zstd.Header
+	if err := h.Decode(data); err != nil {
+		t.Fatalf("Decode header: %v", err)
+	} else if h.DictionaryID != stats.ID {
+		t.Errorf("Dictionary ID: got %d, want %d", h.DictionaryID, stats.ID)
+	}
+
+	// A reader finds the dictionary of each object, whether or not it has one.
+	c3 := newTestCache(t, f)
+	e.checkGet(t, ctx, c3)
+	for _, e := range old[:5] {
+		e.checkGet(t, ctx, c3)
+	}
+	if !slices.Contains(f.requests(), "GET dict/zstd/"+strconv.FormatUint(uint64(stats.ID), 10)) {
+		t.Errorf("Reader did not load the dictionary: requests %q", f.requests())
+	}
+}
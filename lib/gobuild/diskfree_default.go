@@ -0,0 +1,12 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !(linux || darwin || freebsd)
+
+package gobuild
+
+import "errors"
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free space is not reported on this system")
+}
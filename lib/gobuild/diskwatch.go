@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"cmp"
+	"context"
+	"expvar"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// A DiskWatch watches the free space of the filesystem holding the Local
+// directory of an [S3Cache], so that the cache does not fill it and fail the
+// build. When the free space falls below MinFree, the DiskWatch evicts the
+// least recently written entries of the directory, until twice MinFree is
+// free or only entries written in the last minute remain. While the space
+// stays below MinFree, the cache is low:
+//
+//   - Get does not fault entries from peers or S3 in to the directory, and
+//     reports a local miss as a miss with the reason [MissLowDisk].
+//   - Put uploads each entry to S3 before it returns, rather than in the
+//     background, so that it need not stay in the directory to be uploaded.
+//     Put must still store the entry in the directory, since the go command
+//     reads it from there.
+//
+// Uploads in progress when the eviction begins may find their entries gone;
+// they are recorded as failed. A nil *DiskWatch is never low.
+type DiskWatch struct {
+	// MinFree is the free space, in bytes, below which the cache is low.
+	MinFree int64
+
+	// Interval is how often the free space is checked. If zero, the default
+	// is 10 seconds. A Put that fails also triggers a check.
+	Interval time.Duration
+
+	// Logger, if non-nil, is used to log evictions and changes of state.
+	Logger *slog.Logger
+
+	stop     func() // set by Start
+	low      atomic.Bool
+	kickOnce sync.Once
+	kickCh   chan struct{}
+
+	free      expvar.Int // gauge of the free space at the last check, in bytes
+	lowEvents expvar.Int // count of times the free space fell below MinFree
+	evictA    expvar.Int // count of actions evicted
+	evictB    expvar.Int // count of object bytes evicted
+}
+
+// evictAges are the ages beyond which entries are evicted, in turn, until
+// enough space is free. Entries written within the last of these are never
+// evicted, since the build in progress is likely to use them.
+var evictAges = []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, 6 * time.Hour, time.Hour, 10 * time.Minute, time.Minute}
+
+// Low reports whether the free space was below MinFree at the last check.
+func (w *DiskWatch) Low() bool { return w != nil && w.low.Load() }
+
+// Kick requests a check of the free space without waiting for the next
+// interval. It does not block.
+func (w *DiskWatch) Kick() {
+	if w == nil {
+		return
+	}
+	select {
+	case w.kicks() <- struct{}{}:
+	default:
+	}
+}
+
+func (w *DiskWatch) kicks() chan struct{} {
+	w.kickOnce.Do(func() { w.kickCh = make(chan struct{}, 1) })
+	return w.kickCh
+}
+
+// Start checks the free space of the filesystem holding the directory rooted
+// at root, which must be the directory managed by dir, and starts a goroutine
+// that checks it again at each interval until Stop is called. It reports an
+// error if the free space cannot be read on this system.
+func (w *DiskWatch) Start(dir *cachedir.Dir, root string) error {
+	if _, err := diskFree(root); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	w.stop = func() { cancel(); <-done }
+	go func() {
+		defer close(done)
+		t := time.NewTicker(cmp.Or(w.Interval, 10*time.Second))
+		defer t.Stop()
+		for {
+			w.check(ctx, dir, root)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			case <-w.kicks():
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the checks started by Start, and waits for any eviction in
+// progress to end.
+func (w *DiskWatch) Stop() {
+	if w.stop != nil {
+		w.stop()
+	}
+}
+
+// check reads the free space, and evicts entries from dir if it is low.
+func (w *DiskWatch) check(ctx context.Context, dir *cachedir.Dir, root string) {
+	free, err := diskFree(root)
+	if err != nil {
+		w.logger().Warn("read free space failed", "dir", root, "err", err)
+		return
+	}
+	w.free.Set(free)
+	if free >= w.MinFree {
+		if w.low.Swap(false) {
+			w.logger().Info("local cache space recovered", "dir", root, "free", free)
+		}
+		return
+	}
+	if !w.low.Swap(true) {
+		w.lowEvents.Add(1)
+		w.logger().Warn("local cache low on space, evicting entries", "dir", root, "free", free, "min_free", w.MinFree)
+	}
+	for _, age := range evictAges {
+		st, err := dir.PruneEntries(ctx, age)
+		w.evictA.Add(int64(st.ActionsPruned))
+		w.evictB.Add(st.BytesPruned)
+		if err != nil {
+			w.logger().Warn("evict local entries failed", "dir", root, "err", err)
+			return
+		}
+		if free, err = diskFree(root); err != nil {
+			return
+		}
+		w.free.Set(free)
+		w.logger().Info("evicted local entries", "older_than", age, "actions", st.ActionsPruned,
+			"bytes", st.BytesPruned, "free", free)
+		if free >= 2*w.MinFree {
+			break
+		}
+	}
+	if free >= w.MinFree {
+		w.low.Store(false)
+		w.logger().Info("local cache space recovered", "dir", root, "free", free)
+	}
+}
+
+// Metrics returns a map of the metrics of w.
+func (w *DiskWatch) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("disk_free_bytes", &w.free)
+	m.Set("disk_low", expvar.Func(func() any {
+		if w.Low() {
+			return 1
+		}
+		return 0
+	}))
+	m.Set("disk_low_events", &w.lowEvents)
+	m.Set("disk_evicted_actions", &w.evictA)
+	m.Set("disk_evicted_bytes", &w.evictB)
+	return m
+}
+
+func (w *DiskWatch) logger() *slog.Logger {
+	if w.Logger != nil {
+		return w.Logger
+	}
+	return discardLogger
+}
@@ -0,0 +1,268 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// fakeS3 is an in-memory S3 bucket served over HTTP, implementing as much of
+// the S3 API as the cache uses: reading, writing, copying, listing, and
+// deleting objects, with conditional heads by ETag.
+type fakeS3 struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	reqs    []string // "METHOD key" for each request, in order
+
+	// block, if non-nil, is called with each request before it is handled,
+	// and may delay it.
+	block func(method, key string)
+
+	// fail, if non-nil, is called with each request before it is handled,
+	// and if it reports true the request fails with a server error.
+	fail func(method, key string) bool
+}
+
+type fakeObject struct {
+	data  []byte
+	meta  http.Header // x-amz-meta-* headers
+	mtime time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newFakeS3 starts a fake bucket, which is closed at the end of the test.
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{t: t, objects: make(map[string]fakeObject)}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// client returns a client for the bucket.
+func (f *fakeS3) client() *s3util.Client {
+	return &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:                     "us-east-1",
+			BaseEndpoint:               aws.String(f.srv.URL),
+			UsePathStyle:               true,
+			Credentials:                aws.AnonymousCredentials{},
+			HTTPClient:                 f.srv.Client(),
+			RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+			RetryMaxAttempts:           1,
+		}),
+		Bucket: "test",
+	}
+}
+
+// keys returns the keys of the objects in the bucket with the given prefix,
+// in order.
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// get returns the contents of the object at key, and whether it exists.
+func (f *fakeS3) get(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[key]
+	return o.data, ok
+}
+
+// put stores data under key, as if written by another client.
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = fakeObject{data: data, mtime: time.Now()}
+}
+
+// setModTime sets the last-modified time of the object at key.
+func (f *fakeS3) setModTime(key string, mtime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := f.objects[key]
+	obj.mtime = mtime
+	f.objects[key] = obj
+}
+
+// requests returns the requests made so far, as "METHOD key".
+func (f *fakeS3) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.reqs)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/test"), "/")
+	f.mu.Lock()
+	f.reqs = append(f.reqs, r.Method+" "+key)
+	block, fail := f.block, f.fail
+	f.mu.Unlock()
+	if block != nil {
+		block(r.Method, key)
+	}
+	if err := r.Context().Err(); err != nil {
+		return // the client gave up
+	}
+	if fail != nil && fail(r.Method, key) {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	q := r.URL.Query()
+	switch {
+	case r.Method == "GET" && key == "" && q.Get("list-type") == "2":
+		f.list(w, q.Get("prefix"), q.Get("start-after"))
+	case r.Method == "POST" && q.Has("delete"):
+		f.deleteBatch(w, r)
+	case r.Method == "PUT":
+		f.putObject(w, r, key)
+	case r.Method == "GET" || r.Method == "HEAD":
+		f.getObject(w, r, key)
+	case r.Method == "DELETE":
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj := fakeObject{meta: make(http.Header), mtime: time.Now()}
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		src, _ = url.PathUnescape(src)
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		f.mu.Lock()
+		old, ok := f.objects[srcKey]
+		f.mu.Unlock()
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		obj.data, obj.meta = old.data, old.meta
+		f.mu.Lock()
+		f.objects[key] = obj
+		f.mu.Unlock()
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>"%s"</ETag></CopyObjectResult>`, obj.etag())
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obj.data = data
+	for name, vals := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			obj.meta[name] = vals
+		}
+	}
+	f.mu.Lock()
+	f.objects[key] = obj
+	f.mu.Unlock()
+	w.Header().Set("ETag", `"`+obj.etag()+`"`)
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	f.mu.Lock()
+	obj, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+		}
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "" && strings.Trim(m, `"`) != obj.etag() {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	for name, vals := range obj.meta {
+		w.Header()[name] = vals
+	}
+	w.Header().Set("ETag", `"`+obj.etag()+`"`)
+	w.Header().Set("Last-Modified", obj.mtime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+	if r.Method == "GET" {
+		w.Write(obj.data)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, after string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var out struct {
+		XMLName  xml.Name  `xml:"ListBucketResult"`
+		Contents []content `xml:"Contents"`
+	}
+	f.mu.Lock()
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			out.Contents = append(out.Contents, content{key, len(obj.data), obj.mtime.UTC().Format(time.RFC3339)})
+		}
+	}
+	f.mu.Unlock()
+	slices.SortFunc(out.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+	xml.NewEncoder(w).Encode(out)
+}
+
+func (f *fakeS3) deleteBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	for _, obj := range req.Objects {
+		delete(f.objects, obj.Key)
+	}
+	f.mu.Unlock()
+	io.WriteString(w, `<DeleteResult></DeleteResult>`)
+}
+
+func writeS3Error(w http.ResponseWriter, code int, name string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, name, name)
+}
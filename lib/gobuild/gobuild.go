@@ -6,13 +6,17 @@
 package gobuild
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -21,8 +25,13 @@ import (
 
 	"github.com/creachadair/gocache"
 	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/mds/cache"
+	"github.com/creachadair/mds/mapset"
 	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/auditlog"
+	"github.com/grafana/go-cache-plugin/lib/peer"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"golang.org/x/sync/singleflight"
 )
 
 // S3Cache implements callbacks for a gocache.Server using an S3 bucket for
@@ -39,14 +48,45 @@ import (
 //
 //	[<prefix>/]output/<xx>/<object-id>
 //
+// except that with the [TestSeparate] policy, the objects of test results are
+// stored in files named:
+//
+//	[<prefix>/]test/<xx>/<object-id>
+//
 // The object and action IDs are encoded as lower-case hexadecimal strings,
 // with "<xx>" denoting the first two bytes of the ID to partition the space.
 //
+// Object IDs are content addresses: the go command assigns each output the
+// SHA-256 digest of its contents as its ID. Thus actions whose outputs are
+// identical share a single object, both in S3 and in the local directory, and
+// the action records serve as the index from actions to objects. An object
+// already present in S3 with the same content is not written again.
+//
+// By default, objects are stored uncompressed, byte for byte as the go command
+// wrote them, so that a fault from S3 is a plain copy and object sizes match
+// output sizes. With a Compression codec, objects are written compressed, under
+// the same key with a suffix naming the codec (as "<object-id>.zst"), and
+// decompressed when faulted in, since the go command reads outputs directly
+// from the local directory. Readers decode each object in the codec its action
+// names, so servers with different codecs can share a prefix. The zstd codec
+// uses the dictionary trained for the prefix, if any (see TrainDictionary).
+//
+// The cache protocol identifies entries only by their action and output IDs,
+// which are opaque digests: the go command does not say which package an
+// entry belongs to. So the cache cannot choose which entries to upload by
+// package; the only upload filters are by size (see MinUploadSize), and for
+// the test results recognized by their contents (see TestResults). To keep
+// the outputs of sensitive packages out of a shared bucket, build them with a
+// separate cache.
+//
 // The contents of each action file have the format:
 //
-//	<output-id> <timestamp>
+//	<output-id> <timestamp> [test] [<codec>]
 //
 // where the object ID is hex encoded and the timestamp is Unix nanoseconds.
+// The "test" marker means the object is stored under "test" in place of
+// "output" (see [TestSeparate]). The codec, if present, names the compression
+// of the object (see [S3Cache.Compression]).
 // The object file contains just the binary data of the object.
 type S3Cache struct {
 	// Local is the local cache directory where actions and objects are staged.
@@ -63,6 +103,32 @@ type S3Cache struct {
 	// intervening slash.
 	KeyPrefix string
 
+	// Fallback, if non-nil, is a previous location of the cache in S3, which
+	// is consulted for actions missing from S3Client under KeyPrefix. This
+	// allows the cache to move to a new bucket or key prefix without losing
+	// its contents while they are copied. Entries are never written there.
+	Fallback *Fallback
+
+	// Replica, if non-nil, is a second bucket to which the entries written to
+	// S3Client are mirrored in the background, and from which Get reads when
+	// S3Client fails. See [Replica].
+	Replica *Replica
+
+	// ReadPrefixes, if non-empty, are other key prefixes in the bucket of
+	// S3Client that are consulted in order for actions missing under
+	// KeyPrefix, before the Fallback. Each holds a complete cache, objects
+	// included, with the same layout and KeyFunc. Entries are never written
+	// there, so a build can read a trusted cache without changing it.
+	ReadPrefixes []string
+
+	// KeyFunc, if non-nil, maps each action and output to its S3 key relative
+	// to KeyPrefix, in place of the default layout described above. This
+	// allows operators to enforce key policies, such as hashing action IDs or
+	// separating tenants. See [ParseKeyFunc].
+	//
+	// Servers that share a bucket must use the same KeyFunc to share entries.
+	KeyFunc KeyFunc
+
 	// MinUploadSize, if positive, defines a minimum object size in bytes below
 	// which the cache will not write the object to S3.
 	MinUploadSize int64
@@ -72,78 +138,720 @@ type S3Cache struct {
 	// runtime.NumCPU.
 	UploadConcurrency int
 
+	// AdaptiveUploads, if true, means that the number of concurrent tasks
+	// writing to S3 is adjusted to the latency of S3 and to throttling by it:
+	// it starts low, grows while S3 keeps up, and shrinks when S3 slows or
+	// throttles requests. If UploadConcurrency is positive, it is the most
+	// allowed; otherwise, the most is 64. The put_upload_limit metric reports
+	// the current number.
+	AdaptiveUploads bool
+
+	// UploadQueue, if positive, is the number of uploads to S3 that may wait
+	// for a free worker (see UploadConcurrency), so that Put does not wait for
+	// a slow S3. When the queue is full, an upload is dropped or waited for
+	// according to UploadDrop. A dropped upload is reported by FailedActions,
+	// and remains in the Journal, so that it can be completed later. If zero
+	// or negative, Put waits for a worker whenever all of them are busy.
+	UploadQueue int
+
+	// UploadDrop is the policy for a full UploadQueue: [DropNewest] (the
+	// default, if empty), [DropOldest], or [DropNone].
+	UploadDrop string
+
+	// MultipartThreshold, if positive, defines a minimum object size in bytes
+	// at or above which objects are written to S3 with a multipart upload,
+	// using the settings in Multipart. Otherwise, each object is written with
+	// a single request.
+	//
+	// Since S3 reports a different ETag for a multipart object, servers that
+	// share a bucket should use the same threshold and part size, so that they
+	// recognize objects already written by each other.
+	MultipartThreshold int64
+
+	// Multipart are the settings used for multipart uploads.
+	Multipart s3util.MultipartOptions
+
+	// Peers, if non-nil, is consulted for actions missing from the local
+	// cache before falling back to S3. Failures to reach peers are logged and
+	// otherwise treated as misses.
+	Peers *peer.Client
+
+	// MemoryEntries, if positive, is the maximum number of action lookups
+	// retained in memory, so that repeated requests for the same actions (as
+	// from a language server) need not read the local directory.
+	MemoryEntries int
+
+	// HostIndex, if non-nil, is a snapshot of the actions in the Local
+	// directory shared with other processes on the host, consulted before the
+	// directory itself, so that an action found there need not be read from
+	// its file. An object listed in the index is used only if its file is
+	// still present with the expected size.
+	HostIndex *HostIndex
+
+	// MissTTL, if positive, is how long an action found to be missing from S3
+	// (and the Fallback) is remembered in memory. Until then, Get reports a
+	// miss for the action without reading S3 again, which saves many requests
+	// on a cold build. A Put of the action forgets that it was missing.
+	MissTTL time.Duration
+
+	// KeyIndex, if non-nil, lists the actions present in S3, so that Get
+	// reports a miss without reading S3 for an action it does not list. It is
+	// filled by LoadKeyIndex. See [KeyIndex].
+	KeyIndex *KeyIndex
+
+	// BackgroundFault, if true, means that Get does not wait for peers or S3.
+	// On a local miss, Get reports a miss at once, and faults the action in
+	// from a peer or S3 in the background, so that a later request for the
+	// same action may find it locally.
+	BackgroundFault bool
+
+	// Spill, if non-nil, is a larger, slower local directory behind Local,
+	// which is then the fast tier. See [Spill].
+	Spill *Spill
+
+	// DiskWatch, if non-nil, watches the free space of the Local directory.
+	// While it is low, Get does not fault in remote entries, and Put uploads
+	// entries before it returns. See [DiskWatch].
+	DiskWatch *DiskWatch
+
+	// Journal, if non-nil, records each upload to S3 before it begins and
+	// after it succeeds, so that uploads interrupted by the exit of the
+	// process can be completed later (see [S3Cache.Replay]).
+	Journal *Journal
+
+	// TestResults is the policy for storing the test results cached by
+	// "go test" in S3: [TestShared] (the default if empty), [TestSeparate],
+	// or [TestLocal]. Test results change with each change to the code under
+	// test, so they are seldom reused by other builds, and may crowd out the
+	// build outputs that are. Test results are recognized by their contents,
+	// and counted in the metrics whatever the policy.
+	TestResults string
+
+	// TestTTL, if positive, is the age beyond which a test result stored
+	// with the [TestSeparate] policy is treated as a miss when read from S3,
+	// whether or not its object is still present.
+	TestTTL time.Duration
+
+	// Compression is the codec used to compress the objects written to S3:
+	// [CodecNone] (the default if empty), [CodecZstd], or [CodecLZ4]. It trades
+	// CPU for bandwidth and storage. Objects are read in the codec recorded
+	// with their actions, whatever the setting. Servers older than this setting
+	// report the records of compressed objects as invalid.
+	Compression string
+
+	// Canary, if non-nil, routes a fraction of actions to an alternate cache,
+	// to try a change of configuration on live traffic. See [Canary].
+	Canary *Canary
+
+	// SlowLog, if non-nil, records the slowest Get and Put operations, with a
+	// breakdown of where the time was spent.
+	SlowLog *SlowLog
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each Get and Put is logged at [slog.LevelDebug] (these logs are
+	// detailed, but noisy), with the message "get" or "put" and the
+	// attributes:
+	//
+	//    action  -- the action ID
+	//    output  -- the output ID (for hits and puts)
+	//    source  -- for a get, where it was found: "memory", "local", "peer",
+	//               "s3", or "" (a miss)
+	//    size    -- for a put, the size of the object in bytes
+	//    elapsed -- how long the operation took
+	//    err     -- the error reported by the operation, if any
+	Logger *slog.Logger
+
 	// Tracks tasks pushing cache writes to S3.
 	initOnce sync.Once
 	push     *taskgroup.Group
 	start    func(taskgroup.Task)
+	adaptive *adaptiveLimit // the limit of adaptive uploads, or nil
+	queue    *uploadQueue   // uploads waiting for a worker, or nil
+
+	mem    *cache.Cache[string, memEntry]  // recent action lookups, or nil
+	misses *cache.Cache[string, time.Time] // recent S3 misses and when they expire, or nil
+
+	recentMiss   *cache.Cache[string, struct{}]  // recent remote misses, if MinUploadSize > 0
+	missTimes    *cache.Cache[string, time.Time] // recent misses and when they occurred
+	missOnce     sync.Once
+	missByReason *expvar.Map // counts of Get misses by reason
+
+	pmu      sync.Mutex
+	pending  mapset.Set[string] // action IDs with uploads in progress
+	faulting mapset.Set[string] // action IDs with background faults in progress
+	failed   mapset.Set[string] // action IDs whose last upload failed
 
-	getLocalHit  expvar.Int // count of Get hits in the local cache
-	getFaultHit  expvar.Int // count of Get hits faulted in from S3
-	getFaultMiss expvar.Int // count of Get faults that were misses
-	putSkipSmall expvar.Int // count of "small" objects not written to S3
-	putS3Found   expvar.Int // count of objects not written to S3 because they were already present
-	putS3Action  expvar.Int // count of actions written to S3
-	putS3Object  expvar.Int // count of objects written to S3
-	putS3Error   expvar.Int // count of errors writing to S3
+	remote singleflight.Group // remote lookups in progress (see getShared)
+
+	dicts dictSet // zstd dictionaries (see TrainDictionary)
+
+	getHit          expvar.Int // count of Get hits in any tier
+	getMemoryHit    expvar.Int // count of Get hits in memory
+	getLocalHit     expvar.Int // count of Get hits in the local cache
+	getIndexHit     expvar.Int // count of Get hits in the local cache found by the HostIndex
+	getDeferred     expvar.Int // count of Get misses faulted in the background
+	getPeerHit      expvar.Int // count of Get hits faulted in from a peer
+	getPeerMiss     expvar.Int // count of Get misses (or errors) on peers
+	getFaultHit     expvar.Int // count of Get hits faulted in from S3
+	getFaultMiss    expvar.Int // count of Get faults that were misses
+	getMissCached   expvar.Int // count of Get misses remembered from an earlier fault
+	getKeyAbsent    expvar.Int // count of S3 lookups skipped because the KeyIndex does not list the action
+	getJoined       expvar.Int // count of Get requests that joined a remote lookup in progress
+	getFallbackHit  expvar.Int // count of Get hits faulted in from the Fallback
+	getPrefixHit    expvar.Int // count of Get hits faulted in from ReadPrefixes
+	getFailover     expvar.Int // count of S3 reads retried on the Replica after S3Client failed
+	getReplicaHit   expvar.Int // count of Get hits faulted in from the Replica
+	getByRegion     expvar.Map // counts of Get hits faulted in from S3, by region
+	getSkipMemory   expvar.Int // count of Get requests that skipped the memory tier
+	getSkipLocal    expvar.Int // count of Get requests that skipped the local tier
+	getSkipPeer     expvar.Int // count of Get requests that skipped the peer tier
+	getSkipS3       expvar.Int // count of Get requests that skipped the S3 tier
+	getLocalTime    expvar.Int // total microseconds Get spent on memory and the local cache
+	getPeerTime     expvar.Int // total microseconds Get spent on peers
+	getS3Time       expvar.Int // total microseconds Get spent on S3
+	getRemoteBytes  expvar.Int // total bytes of objects faulted in from peers and S3
+	getTestHit      expvar.Int // count of Get hits for test results faulted in from S3
+	getTestStale    expvar.Int // count of test results in S3 older than TestTTL
+	putSkipSmall    expvar.Int // count of "small" objects not written to S3
+	putSkipTest     expvar.Int // count of test results not written to S3 (TestLocal)
+	putSkipReadOnly expvar.Int // count of objects not written to S3 because its client is read-only
+	putLowDisk      expvar.Int // count of objects uploaded before Put returned, because the disk was low
+	putDeferred     expvar.Int // count of uploads to S3 deferred (see Deferral)
+	putDropped      expvar.Int // count of uploads to S3 dropped from a full UploadQueue
+	putBuilt        expvar.Int // count of Put requests for actions that recently missed
+	putBuildTime    expvar.Int // total microseconds between those misses and their Puts
+	putTest         expvar.Int // count of test results stored
+	putTestB        expvar.Int // total bytes of test results stored
+	putS3Found      expvar.Int // count of objects not written to S3 because they were already present
+	putS3FoundB     expvar.Int // total bytes of objects not written to S3 because they were already present
+	putS3Action     expvar.Int // count of actions written to S3
+	putS3Object     expvar.Int // count of objects written to S3
+	putS3ObjectB    expvar.Int // total bytes of objects written to S3
+	putS3Multipart  expvar.Int // count of objects written to S3 by multipart upload
+	putS3Encoded    expvar.Int // total bytes of objects written to S3 after compression
+	putS3Error      expvar.Int // count of errors writing to S3
+
+	putReplica        expvar.Int // count of entries copied to the Replica
+	putReplicaDropped expvar.Int // count of copies to the Replica dropped from a full queue
+	putReplicaError   expvar.Int // count of errors copying to the Replica
+
+	getLocalLatency  latencyHistogram // latencies of Get on memory and the local cache, by object size
+	getRemoteLatency latencyHistogram // latencies of Get on peers and S3, by object size
+	putLocalLatency  latencyHistogram // latencies of Put on the local cache, by object size
+	putRemoteLatency latencyHistogram // latencies of uploads to S3, by object size
+}
+
+// A Fallback is a location in S3 consulted by an [S3Cache] for actions that
+// are missing from its own bucket and key prefix (see [S3Cache.Fallback]).
+// Keys under the fallback prefix have the same layout, and are subject to the
+// same KeyFunc, as those of the cache.
+type Fallback struct {
+	// S3Client is the client for the fallback bucket. If nil, the fallback
+	// is in the same bucket as the cache.
+	S3Client *s3util.Client
+
+	// KeyPrefix is the key prefix of the fallback. It may be empty.
+	KeyPrefix string
 }
 
 func (s *S3Cache) init() {
 	s.initOnce.Do(func() {
-		s.push, s.start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		if s.AdaptiveUploads {
+			s.push = taskgroup.New(nil)
+			s.adaptive = newAdaptiveLimit(cmp.Or(max(s.UploadConcurrency, 0), maxAdaptiveUploads))
+			s.start = func(task taskgroup.Task) { s.adaptive.start(s.push, task) }
+		} else {
+			s.push, s.start = taskgroup.New(nil).Limit(s.uploadConcurrency())
+		}
+		if s.UploadQueue > 0 {
+			s.queue = newUploadQueue(s.start, s.UploadQueue, s.UploadDrop)
+		}
+		if s.MemoryEntries > 0 {
+			s.mem = cache.New(cache.LRU[string, memEntry](int64(s.MemoryEntries)))
+		}
+		if s.MissTTL > 0 {
+			s.misses = cache.New(cache.LRU[string, time.Time](maxMissEntries))
+		}
+		if s.MinUploadSize > 0 {
+			s.recentMiss = cache.New(cache.LRU[string, struct{}](maxRecentMisses))
+		}
+		s.missTimes = cache.New(cache.LRU[string, time.Time](maxMissTimes))
 	})
 }
 
 // Get implements the corresponding callback of the cache protocol.
-func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, _ error) {
+// It consults the tiers selected by the [ReadPolicy] attached to ctx, if any,
+// and otherwise memory, the local cache, peers, and S3 in that order.
+//
+// If ctx ends while Get is reading from a peer or S3, the read stops, and Get
+// reports the cause of ctx as an error. Unless BackgroundFault is set, Get
+// starts no remote work that outlives its request.
+func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID, diskPath string, oerr error) {
 	s.init()
+	if c := s.route(actionID); c != s {
+		return c.Get(ctx, actionID)
+	}
+	start := time.Now()
+	var source string // where a hit was found
+	var localTried, remoteTried bool
+	missReason := MissNotLocal
+	t := new(opTiming)
+	defer func() {
+		if oerr != nil {
+			missReason = MissError
+		}
+		s.countGet(outputID != "", missReason)
+		size := int64(-1) // unknown for a miss
+		if outputID != "" {
+			size = fileSize(diskPath)
+		} else if oerr == nil {
+			s.noteMiss(actionID)
+		}
+		if (source == "peer" || source == "s3") && size > 0 {
+			s.getRemoteBytes.Add(size)
+		}
+		if localTried {
+			if source == "memory" || source == "local" {
+				s.getLocalLatency.observe(size, t.disk)
+			} else {
+				s.getLocalLatency.observe(-1, t.disk)
+			}
+		}
+		if remoteTried {
+			s.getRemoteLatency.observe(size, t.peer+t.s3)
+		}
+		s.logger().Debug("get", "action", actionID, "output", outputID, "source", source,
+			"elapsed", time.Since(start), "err", oerr)
+		s.slowLog(SlowOp{Op: "get", ActionID: actionID, OutputID: outputID, Source: source}, start, t, oerr)
+		s.getLocalTime.Add(t.disk.Microseconds())
+		s.getPeerTime.Add(t.peer.Microseconds())
+		s.getS3Time.Add(t.s3.Microseconds())
+	}()
 
-	objID, diskPath, err := s.Local.Get(ctx, actionID)
-	if err == nil && objID != "" && diskPath != "" {
-		s.getLocalHit.Add(1)
-		return objID, diskPath, nil // cache hit, OK
+	local, remote := s.readTiers(ctx)
+	localTried = len(local) != 0
+	for _, tier := range local {
+		lstart := time.Now()
+		switch tier {
+		case TierMemory:
+			// Check for a recent lookup of this action in memory.
+			e, ok := s.memGet(actionID)
+			since(&t.disk, lstart)
+			if ok {
+				s.getMemoryHit.Add(1)
+				source = "memory"
+				s.audit(ctx, actionID, e.outputID, e.diskPath, "local", "")
+				return e.outputID, e.diskPath, nil // cache hit, OK
+			}
+		case TierLocal:
+			if objID, diskPath, ok := s.indexGet(actionID); ok {
+				since(&t.disk, lstart)
+				s.Spill.touch(actionID)
+				s.getIndexHit.Add(1)
+				s.getLocalHit.Add(1)
+				source = "local"
+				s.memPut(actionID, objID, diskPath)
+				s.audit(ctx, actionID, objID, diskPath, "local", "")
+				return objID, diskPath, nil // cache hit, OK
+			}
+			objID, diskPath, err := s.Local.Get(ctx, actionID)
+			if err == nil && objID != "" && diskPath != "" {
+				s.Spill.touch(actionID)
+			} else {
+				objID, diskPath, _ = s.Spill.get(ctx, s, actionID)
+			}
+			since(&t.disk, lstart)
+			if objID != "" && diskPath != "" {
+				s.getLocalHit.Add(1)
+				source = "local"
+				s.memPut(actionID, objID, diskPath)
+				s.audit(ctx, actionID, objID, diskPath, "local", "")
+				return objID, diskPath, nil // cache hit, OK
+			}
+		}
 	}
 
 	// Reaching here, either we got a cache miss or an error reading from local.
-	// Try reading the action from S3.
-	action, err := s.S3Client.GetData(ctx, s.actionKey(actionID))
+	// If remote lookups are deferred, report a miss now and look in the
+	// background, so that a later request may find it locally.
+	if len(remote) == 0 {
+		return "", "", nil // cache miss, OK
+	} else if s.DiskWatch.Low() {
+		missReason = MissLowDisk
+		return "", "", nil // no room to fault it in, OK
+	} else if s.BackgroundFault {
+		s.faultBackground(ctx, actionID, remote)
+		return "", "", nil // cache miss, OK
+	}
+	remoteTried = true
+	hit, err := s.getShared(ctx, actionID, remote, t)
+	if err != nil || hit.outputID == "" {
+		missReason = MissNotRemote
+		if hit.expired {
+			missReason = MissExpired
+		}
+		if err == nil {
+			s.noteRemoteMiss(actionID)
+		}
+		return "", "", err
+	}
+	source = hit.source
+	s.memPut(actionID, hit.outputID, hit.diskPath)
+	s.audit(ctx, actionID, hit.outputID, hit.diskPath, hit.source, hit.origin)
+	return hit.outputID, hit.diskPath, nil
+}
+
+// remoteHit describes an action faulted in to the local cache from a peer or
+// from S3.
+type remoteHit struct {
+	outputID, diskPath string
+	source             string // "peer" or "s3"
+	origin             string // the peer address or S3 object URL
+
+	// For a miss, whether the action was found in S3 without its object.
+	expired bool
+}
+
+// getRemote attempts to fault actionID in to the local cache from the given
+// remote tiers in order, adding the time spent on each to t. If the action is
+// not found, it returns a remoteHit without an output ID and without error.
+func (s *S3Cache) getRemote(ctx context.Context, actionID string, tiers []string, t *opTiming) (remoteHit, error) {
+	var miss remoteHit
+	for _, tier := range tiers {
+		if ctx.Err() != nil {
+			return remoteHit{}, context.Cause(ctx) // the request was abandoned
+		}
+		switch tier {
+		case TierPeer:
+			// If we have peers, see whether any of them has it.
+			if s.Peers == nil {
+				continue
+			}
+			pstart := time.Now()
+			hit, ok := s.getPeer(ctx, actionID)
+			since(&t.peer, pstart)
+			if ok {
+				return hit, nil
+			}
+		case TierS3:
+			hit, err := s.getS3(ctx, actionID, t)
+			if err != nil || hit.outputID != "" {
+				return hit, err
+			}
+			miss = hit
+		}
+	}
+	return miss, nil // cache miss, OK
+}
+
+// getShared is getRemote, except that concurrent lookups of the same action in
+// the same tiers share one lookup, so that when many builds miss on an action
+// at once, it is faulted in only once. The shared lookup runs in the context
+// of the request that started it; if that request is abandoned before the
+// lookup completes, the requests that joined it start another.
+func (s *S3Cache) getShared(ctx context.Context, actionID string, tiers []string, t *opTiming) (remoteHit, error) {
+	key := missKey(ctx, actionID) + " " + strings.Join(tiers, ",")
+	for {
+		var led bool
+		ch := s.remote.DoChan(key, func() (any, error) {
+			led = true
+			st := new(opTiming)
+			hit, err := s.getRemote(ctx, actionID, tiers, st)
+			return sharedHit{hit, st}, err
+		})
+		var res singleflight.Result
+		select {
+		case <-ctx.Done():
+			return remoteHit{}, context.Cause(ctx) // the request was abandoned
+		case res = <-ch:
+		}
+		if !led {
+			if res.Err != nil && (errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+				continue // the request that started the lookup was abandoned
+			}
+			s.getJoined.Add(1)
+		}
+		sh := res.Val.(sharedHit)
+		t.peer += sh.timing.peer
+		t.s3 += sh.timing.s3
+		return sh.hit, res.Err
+	}
+}
+
+// A sharedHit is the result of a lookup shared by getShared.
+type sharedHit struct {
+	hit    remoteHit
+	timing *opTiming
+}
+
+// getS3 attempts to fault actionID in to the local cache from S3, looking in
+// each namespace of the chain attached to ctx in order, or from ReadPrefixes
+// and the Fallback if it is missing there, adding the time spent to t. If the action is not
+// found, it returns a remoteHit without an output ID and without error.
+func (s *S3Cache) getS3(ctx context.Context, actionID string, t *opTiming) (remoteHit, error) {
+	defer since(&t.s3, time.Now())
+	mkey := missKey(ctx, actionID)
+	if s.missCached(mkey) {
+		s.getMissCached.Add(1)
+		return remoteHit{}, nil // cache miss, OK
+	}
+
+	var expired bool
+	for _, ns := range namespaces(ctx) {
+		hit, err := s.getS3Failover(ctx, s.actionPrefix(ns), s.KeyPrefix, actionID)
+		if err != nil || hit.outputID != "" {
+			return hit, err
+		}
+		expired = expired || hit.expired
+	}
+	for _, pfx := range s.ReadPrefixes {
+		hit, err := s.getS3Failover(ctx, pfx, pfx, actionID)
+		if hit.outputID != "" {
+			s.getPrefixHit.Add(1)
+		}
+		if err != nil || hit.outputID != "" {
+			return hit, err
+		}
+		expired = expired || hit.expired
+	}
+	if fb := s.Fallback; fb != nil {
+		hit, err := s.getS3From(ctx, cmp.Or(fb.S3Client, s.S3Client), fb.KeyPrefix, fb.KeyPrefix, actionID)
+		if hit.outputID != "" {
+			s.getFallbackHit.Add(1)
+		}
+		if err != nil || hit.outputID != "" {
+			return hit, err
+		}
+		expired = expired || hit.expired
+	}
+	s.getFaultMiss.Add(1)
+	s.missPut(mkey)
+	return remoteHit{expired: expired}, nil // cache miss, OK
+}
+
+// maxMissEntries is the maximum number of S3 misses remembered when MissTTL
+// is set. It bounds memory use; older misses are forgotten first.
+const maxMissEntries = 1 << 16
+
+// missCached reports whether the action with the given miss key (see missKey)
+// was recently found missing from S3.
+func (s *S3Cache) missCached(key string) bool {
+	if s.misses == nil {
+		return false
+	}
+	exp, ok := s.misses.Get(key)
+	if ok && time.Now().After(exp) {
+		s.misses.Remove(key)
+		return false
+	}
+	return ok
+}
+
+// missPut remembers that the action with the given miss key is missing from
+// S3, if that is enabled.
+func (s *S3Cache) missPut(key string) {
+	if s.misses != nil {
+		s.misses.Put(key, time.Now().Add(s.MissTTL))
+	}
+}
+
+// getS3From attempts to fault actionID in to the local cache from the bucket
+// of client, reading the action under actionPrefix and its object under
+// outputPrefix. If the action is not found, it returns a remoteHit without an
+// output ID and without error.
+func (s *S3Cache) getS3From(ctx context.Context, client *s3util.Client, actionPrefix, outputPrefix, actionID string) (remoteHit, error) {
+	// Try reading the action from S3, unless it is known to be absent.
+	actionKey := s.keyIn(actionPrefix, "action", actionID)
+	if client == s.S3Client && s.KeyIndex.absent(actionKey) {
+		s.getKeyAbsent.Add(1)
+		return remoteHit{}, nil // cache miss, OK
+	}
+	astart := time.Now()
+	action, err := client.GetData(ctx, actionKey)
+	if client == s.S3Client {
+		s.Replica.observe(time.Since(astart), err)
+	}
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			s.getFaultMiss.Add(1)
-			return "", "", nil // cache miss, OK
+			return remoteHit{}, nil // cache miss, OK
 		}
-		return "", "", fmt.Errorf("[s3] read action %s: %w", actionID, err)
+		return remoteHit{}, fmt.Errorf("[s3] read action %s: %w", actionID, err)
 	}
 
 	// We got an action hit remotely, try to update the local copy.
-	outputID, mtime, err := parseAction(action)
+	rec, err := parseAction(action)
 	if err != nil {
-		return "", "", err
+		return remoteHit{}, err
+	}
+	outputID := rec.outputID
+	if rec.kind == "test" && s.TestTTL > 0 && time.Since(rec.mtime) > s.TestTTL {
+		s.getTestStale.Add(1)
+		return remoteHit{expired: true}, nil // cache miss, OK
 	}
 
-	object, size, err := s.S3Client.Get(ctx, s.outputKey(outputID))
-	if err != nil {
+	outputKey := s.recordKey(outputPrefix, rec)
+	object, size, err := client.Get(ctx, outputKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The action exists, but its object is gone, for example removed by
+		// a lifecycle rule on the bucket. Nothing can be read, so report it
+		// as a miss, and rewrite both when the action is stored again.
+		return remoteHit{expired: true}, nil // cache miss, OK
+	} else if err != nil {
 		// At this point we know the action exists, so if we can't read the
 		// object report it as an error rather than a cache miss.
-		return "", "", fmt.Errorf("[s3] read object %s: %w", outputID, err)
+		return remoteHit{}, fmt.Errorf("[s3] read object %s: %w", outputID, err)
+	}
+	if rec.codec != "" {
+		object, err = s.decodeObject(ctx, object, rec.codec)
+		if err != nil {
+			return remoteHit{}, fmt.Errorf("[s3] decode object %s: %w", outputID, err)
+		}
+		size = -1 // not known until decoded
 	}
 	defer object.Close()
 	s.getFaultHit.Add(1)
+	if rec.kind == "test" {
+		s.getTestHit.Add(1)
+	}
 
 	// Now we should have the body; poke it into the local cache.  Preserve the
 	// modification timestamp recorded with the original action.
-	diskPath, err = s.Local.Put(ctx, gocache.Object{
+	diskPath, err := s.Local.Put(ctx, gocache.Object{
 		ActionID: actionID,
 		OutputID: outputID,
 		Size:     size,
 		Body:     object,
-		ModTime:  mtime,
+		ModTime:  rec.mtime,
 	})
-	return outputID, diskPath, err
+	if err != nil {
+		return remoteHit{}, err
+	}
+	return remoteHit{
+		outputID: outputID,
+		diskPath: diskPath,
+		source:   "s3",
+		origin:   "s3://" + client.Bucket + "/" + outputKey,
+	}, nil
+}
+
+// faultBackground starts a background task to fault actionID in to the local
+// cache from the given remote tiers, unless one is already in progress.
+func (s *S3Cache) faultBackground(ctx context.Context, actionID string, tiers []string) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if s.faulting.Has(actionID) {
+		return
+	}
+	s.faulting.Add(actionID)
+	s.getDeferred.Add(1)
+	s.start(func() error {
+		defer func() {
+			s.pmu.Lock()
+			defer s.pmu.Unlock()
+			s.faulting.Remove(actionID)
+		}()
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
+		defer cancel()
+		if _, err := s.getShared(sctx, actionID, tiers, new(opTiming)); err != nil {
+			s.logger().Warn("background fault failed", "action", actionID, "err", err)
+		}
+		return nil
+	})
+}
+
+// getPeer attempts to fetch actionID from a peer into the local cache, and
+// reports whether it succeeded.
+func (s *S3Cache) getPeer(ctx context.Context, actionID string) (remoteHit, bool) {
+	obj, err := s.Peers.Get(ctx, actionID)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && ctx.Err() == nil {
+			s.logger().Warn("peer get failed", "action", actionID, "err", err)
+		}
+		s.getPeerMiss.Add(1)
+		return remoteHit{}, false
+	}
+	defer obj.Body.Close()
+
+	// The body reports an error at the end if it does not match the output ID
+	// and size, so a corrupt or forged object fails the Put and is not stored.
+	diskPath, err := s.Local.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: obj.OutputID,
+		Size:     obj.Size,
+		Body:     obj.Body,
+		ModTime:  obj.ModTime,
+	})
+	if err != nil {
+		s.logger().Warn("peer store failed", "action", actionID, "peer", obj.Peer, "err", err)
+		s.getPeerMiss.Add(1)
+		return remoteHit{}, false
+	}
+	s.getPeerHit.Add(1)
+	return remoteHit{outputID: obj.OutputID, diskPath: diskPath, source: "peer", origin: obj.Peer}, true
+}
+
+// indexGet reports whether actionID is listed in the HostIndex with an object
+// that is still present in the local cache, and if so returns it.
+func (s *S3Cache) indexGet(actionID string) (outputID, diskPath string, ok bool) {
+	if s.HostIndex == nil {
+		return "", "", false
+	}
+	outputID, size, ok := s.HostIndex.Lookup(actionID)
+	if !ok {
+		return "", "", false
+	}
+	diskPath = s.HostIndex.OutputPath(outputID)
+	if fi, err := os.Stat(diskPath); err != nil || fi.Size() != size {
+		return "", "", false // pruned or replaced since the snapshot
+	}
+	return outputID, diskPath, true
+}
+
+// memEntry is an action lookup retained in memory.
+type memEntry struct{ outputID, diskPath string }
+
+// memGet reports whether a lookup of actionID is retained in memory, and if so
+// returns it. Entries whose object file has been removed are discarded.
+func (s *S3Cache) memGet(actionID string) (memEntry, bool) {
+	if s.mem == nil {
+		return memEntry{}, false
+	}
+	e, ok := s.mem.Get(actionID)
+	if !ok {
+		return memEntry{}, false
+	} else if _, err := os.Stat(e.diskPath); err != nil {
+		s.mem.Remove(actionID) // pruned from the local cache
+		return memEntry{}, false
+	}
+	return e, true
+}
+
+// memPut retains a lookup of actionID in memory, if that is enabled.
+func (s *S3Cache) memPut(actionID, outputID, diskPath string) {
+	if s.mem != nil {
+		s.mem.Put(actionID, memEntry{outputID: outputID, diskPath: diskPath})
+	}
 }
 
 // Put implements the corresponding callback of the cache protocol.
-func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, _ error) {
+func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string, oerr error) {
 	s.init()
+	if c := s.route(obj.ActionID); c != s {
+		return c.Put(ctx, obj)
+	}
+	start := time.Now()
+	t := new(opTiming)
+	uploading := false // if true, the upload records the slow log entry
+	slowOp := SlowOp{Op: "put", ActionID: obj.ActionID, OutputID: obj.OutputID, Size: obj.Size}
+	defer func() {
+		s.logger().Debug("put", "action", obj.ActionID, "output", obj.OutputID, "size", obj.Size,
+			"elapsed", time.Since(start), "err", oerr)
+		if !uploading {
+			s.slowLog(slowOp, start, t, oerr)
+		}
+	}()
 
 	// Compute an etag so we can do a conditional put on the object data.
 	// We do not rely on it as a secure checksum. The toolchain verifies the
@@ -152,70 +860,438 @@ func (s *S3Cache) Put(ctx context.Context, obj gocache.Object) (diskPath string,
 	obj.Body = etr
 
 	diskPath, err := s.Local.Put(ctx, obj)
+	since(&t.disk, start)
+	s.putLocalLatency.observe(obj.Size, t.disk)
 	if err != nil {
-		return "", err // don't bother trying to forward it to the remote
+		s.DiskWatch.Kick() // in case the disk is full
+		return "", err     // don't bother trying to forward it to the remote
+	}
+	s.memPut(obj.ActionID, obj.OutputID, diskPath)
+	if s.misses != nil {
+		s.misses.Remove(missKey(ctx, obj.ActionID))
+	}
+	s.notePut(obj.ActionID, obj.Size)
+	s.noteBuilt(obj.ActionID)
+	test := isTestResult(diskPath, obj.Size)
+	if test {
+		s.putTest.Add(1)
+		s.putTestB.Add(obj.Size)
 	}
 	if obj.Size < s.MinUploadSize {
 		s.putSkipSmall.Add(1)
+		countUpload(ctx, func(c *UploadCounts) { c.Small++ })
 		return diskPath, nil // don't bother uploading this, it's too small
+	} else if test && s.TestResults == TestLocal {
+		s.putSkipTest.Add(1)
+		return diskPath, nil // test results stay local
+	} else if s.S3Client.ReadOnly {
+		s.putSkipReadOnly.Add(1)
+		return diskPath, nil // the bucket is not written
+	}
+	kind := s.objectKind(test)
+	if d := deferral(ctx); d != nil {
+		d.add(ctx, obj.ActionID)
+		s.putDeferred.Add(1)
+		return diskPath, nil // uploaded by Commit, if the build succeeds
 	}
 
-	// Try to push the record to S3 in the background.
-	s.start(func() error {
+	// Try to push the record to S3 in the background. The journal and the
+	// pending and failed sets are replayed to the root namespace, so uploads
+	// to other namespaces are not tracked there.
+	tracked := !namespaced(ctx)
+	if tracked {
+		s.Journal.record("+", obj.ActionID)
+		s.setPending(obj.ActionID, true)
+	}
+	uploading = true
+	queued := time.Now()
+	drop := func() {
+		s.putDropped.Add(1)
+		if tracked {
+			s.setFailed(obj.ActionID, true)
+			s.setPending(obj.ActionID, false)
+		}
+		s.logger().Debug("upload dropped, queue full", "action", obj.ActionID)
+		s.slowLog(slowOp, start, t, errUploadDropped)
+	}
+	upload := func() (err error) {
+		defer func() {
+			if !tracked {
+				return
+			}
+			if err == nil {
+				s.Journal.record("-", obj.ActionID)
+			}
+			s.setFailed(obj.ActionID, err != nil)
+			s.setPending(obj.ActionID, false)
+		}()
+		ustart := since(&t.queue, queued)
+		defer func() {
+			s.putRemoteLatency.observe(obj.Size, time.Since(ustart))
+			since(&t.s3, ustart)
+			s.slowLog(slowOp, start, t, err)
+		}()
+
 		// Override the context with a separate timeout in case S3 is farkakte.
 		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 1*time.Minute)
 		defer cancel()
 
 		// Stage 1: Maybe write the object. Do this before writing the action
 		// record so we are less likely to get a spurious miss later.
-		mtime, err := s.maybePutObject(sctx, obj.OutputID, diskPath, etr.ETag())
+		mtime, err := s.maybePutObject(sctx, kind, obj.OutputID, diskPath, etr.ETag())
 		if err != nil {
 			return err
 		}
 
 		// Stage 2: Write the action record.
-		if err := s.S3Client.Put(ctx, s.actionKey(obj.ActionID),
-			strings.NewReader(fmt.Sprintf("%s %d", obj.OutputID, mtime.UnixNano()))); err != nil {
-			gocache.Logf(ctx, "write action %s: %v", obj.ActionID, err)
+		return s.putAction(sctx, obj.ActionID, kind, obj.OutputID, mtime)
+	}
+	if s.DiskWatch.Low() {
+		// Upload now, so the local copy may be evicted as soon as we return.
+		s.putLowDisk.Add(1)
+		upload()
+		return diskPath, nil
+	}
+	s.enqueue(upload, drop)
+	return diskPath, nil
+}
+
+// putAction writes an action record to S3 for the specified action, in the
+// first namespace of the chain attached to ctx. The record of an object of a
+// kind other than "output" is marked with its kind, and the record of a
+// compressed object with its codec. The write is recorded in the
+// audit log attached to ctx, if any.
+func (s *S3Cache) putAction(ctx context.Context, actionID, kind, outputID string, mtime time.Time) error {
+	record := fmt.Sprintf("%s %d", outputID, mtime.UnixNano())
+	if kind != "output" {
+		record += " " + kind
+	}
+	if c := s.writeCodec(); c != "" {
+		record += " " + c
+	}
+	key := s.writeActionKey(ctx, actionID)
+	if err := s.S3Client.Put(ctx, key, strings.NewReader(record)); err != nil {
+		s.logger().Warn("s3 write action failed", "action", actionID, "err", err)
+		return err
+	}
+	s.KeyIndex.add(key)
+	s.putS3Action.Add(1)
+	s.replicate(actionID, key, s.recordKey(s.KeyPrefix, actionRecord{outputID: outputID, kind: kind, codec: s.writeCodec()}))
+	auditlog.Record(ctx, auditlog.Entry{Kind: auditlog.KindWrite, Name: actionID, Object: outputID})
+	return nil
+}
+
+// SyncStats report the results of a call to [S3Cache.Sync].
+type SyncStats struct {
+	Actions int           // the number of local actions examined
+	Synced  int           // the number of actions written to S3
+	Skipped int           // the number of actions skipped as too small, or as local test results
+	Errors  int           // the number of actions that could not be written
+	Elapsed time.Duration // how long the sync took
+}
+
+// Sync writes to S3 each action and object stored in the local cache
+// directory rooted at root, which must be the directory managed by s.Local.
+// Objects already present in S3 with matching content are not rewritten.
+// Sync is meant to repair the remote cache after uploads were lost, and runs
+// concurrently with ordinary cache operations.
+func (s *S3Cache) Sync(ctx context.Context, root string) (SyncStats, error) {
+	return s.syncEach(ctx, root, func(visit func(string) error) error {
+		err := filepath.WalkDir(filepath.Join(root, "action"), func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if !de.Type().IsRegular() {
+				return nil
+			}
+			return visit(de.Name())
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // no actions have been stored yet
+		}
+		return err
+	})
+}
+
+// SyncActions is like [S3Cache.Sync], but writes only the specified actions.
+// Actions that are not present in the local cache are ignored.
+func (s *S3Cache) SyncActions(ctx context.Context, root string, actionIDs []string) (SyncStats, error) {
+	return s.syncEach(ctx, root, func(visit func(string) error) error {
+		for _, id := range actionIDs {
+			if err := visit(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// syncEach calls each with a visitor that writes the specified action and its
+// object from the local cache at root to S3, and reports the results.
+func (s *S3Cache) syncEach(ctx context.Context, root string, each func(visit func(actionID string) error) error) (SyncStats, error) {
+	s.init()
+	start := time.Now()
+
+	var mu sync.Mutex
+	var stats SyncStats
+	count := func(p *int) { mu.Lock(); defer mu.Unlock(); *p++ }
+
+	g, run := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	werr := each(func(actionID string) error {
+		if err := ctx.Err(); err != nil {
 			return err
+		} else if len(actionID) < 2 {
+			return nil // not a valid action ID
+		}
+		c := s.route(actionID) // the cache whose settings apply to this action
+		outputID, size, err := readLocalAction(filepath.Join(root, "action", actionID[:2], actionID))
+		if err != nil {
+			s.logger().Info("sync: skip action", "action", actionID, "err", err)
+			s.Journal.record("-", actionID)
+			return nil // skip missing or invalid actions
+		}
+		count(&stats.Actions)
+		if size < c.MinUploadSize {
+			s.Journal.record("-", actionID)
+			count(&stats.Skipped)
+			return nil
 		}
-		s.putS3Action.Add(1)
+		objPath := filepath.Join(root, "output", outputID[:2], outputID)
+		test := isTestResult(objPath, size)
+		if test && c.TestResults == TestLocal {
+			s.Journal.record("-", actionID)
+			count(&stats.Skipped)
+			return nil
+		}
+		run(func() error {
+			kind := c.objectKind(test)
+			etag, err := fileETag(objPath)
+			if err == nil {
+				var mtime time.Time
+				mtime, err = c.maybePutObject(ctx, kind, outputID, objPath, etag)
+				if err == nil {
+					err = c.putAction(ctx, actionID, kind, outputID, mtime)
+				}
+			}
+			c.setFailed(actionID, err != nil)
+			if err != nil {
+				count(&stats.Errors)
+			} else {
+				s.Journal.record("-", actionID)
+				count(&stats.Synced)
+			}
+			return nil
+		})
 		return nil
 	})
+	g.Wait()
+	stats.Elapsed = time.Since(start)
+	return stats, werr
+}
 
-	return diskPath, nil
+// readLocalAction reads the output ID and size from a local action file,
+// in the format written by [cachedir.Dir].
+func readLocalAction(path string) (outputID string, size int64, _ error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	fs := strings.Fields(string(data))
+	if len(fs) != 2 || len(fs[0]) < 2 {
+		return "", 0, errors.New("invalid action file")
+	}
+	size, err = strconv.ParseInt(fs[1], 10, 64)
+	return fs[0], size, err
+}
+
+// fileETag computes the S3 ETag of the contents of the file at path.
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	etr := s3util.NewETagReader(f)
+	if _, err := io.Copy(io.Discard, etr); err != nil {
+		return "", err
+	}
+	return etr.ETag(), nil
 }
 
-// Close implements the corresponding callback of the cache protocol.
+// Close implements the corresponding callback of the cache protocol. It waits
+// for uploads in progress to complete, or until ctx ends; uploads that have
+// not completed by then are reported by PendingActions.
 func (s *S3Cache) Close(ctx context.Context) error {
 	if s.push != nil {
-		gocache.Logf(ctx, "waiting for uploads...")
+		s.logger().Info("waiting for uploads...")
 		wstart := time.Now()
-		s.push.Wait()
-		gocache.Logf(ctx, "uploads complete (%v elapsed)", time.Since(wstart).Round(10*time.Microsecond))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if s.queue != nil {
+				s.queue.wait()
+			}
+			s.push.Wait()
+		}()
+		select {
+		case <-done:
+			s.logger().Info("uploads complete", "elapsed", time.Since(wstart).Round(10*time.Microsecond))
+		case <-ctx.Done():
+			s.logger().Info("stopped waiting for uploads", "elapsed", time.Since(wstart).Round(10*time.Microsecond))
+		}
+	}
+	if s.Replica != nil {
+		if err := s.Replica.wait(ctx); err != nil {
+			s.logger().Info("stopped waiting for replica copies")
+		}
+	}
+	if s.Canary != nil {
+		return s.Canary.Cache.Close(ctx)
 	}
 	return nil
 }
 
+// PendingActions returns the IDs of actions whose uploads to S3 have been
+// started but have not yet completed, in no particular order. These include
+// the actions of the Canary, if any.
+func (s *S3Cache) PendingActions() []string {
+	var alt []string
+	if s.Canary != nil {
+		alt = s.Canary.Cache.PendingActions()
+	}
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	return append(s.pending.Slice(), alt...)
+}
+
+func (s *S3Cache) setPending(actionID string, pending bool) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if pending {
+		s.pending.Add(actionID)
+	} else {
+		s.pending.Remove(actionID)
+	}
+}
+
+// FailedActions returns the IDs of actions whose most recent upload to S3,
+// by Put or by a sync, failed, in no particular order. An action is removed
+// from the list once it has been uploaded successfully. These include the
+// actions of the Canary, if any.
+func (s *S3Cache) FailedActions() []string {
+	var alt []string
+	if s.Canary != nil {
+		alt = s.Canary.Cache.FailedActions()
+	}
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	return append(s.failed.Slice(), alt...)
+}
+
+func (s *S3Cache) setFailed(actionID string, failed bool) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if failed {
+		s.failed.Add(actionID)
+	} else {
+		s.failed.Remove(actionID)
+	}
+}
+
+// Flush blocks until all pending writes to S3 have completed, or until ctx
+// ends. Unlike Close, the cache remains usable after Flush returns.
+func (s *S3Cache) Flush(ctx context.Context) error {
+	s.init()
+	done := make(chan struct{})
+	go func() { defer close(done); s.push.Wait() }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
 // SetMetrics implements the corresponding server callback.
 func (s *S3Cache) SetMetrics(_ context.Context, m *expvar.Map) {
+	m.Set("get_hit", &s.getHit)
+	m.Set("get_hit_ratio", expvar.Func(func() any { return s.GetStats().HitRatio() }))
+	s.missReasons().Do(func(kv expvar.KeyValue) { m.Set("get_miss_"+kv.Key, kv.Value) })
+	m.Set("get_memory_hit", &s.getMemoryHit)
 	m.Set("get_local_hit", &s.getLocalHit)
+	m.Set("get_index_hit", &s.getIndexHit)
+	m.Set("get_deferred", &s.getDeferred)
 	m.Set("get_fault_hit", &s.getFaultHit)
 	m.Set("get_fault_miss", &s.getFaultMiss)
+	m.Set("get_miss_cached", &s.getMissCached)
+	m.Set("get_key_absent", &s.getKeyAbsent)
+	m.Set("get_joined", &s.getJoined)
+	m.Set("get_fallback_hit", &s.getFallbackHit)
+	m.Set("get_prefix_hit", &s.getPrefixHit)
+	m.Set("get_failover", &s.getFailover)
+	m.Set("get_replica_hit", &s.getReplicaHit)
+	m.Set("get_peer_hit", &s.getPeerHit)
+	m.Set("get_peer_miss", &s.getPeerMiss)
+	m.Set("get_skip_memory", &s.getSkipMemory)
+	m.Set("get_skip_local", &s.getSkipLocal)
+	m.Set("get_skip_peer", &s.getSkipPeer)
+	m.Set("get_skip_s3", &s.getSkipS3)
+	m.Set("get_local_us", &s.getLocalTime)
+	m.Set("get_peer_us", &s.getPeerTime)
+	m.Set("get_s3_us", &s.getS3Time)
+	m.Set("get_remote_bytes", &s.getRemoteBytes)
+	m.Set("get_local_latency", &s.getLocalLatency)
+	m.Set("get_remote_latency", &s.getRemoteLatency)
+	m.Set("put_local_latency", &s.putLocalLatency)
+	m.Set("put_remote_latency", &s.putRemoteLatency)
+	m.Set("get_test_hit", &s.getTestHit)
+	m.Set("get_test_stale", &s.getTestStale)
 	m.Set("put_skip_small", &s.putSkipSmall)
+	m.Set("put_skip_test", &s.putSkipTest)
+	m.Set("put_skip_readonly", &s.putSkipReadOnly)
+	m.Set("put_low_disk", &s.putLowDisk)
+	m.Set("put_deferred", &s.putDeferred)
+	m.Set("put_dropped", &s.putDropped)
+	m.Set("put_built", &s.putBuilt)
+	m.Set("put_build_us", &s.putBuildTime)
+	m.Set("put_queue_depth", s.QueueDepth())
+	m.Set("put_queue_lag_seconds", s.QueueLag())
+	m.Set("put_upload_limit", expvar.Func(func() any {
+		if s.init(); s.adaptive != nil {
+			return s.adaptive.current()
+		}
+		return s.uploadConcurrency()
+	}))
+	m.Set("put_test", &s.putTest)
+	m.Set("put_test_bytes", &s.putTestB)
 	m.Set("put_s3_found", &s.putS3Found)
+	m.Set("put_s3_found_bytes", &s.putS3FoundB)
 	m.Set("put_s3_action", &s.putS3Action)
 	m.Set("put_s3_object", &s.putS3Object)
+	m.Set("put_s3_object_bytes", &s.putS3ObjectB)
+	m.Set("put_s3_dedup_ratio", expvar.Func(func() any {
+		found, written := s.putS3Found.Value(), s.putS3Object.Value()
+		if found+written == 0 {
+			return 0.0
+		}
+		return float64(found) / float64(found+written)
+	}))
+	m.Set("put_s3_multipart", &s.putS3Multipart)
+	m.Set("put_s3_encoded_bytes", &s.putS3Encoded)
 	m.Set("put_s3_error", &s.putS3Error)
+	m.Set("put_replica", &s.putReplica)
+	m.Set("put_replica_dropped", &s.putReplicaDropped)
+	m.Set("put_replica_error", &s.putReplicaError)
 }
 
-// maybePutObject writes the specified object contents to S3 if there is not
-// already a matching key with the same etag. It returns the modified time of
-// the object file, whether or not it was sent to S3.
-func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag string) (time.Time, error) {
+// maybePutObject writes the specified object contents to S3, under the key
+// of the given kind, if there is not already a matching key with the same
+// etag (or for a compressed object, any object under its key). It returns the
+// modified time of the object file, whether or not it was sent to S3. The
+// outcome is counted in the upload stats attached to ctx, if any.
+func (s *S3Cache) maybePutObject(ctx context.Context, kind, outputID, diskPath, etag string) (time.Time, error) {
 	f, err := os.Open(diskPath)
 	if err != nil {
-		gocache.Logf(ctx, "[s3] open local object %s: %v", outputID, err)
+		s.logger().Warn("open local object failed", "output", outputID, "err", err)
 		return time.Time{}, err
 	}
 	defer f.Close()
@@ -224,28 +1300,103 @@ func (s *S3Cache) maybePutObject(ctx context.Context, outputID, diskPath, etag s
 		return time.Time{}, err
 	}
 
-	written, err := s.S3Client.PutCond(ctx, s.outputKey(outputID), etag, f)
+	var written bool
+	if c := s.writeCodec(); c != "" {
+		written, err = s.putEncoded(ctx, c, s.objectKey(kind, outputID), f)
+	} else if s.MultipartThreshold > 0 && fi.Size() >= s.MultipartThreshold {
+		written, err = s.S3Client.PutMultipartCond(ctx, s.objectKey(kind, outputID), f, fi.Size(), s.Multipart)
+		if written && err == nil {
+			s.putS3Multipart.Add(1)
+		}
+	} else {
+		written, err = s.S3Client.PutCond(ctx, s.objectKey(kind, outputID), etag, f)
+	}
 	if err != nil {
 		s.putS3Error.Add(1)
-		gocache.Logf(ctx, "[s3] put object %s: %v", outputID, err)
+		countUpload(ctx, func(c *UploadCounts) { c.Errors++ })
+		s.logger().Warn("s3 put object failed", "output", outputID, "err", err)
 		return fi.ModTime(), err
 	}
-	if written {
+	if !written {
 		s.putS3Found.Add(1)
+		s.putS3FoundB.Add(fi.Size())
+		countUpload(ctx, func(c *UploadCounts) { c.Found++; c.FoundBytes += fi.Size() })
 		return fi.ModTime(), nil // already present and matching
 	}
 	s.putS3Object.Add(1)
+	s.putS3ObjectB.Add(fi.Size())
+	countUpload(ctx, func(c *UploadCounts) { c.Uploaded++; c.UploadedBytes += fi.Size() })
 	return fi.ModTime(), nil
 }
 
-// makeKey assembles a complete key from the specified parts, including the key
-// prefix if one is defined.
-func (s *S3Cache) makeKey(parts ...string) string {
-	return path.Join(s.KeyPrefix, path.Join(parts...))
+// putEncoded writes the contents of f to S3 compressed with the named codec,
+// under the key of that codec for key, if no object is present there. Since
+// objects are content addresses, an object present under the key has the same
+// contents; its compressed form may differ, as between encoder versions, so it
+// is not compared. The compressed object is staged in a temporary file, so
+// that its size is known for the upload.
+func (s *S3Cache) putEncoded(ctx context.Context, name, key string, f *os.File) (written bool, _ error) {
+	key = codecKey(key, name)
+	if ok, err := s.S3Client.Exists(ctx, key); err != nil {
+		return false, err
+	} else if ok {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp("", "gocache-encode-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var dict []byte
+	if name == CodecZstd {
+		dict = s.encoderDict(ctx)
+	}
+	w, err := codecs[name].newWriter(tmp, dict)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return false, fmt.Errorf("compress: %w", err)
+	} else if err := w.Close(); err != nil {
+		return false, fmt.Errorf("compress: %w", err)
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if s.MultipartThreshold > 0 && fi.Size() >= s.MultipartThreshold {
+		err = s.S3Client.PutMultipart(ctx, key, tmp, fi.Size(), s.Multipart)
+		if err == nil {
+			s.putS3Multipart.Add(1)
+		}
+	} else if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+		err = s.S3Client.Put(ctx, key, tmp)
+	}
+	if err != nil {
+		return false, err
+	}
+	s.putS3Encoded.Add(fi.Size())
+	return true, nil
+}
+
+// keyIn assembles a complete key for the specified kind and ID under the given
+// key prefix, if it is non-empty.
+func (s *S3Cache) keyIn(prefix, kind, id string) string {
+	return path.Join(prefix, s.keyFunc()(kind, id))
 }
 
-func (s *S3Cache) actionKey(id string) string { return s.makeKey("action", id[:2], id) }
-func (s *S3Cache) outputKey(id string) string { return s.makeKey("output", id[:2], id) }
+func (s *S3Cache) objectKey(kind, id string) string { return s.keyIn(s.KeyPrefix, kind, id) }
+
+func (s *S3Cache) keyFunc() KeyFunc {
+	if s.KeyFunc == nil {
+		return defaultKey
+	}
+	return s.KeyFunc
+}
 
 func (s *S3Cache) uploadConcurrency() int {
 	if s.UploadConcurrency <= 0 {
@@ -254,14 +1405,55 @@ func (s *S3Cache) uploadConcurrency() int {
 	return s.UploadConcurrency
 }
 
-func parseAction(data []byte) (outputID string, mtime time.Time, _ error) {
+func (s *S3Cache) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// An actionRecord is the content of an action record stored in S3.
+type actionRecord struct {
+	outputID string
+	kind     string // "output" or "test"
+	codec    string // the compression codec of the object, or ""
+	mtime    time.Time
+}
+
+// recordKey returns the key under the given key prefix of the object named by
+// the action record r.
+func (s *S3Cache) recordKey(prefix string, r actionRecord) string {
+	key := s.keyIn(prefix, r.kind, r.outputID)
+	if r.codec != "" {
+		key = codecKey(key, r.codec)
+	}
+	return key
+}
+
+func parseAction(data []byte) (actionRecord, error) {
 	fs := strings.Fields(string(data))
-	if len(fs) != 2 {
-		return "", time.Time{}, errors.New("invalid action record")
+	if len(fs) < 2 {
+		return actionRecord{}, errors.New("invalid action record")
+	}
+	r := actionRecord{outputID: fs[0], kind: "output"}
+	rest := fs[2:]
+	if len(rest) != 0 && rest[0] == "test" {
+		r.kind, rest = "test", rest[1:]
+	}
+	if len(rest) != 0 {
+		if _, ok := codecs[rest[0]]; ok {
+			r.codec, rest = rest[0], rest[1:]
+		}
+	}
+	if len(rest) != 0 {
+		return actionRecord{}, errors.New("invalid action record")
 	}
 	ts, err := strconv.ParseInt(fs[1], 10, 64)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+		return actionRecord{}, fmt.Errorf("invalid timestamp: %w", err)
 	}
-	return fs[0], time.Unix(ts/1e9, ts%1e9), nil
+	r.mtime = time.Unix(ts/1e9, ts%1e9)
+	return r, nil
 }
@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+// newTestCache returns a cache backed by a new local directory and the given
+// fake bucket.
+func newTestCache(t *testing.T, f *fakeS3) *gobuild.S3Cache {
+	t.Helper()
+	return newTestCacheIn(t, f, t.TempDir())
+}
+
+// newTestCacheIn returns a cache backed by the local directory at root and
+// the given fake bucket.
+func newTestCacheIn(t *testing.T, f *fakeS3, root string) *gobuild.S3Cache {
+	t.Helper()
+	dir, err := cachedir.New(root)
+	if err != nil {
+		t.Fatalf("New cache dir: %v", err)
+	}
+	return &gobuild.S3Cache{Local: dir, S3Client: f.client()}
+}
+
+// testEntry is a cache entry with the given contents, and an action ID
+// derived from its name.
+type testEntry struct {
+	actionID, outputID, data string
+}
+
+func newEntry(name, data string) testEntry {
+	return testEntry{actionID: hexSum(name), outputID: hexSum(data), data: data}
+}
+
+func hexSum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// put stores e in c, and reports the path of its local copy.
+func (e testEntry) put(t *testing.T, ctx context.Context, c *gobuild.S3Cache) string {
+	t.Helper()
+	path, err := c.Put(ctx, gocache.Object{
+		ActionID: e.actionID,
+		OutputID: e.outputID,
+		Size:     int64(len(e.data)),
+		Body:     strings.NewReader(e.data),
+	})
+	if err != nil {
+		t.Fatalf("Put %s: %v", e.actionID, err)
+	}
+	return path
+}
+
+// checkGet verifies that c finds e, with its contents.
+func (e testEntry) checkGet(t *testing.T, ctx context.Context, c *gobuild.S3Cache) {
+	t.Helper()
+	outputID, path, err := c.Get(ctx, e.actionID)
+	if err != nil {
+		t.Fatalf("Get %s: %v", e.actionID, err)
+	} else if outputID != e.outputID {
+		t.Fatalf("Get %s: got output %q, want %q", e.actionID, outputID, e.outputID)
+	}
+	if data, err := os.ReadFile(path); err != nil {
+		t.Errorf("Read %s: %v", path, err)
+	} else if string(data) != e.data {
+		t.Errorf("Get %s: got %q, want %q", e.actionID, data, e.data)
+	}
+}
+
+// checkMiss verifies that c does not find e.
+func (e testEntry) checkMiss(t *testing.T, ctx context.Context, c *gobuild.S3Cache) {
+	t.Helper()
+	if outputID, _, err := c.Get(ctx, e.actionID); err != nil {
+		t.Fatalf("Get %s: %v", e.actionID, err)
+	} else if outputID != "" {
+		t.Errorf("Get %s: got output %q, want miss", e.actionID, outputID)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	e := newEntry("hello", "hello, world")
+
+	// A Put is stored locally, and uploaded by the time the cache is closed.
+	c1 := newTestCache(t, f)
+	e.put(t, ctx, c1)
+	e.checkGet(t, ctx, c1)
+	if err := c1.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := f.keys("action/"); len(got) != 1 {
+		t.Errorf("Action keys: got %q, want 1", got)
+	}
+	if got := f.keys("output/"); len(got) != 1 {
+		t.Errorf("Output keys: got %q, want 1", got)
+	}
+
+	// Another cache with an empty directory faults it in from S3.
+	c2 := newTestCache(t, f)
+	e.checkGet(t, ctx, c2)
+	if st := c2.GetStats(); st.Hits != 1 {
+		t.Errorf("Hits: got %d, want 1", st.Hits)
+	}
+	newEntry("other", "nothing").checkMiss(t, ctx, c2)
+	if st := c2.GetStats(); st.Misses[gobuild.MissNotRemote] != 1 {
+		t.Errorf("Misses: got %v, want 1 %s", st.Misses, gobuild.MissNotRemote)
+	}
+}
+
+func TestUploadOutlivesRequest(t *testing.T) {
+	// The upload of a Put must complete, even if the context of the request
+	// that stored it ends first, as when the client disconnects.
+	f := newFakeS3(t)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	f.block = func(method, key string) {
+		if method == "PUT" && strings.HasPrefix(key, "output/") {
+			started <- struct{}{}
+			<-release
+		}
+	}
+	c := newTestCache(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	e := newEntry("request", "canceled before upload")
+	e.put(t, ctx, c)
+
+	<-started
+	cancel()
+	close(release)
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := c.FailedActions(); len(got) != 0 {
+		t.Errorf("Failed actions: got %q, want none", got)
+	}
+	if got := f.keys("action/"); len(got) != 1 {
+		t.Errorf("Action keys: got %q, want 1", got)
+	}
+}
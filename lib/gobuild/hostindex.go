@@ -0,0 +1,300 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+)
+
+// A HostIndex is a snapshot of the actions in a local cache directory, shared
+// by the processes that use the directory on one host. The snapshot is stored
+// in a file in the directory, which each process maps into memory read-only,
+// so that a process started for one invocation of the go command can look up
+// actions without reading their files, and without scanning the directory.
+//
+// The snapshot is rebuilt in the background by whichever process first finds
+// it older than its maximum age, and replaced atomically; other processes map
+// the new snapshot when they next notice it. Actions stored after a snapshot
+// was taken are missing from it, so a miss in the index is not a miss in the
+// local cache, and the caller must still consult the directory.
+//
+// # Index Format
+//
+// The index file begins with an 8-byte magic number and the count of records
+// as a little-endian uint64, followed by the records sorted by action ID. Each
+// record has a fixed size: the action ID and output ID as 32 raw bytes each,
+// and the size of the output as a little-endian int64. Actions whose IDs are
+// not 32-byte hex digests are omitted.
+type HostIndex struct {
+	root   string
+	maxAge time.Duration
+	logger *slog.Logger
+
+	rebuilding atomic.Bool
+
+	mu      sync.Mutex
+	data    []byte       // the mapped index file, or nil
+	unmap   func() error // unmap data, or nil
+	mapped  fs.FileInfo  // the index file that is mapped, or nil
+	checked time.Time    // when the index file was last checked for changes
+	closed  bool
+}
+
+const (
+	hostIndexFile  = "hostindex"
+	hostIndexMagic = "gcpidx01"
+	hostIndexHead  = len(hostIndexMagic) + 8
+	hostIndexRec   = 32 + 32 + 8
+
+	// hostIndexCheck is how often a HostIndex checks whether its file has
+	// been replaced or is due to be rebuilt.
+	hostIndexCheck = time.Second
+)
+
+// OpenHostIndex opens the shared index of the local cache directory at root,
+// which must be the directory managed by [S3Cache.Local]. The index is
+// rebuilt when it is older than maxAge, which must be positive. If the index
+// is missing or stale, OpenHostIndex starts a rebuild in the background and
+// returns at once; until it completes, lookups report a miss. An index file
+// that cannot be read is likewise rebuilt. If logger is nil, logs are
+// discarded.
+func OpenHostIndex(root string, maxAge time.Duration, logger *slog.Logger) (*HostIndex, error) {
+	if maxAge <= 0 {
+		return nil, errors.New("host index age must be positive")
+	}
+	h := &HostIndex{root: root, maxAge: maxAge, logger: logger}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.refreshLocked(time.Now()); err != nil {
+		h.logf("host index unavailable", "err", err)
+	}
+	return h, nil
+}
+
+// Lookup reports the output ID and size recorded in the index for actionID,
+// if it is present.
+func (h *HostIndex) Lookup(actionID string) (outputID string, size int64, ok bool) {
+	var key [32]byte
+	if len(actionID) != 2*len(key) {
+		return "", 0, false
+	} else if _, err := hex.Decode(key[:], []byte(actionID)); err != nil {
+		return "", 0, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); !h.closed && now.Sub(h.checked) >= hostIndexCheck {
+		if err := h.refreshLocked(now); err != nil {
+			h.logf("host index refresh failed", "err", err)
+		}
+	}
+	n := h.countLocked()
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(h.recordLocked(i)[:32], key[:]) >= 0
+	})
+	if i >= n {
+		return "", 0, false
+	}
+	rec := h.recordLocked(i)
+	if !bytes.Equal(rec[:32], key[:]) {
+		return "", 0, false
+	}
+	return hex.EncodeToString(rec[32:64]), int64(binary.LittleEndian.Uint64(rec[64:])), true
+}
+
+// OutputPath returns the path of the object file for outputID in the local
+// cache directory of h.
+func (h *HostIndex) OutputPath(outputID string) string {
+	return filepath.Join(h.root, "output", outputID[:2], outputID)
+}
+
+// Len reports the number of actions in the index.
+func (h *HostIndex) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.countLocked()
+}
+
+// Close unmaps the index. Lookups after Close report a miss.
+func (h *HostIndex) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	return h.unmapLocked()
+}
+
+// Rebuild scans the local cache directory and replaces the index file with a
+// new snapshot of its actions.
+func (h *HostIndex) Rebuild(ctx context.Context) (int, error) {
+	type record struct {
+		action, output [32]byte
+		size           int64
+	}
+	var recs []record
+	err := filepath.WalkDir(filepath.Join(h.root, "action"), func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if !de.Type().IsRegular() {
+			return nil
+		}
+		var r record
+		if n, err := hex.Decode(r.action[:], []byte(de.Name())); err != nil || n != len(r.action) {
+			return nil // not an action
+		}
+		outputID, size, err := readLocalAction(path)
+		if err != nil {
+			return nil // removed or invalid; skip it
+		} else if n, err := hex.Decode(r.output[:], []byte(outputID)); err != nil || n != len(r.output) {
+			return nil
+		}
+		r.size = size
+		recs = append(recs, r)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	slices.SortFunc(recs, func(a, b record) int { return bytes.Compare(a.action[:], b.action[:]) })
+	recs = slices.CompactFunc(recs, func(a, b record) bool { return a.action == b.action })
+
+	buf := make([]byte, hostIndexHead, hostIndexHead+len(recs)*hostIndexRec)
+	copy(buf, hostIndexMagic)
+	binary.LittleEndian.PutUint64(buf[len(hostIndexMagic):], uint64(len(recs)))
+	for _, r := range recs {
+		buf = append(buf, r.action[:]...)
+		buf = append(buf, r.output[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(r.size))
+	}
+	if err := atomicfile.WriteData(h.path(), buf, 0644); err != nil {
+		return 0, err
+	}
+	return len(recs), nil
+}
+
+func (h *HostIndex) path() string { return filepath.Join(h.root, hostIndexFile) }
+
+// refreshLocked maps the index file if it has been replaced since it was last
+// mapped, and starts a rebuild if it is missing or older than h.maxAge.
+func (h *HostIndex) refreshLocked(now time.Time) error {
+	h.checked = now
+	fi, err := os.Stat(h.path())
+	if errors.Is(err, fs.ErrNotExist) {
+		h.startRebuild()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if now.Sub(fi.ModTime()) > h.maxAge {
+		h.startRebuild()
+	}
+	if h.mapped != nil && os.SameFile(h.mapped, fi) && fi.ModTime().Equal(h.mapped.ModTime()) {
+		return nil // unchanged
+	}
+
+	f, err := os.Open(h.path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err = f.Stat()
+	if err != nil {
+		return err
+	}
+	data, unmap, err := mapFile(f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("map host index: %w", err)
+	}
+	if err := checkHostIndex(data); err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		h.startRebuild()
+		return err
+	}
+	if err := h.unmapLocked(); err != nil {
+		h.logf("unmap host index failed", "err", err)
+	}
+	h.data, h.unmap, h.mapped = data, unmap, fi
+	h.logf("mapped host index", "actions", h.countLocked(), "age", now.Sub(fi.ModTime()).Round(time.Second))
+	return nil
+}
+
+// startRebuild starts a rebuild of the index in the background, unless one is
+// already in progress. The new index is mapped at the next refresh.
+func (h *HostIndex) startRebuild() {
+	if !h.rebuilding.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer h.rebuilding.Store(false)
+		start := time.Now()
+		n, err := h.Rebuild(context.Background())
+		if err != nil {
+			h.logf("rebuild host index failed", "err", err)
+			return
+		}
+		h.logf("rebuilt host index", "actions", n, "elapsed", time.Since(start))
+
+		// Map the new index at the next lookup.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.checked = time.Time{}
+	}()
+}
+
+func (h *HostIndex) unmapLocked() error {
+	var err error
+	if h.unmap != nil {
+		err = h.unmap()
+	}
+	h.data, h.unmap, h.mapped = nil, nil, nil
+	return err
+}
+
+func (h *HostIndex) countLocked() int {
+	if len(h.data) < hostIndexHead {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint64(h.data[len(hostIndexMagic):]))
+}
+
+func (h *HostIndex) recordLocked(i int) []byte {
+	pos := hostIndexHead + i*hostIndexRec
+	return h.data[pos : pos+hostIndexRec]
+}
+
+func (h *HostIndex) logf(msg string, args ...any) {
+	cmp.Or(h.logger, discardLogger).Debug(msg, args...)
+}
+
+// checkHostIndex reports an error if data is not a well-formed index.
+func checkHostIndex(data []byte) error {
+	if len(data) < hostIndexHead || string(data[:len(hostIndexMagic)]) != hostIndexMagic {
+		return errors.New("invalid host index header")
+	}
+	n := binary.LittleEndian.Uint64(data[len(hostIndexMagic):])
+	if uint64(len(data)-hostIndexHead) != n*uint64(hostIndexRec) {
+		return fmt.Errorf("host index has %d bytes for %d records", len(data)-hostIndexHead, n)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package gobuild
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f into memory. On this platform the
+// index is not shared, but each process still avoids reading action files.
+func mapFile(f *os.File, size int64) (data []byte, unmap func() error, _ error) {
+	data = make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
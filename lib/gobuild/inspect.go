@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// An Entry describes how a build cache entry is stored in one tier of the
+// cache, as reported by [S3Cache.Lookup].
+type Entry struct {
+	ActionKey string    // the S3 key of the action record (remote only)
+	OutputID  string    // the output ID recorded for the action
+	Written   time.Time // when the action was written (remote only)
+	Kind      string    // "output" or "test" (remote only)
+	Codec     string    // the compression of the object, if any (remote only)
+
+	Object  string    // the local path or S3 key of the object
+	Missing bool      // the action is present, but its object is not
+	Size    int64     // the stored size of the object
+	ModTime time.Time // when the object was last written
+}
+
+// Lookup reports how the entry for actionID is stored in the local directory
+// and in S3 under the key prefix of s, without faulting it in or updating
+// metrics. Either result is nil if the action is not present in that tier.
+// Lookup is meant for debugging; the cache itself uses [S3Cache.Get].
+func (s *S3Cache) Lookup(ctx context.Context, actionID string) (local, remote *Entry, _ error) {
+	outputID, diskPath, err := s.Local.Get(ctx, actionID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("local get: %w", err)
+	} else if outputID != "" {
+		fi, err := os.Stat(diskPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		local = &Entry{OutputID: outputID, Object: diskPath, Size: fi.Size(), ModTime: fi.ModTime()}
+	}
+
+	akey := s.objectKey("action", actionID)
+	data, err := s.S3Client.GetData(ctx, akey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return local, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("read action %s: %w", akey, err)
+	}
+	rec, err := parseAction(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("action %s: %w", akey, err)
+	}
+	remote = &Entry{
+		ActionKey: akey,
+		OutputID:  rec.outputID,
+		Written:   rec.mtime,
+		Kind:      rec.kind,
+		Codec:     rec.codec,
+		Object:    s.recordKey(s.KeyPrefix, rec),
+		Size:      -1,
+	}
+	if info, err := s.S3Client.Stat(ctx, remote.Object); s3util.IsNotExist(err) {
+		remote.Missing = true
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("stat object %s: %w", remote.Object, err)
+	} else {
+		remote.Size, remote.ModTime = info.Size, info.ModTime
+	}
+	return local, remote, nil
+}
+
+// OpenRemote opens the output of actionID stored in S3 under the key prefix
+// of s, decompressed if necessary. If the action or its object is not
+// present, the error satisfies [fs.ErrNotExist]. The caller must close the
+// reader when it is done.
+func (s *S3Cache) OpenRemote(ctx context.Context, actionID string) (io.ReadCloser, error) {
+	data, err := s.S3Client.GetData(ctx, s.objectKey("action", actionID))
+	if err != nil {
+		return nil, err
+	}
+	rec, err := parseAction(data)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := s.S3Client.Get(ctx, s.recordKey(s.KeyPrefix, rec))
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeObject(ctx, rc, rec.codec)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// A Journal is a write-ahead log of the uploads to S3 made by an [S3Cache], so
+// that uploads interrupted when the process exits (or crashes) are not lost. A
+// later process can read the journal and complete them (see [S3Cache.Replay]).
+//
+// A journal is attached to a cache by setting its Journal field. Each upload
+// is recorded as a line "+ <action-id>" before it begins, and as a line
+// "- <action-id>" once it has succeeded, or is found to be unnecessary. An
+// upload that fails is not marked complete, so it is replayed along with those
+// that were interrupted.
+type Journal struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJournal constructs a journal that writes entries to w. Since each entry
+// is written to w at once, an *os.File suffices to preserve the journal if
+// the process crashes.
+func NewJournal(w io.Writer) *Journal { return &Journal{w: w} }
+
+// Err reports the first error that occurred writing to j, if any.
+// Once an error has occurred, no further entries are written.
+func (j *Journal) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// record writes an entry with the given op for each of ids, if j != nil.
+func (j *Journal) record(op string, ids ...string) {
+	if j == nil || len(ids) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(op + " " + id + "\n")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err == nil {
+		_, j.err = j.w.Write(buf.Bytes())
+	}
+}
+
+// ReadJournal reads a journal from r, and returns the IDs of actions whose
+// uploads began but did not complete, in the order they began. Malformed
+// lines, such as a partial entry cut off by a crash, are ignored.
+func ReadJournal(r io.Reader) ([]string, error) {
+	var order []string
+	open := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		op, id, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok || len(id) < 2 {
+			continue
+		}
+		switch op {
+		case "+":
+			if _, seen := open[id]; !seen {
+				order = append(order, id)
+			}
+			open[id] = true
+		case "-":
+			open[id] = false
+		}
+	}
+	var out []string
+	for _, id := range order {
+		if open[id] {
+			out = append(out, id)
+		}
+	}
+	return out, sc.Err()
+}
+
+// Replay completes the uploads that began but did not complete according to
+// the journal read from r, from the local cache directory rooted at root, as
+// [S3Cache.SyncActions] does. The uploads are recorded in the Journal of s, if
+// it has one, before they begin, so that they are not lost if this process
+// also exits before they complete.
+func (s *S3Cache) Replay(ctx context.Context, root string, r io.Reader) (SyncStats, error) {
+	ids, err := ReadJournal(r)
+	if err != nil {
+		return SyncStats{}, err
+	}
+	s.Journal.record("+", ids...)
+	return s.SyncActions(ctx, root, ids)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+)
+
+func TestReadJournal(t *testing.T) {
+	got, err := gobuild.ReadJournal(strings.NewReader(`+ aa01
++ bb02
+- aa01
++ cc03
++ bb02
+garbage
+- cc0`))
+	if err != nil {
+		t.Fatalf("ReadJournal: %v", err)
+	}
+	if want := []string{"bb02", "cc03"}; !slices.Equal(got, want) {
+		t.Errorf("ReadJournal: got %q, want %q", got, want)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	root := t.TempDir()
+
+	// One upload of a process fails, and remains open in its journal.
+	var jbuf bytes.Buffer
+	c1 := newTestCacheIn(t, f, root)
+	c1.Journal = gobuild.NewJournal(&jbuf)
+	ok := newEntry("replay-ok", "uploaded before the failure")
+	lost := newEntry("replay-lost", "upload failed")
+	ok.put(t, ctx, c1)
+	if err := c1.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	f.fail = func(method, key string) bool { return method == "PUT" }
+	lost.put(t, ctx, c1)
+	c1.Close(ctx) // fails with the upload
+	if got := c1.FailedActions(); !slices.Equal(got, []string{lost.actionID}) {
+		t.Errorf("Failed actions: got %q, want %q", got, lost.actionID)
+	}
+	if got := f.keys("action/"); len(got) != 1 {
+		t.Fatalf("Action keys: got %q, want 1", got)
+	}
+	open, err := gobuild.ReadJournal(bytes.NewReader(jbuf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadJournal: %v", err)
+	} else if !slices.Equal(open, []string{lost.actionID}) {
+		t.Errorf("Open uploads: got %q, want %q", open, lost.actionID)
+	}
+
+	// A later process on the same directory completes the open uploads, and
+	// records them in its own journal.
+	f.fail = nil
+	var jbuf2 bytes.Buffer
+	c2 := newTestCacheIn(t, f, root)
+	c2.Journal = gobuild.NewJournal(&jbuf2)
+	st, err := c2.Replay(ctx, root, bytes.NewReader(jbuf.Bytes()))
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if st.Actions != 1 || st.Synced != 1 {
+		t.Errorf("Replay: got %+v, want 1 action synced", st)
+	}
+	if err := c2.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	lost.checkGet(t, ctx, newTestCache(t, f))
+	if open, err := gobuild.ReadJournal(bytes.NewReader(jbuf2.Bytes())); err != nil {
+		t.Fatalf("ReadJournal: %v", err)
+	} else if len(open) != 0 {
+		t.Errorf("Open uploads after replay: got %q, want none", open)
+	}
+}
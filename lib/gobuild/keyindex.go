@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"hash/maphash"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// A KeyIndex is a set of the action keys present in S3, listed in advance so
+// that [S3Cache.Get] need not request the actions known to be absent. On a
+// cold cache, nearly every lookup is a miss, and one listing of the bucket
+// replaces thousands of failed requests.
+//
+// The index covers only the actions of the [RootNamespace] under the key
+// prefix of the cache, and only once it has been loaded (see
+// [S3Cache.LoadKeyIndex]); until then, it reports no key absent. Actions
+// written by this cache are added as they are written, but those written by
+// other servers are missing until the index is loaded again, so the index
+// should be reloaded periodically.
+//
+// Keys are stored as 64-bit hashes, so the index of a large bucket is small.
+// A collision reports an absent key present, at the cost of one request.
+//
+// A zero KeyIndex is ready for use. A KeyIndex is safe for concurrent use.
+type KeyIndex struct {
+	mu      sync.Mutex
+	seed    maphash.Seed
+	prefix  string              // the prefix of the keys indexed
+	keys    map[uint64]struct{} // hashes of the keys present, or nil if not loaded
+	added   []uint64            // hashes added while loading, or nil
+	loading bool
+	loaded  time.Time
+}
+
+// Len reports the number of keys in x, and when it was last loaded. If x has
+// not been loaded, it reports 0 and a zero time.
+func (x *KeyIndex) Len() (int, time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.keys), x.loaded
+}
+
+// absent reports whether key is known to be absent from the index.
+func (x *KeyIndex) absent(key string) bool {
+	if x == nil {
+		return false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.keys == nil || !strings.HasPrefix(key, x.prefix) {
+		return false
+	}
+	_, ok := x.keys[maphash.String(x.seed, key)]
+	return !ok
+}
+
+// add records that key is present, if it is covered by the index.
+func (x *KeyIndex) add(key string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.keys == nil && !x.loading {
+		return
+	}
+	h := maphash.String(x.seed, key)
+	if x.keys != nil {
+		x.keys[h] = struct{}{}
+	}
+	if x.loading {
+		x.added = append(x.added, h)
+	}
+}
+
+// LoadKeyIndex lists the action keys of the root namespace in S3, and replaces
+// the contents of the KeyIndex with them, reporting the number of keys found.
+// Lookups continue to use the previous contents until the listing is
+// complete. If KeyIndex is nil, LoadKeyIndex does nothing.
+func (s *S3Cache) LoadKeyIndex(ctx context.Context) (int, error) {
+	x := s.KeyIndex
+	if x == nil {
+		return 0, nil
+	}
+	// The actions are listed under the directory of the key of an action,
+	// less the two-digit shard, whatever KeyFunc adds above it.
+	prefix := path.Dir(path.Dir(s.keyIn(s.KeyPrefix, "action", strings.Repeat("0", 64)))) + "/"
+
+	x.mu.Lock()
+	if x.keys == nil {
+		x.seed = maphash.MakeSeed()
+	}
+	x.loading, x.added = true, nil
+	seed := x.seed
+	x.mu.Unlock()
+
+	keys := make(map[uint64]struct{})
+	err := s.S3Client.List(ctx, prefix, func(obj s3util.ObjectInfo) error {
+		keys[maphash.String(seed, obj.Key)] = struct{}{}
+		return nil
+	})
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.loading = false
+	if err != nil {
+		x.added = nil
+		return 0, err
+	}
+	for _, h := range x.added {
+		keys[h] = struct{}{}
+	}
+	x.prefix, x.keys, x.added, x.loaded = prefix, keys, nil, time.Now()
+	return len(keys), nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A KeyFunc maps a cache entry to the S3 key where it is stored, relative to
+// the key prefix. The kind is "action", "output", or "test" (see
+// [TestSeparate]), and id is the hex-encoded action or output ID.
+type KeyFunc func(kind, id string) string
+
+// defaultKey is the [KeyFunc] used when none is specified.
+func defaultKey(kind, id string) string { return path.Join(kind, id[:2], id) }
+
+// ParseKeyFunc parses a key transformation specification and returns a
+// [KeyFunc] that implements it. The specification is a comma-separated list
+// of steps, applied in order:
+//
+//	prefix=P   store keys under the additional path prefix P ("\" is read as "/")
+//	salt=S     replace the ID with the SHA-256 digest of S and the ID
+//	hash       replace the ID with the SHA-256 digest of the ID
+//
+// For example, "prefix=team-a,salt=secret" stores the action with ID x at
+// "team-a/action/yy/y" where y is the hex digest of "secret:x".
+//
+// An empty specification returns the default layout.
+func ParseKeyFunc(spec string) (KeyFunc, error) {
+	if spec == "" {
+		return defaultKey, nil
+	}
+	var prefix []string
+	var hashes []func(string) string
+	for step := range strings.SplitSeq(spec, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(step), "=")
+		switch name {
+		case "prefix":
+			p := path.Clean(strings.ReplaceAll(arg, `\`, "/"))
+			if arg == "" || path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+				return nil, fmt.Errorf("invalid key prefix %q", arg)
+			}
+			prefix = append(prefix, p)
+		case "salt":
+			if arg == "" {
+				return nil, errors.New("empty key salt")
+			}
+			hashes = append(hashes, func(id string) string { return hashID(arg + ":" + id) })
+		case "hash":
+			if hasArg {
+				return nil, fmt.Errorf("unexpected argument to hash: %q", arg)
+			}
+			hashes = append(hashes, hashID)
+		default:
+			return nil, fmt.Errorf("unknown key transformation %q", name)
+		}
+	}
+	pfx := path.Join(prefix...)
+	return func(kind, id string) string {
+		for _, h := range hashes {
+			id = h(id)
+		}
+		return path.Join(pfx, defaultKey(kind, id))
+	}, nil
+}
+
+// hashID returns the hex-encoded SHA-256 digest of s.
+func hashID(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
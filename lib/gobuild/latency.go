@@ -0,0 +1,122 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of a latencyHistogram.
+// Latencies above the last are counted only in the total.
+var latencyBounds = [...]struct {
+	name string
+	max  time.Duration
+}{
+	{"le_1ms", time.Millisecond},
+	{"le_5ms", 5 * time.Millisecond},
+	{"le_25ms", 25 * time.Millisecond},
+	{"le_100ms", 100 * time.Millisecond},
+	{"le_500ms", 500 * time.Millisecond},
+	{"le_2500ms", 2500 * time.Millisecond},
+	{"le_10s", 10 * time.Second},
+}
+
+// sizeClasses are the object size classes of a latencyHistogram, by upper
+// bound. Objects of unknown size, as for a miss, have the class "miss", and
+// objects larger than the last bound the class "huge".
+var sizeClasses = [...]struct {
+	name string
+	max  int64
+}{
+	{"tiny", 1 << 10},   // up to 1KiB
+	{"small", 64 << 10}, // up to 64KiB
+	{"medium", 1 << 20}, // up to 1MiB
+	{"large", 16 << 20}, // up to 16MiB
+}
+
+const (
+	sizeMiss = len(sizeClasses)     // index of the "miss" class
+	sizeHuge = len(sizeClasses) + 1 // index of the "huge" class
+)
+
+// A latencyHistogram counts the latencies of an operation of the cache, by
+// the size of the object concerned. It is an [expvar.Var], whose value is a
+// JSON object with a member for each size class, itself an object with the
+// cumulative count of latencies in each bucket (as "le_<bound>"), the total
+// count, and the sum of the latencies in microseconds. The counts only
+// increase, so that the buckets may be exported as counters. The zero value
+// is ready for use.
+type latencyHistogram struct {
+	classes [len(sizeClasses) + 2]latencyCounts
+}
+
+type latencyCounts struct {
+	buckets [len(latencyBounds)]atomic.Int64 // not cumulative
+	count   atomic.Int64
+	sumUS   atomic.Int64
+}
+
+// observe records a latency d for an object of the given size in bytes, or of
+// unknown size if size < 0.
+func (h *latencyHistogram) observe(size int64, d time.Duration) {
+	class := sizeMiss
+	if size >= 0 {
+		class = sizeHuge
+		for i, c := range sizeClasses {
+			if size <= c.max {
+				class = i
+				break
+			}
+		}
+	}
+	c := &h.classes[class]
+	for i, b := range latencyBounds {
+		if d <= b.max {
+			c.buckets[i].Add(1)
+			break
+		}
+	}
+	c.count.Add(1)
+	c.sumUS.Add(d.Microseconds())
+}
+
+// String implements the [expvar.Var] interface.
+func (h *latencyHistogram) String() string {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i := range h.classes {
+		name := "miss"
+		if i < len(sizeClasses) {
+			name = sizeClasses[i].name
+		} else if i == sizeHuge {
+			name = "huge"
+		}
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		c := &h.classes[i]
+		fmt.Fprintf(&sb, "%q:{", name)
+		var cum int64
+		for j, b := range latencyBounds {
+			cum += c.buckets[j].Load()
+			fmt.Fprintf(&sb, "%q:%d,", b.name, cum)
+		}
+		fmt.Fprintf(&sb, `"count":%d,"sum_us":%d}`, c.count.Load(), c.sumUS.Load())
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// fileSize returns the size of the file at path, or -1 if it cannot be read.
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
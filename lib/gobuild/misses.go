@@ -0,0 +1,131 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import "expvar"
+
+// Reasons for a miss reported by [S3Cache.Get], as counted in its metrics.
+const (
+	// MissNotLocal is a miss in the local tiers, when no remote tier was
+	// consulted: none was selected, or the lookup was deferred to the
+	// background (see BackgroundFault).
+	MissNotLocal = "not_local"
+
+	// MissNotRemote is a miss in every tier consulted, including misses
+	// remembered from an earlier lookup (see MissTTL).
+	MissNotRemote = "not_remote"
+
+	// MissExpired is a miss for an action whose record is in S3 but whose
+	// object is not, as when a bucket lifecycle rule removed the object.
+	MissExpired = "expired"
+
+	// MissSmall counts the remote misses for actions whose objects were then
+	// stored below MinUploadSize. These never reach S3, so other builds will
+	// miss them too. Unlike the other reasons, these misses are also counted
+	// as MissNotRemote or MissExpired.
+	MissSmall = "small"
+
+	// MissError is a lookup that failed with an error.
+	MissError = "error"
+
+	// MissLowDisk is a miss in the local tiers, when the remote tiers were
+	// not consulted because the local directory is low on space (see
+	// [DiskWatch]).
+	MissLowDisk = "low_disk"
+)
+
+// GetStats are the totals of the outcomes of Get requests to an [S3Cache].
+type GetStats struct {
+	Hits   int64            // the number of hits in any tier
+	Misses map[string]int64 // the number of misses by reason (Miss* constants)
+}
+
+// Total reports the number of Get requests in s.
+func (s GetStats) Total() int64 {
+	n := s.Hits
+	for r, v := range s.Misses {
+		if r != MissSmall {
+			n += v
+		}
+	}
+	return n
+}
+
+// HitRatio reports the fraction of Get requests that were hits, or 0 if there
+// were none.
+func (s GetStats) HitRatio() float64 {
+	if n := s.Total(); n > 0 {
+		return float64(s.Hits) / float64(n)
+	}
+	return 0
+}
+
+// Sub returns the difference of s and old, for the Get requests between them.
+func (s GetStats) Sub(old GetStats) GetStats {
+	d := GetStats{Hits: s.Hits - old.Hits, Misses: make(map[string]int64)}
+	for r, v := range s.Misses {
+		d.Misses[r] = v - old.Misses[r]
+	}
+	return d
+}
+
+// GetStats returns the totals of the outcomes of Get requests so far.
+func (s *S3Cache) GetStats() GetStats {
+	out := GetStats{Hits: s.getHit.Value(), Misses: make(map[string]int64)}
+	s.missReasons().Do(func(kv expvar.KeyValue) {
+		out.Misses[kv.Key] = kv.Value.(*expvar.Int).Value()
+	})
+	return out
+}
+
+// MissMetrics returns a map of the counts of misses by reason. Published with
+// a name of the form "counter_labelmap_reason_<name>", it is exported by the
+// Prometheus handler of tsweb as a counter with a "reason" label.
+func (s *S3Cache) MissMetrics() *expvar.Map { return s.missReasons() }
+
+func (s *S3Cache) missReasons() *expvar.Map {
+	s.missOnce.Do(func() {
+		s.missByReason = new(expvar.Map)
+		for _, r := range []string{MissNotLocal, MissNotRemote, MissExpired, MissSmall, MissError, MissLowDisk} {
+			s.missByReason.Set(r, new(expvar.Int))
+		}
+	})
+	return s.missByReason
+}
+
+// countGet counts the outcome of a Get request: a hit if hit is true, or else
+// a miss for the given reason.
+func (s *S3Cache) countGet(hit bool, reason string) {
+	if hit {
+		s.getHit.Add(1)
+	} else {
+		s.missReasons().Add(reason, 1)
+	}
+}
+
+// maxRecentMisses is the maximum number of remote misses remembered so that a
+// subsequent Put below MinUploadSize is counted as a MissSmall.
+const maxRecentMisses = 1 << 14
+
+// noteRemoteMiss remembers that actionID was missing remotely, so that its
+// Put can be checked against MinUploadSize.
+func (s *S3Cache) noteRemoteMiss(actionID string) {
+	if s.recentMiss != nil {
+		s.recentMiss.Put(actionID, struct{}{})
+	}
+}
+
+// notePut counts a MissSmall if actionID was recently missing remotely and
+// its object of the given size is too small to upload.
+func (s *S3Cache) notePut(actionID string, size int64) {
+	if s.recentMiss == nil {
+		return
+	}
+	if _, ok := s.recentMiss.Get(actionID); ok {
+		s.recentMiss.Remove(actionID)
+		if size < s.MinUploadSize {
+			s.countGet(false, MissSmall)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// RootNamespace names the shared space of the remote cache, which holds the
+// actions of builds without a [NamespaceChain].
+const RootNamespace = "."
+
+// ParseNamespaceChain parses a comma-separated list of namespace names, such
+// as "pr-1234,main,release-1.22". Names consist of letters, digits, and the
+// punctuation "-", "_", and ".", and may be listed at most once. The name "."
+// is the [RootNamespace]. An empty string returns an empty chain.
+func ParseNamespaceChain(s string) ([]string, error) {
+	var chain []string
+	for name := range strings.SplitSeq(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		} else if !validNamespace(name) {
+			return nil, fmt.Errorf("invalid namespace %q", name)
+		} else if slices.Contains(chain, name) {
+			return nil, fmt.Errorf("duplicate namespace %q", name)
+		}
+		chain = append(chain, name)
+	}
+	return chain, nil
+}
+
+func validNamespace(name string) bool {
+	if name == RootNamespace {
+		return true
+	} else if strings.Trim(name, ".") == "" {
+		return false // "..", etc.
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-_.", r))
+	}) < 0
+}
+
+// A NamespaceChain selects the namespaces of the remote cache used by the
+// requests of a single build. A chain is attached to the context of a cache
+// server with [WithNamespaceChain].
+//
+// [S3Cache.Get] looks for an action in each namespace of the chain in order,
+// and [S3Cache.Put] writes actions only to the first. A feature branch build
+// might read "pr-1234,main", for example, to find what the main branch built
+// without being able to change it. Objects are stored by content, and are
+// shared by all namespaces; so are the local cache and peers.
+//
+// A zero NamespaceChain uses only the [RootNamespace]. Its names may be
+// changed while it is in use, and the change applies to subsequent requests.
+type NamespaceChain struct {
+	names atomic.Pointer[[]string]
+}
+
+// SetNames sets the namespaces of c, in order. An empty list restores the
+// root namespace. The list should be valid as for [ParseNamespaceChain].
+func (c *NamespaceChain) SetNames(names []string) {
+	if len(names) == 0 {
+		c.names.Store(nil)
+		return
+	}
+	names = slices.Clone(names)
+	c.names.Store(&names)
+}
+
+// Names returns the namespaces of c, in order.
+func (c *NamespaceChain) Names() []string {
+	if n := c.names.Load(); n != nil {
+		return *n
+	}
+	return rootChain
+}
+
+var rootChain = []string{RootNamespace}
+
+type namespaceChainKey struct{}
+
+// WithNamespaceChain returns a child of ctx with the specified namespace chain
+// attached.
+func WithNamespaceChain(ctx context.Context, c *NamespaceChain) context.Context {
+	return context.WithValue(ctx, namespaceChainKey{}, c)
+}
+
+// namespaces returns the namespace chain for a request with the given context.
+func namespaces(ctx context.Context) []string {
+	if c, ok := ctx.Value(namespaceChainKey{}).(*NamespaceChain); ok && c != nil {
+		return c.Names()
+	}
+	return rootChain
+}
+
+// namespaced reports whether a request with the given context writes to a
+// namespace other than the root.
+func namespaced(ctx context.Context) bool { return namespaces(ctx)[0] != RootNamespace }
+
+// actionPrefix returns the S3 key prefix of the actions in namespace ns.
+func (s *S3Cache) actionPrefix(ns string) string {
+	if ns == RootNamespace {
+		return s.KeyPrefix
+	}
+	return path.Join(s.KeyPrefix, "ns", ns)
+}
+
+// writeActionKey returns the S3 key where a request with the given context
+// writes the specified action.
+func (s *S3Cache) writeActionKey(ctx context.Context, actionID string) string {
+	return s.keyIn(s.actionPrefix(namespaces(ctx)[0]), "action", actionID)
+}
+
+// missKey returns the key of actionID in the cache of misses, which depends on
+// the namespaces consulted.
+func missKey(ctx context.Context, actionID string) string {
+	if chain := namespaces(ctx); len(chain) != 1 || chain[0] != RootNamespace {
+		return strings.Join(chain, ",") + " " + actionID
+	}
+	return actionID
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// ScanActions lists the action records stored in S3 under the key prefix of
+// s, including the actions of every namespace (see [NamespaceChain]), and
+// calls stale for each record last written before cutoff. The listing calls
+// stale serially. ScanActions reads every other record, and returns the set
+// of S3 keys of the objects they refer to.
+//
+// An object may be older than the actions that refer to it, since an output
+// already in S3 is not written again when another action produces it. To
+// prune the cache, delete the stale actions first, and then only the stale
+// objects that are not in the returned set. An action record that cannot be
+// parsed refers to no object.
+func (s *S3Cache) ScanActions(ctx context.Context, cutoff time.Time, stale func(s3util.ObjectInfo)) (map[string]bool, error) {
+	var mu sync.Mutex
+	live := make(map[string]bool)
+	g, start := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	visit := func(obj s3util.ObjectInfo) error {
+		if obj.ModTime.Before(cutoff) {
+			stale(obj)
+			return nil
+		}
+		start(func() error {
+			data, err := s.S3Client.GetData(ctx, obj.Key)
+			if s3util.IsNotExist(err) {
+				return nil // deleted since it was listed
+			} else if err != nil {
+				return fmt.Errorf("read action %s: %w", obj.Key, err)
+			}
+			rec, err := parseAction(data)
+			if err != nil {
+				return nil
+			}
+			okey := s.recordKey(s.KeyPrefix, rec)
+			mu.Lock()
+			defer mu.Unlock()
+			live[okey] = true
+			return nil
+		})
+		return nil
+	}
+	lerr := s.S3Client.List(ctx, s.kindDir("action"), visit)
+	if lerr == nil {
+		lerr = s.S3Client.List(ctx, s.namespaceDir(), visit)
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	} else if lerr != nil {
+		return nil, fmt.Errorf("list actions: %w", lerr)
+	}
+	return live, nil
+}
+
+// EntryKind reports the kind of the cache entry stored in S3 at key: "action"
+// for an action record, including those of namespaces, "output" or "test" for
+// an object, or "" if key is not an entry of the build cache under the key
+// prefix of s.
+func (s *S3Cache) EntryKind(key string) string {
+	if strings.HasPrefix(key, s.namespaceDir()) {
+		return "action" // only actions are stored in namespaces
+	}
+	for _, kind := range []string{"action", "output", "test"} {
+		if strings.HasPrefix(key, s.kindDir(kind)) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// namespaceDir returns the key prefix under which the actions of namespaces
+// are stored in S3, ending in a slash.
+func (s *S3Cache) namespaceDir() string { return path.Join(s.KeyPrefix, "ns") + "/" }
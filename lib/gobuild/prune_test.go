@@ -0,0 +1,65 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestScanActions(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	old := newEntry("old", "old output")
+	cur := newEntry("current", "current output")
+
+	c := newTestCache(t, f)
+	old.put(t, ctx, c)
+	cur.put(t, ctx, c)
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Everything is stale but the action of cur, whose output was written
+	// long before, as when an existing output is produced by a new action.
+	oldAction := "action/" + old.actionID[:2] + "/" + old.actionID
+	oldOutput := "output/" + old.outputID[:2] + "/" + old.outputID
+	curOutput := "output/" + cur.outputID[:2] + "/" + cur.outputID
+	past := time.Now().Add(-48 * time.Hour)
+	for _, key := range []string{oldAction, oldOutput, curOutput} {
+		f.setModTime(key, past)
+	}
+
+	var stale []string
+	live, err := c.ScanActions(ctx, time.Now().Add(-24*time.Hour), func(obj s3util.ObjectInfo) {
+		stale = append(stale, obj.Key)
+	})
+	if err != nil {
+		t.Fatalf("ScanActions: %v", err)
+	}
+	if want := []string{oldAction}; !slices.Equal(stale, want) {
+		t.Errorf("Stale actions: got %q, want %q", stale, want)
+	}
+	if got, want := slices.Sorted(maps.Keys(live)), []string{curOutput}; !slices.Equal(got, want) {
+		t.Errorf("Live objects: got %q, want %q", got, want)
+	}
+
+	for key, want := range map[string]string{
+		oldAction: "action",
+		"action/" + cur.actionID[:2] + "/" + cur.actionID: "action",
+		curOutput:                 "output",
+		"ns/team/action/00/00":    "action",
+		"test/00/00":              "test",
+		"module/cache/download/x": "",
+	} {
+		if got := c.EntryKind(key); got != want {
+			t.Errorf("EntryKind(%q): got %q, want %q", key, got, want)
+		}
+	}
+}
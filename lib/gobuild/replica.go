@@ -0,0 +1,223 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+const (
+	// defaultReplicaQueue is the number of copies to a Replica that may wait
+	// when its Queue is not set.
+	defaultReplicaQueue = 1024
+
+	// defaultReplicaConcurrency is the number of concurrent copies to a
+	// Replica when its Concurrency is not set.
+	defaultReplicaConcurrency = 4
+
+	// replicaTimeout bounds each copy to a Replica.
+	replicaTimeout = time.Minute
+
+	// failoverStrikes is the number of reads from the bucket of the cache in
+	// a row that must fail, or be slow, for reads to fail over to a Replica.
+	failoverStrikes = 3
+
+	// defaultFailoverPeriod is how long reads fail over to a Replica when its
+	// FailoverPeriod is not set.
+	defaultFailoverPeriod = 30 * time.Second
+)
+
+// A Replica is a second bucket, usually in another region, to which an
+// [S3Cache] mirrors the entries it writes, and from which it reads when its
+// own bucket fails, so that the cache remains available during an outage of S3
+// in one region (see [S3Cache.Replica]). The replica has the same layout as
+// the bucket of the cache, under the same KeyPrefix.
+//
+// Entries are mirrored in the background once they are written, by copies
+// made within S3, so that their contents are not sent again by the client.
+// Mirroring is best-effort: a copy that fails, or that finds the queue full,
+// is counted and dropped, and the replica may lack entries that the cache
+// has. The credentials of the replica must permit reading the bucket of the
+// cache.
+//
+// A read that fails in the bucket of the cache is retried in the replica.
+// Once several reads in a row fail or are slow (see SlowRead), the bucket of
+// the cache is presumed unhealthy, and for the FailoverPeriod, reads go to the
+// replica first, and to the bucket of the cache only if the replica fails.
+type Replica struct {
+	// S3Client is the client for the replica bucket. It must be non-nil.
+	S3Client *s3util.Client
+
+	// Queue, if positive, is the number of copies that may wait to be made.
+	// If zero or negative, 1024 are allowed.
+	Queue int
+
+	// Concurrency, if positive, is the number of copies made at once. If zero
+	// or negative, 4 are made at once.
+	Concurrency int
+
+	// SlowRead, if positive, is the time to read an action from the bucket of
+	// the cache beyond which the read counts as slow, as if it had failed.
+	// If zero or negative, only failed reads count.
+	SlowRead time.Duration
+
+	// FailoverPeriod, if positive, is how long reads go first to the replica
+	// once the bucket of the cache is presumed unhealthy. If zero or negative,
+	// it is 30s.
+	FailoverPeriod time.Duration
+
+	mu      sync.Mutex
+	strikes int       // reads in a row that failed or were slow
+	until   time.Time // the end of the current failover, if any
+
+	once    sync.Once
+	copies  chan func()
+	pending sync.WaitGroup
+}
+
+func (r *Replica) init() {
+	r.once.Do(func() {
+		r.copies = make(chan func(), cmp.Or(max(r.Queue, 0), defaultReplicaQueue))
+		for range cmp.Or(max(r.Concurrency, 0), defaultReplicaConcurrency) {
+			go func() {
+				for task := range r.copies {
+					task()
+				}
+			}()
+		}
+	})
+}
+
+// add queues task to run in the background, reporting false if the queue
+// is full.
+func (r *Replica) add(task func()) bool {
+	r.init()
+	r.pending.Add(1)
+	select {
+	case r.copies <- func() { defer r.pending.Done(); task() }:
+		return true
+	default:
+		r.pending.Done()
+		return false
+	}
+}
+
+// wait blocks until the copies queued to r are complete, or ctx ends.
+func (r *Replica) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() { defer close(done); r.pending.Wait() }()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// failedOver reports whether reads go to the replica first.
+func (r *Replica) failedOver() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().Before(r.until)
+}
+
+// observe records the outcome of a read of an action from the bucket of the
+// cache, which took elapsed and reported err, starting a failover if this
+// read is the last of failoverStrikes in a row to fail or be slow. It does
+// nothing if r is nil.
+func (r *Replica) observe(elapsed time.Duration, err error) {
+	if r == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	bad := (err != nil && !errors.Is(err, fs.ErrNotExist)) || (r.SlowRead > 0 && elapsed > r.SlowRead)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !bad {
+		r.strikes = 0
+		return
+	}
+	r.strikes++
+	if r.strikes >= failoverStrikes && !time.Now().Before(r.until) {
+		r.until = time.Now().Add(cmp.Or(max(r.FailoverPeriod, 0), defaultFailoverPeriod))
+		r.strikes = 0
+	}
+}
+
+// replicate queues copies of the object and action record at the given keys
+// of S3Client to the Replica, if there is one. The object is copied first, so
+// that the replica does not record an action whose object is missing.
+func (s *S3Cache) replicate(actionID, actionKey, objectKey string) {
+	r := s.Replica
+	if r == nil {
+		return
+	}
+	ok := r.add(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaTimeout)
+		defer cancel()
+		for _, key := range []string{objectKey, actionKey} {
+			if err := r.S3Client.CopyFrom(ctx, s.S3Client, key, key); err != nil {
+				s.putReplicaError.Add(1)
+				s.logger().Warn("s3 replica copy failed", "action", actionID, "key", key, "err", err)
+				return
+			}
+		}
+		s.putReplica.Add(1)
+	})
+	if !ok {
+		s.putReplicaDropped.Add(1)
+	}
+}
+
+// getS3Failover is as getS3From for S3Client, but if there is a Replica, it
+// reads the action from the replica when S3Client fails, or first while reads
+// have failed over (see [Replica]). If both fail, it reports the error of the
+// first read. Hits are counted by the region that served them.
+func (s *S3Cache) getS3Failover(ctx context.Context, actionPrefix, outputPrefix, actionID string) (remoteHit, error) {
+	r := s.Replica
+	clients := []*s3util.Client{s.S3Client}
+	if r != nil {
+		if r.failedOver() {
+			clients = []*s3util.Client{r.S3Client, s.S3Client}
+		} else {
+			clients = append(clients, r.S3Client)
+		}
+	}
+	var first error
+	for i, client := range clients {
+		if i > 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			s.getFailover.Add(1)
+		}
+		hit, err := s.getS3From(ctx, client, actionPrefix, outputPrefix, actionID)
+		if err != nil {
+			first = cmp.Or(first, err)
+			continue
+		}
+		if hit.outputID != "" {
+			if client != s.S3Client {
+				s.getReplicaHit.Add(1)
+			}
+			s.getByRegion.Add(client.Client.Options().Region, 1)
+		}
+		return hit, nil
+	}
+	return remoteHit{}, first
+}
+
+// RegionMetrics returns a map of the counts of Get hits faulted in from S3 by
+// the region of the bucket that served them, the bucket of the cache or the
+// Replica. Published with a name of the form "counter_labelmap_region_<name>",
+// it is exported by the Prometheus handler of tsweb as a counter with a
+// "region" label.
+func (s *S3Cache) RegionMetrics() *expvar.Map { return &s.getByRegion }
@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// ScrubOptions are the settings for [S3Cache.Scrub].
+type ScrubOptions struct {
+	// Refetch, if true, means each action removed because its object was
+	// missing or corrupt is read again from S3, and the copy read verified.
+	Refetch bool
+
+	// DryRun, if true, means problems are reported, but nothing is removed
+	// or read again from S3.
+	DryRun bool
+}
+
+// ScrubStats are the totals reported by [S3Cache.Scrub].
+type ScrubStats struct {
+	Actions   int64            // the number of local actions examined
+	Objects   int64            // the number of local objects hashed
+	Removed   int64            // the number of actions removed
+	Refetched int64            // the number of removed actions read again from S3
+	Errors    int64            // the number of actions that could not be removed or read again
+	Problems  map[string]int64 // the number of problems found, by kind
+	Elapsed   time.Duration    // how long the scrub took
+}
+
+// Scrub re-hashes the objects of the local cache directory rooted at root,
+// which must be the directory managed by s.Local, and compares each with the
+// output ID and size recorded by the actions that refer to it. It calls report
+// for each problem found, with the local path of the file at fault, and
+// removes the actions with problems, along with their corrupt objects, so
+// that they are misses rather than wrong results. With opts.Refetch, each
+// action removed is read again from S3.
+//
+// Scrub is safe to run while other processes use the cache directory: an
+// action rewritten since it was read is left alone. It reports an error only
+// if it cannot read the cache directory; problems are reported via report.
+func (s *S3Cache) Scrub(ctx context.Context, root string, opts ScrubOptions, report func(Problem)) (ScrubStats, error) {
+	start := time.Now()
+	stats := ScrubStats{Problems: make(map[string]int64)}
+	var mu sync.Mutex // protects stats and calls to report
+	problem := func(p Problem) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Problems[p.Kind]++
+		report(p)
+	}
+	count := func(p *int64) { mu.Lock(); defer mu.Unlock(); *p++ }
+	actionPath := func(id string) string { return filepath.Join(root, "action", id[:2], id) }
+	objectPath := func(id string) string { return filepath.Join(root, "output", id[:2], id) }
+
+	// removeAction removes the action with the given ID, unless it has been
+	// rewritten since it was found to refer to outputID.
+	removeAction := func(actionID, outputID string) bool {
+		if opts.DryRun {
+			return false
+		}
+		if cur, _, err := readLocalAction(actionPath(actionID)); err == nil && cur != outputID {
+			return false // rewritten since it was read
+		}
+		if err := os.Remove(actionPath(actionID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logger().Warn("scrub: remove action failed", "action", actionID, "err", err)
+			count(&stats.Errors)
+			return false
+		}
+		count(&stats.Removed)
+		return true
+	}
+
+	// Read all the actions before hashing their objects, so that an object
+	// referred to by several actions is hashed once.
+	byOutput := make(map[string][]string) // output ID → action IDs
+	werr := filepath.WalkDir(filepath.Join(root, "action"), func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if !de.Type().IsRegular() || len(de.Name()) < 2 {
+			return nil
+		}
+		stats.Actions++
+		outputID, _, err := readLocalAction(path)
+		if err == nil && !isHexDigest(outputID) {
+			err = fmt.Errorf("invalid output ID %q", outputID)
+		}
+		if err != nil {
+			problem(Problem{Kind: ProblemCorrupt, Key: path, Detail: err.Error()})
+			removeAction(de.Name(), "")
+			return nil
+		}
+		byOutput[outputID] = append(byOutput[outputID], de.Name())
+		return nil
+	})
+	if errors.Is(werr, fs.ErrNotExist) {
+		werr = nil // no actions have been stored yet
+	}
+
+	g, run := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	for outputID, actionIDs := range byOutput {
+		if werr != nil {
+			break
+		}
+		run(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+			opath := objectPath(outputID)
+			sum, size, err := fileDigest(opath)
+			if errors.Is(err, fs.ErrNotExist) {
+				for _, id := range actionIDs {
+					problem(Problem{Kind: ProblemMissing, Key: actionPath(id), Detail: "object " + outputID + " not found"})
+				}
+			} else if err != nil {
+				s.logger().Warn("scrub: read object failed", "object", outputID, "err", err)
+				count(&stats.Errors)
+				return nil
+			} else {
+				count(&stats.Objects)
+				if sum != outputID {
+					problem(Problem{Kind: ProblemMismatch, Key: opath, Detail: "content digest is " + sum})
+					if !opts.DryRun {
+						if err := os.Remove(opath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+							s.logger().Warn("scrub: remove object failed", "object", outputID, "err", err)
+						}
+					}
+				} else {
+					// The object is intact: remove only the actions that
+					// record the wrong size for it.
+					var bad []string
+					for _, id := range actionIDs {
+						if _, want, err := readLocalAction(actionPath(id)); err == nil && want != size {
+							problem(Problem{Kind: ProblemMismatch, Key: actionPath(id),
+								Detail: fmt.Sprintf("records size %d, object has %d bytes", want, size)})
+							bad = append(bad, id)
+						}
+					}
+					actionIDs = bad
+				}
+			}
+
+			for _, id := range actionIDs {
+				if !removeAction(id, outputID) || !opts.Refetch {
+					continue
+				}
+				ok, err := s.scrubRefetch(ctx, id)
+				if err != nil {
+					s.logger().Warn("scrub: refetch failed", "action", id, "err", err)
+					count(&stats.Errors)
+				} else if ok {
+					count(&stats.Refetched)
+				}
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	stats.Elapsed = time.Since(start)
+	if werr != nil {
+		return stats, fmt.Errorf("read actions: %w", werr)
+	}
+	return stats, ctx.Err()
+}
+
+// scrubRefetch reads actionID again from S3 into the local cache, and verifies
+// the object read. It reports whether the action was found. An object that
+// does not match its output ID is removed, and reported as an error.
+func (s *S3Cache) scrubRefetch(ctx context.Context, actionID string) (bool, error) {
+	hit, err := s.getS3(ctx, actionID, new(opTiming))
+	if err != nil || hit.outputID == "" {
+		return false, err
+	}
+	if sum, _, err := fileDigest(hit.diskPath); err != nil {
+		return false, err
+	} else if sum != hit.outputID {
+		os.Remove(hit.diskPath)
+		return false, fmt.Errorf("object %s from %s has digest %s", hit.outputID, hit.origin, sum)
+	}
+	return true, nil
+}
+
+// fileDigest returns the hex-encoded SHA-256 digest and the size of the file
+// at path.
+func fileDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import "time"
+
+// SessionStats are the totals of the work done by an [S3Cache] since it was
+// created, for a summary of whether the cache helped a build.
+type SessionStats struct {
+	Hits       int64         // the number of Get requests that hit in any tier
+	Misses     int64         // the number of Get requests that missed in every tier
+	Downloaded int64         // the number of object bytes faulted in from peers and S3
+	Uploaded   int64         // the number of object bytes written to S3
+	FetchTime  time.Duration // the total time Get spent on peers and S3
+	Built      int64         // the number of misses whose build time was measured
+	BuildTime  time.Duration // the total time between those misses and their Puts
+}
+
+// TimeSaved estimates the build time the cache saved: the hits, each costing
+// the mean time the go command took to build an action it missed, less the
+// time spent fetching remote hits. The estimate is rough, since the actions
+// that hit need not take as long to build as those that missed. It is zero if
+// no build time was measured.
+func (s SessionStats) TimeSaved() time.Duration {
+	if s.Built == 0 {
+		return 0
+	}
+	saved := time.Duration(s.Hits)*(s.BuildTime/time.Duration(s.Built)) - s.FetchTime
+	return max(saved, 0)
+}
+
+// add returns the sum of s and o.
+func (s SessionStats) add(o SessionStats) SessionStats {
+	return SessionStats{
+		Hits:       s.Hits + o.Hits,
+		Misses:     s.Misses + o.Misses,
+		Downloaded: s.Downloaded + o.Downloaded,
+		Uploaded:   s.Uploaded + o.Uploaded,
+		FetchTime:  s.FetchTime + o.FetchTime,
+		Built:      s.Built + o.Built,
+		BuildTime:  s.BuildTime + o.BuildTime,
+	}
+}
+
+// SessionStats returns the totals of the work done by s since it was
+// created, including that of the alternate cache of its Canary, if any.
+func (s *S3Cache) SessionStats() SessionStats {
+	st := s.GetStats()
+	out := SessionStats{
+		Hits:       st.Hits,
+		Misses:     st.Total() - st.Hits,
+		Downloaded: s.getRemoteBytes.Value(),
+		Uploaded:   s.putS3ObjectB.Value(),
+		FetchTime:  time.Duration(s.getPeerTime.Value()+s.getS3Time.Value()) * time.Microsecond,
+		Built:      s.putBuilt.Value(),
+		BuildTime:  time.Duration(s.putBuildTime.Value()) * time.Microsecond,
+	}
+	if s.Canary != nil && s.Canary.Cache != nil {
+		out = out.add(s.Canary.Cache.SessionStats())
+	}
+	return out
+}
+
+// maxMissTimes is the maximum number of misses remembered so that the time
+// to build them can be measured when they are stored.
+const maxMissTimes = 1 << 14
+
+// noteMiss remembers when actionID missed, so that the time the go command
+// took to build it can be measured by noteBuilt.
+func (s *S3Cache) noteMiss(actionID string) {
+	s.missTimes.Put(actionID, time.Now())
+}
+
+// noteBuilt counts the time since actionID missed, if it did recently.
+func (s *S3Cache) noteBuilt(actionID string) {
+	if at, ok := s.missTimes.Get(actionID); ok {
+		s.missTimes.Remove(actionID)
+		s.putBuilt.Add(1)
+		s.putBuildTime.Add(time.Since(at).Microseconds())
+	}
+}
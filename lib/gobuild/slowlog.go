@@ -0,0 +1,153 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A SlowLog retains the slowest Get and Put operations handled by an
+// [S3Cache], with a breakdown of where the time was spent, to help with
+// investigating tail latency.
+//
+// A SlowLog is an [expvar.Var], whose value is a JSON array of the retained
+// operations (see [SlowOp]), slowest first. It is also an [http.Handler] that
+// serves the same array.
+type SlowLog struct {
+	mu  sync.Mutex
+	max int
+	ops []SlowOp // in descending order of elapsed time
+}
+
+// NewSlowLog constructs a slow log that retains the n slowest operations.
+// It will panic if n <= 0.
+func NewSlowLog(n int) *SlowLog {
+	if n <= 0 {
+		panic("slow log size must be positive")
+	}
+	return &SlowLog{max: n}
+}
+
+// SlowOp is a single operation recorded in a [SlowLog].
+//
+// For a Get, Disk is the time spent looking up the local cache, and Peer and
+// S3 are the times spent fetching from peers and S3, including writing what
+// was fetched to the local cache. For a Put, Disk is the time spent writing
+// the local cache, Queue is the time the upload waited to start, and S3 is the
+// time spent writing to S3. The elapsed time of a Put runs until its upload is
+// complete.
+type SlowOp struct {
+	Time     time.Time     // when the operation started
+	Op       string        // "get" or "put"
+	ActionID string        // the action ID
+	OutputID string        // the output ID, if known
+	Source   string        // for a get, where it was found ("" for a miss)
+	Size     int64         // for a put, the size of the object in bytes
+	Elapsed  time.Duration // the total elapsed time
+	Queue    time.Duration // time spent waiting to start
+	Disk     time.Duration // time spent on the local cache
+	Peer     time.Duration // time spent on peers
+	S3       time.Duration // time spent on S3
+	Err      string        // the error reported, if any
+}
+
+// MarshalJSON encodes o as a JSON object, with durations in milliseconds.
+func (o SlowOp) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return json.Marshal(struct {
+		Time     time.Time `json:"time"`
+		Op       string    `json:"op"`
+		ActionID string    `json:"action"`
+		OutputID string    `json:"output,omitempty"`
+		Source   string    `json:"source,omitempty"`
+		Size     int64     `json:"size,omitempty"`
+		Elapsed  float64   `json:"elapsed_ms"`
+		Queue    float64   `json:"queue_ms"`
+		Disk     float64   `json:"disk_ms"`
+		Peer     float64   `json:"peer_ms"`
+		S3       float64   `json:"s3_ms"`
+		Err      string    `json:"err,omitempty"`
+	}{
+		o.Time.UTC(), o.Op, o.ActionID, o.OutputID, o.Source, o.Size,
+		ms(o.Elapsed), ms(o.Queue), ms(o.Disk), ms(o.Peer), ms(o.S3), o.Err,
+	})
+}
+
+// Ops returns a copy of the operations retained by l, slowest first.
+func (l *SlowLog) Ops() []SlowOp {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.ops)
+}
+
+// Reset discards all the operations retained by l.
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ops = nil
+}
+
+// String implements the [expvar.Var] interface.
+func (l *SlowLog) String() string {
+	data, _ := json.Marshal(l.Ops())
+	return string(data)
+}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (l *SlowLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(l.String()))
+}
+
+// add records op in l, if it is among the slowest.
+func (l *SlowLog) add(op SlowOp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ops) == l.max && op.Elapsed <= l.ops[len(l.ops)-1].Elapsed {
+		return // not slow enough to keep
+	}
+	i, _ := slices.BinarySearchFunc(l.ops, op.Elapsed, func(o SlowOp, d time.Duration) int {
+		if o.Elapsed > d {
+			return -1
+		} else if o.Elapsed < d {
+			return 1
+		}
+		return 0
+	})
+	l.ops = slices.Insert(l.ops, i, op)
+	if len(l.ops) > l.max {
+		l.ops = l.ops[:l.max]
+	}
+}
+
+// opTiming accumulates the time an operation spends in each stage.
+type opTiming struct {
+	queue, disk, peer, s3 time.Duration
+}
+
+// since adds the time elapsed since start to *d, and returns the current time
+// so that the next stage can be timed from it.
+func since(d *time.Duration, start time.Time) time.Time {
+	now := time.Now()
+	*d += now.Sub(start)
+	return now
+}
+
+// slowLog records an operation in the slow log of s, if it has one.
+func (s *S3Cache) slowLog(op SlowOp, start time.Time, t *opTiming, err error) {
+	if s.SlowLog == nil {
+		return
+	}
+	op.Time = start
+	op.Elapsed = time.Since(start)
+	op.Queue, op.Disk, op.Peer, op.S3 = t.queue, t.disk, t.peer, t.s3
+	if err != nil {
+		op.Err = err.Error()
+	}
+	s.SlowLog.add(op)
+}
@@ -0,0 +1,206 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"expvar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/creachadair/mds/mapset"
+)
+
+// A Spill is a larger, slower local cache directory, such as one on an HDD
+// or an EBS volume, behind the Local directory of an [S3Cache], which is then
+// the fast tier, such as one on tmpfs or NVMe.
+//
+// Put stores entries in the fast tier. Get looks for an entry in the fast
+// tier, then in the spill tier, before the remote tiers. An entry found in
+// the spill tier is promoted (copied to the fast tier) if it was also found
+// there within the PromoteWindow, so that entries used often are served from
+// the fast tier; otherwise it is served from the spill tier. [S3Cache.Demote]
+// moves the entries of the fast tier not used within the DemoteAge to the
+// spill tier. The use of an entry is recorded in the modification time of its
+// action file.
+type Spill struct {
+	// Dir is the spill directory. It must be non-nil.
+	Dir *cachedir.Dir
+
+	// Root is the path of the directory managed by Dir.
+	Root string
+
+	// LocalRoot is the path of the directory managed by the Local directory
+	// of the cache, the fast tier.
+	LocalRoot string
+
+	// PromoteWindow is the period within which a second use of an entry in
+	// the spill tier promotes it. If zero, the default is one hour.
+	PromoteWindow time.Duration
+
+	// DemoteAge is the period beyond which an entry of the fast tier not
+	// used is demoted. If zero, the default is one hour.
+	DemoteAge time.Duration
+
+	hits      expvar.Int // count of Get hits in the spill tier
+	promoted  expvar.Int // count of entries copied to the fast tier
+	demoted   expvar.Int // count of entries moved to the spill tier
+	demotedB  expvar.Int // count of object bytes moved to the spill tier
+	demoteErr expvar.Int // count of entries that could not be moved
+}
+
+// Metrics returns a map of the metrics of p.
+func (p *Spill) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("get_spill_hit", &p.hits)
+	m.Set("spill_promoted", &p.promoted)
+	m.Set("spill_demoted", &p.demoted)
+	m.Set("spill_demoted_bytes", &p.demotedB)
+	m.Set("spill_demote_error", &p.demoteErr)
+	return m
+}
+
+// get looks for actionID in the spill tier, and reports whether it was found.
+// An entry used twice within the PromoteWindow is copied to the fast tier, and
+// its path there is reported.
+func (p *Spill) get(ctx context.Context, s *S3Cache, actionID string) (outputID, diskPath string, ok bool) {
+	if p == nil {
+		return "", "", false
+	}
+	outputID, diskPath, err := p.Dir.Get(ctx, actionID)
+	if err != nil || outputID == "" || diskPath == "" {
+		return "", "", false
+	}
+	p.hits.Add(1)
+	apath := filepath.Join(p.Root, "action", actionID[:2], actionID)
+	now := time.Now()
+	fi, err := os.Stat(apath)
+	recent := err == nil && now.Sub(fi.ModTime()) < cmp.Or(p.PromoteWindow, time.Hour)
+	os.Chtimes(apath, time.Time{}, now) // best-effort
+	if !recent || s.DiskWatch.Low() {
+		return outputID, diskPath, true
+	}
+
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return outputID, diskPath, true
+	}
+	defer f.Close()
+	ofi, err := f.Stat()
+	if err != nil {
+		return outputID, diskPath, true
+	}
+	fastPath, err := s.Local.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     ofi.Size(),
+		Body:     f,
+		ModTime:  ofi.ModTime(),
+	})
+	if err != nil {
+		s.logger().Debug("spill: promote failed", "action", actionID, "err", err)
+		return outputID, diskPath, true
+	}
+	p.promoted.Add(1)
+	return outputID, fastPath, true
+}
+
+// touch records a use of actionID in the fast tier, so that it is not demoted.
+func (p *Spill) touch(actionID string) {
+	if p != nil {
+		os.Chtimes(filepath.Join(p.LocalRoot, "action", actionID[:2], actionID), time.Time{}, time.Now()) // best-effort
+	}
+}
+
+// DemoteStats report the results of a call to [S3Cache.Demote].
+type DemoteStats struct {
+	Actions int64         // the number of fast actions examined
+	Demoted int64         // the number of actions moved to the spill tier
+	Bytes   int64         // the number of object bytes moved to the spill tier
+	Errors  int64         // the number of actions that could not be moved
+	Elapsed time.Duration // how long the demotion took
+}
+
+// Demote moves the entries of the fast tier of s not used within the
+// DemoteAge of its Spill to the spill tier. Objects are copied to the spill
+// tier only if they are not already present there. Demote does nothing if s
+// has no Spill.
+func (s *S3Cache) Demote(ctx context.Context) (DemoteStats, error) {
+	var stats DemoteStats
+	p := s.Spill
+	if p == nil {
+		return stats, nil
+	}
+	start := time.Now()
+	cutoff := start.Add(-cmp.Or(p.DemoteAge, time.Hour))
+
+	var keep, moved mapset.Set[string] // output IDs of kept and demoted actions
+	err := filepath.WalkDir(filepath.Join(p.LocalRoot, "action"), func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if !de.Type().IsRegular() || len(de.Name()) < 2 {
+			return nil
+		}
+		stats.Actions++
+		outputID, size, err := readLocalAction(path)
+		if err != nil || len(outputID) < 2 {
+			return nil // leave invalid actions to the cleanup
+		}
+		if fi, err := de.Info(); err != nil || fi.ModTime().After(cutoff) {
+			keep.Add(outputID)
+			return nil
+		}
+		if err := p.demote(ctx, de.Name(), outputID, size); err != nil {
+			s.logger().Debug("spill: demote failed", "action", de.Name(), "err", err)
+			p.demoteErr.Add(1)
+			stats.Errors++
+			keep.Add(outputID)
+			return nil
+		}
+		os.Remove(path)
+		moved.Add(outputID)
+		p.demoted.Add(1)
+		p.demotedB.Add(size)
+		stats.Demoted++
+		stats.Bytes += size
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil // no actions have been stored yet
+	}
+
+	// Remove the objects of the fast tier no longer referred to by its
+	// actions. Objects shared with actions that were kept stay.
+	for id := range moved {
+		if !keep.Has(id) {
+			os.Remove(filepath.Join(p.LocalRoot, "output", id[:2], id))
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	return stats, err
+}
+
+// demote copies the entry for actionID from the fast tier to the spill tier.
+func (p *Spill) demote(ctx context.Context, actionID, outputID string, size int64) error {
+	f, err := os.Open(filepath.Join(p.LocalRoot, "output", outputID[:2], outputID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = p.Dir.Put(ctx, gocache.Object{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     size,
+		Body:     f,
+	})
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Policies for storing the test results cached by "go test" in S3 (see
+// [S3Cache.TestResults]).
+const (
+	// TestShared stores test results like other entries.
+	TestShared = "shared"
+
+	// TestSeparate stores the objects of test results under their own kind,
+	// "test" in place of "output", so that they may be expired separately (as
+	// by a lifecycle rule on the bucket, or TestTTL). Their action records
+	// are marked so that readers find the objects; servers older than this
+	// policy report such records as invalid.
+	TestSeparate = "separate"
+
+	// TestLocal keeps test results in the local cache only, and does not
+	// write them to S3.
+	TestLocal = "local"
+)
+
+// ParseTestPolicy checks that name is a valid policy for test results, and
+// returns it. An empty name is [TestShared].
+func ParseTestPolicy(name string) (string, error) {
+	switch name {
+	case "", TestShared:
+		return TestShared, nil
+	case TestSeparate, TestLocal:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown test result policy %q (want %s, %s, or %s)", name, TestShared, TestSeparate, TestLocal)
+}
+
+// testLogMagic begins the log of the inputs of a test, which "go test" caches
+// along with its output (see cmd/go/internal/test).
+const testLogMagic = "# test log\n"
+
+// testOutputMarker begins the last line of the cached output of a test that
+// passed, which "go test" requires to reuse it.
+const testOutputMarker = "ok  \t"
+
+// maxTestLine bounds the length of the last line of test output examined by
+// isTestResult. The line names the package, its run time, and coverage.
+const maxTestLine = 4096
+
+// isTestResult reports whether the object of the given size at diskPath is a
+// test result cached by "go test": either the log of the inputs of a test, or
+// its output. These have no marker besides their content, so isTestResult
+// recognizes them by the formats of the go command.
+func isTestResult(diskPath string, size int64) bool {
+	if size < int64(len(testLogMagic)) {
+		return false
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, len(testLogMagic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	} else if string(head) == testLogMagic {
+		return true
+	}
+	tail := make([]byte, min(size, maxTestLine))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return false
+	} else if !bytes.HasSuffix(tail, []byte("\n")) {
+		return false
+	}
+	last := tail[bytes.LastIndexByte(tail[:len(tail)-1], '\n')+1:]
+	return bytes.HasPrefix(last, []byte(testOutputMarker))
+}
+
+// objectKind returns the kind of the key of an object stored in S3, given
+// whether it is a test result.
+func (s *S3Cache) objectKind(test bool) string {
+	if test && s.TestResults == TestSeparate {
+		return "test"
+	}
+	return "output"
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Read tiers consulted by [S3Cache.Get].
+const (
+	TierMemory = "memory" // recent lookups retained in memory (see MemoryEntries)
+	TierLocal  = "local"  // the local cache directory
+	TierPeer   = "peer"   // peer cache servers (see Peers)
+	TierS3     = "s3"     // the S3 bucket
+)
+
+// defaultTiers are the tiers consulted when no [ReadPolicy] applies.
+var defaultTiers = []string{TierMemory, TierLocal, TierPeer, TierS3}
+
+// ParseReadTiers parses a comma-separated list of read tiers, such as
+// "memory,local,s3". Each tier may be listed at most once. The local tiers
+// (memory and local) must precede the remote tiers (peer and s3), since what
+// is found remotely is stored locally.
+func ParseReadTiers(s string) ([]string, error) {
+	var tiers []string
+	remote := false
+	for t := range strings.SplitSeq(s, ",") {
+		t = strings.TrimSpace(t)
+		switch t {
+		case TierMemory, TierLocal:
+			if remote {
+				return nil, fmt.Errorf("tier %q must precede the remote tiers", t)
+			}
+		case TierPeer, TierS3:
+			remote = true
+		default:
+			return nil, fmt.Errorf("unknown read tier %q", t)
+		}
+		if slices.Contains(tiers, t) {
+			return nil, fmt.Errorf("duplicate read tier %q", t)
+		}
+		tiers = append(tiers, t)
+	}
+	if len(tiers) == 0 {
+		return nil, errors.New("no read tiers")
+	}
+	return tiers, nil
+}
+
+// A ReadPolicy selects the tiers consulted by [S3Cache.Get], and their order,
+// for the requests of a single build. A policy is attached to the context of
+// a cache server with [WithReadPolicy]. A latency-sensitive build may skip
+// slow tiers, for example, while a batch build uses all of them.
+//
+// A zero ReadPolicy consults the default tiers, in the order memory, local,
+// peer, s3. Its tiers may be changed while it is in use, and the change
+// applies to subsequent requests.
+type ReadPolicy struct {
+	tiers atomic.Pointer[[]string]
+}
+
+// SetTiers sets the tiers consulted by p, in order. An empty list restores the
+// default tiers. The list should be valid as for [ParseReadTiers].
+func (p *ReadPolicy) SetTiers(tiers []string) {
+	if len(tiers) == 0 {
+		p.tiers.Store(nil)
+		return
+	}
+	tiers = slices.Clone(tiers)
+	p.tiers.Store(&tiers)
+}
+
+// Tiers returns the tiers consulted by p, in order.
+func (p *ReadPolicy) Tiers() []string {
+	if t := p.tiers.Load(); t != nil {
+		return *t
+	}
+	return defaultTiers
+}
+
+type readPolicyKey struct{}
+
+// WithReadPolicy returns a child of ctx with the specified read policy attached.
+func WithReadPolicy(ctx context.Context, p *ReadPolicy) context.Context {
+	return context.WithValue(ctx, readPolicyKey{}, p)
+}
+
+// readTiers returns the local and remote tiers to consult for a request with
+// the given context, and counts the tiers it skips.
+func (s *S3Cache) readTiers(ctx context.Context) (local, remote []string) {
+	tiers := defaultTiers
+	if p, ok := ctx.Value(readPolicyKey{}).(*ReadPolicy); ok && p != nil {
+		tiers = p.Tiers()
+	}
+	for _, t := range tiers {
+		switch t {
+		case TierMemory, TierLocal:
+			local = append(local, t)
+		case TierPeer, TierS3:
+			remote = append(remote, t)
+		}
+	}
+	if len(tiers) != len(defaultTiers) {
+		for _, t := range defaultTiers {
+			if !slices.Contains(tiers, t) {
+				s.skipCounter(t).Add(1)
+			}
+		}
+	}
+	return local, remote
+}
+
+// skipCounter returns the metric counting requests that skipped tier.
+func (s *S3Cache) skipCounter(tier string) *expvar.Int {
+	switch tier {
+	case TierMemory:
+		return &s.getSkipMemory
+	case TierLocal:
+		return &s.getSkipLocal
+	case TierPeer:
+		return &s.getSkipPeer
+	default:
+		return &s.getSkipS3
+	}
+}
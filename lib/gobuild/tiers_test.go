@@ -0,0 +1,84 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/gobuild"
+	"github.com/grafana/go-cache-plugin/lib/peer"
+)
+
+// withTiers returns a child of ctx that reads only the given tiers.
+func withTiers(ctx context.Context, tiers ...string) context.Context {
+	p := new(gobuild.ReadPolicy)
+	p.SetTiers(tiers)
+	return gobuild.WithReadPolicy(ctx, p)
+}
+
+func TestReadTiers(t *testing.T) {
+	f := newFakeS3(t)
+	ctx := context.Background()
+	e := newEntry("tiers", "found in every tier")
+
+	// The writer has the entry in memory, on disk, and in S3.
+	root := t.TempDir()
+	w := newTestCacheIn(t, f, root)
+	w.MemoryEntries = 10
+	e.put(t, ctx, w)
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		e.checkGet(t, withTiers(ctx, gobuild.TierMemory), w)
+
+		// Another cache on the same directory has nothing in memory yet.
+		c := newTestCacheIn(t, f, root)
+		c.MemoryEntries = 10
+		e.checkMiss(t, withTiers(ctx, gobuild.TierMemory), c)
+	})
+	t.Run("Local", func(t *testing.T) {
+		c := newTestCacheIn(t, f, root)
+		e.checkGet(t, withTiers(ctx, gobuild.TierLocal), c)
+		e.checkMiss(t, withTiers(ctx, gobuild.TierLocal), newTestCache(t, f))
+	})
+	t.Run("Peer", func(t *testing.T) {
+		mux := http.NewServeMux()
+		key := []byte("peer key")
+		mux.Handle("/peer/", peer.Handler{Local: w.Local, Key: key})
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		// The reader's bucket is empty, so a hit must come from the peer.
+		c := newTestCache(t, newFakeS3(t))
+		c.Peers = &peer.Client{
+			Peers: func() []string { return []string{strings.TrimPrefix(srv.URL, "http://")} },
+			Key:   key,
+		}
+		e.checkGet(t, withTiers(ctx, gobuild.TierPeer), c)
+
+		// What is found remotely is stored locally.
+		e.checkGet(t, withTiers(ctx, gobuild.TierLocal), c)
+	})
+	t.Run("S3", func(t *testing.T) {
+		c := newTestCache(t, f)
+		e.checkMiss(t, withTiers(ctx, gobuild.TierLocal), c)
+		e.checkGet(t, withTiers(ctx, gobuild.TierS3), c)
+		e.checkGet(t, withTiers(ctx, gobuild.TierLocal), c)
+	})
+	t.Run("Skipped", func(t *testing.T) {
+		// A policy without S3 does not consult it, even on a miss.
+		c := newTestCache(t, f)
+		before := len(f.requests())
+		e.checkMiss(t, withTiers(ctx, gobuild.TierMemory, gobuild.TierLocal), c)
+		if got := f.requests()[before:]; len(got) != 0 {
+			t.Errorf("Requests to S3: got %q, want none", got)
+		}
+	})
+}
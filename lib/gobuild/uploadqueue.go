@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+)
+
+// Policies for a full upload queue (see [S3Cache.UploadDrop]).
+const (
+	// DropNewest drops the upload being added to a full queue.
+	DropNewest = "newest"
+
+	// DropOldest drops the upload that has waited longest in a full queue, to
+	// make room for the one being added.
+	DropOldest = "oldest"
+
+	// DropNone drops no uploads: Put waits for room in a full queue, so that
+	// a slow S3 slows the build instead.
+	DropNone = "block"
+)
+
+// ParseDropPolicy checks that name is a valid policy for a full upload queue,
+// and returns it. An empty name is [DropNewest].
+func ParseDropPolicy(name string) (string, error) {
+	switch name {
+	case "":
+		return DropNewest, nil
+	case DropNewest, DropOldest, DropNone:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown drop policy %q (want %s, %s, or %s)", name, DropNewest, DropOldest, DropNone)
+}
+
+// errUploadDropped is recorded in the slow log for an upload that was dropped
+// from a full queue.
+var errUploadDropped = errors.New("upload dropped: queue full")
+
+// An uploadQueue holds uploads to S3 waiting for a worker, so that Put need
+// not wait for one. A single feeder goroutine, running while the queue is not
+// empty, hands the uploads to the workers in order.
+type uploadQueue struct {
+	start  func(taskgroup.Task) // start a task on a worker, waiting for one if all are busy
+	max    int
+	policy string
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when an upload leaves the queue (for DropNone)
+	items   []queuedUpload
+	feeding bool
+	fed     sync.WaitGroup // the feeder, while it runs
+
+	depth expvar.Int // the number of uploads waiting
+}
+
+// A queuedUpload is an upload waiting in an uploadQueue.
+type queuedUpload struct {
+	run    taskgroup.Task
+	drop   func() // called instead of run if the upload is dropped
+	queued time.Time
+}
+
+func newUploadQueue(start func(taskgroup.Task), max int, policy string) *uploadQueue {
+	q := &uploadQueue{start: start, max: max, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// add adds an upload to q, which runs task unless it is dropped under the
+// policy of q, in which case drop is called instead.
+func (q *uploadQueue) add(task taskgroup.Task, drop func()) {
+	var dropped func() // called after q is unlocked
+	defer func() {
+		if dropped != nil {
+			dropped()
+		}
+	}()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) >= q.max && q.policy == DropNone {
+		q.cond.Wait()
+	}
+	if len(q.items) >= q.max {
+		if q.policy != DropOldest {
+			dropped = drop
+			return
+		}
+		dropped = q.items[0].drop
+		q.items[0] = queuedUpload{}
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, queuedUpload{run: task, drop: drop, queued: time.Now()})
+	q.depth.Set(int64(len(q.items)))
+	if !q.feeding {
+		q.feeding = true
+		q.fed.Add(1)
+		go q.feed()
+	}
+}
+
+// feed hands the uploads in q to the workers until q is empty.
+func (q *uploadQueue) feed() {
+	defer q.fed.Done()
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.feeding = false
+			q.mu.Unlock()
+			return
+		}
+		u := q.items[0]
+		q.items[0] = queuedUpload{}
+		q.items = q.items[1:]
+		q.depth.Set(int64(len(q.items)))
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		q.start(u.run)
+	}
+}
+
+// wait blocks until every upload in q has been handed to a worker.
+func (q *uploadQueue) wait() { q.fed.Wait() }
+
+// lag reports how long the oldest upload in q has waited.
+func (q *uploadQueue) lag() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return 0
+	}
+	return time.Since(q.items[0].queued)
+}
+
+// enqueue starts an upload task, or adds it to the UploadQueue if there is
+// one. If the upload is dropped from a full queue, drop is called instead.
+func (s *S3Cache) enqueue(task taskgroup.Task, drop func()) {
+	if s.queue == nil {
+		s.start(task)
+		return
+	}
+	s.queue.add(task, drop)
+}
+
+// QueueDepth returns a metric of the number of uploads waiting in the
+// UploadQueue. Published with a name of the form "gauge_<name>", it is
+// exported by the Prometheus handler of tsweb as a gauge.
+func (s *S3Cache) QueueDepth() expvar.Var {
+	return expvar.Func(func() any {
+		if q := s.uploadQueue(); q != nil {
+			return q.depth.Value()
+		}
+		return int64(0)
+	})
+}
+
+// QueueLag returns a metric of how long, in seconds, the oldest upload in the
+// UploadQueue has waited for a worker. Published with a name of the form
+// "gauge_<name>", it is exported by the Prometheus handler of tsweb as a
+// gauge.
+func (s *S3Cache) QueueLag() expvar.Var {
+	return expvar.Func(func() any {
+		if q := s.uploadQueue(); q != nil {
+			return q.lag().Seconds()
+		}
+		return 0.0
+	})
+}
+
+func (s *S3Cache) uploadQueue() *uploadQueue {
+	s.init()
+	return s.queue
+}
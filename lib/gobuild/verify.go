@@ -0,0 +1,181 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package gobuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// Kinds of problems reported by [S3Cache.Verify], in addition to those of
+// [S3Cache.Check].
+const (
+	ProblemUnsynced = "unsynced" // a local action not stored in S3
+	ProblemDrift    = "drift"    // an action whose local and remote output IDs differ
+)
+
+// VerifyOptions are the settings for [S3Cache.Verify].
+type VerifyOptions struct {
+	// Sample, if positive, is the number of local actions chosen at random
+	// to compare with S3. Otherwise, every local action is compared.
+	Sample int
+
+	// Digest, if true, means each remote object compared is read, and its
+	// SHA-256 digest compared with its output ID. Otherwise, only the size of
+	// the remote object is compared, where S3 stores objects as they are.
+	Digest bool
+
+	// Orphans, if true, means the remote objects not referenced by any action
+	// in S3 are also reported, as by [S3Cache.Check]. This reads every action
+	// stored in S3, not only those in the local cache.
+	Orphans bool
+
+	// MinAge is the age below which an unreferenced remote object is not
+	// reported as an orphan (see [CheckOptions]).
+	MinAge time.Duration
+}
+
+// VerifyStats are the totals reported by [S3Cache.Verify].
+type VerifyStats struct {
+	Local    int64            // the number of local actions found
+	Compared int64            // the number of local actions compared with S3
+	Matched  int64            // the number of actions compared that matched S3
+	Skipped  int64            // the number of actions not uploaded by policy, as by Sync
+	Verified int64            // the number of remote objects whose digests were checked
+	Problems map[string]int64 // the number of problems found, by kind
+}
+
+// Verify compares the actions of the local cache directory rooted at root,
+// which must be the directory managed by s.Local, with those stored in S3, and
+// calls report for each problem found, with the S3 key of the entry at fault.
+// An action is compared if it would be written to S3 by [S3Cache.Sync]; a
+// local action that is not in S3 is reported as unsynced, and one whose
+// record in S3 names another output ID as drift. Verify changes nothing, and
+// reports an error only if it cannot read the local cache or S3.
+func (s *S3Cache) Verify(ctx context.Context, root string, opts VerifyOptions, report func(Problem)) (VerifyStats, error) {
+	stats := VerifyStats{Problems: make(map[string]int64)}
+	var mu sync.Mutex // protects stats and calls to report
+	problem := func(p Problem) {
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Problems[p.Kind]++
+		report(p)
+	}
+	count := func(p *int64) { mu.Lock(); defer mu.Unlock(); *p++ }
+
+	var actionIDs []string
+	werr := filepath.WalkDir(filepath.Join(root, "action"), func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if de.Type().IsRegular() && len(de.Name()) >= 2 {
+			actionIDs = append(actionIDs, de.Name())
+		}
+		return nil
+	})
+	if werr != nil && !errors.Is(werr, fs.ErrNotExist) {
+		return stats, fmt.Errorf("read local actions: %w", werr)
+	}
+	stats.Local = int64(len(actionIDs))
+	if opts.Sample > 0 && opts.Sample < len(actionIDs) {
+		rand.Shuffle(len(actionIDs), func(i, j int) { actionIDs[i], actionIDs[j] = actionIDs[j], actionIDs[i] })
+		actionIDs = actionIDs[:opts.Sample]
+	}
+
+	g, run := taskgroup.New(nil).Limit(s.uploadConcurrency())
+	for _, actionID := range actionIDs {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		c := s.route(actionID) // the cache whose settings apply to this action
+		outputID, size, err := readLocalAction(filepath.Join(root, "action", actionID[:2], actionID))
+		if err != nil {
+			s.logger().Info("verify: skip action", "action", actionID, "err", err)
+			continue // skip missing or invalid actions
+		}
+		test := isTestResult(filepath.Join(root, "output", outputID[:2], outputID), size)
+		if size < c.MinUploadSize || (test && c.TestResults == TestLocal) {
+			count(&stats.Skipped)
+			continue
+		}
+		run(func() error {
+			akey := c.objectKey("action", actionID)
+			data, err := c.S3Client.GetData(ctx, akey)
+			if s3util.IsNotExist(err) {
+				problem(Problem{Kind: ProblemUnsynced, Key: akey, Detail: "local action not found in S3"})
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("read action %s: %w", akey, err)
+			}
+			count(&stats.Compared)
+			rec, err := parseAction(data)
+			if err != nil {
+				problem(Problem{Kind: ProblemCorrupt, Key: akey, Detail: err.Error()})
+				return nil
+			} else if rec.outputID != outputID {
+				problem(Problem{Kind: ProblemDrift, Key: akey,
+					Detail: fmt.Sprintf("local output is %s, remote output is %s", outputID, rec.outputID)})
+				return nil
+			}
+
+			okey := c.recordKey(c.KeyPrefix, rec)
+			if opts.Digest {
+				sum, err := c.objectDigest(ctx, okey)
+				if s3util.IsNotExist(err) {
+					problem(Problem{Kind: ProblemMissing, Key: akey, Detail: "object " + okey + " not found"})
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("read object %s: %w", okey, err)
+				}
+				count(&stats.Verified)
+				if sum != outputID {
+					problem(Problem{Kind: ProblemMismatch, Key: okey, Detail: "content digest is " + sum})
+					return nil
+				}
+			} else {
+				info, err := c.S3Client.Stat(ctx, okey)
+				if s3util.IsNotExist(err) {
+					problem(Problem{Kind: ProblemMissing, Key: akey, Detail: "object " + okey + " not found"})
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("stat object %s: %w", okey, err)
+				}
+				// Compressed and client-side encrypted objects are stored
+				// with sizes that differ from their contents.
+				if rec.codec == "" && c.S3Client.Envelope == nil && info.Size != size {
+					problem(Problem{Kind: ProblemMismatch, Key: okey,
+						Detail: fmt.Sprintf("remote size is %d, local size is %d", info.Size, size)})
+					return nil
+				}
+			}
+			count(&stats.Matched)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return stats, err
+	} else if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	if opts.Orphans {
+		_, err := s.Check(ctx, CheckOptions{MinAge: opts.MinAge}, func(p Problem) {
+			if p.Kind == ProblemOrphan {
+				problem(p)
+			}
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
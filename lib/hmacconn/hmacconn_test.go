@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hmacconn_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/hmacconn"
+)
+
+func TestRoundTrip(t *testing.T) {
+	key := []byte("the once and future kitten")
+	cc, sc := net.Pipe()
+
+	srv := taskgroup.Call(func() (string, error) {
+		c, err := hmacconn.Server(sc, key)
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		data, err := io.ReadAll(c)
+		if err != nil {
+			return "", err
+		}
+		if _, err := c.Write([]byte("reply: " + string(data))); err != nil {
+			return "", err
+		}
+		return string(data), c.CloseWrite()
+	})
+
+	c, err := hmacconn.Client(cc, key)
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	const msg = "hello, is it me you're looking for"
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	reply, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("Read reply: %v", err)
+	}
+	if got, want := string(reply), "reply: "+msg; got != want {
+		t.Errorf("Reply: got %q, want %q", got, want)
+	}
+	if got, err := srv.Wait().Get(); err != nil {
+		t.Errorf("Server: %v", err)
+	} else if got != msg {
+		t.Errorf("Server got %q, want %q", got, msg)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	cc, sc := net.Pipe()
+	srv := taskgroup.Go(func() error {
+		c, err := hmacconn.Server(sc, []byte("right"))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = io.ReadAll(c)
+		return err
+	})
+
+	c, err := hmacconn.Client(cc, []byte("wrong"))
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	io.Copy(c, strings.NewReader("let me in"))
+	c.CloseWrite()
+	if err := srv.Wait(); !errors.Is(err, hmacconn.ErrAuth) {
+		t.Errorf("Server: got error %v, want %v", err, hmacconn.ErrAuth)
+	}
+	c.Close()
+}
+
+func TestNoHandshake(t *testing.T) {
+	cc, sc := net.Pipe()
+	go func() { cc.Write([]byte("{\"ID\":1,\"Command\":\"get\"}\n")); cc.Close() }()
+	if _, err := hmacconn.Server(sc, []byte("key")); !errors.Is(err, hmacconn.ErrAuth) {
+		t.Errorf("Server: got error %v, want %v", err, hmacconn.ErrAuth)
+	}
+}
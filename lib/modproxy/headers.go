@@ -0,0 +1,140 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// CacheHeaders wraps h, which should be a module proxy whose cacher is an
+// [S3Cacher], so that successful responses report how they were obtained.
+// Each response includes an "X-Cache" header whose value is one of:
+//
+//   - "HIT": The response was served from the cache.
+//   - "MISS": The response was fetched from the upstream and cached.
+//   - "STALE": The upstream could not be reached, and the response was
+//     served from a previously-cached copy.
+//
+// Responses served from the cache also include an "Age" header giving the
+// number of seconds since the cached copy was stored locally.
+func CacheHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := new(cacheStatus)
+		ctx := context.WithValue(r.Context(), cacheStatusKey{}, st)
+		h.ServeHTTP(&statusWriter{ResponseWriter: w, st: st, r: r}, r.WithContext(ctx))
+	})
+}
+
+type cacheStatusKey struct{}
+
+// cacheStatus records the cache operations performed on behalf of a single
+// proxy request.
+type cacheStatus struct {
+	mu    sync.Mutex
+	hit   bool      // a Get succeeded
+	put   bool      // a Put was attempted
+	mtime time.Time // for a hit, the modification time of the cached file
+}
+
+// noteGet records a successful Get of a cached file modified at mtime, if ctx
+// belongs to a request wrapped by [CacheHeaders].
+func noteGet(ctx context.Context, mtime time.Time) {
+	if st, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus); ok {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.hit, st.mtime = true, mtime
+	}
+}
+
+// notePut records a Put, if ctx belongs to a request wrapped by
+// [CacheHeaders].
+func notePut(ctx context.Context) {
+	if st, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus); ok {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.put = true
+	}
+}
+
+// statusWriter is an [http.ResponseWriter] that adds cache status headers to a
+// successful response before it is written.
+type statusWriter struct {
+	http.ResponseWriter
+	st    *cacheStatus
+	r     *http.Request
+	wrote bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		if code == http.StatusOK {
+			w.setHeaders()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) setHeaders() {
+	w.st.mu.Lock()
+	defer w.st.mu.Unlock()
+	h := w.Header()
+	switch {
+	case w.st.put:
+		h.Set("X-Cache", "MISS")
+		return
+	case !w.st.hit:
+		return // not served by the cacher at all
+	case consultsCacheFirst(w.r):
+		h.Set("X-Cache", "HIT")
+	default:
+		h.Set("X-Cache", "STALE")
+	}
+	if age := time.Since(w.st.mtime); age > 0 {
+		h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+}
+
+// consultsCacheFirst reports whether r is a request for which the proxy
+// checks the cache before contacting the upstream. Immutable module files for
+// a specific version are served from the cache when present; other requests
+// (version lists, queries, and checksum database lookups) are fetched from the
+// upstream, and only served from the cache if the upstream fails.
+func consultsCacheFirst(r *http.Request) bool {
+	if r.Header.Get("Disable-Module-Fetch") == "true" {
+		return true
+	}
+	dir, file := path.Split(r.URL.Path)
+	if !strings.HasSuffix(dir, "/@v/") || strings.Contains(r.URL.Path, "/sumdb/") {
+		return false
+	}
+	switch ext := path.Ext(file); ext {
+	case ".mod", ".zip":
+		return true
+	case ".info":
+		// An .info request may also be a query ("@v/master.info").
+		v, err := module.UnescapeVersion(strings.TrimSuffix(file, ext))
+		if err != nil {
+			return false
+		}
+		return semver.IsValid(v) && semver.Canonical(v) == strings.TrimSuffix(v, "+incompatible")
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	c := &modproxy.S3Cacher{Local: t.TempDir()}
+	const name = "example.com/m/@v/cached"
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	path := filepath.Join(c.Local, hash[:2], hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stand-in for the module proxy that always serves the same cached file.
+	h := modproxy.CacheHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc, err := c.Get(r.Context(), name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/example.com/m/@v/v1.0.0.zip", "HIT"},
+		{"/example.com/m/@v/v1.0.0.info", "HIT"},
+		{"/example.com/m/@v/v2.0.0+incompatible.mod", "HIT"},
+		{"/example.com/m/@v/list", "STALE"},
+		{"/example.com/m/@latest", "STALE"},
+		{"/example.com/m/@v/master.info", "STALE"},
+		{"/sumdb/sum.golang.org/latest", "STALE"},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if got := rec.Header().Get("X-Cache"); got != tc.want {
+			t.Errorf("GET %s: X-Cache is %q, want %q", tc.path, got, tc.want)
+		}
+		if rec.Header().Get("Age") == "" {
+			t.Errorf("GET %s: missing Age header", tc.path)
+		}
+	}
+}
+
+// panicFetcher is a module fetcher that fails any attempt to use it.
+type panicFetcher struct{ t *testing.T }
+
+func (f panicFetcher) Query(ctx context.Context, path, query string) (string, time.Time, error) {
+	f.t.Fatalf("unexpected query %s@%s", path, query)
+	return "", time.Time{}, nil
+}
+
+func (f panicFetcher) List(ctx context.Context, path string) ([]string, error) {
+	f.t.Fatalf("unexpected list %s", path)
+	return nil, nil
+}
+
+func (f panicFetcher) Download(ctx context.Context, path, version string) (_, _, _ io.ReadSeekCloser, _ error) {
+	f.t.Fatalf("unexpected download %s@%s", path, version)
+	return nil, nil, nil, nil
+}
+
+func TestOffline(t *testing.T) {
+	dir := t.TempDir()
+	const name = "example.com/m/@v/v1.0.0.mod"
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("module example.com/m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := modproxy.Offline(&goproxy.Goproxy{
+		Fetcher:       panicFetcher{t},
+		Cacher:        goproxy.DirCacher(dir),
+		ProxiedSumDBs: []string{"sum.golang.org"},
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/example.com/m/@v/v1.0.0.mod", http.StatusOK},
+		{"/example.com/m/@v/v1.0.0.zip", http.StatusNotFound},
+		{"/example.com/m/@v/list", http.StatusNotFound},
+		{"/example.com/m/@latest", http.StatusNotFound},
+		{"/sumdb/sum.golang.org/supported", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s: got %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
@@ -22,10 +23,13 @@ import (
 	"time"
 
 	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/mds/cache"
 	"github.com/creachadair/taskgroup"
 	"github.com/goproxy/goproxy"
+	"github.com/grafana/go-cache-plugin/lib/atrest"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
 var _ goproxy.Cacher = (*S3Cacher)(nil)
@@ -66,42 +70,59 @@ type S3Cacher struct {
 	// [runtime.NumCPU].
 	MaxTasks int
 
-	// Logf, if non-nil, is used to write log messages. If nil, logs are
+	// Scanner, if non-nil, inspects each module zip stored by Put, before it
+	// is cached. If the scanner blocks a zip, Put reports [ErrBlocked].
+	// Entries faulted in from S3 are not scanned again.
+	Scanner *ZipScanner
+
+	// MemoryBytes, if positive, is the maximum total size of the entries
+	// retained in memory, so that frequently requested entries (such as the
+	// .info and .mod files of common modules) need not be read from the Local
+	// directory. Entries larger than 1/8 of MemoryBytes are not retained, and
+	// an entry is served from memory only while its file in the Local
+	// directory is unchanged.
+	MemoryBytes int64
+
+	// Encrypt, if non-nil, encrypts the files written to the Local directory,
+	// so that their contents are not readable at rest. Files written without
+	// a key remain readable. The entries stored in S3 are not encrypted.
+	Encrypt *atrest.Key
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
-	Logf func(string, ...any)
-
-	// LogRequests, if true, enables detailed (but noisy) debug logging of all
-	// requests handled by the cache. Logs are written to Logf.
-	//
-	// Each result is presented in the format:
-	//
-	//    B <op> "<name>" (<digest>)
-	//    E <op> "<name>", err=<error>, <time> elapsed
-	//
-	// Where the operations are "GET" and "PUT". The "B" line is when the
-	// operation began, and "E" when it ended. When a GET operation successfully
-	// faults in a result from S3, the log is:
 	//
-	//    F GET "<name>" hit (<digest>)
+	// Each operation on the cache is logged at [slog.LevelDebug] (these logs
+	// are detailed, but noisy), with the message "get" or "put" and the
+	// attributes:
 	//
-	// When a PUT operation finishes writing a value behind to S3, the log is:
+	//    name    -- the name of the cache entry
+	//    hash    -- the digest of the name (the cache key)
+	//    source  -- for a get hit, "memory", "local", or "s3"
+	//    elapsed -- how long the operation took
+	//    err     -- the error reported by the operation, if any
 	//
-	//    W PUT "<name>", err=<error>, <time> elapsed
-	//
-	LogRequests bool
+	// When a put operation finishes writing a value behind to S3, this is
+	// logged with the message "write behind". When the Scanner reports
+	// findings for a module zip, this is logged at [slog.LevelWarn] with the
+	// message "module zip flagged".
+	Logger *slog.Logger
 
 	// Tracks tasks interacting with S3 in the background.
 	initOnce sync.Once
 	tasks    *taskgroup.Group
 	start    func(taskgroup.Task)
 	sema     *semaphore.Weighted
+	faults   singleflight.Group             // faults from S3 in progress, by hash
+	mem      *cache.Cache[string, memEntry] // entries retained in memory, by hash
 
 	pathError     expvar.Int // errors constructing file paths
 	getRequest    expvar.Int // total number of Get requests
+	getMemoryHit  expvar.Int // get: hit in memory
 	getLocalHit   expvar.Int // get: hit in local directory
 	getLocalMiss  expvar.Int // get: miss in local directory
 	getFaultHit   expvar.Int // get: hit in S3
 	getFaultMiss  expvar.Int // get: miss in S3
+	getFaultJoin  expvar.Int // get: joined a fault from S3 in progress
 	getLocalError expvar.Int // get: error reading the local directory
 	getFaultError expvar.Int // get: error reading from S3
 	getLocalBytes expvar.Int // get: total bytes fetched from the local directory
@@ -112,6 +133,9 @@ type S3Cacher struct {
 	putS3Error    expvar.Int // put: error writing to S3
 	putLocalBytes expvar.Int // put: total bytes written to the local directory
 	putS3Bytes    expvar.Int // put: total bytes written to S3
+	scanFlagged   expvar.Int // put: module zips with scan findings
+	scanBlocked   expvar.Int // put: module zips rejected by the scanner
+	scanError     expvar.Int // put: module zips that could not be scanned
 }
 
 func (c *S3Cacher) init() {
@@ -122,6 +146,9 @@ func (c *S3Cacher) init() {
 		}
 		c.tasks, c.start = taskgroup.New(nil).Limit(nt)
 		c.sema = semaphore.NewWeighted(int64(nt))
+		if c.MemoryBytes > 0 {
+			c.mem = cache.New(cache.LRU[string, memEntry](c.MemoryBytes).WithSize(memEntrySize))
+		}
 	})
 }
 
@@ -133,48 +160,86 @@ func (c *S3Cacher) Get(ctx context.Context, name string) (_ io.ReadCloser, oerr
 	start := time.Now()
 	hash, path, err := c.makePath(name)
 
-	c.vlogf("mc B GET %q (%s)", name, hash)
-	defer func() { c.vlogf("mc E GET %q, err=%v, %v elapsed", name, oerr, time.Since(start)) }()
+	var source string // where a hit was found
+	defer func() {
+		c.logger().Debug("get", "name", name, "hash", hash, "source", source,
+			"elapsed", time.Since(start), "err", oerr)
+	}()
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Check whether the file already exists locally.
-	if rc, size, err := openReader(path); err == nil {
+	// Check whether the entry is retained in memory, or else whether the file
+	// already exists locally.
+	if e, ok := c.memGet(hash, path); ok {
+		c.getMemoryHit.Add(1)
+		source = "memory"
+		noteGet(ctx, e.mtime)
+		return io.NopCloser(bytes.NewReader(e.data)), nil
+	}
+	if rc, size, err := c.openLocal(path); err == nil {
 		c.getLocalHit.Add(1)
 		c.getLocalBytes.Add(size)
+		source = "local"
+		if fi, err := os.Stat(path); err == nil {
+			noteGet(ctx, fi.ModTime())
+		}
 		return rc, nil
 	} else if errors.Is(err, os.ErrNotExist) {
 		c.getLocalMiss.Add(1)
 	} else {
 		c.getLocalError.Add(1)
-		c.logf("get %q local: %v (treating as miss)", name, err)
+		c.logger().Warn("get local failed, treating as miss", "name", name, "err", err)
 	}
 
-	// Local cache miss, fault in from S3.
+	// Local cache miss, fault in from S3. Concurrent requests for the same
+	// entry share one fault, which completes even if they are abandoned, so
+	// that a later request finds the entry locally.
+	var led bool
+	ch := c.faults.DoChan(hash, func() (any, error) {
+		led = true
+		return nil, c.faultS3(context.WithoutCancel(ctx), name, hash, path)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-ch:
+		if !led {
+			c.getFaultJoin.Add(1)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+	}
+	source = "s3"
+	rc, _, err := c.openLocal(path)
+	if err == nil {
+		noteGet(ctx, time.Now())
+	}
+	return rc, err
+}
+
+// faultS3 fetches the entry with the given name and hash from S3, and writes
+// it into the local cache at path.
+func (c *S3Cacher) faultS3(ctx context.Context, name, hash, path string) error {
 	if err := c.sema.Acquire(ctx, 1); err != nil {
-		return nil, err
+		return err
 	}
 	defer c.sema.Release(1)
 
 	obj, _, err := c.S3Client.Get(ctx, c.makeKey(hash))
 	if errors.Is(err, fs.ErrNotExist) {
 		c.getFaultMiss.Add(1)
-		return nil, err
+		return err
 	} else if err != nil {
 		c.getFaultError.Add(1)
-		return nil, err
+		return err
 	}
 	defer obj.Close()
 	c.getFaultHit.Add(1)
-	c.vlogf("mc F GET %q hit (%s)", name, hash)
-
-	if _, err := c.putLocal(ctx, name, path, obj); err != nil {
-		return nil, err
-	}
-	rc, _, err := openReader(path)
-	return rc, err
+	_, err = c.putLocal(ctx, name, path, obj)
+	return err
 }
 
 // putLocal reports whether the specified path already exists in the local
@@ -183,6 +248,14 @@ func (c *S3Cacher) putLocal(ctx context.Context, name, path string, data io.Read
 	if _, err := os.Stat(path); err == nil {
 		return true, nil
 	}
+	if c.Encrypt != nil {
+		plain, err := io.ReadAll(data)
+		if err != nil {
+			c.putLocalError.Add(1)
+			return false, err
+		}
+		data = bytes.NewReader(c.Encrypt.Seal(plain))
+	}
 	nw, err := atomicfile.WriteAll(path, data, 0644)
 	c.putLocalBytes.Add(nw)
 	if err != nil {
@@ -199,12 +272,19 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 	start := time.Now()
 	hash, path, err := c.makePath(name)
 
-	c.vlogf("mc B PUT %q (%s)", name, hash)
-	defer func() { c.vlogf("mc E PUT %q, err=%v, %v elapsed", name, oerr, time.Since(start)) }()
+	defer func() {
+		c.logger().Debug("put", "name", name, "hash", hash, "elapsed", time.Since(start), "err", oerr)
+	}()
 
 	if err != nil {
 		return err
 	}
+	if c.Scanner != nil {
+		if err := c.scan(name, data); err != nil {
+			return err
+		}
+	}
+	notePut(ctx)
 
 	if ok, err := c.putLocal(ctx, name, path, data); err != nil {
 		return err
@@ -214,7 +294,14 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 	}
 
 	// Try to push the object to S3 in the background.
+	if c.S3Client.ReadOnly {
+		return nil
+	}
 	f, size, err := openFileSize(path)
+	if c.Encrypt != nil && err == nil {
+		f.Close()
+		f, size, err = c.openLocal(path)
+	}
 	if err != nil {
 		c.putLocalError.Add(1)
 		return err
@@ -229,16 +316,47 @@ func (c *S3Cacher) Put(ctx context.Context, name string, data io.ReadSeeker) (oe
 
 		if err := c.S3Client.Put(sctx, c.makeKey(hash), f); err != nil {
 			c.putS3Error.Add(1)
-			c.logf("[s3] put %q failed: %v", name, err)
+			c.logger().Warn("s3 put failed", "name", name, "err", err)
 		} else {
 			c.putS3Bytes.Add(size)
 		}
-		c.vlogf("mc W PUT %q, err=%v %v elapsed", name, err, time.Since(start))
+		c.logger().Debug("write behind", "name", name, "hash", hash, "elapsed", time.Since(start), "err", err)
 		return err
 	})
 	return nil
 }
 
+// scan checks the named entry, whose contents are data, with c.Scanner. It
+// reports an error wrapping [ErrBlocked] if the scanner blocks the entry.
+func (c *S3Cacher) scan(name string, data io.ReadSeeker) error {
+	r, size, err := readerAt(data)
+	if err != nil {
+		return err
+	}
+	found, err := c.Scanner.Scan(name, r, size)
+	if err != nil {
+		c.scanError.Add(1)
+		c.logger().Warn("scan module zip failed", "name", name, "blocked", c.Scanner.Block, "err", err)
+		if c.Scanner.Block {
+			return fmt.Errorf("%w: %s: %v", ErrBlocked, name, err)
+		}
+		return nil
+	} else if len(found) == 0 {
+		return nil
+	}
+	c.scanFlagged.Add(1)
+	files := make([]string, len(found))
+	for i, f := range found {
+		files[i] = f.String()
+	}
+	c.logger().Warn("module zip flagged", "name", name, "blocked", c.Scanner.Block, "findings", files)
+	if c.Scanner.Block {
+		c.scanBlocked.Add(1)
+		return fmt.Errorf("%w: %s: %v", ErrBlocked, name, found[0])
+	}
+	return nil
+}
+
 // Close waits until all background updates are complete.
 func (c *S3Cacher) Close() error {
 	c.init()
@@ -251,10 +369,12 @@ func (c *S3Cacher) Metrics() *expvar.Map {
 	m := new(expvar.Map)
 	m.Set("path_error", &c.pathError)
 	m.Set("get_request", &c.getRequest)
+	m.Set("get_memory_hit", &c.getMemoryHit)
 	m.Set("get_local_hit", &c.getLocalHit)
 	m.Set("get_local_miss", &c.getLocalMiss)
 	m.Set("get_fault_hit", &c.getFaultHit)
 	m.Set("get_fault_miss", &c.getFaultMiss)
+	m.Set("get_fault_join", &c.getFaultJoin)
 	m.Set("get_local_error", &c.getLocalError)
 	m.Set("get_local_bytes", &c.getLocalBytes)
 	m.Set("get_s3_bytes", &c.getS3Bytes)
@@ -264,6 +384,9 @@ func (c *S3Cacher) Metrics() *expvar.Map {
 	m.Set("put_s3_error", &c.putS3Error)
 	m.Set("put_local_bytes", &c.putLocalBytes)
 	m.Set("put_s3_bytes", &c.putS3Bytes)
+	m.Set("scan_flagged", &c.scanFlagged)
+	m.Set("scan_blocked", &c.scanBlocked)
+	m.Set("scan_error", &c.scanError)
 	return m
 }
 
@@ -289,26 +412,60 @@ func (c *S3Cacher) makePath(name string) (hash, path string, err error) {
 	return hash, path, err
 }
 
-func (c *S3Cacher) logf(msg string, args ...any) {
-	if c.Logf != nil {
-		c.Logf(msg, args...)
+func (c *S3Cacher) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
 	}
+	return discardLogger
 }
 
-func (c *S3Cacher) vlogf(msg string, args ...any) {
-	if c.LogRequests {
-		c.logf(msg, args...)
-	}
-}
+var discardLogger = slog.New(slog.DiscardHandler)
 
-func openReader(path string) (_ io.ReadCloser, size int64, _ error) {
+// openLocal returns a reader for the contents of the local cache file at
+// path, decrypted if necessary, and the size of the contents. If the memory
+// tier is enabled, the contents are retained there.
+func (c *S3Cacher) openLocal(path string) (_ io.ReadCloser, size int64, _ error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, 0, err
 	}
+	data, err = c.Encrypt.Open(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.mem != nil && int64(len(data)) <= c.MemoryBytes/8 {
+		if fi, err := os.Stat(path); err == nil {
+			c.mem.Put(filepath.Base(path), memEntry{data: data, mtime: fi.ModTime()})
+		}
+	}
 	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
 }
 
+// memEntry is the contents of an entry retained in memory.
+type memEntry struct {
+	data  []byte
+	mtime time.Time // the modification time of the local file
+}
+
+func memEntrySize(e memEntry) int64 { return int64(len(e.data)) }
+
+// memGet reports whether the entry with the given hash is retained in memory,
+// and if so returns it. An entry whose local file at path has been removed
+// (as by expiration) or rewritten since it was retained is evicted instead.
+func (c *S3Cacher) memGet(hash, path string) (memEntry, bool) {
+	if c.mem == nil {
+		return memEntry{}, false
+	}
+	e, ok := c.mem.Get(hash)
+	if !ok {
+		return memEntry{}, false
+	} else if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(e.mtime) {
+		c.mem.Remove(hash) // pruned or replaced in the local cache
+		return memEntry{}, false
+	}
+	return e, true
+}
+
 func openFileSize(path string) (io.ReadCloser, int64, error) {
 	f, err := os.Open(path)
 	if err != nil {
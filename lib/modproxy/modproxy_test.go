@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/atrest"
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestEncryptLocal(t *testing.T) {
+	key, err := atrest.ParseKey(strings.Repeat("01", atrest.KeySize))
+	if err != nil {
+		t.Fatalf("ParseKey: %v", err)
+	}
+	c := &modproxy.S3Cacher{Local: t.TempDir(), Encrypt: key}
+	write := func(name string, data []byte) {
+		t.Helper()
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+		path := filepath.Join(c.Local, hash[:2], hash)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(name, want string) {
+		t.Helper()
+		rc, err := c.Get(context.Background(), name)
+		if err != nil {
+			t.Fatalf("Get %q: %v", name, err)
+		}
+		defer rc.Close()
+		if got, err := io.ReadAll(rc); err != nil || string(got) != want {
+			t.Errorf("Get %q: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	// An encrypted entry is decrypted, and one written before the key was set
+	// is read as it is.
+	write("example.com/m/@v/v1.0.0.mod", key.Seal([]byte("module example.com/m\n")))
+	write("example.com/m/@v/v0.9.0.mod", []byte("module example.com/old\n"))
+	check("example.com/m/@v/v1.0.0.mod", "module example.com/m\n")
+	check("example.com/m/@v/v0.9.0.mod", "module example.com/old\n")
+}
+
+func TestMemoryTier(t *testing.T) {
+	// A stand-in for S3 that has no objects.
+	s3srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+	}))
+	defer s3srv.Close()
+	c := &modproxy.S3Cacher{
+		Local:       t.TempDir(),
+		MemoryBytes: 1 << 10,
+		S3Client: &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:       "us-east-1",
+				BaseEndpoint: aws.String(s3srv.URL),
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket: "test",
+		},
+	}
+	defer c.Close()
+	write := func(name, data string) string {
+		t.Helper()
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+		path := filepath.Join(c.Local, hash[:2], hash)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	get := func(name string) (string, error) {
+		rc, err := c.Get(context.Background(), name)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		return string(data), err
+	}
+
+	// A small entry read once is served from memory, but one larger than 1/8
+	// of the memory is not retained.
+	const info = "example.com/m/@v/v1.0.0.info"
+	small := write(info, `{"Version":"v1.0.0"}`)
+	write("example.com/m/@v/v1.0.0.zip", strings.Repeat("x", 200))
+	for _, name := range []string{info, info, "example.com/m/@v/v1.0.0.zip", "example.com/m/@v/v1.0.0.zip"} {
+		if _, err := get(name); err != nil {
+			t.Fatalf("Get %q: %v", name, err)
+		}
+	}
+	if got := c.Metrics().Get("get_memory_hit").String(); got != "1" {
+		t.Errorf("Memory hits: got %s, want 1", got)
+	}
+
+	// Once its file is gone, as by expiration, the entry is no longer served
+	// from memory.
+	os.Remove(small)
+	if got, err := get(info); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get removed info: got %q, %v; want %v", got, err, fs.ErrNotExist)
+	}
+
+	// Nor is it once its file is rewritten.
+	write(info, `{"Version":"v1.0.0"}`)
+	if _, err := get(info); err != nil {
+		t.Fatalf("Get %q: %v", info, err)
+	}
+	write(info, `{"Version":"v1.0.0","Time":"2024-01-01T00:00:00Z"}`)
+	os.Chtimes(small, time.Time{}, time.Now().Add(time.Hour))
+	if got, err := get(info); err != nil || got != `{"Version":"v1.0.0","Time":"2024-01-01T00:00:00Z"}` {
+		t.Errorf("Get rewritten info: got %q, %v; want the new contents", got, err)
+	}
+	if got := c.Metrics().Get("get_memory_hit").String(); got != "1" {
+		t.Errorf("Memory hits: got %s, want 1", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// NetrcEntry is a single machine entry from a .netrc file.
+type NetrcEntry struct {
+	Machine  string // host name; "" for the default entry
+	Login    string
+	Password string
+}
+
+// ParseNetrc parses the contents of a .netrc file and returns the entries it
+// defines, in order of appearance. Macro definitions are skipped.
+func ParseNetrc(data string) []NetrcEntry {
+	var out []NetrcEntry
+	var cur *NetrcEntry
+	fs := strings.Fields(data)
+	for i := 0; i < len(fs); i++ {
+		switch fs[i] {
+		case "machine", "default":
+			out = append(out, NetrcEntry{})
+			cur = &out[len(out)-1]
+			if fs[i] == "machine" && i+1 < len(fs) {
+				i++
+				cur.Machine = fs[i]
+			}
+		case "login", "password", "account":
+			if cur == nil || i+1 >= len(fs) {
+				continue
+			}
+			i++
+			if fs[i-1] == "login" {
+				cur.Login = fs[i]
+			} else if fs[i-1] == "password" {
+				cur.Password = fs[i]
+			}
+		case "macdef":
+			// A macro runs to the end of the line; since we have already split
+			// on whitespace, simply stop associating tokens with the entry.
+			cur = nil
+		}
+	}
+	return out
+}
+
+// ReadNetrc reads and parses the .netrc file at path.
+func ReadNetrc(path string) ([]NetrcEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNetrc(string(data)), nil
+}
+
+// NetrcTransport is an [http.RoundTripper] that adds HTTP basic auth
+// credentials from a set of .netrc entries to outbound HTTPS requests whose
+// host matches a machine entry. As in the go command, the default entry is
+// not used, so credentials are only sent to the hosts named for them, and they
+// are never sent over plain HTTP. Requests that already carry an Authorization
+// header are passed through unmodified.
+type NetrcTransport struct {
+	// Base is the underlying transport. If nil, [http.DefaultTransport] is used.
+	Base http.RoundTripper
+
+	// Entries are the netrc entries to match against request hosts.
+	Entries []NetrcEntry
+}
+
+// RoundTrip implements the [http.RoundTripper] interface.
+func (t *NetrcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Header.Get("Authorization") != "" || req.URL.User != nil {
+		return base.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" {
+		return base.RoundTrip(req)
+	}
+	if e, ok := t.lookup(req.URL.Hostname()); ok {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(e.Login, e.Password)
+	}
+	return base.RoundTrip(req)
+}
+
+// lookup returns the first machine entry matching host. The default entry
+// never matches.
+func (t *NetrcTransport) lookup(host string) (NetrcEntry, bool) {
+	for _, e := range t.Entries {
+		if e.Machine != "" && e.Machine == host {
+			return e, true
+		}
+	}
+	return NetrcEntry{}, false
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+)
+
+func TestParseNetrc(t *testing.T) {
+	const input = `
+machine artifactory.example.com
+  login alice
+  password s3cr3t
+
+machine other.example.com login bob password hunter2 account ignored
+macdef init
+  cd /pub
+
+default login anon password guest
+`
+	got := modproxy.ParseNetrc(input)
+	want := []modproxy.NetrcEntry{
+		{Machine: "artifactory.example.com", Login: "alice", Password: "s3cr3t"},
+		{Machine: "other.example.com", Login: "bob", Password: "hunter2"},
+		{Machine: "", Login: "anon", Password: "guest"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseNetrc:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestNetrcTransport(t *testing.T) {
+	var gotUser, gotPass string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, _ = r.BasicAuth()
+	})
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	plainSrv := httptest.NewServer(handler)
+	defer plainSrv.Close()
+
+	get := func(t *testing.T, entries []modproxy.NetrcEntry, url string) (user, pass string) {
+		t.Helper()
+		gotUser, gotPass = "", ""
+		cli := &http.Client{Transport: &modproxy.NetrcTransport{
+			Base:    tlsSrv.Client().Transport,
+			Entries: entries,
+		}}
+		rsp, err := cli.Get(url)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		rsp.Body.Close()
+		return gotUser, gotPass
+	}
+
+	machine := []modproxy.NetrcEntry{{Machine: "127.0.0.1", Login: "alice", Password: "s3cr3t"}}
+	if user, pass := get(t, machine, tlsSrv.URL); user != "alice" || pass != "s3cr3t" {
+		t.Errorf("Credentials: got %q, %q; want alice, s3cr3t", user, pass)
+	}
+
+	// Credentials are not sent over plain HTTP.
+	if user, pass := get(t, machine, plainSrv.URL); user != "" || pass != "" {
+		t.Errorf("Credentials over HTTP: got %q, %q; want none", user, pass)
+	}
+
+	// The default entry does not match any host.
+	other := []modproxy.NetrcEntry{
+		{Machine: "other.example.com", Login: "bob", Password: "hunter2"},
+		{Login: "anon", Password: "guest"},
+	}
+	if user, pass := get(t, other, tlsSrv.URL); user != "" || pass != "" {
+		t.Errorf("Credentials from default: got %q, %q; want none", user, pass)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Offline wraps h, which should be a module proxy, so that it serves only
+// what is already in its cache and never contacts an upstream. Requests for
+// anything not cached, including version lists and queries that were never
+// cached, report 404 Not Found. Checksum database requests are not proxied,
+// and also report 404, which the go command takes to mean the proxy does not
+// support them.
+//
+// Offline relies on the proxy honoring the "Disable-Module-Fetch" request
+// header, as [github.com/goproxy/goproxy.Goproxy] does.
+func Offline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+			http.Error(w, "checksum database not available offline", http.StatusNotFound)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Disable-Module-Fetch", "true")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// A Policy restricts which modules a module proxy serves.
+type Policy struct {
+	// Allow, if non-empty, is a comma-separated list of module path patterns
+	// (in the syntax of GOPRIVATE). Only modules that match are served.
+	Allow string
+
+	// Block, if non-empty, is a comma-separated list of module path patterns
+	// (in the syntax of GOPRIVATE) of modules that are not served, even if
+	// they match Allow.
+	Block string
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded. Each request refused by the policy is logged at
+	// [slog.LevelWarn] with the message "module blocked by policy".
+	Logger *slog.Logger
+
+	blocked expvar.Int // requests refused by the policy
+}
+
+// Permits reports whether p permits the module with the given path.
+func (p *Policy) Permits(modPath string) bool {
+	if p.Block != "" && module.MatchPrefixPatterns(p.Block, modPath) {
+		return false
+	}
+	return p.Allow == "" || module.MatchPrefixPatterns(p.Allow, modPath)
+}
+
+// Enforce wraps h, which should be a module proxy, so that requests for
+// modules not permitted by p report 403 Forbidden, with a message naming the
+// module. Other requests, including those for the checksum database, are
+// passed to h.
+func (p *Policy) Enforce(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if modPath, ok := requestModulePath(r.URL.Path); ok && !p.Permits(modPath) {
+			p.blocked.Add(1)
+			p.logger().Warn("module blocked by policy", "module", modPath, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("module %s is blocked by proxy policy", modPath), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Metrics returns a map of policy metrics for p. The caller is responsible to
+// publish these metrics as desired.
+func (p *Policy) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("blocked", &p.blocked)
+	return m
+}
+
+// requestModulePath reports the module path of a module proxy request for
+// urlPath, of the form "/<module>/@v/..." or "/<module>/@latest".
+func requestModulePath(urlPath string) (string, bool) {
+	p := strings.TrimPrefix(urlPath, "/")
+	if strings.HasPrefix(p, "sumdb/") {
+		return "", false
+	}
+	esc, _, ok := strings.Cut(p, "/@v/")
+	if !ok {
+		esc, ok = strings.CutSuffix(p, "/@latest")
+	}
+	if !ok {
+		return "", false
+	}
+	modPath, err := module.UnescapePath(esc)
+	if err != nil {
+		return "", false
+	}
+	return modPath, true
+}
+
+func (p *Policy) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return discardLogger
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &modproxy.Policy{
+		Allow: "github.com/good,golang.org/x",
+		Block: "github.com/good/bad",
+	}
+	h := p.Enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/github.com/good/lib/@v/list", http.StatusOK},
+		{"/github.com/good/lib/@v/v1.0.0.zip", http.StatusOK},
+		{"/golang.org/x/mod/@latest", http.StatusOK},
+		{"/github.com/good/bad/@v/v1.0.0.mod", http.StatusForbidden},
+		{"/github.com/good/bad/sub/@v/list", http.StatusForbidden},
+		{"/github.com/other/lib/@v/v1.0.0.info", http.StatusForbidden},
+		{"/github.com/!other/lib/@latest", http.StatusForbidden},
+
+		// Requests that do not name a module are not checked.
+		{"/sumdb/sum.golang.org/lookup/github.com/other/lib@v1.0.0", http.StatusOK},
+		{"/github.com/other/lib", http.StatusOK},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s: got %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+	if got := p.Metrics().Get("blocked").String(); got != "4" {
+		t.Errorf("Blocked: got %s, want 4", got)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// ErrBlocked is reported by [S3Cacher.Put] for a module zip rejected by its
+// [ZipScanner].
+var ErrBlocked = errors.New("module zip blocked by scan policy")
+
+// A ZipScanner inspects module zip files for content that may hide code from
+// review, such as executables, object files, and other large blobs.
+type ZipScanner struct {
+	// MaxFileSize, if positive, is the size in bytes of the largest file in a
+	// module zip that is not reported.
+	MaxFileSize int64
+
+	// Block, if true, means zips with findings are rejected. Otherwise they
+	// are reported, but cached and served as usual.
+	Block bool
+
+	// Allow, if non-empty, is a comma-separated list of module path patterns
+	// (in the syntax of GOPRIVATE) of modules that are not scanned.
+	Allow string
+}
+
+// A Finding describes a file in a module zip reported by a [ZipScanner].
+type Finding struct {
+	File   string // the name of the file in the zip
+	Size   int64  // the uncompressed size of the file in bytes
+	Reason string // why the file was reported
+}
+
+func (f Finding) String() string { return fmt.Sprintf("%s (%d bytes): %s", f.File, f.Size, f.Reason) }
+
+// binaryMagic lists the leading bytes of executable and object file formats.
+var binaryMagic = []struct {
+	magic, kind string
+}{
+	{"\x7fELF", "ELF binary"},
+	{"\xfe\xed\xfa\xce", "Mach-O binary"},
+	{"\xfe\xed\xfa\xcf", "Mach-O binary"},
+	{"\xce\xfa\xed\xfe", "Mach-O binary"},
+	{"\xcf\xfa\xed\xfe", "Mach-O binary"},
+	{"\xca\xfe\xba\xbe", "Mach-O universal binary or Java class"},
+	{"MZ", "PE binary"},
+	{"\x00asm", "WebAssembly module"},
+	{"!<arch>\n", "archive library"},
+}
+
+// Scan reports the findings for the file of a module cache entry with the
+// given name, whose contents are read from r. Entries other than module zips,
+// and zips of modules matched by s.Allow, have no findings.
+func (s *ZipScanner) Scan(name string, r io.ReaderAt, size int64) ([]Finding, error) {
+	modPath, ok := zipModulePath(name)
+	if !ok || module.MatchPrefixPatterns(s.Allow, modPath) {
+		return nil, nil
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("read module zip: %w", err)
+	}
+	var out []Finding
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue // directory
+		}
+		fsize := int64(f.UncompressedSize64)
+		if s.MaxFileSize > 0 && fsize > s.MaxFileSize {
+			out = append(out, Finding{File: f.Name, Size: fsize, Reason: "file too large"})
+			continue
+		}
+		kind, err := binaryKind(f)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f.Name, err)
+		} else if kind != "" {
+			out = append(out, Finding{File: f.Name, Size: fsize, Reason: kind})
+		}
+	}
+	return out, nil
+}
+
+// binaryKind reports the kind of binary in f, or "" if it does not appear to
+// be a binary.
+func binaryKind(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	var head [8]byte
+	n, err := io.ReadFull(rc, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	for _, m := range binaryMagic {
+		if bytes.HasPrefix(head[:n], []byte(m.magic)) {
+			return m.kind, nil
+		}
+	}
+	return "", nil
+}
+
+// zipModulePath reports the module path of a cache entry name for a module
+// zip, of the form "<escaped-path>/@v/<version>.zip".
+func zipModulePath(name string) (string, bool) {
+	esc, file, ok := strings.Cut(name, "/@v/")
+	if !ok || !strings.HasSuffix(file, ".zip") {
+		return "", false
+	}
+	modPath, err := module.UnescapePath(esc)
+	if err != nil {
+		return "", false
+	}
+	return modPath, true
+}
+
+// readerAt returns a reader for the contents of r, and their size.
+func readerAt(r io.ReadSeeker) (io.ReaderAt, int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra, size, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return bytes.NewReader(data), size, err
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+)
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipScanner(t *testing.T) {
+	zipData := makeZip(t, map[string]string{
+		"example.com/m@v1.0.0/go.mod":        "module example.com/m\n",
+		"example.com/m@v1.0.0/main.go":       "package main\n",
+		"example.com/m@v1.0.0/bin/tool":      "\x7fELF\x02\x01\x01",
+		"example.com/m@v1.0.0/testdata/blob": strings.Repeat("x", 2000),
+	})
+	s := &modproxy.ZipScanner{MaxFileSize: 1000}
+	scan := func(name string) []modproxy.Finding {
+		t.Helper()
+		found, err := s.Scan(name, bytes.NewReader(zipData), int64(len(zipData)))
+		if err != nil {
+			t.Fatalf("Scan %q: unexpected error: %v", name, err)
+		}
+		return found
+	}
+
+	found := scan("example.com/m/@v/v1.0.0.zip")
+	got := make(map[string]string)
+	for _, f := range found {
+		got[f.File] = f.Reason
+	}
+	if len(got) != 2 || got["example.com/m@v1.0.0/bin/tool"] != "ELF binary" ||
+		got["example.com/m@v1.0.0/testdata/blob"] != "file too large" {
+		t.Errorf("Scan: got %v, want the binary and the large file", found)
+	}
+
+	// Other entries, and allowed modules, are not scanned.
+	if found := scan("example.com/m/@v/v1.0.0.mod"); len(found) != 0 {
+		t.Errorf("Scan .mod: got %v, want no findings", found)
+	}
+	s.Allow = "example.com"
+	if found := scan("example.com/m/@v/v1.0.0.zip"); len(found) != 0 {
+		t.Errorf("Scan allowed: got %v, want no findings", found)
+	}
+}
+
+func TestPutBlocked(t *testing.T) {
+	c := &modproxy.S3Cacher{
+		Local:   t.TempDir(),
+		Scanner: &modproxy.ZipScanner{Block: true},
+	}
+	const name = "example.com/m/@v/v1.0.0.zip"
+	zipData := makeZip(t, map[string]string{"example.com/m@v1.0.0/lib.a": "!<arch>\n"})
+	err := c.Put(context.Background(), name, bytes.NewReader(zipData))
+	if !errors.Is(err, modproxy.ErrBlocked) {
+		t.Fatalf("Put: got %v, want %v", err, modproxy.ErrBlocked)
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	if _, err := os.Stat(filepath.Join(c.Local, hash[:2], hash)); err == nil {
+		t.Error("Put: blocked zip was cached")
+	}
+}
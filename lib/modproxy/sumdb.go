@@ -0,0 +1,579 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// DefaultSumDBKey is the verifier key of sum.golang.org, as built into the go
+// command.
+const DefaultSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ze6/lC9/zZ/0sqYDK"
+
+// ErrSumDBMisbehavior is reported when responses from a checksum database
+// are not consistent with the signed trees it has published.
+var ErrSumDBMisbehavior = errors.New("checksum database misbehavior detected")
+
+// sumdbHeight is the tile height used by the checksum database protocol.
+const sumdbHeight = 8
+
+// SumDB is a proxy for a Go checksum database (see
+// https://go.dev/design/25530-sumdb) that verifies what it serves.
+//
+// Signed tree heads are checked with the verifier key of the database, and
+// each new tree head is checked to be consistent with the last one accepted.
+// Lookup records are checked to be included in the tree signed along with
+// them, and hash tiles are checked against the latest accepted tree. Nothing
+// that fails these checks is cached or served.
+//
+// The proxy serves these paths, relative to wherever it is mounted:
+//
+//	/supported
+//	/latest
+//	/lookup/<module>@<version>
+//	/tile/8/<level>/<index>[.p/<width>]
+//
+// Data tiles are not served; the go command does not use them.
+//
+// # Cache Layout
+//
+// Lookup records and tiles never change once published, so they are cached
+// under their own paths, relative to the local directory and the key prefix:
+//
+//	<local>/lookup/golang.org/x/mod@v0.23.0
+//	<local>/tile/8/0/x001/234.p/5
+//
+// The latest accepted tree head is stored as "latest" in the same places, so
+// that a proxy sharing the bucket can serve it without reaching the database.
+type SumDB struct {
+	// Verifier checks the signatures of tree heads. It must be non-nil. Its
+	// name is the name of the database, e.g., "sum.golang.org".
+	Verifier note.Verifier
+
+	// Upstream is the base URL of the checksum database. If empty, the
+	// database is reached over HTTPS at its name.
+	Upstream string
+
+	// Offline, if true, means the proxy never contacts the upstream, and
+	// serves only what it has cached locally or in S3.
+	Offline bool
+
+	// Local is the path of a local cache directory where records and tiles
+	// are cached. It must be non-empty.
+	Local string
+
+	// S3Client is the S3 client used to read and write cache entries to the
+	// backing store. It must be non-nil.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
+	// intervening slash.
+	KeyPrefix string
+
+	// Client, if non-nil, is used to issue requests to the upstream. If nil,
+	// [http.DefaultClient] is used.
+	Client *http.Client
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each request handled by the proxy is logged at [slog.LevelDebug] when it
+	// is finished, with the message "sumdb" and the attributes:
+	//
+	//    path    -- the requested path
+	//    result  -- "hit", "hit S3", "fetch", "stale", or "error"
+	//    elapsed -- how long the request took
+	//    err     -- the error reported, if any
+	//
+	// Responses that fail verification are logged at [slog.LevelError].
+	Logger *slog.Logger
+
+	initOnce sync.Once
+	tasks    *taskgroup.Group
+	start    func(taskgroup.Task)
+
+	mu        sync.Mutex
+	loaded    bool      // latest has been loaded from storage
+	latest    tlog.Tree // the latest accepted tree
+	latestMsg []byte    // the signed note for latest
+
+	latestRequest expvar.Int // /latest requests
+	latestFetch   expvar.Int // tree heads fetched and accepted
+	latestStale   expvar.Int // stored tree heads served after upstream failure
+	lookupRequest expvar.Int // /lookup requests
+	lookupHit     expvar.Int // lookups served from local cache
+	lookupFault   expvar.Int // lookups faulted in from S3
+	lookupFetch   expvar.Int // lookups fetched from upstream
+	tileRequest   expvar.Int // /tile requests
+	tileHit       expvar.Int // tiles served from local cache
+	tileVerify    expvar.Int // tiles served after verification
+	verifyError   expvar.Int // responses that failed verification
+	requestError  expvar.Int // requests that failed for other reasons
+	pushError     expvar.Int // errors writing to S3
+}
+
+func (s *SumDB) init() {
+	s.initOnce.Do(func() {
+		s.tasks, s.start = taskgroup.New(nil).Limit(runtime.NumCPU())
+	})
+}
+
+// Name returns the name of the checksum database served by s.
+func (s *SumDB) Name() string { return s.Verifier.Name() }
+
+// Metrics returns a map of proxy metrics for s. The caller is responsible to
+// publish these metrics as desired.
+func (s *SumDB) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("latest_request", &s.latestRequest)
+	m.Set("latest_fetch", &s.latestFetch)
+	m.Set("latest_stale", &s.latestStale)
+	m.Set("lookup_request", &s.lookupRequest)
+	m.Set("lookup_hit", &s.lookupHit)
+	m.Set("lookup_fault", &s.lookupFault)
+	m.Set("lookup_fetch", &s.lookupFetch)
+	m.Set("tile_request", &s.tileRequest)
+	m.Set("tile_hit", &s.tileHit)
+	m.Set("tile_verify", &s.tileVerify)
+	m.Set("verify_error", &s.verifyError)
+	m.Set("request_error", &s.requestError)
+	m.Set("push_error", &s.pushError)
+	return m
+}
+
+// Close waits until all background updates are complete.
+func (s *SumDB) Close() error {
+	s.init()
+	return s.tasks.Wait()
+}
+
+// ServeHTTP implements the [http.Handler] interface for the proxy.
+func (s *SumDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	start := time.Now()
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	var data []byte
+	var result string
+	var err error
+	switch {
+	case p == "supported":
+		w.WriteHeader(http.StatusOK)
+		return
+	case p == "latest":
+		data, result, err = s.serveLatest(r.Context())
+	case strings.HasPrefix(p, "lookup/"):
+		data, result, err = s.serveLookup(r.Context(), p)
+	case strings.HasPrefix(p, "tile/"):
+		data, result, err = s.serveTile(r.Context(), p)
+	default:
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		result = "error"
+		if errors.Is(err, ErrSumDBMisbehavior) {
+			s.verifyError.Add(1)
+			s.logger().Error("sumdb verification failed", "name", s.Name(), "path", p, "err", err)
+		} else {
+			s.requestError.Add(1)
+		}
+	}
+	s.logger().Debug("sumdb", "path", p, "result", result, "elapsed", time.Since(start), "err", err)
+	switch {
+	case err == nil:
+		if strings.HasPrefix(p, "tile/") {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Write(data)
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// serveLatest returns the latest signed tree head. Online, it is fetched from
+// the upstream and checked against the last tree accepted; if the upstream
+// cannot be reached, the last tree accepted is served instead.
+func (s *SumDB) serveLatest(ctx context.Context) ([]byte, string, error) {
+	s.latestRequest.Add(1)
+	if !s.Offline {
+		msg, err := s.fetch(ctx, "latest")
+		if err == nil {
+			if _, err := s.mergeLatest(ctx, msg); err != nil {
+				return nil, "", err
+			}
+			s.latestFetch.Add(1)
+			return msg, "fetch", nil
+		}
+		s.logger().Debug("fetch latest failed", "name", s.Name(), "err", err)
+	}
+	_, msg, err := s.current(ctx)
+	if err != nil {
+		return nil, "", err
+	} else if msg == nil {
+		return nil, "", fmt.Errorf("no tree head available: %w", fs.ErrNotExist)
+	}
+	s.latestStale.Add(1)
+	return msg, "stale", nil
+}
+
+// serveLookup returns the lookup record at p, of the form "lookup/mod@vers".
+// Records from S3 or the upstream are verified before they are cached.
+func (s *SumDB) serveLookup(ctx context.Context, p string) ([]byte, string, error) {
+	s.lookupRequest.Add(1)
+	mod, vers, ok := strings.Cut(strings.TrimPrefix(p, "lookup/"), "@")
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	} else if _, err := module.UnescapePath(mod); err != nil {
+		return nil, "", fs.ErrNotExist
+	} else if _, err := module.UnescapeVersion(vers); err != nil {
+		return nil, "", fs.ErrNotExist
+	}
+
+	if data, err := os.ReadFile(s.makePath(p)); err == nil {
+		s.lookupHit.Add(1)
+		return data, "hit", nil
+	}
+	if data, err := s.S3Client.GetData(ctx, s.makeKey(p)); err == nil {
+		if err := s.checkLookup(ctx, data); err != nil {
+			return nil, "", err
+		}
+		if err := s.storeLocal(p, data); err != nil {
+			s.logger().Warn("save lookup failed", "path", p, "err", err)
+		}
+		s.lookupFault.Add(1)
+		return data, "hit S3", nil
+	}
+	if s.Offline {
+		return nil, "", fs.ErrNotExist
+	}
+	data, err := s.fetch(ctx, p)
+	if err != nil {
+		return nil, "", err
+	} else if err := s.checkLookup(ctx, data); err != nil {
+		return nil, "", err
+	}
+	s.save(p, data, true)
+	s.lookupFetch.Add(1)
+	return data, "fetch", nil
+}
+
+// checkLookup verifies that the lookup response data is signed by the
+// database, and that its record is included in the tree it was signed with.
+func (s *SumDB) checkLookup(ctx context.Context, data []byte) error {
+	id, text, msg, err := tlog.ParseRecord(data)
+	if err != nil {
+		return fmt.Errorf("%w: invalid lookup record: %v", ErrSumDBMisbehavior, err)
+	}
+	tree, err := s.mergeLatest(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if id >= tree.N {
+		return fmt.Errorf("%w: record %d is not in tree of size %d", ErrSumDBMisbehavior, id, tree.N)
+	}
+	hashes, err := tlog.TileHashReader(tree, s.tileReader(ctx)).ReadHashes([]int64{tlog.StoredHashIndex(0, id)})
+	if err != nil {
+		return err
+	} else if hashes[0] != tlog.RecordHash(text) {
+		return fmt.Errorf("%w: record %d does not match tree", ErrSumDBMisbehavior, id)
+	}
+	return nil
+}
+
+// serveTile returns the hash tile at p. Tiles not cached locally are rebuilt
+// from hashes verified against the latest accepted tree, which is refreshed
+// from the upstream if it does not yet cover the tile.
+func (s *SumDB) serveTile(ctx context.Context, p string) ([]byte, string, error) {
+	s.tileRequest.Add(1)
+	t, err := tlog.ParseTilePath(p)
+	if err != nil || t.H != sumdbHeight || t.L < 0 {
+		return nil, "", fs.ErrNotExist
+	}
+	if data, err := os.ReadFile(s.makePath(p)); err == nil {
+		s.tileHit.Add(1)
+		return data, "hit", nil
+	}
+
+	tree, _, err := s.current(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if !tileInTree(t, tree) && !s.Offline {
+		msg, err := s.fetch(ctx, "latest")
+		if err != nil {
+			return nil, "", err
+		} else if tree, err = s.mergeLatest(ctx, msg); err != nil {
+			return nil, "", err
+		}
+	}
+	if !tileInTree(t, tree) {
+		return nil, "", fmt.Errorf("tile %s is beyond tree of size %d: %w", p, tree.N, fs.ErrNotExist)
+	}
+
+	indexes := make([]int64, t.W)
+	for i := range indexes {
+		indexes[i] = tlog.StoredHashIndex(t.L*t.H, t.N<<t.H+int64(i))
+	}
+	hashes, err := tlog.TileHashReader(tree, s.tileReader(ctx)).ReadHashes(indexes)
+	if err != nil {
+		return nil, "", err
+	}
+	data := make([]byte, 0, len(hashes)*tlog.HashSize)
+	for _, h := range hashes {
+		data = append(data, h[:]...)
+	}
+	if _, err := os.Stat(s.makePath(p)); err != nil {
+		s.save(p, data, true)
+	}
+	s.tileVerify.Add(1)
+	return data, "fetch", nil
+}
+
+// tileInTree reports whether every hash in t is stored in tree.
+func tileInTree(t tlog.Tile, tree tlog.Tree) bool {
+	return t.N<<t.H+int64(t.W) <= tree.N>>(t.L*t.H)
+}
+
+// current returns the latest accepted tree and its signed note, loading them
+// from storage if necessary. If no tree has been accepted, it returns the
+// empty tree and a nil note.
+func (s *SumDB) current(ctx context.Context) (tlog.Tree, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		msg, err := os.ReadFile(s.makePath("latest"))
+		if err != nil {
+			msg, err = s.S3Client.GetData(ctx, s.makeKey("latest"))
+		}
+		if err == nil {
+			tree, err := s.openTree(msg)
+			if err != nil {
+				return tlog.Tree{}, nil, err
+			}
+			s.latest, s.latestMsg = tree, msg
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return tlog.Tree{}, nil, fmt.Errorf("load latest tree: %w", err)
+		}
+		s.loaded = true
+	}
+	return s.latest, s.latestMsg, nil
+}
+
+// mergeLatest checks the signed tree head msg, and verifies that it is
+// consistent with the latest accepted tree. If it is newer, it becomes the
+// latest accepted tree. It returns the tree signed by msg.
+func (s *SumDB) mergeLatest(ctx context.Context, msg []byte) (tlog.Tree, error) {
+	tree, err := s.openTree(msg)
+	if err != nil {
+		return tlog.Tree{}, err
+	}
+	for {
+		cur, _, err := s.current(ctx)
+		if err != nil {
+			return tlog.Tree{}, err
+		}
+		if tree.N <= cur.N {
+			return tree, s.checkTrees(ctx, tree, cur)
+		}
+		if err := s.checkTrees(ctx, cur, tree); err != nil {
+			return tlog.Tree{}, err
+		}
+
+		// Install the new tree, unless another request moved the latest tree
+		// in the meantime, in which case check again.
+		s.mu.Lock()
+		ok := s.latest == cur
+		if ok {
+			s.latest, s.latestMsg = tree, msg
+		}
+		s.mu.Unlock()
+		if ok {
+			s.save("latest", msg, false)
+			s.logger().Debug("sumdb tree updated", "name", s.Name(), "size", tree.N)
+			return tree, nil
+		}
+	}
+}
+
+// checkTrees verifies that older is a prefix of newer.
+func (s *SumDB) checkTrees(ctx context.Context, older, newer tlog.Tree) error {
+	if older.N == 0 {
+		return nil
+	}
+	h, err := tlog.TreeHash(older.N, tlog.TileHashReader(newer, s.tileReader(ctx)))
+	if err != nil {
+		return fmt.Errorf("check tree %d against tree %d: %w", older.N, newer.N, err)
+	} else if h != older.Hash {
+		return fmt.Errorf("%w: tree %d is inconsistent with tree %d", ErrSumDBMisbehavior, older.N, newer.N)
+	}
+	return nil
+}
+
+// openTree verifies the signature on the tree head msg, and returns its tree.
+func (s *SumDB) openTree(msg []byte) (tlog.Tree, error) {
+	n, err := note.Open(msg, note.VerifierList(s.Verifier))
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("%w: invalid tree note: %v", ErrSumDBMisbehavior, err)
+	}
+	tree, err := tlog.ParseTree([]byte(n.Text))
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("%w: invalid tree: %v", ErrSumDBMisbehavior, err)
+	}
+	return tree, nil
+}
+
+// tileReader returns a [tlog.TileReader] that reads tiles from the cache, or
+// from the upstream, and caches those tiles that have been verified.
+func (s *SumDB) tileReader(ctx context.Context) tlog.TileReader {
+	return &sumdbTiles{s: s, ctx: ctx, fetched: make(map[tlog.Tile]bool)}
+}
+
+type sumdbTiles struct {
+	s       *SumDB
+	ctx     context.Context
+	fetched map[tlog.Tile]bool // tiles read from the upstream
+}
+
+func (r *sumdbTiles) Height() int { return sumdbHeight }
+
+func (r *sumdbTiles) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	out := make([][]byte, len(tiles))
+	for i, t := range tiles {
+		p := t.Path()
+		if data, err := os.ReadFile(r.s.makePath(p)); err == nil {
+			out[i] = data
+		} else if data, err := r.s.S3Client.GetData(r.ctx, r.s.makeKey(p)); err == nil {
+			out[i] = data
+		} else if r.s.Offline {
+			return nil, fmt.Errorf("tile %s is not cached: %w", p, fs.ErrNotExist)
+		} else if data, err := r.s.fetch(r.ctx, p); err == nil {
+			out[i] = data
+			r.fetched[t] = true
+		} else {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// SaveTiles caches tiles that have been verified. Tiles fetched from the
+// upstream are also written back to S3.
+func (r *sumdbTiles) SaveTiles(tiles []tlog.Tile, data [][]byte) {
+	for i, t := range tiles {
+		if _, err := os.Stat(r.s.makePath(t.Path())); err != nil {
+			r.s.save(t.Path(), data[i], r.fetched[t])
+		}
+	}
+}
+
+// save stores data for the entry at p in the local cache and, if push is
+// true, writes it back to S3 in the background. The latest tree head is
+// always written back.
+func (s *SumDB) save(p string, data []byte, push bool) {
+	if err := s.storeLocal(p, data); err != nil {
+		s.logger().Warn("save sumdb entry failed", "path", p, "err", err)
+	}
+	if (!push && p != "latest") || s.S3Client.ReadOnly {
+		return
+	}
+	s.start(func() error {
+		sctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+		defer cancel()
+		if err := s.S3Client.Put(sctx, s.makeKey(p), bytes.NewReader(data)); err != nil {
+			s.pushError.Add(1)
+			s.logger().Warn("s3 put failed", "path", p, "err", err)
+		}
+		return nil
+	})
+}
+
+// fetch issues a GET request for p to the upstream, and returns the body of
+// the response if it succeeded. If the upstream reports 404 or 410, the error
+// satisfies [fs.ErrNotExist].
+func (s *SumDB) fetch(ctx context.Context, p string) ([]byte, error) {
+	u := s.upstream() + "/" + p
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	cli := s.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	rsp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(rsp.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("get %q: %w", u, fs.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("get %q: %s", u, rsp.Status)
+	}
+}
+
+// storeLocal writes data atomically to the local cache entry for p.
+func (s *SumDB) storeLocal(p string, data []byte) error {
+	path := s.makePath(p)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomicfile.WriteData(path, data, 0644)
+}
+
+func (s *SumDB) upstream() string {
+	if s.Upstream == "" {
+		return "https://" + s.Name()
+	}
+	return strings.TrimSuffix(s.Upstream, "/")
+}
+
+// makePath returns the local cache path for the entry at p.
+func (s *SumDB) makePath(p string) string {
+	return filepath.Join(s.Local, filepath.FromSlash(p))
+}
+
+// makeKey returns the S3 object key for the entry at p.
+func (s *SumDB) makeKey(p string) string {
+	return path.Join(s.KeyPrefix, p)
+}
+
+func (s *SumDB) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// memS3 is a stand-in for S3 that keeps objects in memory.
+type memS3 struct {
+	mu   sync.Mutex
+	objs map[string][]byte
+}
+
+func (m *memS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := m.objs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		m.objs[r.URL.Path] = data
+	}
+}
+
+func newS3Client(url string) *s3util.Client {
+	return &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(url),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test",
+	}
+}
+
+// sumdbOps implements sumdb.ClientOps for a client of the proxy at url.
+type sumdbOps struct {
+	t      *testing.T
+	url    string
+	key    string
+	latest []byte
+}
+
+func (o *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	rsp, err := http.Get(o.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", path, rsp.Status)
+	}
+	return io.ReadAll(rsp.Body)
+}
+
+func (o *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	return o.latest, nil
+}
+
+func (o *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	o.latest = new
+	return nil
+}
+
+func (*sumdbOps) ReadCache(string) ([]byte, error) { return nil, fmt.Errorf("no cache") }
+func (*sumdbOps) WriteCache(string, []byte)        {}
+func (o *sumdbOps) Log(msg string)                 { o.t.Log(msg) }
+func (o *sumdbOps) SecurityError(msg string)       { o.t.Errorf("security error: %s", msg) }
+
+func TestSumDB(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := sumdb.NewTestServer(skey, func(path, vers string) ([]byte, error) {
+		return fmt.Appendf(nil, "%[1]s %[2]s h1:abc=\n%[1]s %[2]s/go.mod h1:def=\n", path, vers), nil
+	})
+	var fetches atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		sumdb.NewServer(ts).ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	fakeS3 := httptest.NewServer(&memS3{objs: make(map[string][]byte)})
+	defer fakeS3.Close()
+
+	lookup := func(t *testing.T, proxyURL string) {
+		t.Helper()
+		cli := sumdb.NewClient(&sumdbOps{t: t, url: proxyURL, key: vkey})
+		for _, mod := range []string{"example.com/a", "example.com/b", "example.com/a"} {
+			lines, err := cli.Lookup(mod, "v1.0.0")
+			if err != nil {
+				t.Fatalf("Lookup %s: %v", mod, err)
+			}
+			if len(lines) != 1 || !strings.HasPrefix(lines[0], mod+" v1.0.0 ") {
+				t.Errorf("Lookup %s: got %q", mod, lines)
+			}
+		}
+	}
+
+	// Online, records and tiles are fetched from the upstream and verified.
+	online := &modproxy.SumDB{
+		Verifier:  verifier,
+		Upstream:  upstream.URL,
+		Local:     t.TempDir(),
+		S3Client:  newS3Client(fakeS3.URL),
+		KeyPrefix: "sumdb",
+	}
+	srv := httptest.NewServer(online)
+	lookup(t, srv.URL)
+	srv.Close()
+	if err := online.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if fetches.Load() == 0 {
+		t.Error("No fetches from upstream")
+	}
+
+	// Offline, with a fresh local cache, everything is served out of S3.
+	fetches.Store(0)
+	offline := &modproxy.SumDB{
+		Verifier:  verifier,
+		Upstream:  upstream.URL,
+		Offline:   true,
+		Local:     t.TempDir(),
+		S3Client:  newS3Client(fakeS3.URL),
+		KeyPrefix: "sumdb",
+	}
+	srv = httptest.NewServer(offline)
+	defer srv.Close()
+	lookup(t, srv.URL)
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("Offline: got %d fetches from upstream, want 0", n)
+	}
+	if rsp, err := http.Get(srv.URL + "/lookup/example.com/c@v1.0.0"); err != nil {
+		t.Fatal(err)
+	} else if rsp.Body.Close(); rsp.StatusCode != http.StatusNotFound {
+		t.Errorf("Offline lookup of uncached record: got %s, want 404", rsp.Status)
+	}
+
+	// A tree signed with a different key is rejected.
+	_, otherKey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := note.NewVerifier(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := httptest.NewServer(&modproxy.SumDB{
+		Verifier: other,
+		Upstream: upstream.URL,
+		Local:    t.TempDir(),
+		S3Client: newS3Client(fakeS3.URL),
+	})
+	defer bad.Close()
+	if rsp, err := http.Get(bad.URL + "/latest"); err != nil {
+		t.Fatal(err)
+	} else if rsp.Body.Close(); rsp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Latest with wrong key: got %s, want 502", rsp.Status)
+	}
+}
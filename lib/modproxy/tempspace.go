@@ -0,0 +1,218 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy
+
+import (
+	"context"
+	"expvar"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TempSpace manages a directory of temporary files for a module proxy, such
+// as partial downloads of modules fetched from upstream and the scratch space
+// of the go command for direct fetches. Set it as the TempDir of the proxy
+// and its fetcher.
+//
+// The proxy removes its temporary files when a fetch completes, but files of
+// fetches in progress are left behind if the process exits. TempSpace removes
+// those when it is reset, and prunes files abandoned while it runs.
+type TempSpace struct {
+	// Dir is the path of the temporary directory. It must be non-empty.
+	Dir string
+
+	// MaxBytes, if positive, is the size in bytes of temporary files beyond
+	// which the proxy does not fetch modules. While the files exceed this
+	// size, the handler returned by Limit serves only cached modules, and
+	// reports 503 Service Unavailable for the rest.
+	MaxBytes int64
+
+	// MaxAge, if positive, is the age beyond which files of a fetch that
+	// have not been modified are pruned as abandoned. If zero, the default
+	// is one hour.
+	MaxAge time.Duration
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+
+	bytes   expvar.Int // bytes of temporary files at the last check
+	entries expvar.Int // fetches with temporary files at the last check
+	pruned  expvar.Int // bytes of abandoned temporary files removed
+	refused expvar.Int // requests refused while over MaxBytes
+}
+
+// Metrics returns a map of metrics for t. The caller is responsible for
+// publishing these metrics.
+func (t *TempSpace) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("temp_bytes", &t.bytes)
+	m.Set("temp_entries", &t.entries)
+	m.Set("temp_pruned_bytes", &t.pruned)
+	m.Set("temp_refused", &t.refused)
+	return m
+}
+
+// Reset removes everything in the temporary directory, creating it if it
+// does not exist, and reports the number of bytes removed. Call Reset before
+// the proxy starts, since it also removes the files of fetches in progress.
+func (t *TempSpace) Reset() (int64, error) {
+	var removed int64
+	for _, e := range t.scan() {
+		removed += e.size
+	}
+	if err := os.RemoveAll(t.Dir); err != nil {
+		return 0, err
+	}
+	t.bytes.Set(0)
+	t.entries.Set(0)
+	return removed, os.MkdirAll(t.Dir, 0700)
+}
+
+// Check measures the temporary files, and prunes those of fetches abandoned
+// for longer than MaxAge.
+func (t *TempSpace) Check() {
+	cutoff := time.Now().Add(-t.maxAge())
+	var total, n int64
+	for _, e := range t.scan() {
+		if e.mtime.Before(cutoff) {
+			if err := os.RemoveAll(e.path); err == nil {
+				t.pruned.Add(e.size)
+				t.logger().Info("pruned abandoned fetch files", "path", e.path, "bytes", e.size)
+				continue
+			}
+		}
+		total += e.size
+		n++
+	}
+	t.bytes.Set(total)
+	t.entries.Set(n)
+}
+
+// Run calls Check periodically until ctx ends.
+func (t *TempSpace) Run(ctx context.Context) {
+	tick := time.NewTicker(30 * time.Second)
+	defer tick.Stop()
+	for {
+		t.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Limit wraps h, which should be a module proxy using t, so that while the
+// temporary files exceed MaxBytes (as of the last check), it serves only what
+// is already in its cache. Other requests report 503 Service Unavailable.
+// If MaxBytes is not positive, Limit returns h unmodified.
+//
+// Limit relies on the proxy honoring the "Disable-Module-Fetch" request
+// header, as [github.com/goproxy/goproxy.Goproxy] does.
+func (t *TempSpace) Limit(h http.Handler) http.Handler {
+	if t.MaxBytes <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.bytes.Value() < t.MaxBytes {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/sumdb/") {
+			t.refuse(w)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Disable-Module-Fetch", "true")
+		h.ServeHTTP(&refuseMissWriter{ResponseWriter: w, t: t}, r)
+	})
+}
+
+func (t *TempSpace) refuse(w http.ResponseWriter) {
+	t.refused.Add(1)
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, "module fetch space exhausted", http.StatusServiceUnavailable)
+}
+
+// refuseMissWriter is an [http.ResponseWriter] that reports a 404 response,
+// which the proxy gives for a module not in its cache, as unavailable.
+type refuseMissWriter struct {
+	http.ResponseWriter
+	t    *TempSpace
+	miss bool
+}
+
+func (w *refuseMissWriter) WriteHeader(code int) {
+	if code != http.StatusNotFound {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.miss = true
+	h := w.Header()
+	h.Del("Cache-Control")
+	h.Del("Content-Length")
+	w.t.refuse(w.ResponseWriter)
+}
+
+func (w *refuseMissWriter) Write(data []byte) (int, error) {
+	if w.miss {
+		return len(data), nil // discard the body of the original response
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// tempEntry describes the files of one fetch in the temporary directory.
+type tempEntry struct {
+	path  string
+	size  int64     // total size of regular files
+	mtime time.Time // latest modification time of any file
+}
+
+// scan reports the top-level entries of the temporary directory.
+func (t *TempSpace) scan() []tempEntry {
+	des, err := os.ReadDir(t.Dir)
+	if err != nil {
+		return nil
+	}
+	out := make([]tempEntry, 0, len(des))
+	for _, de := range des {
+		e := tempEntry{path: filepath.Join(t.Dir, de.Name())}
+		filepath.WalkDir(e.path, func(_ string, de fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // vanished, or unreadable
+			}
+			if fi, err := de.Info(); err == nil {
+				if fi.ModTime().After(e.mtime) {
+					e.mtime = fi.ModTime()
+				}
+				if fi.Mode().IsRegular() {
+					e.size += fi.Size()
+				}
+			}
+			return nil
+		})
+		out = append(out, e)
+	}
+	return out
+}
+
+func (t *TempSpace) maxAge() time.Duration {
+	if t.MaxAge > 0 {
+		return t.MaxAge
+	}
+	return time.Hour
+}
+
+func (t *TempSpace) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return discardLogger
+}
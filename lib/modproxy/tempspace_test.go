@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package modproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/modproxy"
+)
+
+func writeTemp(t *testing.T, dir, name string, size int, age time.Duration) {
+	t.Helper()
+	path := filepath.Join(dir, name, "file")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-age)
+	for _, p := range []string{path, filepath.Dir(path)} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTempSpace(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tmp")
+	ts := &modproxy.TempSpace{Dir: dir, MaxBytes: 100}
+
+	// Reset discards leftovers, and creates the directory.
+	writeTemp(t, dir, "goproxy.tmp.1", 50, 0)
+	if n, err := ts.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	} else if n != 50 {
+		t.Errorf("Reset: got %d bytes, want 50", n)
+	}
+	if des, err := os.ReadDir(dir); err != nil || len(des) != 0 {
+		t.Fatalf("After Reset: got %d entries, %v; want empty", len(des), err)
+	}
+
+	// Check prunes abandoned fetches, and keeps active ones.
+	writeTemp(t, dir, "goproxy.tmp.old", 30, 2*time.Hour)
+	writeTemp(t, dir, "goproxy.tmp.new", 120, 0)
+	ts.Check()
+	if _, err := os.Stat(filepath.Join(dir, "goproxy.tmp.old")); !os.IsNotExist(err) {
+		t.Errorf("Abandoned fetch not pruned: %v", err)
+	}
+	m := ts.Metrics()
+	if got := m.Get("temp_bytes").String(); got != "120" {
+		t.Errorf("temp_bytes: got %s, want 120", got)
+	}
+	if got := m.Get("temp_pruned_bytes").String(); got != "30" {
+		t.Errorf("temp_pruned_bytes: got %s, want 30", got)
+	}
+
+	// Over the limit, fetches are disabled and misses are unavailable.
+	h := ts.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Disable-Module-Fetch") != "true" {
+			t.Error("Fetch not disabled over the limit")
+		}
+		if r.URL.Path == "/cached/@v/v1.0.0.info" {
+			w.Write([]byte("{}"))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/cached/@v/v1.0.0.info", http.StatusOK},
+		{"/missing/@v/v1.0.0.info", http.StatusServiceUnavailable},
+		{"/sumdb/sum.golang.org/supported", http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s: got %d, want %d", tc.path, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("GET %s: missing Retry-After", tc.path)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package npmproxy implements a pull-through cache for an npm package
+// registry, caching files locally on disk, backed by objects in an S3 bucket.
+//
+// The proxy distinguishes two kinds of request:
+//
+//   - Package tarballs ("/<name>/-/<file>.tgz") are immutable. They are cached
+//     locally and in S3, and served from the cache once present.
+//
+//   - Package metadata documents ("/<name>") change as new versions are
+//     published. They are cached locally for a short period, and served from
+//     the cache if the upstream cannot be reached. The tarball URLs in each
+//     document are rewritten to refer to the proxy.
+//
+// Other requests, including those not using GET, are forwarded to the upstream
+// without caching.
+package npmproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// DefaultUpstream is the default upstream registry used by a [Server].
+const DefaultUpstream = "https://registry.npmjs.org"
+
+// Server is a caching proxy for an npm registry.
+//
+// # Cache Layout
+//
+// Cached metadata documents and tarballs are stored under a SHA256 digest of
+// their upstream URL, encoded as hex and partitioned by the first two bytes of
+// the digest:
+//
+//	<local>/meta/<xx>/<digest>
+//	<local>/tarball/<xx>/<digest>
+//
+// Tarballs are also stored in S3 under the same names, relative to the key
+// prefix. Metadata documents are not stored in S3.
+type Server struct {
+	// Upstream is the base URL of the upstream registry. If empty,
+	// [DefaultUpstream] is used.
+	Upstream string
+
+	// BaseURL, if non-empty, is the external base URL of the proxy, used to
+	// rewrite tarball URLs in metadata documents (for example,
+	// "http://cache.example.com:5970/npm"). If empty, it is derived from the
+	// Host of each request and MountPath.
+	BaseURL string
+
+	// MountPath is the path prefix at which the proxy is mounted (e.g.,
+	// "/npm"), used to derive the base URL when BaseURL is empty.
+	MountPath string
+
+	// Local is the path of a local cache directory where responses are cached.
+	// It must be non-empty.
+	Local string
+
+	// S3Client is the S3 client used to read and write cache entries to the
+	// backing store. It must be non-nil.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
+	// intervening slash.
+	KeyPrefix string
+
+	// MetadataTTL is how long a cached metadata document is served before it
+	// is refreshed from the upstream. If zero, a default of 5 minutes is used.
+	MetadataTTL time.Duration
+
+	// Client, if non-nil, is used to issue requests to the upstream. If nil,
+	// [http.DefaultClient] is used.
+	Client *http.Client
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each request handled by the proxy is logged at [slog.LevelDebug] (these
+	// logs are detailed, but noisy) when it is finished, with the message
+	// "meta" or "tarball" and the attributes:
+	//
+	//    name    -- the name of the requested object
+	//    result  -- the disposition of the request (see below)
+	//    elapsed -- how long the request took
+	//    err     -- the error reported by the upstream, if any
+	//
+	// The disposition is one of "hit" (served from the local cache), "hit S3"
+	// (faulted in from S3), "fetch" (fetched from the upstream), "stale" (served
+	// from the local cache after the upstream failed), or "error". Requests
+	// forwarded without caching are logged with the message "forward".
+	Logger *slog.Logger
+
+	initOnce sync.Once
+	tasks    *taskgroup.Group
+	start    func(taskgroup.Task)
+	forward  *httputil.ReverseProxy
+
+	metaRequest  expvar.Int // metadata requests
+	metaHit      expvar.Int // metadata served from local cache
+	metaFetch    expvar.Int // metadata fetched from upstream
+	metaStale    expvar.Int // stale metadata served after upstream failure
+	metaError    expvar.Int // metadata requests that failed
+	tarRequest   expvar.Int // tarball requests
+	tarHit       expvar.Int // tarball served from local cache
+	tarFaultHit  expvar.Int // tarball faulted in from S3
+	tarFetch     expvar.Int // tarball fetched from upstream
+	tarError     expvar.Int // tarball requests that failed
+	tarBytes     expvar.Int // bytes of tarballs fetched from upstream
+	pushError    expvar.Int // errors writing tarballs to S3
+	pushBytes    expvar.Int // bytes written to S3
+	reqForwarded expvar.Int // requests forwarded without caching
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.tasks, s.start = taskgroup.New(nil).Limit(runtime.NumCPU())
+		up, _ := url.Parse(s.upstream())
+		s.forward = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(up)
+				pr.Out.Host = up.Host
+			},
+		}
+		if s.Client != nil && s.Client.Transport != nil {
+			s.forward.Transport = s.Client.Transport
+		}
+	})
+}
+
+// Metrics returns a map of proxy metrics for s. The caller is responsible to
+// publish these metrics as desired.
+func (s *Server) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("meta_request", &s.metaRequest)
+	m.Set("meta_hit", &s.metaHit)
+	m.Set("meta_fetch", &s.metaFetch)
+	m.Set("meta_stale", &s.metaStale)
+	m.Set("meta_error", &s.metaError)
+	m.Set("tarball_request", &s.tarRequest)
+	m.Set("tarball_hit", &s.tarHit)
+	m.Set("tarball_fault_hit", &s.tarFaultHit)
+	m.Set("tarball_fetch", &s.tarFetch)
+	m.Set("tarball_error", &s.tarError)
+	m.Set("tarball_bytes", &s.tarBytes)
+	m.Set("push_error", &s.pushError)
+	m.Set("push_bytes", &s.pushBytes)
+	m.Set("req_forwarded", &s.reqForwarded)
+	return m
+}
+
+// Close waits until all background updates are complete.
+func (s *Server) Close() error {
+	s.init()
+	return s.tasks.Wait()
+}
+
+// ServeHTTP implements the [http.Handler] interface for the proxy.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	p := r.URL.EscapedPath()
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead,
+		p == "/", strings.HasPrefix(p, "/-/"):
+		s.reqForwarded.Add(1)
+		s.logger().Debug("forward", "method", r.Method, "name", p)
+		s.forward.ServeHTTP(w, r)
+	case isTarball(p):
+		s.serveTarball(w, r, p)
+	default:
+		s.serveMetadata(w, r, p)
+	}
+}
+
+// isTarball reports whether the escaped request path p refers to a tarball.
+func isTarball(p string) bool {
+	return strings.Contains(p, "/-/") && strings.HasSuffix(p, ".tgz")
+}
+
+// serveMetadata serves the metadata document for a package.
+func (s *Server) serveMetadata(w http.ResponseWriter, r *http.Request, p string) {
+	s.metaRequest.Add(1)
+
+	// Clients may request the full document or an abbreviated one, which
+	// differ in content, so they are cached separately.
+	accept := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), abbreviatedType) {
+		accept = abbreviatedType
+	}
+	metaURL := s.upstream() + p
+	hash := hashURL(metaURL + "\n" + accept)
+	path := s.makePath("meta", hash)
+	start := time.Now()
+
+	fi, err := os.Stat(path)
+	if err == nil && time.Since(fi.ModTime()) < s.metadataTTL() {
+		s.metaHit.Add(1)
+		s.logger().Debug("meta", "name", p, "result", "hit", "elapsed", time.Since(start))
+		s.serveDocument(w, r, path, accept)
+		return
+	}
+
+	err = s.fetchToFile(r.Context(), metaURL, accept, path)
+	if err == nil {
+		s.metaFetch.Add(1)
+		s.logger().Debug("meta", "name", p, "result", "fetch", "elapsed", time.Since(start))
+		s.serveDocument(w, r, path, accept)
+		return
+	}
+
+	// The upstream failed; if we have any copy of the document, serve that.
+	if fi != nil {
+		s.metaStale.Add(1)
+		s.logger().Debug("meta", "name", p, "result", "stale", "elapsed", time.Since(start), "err", err)
+		s.serveDocument(w, r, path, accept)
+		return
+	}
+	s.metaError.Add(1)
+	s.logger().Debug("meta", "name", p, "result", "error", "elapsed", time.Since(start), "err", err)
+	writeError(w, err)
+}
+
+const abbreviatedType = "application/vnd.npm.install-v1+json"
+
+// serveDocument serves the cached metadata document at path, with its
+// tarball URLs rewritten to refer to the proxy.
+func (s *Server) serveDocument(w http.ResponseWriter, r *http.Request, path, contentType string) {
+	doc, err := os.ReadFile(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(rewriteTarballs(doc, s.upstream(), s.baseURL(r)))
+}
+
+// tarballRE matches the tarball URL fields of a metadata document.
+var tarballRE = regexp.MustCompile(`"tarball"\s*:\s*"([^"]*)"`)
+
+// rewriteTarballs rewrites tarball URLs in doc whose prefix is upstream to use
+// base instead. Other URLs are not modified.
+func rewriteTarballs(doc []byte, upstream, base string) []byte {
+	return tarballRE.ReplaceAllFunc(doc, func(m []byte) []byte {
+		u := string(tarballRE.FindSubmatch(m)[1])
+		rest, ok := strings.CutPrefix(u, upstream+"/")
+		if !ok {
+			return m
+		}
+		return []byte(`"tarball":"` + base + "/" + rest + `"`)
+	})
+}
+
+// serveTarball serves a package tarball.
+func (s *Server) serveTarball(w http.ResponseWriter, r *http.Request, p string) {
+	s.tarRequest.Add(1)
+	tarURL := s.upstream() + p
+	hash := hashURL(tarURL)
+	path := s.makePath("tarball", hash)
+	start := time.Now()
+
+	// Check for a hit in the local cache.
+	if _, err := os.Stat(path); err == nil {
+		s.tarHit.Add(1)
+		s.logger().Debug("tarball", "name", p, "result", "hit", "elapsed", time.Since(start))
+		serveTarballFile(w, r, path)
+		return
+	}
+
+	// Fault in from S3.
+	if obj, _, err := s.S3Client.Get(r.Context(), s.makeKey("tarball", hash)); err == nil {
+		err := s.storeLocal(path, obj)
+		obj.Close()
+		if err == nil {
+			s.tarFaultHit.Add(1)
+			s.logger().Debug("tarball", "name", p, "result", "hit S3", "elapsed", time.Since(start))
+			serveTarballFile(w, r, path)
+			return
+		}
+		s.logger().Warn("save tarball failed", "name", p, "err", err)
+	}
+
+	// Fetch from the upstream, and write it back to S3 in the background.
+	if err := s.fetchToFile(r.Context(), tarURL, "application/octet-stream", path); err != nil {
+		s.tarError.Add(1)
+		s.logger().Debug("tarball", "name", p, "result", "error", "elapsed", time.Since(start), "err", err)
+		writeError(w, err)
+		return
+	}
+	s.tarFetch.Add(1)
+	s.logger().Debug("tarball", "name", p, "result", "fetch", "elapsed", time.Since(start))
+	if fi, err := os.Stat(path); err == nil {
+		s.tarBytes.Add(fi.Size())
+		if !s.S3Client.ReadOnly {
+			s.start(s.pushS3(path, s.makeKey("tarball", hash), fi.Size()))
+		}
+	}
+	serveTarballFile(w, r, path)
+}
+
+// pushS3 returns a task that writes the local file at path to S3 under key.
+func (s *Server) pushS3(path, key string, size int64) taskgroup.Task {
+	return func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil // the file was pruned in the meantime
+		}
+		defer f.Close()
+
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := s.S3Client.Put(sctx, key, f); err != nil {
+			s.pushError.Add(1)
+			s.logger().Warn("s3 put failed", "name", key, "err", err)
+		} else {
+			s.pushBytes.Add(size)
+		}
+		return nil
+	}
+}
+
+// fetchToFile fetches u from the upstream and writes the response body
+// atomically to path. If the upstream reports 404, the error satisfies
+// [fs.ErrNotExist].
+func (s *Server) fetchToFile(ctx context.Context, u, accept, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	cli := s.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	rsp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return s.storeLocal(path, rsp.Body)
+	case http.StatusNotFound:
+		return fmt.Errorf("get %q: %w", u, fs.ErrNotExist)
+	default:
+		return fmt.Errorf("get %q: %s", u, rsp.Status)
+	}
+}
+
+// storeLocal writes the contents of r atomically to path in the local cache.
+func (s *Server) storeLocal(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_, err := atomicfile.WriteAll(path, r, 0644)
+	return err
+}
+
+func (s *Server) upstream() string {
+	if s.Upstream == "" {
+		return DefaultUpstream
+	}
+	return strings.TrimSuffix(s.Upstream, "/")
+}
+
+// baseURL returns the external base URL of the proxy for r.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.BaseURL != "" {
+		return strings.TrimSuffix(s.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(s.MountPath, "/")
+}
+
+func (s *Server) metadataTTL() time.Duration {
+	if s.MetadataTTL > 0 {
+		return s.MetadataTTL
+	}
+	return 5 * time.Minute
+}
+
+// makePath returns the local cache path for the specified kind and hash.
+func (s *Server) makePath(kind, hash string) string {
+	return filepath.Join(s.Local, kind, hash[:2], hash)
+}
+
+// makeKey returns the S3 object key for the specified kind and hash.
+func (s *Server) makeKey(kind, hash string) string {
+	return path.Join(s.KeyPrefix, kind, hash[:2], hash)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func serveTarballFile(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, `{"error":"Not found"}`, http.StatusNotFound)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func hashURL(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
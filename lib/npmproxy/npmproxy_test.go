@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package npmproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/npmproxy"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestServer(t *testing.T) {
+	const tarData = "not really a tarball"
+	var fetches int
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.EscapedPath() {
+		case "/@scope%2ffoo":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name":"@scope/foo","versions":{"1.0.0":{"dist":{`+
+				`"tarball":"`+upstream.URL+`/@scope/foo/-/foo-1.0.0.tgz",`+
+				`"integrity":"sha512-abc"}}}}`)
+		case "/@scope/foo/-/foo-1.0.0.tgz":
+			io.WriteString(w, tarData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	// A stand-in for S3 that has no objects, and accepts all writes.
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+		}
+	}))
+	defer fakeS3.Close()
+
+	s := &npmproxy.Server{
+		Upstream:  upstream.URL,
+		MountPath: "/npm",
+		Local:     t.TempDir(),
+		S3Client: &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:       "us-east-1",
+				BaseEndpoint: aws.String(fakeS3.URL),
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket: "test",
+		},
+		MetadataTTL: time.Hour,
+	}
+	defer s.Close()
+	proxy := httptest.NewServer(http.StripPrefix("/npm", s))
+	defer proxy.Close()
+
+	get := func(t *testing.T, u string) string {
+		t.Helper()
+		rsp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("Get %q: %v", u, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Get %q: %s", u, rsp.Status)
+		}
+		return string(body)
+	}
+
+	// The tarball URL is rewritten to refer to the proxy.
+	metaURL := proxy.URL + "/npm/@scope%2ffoo"
+	meta := get(t, metaURL)
+	var doc struct {
+		Versions map[string]struct {
+			Dist struct {
+				Tarball   string `json:"tarball"`
+				Integrity string `json:"integrity"`
+			} `json:"dist"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal([]byte(meta), &doc); err != nil {
+		t.Fatalf("Invalid metadata: %v\n%s", err, meta)
+	}
+	dist := doc.Versions["1.0.0"].Dist
+	if want := proxy.URL + "/npm/@scope/foo/-/foo-1.0.0.tgz"; dist.Tarball != want {
+		t.Errorf("Tarball URL: got %q, want %q", dist.Tarball, want)
+	}
+	if dist.Integrity != "sha512-abc" {
+		t.Errorf("Integrity: got %q, want %q", dist.Integrity, "sha512-abc")
+	}
+	if got := get(t, dist.Tarball); got != tarData {
+		t.Errorf("Tarball: got %q, want %q", got, tarData)
+	}
+
+	// Repeated requests are served from the cache.
+	n := fetches
+	get(t, metaURL)
+	get(t, dist.Tarball)
+	if fetches != n {
+		t.Errorf("Cached requests made %d upstream fetches, want 0", fetches-n)
+	}
+
+	// Expired metadata is served stale if the upstream is unavailable, and
+	// tarballs do not expire.
+	s.MetadataTTL = time.Nanosecond
+	upstream.Close()
+	if got := get(t, metaURL); got != meta {
+		t.Errorf("Stale metadata: got %q, want %q", got, meta)
+	}
+	if got := get(t, dist.Tarball); got != tarData {
+		t.Errorf("Cached tarball: got %q, want %q", got, tarData)
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package peer implements sharing of build cache entries between cache
+// servers over HTTP.
+//
+// Each participating server exports its local build cache via a [Handler],
+// and queries the other servers using a [Client] before falling back to the
+// remote (S3) store.
+//
+// # Protocol
+//
+// A peer serves the object for an action in response to:
+//
+//	GET /peer/action/<action-id>
+//
+// The response body is the object contents, and the output ID is reported in
+// the Gocache-Output-Id header. A missing entry is reported with HTTP 404.
+// A HEAD request may be used to check for an entry without fetching it.
+//
+// # Authentication
+//
+// Peers share a secret key. Each request carries the current time and a
+// random nonce, in the Gocache-Peer-Time and Gocache-Peer-Nonce headers, and
+// a MAC in the Gocache-Peer-Mac header:
+//
+//	HMAC-SHA256(key, "req" || action-id || time || nonce)
+//
+// with the fields separated by NUL bytes. A peer rejects a request whose MAC
+// does not verify, or whose time is more than a minute away from its own, with
+// HTTP 401. A peer reporting a hit authenticates its response in turn, with a
+// Gocache-Peer-Mac header of:
+//
+//	HMAC-SHA256(key, "rsp" || nonce || action-id || output-id || size)
+//
+// The output ID of an object is the SHA-256 digest of its contents, so the
+// client also checks the body it receives against the output ID and size.
+package peer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/gocache/cachedir"
+)
+
+// Handler is an [http.Handler] that serves the protocol for the contents of a
+// local cache directory. It expects to be mounted at "/peer/".
+type Handler struct {
+	Local *cachedir.Dir
+
+	// Key is the secret key shared by the peers. If it is empty, every
+	// request is rejected.
+	Key []byte
+}
+
+// ServeHTTP implements the [http.Handler] interface.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := strings.CutPrefix(r.URL.Path, "/peer/action/")
+	if !ok || !isHexID(id) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	nonce := r.Header.Get(nonceHeader)
+	if !h.checkRequest(r, id, nonce) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	outputID, diskPath, err := h.Local.Get(r.Context(), id)
+	if err != nil || outputID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(outputIDHeader, outputID)
+	w.Header().Set(macHeader, responseMAC(h.Key, nonce, id, outputID, fi.Size()))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// checkRequest reports whether r carries a valid MAC for actionID and nonce,
+// made within maxSkew of the current time.
+func (h Handler) checkRequest(r *http.Request, actionID, nonce string) bool {
+	if len(h.Key) == 0 || nonce == "" {
+		return false
+	}
+	ts := r.Header.Get(timeHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > maxSkew {
+		return false
+	}
+	want := requestMAC(h.Key, actionID, ts, nonce)
+	return hmac.Equal([]byte(r.Header.Get(macHeader)), []byte(want))
+}
+
+const (
+	outputIDHeader = "Gocache-Output-Id"
+	timeHeader     = "Gocache-Peer-Time"
+	nonceHeader    = "Gocache-Peer-Nonce"
+	macHeader      = "Gocache-Peer-Mac"
+
+	// maxSkew is the largest difference allowed between the time of a
+	// request and the clock of the peer serving it.
+	maxSkew = time.Minute
+)
+
+// requestMAC returns the MAC of a request for actionID.
+func requestMAC(key []byte, actionID, ts, nonce string) string {
+	return mac(key, "req", actionID, ts, nonce)
+}
+
+// responseMAC returns the MAC of a response to the request with nonce, for
+// an object of the given output ID and size.
+func responseMAC(key []byte, nonce, actionID, outputID string, size int64) string {
+	return mac(key, "rsp", nonce, actionID, outputID, strconv.FormatInt(size, 10))
+}
+
+func mac(key []byte, fields ...string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isHexID(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Client queries a set of peers for build cache entries.
+type Client struct {
+	// Peers returns the current list of peer addresses (host:port).
+	// It must be non-nil.
+	Peers func() []string
+
+	// HTTPClient is used to issue requests. If nil, a client with a short
+	// timeout is used.
+	HTTPClient *http.Client
+
+	// Timeout bounds the time spent looking up an action on the peers.
+	// If zero, a default of 2 seconds is used.
+	Timeout time.Duration
+
+	// Key is the secret key shared by the peers. It must be non-empty.
+	Key []byte
+}
+
+// Object is a cache object fetched from a peer. The caller must close Body.
+//
+// Body is checked against the output ID and size as it is read: if its
+// contents do not match, reading it reports [ErrMismatch] at the end instead
+// of [io.EOF], so a caller that stores it must discard it on error.
+type Object struct {
+	Peer     string // the address of the peer that served the object
+	OutputID string
+	ModTime  time.Time
+	Size     int64
+	Body     io.ReadCloser
+}
+
+// ErrMismatch is reported when the contents of an object fetched from a peer
+// do not match its output ID or size.
+var ErrMismatch = errors.New("peer object does not match its output ID")
+
+// Get queries all the peers concurrently for the specified action, and
+// fetches the corresponding object from the first peer to report a hit.
+// If no peer has the action, Get reports an error satisfying
+// [fs.ErrNotExist].
+func (c *Client) Get(ctx context.Context, actionID string) (*Object, error) {
+	peers := c.Peers()
+	if len(peers) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	lctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	hits := make(chan string, len(peers))
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rsp, err := c.do(lctx, http.MethodHead, p, actionID); err == nil {
+				rsp.Body.Close()
+				hits <- p
+			}
+		}()
+	}
+	go func() { wg.Wait(); close(hits) }()
+
+	p, ok := <-hits
+	cancel() // stop waiting for the other peers
+	if !ok {
+		return nil, fmt.Errorf("action %s: %w", actionID, fs.ErrNotExist)
+	}
+	rsp, err := c.do(ctx, http.MethodGet, p, actionID)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s: %w", p, err)
+	}
+	outputID := rsp.Header.Get(outputIDHeader)
+	mtime, _ := http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return &Object{
+		Peer:     p,
+		OutputID: outputID,
+		ModTime:  mtime,
+		Size:     rsp.ContentLength,
+		Body: &checkReader{
+			r:    rsp.Body,
+			c:    rsp.Body,
+			h:    sha256.New(),
+			want: outputID,
+			left: rsp.ContentLength,
+		},
+	}, nil
+}
+
+// do issues a request for actionID to peer, and returns the response if it
+// reports success and is authenticated. The caller must close the response
+// body.
+func (c *Client) do(ctx context.Context, method, peer, actionID string) (*http.Response, error) {
+	if len(c.Key) == 0 {
+		return nil, errors.New("no peer key")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+peer+"/peer/action/"+actionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ts := rand.Text(), strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timeHeader, ts)
+	req.Header.Set(nonceHeader, nonce)
+	req.Header.Set(macHeader, requestMAC(c.Key, actionID, ts, nonce))
+	rsp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	outputID := rsp.Header.Get(outputIDHeader)
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		rsp.Body.Close()
+		return nil, fs.ErrNotExist
+	case rsp.StatusCode != http.StatusOK:
+		rsp.Body.Close()
+		return nil, errors.New(rsp.Status)
+	case !isHexID(outputID):
+		rsp.Body.Close()
+		return nil, errors.New("missing output ID")
+	case rsp.ContentLength < 0:
+		rsp.Body.Close()
+		return nil, errors.New("missing content length")
+	case !hmac.Equal([]byte(rsp.Header.Get(macHeader)), []byte(responseMAC(c.Key, nonce, actionID, outputID, rsp.ContentLength))):
+		rsp.Body.Close()
+		return nil, errors.New("invalid response MAC")
+	}
+	return rsp, nil
+}
+
+// checkReader reads an object body, and reports [ErrMismatch] at the end if
+// its contents do not have the wanted digest and size.
+type checkReader struct {
+	r    io.Reader
+	c    io.Closer
+	h    hash.Hash
+	want string // hex SHA-256 digest
+	left int64  // bytes remaining
+}
+
+func (c *checkReader) Read(data []byte) (int, error) {
+	nr, err := c.r.Read(data)
+	c.h.Write(data[:nr])
+	c.left -= int64(nr)
+	if c.left < 0 {
+		return nr, ErrMismatch
+	} else if err == io.EOF && (c.left != 0 || hex.EncodeToString(c.h.Sum(nil)) != c.want) {
+		return nr, ErrMismatch
+	}
+	return nr, err
+}
+
+func (c *checkReader) Close() error { return c.c.Close() }
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 2 * time.Second
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultClient
+}
+
+var defaultClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Resolver maintains a list of peer addresses from a specification.
+//
+// The specification is a comma-separated list of entries, each of which is
+// either a literal "host:port" address, or a DNS name to be resolved:
+//
+//	dns+srv://_service._proto.name  -- addresses from SRV records
+//	dns://name:port                 -- addresses from A/AAAA records
+//
+// DNS names are re-resolved periodically.
+type Resolver struct {
+	// Spec is the peer specification, as described above.
+	Spec string
+
+	// Self, if non-empty, is the address of this server, which is excluded
+	// from the resulting peer list.
+	Self string
+
+	// Refresh is the interval between DNS lookups. If zero, a default of 30
+	// seconds is used.
+	Refresh time.Duration
+
+	// Logger, if non-nil, is used to log resolution errors.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	peers   []string
+	updated time.Time
+}
+
+// Peers returns the current list of peers, refreshing DNS entries if needed.
+// It is safe for concurrent use, and is suitable for use as [Client.Peers].
+func (r *Resolver) Peers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	refresh := r.Refresh
+	if refresh <= 0 {
+		refresh = 30 * time.Second
+	}
+	if r.peers == nil || time.Since(r.updated) > refresh {
+		r.peers = r.resolve()
+		r.updated = time.Now()
+	}
+	return r.peers
+}
+
+func (r *Resolver) resolve() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out := []string{}
+	add := func(addr string) {
+		if addr != r.Self {
+			out = append(out, addr)
+		}
+	}
+	for _, e := range strings.Split(r.Spec, ",") {
+		e = strings.TrimSpace(e)
+		switch {
+		case e == "":
+			continue
+		case strings.HasPrefix(e, "dns+srv://"):
+			_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", strings.TrimPrefix(e, "dns+srv://"))
+			if err != nil {
+				r.logger().Warn("resolve peers failed", "spec", e, "err", err)
+				continue
+			}
+			for _, srv := range srvs {
+				add(net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+			}
+		case strings.HasPrefix(e, "dns://"):
+			host, port, err := net.SplitHostPort(strings.TrimPrefix(e, "dns://"))
+			if err != nil {
+				r.logger().Warn("invalid peer spec", "spec", e, "err", err)
+				continue
+			}
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				r.logger().Warn("resolve peers failed", "spec", e, "err", err)
+				continue
+			}
+			for _, a := range addrs {
+				add(net.JoinHostPort(a, port))
+			}
+		default:
+			add(e)
+		}
+	}
+	return out
+}
+
+func (r *Resolver) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.New(slog.DiscardHandler)
+}
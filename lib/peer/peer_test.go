@@ -0,0 +1,124 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package peer_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/gocache"
+	"github.com/creachadair/gocache/cachedir"
+	"github.com/grafana/go-cache-plugin/lib/peer"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const actionID, body = "a1b2c3", "hello, world"
+	outputID := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	put := func(actionID, outputID, body string) {
+		t.Helper()
+		if _, err := dir.Put(context.Background(), gocache.Object{
+			ActionID: actionID,
+			OutputID: outputID,
+			Size:     int64(len(body)),
+			Body:     strings.NewReader(body),
+		}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	put(actionID, outputID, body)
+	put("bad0", "d4e5f6", "not what it claims")
+
+	key := []byte("shared secret")
+	hit := httptest.NewServer(peer.Handler{Local: dir, Key: key})
+	defer hit.Close()
+	empty, err := cachedir.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	miss := httptest.NewServer(peer.Handler{Local: empty, Key: key})
+	defer miss.Close()
+
+	peers := []string{
+		strings.TrimPrefix(miss.URL, "http://"),
+		strings.TrimPrefix(hit.URL, "http://"),
+	}
+	c := &peer.Client{Peers: func() []string { return peers }, Key: key}
+
+	t.Run("Hit", func(t *testing.T) {
+		obj, err := c.Get(context.Background(), actionID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer obj.Body.Close()
+		data, err := io.ReadAll(obj.Body)
+		if err != nil {
+			t.Fatalf("Read body: %v", err)
+		}
+		if obj.OutputID != outputID || obj.Peer != peers[1] || string(data) != body {
+			t.Errorf("Get: got (%q, %q, %q), want (%q, %q, %q)",
+				obj.OutputID, obj.Peer, data, outputID, peers[1], body)
+		}
+		if obj.Size != int64(len(body)) {
+			t.Errorf("Size: got %d, want %d", obj.Size, len(body))
+		}
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		obj, err := c.Get(context.Background(), "ffff00")
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get: got (%v, %v), want %v", obj, err, fs.ErrNotExist)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		other := &peer.Client{Peers: c.Peers, Key: []byte("other secret")}
+		obj, err := other.Get(context.Background(), actionID)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get: got (%v, %v), want %v", obj, err, fs.ErrNotExist)
+		}
+		rsp, err := http.Get(hit.URL + "/peer/action/" + actionID)
+		if err != nil {
+			t.Fatalf("Get without key: %v", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Get without key: got %d, want %d", rsp.StatusCode, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		obj, err := c.Get(context.Background(), "bad0")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer obj.Body.Close()
+		if _, err := io.ReadAll(obj.Body); !errors.Is(err, peer.ErrMismatch) {
+			t.Errorf("Read body: got %v, want %v", err, peer.ErrMismatch)
+		}
+	})
+}
+
+func TestResolver(t *testing.T) {
+	r := &peer.Resolver{
+		Spec: "a.example:8080, b.example:8080,,self:8080",
+		Self: "self:8080",
+	}
+	got := r.Peers()
+	if want := []string{"a.example:8080", "b.example:8080"}; !slices.Equal(got, want) {
+		t.Errorf("Peers: got %q, want %q", got, want)
+	}
+}
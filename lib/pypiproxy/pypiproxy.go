@@ -0,0 +1,484 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package pypiproxy implements a caching proxy for a Python package index that
+// speaks the PEP 503 "simple" repository API, caching files locally on disk,
+// backed by objects in an S3 bucket.
+//
+// The proxy serves these paths, relative to wherever it is mounted:
+//
+//	/simple/            -- the index of all projects (passed through)
+//	/simple/<project>/  -- the index of files for a project
+//	/files/<host>/<path> -- a package file
+//
+// Project indexes are fetched from the upstream and cached locally for a short
+// period, and the links they contain are rewritten to refer to the proxy's own
+// /files/ path, so that clients fetch package files through the proxy. Package
+// files are immutable, and are cached locally and in S3. If the upstream
+// cannot be reached, the proxy serves the most recently cached copy of an
+// index, if it has one.
+package pypiproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// DefaultUpstream is the default upstream index used by a [Server].
+const DefaultUpstream = "https://pypi.org/simple"
+
+// Server is a caching proxy for a PEP 503 package index.
+//
+// # Cache Layout
+//
+// Cached project indexes and package files are stored under a SHA256 digest
+// of their upstream URL, encoded as hex and partitioned by the first two bytes
+// of the digest:
+//
+//	<local>/index/<xx>/<digest>
+//	<local>/files/<xx>/<digest>
+//
+// Package files are also stored in S3 under the same names, relative to the
+// key prefix. Project indexes are not stored in S3.
+type Server struct {
+	// Upstream is the base URL of the upstream simple index. If empty,
+	// [DefaultUpstream] is used.
+	Upstream string
+
+	// FileHosts are the hosts from which the proxy will fetch package files.
+	// The host of the upstream index is always permitted. If empty, the proxy
+	// also permits "files.pythonhosted.org", where PyPI stores its files.
+	FileHosts []string
+
+	// Local is the path of a local cache directory where responses are cached.
+	// It must be non-empty.
+	Local string
+
+	// S3Client is the S3 client used to read and write cache entries to the
+	// backing store. It must be non-nil.
+	S3Client *s3util.Client
+
+	// KeyPrefix, if non-empty, is prepended to each key stored into S3, with an
+	// intervening slash.
+	KeyPrefix string
+
+	// IndexTTL is how long a cached project index is served before it is
+	// refreshed from the upstream. If zero, a default of 5 minutes is used.
+	IndexTTL time.Duration
+
+	// Client, if non-nil, is used to issue requests to the upstream. If nil,
+	// [http.DefaultClient] is used.
+	Client *http.Client
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	//
+	// Each request handled by the proxy is logged at [slog.LevelDebug] (these
+	// logs are detailed, but noisy) when it is finished, with the message
+	// "index" or "file" and the attributes:
+	//
+	//    name    -- the name of the requested object
+	//    result  -- the disposition of the request (see below)
+	//    elapsed -- how long the request took
+	//    err     -- the error reported by the upstream, if any
+	//
+	// The disposition is one of "hit" (served from the local cache), "hit S3"
+	// (faulted in from S3), "fetch" (fetched from the upstream), "stale" (served
+	// from the local cache after the upstream failed), or "error".
+	Logger *slog.Logger
+
+	initOnce sync.Once
+	tasks    *taskgroup.Group
+	start    func(taskgroup.Task)
+
+	idxRequest   expvar.Int // project index requests
+	idxHit       expvar.Int // index served from local cache
+	idxFetch     expvar.Int // index fetched from upstream
+	idxStale     expvar.Int // stale index served after upstream failure
+	idxError     expvar.Int // index requests that failed
+	fileRequest  expvar.Int // package file requests
+	fileHit      expvar.Int // file served from local cache
+	fileFaultHit expvar.Int // file faulted in from S3
+	fileFetch    expvar.Int // file fetched from upstream
+	fileError    expvar.Int // file requests that failed
+	fileBytes    expvar.Int // bytes of files fetched from upstream
+	pushError    expvar.Int // errors writing files to S3
+	pushBytes    expvar.Int // bytes written to S3
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.tasks, s.start = taskgroup.New(nil).Limit(runtime.NumCPU())
+	})
+}
+
+// Metrics returns a map of proxy metrics for s. The caller is responsible to
+// publish these metrics as desired.
+func (s *Server) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("index_request", &s.idxRequest)
+	m.Set("index_hit", &s.idxHit)
+	m.Set("index_fetch", &s.idxFetch)
+	m.Set("index_stale", &s.idxStale)
+	m.Set("index_error", &s.idxError)
+	m.Set("file_request", &s.fileRequest)
+	m.Set("file_hit", &s.fileHit)
+	m.Set("file_fault_hit", &s.fileFaultHit)
+	m.Set("file_fetch", &s.fileFetch)
+	m.Set("file_error", &s.fileError)
+	m.Set("file_bytes", &s.fileBytes)
+	m.Set("push_error", &s.pushError)
+	m.Set("push_bytes", &s.pushBytes)
+	return m
+}
+
+// Close waits until all background updates are complete.
+func (s *Server) Close() error {
+	s.init()
+	return s.tasks.Wait()
+}
+
+// ServeHTTP implements the [http.Handler] interface for the proxy.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch p := r.URL.Path; {
+	case p == "/simple" || p == "/simple/":
+		s.serveRoot(w, r)
+	case strings.HasPrefix(p, "/simple/"):
+		name := strings.Trim(strings.TrimPrefix(p, "/simple/"), "/")
+		if name == "" || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveIndex(w, r, normalizeName(name))
+	case strings.HasPrefix(p, "/files/"):
+		s.serveFile(w, r, strings.TrimPrefix(p, "/files/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveRoot forwards a request for the index of all projects to the upstream
+// without caching it. Clients rarely need it, and it is very large.
+func (s *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
+	rsp, err := s.fetch(r.Context(), s.upstream()+"/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rsp.Body.Close()
+	w.Header().Set("Content-Type", rsp.Header.Get("Content-Type"))
+	io.Copy(w, rsp.Body)
+}
+
+// serveIndex serves the index of files for the named project.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, name string) {
+	s.idxRequest.Add(1)
+	indexURL := s.upstream() + "/" + name + "/"
+	hash := hashURL(indexURL)
+	path := s.makePath("index", hash)
+	start := time.Now()
+
+	// If we have a fresh copy of the index, serve it.
+	fi, err := os.Stat(path)
+	if err == nil && time.Since(fi.ModTime()) < s.indexTTL() {
+		s.idxHit.Add(1)
+		s.logger().Debug("index", "name", name, "result", "hit", "elapsed", time.Since(start))
+		serveHTML(w, r, path)
+		return
+	}
+
+	html, err := s.fetchIndex(r.Context(), indexURL)
+	if err == nil {
+		if err := s.storeLocal(path, bytes.NewReader(html)); err != nil {
+			s.logger().Warn("save index failed", "name", name, "err", err)
+		}
+		s.idxFetch.Add(1)
+		s.logger().Debug("index", "name", name, "result", "fetch", "elapsed", time.Since(start))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(html)
+		return
+	}
+
+	// The upstream failed; if we have any copy of the index, serve that.
+	if fi != nil {
+		s.idxStale.Add(1)
+		s.logger().Debug("index", "name", name, "result", "stale", "elapsed", time.Since(start), "err", err)
+		serveHTML(w, r, path)
+		return
+	}
+	s.idxError.Add(1)
+	s.logger().Debug("index", "name", name, "result", "error", "elapsed", time.Since(start), "err", err)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// fetchIndex fetches the project index at indexURL from the upstream and
+// rewrites its file links to refer to the proxy.
+func (s *Server) fetchIndex(ctx context.Context, indexURL string) ([]byte, error) {
+	rsp, err := s.fetch(ctx, indexURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	base := rsp.Request.URL // after any redirects
+	return rewriteLinks(body, base), nil
+}
+
+// linkRE matches the href attribute of an anchor in a simple index page.
+var linkRE = regexp.MustCompile(`href="([^"]*)"`)
+
+// rewriteLinks rewrites each link in an index page to refer to the proxy's
+// files path. Links are resolved relative to base, and the rewritten links
+// are relative to the page (at /simple/<project>/), so they are correct
+// wherever the proxy is mounted. The fragment (which carries the file hash)
+// is preserved.
+func rewriteLinks(page []byte, base *url.URL) []byte {
+	return linkRE.ReplaceAllFunc(page, func(m []byte) []byte {
+		href := string(linkRE.FindSubmatch(m)[1])
+		u, err := base.Parse(strings.ReplaceAll(href, "&amp;", "&"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return m
+		}
+		link := "../../files/" + u.Host + u.EscapedPath()
+		if u.Fragment != "" {
+			link += "#" + u.EscapedFragment()
+		}
+		return []byte(`href="` + link + `"`)
+	})
+}
+
+// serveFile serves a package file, given its upstream host and path.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, hostPath string) {
+	s.fileRequest.Add(1)
+	host, fpath, ok := strings.Cut(hostPath, "/")
+	if !ok || !s.allowedHost(host) {
+		http.Error(w, "file host not permitted", http.StatusForbidden)
+		return
+	}
+	fileURL := (&url.URL{Scheme: s.fileScheme(host), Host: host, Path: "/" + fpath}).String()
+	hash := hashURL(fileURL)
+	path := s.makePath("files", hash)
+	start := time.Now()
+
+	// Check for a hit in the local cache.
+	if _, err := os.Stat(path); err == nil {
+		s.fileHit.Add(1)
+		s.logger().Debug("file", "name", fileURL, "result", "hit", "elapsed", time.Since(start))
+		serveBinary(w, r, path)
+		return
+	}
+
+	// Fault in from S3.
+	if obj, _, err := s.S3Client.Get(r.Context(), s.makeKey("files", hash)); err == nil {
+		err := s.storeLocal(path, obj)
+		obj.Close()
+		if err == nil {
+			s.fileFaultHit.Add(1)
+			s.logger().Debug("file", "name", fileURL, "result", "hit S3", "elapsed", time.Since(start))
+			serveBinary(w, r, path)
+			return
+		}
+		s.logger().Warn("save file failed", "name", fileURL, "err", err)
+	}
+
+	// Fetch from the upstream.
+	err := s.fetchFile(r.Context(), fileURL, path, hash)
+	if err != nil {
+		s.fileError.Add(1)
+		s.logger().Debug("file", "name", fileURL, "result", "error", "elapsed", time.Since(start), "err", err)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	s.fileFetch.Add(1)
+	s.logger().Debug("file", "name", fileURL, "result", "fetch", "elapsed", time.Since(start))
+	serveBinary(w, r, path)
+}
+
+// fetchFile fetches fileURL from the upstream into the local cache at path,
+// and writes it back to S3 in the background.
+func (s *Server) fetchFile(ctx context.Context, fileURL, path, hash string) error {
+	rsp, err := s.fetch(ctx, fileURL)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if err := s.storeLocal(path, rsp.Body); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.fileBytes.Add(fi.Size())
+	if s.S3Client.ReadOnly {
+		return nil
+	}
+	s.start(func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil // the file was pruned in the meantime
+		}
+		defer f.Close()
+
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := s.S3Client.Put(sctx, s.makeKey("files", hash), f); err != nil {
+			s.pushError.Add(1)
+			s.logger().Warn("s3 put failed", "name", fileURL, "err", err)
+		} else {
+			s.pushBytes.Add(fi.Size())
+		}
+		return nil
+	})
+	return nil
+}
+
+// fetch issues a GET request for u to the upstream, and returns the response
+// if it succeeded. If the upstream reports 404, the error satisfies
+// [fs.ErrNotExist]. The caller must close the response body.
+func (s *Server) fetch(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html") // PEP 503
+	cli := s.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	rsp, err := cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return rsp, nil
+	case http.StatusNotFound:
+		rsp.Body.Close()
+		return nil, fmt.Errorf("get %q: %w", u, fs.ErrNotExist)
+	default:
+		rsp.Body.Close()
+		return nil, fmt.Errorf("get %q: %s", u, rsp.Status)
+	}
+}
+
+// fileScheme returns the URL scheme to use for fetching files from host.
+// Files are fetched over HTTPS, unless they are served by an upstream whose
+// own URL specifies plain HTTP.
+func (s *Server) fileScheme(host string) string {
+	if u, err := url.Parse(s.upstream()); err == nil && u.Host == host && u.Scheme == "http" {
+		return "http"
+	}
+	return "https"
+}
+
+func (s *Server) allowedHost(host string) bool {
+	if u, err := url.Parse(s.upstream()); err == nil && u.Host == host {
+		return true
+	}
+	if len(s.FileHosts) == 0 {
+		return host == "files.pythonhosted.org"
+	}
+	return slices.Contains(s.FileHosts, host)
+}
+
+// storeLocal writes the contents of r atomically to path in the local cache.
+func (s *Server) storeLocal(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_, err := atomicfile.WriteAll(path, r, 0644)
+	return err
+}
+
+func (s *Server) upstream() string {
+	if s.Upstream == "" {
+		return DefaultUpstream
+	}
+	return strings.TrimSuffix(s.Upstream, "/")
+}
+
+func (s *Server) indexTTL() time.Duration {
+	if s.IndexTTL > 0 {
+		return s.IndexTTL
+	}
+	return 5 * time.Minute
+}
+
+// makePath returns the local cache path for the specified kind and hash.
+func (s *Server) makePath(kind, hash string) string {
+	return filepath.Join(s.Local, kind, hash[:2], hash)
+}
+
+// makeKey returns the S3 object key for the specified kind and hash.
+func (s *Server) makeKey(kind, hash string) string {
+	return path.Join(s.KeyPrefix, kind, hash[:2], hash)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func serveHTML(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeFile(w, r, path)
+}
+
+func serveBinary(w http.ResponseWriter, r *http.Request, path string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, path)
+}
+
+// normalizeName normalizes a project name as specified by PEP 503.
+func normalizeName(name string) string {
+	return strings.ToLower(nameSepRE.ReplaceAllString(name, "-"))
+}
+
+var nameSepRE = regexp.MustCompile(`[-_.]+`)
+
+func hashURL(u string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(u)))
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pypiproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/pypiproxy"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestServer(t *testing.T) {
+	const fileData = "not really a tarball"
+	var fetches int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/simple/foo-bar/":
+			io.WriteString(w, `<html><body>
+<a href="../../packages/foo_bar-1.0.tar.gz#sha256=abc123" data-requires-python="&gt;=3.8">foo_bar-1.0.tar.gz</a>
+</body></html>`)
+		case "/packages/foo_bar-1.0.tar.gz":
+			io.WriteString(w, fileData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	// A stand-in for S3 that has no objects, and accepts all writes.
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.NotFound(w, r)
+		}
+	}))
+	defer fakeS3.Close()
+
+	s := &pypiproxy.Server{
+		Upstream: upstream.URL + "/simple",
+		Local:    t.TempDir(),
+		S3Client: &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:       "us-east-1",
+				BaseEndpoint: aws.String(fakeS3.URL),
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}),
+			Bucket: "test",
+		},
+		IndexTTL: time.Hour,
+	}
+	defer s.Close()
+	proxy := httptest.NewServer(http.StripPrefix("/pypi", s))
+	defer proxy.Close()
+
+	get := func(t *testing.T, u string) string {
+		t.Helper()
+		rsp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("Get %q: %v", u, err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Get %q: %s", u, rsp.Status)
+		}
+		return string(body)
+	}
+
+	// The project name is normalized, and the link is rewritten to the proxy.
+	indexURL := proxy.URL + "/pypi/simple/Foo_Bar/"
+	index := get(t, indexURL)
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	wantLink := `href="../../files/` + host + `/packages/foo_bar-1.0.tar.gz#sha256=abc123"`
+	if !strings.Contains(index, wantLink) {
+		t.Fatalf("Index does not contain %s:\n%s", wantLink, index)
+	}
+	if !strings.Contains(index, `data-requires-python="&gt;=3.8"`) {
+		t.Errorf("Index lost data attributes:\n%s", index)
+	}
+
+	base, _ := url.Parse(indexURL)
+	fileURL, _ := base.Parse("../../files/" + host + "/packages/foo_bar-1.0.tar.gz")
+	if got := get(t, fileURL.String()); got != fileData {
+		t.Errorf("File: got %q, want %q", got, fileData)
+	}
+
+	// Repeated requests are served from the cache.
+	n := fetches
+	get(t, indexURL)
+	get(t, fileURL.String())
+	if fetches != n {
+		t.Errorf("Cached requests made %d upstream fetches, want 0", fetches-n)
+	}
+
+	// An expired index is served stale if the upstream is unavailable.
+	s.IndexTTL = time.Nanosecond
+	upstream.Close()
+	if got := get(t, indexURL); got != index {
+		t.Errorf("Stale index: got %q, want %q", got, index)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,23 +24,36 @@ import (
 
 // cacheLoadLocal reads cached headers and body from the local cache.
 func (s *Server) cacheLoadLocal(hash string) ([]byte, http.Header, error) {
-	data, err := os.ReadFile(s.makePath(hash))
+	path := s.makePath(hash)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, nil, err
 	}
+	data, err = s.Encrypt.Open(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
 	return parseCacheObject(data)
 }
 
 // cacheStoreLocal writes the contents of body to the local cache.
 //
 // The file format is a plain-text section at the top recording a subset of the
-// response headers, followed by "\n\n", followed by the response body.
+// response headers, followed by "\n\n", followed by the response body. If
+// s.Encrypt is set, the file holds that format encrypted.
 func (s *Server) cacheStoreLocal(hash string, hdr http.Header, body []byte) error {
 	path := s.makePath(hash)
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	return atomicfile.Tx(s.makePath(hash), 0644, func(f *atomicfile.File) error {
+	if s.Encrypt != nil {
+		var buf bytes.Buffer
+		if err := writeCacheObject(&buf, hdr, body); err != nil {
+			return err
+		}
+		return atomicfile.WriteData(path, s.Encrypt.Seal(buf.Bytes()), 0644)
+	}
+	return atomicfile.Tx(path, 0644, func(f *atomicfile.File) error {
 		return writeCacheObject(f, hdr, body)
 	})
 }
@@ -64,7 +78,7 @@ func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgro
 		defer cancel()
 
 		if err := s.S3Client.Put(sctx, s.makeKey(hash), &buf); err != nil {
-			s.logf("[s3] put %q failed: %v", hash, err)
+			s.logger().Warn("s3 put failed", "hash", hash, "err", err)
 			s.rspPushError.Add(1)
 		} else {
 			s.rspPush.Add(1)
@@ -74,30 +88,40 @@ func (s *Server) cacheStoreS3(hash string, hdr http.Header, body []byte) taskgro
 	}
 }
 
-// cacheLoadMemory reads cached headers and body from the memory cache.
-func (s *Server) cacheLoadMemory(hash string) ([]byte, http.Header, error) {
+// cacheLoadMemory reads cached headers and body from the memory cache, and
+// reports whether the entry has expired. Expired entries are retained only if
+// s serves stale responses (see ServeStaleOnError).
+func (s *Server) cacheLoadMemory(hash string) (_ []byte, _ http.Header, expired bool, _ error) {
 	e, ok := s.mcache.Get(hash)
 	if !ok {
-		return nil, nil, fs.ErrNotExist
+		return nil, nil, false, fs.ErrNotExist
 	}
-	return e.body, e.header, nil
+	return e.body, e.header, time.Now().After(e.expires), nil
 }
 
 // cacheStoreMemory writes the contents of body to the memory cache.
 func (s *Server) cacheStoreMemory(hash string, maxAge time.Duration, hdr http.Header, body []byte) {
 	s.mcache.Put(hash, memCacheEntry{
-		header: trimCacheHeader(hdr),
-		body:   body,
+		header:  trimCacheHeader(hdr),
+		body:    body,
+		expires: time.Now().Add(maxAge),
 	})
+	if s.ServeStaleOnError {
+		return // keep the entry until it is evicted, in case the target fails
+	}
 	s.expire.After(maxAge, scheddle.Run(func() {
 		s.mcache.Remove(hash)
 	}))
 }
 
 var keepHeader = []string{
-	"Cache-Control", "Content-Type", "Date", "Etag",
+	"Cache-Control", "Content-Type", "Date", "Etag", statusHeader,
 }
 
+// statusHeader records the status of a cached response other than 200 (OK).
+// It is stored with the cached headers, but not sent to clients.
+const statusHeader = "Status"
+
 func trimCacheHeader(h http.Header) http.Header {
 	out := make(http.Header)
 	for _, name := range keepHeader {
@@ -129,6 +153,7 @@ func writeCacheObject(w io.Writer, h http.Header, body []byte) error {
 	hprintf(w, h, "Content-Type", "application/octet-stream")
 	hprintf(w, h, "Date", "")
 	hprintf(w, h, "Etag", "")
+	hprintf(w, h, statusHeader, "")
 	fmt.Fprint(w, "\n")
 	_, err := w.Write(body)
 	return err
@@ -142,18 +167,30 @@ func hprintf(w io.Writer, h http.Header, name, fallback string) {
 	}
 }
 
-// setXCacheInfo adds cache-specific headers to h.
-func setXCacheInfo(h http.Header, result, hash string) {
-	h.Set("X-Cache", result)
+// setXCacheInfo adds cache-specific headers to h, unless they are disabled.
+func (s *Server) setXCacheInfo(h http.Header, status, detail, hash string) {
+	if s.DisableCacheHeaders {
+		return
+	}
+	h.Set("X-Cache", status)
+	h.Set("X-Cache-Detail", detail)
 	if hash != "" {
 		h.Set("X-Cache-Id", hash[:12])
 	}
+	if status == "HIT" {
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			if age := time.Since(date); age > 0 {
+				h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+			}
+		}
+	}
 }
 
 // memCacheEntry is the format of entries in the memory cache.
 type memCacheEntry struct {
-	header http.Header
-	body   []byte
+	header  http.Header
+	body    []byte
+	expires time.Time
 }
 
 func entrySize(e memCacheEntry) int64 { return int64(len(e.body)) }
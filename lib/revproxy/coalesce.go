@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// faultS3 reads the cached response for hash from S3, and if it has not
+// expired under rule, writes it to the local cache. Concurrent faults of the
+// same hash share one read, which completes even if the requests that wait
+// for it are abandoned. The caller may modify the header of the result.
+func (s *Server) faultS3(ctx context.Context, hash string, rule *Rule) (*cachedResponse, error) {
+	var led bool
+	ch := s.faults.DoChan(hash, func() (any, error) {
+		led = true
+		data, hdr, err := s.cacheLoadS3(context.WithoutCancel(ctx), hash)
+		if err != nil {
+			return nil, err
+		}
+		if !rule.expired(hdr) {
+			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
+				s.logger().Warn("update local cache failed", "hash", hash, "err", err)
+			}
+		}
+		return &cachedResponse{header: hdr, body: data}, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-ch:
+		if !led {
+			s.reqFaultJoin.Add(1)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		rsp := res.Val.(*cachedResponse)
+		return &cachedResponse{header: rsp.header.Clone(), body: rsp.body}, nil
+	}
+}
+
+// beginFetch reports whether another request is fetching hash from a target.
+// If so, it returns a channel that is closed when that fetch is done, after
+// which the response may be in the cache. Otherwise, the caller is now the
+// request fetching hash, and must call done once its response is cached (or
+// found to be uncacheable).
+func (s *Server) beginFetch(hash string) (wait <-chan struct{}, done func()) {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+	if ch, ok := s.fetching[hash]; ok {
+		return ch, nil
+	}
+	if s.fetching == nil {
+		s.fetching = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	s.fetching[hash] = ch
+	return nil, func() {
+		s.fmu.Lock()
+		defer s.fmu.Unlock()
+		delete(s.fetching, hash)
+		close(ch)
+	}
+}
+
+// loadFetched returns the response for hash cached by a concurrent fetch, if
+// it is present in memory or on disk and has not expired under rule, along
+// with where it was found ("memory" or "local").
+func (s *Server) loadFetched(hash string, rule *Rule) (*cachedResponse, string) {
+	if data, hdr, expired, err := s.cacheLoadMemory(hash); err == nil && !expired {
+		return &cachedResponse{header: hdr.Clone(), body: data}, "memory"
+	}
+	if data, hdr, err := s.cacheLoadLocal(hash); err == nil && !rule.expired(hdr) {
+		return &cachedResponse{header: hdr, body: data}, "local"
+	}
+	return nil, ""
+}
+
+// joinFetch waits for a fetch of hash by a concurrent request, if there is
+// one, and serves r from the response it cached. It reports whether r was
+// served (or abandoned while waiting). If it reports false, and done is
+// non-nil, the caller is fetching hash and must call done when finished.
+func (s *Server) joinFetch(w http.ResponseWriter, r *http.Request, hash string, rule *Rule, logDone func(string, ...any)) (served bool, done func()) {
+	wait, done := s.beginFetch(hash)
+	if wait == nil {
+		return false, done
+	}
+	select {
+	case <-r.Context().Done():
+		return true, nil // the client is gone
+	case <-wait:
+	}
+	rsp, where := s.loadFetched(hash, rule)
+	if rsp == nil {
+		return false, nil // not cached; fetch it ourselves
+	}
+	s.reqFetchJoin.Add(1)
+	s.setXCacheInfo(rsp.header, "HIT", where, hash)
+	writeCachedResponse(w, r, rsp.header, rsp.body)
+	logDone("hit joined", "bytes", len(rsp.body), "source", where)
+	return true, nil
+}
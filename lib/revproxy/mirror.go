@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mirror configures shadow traffic for a [Server]. A sample of the requests the
+// proxy forwards to a target are repeated in the background against a second
+// origin, or reported to a validation endpoint, or both. This allows a new
+// origin to be checked against the current one before clients are moved to it.
+//
+// Mirrored requests do not affect the response to the client, nor the cache.
+type Mirror struct {
+	// Origins maps target host names to the base URL of a mirror origin. Each
+	// sampled request to a target listed here is repeated with the same path
+	// and query against the mirror, and the response status and body digest
+	// are compared with those of the original. The key "*" matches any target
+	// not otherwise listed.
+	Origins map[string]string
+
+	// Validate, if non-empty, is the URL of an endpoint to which a report of
+	// each sampled request is posted, as a JSON object with the fields:
+	//
+	//	url     -- the original request URL
+	//	status  -- the HTTP status code of the origin response
+	//	size    -- the size of the response body in bytes
+	//	sha256  -- the SHA256 digest of the response body, hex encoded
+	//	mirror  -- if a mirror origin was checked, an object with the same
+	//	           fields for the mirror response, plus "match" (bool)
+	//
+	// Responses from the endpoint are ignored, except that a non-2xx status
+	// is counted as an error.
+	Validate string
+
+	// Rate is the fraction of eligible requests to sample, in (0, 1].
+	// If zero, all eligible requests are sampled.
+	Rate float64
+
+	// Client, if non-nil, is used for mirror and validation requests.
+	// If nil, a client with a 1 minute timeout is used.
+	Client *http.Client
+
+	sample   expvar.Int // requests sampled
+	match    expvar.Int // mirror responses matching the origin
+	mismatch expvar.Int // mirror responses differing from the origin
+	errors   expvar.Int // errors fetching from the mirror or posting reports
+}
+
+// Metrics returns a map of mirror metrics. The caller is responsible to
+// publish these metrics as desired.
+func (m *Mirror) Metrics() *expvar.Map {
+	out := new(expvar.Map)
+	out.Set("sample", &m.sample)
+	out.Set("match", &m.match)
+	out.Set("mismatch", &m.mismatch)
+	out.Set("errors", &m.errors)
+	return out
+}
+
+// ParseMirrorOrigins parses a comma-separated list of mirror origins, each of
+// the form "host=url" or just "url". A bare URL applies to all targets.
+func ParseMirrorOrigins(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		host, base, ok := strings.Cut(e, "=")
+		if !ok {
+			host, base = "*", e
+		}
+		u, err := url.Parse(base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid mirror origin %q", base)
+		}
+		out[host] = strings.TrimSuffix(base, "/")
+	}
+	return out, nil
+}
+
+// start reports whether the request r should be mirrored, and if so returns
+// a sample to record the origin response.
+func (m *Mirror) start(r *http.Request) *mirrorSample {
+	if m == nil || r.Method != http.MethodGet {
+		return nil
+	}
+	origin := m.Origins[r.Host]
+	if origin == "" {
+		origin = m.Origins["*"]
+	}
+	if origin == "" && m.Validate == "" {
+		return nil
+	}
+	if m.Rate > 0 && rand.Float64() >= m.Rate {
+		return nil
+	}
+	m.sample.Add(1)
+	u := *r.URL
+	u.Host = r.Host
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	return &mirrorSample{m: m, url: u.String(), origin: origin, hash: sha256.New()}
+}
+
+// mirrorSample records the origin response to a sampled request.
+type mirrorSample struct {
+	m      *Mirror
+	url    string // the original request URL
+	origin string // the mirror origin base URL, or ""
+
+	status int
+	size   int64
+	hash   hash.Hash
+	done   bool // the whole response body was read
+}
+
+// observe arranges for the body of rsp to be recorded as it is read.
+func (ms *mirrorSample) observe(rsp *http.Response) {
+	ms.status = rsp.StatusCode
+	rsp.Body = copyReader{
+		Reader: &digestReader{r: rsp.Body, ms: ms},
+		Closer: rsp.Body,
+	}
+}
+
+type digestReader struct {
+	r  io.Reader
+	ms *mirrorSample
+}
+
+func (d *digestReader) Read(data []byte) (int, error) {
+	nr, err := d.r.Read(data)
+	d.ms.hash.Write(data[:nr])
+	d.ms.size += int64(nr)
+	if err == io.EOF {
+		d.ms.done = true
+	}
+	return nr, err
+}
+
+type mirrorResult struct {
+	Status int    `json:"status"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// mirrorReport is the report posted to a validation endpoint.
+type mirrorReport struct {
+	URL string `json:"url"`
+	mirrorResult
+	Mirror *mirrorCheck `json:"mirror,omitempty"`
+}
+
+// mirrorCheck is the result of checking a sample against a mirror origin.
+type mirrorCheck struct {
+	URL string `json:"url"`
+	mirrorResult
+	Match bool `json:"match"`
+}
+
+// run fetches the request from the mirror origin (if any), compares it to the
+// origin response, and posts a report to the validation endpoint (if any).
+// It is intended to run as a background task.
+func (ms *mirrorSample) run(logger *slog.Logger) func() error {
+	return func() error {
+		if !ms.done {
+			return nil // the client went away before the response was complete
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		m := ms.m
+		report := mirrorReport{
+			URL: ms.url,
+			mirrorResult: mirrorResult{
+				Status: ms.status,
+				Size:   ms.size,
+				SHA256: fmt.Sprintf("%x", ms.hash.Sum(nil)),
+			},
+		}
+		if ms.origin != "" {
+			murl, res, err := ms.fetchMirror(ctx)
+			if err != nil {
+				m.errors.Add(1)
+				logger.Warn("mirror fetch failed", "url", ms.url, "err", err)
+			} else {
+				match := res == report.mirrorResult
+				if match {
+					m.match.Add(1)
+				} else {
+					m.mismatch.Add(1)
+					logger.Warn("mirror mismatch", "url", ms.url,
+						slog.Group("origin", "status", report.Status, "sha256", report.SHA256, "size", report.Size),
+						slog.Group("mirror", "status", res.Status, "sha256", res.SHA256, "size", res.Size))
+				}
+				report.Mirror = &mirrorCheck{URL: murl, mirrorResult: res, Match: match}
+			}
+		}
+		if m.Validate != "" {
+			body, _ := json.Marshal(report)
+			if err := m.post(ctx, body); err != nil {
+				m.errors.Add(1)
+				logger.Warn("mirror validate failed", "url", ms.url, "err", err)
+			}
+		}
+		return nil
+	}
+}
+
+// fetchMirror fetches the sampled request from the mirror origin.
+func (ms *mirrorSample) fetchMirror(ctx context.Context) (string, mirrorResult, error) {
+	u, err := url.Parse(ms.url)
+	if err != nil {
+		return "", mirrorResult{}, err
+	}
+	murl := ms.origin + u.EscapedPath()
+	if u.RawQuery != "" {
+		murl += "?" + u.RawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, murl, nil)
+	if err != nil {
+		return murl, mirrorResult{}, err
+	}
+	rsp, err := ms.m.client().Do(req)
+	if err != nil {
+		return murl, mirrorResult{}, err
+	}
+	defer rsp.Body.Close()
+	h := sha256.New()
+	nr, err := io.Copy(h, rsp.Body)
+	if err != nil {
+		return murl, mirrorResult{}, err
+	}
+	return murl, mirrorResult{
+		Status: rsp.StatusCode,
+		Size:   nr,
+		SHA256: fmt.Sprintf("%x", h.Sum(nil)),
+	}, nil
+}
+
+// post sends a report to the validation endpoint.
+func (m *Mirror) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.Validate, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := m.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("validation endpoint: %s", rsp.Status)
+	}
+	return nil
+}
+
+func (m *Mirror) client() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+	return mirrorClient
+}
+
+var mirrorClient = &http.Client{Timeout: time.Minute}
@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/revproxy"
+)
+
+func TestMirror(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "original "+r.URL.Path)
+	}))
+	defer origin.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/same" {
+			io.WriteString(w, "original "+r.URL.Path)
+		} else {
+			io.WriteString(w, "different")
+		}
+	}))
+	defer mirror.Close()
+
+	type report struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+		Mirror struct {
+			URL   string `json:"url"`
+			Match bool   `json:"match"`
+		} `json:"mirror"`
+	}
+	reports := make(chan report, 2)
+	validate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep report
+		if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+			t.Errorf("Decode report: %v", err)
+		}
+		reports <- rep
+	}))
+	defer validate.Close()
+
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	s := &revproxy.Server{
+		Targets: []string{originHost},
+		Local:   t.TempDir(),
+		Mirror: &revproxy.Mirror{
+			Origins:  map[string]string{originHost: mirror.URL},
+			Validate: validate.URL,
+		},
+	}
+
+	for _, tc := range []struct {
+		path  string
+		match bool
+	}{
+		{"/same", true},
+		{"/other", false},
+	} {
+		req := httptest.NewRequest("GET", origin.URL+tc.path, nil)
+		req.Header.Set("Cache-Control", "no-store") // bypass the cache
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if got, want := rec.Body.String(), "original "+tc.path; got != want {
+			t.Errorf("GET %s: got %q, want %q", tc.path, got, want)
+		}
+
+		select {
+		case rep := <-reports:
+			if rep.URL != origin.URL+tc.path {
+				t.Errorf("Report URL: got %q, want %q", rep.URL, origin.URL+tc.path)
+			}
+			if rep.Mirror.URL != mirror.URL+tc.path {
+				t.Errorf("Report mirror URL: got %q, want %q", rep.Mirror.URL, mirror.URL+tc.path)
+			}
+			if rep.Mirror.Match != tc.match {
+				t.Errorf("Report match for %s: got %v, want %v", tc.path, rep.Mirror.Match, tc.match)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for report of %s", tc.path)
+		}
+	}
+}
+
+func TestParseMirrorOrigins(t *testing.T) {
+	got, err := revproxy.ParseMirrorOrigins("a.example.com=https://new-a.example.com/, https://fallback.example.com")
+	if err != nil {
+		t.Fatalf("ParseMirrorOrigins: %v", err)
+	}
+	if got["a.example.com"] != "https://new-a.example.com" || got["*"] != "https://fallback.example.com" || len(got) != 2 {
+		t.Errorf("ParseMirrorOrigins: got %v", got)
+	}
+	if _, err := revproxy.ParseMirrorOrigins("a.example.com=not a url"); err == nil {
+		t.Error("ParseMirrorOrigins: got nil error for an invalid URL")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errUncacheable is reported by fetchWhole for a response that cannot be
+// cached, so the ranged request is forwarded to the target instead.
+var errUncacheable = errors.New("response cannot be cached")
+
+// A wholeFetch is the result of fetching a whole object for ranged requests.
+type wholeFetch struct {
+	cachedResponse
+	cached string // where the response was cached ("mem" or "yes")
+}
+
+// serveRange answers the ranged request r from the whole object at its URL,
+// which it fetches from the target and caches. Concurrent ranged requests for
+// the same object share a single fetch. It reports false without writing to w
+// if the object cannot be fetched and cached, in which case the caller should
+// forward r to the target as usual.
+func (s *Server) serveRange(w http.ResponseWriter, r *http.Request, rule *Rule, hash string, logDone func(string, ...any)) bool {
+	v, err, shared := s.ranges.Do(hash, func() (any, error) {
+		return s.fetchWhole(r, rule, hash)
+	})
+	if err != nil {
+		if !errors.Is(err, errUncacheable) {
+			s.logger().Debug("fetch for ranged request failed", "url", r.URL.String(), "err", err)
+		}
+		return false
+	}
+	f := v.(*wholeFetch)
+	s.reqRange.Add(1)
+	if shared {
+		s.reqRangeJoin.Add(1)
+	}
+	hdr := f.header.Clone()
+	if f.cached == "mem" {
+		s.setXCacheInfo(hdr, "MISS", "cached, volatile", hash)
+	} else {
+		s.setXCacheInfo(hdr, "MISS", "cached", hash)
+	}
+	writeCachedResponse(w, r, hdr, f.body)
+	logDone("fetch range", "cached", f.cached, "bytes", len(f.body), "shared", shared)
+	return true
+}
+
+// fetchWhole fetches the whole object for the ranged request r from its
+// target, and caches it under hash. It reports errUncacheable if the response
+// is not a 200 (OK) that can be cached under rule.
+func (s *Server) fetchWhole(r *http.Request, rule *Rule, hash string) (*wholeFetch, error) {
+	// The fetch is shared by other requests, so it does not end with r.
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), http.MethodGet, targetURL(r).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range fetchWholeOmit {
+		req.Header.Del(name)
+	}
+	rsp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errUncacheable
+	}
+	maxAge, isVolatile := s.canMemoryCache(rsp, rule)
+	canCacheResponse := s.canCacheResponse(rsp, rule)
+	if rule.tooLarge(rsp.ContentLength) || (!canCacheResponse && !isVolatile) {
+		return nil, errUncacheable
+	}
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	} else if rule.tooLarge(int64(len(body))) {
+		return nil, errUncacheable
+	}
+	hdr := cacheHeader(rsp)
+	for _, name := range hopHeaders {
+		hdr.Del(name)
+	}
+	return &wholeFetch{
+		cachedResponse: cachedResponse{header: hdr, body: body},
+		cached:         s.saveResponse(hash, hdr, body, !canCacheResponse, maxAge),
+	}, nil
+}
+
+// fetchWholeOmit are the request headers not sent when fetching a whole object
+// for a ranged request: those that would select part of it, or none of it, and
+// the hop-by-hop headers of the inbound request.
+var fetchWholeOmit = append([]string{
+	"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+	"Proxy-Authorization",
+}, hopHeaders...)
+
+// hopHeaders are the hop-by-hop headers, which are not forwarded or cached.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
@@ -19,6 +19,8 @@ import (
 	"expvar"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -35,7 +37,9 @@ import (
 	"github.com/creachadair/mds/mapset"
 	"github.com/creachadair/scheddle"
 	"github.com/creachadair/taskgroup"
+	"github.com/grafana/go-cache-plugin/lib/atrest"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
+	"golang.org/x/sync/singleflight"
 )
 
 // Server is a caching reverse proxy server that caches successful responses to
@@ -49,6 +53,21 @@ import (
 // In addition, a successful response that is not immutable and specifies a
 // max-age will be cached temporarily in-memory.
 //
+// Concurrent requests for the same cacheable URL are coalesced: while one of
+// them faults the response in from S3, or fetches it from the target, the
+// others wait for it, and are then served from the cache. If the response
+// turns out not to be cacheable, the waiting requests are forwarded.
+//
+// # Range Requests
+//
+// A cached response to a GET request with a Range header is served in part, as
+// the header requests. If the response is not cached, the whole object is
+// fetched from the target (without the Range header), cached as usual, and the
+// requested ranges served from it. Concurrent ranged requests for the same URL
+// share one fetch, so that a client downloading a large artifact in parallel
+// ranges causes only one download from the target. If the whole object cannot
+// be cached, a ranged request is forwarded to the target unchanged.
+//
 // # Cache Format
 //
 // A cached response is a file with a header section and the body, separated by
@@ -57,25 +76,42 @@ import (
 // # Cache Responses
 //
 // For requests handled by the proxy, the response includes an "X-Cache" header
-// indicating how the response was obtained:
+// indicating whether the response was served from the cache ("HIT") or
+// forwarded to the target ("MISS"), and an "X-Cache-Detail" header giving
+// more specific information:
 //
-//   - "hit, memory": The response was served out of the memory cache.
-//   - "hit, local": The response was served out of the local cache.
-//   - "hit, remote": The response was faulted in from S3.
-//   - "fetch, cached": The response was forwarded to the target and cached.
-//   - "fetch, uncached": The response was forwarded to the target and not cached.
+//   - "HIT", "memory": The response was served out of the memory cache.
+//   - "HIT", "local": The response was served out of the local cache.
+//   - "HIT", "remote": The response was faulted in from S3.
+//   - "MISS", "cached": The response was forwarded to the target and cached.
+//   - "MISS", "cached, volatile": The response was forwarded to the target and
+//     cached in memory.
+//   - "MISS", "uncached": The response was forwarded to the target and not
+//     cached.
+//   - "HIT", "stale": The target failed, and an expired cached response was
+//     served in its place (see ServeStaleOnError).
 //
 // For results intersecting with the cache, it also reports a X-Cache-Id giving
-// the storage key of the cache object.
+// the storage key of the cache object. Cache hits include an "Age" header
+// giving the number of seconds since the response was generated by the target.
+// These headers are omitted if DisableCacheHeaders is true.
 type Server struct {
 	// Targets is the list of hosts for which the proxy should forward requests.
-	// Host names should be fully-qualified ("host.example.com").
+	// Host names should be fully-qualified ("host.example.com"). A target of
+	// the form "*.example.com" matches any subdomain of example.com, at any
+	// depth, and one of the form ".example.com" matches example.com itself as
+	// well as its subdomains (see [MatchTarget]).
 	Targets []string
 
 	// Local is the path of a local cache directory where responses are cached.
 	// It must be non-empty.
 	Local string
 
+	// Encrypt, if non-nil, encrypts the files written to the Local directory,
+	// so that their contents are not readable at rest. Files written without
+	// a key remain readable. The entries stored in S3 are not encrypted.
+	Encrypt *atrest.Key
+
 	// S3Client is the S3 client used to read and write cache entries to the
 	// backing store. It must be non-nil
 	S3Client *s3util.Client
@@ -84,45 +120,76 @@ type Server struct {
 	// intervening slash.
 	KeyPrefix string
 
-	// Logf, if non-nil, is used to write log messages. If nil, logs are
+	// Rules, if non-empty, are cache policies for some requests, in place of
+	// the default policy described above. The first rule that applies to a
+	// request governs it; requests to which no rule applies use the default
+	// policy. See [Rule].
+	Rules []Rule
+
+	// Mirror, if non-nil, configures shadow traffic for requests forwarded to
+	// the targets. See [Mirror].
+	Mirror *Mirror
+
+	// ServeStaleOnError, if true, means that when a cached response has expired
+	// (by the TTL of a [Rule], or the max-age of a response cached in memory),
+	// it is kept, and if the target then fails to respond, or responds with a
+	// server error (5xx), the expired response is served in its place with a
+	// "Warning: 110" header. Responses expired from memory are kept until they
+	// are evicted.
+	ServeStaleOnError bool
+
+	// StaleTimeout, if positive, is how long to wait for the response headers
+	// from a target when an expired response could be served in its place
+	// (see ServeStaleOnError), before giving up and serving it.
+	StaleTimeout time.Duration
+
+	// DisableCacheHeaders, if true, suppresses the cache status headers
+	// described above.
+	DisableCacheHeaders bool
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
 	// discarded.
-	Logf func(string, ...any)
-
-	// LogRequests, if true, enables detailed (but noisy) debug logging of all
-	// requests handled by the reverse proxy. Logs are written to Logf.
 	//
-	// Each request is presented in the format:
+	// Each request handled by the reverse proxy is logged at [slog.LevelDebug]
+	// (these logs are detailed, but noisy) when it is finished, with the
+	// message "request" and the attributes:
 	//
-	//     B U:"<url>" H:<digest> C:<bool>
-	//     E H:<digest> <disposition> B:<bytes> (<time> elapsed)
-	//     - H:<digest> miss
-	//
-	// The "B" line is when the request began, and "E" when it was finished.
-	// The abbreviated fields are:
-	//
-	//     U:       -- request URL
-	//     H:       -- request URL digest (cache key)
-	//     C:       -- whether the request is cacheable (true/false)
-	//     B:       -- body size in bytes (for hits)
+	//    url       -- request URL
+	//    hash      -- request URL digest (cache key)
+	//    cacheable -- whether the request is cacheable (true/false)
+	//    result    -- the disposition of the request (see below)
+	//    bytes     -- body size in bytes (for hits and cached fetches)
+	//    elapsed   -- how long the request took
 	//
 	// The dispositions of a request are:
 	//
-	//     hit mem  -- cache hit in memory (volatile)
-	//     hit disk -- cache hit in local disk
-	//     hit S3   -- cache hit in S3 (faulted to disk)
-	//     fetch    -- fetched from the origin server
+	//    hit mem     -- cache hit in memory (volatile)
+	//    hit disk    -- cache hit in local disk
+	//    hit S3      -- cache hit in S3 (faulted to disk)
+	//    hit stale   -- expired cache entry served because the origin failed
+	//    hit joined  -- cached by a concurrent fetch of the same URL, which
+	//                   the request waited for ("source" is memory or local)
+	//    fetch       -- fetched from the origin server
+	//    fetch range -- whole object fetched from the origin for a ranged
+	//                   request ("shared" reports whether it joined another)
 	//
-	// On fetches, the "RC" tag indicates whether the response is cacheable,
-	// with "no" meaning it was not cached at all, "mem" meaning it was cached
-	// as a short-lived volatile response in memory, and "yes" meaning it was
-	// cached on disk (and S3).
-	LogRequests bool
+	// On fetches, the "cached" attribute indicates whether the response is
+	// cacheable, with "no" meaning it was not cached at all, "mem" meaning it
+	// was cached as a short-lived volatile response in memory, and "yes"
+	// meaning it was cached on disk (and S3).
+	Logger *slog.Logger
 
 	initOnce sync.Once
 	tasks    *taskgroup.Group
 	start    func(taskgroup.Task)
 	mcache   *cache.Cache[string, memCacheEntry] // short-lived mutable objects
 	expire   *scheddle.Queue                     // cache expirations
+	staleRT  http.RoundTripper                   // transport with StaleTimeout, or nil
+	ranges   singleflight.Group                  // whole-object fetches for ranged requests
+	faults   singleflight.Group                  // faults from S3 in progress, by hash
+
+	fmu      sync.Mutex
+	fetching map[string]chan struct{} // fetches from targets in progress, by hash
 
 	reqReceived  expvar.Int // total requests received
 	reqMemoryHit expvar.Int // hit in memory cache (volatile)
@@ -130,7 +197,12 @@ type Server struct {
 	reqLocalMiss expvar.Int // miss in local cache
 	reqFaultHit  expvar.Int // hit in remote (S3) cache
 	reqFaultMiss expvar.Int // miss in remote (S3) cache
+	reqFaultJoin expvar.Int // joined a fault from S3 in progress
+	reqFetchJoin expvar.Int // hit cached by a concurrent fetch from upstream
 	reqForward   expvar.Int // request forwarded directly to upstream
+	reqStaleHit  expvar.Int // expired response served when upstream failed
+	reqRange     expvar.Int // ranged request answered from a whole-object fetch
+	reqRangeJoin expvar.Int // ranged request that joined a fetch in progress
 	rspSave      expvar.Int // successful response saved in local cache
 	rspSaveMem   expvar.Int // response saved in memory cache
 	rspSaveError expvar.Int // error saving to local cache
@@ -149,6 +221,11 @@ func (s *Server) init() {
 			WithSize(entrySize),
 		)
 		s.expire = scheddle.NewQueue(nil)
+		if s.StaleTimeout > 0 {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.ResponseHeaderTimeout = s.StaleTimeout
+			s.staleRT = t
+		}
 	})
 }
 
@@ -162,7 +239,12 @@ func (s *Server) Metrics() *expvar.Map {
 	m.Set("req_local_miss", &s.reqLocalMiss)
 	m.Set("req_fault_hit", &s.reqFaultHit)
 	m.Set("req_fault_miss", &s.reqFaultMiss)
+	m.Set("req_fault_join", &s.reqFaultJoin)
+	m.Set("req_fetch_join", &s.reqFetchJoin)
 	m.Set("req_forward", &s.reqForward)
+	m.Set("req_stale_hit", &s.reqStaleHit)
+	m.Set("req_range", &s.reqRange)
+	m.Set("req_range_join", &s.reqRangeJoin)
 	m.Set("rsp_save", &s.rspSave)
 	m.Set("rsp_save_memory", &s.rspSaveMem)
 	m.Set("rsp_save_error", &s.rspSaveError)
@@ -180,49 +262,73 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.reqReceived.Add(1)
 
 	// Check whether this request is to a target we are permitted to proxy for.
-	if !hostMatchesTarget(r.Host, s.Targets) {
-		s.logf("reject proxy request for non-target %q", r.Host)
+	if MatchTarget(r.Host, s.Targets) == "" {
+		s.logger().Warn("reject proxy request for non-target", "host", r.Host)
 		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		return
 	}
 
-	hash := hashRequestURL(r.URL)
+	rule := s.ruleFor(r)
+	hash := hashRequestURL(rule.keyURL(r.URL))
 	canCache := s.canCacheRequest(r)
-	s.vlogf("rp B U:%q H:%s C:%v", r.URL, hash, canCache)
 	start := time.Now()
+	logDone := func(result string, attrs ...any) {
+		s.logger().Debug("request", append(attrs, "url", r.URL.String(), "hash", hash,
+			"cacheable", canCache, "result", result, "elapsed", time.Since(start))...)
+	}
+	var stale *cachedResponse // an expired response to serve if the target fails
 	if canCache {
 		// Check for a hit on this object in the memory cache.
-		if data, hdr, err := s.cacheLoadMemory(hash); err == nil {
+		if data, hdr, expired, err := s.cacheLoadMemory(hash); err == nil && !expired {
 			s.reqMemoryHit.Add(1)
-			setXCacheInfo(hdr, "hit, memory", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit mem B:%d (%v elapsed)", hash, len(data), time.Since(start))
+			s.setXCacheInfo(hdr, "HIT", "memory", hash)
+			writeCachedResponse(w, r, hdr, data)
+			logDone("hit mem", "bytes", len(data))
 			return
+		} else if err == nil {
+			stale = s.keepStale(stale, data, hdr)
 		}
 
 		// Check for a hit on this object in the local cache.
-		if data, hdr, err := s.cacheLoadLocal(hash); err == nil {
+		if data, hdr, err := s.cacheLoadLocal(hash); err == nil && !rule.expired(hdr) {
 			s.reqLocalHit.Add(1)
-			setXCacheInfo(hdr, "hit, local", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit disk B:%d (%v elapsed)", hash, len(data), time.Since(start))
+			s.setXCacheInfo(hdr, "HIT", "local", hash)
+			writeCachedResponse(w, r, hdr, data)
+			logDone("hit disk", "bytes", len(data))
 			return
+		} else if err == nil {
+			stale = s.keepStale(stale, data, hdr)
 		}
 		s.reqLocalMiss.Add(1)
 
 		// Fault in from S3.
-		if data, hdr, err := s.cacheLoadS3(r.Context(), hash); err == nil {
+		if rsp, err := s.faultS3(r.Context(), hash, rule); err == nil && !rule.expired(rsp.header) {
 			s.reqFaultHit.Add(1)
-			if err := s.cacheStoreLocal(hash, hdr, data); err != nil {
-				s.logf("update %q local: %v", hash, err)
-			}
-			setXCacheInfo(hdr, "hit, remote", hash)
-			writeCachedResponse(w, hdr, data)
-			s.vlogf("rp E H:%s hit S3 B:%d (%v elapsed)", hash, len(data), time.Since(start))
+			s.setXCacheInfo(rsp.header, "HIT", "remote", hash)
+			writeCachedResponse(w, r, rsp.header, rsp.body)
+			logDone("hit S3", "bytes", len(rsp.body))
 			return
+		} else if err == nil {
+			stale = s.keepStale(stale, rsp.body, rsp.header)
 		}
 		s.reqFaultMiss.Add(1)
-		s.vlogf("rp - H:%s miss", hash)
+	}
+
+	// A ranged request for an object that is not cached is answered from the
+	// whole object, fetched once for all the concurrent requests for it.
+	if canCache && r.Header.Get("Range") != "" && s.serveRange(w, r, rule, hash, logDone) {
+		return
+	}
+
+	// If another request is already fetching this object, wait for it to be
+	// cached rather than fetching it again.
+	if canCache && r.Header.Get("Range") == "" {
+		served, done := s.joinFetch(w, r, hash, rule, logDone)
+		if served {
+			return
+		} else if done != nil {
+			defer done()
+		}
 	}
 
 	// Reaching here, the object is not already cached locally so we have to
@@ -232,15 +338,32 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.reqForward.Add(1)
 	proxy := &httputil.ReverseProxy{Rewrite: s.rewriteRequest}
 	updateCache := func() {}
+	if stale != nil {
+		// If the target fails, serve the expired response in its place.
+		if s.staleRT != nil {
+			proxy.Transport = s.staleRT
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			s.reqStaleHit.Add(1)
+			hdr := stale.header.Clone()
+			s.setXCacheInfo(hdr, "HIT", "stale", hash)
+			hdr.Set("Warning", `110 - "Response is Stale"`)
+			writeCachedResponse(w, r, hdr, stale.body)
+			logDone("hit stale", "bytes", len(stale.body), "err", err)
+		}
+	}
 	if canCache {
 		proxy.ModifyResponse = func(rsp *http.Response) error {
-			maxAge, isVolatile := s.canMemoryCache(rsp)
-			canCacheResponse := s.canCacheResponse(rsp)
-			if !canCacheResponse && !isVolatile {
+			if stale != nil && rsp.StatusCode >= 500 {
+				return fmt.Errorf("target reported %s", rsp.Status) // handled by ErrorHandler
+			}
+			maxAge, isVolatile := s.canMemoryCache(rsp, rule)
+			canCacheResponse := s.canCacheResponse(rsp, rule)
+			if rule.tooLarge(rsp.ContentLength) || (!canCacheResponse && !isVolatile) {
 				// A response we cannot cache at all.
-				setXCacheInfo(rsp.Header, "fetch, uncached", "")
+				s.setXCacheInfo(rsp.Header, "MISS", "uncached", "")
 				s.rspNotCached.Add(1)
-				s.vlogf("rp E H:%s fetch RC:no (%v elapsed)", hash, time.Since(start))
+				logDone("fetch", "cached", "no")
 				return nil
 			}
 
@@ -251,50 +374,98 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				Reader: io.TeeReader(rsp.Body, &buf),
 				Closer: rsp.Body,
 			}
+			hdr := cacheHeader(rsp)
 			if !canCacheResponse && isVolatile {
 				// A volatile response we can cache temporarily.
-				setXCacheInfo(rsp.Header, "fetch, cached, volatile", hash)
-				updateCache = func() {
-					body := buf.Bytes()
-					s.cacheStoreMemory(hash, maxAge, rsp.Header, body)
-					s.rspSaveMem.Add(1)
-
-					// N.B. Don't persist on disk or in S3.
-					s.vlogf("rp E H:%s fetch RC:mem B:%d (%v elapsed)", hash, len(body), time.Since(start))
-				}
+				s.setXCacheInfo(rsp.Header, "MISS", "cached, volatile", hash)
 			} else {
-				setXCacheInfo(rsp.Header, "fetch, cached", hash)
-				updateCache = func() {
-					body := buf.Bytes()
-					if err := s.cacheStoreLocal(hash, rsp.Header, body); err != nil {
-						s.rspSaveError.Add(1)
-						s.logf("save %q to cache: %v", hash, err)
-
-						// N.B.: Don't bother trying to forward to S3 in this case.
-					} else {
-						s.rspSave.Add(1)
-						s.rspSaveBytes.Add(int64(len(body)))
-						s.start(s.cacheStoreS3(hash, rsp.Header, body))
-					}
-					s.vlogf("rp E H:%s fetch RC:yes B:%d (%v elapsed)", hash, len(body), time.Since(start))
+				s.setXCacheInfo(rsp.Header, "MISS", "cached", hash)
+			}
+			updateCache = func() {
+				body := buf.Bytes()
+				if rule.tooLarge(int64(len(body))) {
+					s.rspNotCached.Add(1)
+					logDone("fetch", "cached", "no", "bytes", len(body))
+					return
 				}
+				cached := s.saveResponse(hash, hdr, body, !canCacheResponse, maxAge)
+				logDone("fetch", "cached", cached, "bytes", len(body))
 			}
 			return nil
 		}
 	}
+	if shadow := s.Mirror.start(r); shadow != nil {
+		next := proxy.ModifyResponse
+		proxy.ModifyResponse = func(rsp *http.Response) error {
+			shadow.observe(rsp)
+			if next != nil {
+				return next(rsp)
+			}
+			return nil
+		}
+		defer func() { s.start(shadow.run(s.logger())) }()
+	}
 	proxy.ServeHTTP(w, r)
 	updateCache()
 }
 
 // rewriteRequest rewrites the inbound request for routing to a target.
 func (s *Server) rewriteRequest(pr *httputil.ProxyRequest) {
-	u, _ := url.ParseRequestURI(pr.In.RequestURI)
-	u.Host = pr.In.Host
+	u := targetURL(pr.In)
+	pr.Out.URL = u
+	pr.Out.Host = u.Host
+}
+
+// targetURL returns the URL of the target for the inbound request r.
+func targetURL(r *http.Request) *url.URL {
+	u, _ := url.ParseRequestURI(r.RequestURI)
+	u.Host = r.Host
 	if u.Scheme == "" {
 		u.Scheme = "https"
 	}
-	pr.Out.URL = u
-	pr.Out.Host = u.Host
+	return u
+}
+
+// saveResponse caches the headers and body of a response under hash, and
+// reports where it was cached ("mem" or "yes", as logged). A volatile response
+// is cached in memory for maxAge; any other is cached on disk and in S3.
+func (s *Server) saveResponse(hash string, hdr http.Header, body []byte, volatile bool, maxAge time.Duration) string {
+	if volatile {
+		s.cacheStoreMemory(hash, maxAge, hdr, body)
+		s.rspSaveMem.Add(1)
+
+		// N.B. Don't persist on disk or in S3.
+		return "mem"
+	}
+	if err := s.cacheStoreLocal(hash, hdr, body); err != nil {
+		s.rspSaveError.Add(1)
+		s.logger().Warn("save to cache failed", "hash", hash, "err", err)
+
+		// N.B.: Don't bother trying to forward to S3 in this case.
+	} else {
+		s.rspSave.Add(1)
+		s.rspSaveBytes.Add(int64(len(body)))
+		if !s.S3Client.ReadOnly {
+			s.start(s.cacheStoreS3(hash, hdr, body))
+		}
+	}
+	return "yes"
+}
+
+// A cachedResponse is the headers and body of a cached response.
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// keepStale returns a cached response for an expired entry with the given
+// headers and body, if s serves stale responses and cur is nil; otherwise it
+// returns cur.
+func (s *Server) keepStale(cur *cachedResponse, body []byte, hdr http.Header) *cachedResponse {
+	if cur != nil || !s.ServeStaleOnError {
+		return cur
+	}
+	return &cachedResponse{header: hdr, body: body}
 }
 
 type copyReader struct {
@@ -308,20 +479,45 @@ func (s *Server) makePath(hash string) string { return filepath.Join(s.Local, ha
 // makeKey returns the S3 object key for the specified request hash.
 func (s *Server) makeKey(hash string) string { return path.Join(s.KeyPrefix, hash[:2], hash) }
 
-func (s *Server) logf(msg string, args ...any) {
-	if s.Logf != nil {
-		s.Logf(msg, args...)
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
 	}
+	return discardLogger
 }
 
-func (s *Server) vlogf(msg string, args ...any) {
-	if s.LogRequests {
-		s.logf(msg, args...)
-	}
-}
+var discardLogger = slog.New(slog.DiscardHandler)
 
-func hostMatchesTarget(host string, targets []string) bool {
-	return slices.Contains(targets, host)
+// MatchTarget returns the first of targets that matches host, or "" if none
+// does. A target matches host if they are equal, or if the target is a
+// wildcard ("*.example.com") or suffix (".example.com") pattern that matches
+// the name of host, without its port if it has one.
+func MatchTarget(host string, targets []string) string {
+	if slices.Contains(targets, host) {
+		return host
+	}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, t := range targets {
+		if suffix, ok := strings.CutPrefix(t, "*"); ok {
+			// "*.example.com" matches any subdomain, but not example.com.
+			if strings.HasPrefix(suffix, ".") && len(name) > len(suffix) && strings.HasSuffix(name, strings.ToLower(suffix)) {
+				return t
+			}
+		} else if strings.HasPrefix(t, ".") {
+			// ".example.com" matches example.com and any subdomain.
+			suffix := strings.ToLower(t)
+			if name == suffix[1:] || strings.HasSuffix(name, suffix) {
+				return t
+			}
+		} else if name == strings.ToLower(t) {
+			return t
+		}
+	}
+	return ""
 }
 
 // canCacheRequest reports whether r is a request whose response can be cached.
@@ -329,14 +525,17 @@ func (s *Server) canCacheRequest(r *http.Request) bool {
 	return r.Method == "GET" && !parseCacheControl(r.Header.Get("Cache-Control")).Keys.Has("no-store")
 }
 
-// canCacheResponse reports whether r is a response whose body can be cached.
-func (s *Server) canCacheResponse(rsp *http.Response) bool {
-	if rsp.StatusCode != http.StatusOK {
+// canCacheResponse reports whether r is a response whose body can be cached,
+// under the given rule if it is non-nil.
+func (s *Server) canCacheResponse(rsp *http.Response, rule *Rule) bool {
+	if !rule.cacheStatus(rsp.StatusCode) {
 		return false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
 	if cc.Keys.Has("no-store") {
 		return false
+	} else if rule != nil && rule.TTL > 0 {
+		return rule.TTL >= time.Hour // shorter TTLs are cached in memory
 	} else if cc.Keys.Has("immutable") {
 		return true
 	}
@@ -368,12 +567,18 @@ func parseCacheControl(s string) (out cacheControl) {
 
 // canMemoryCache reports whether r is a volatile response whose body can be
 // cached temporarily, and if so returns the maxmimum length of time the cache
-// entry should be valid for.
-func (s *Server) canMemoryCache(rsp *http.Response) (time.Duration, bool) {
-	if rsp.StatusCode != http.StatusOK {
+// entry should be valid for, under the given rule if it is non-nil.
+func (s *Server) canMemoryCache(rsp *http.Response, rule *Rule) (time.Duration, bool) {
+	if !rule.cacheStatus(rsp.StatusCode) {
 		return 0, false
 	}
 	cc := parseCacheControl(rsp.Header.Get("Cache-Control"))
+	if rule != nil && rule.TTL > 0 {
+		if cc.Keys.Has("no-store") || rule.TTL >= time.Hour {
+			return 0, false
+		}
+		return rule.TTL, true
+	}
 	if cc.Keys.Has("no-store") || cc.Keys.Has("no-cache") {
 		// While no-cache doesn't mean we can't cache it, it requires
 		// re-validation before reusing the response, so treat that as if it were
@@ -393,14 +598,40 @@ func hashRequestURL(u *url.URL) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(u.String())))
 }
 
-// writeCachedResponse generates an HTTP response for a cached result using the
-// provided headers and body from the cache object.
-func writeCachedResponse(w http.ResponseWriter, hdr http.Header, body []byte) {
+// writeCachedResponse generates an HTTP response to r for a cached result using
+// the provided headers and body from the cache object. If r has a Range header
+// and the cached response is 200 (OK), only the requested ranges are written.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, hdr http.Header, body []byte) {
+	code := http.StatusOK
+	if v, err := strconv.Atoi(hdr.Get(statusHeader)); err == nil {
+		code = v
+	}
 	wh := w.Header()
 	for name, vals := range hdr {
+		if name == statusHeader {
+			continue
+		}
 		for _, val := range vals {
 			wh.Add(name, val)
 		}
 	}
+	if code == http.StatusOK && r.Header.Get("Range") != "" {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		return
+	}
+	w.WriteHeader(code)
 	w.Write(body)
 }
+
+// cacheHeader returns the headers to cache for rsp. These are the headers of
+// rsp, plus its status if it is not 200 (OK), and its Date if it has none.
+func cacheHeader(rsp *http.Response) http.Header {
+	hdr := rsp.Header.Clone()
+	if rsp.StatusCode != http.StatusOK {
+		hdr.Set(statusHeader, strconv.Itoa(rsp.StatusCode))
+	}
+	if hdr.Get("Date") == "" {
+		hdr.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	return hdr
+}
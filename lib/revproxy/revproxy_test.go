@@ -0,0 +1,271 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/revproxy"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestMatchTarget(t *testing.T) {
+	targets := []string{"api.example.com", "*.cdn.example.com", ".files.example.org", "localhost:8080"}
+	tests := []struct {
+		host, want string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.example.com", "api.example.com"},
+		{"api.example.com:443", "api.example.com"},
+		{"www.example.com", ""},
+		{"localhost:8080", "localhost:8080"},
+		{"localhost", ""},
+
+		{"a.cdn.example.com", "*.cdn.example.com"},
+		{"a.b.cdn.example.com:443", "*.cdn.example.com"},
+		{"cdn.example.com", ""},
+		{"xcdn.example.com", ""},
+
+		{"files.example.org", ".files.example.org"},
+		{"x.y.files.example.org", ".files.example.org"},
+		{"myfiles.example.org", ""},
+	}
+	for _, tc := range tests {
+		if got := revproxy.MatchTarget(tc.host, targets); got != tc.want {
+			t.Errorf("MatchTarget(%q): got %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := revproxy.ParseRules([]byte(`[
+	  {"host": "deb.debian.org", "path": "^/debian/pool/", "ttl": "720h", "max_size": 1024},
+	  {"host": "*.example.com", "ttl": "5m", "status": [200, 404], "ignore_query": true}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("ParseRules: got %d rules, want 2", len(rules))
+	}
+	if r := rules[0]; r.Host != "deb.debian.org" || r.Path.String() != "^/debian/pool/" || r.TTL != 720*time.Hour || r.MaxSize != 1024 {
+		t.Errorf("Rule 1: got %+v", r)
+	}
+	if r := rules[1]; r.Path != nil || r.TTL != 5*time.Minute || len(r.Status) != 2 || !r.IgnoreQuery {
+		t.Errorf("Rule 2: got %+v", r)
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`[{"path": "("}]`,
+		`[{"ttl": "soon"}]`,
+		`[{"status": [42]}]`,
+	} {
+		if _, err := revproxy.ParseRules([]byte(bad)); err == nil {
+			t.Errorf("ParseRules(%s): got nil error", bad)
+		}
+	}
+}
+
+func TestRuleStatus(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "not here", http.StatusNotFound)
+	}))
+	defer origin.Close()
+
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	s := &revproxy.Server{
+		Targets:  []string{originHost},
+		Local:    t.TempDir(),
+		S3Client: emptyS3(t),
+		Rules: []revproxy.Rule{
+			{Host: originHost, TTL: time.Minute, Status: []int{http.StatusNotFound}, IgnoreQuery: true},
+		},
+	}
+	for i, query := range []string{"?a=1", "?a=2"} {
+		req := httptest.NewRequest("GET", origin.URL+"/missing"+query, nil)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %d: got status %d, want %d", i+1, rec.Code, http.StatusNotFound)
+		}
+		if got := rec.Header().Get("Status"); got != "" {
+			t.Errorf("GET %d: got Status header %q", i+1, got)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Origin requests: got %d, want 1", n)
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	var down atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "fresh")
+	}))
+	defer origin.Close()
+
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+	for _, serveStale := range []bool{false, true} {
+		down.Store(false)
+		s := &revproxy.Server{
+			Targets:           []string{originHost},
+			Local:             t.TempDir(),
+			S3Client:          emptyS3(t),
+			Rules:             []revproxy.Rule{{TTL: 10 * time.Millisecond}},
+			ServeStaleOnError: serveStale,
+		}
+		get := func() *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/data", nil))
+			return rec
+		}
+		if rec := get(); rec.Code != http.StatusOK || rec.Body.String() != "fresh" {
+			t.Fatalf("GET: got %d %q, want 200 fresh", rec.Code, rec.Body)
+		}
+
+		// Once the entry expires, a failing origin is masked only when stale
+		// responses are served.
+		time.Sleep(50 * time.Millisecond)
+		down.Store(true)
+		rec := get()
+		if serveStale {
+			if rec.Code != http.StatusOK || rec.Body.String() != "fresh" {
+				t.Errorf("GET stale: got %d %q, want 200 fresh", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Warning"); !strings.HasPrefix(got, "110") {
+				t.Errorf("GET stale: got Warning %q, want 110", got)
+			}
+			if got := rec.Header().Get("X-Cache-Detail"); got != "stale" {
+				t.Errorf("GET stale: got X-Cache-Detail %q, want stale", got)
+			}
+		} else if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET: got %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	var hits atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("Range") != "" {
+			t.Errorf("Origin: got Range %q, want none", r.Header.Get("Range"))
+		}
+		<-release
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	s := &revproxy.Server{
+		Targets:  []string{strings.TrimPrefix(origin.URL, "http://")},
+		Local:    t.TempDir(),
+		S3Client: emptyS3(t),
+	}
+	getRange := func(lo, hi int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", origin.URL+"/artifact.tar", nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", lo, hi))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPartialContent {
+			t.Errorf("GET %d-%d: got status %d, want %d", lo, hi, rec.Code, http.StatusPartialContent)
+		} else if got, want := rec.Body.String(), body[lo:hi+1]; got != want {
+			t.Errorf("GET %d-%d: got %q, want %q", lo, hi, got, want)
+		}
+	}
+
+	// Concurrent ranged requests share one fetch of the whole object.
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getRange(i*250, i*250+249)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Later ranged requests are served from the cache.
+	getRange(10, 19)
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Origin requests: got %d, want 1", n)
+	}
+}
+
+func TestCoalesceFetch(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+		io.WriteString(w, "module zip")
+	}))
+	defer origin.Close()
+
+	s := &revproxy.Server{
+		Targets:  []string{strings.TrimPrefix(origin.URL, "http://")},
+		Local:    t.TempDir(),
+		S3Client: emptyS3(t),
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", origin.URL+"/mod.zip", nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != "module zip" {
+				t.Errorf("GET: got %d %q, want 200 module zip", rec.Code, rec.Body)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Origin requests: got %d, want 1", n)
+	}
+}
+
+// emptyS3 returns a client for a stand-in for S3 that has no objects.
+func emptyS3(t *testing.T) *s3util.Client {
+	t.Helper()
+	fakeS3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+	}))
+	t.Cleanup(fakeS3.Close)
+	return &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(fakeS3.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test",
+	}
+}
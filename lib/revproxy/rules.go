@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package revproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// A Rule is a cache policy for the requests to some of the targets of a
+// [Server], in place of the default policy driven by the Cache-Control header
+// of each response.
+type Rule struct {
+	// Host, if non-empty, is a target (as for [Server.Targets], including
+	// wildcards) whose requests the rule applies to. If empty, the rule
+	// applies to all targets.
+	Host string
+
+	// Path, if non-nil, must match the path of a request URL for the rule to
+	// apply to it. The match is not anchored unless the expression says so.
+	Path *regexp.Regexp
+
+	// TTL, if positive, is how long a response is cached, whatever its
+	// Cache-Control header says (except "no-store"). A TTL below an hour is
+	// cached only in memory; a longer one is cached on disk and in S3, and a
+	// hit older than the TTL (by its Date header) is treated as a miss.
+	// If zero, responses are cached under the default policy.
+	TTL time.Duration
+
+	// MaxSize, if positive, is the largest response body in bytes that is
+	// cached. Larger responses are forwarded, but not cached.
+	MaxSize int64
+
+	// Status lists the response status codes that may be cached. If empty,
+	// only 200 (OK) responses are cached. Partial responses (206) are never
+	// cached; see [Server] for how ranged requests are handled.
+	Status []int
+
+	// IgnoreQuery, if true, means the query string of a request URL is not
+	// part of its cache key, so that requests differing only in their query
+	// share a cache entry.
+	IgnoreQuery bool
+}
+
+// ParseRules parses a JSON array of rules. Each element is an object with the
+// optional fields:
+//
+//	host          -- a target, as for Rule.Host
+//	path          -- a regular expression, as for Rule.Path
+//	ttl           -- a duration such as "10m" or "720h", as for Rule.TTL
+//	max_size      -- a size in bytes, as for Rule.MaxSize
+//	status        -- an array of status codes, as for Rule.Status
+//	ignore_query  -- a Boolean, as for Rule.IgnoreQuery
+func ParseRules(data []byte) ([]Rule, error) {
+	var in []struct {
+		Host        string `json:"host"`
+		Path        string `json:"path"`
+		TTL         string `json:"ttl"`
+		MaxSize     int64  `json:"max_size"`
+		Status      []int  `json:"status"`
+		IgnoreQuery bool   `json:"ignore_query"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+	out := make([]Rule, len(in))
+	for i, r := range in {
+		out[i] = Rule{Host: r.Host, MaxSize: r.MaxSize, Status: r.Status, IgnoreQuery: r.IgnoreQuery}
+		if r.Path != "" {
+			re, err := regexp.Compile(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid path: %w", i+1, err)
+			}
+			out[i].Path = re
+		}
+		if r.TTL != "" {
+			d, err := time.ParseDuration(r.TTL)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("rule %d: invalid ttl %q", i+1, r.TTL)
+			}
+			out[i].TTL = d
+		}
+		for _, code := range r.Status {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("rule %d: invalid status %d", i+1, code)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ruleFor returns the first of the rules of s that applies to r, or nil if
+// none does.
+func (s *Server) ruleFor(r *http.Request) *Rule {
+	for i, rule := range s.Rules {
+		if rule.Host != "" && MatchTarget(r.Host, []string{rule.Host}) == "" {
+			continue
+		}
+		if rule.Path != nil && !rule.Path.MatchString(r.URL.Path) {
+			continue
+		}
+		return &s.Rules[i]
+	}
+	return nil
+}
+
+// keyURL returns the URL whose digest is the cache key for a request to u.
+func (r *Rule) keyURL(u *url.URL) *url.URL {
+	if r == nil || !r.IgnoreQuery || u.RawQuery == "" {
+		return u
+	}
+	c := *u
+	c.RawQuery, c.ForceQuery = "", false
+	return &c
+}
+
+// cacheStatus reports whether a response with the given status may be cached.
+// A partial response (206) is never cached, since it is not the whole object.
+func (r *Rule) cacheStatus(code int) bool {
+	if code == http.StatusPartialContent {
+		return false
+	} else if r == nil || len(r.Status) == 0 {
+		return code == http.StatusOK
+	}
+	return slices.Contains(r.Status, code)
+}
+
+// tooLarge reports whether a response body of n bytes is too large to cache.
+func (r *Rule) tooLarge(n int64) bool { return r != nil && r.MaxSize > 0 && n > r.MaxSize }
+
+// expired reports whether a cached response with the given headers is older
+// than the TTL of r. A response without a Date is treated as expired.
+func (r *Rule) expired(hdr http.Header) bool {
+	if r == nil || r.TTL <= 0 {
+		return false
+	}
+	date, err := http.ParseTime(hdr.Get("Date"))
+	return err != nil || time.Since(date) > r.TTL
+}
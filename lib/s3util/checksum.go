@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"cmp"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrCorrupt is reported by reading the contents of an object whose checksum
+// does not match them (see [Client.VerifyChecksums]).
+var ErrCorrupt = errors.New("object contents do not match their checksum")
+
+// ParseChecksum returns the checksum algorithm with the given name, such as
+// "crc32c" or "SHA256" (case does not matter). An empty name returns "",
+// meaning the default of the AWS SDK applies.
+func ParseChecksum(name string) (types.ChecksumAlgorithm, error) {
+	if name == "" {
+		return "", nil
+	}
+	alg := types.ChecksumAlgorithm(strings.ToUpper(name))
+	if !slices.Contains(alg.Values(), alg) {
+		return "", fmt.Errorf("unknown checksum algorithm %q", name)
+	}
+	return alg, nil
+}
+
+// ChecksumStats count the objects read by a [Client] that verifies checksums.
+// A ChecksumStats may be shared by several clients. A zero ChecksumStats is
+// ready for use.
+type ChecksumStats struct {
+	verified   expvar.Int // count of objects read whose checksums matched
+	unverified expvar.Int // count of objects read without a checksum to verify
+	corrupt    expvar.Int // count of objects read whose checksums did not match
+}
+
+// Metrics returns a map of the checksum metrics.
+func (s *ChecksumStats) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("get_checksum_verified", &s.verified)
+	m.Set("get_checksum_unverified", &s.unverified)
+	m.Set("get_checksum_corrupt", &s.corrupt)
+	return m
+}
+
+// Corrupt reports the number of objects counted by s whose contents did not
+// match their checksums.
+func (s *ChecksumStats) Corrupt() int64 { return s.corrupt.Value() }
+
+// checksumMode returns the checksum mode of requests to read objects.
+func (c *Client) checksumMode() types.ChecksumMode {
+	if c.VerifyChecksums {
+		return types.ChecksumModeEnabled
+	}
+	return ""
+}
+
+// checkBody returns the body of rsp, the response to a request to read key,
+// wrapped to count the outcome of its verification and to report a mismatch
+// as [ErrCorrupt], if c verifies checksums. The AWS SDK verifies the contents
+// as they are read, and reports a mismatch at the end, so that a corrupt
+// object is never read in full.
+func (c *Client) checkBody(key string, rsp *s3.GetObjectOutput) io.ReadCloser {
+	if !c.VerifyChecksums {
+		return rsp.Body
+	}
+	sum := cmp.Or(rsp.ChecksumCRC32C, rsp.ChecksumSHA256, rsp.ChecksumCRC32, rsp.ChecksumSHA1, rsp.ChecksumCRC64NVME)
+	if sum == nil || strings.Contains(*sum, "-") {
+		// S3 reports no checksum, or that of the parts of a multipart
+		// upload, which the SDK does not verify.
+		if s := c.ChecksumStats; s != nil {
+			s.unverified.Add(1)
+		}
+		return rsp.Body
+	}
+	return &checkedBody{ReadCloser: rsp.Body, key: key, stats: c.ChecksumStats}
+}
+
+// checkedBody is the body of an object whose checksum is verified by the SDK.
+type checkedBody struct {
+	io.ReadCloser
+	key     string
+	stats   *ChecksumStats
+	counted bool // whether the outcome has been counted
+}
+
+func (b *checkedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	switch {
+	case err == nil:
+		return n, nil
+	case err == io.EOF:
+		if b.stats != nil && !b.counted {
+			b.stats.verified.Add(1)
+		}
+	case strings.Contains(err.Error(), "checksum did not match"):
+		// The SDK does not export the type of this error.
+		if b.stats != nil && !b.counted {
+			b.stats.corrupt.Add(1)
+		}
+		err = fmt.Errorf("key %q: %w: %v", b.key, ErrCorrupt, err)
+	default:
+		return n, err
+	}
+	b.counted = true
+	return n, err
+}
@@ -0,0 +1,115 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func crc32c(s string) string {
+	sum := crc32.Checksum([]byte(s), crc32.MakeTable(crc32.Castagnoli))
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, sum))
+}
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		want types.ChecksumAlgorithm
+		ok   bool
+	}{
+		{"", "", true},
+		{"crc32c", types.ChecksumAlgorithmCrc32c, true},
+		{"SHA256", types.ChecksumAlgorithmSha256, true},
+		{"md5", "", false},
+	}
+	for _, tc := range tests {
+		got, err := s3util.ParseChecksum(tc.name)
+		if tc.ok && err != nil {
+			t.Errorf("ParseChecksum(%q): unexpected error: %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("ParseChecksum(%q): got %q, want error", tc.name, got)
+		} else if got != tc.want {
+			t.Errorf("ParseChecksum(%q): got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	// The server serves each object with the checksum of "good", and records
+	// the checksum sent with each upload.
+	const good = "the contents of the object"
+	var uploaded string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			uploaded = r.Header.Get("X-Amz-Checksum-Crc32c")
+		case "GET":
+			if r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+				w.Header().Set("X-Amz-Checksum-Crc32c", crc32c(good))
+			}
+			switch r.URL.Path {
+			case "/test/good":
+				io.WriteString(w, good)
+			case "/test/bad":
+				io.WriteString(w, strings.ToUpper(good))
+			}
+		}
+	}))
+	defer srv.Close()
+
+	stats := new(s3util.ChecksumStats)
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			HTTPClient:   srv.Client(),
+		}),
+		Bucket:          "test",
+		Checksum:        types.ChecksumAlgorithmCrc32c,
+		VerifyChecksums: true,
+		ChecksumStats:   stats,
+	}
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "good", strings.NewReader(good)); err != nil {
+		t.Fatalf("Put: %v", err)
+	} else if want := crc32c(good); uploaded != want {
+		t.Errorf("Put checksum: got %q, want %q", uploaded, want)
+	}
+
+	if data, err := c.GetData(ctx, "good"); err != nil || string(data) != good {
+		t.Errorf("GetData good: got %q, %v; want %q", data, err, good)
+	}
+	if data, err := c.GetData(ctx, "bad"); !errors.Is(err, s3util.ErrCorrupt) {
+		t.Errorf("GetData bad: got %q, %v; want %v", data, err, s3util.ErrCorrupt)
+	}
+
+	m := stats.Metrics()
+	for name, want := range map[string]int64{
+		"get_checksum_verified":   1,
+		"get_checksum_unverified": 0,
+		"get_checksum_corrupt":    1,
+	} {
+		if got := m.Get(name).(*expvar.Int).Value(); got != want {
+			t.Errorf("Metric %s: got %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A KeyWrapper generates and unwraps the data keys used by an [Envelope].
+type KeyWrapper interface {
+	// GenerateDataKey returns a new 256-bit data key, the same key wrapped
+	// (encrypted) for storage beside the data it encrypts, and the ID of the
+	// key that wrapped it.
+	GenerateDataKey(ctx context.Context) (keyID string, plain, wrapped []byte, _ error)
+
+	// UnwrapDataKey returns the plaintext of a data key wrapped by the key
+	// with the given ID.
+	UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// An Envelope encrypts the contents of objects on the client before they are
+// written to S3, so that they cannot be read by a principal with access to the
+// bucket but not to the wrapping key.
+//
+// Each object is encrypted with AES-256-GCM under a data key, and the data key,
+// wrapped by Keys, is stored with the ID of the wrapping key in the metadata
+// of the object. The ciphertext is bound to the key of the object and the ID
+// of the wrapping key, so it cannot be copied to another key and still be
+// read. The MD5 digest of the contents, used by conditional puts, is likewise
+// stored encrypted. Objects are decrypted with the key named by their metadata,
+// so that objects written before the wrapping key was rotated remain readable.
+// Objects with no such metadata are rejected with [ErrDecrypt], unless
+// AllowPlaintext is set.
+//
+// The contents of each object are encrypted and decrypted in memory.
+type Envelope struct {
+	// Keys generates and unwraps the data keys. It must be non-nil.
+	Keys KeyWrapper
+
+	// DataKeyTTL is how long a data key is used to encrypt new objects before
+	// a new one is generated. If zero, the default is 1h. Each data key
+	// encrypts many objects, so that writing an object does not usually need
+	// a request to the key service.
+	DataKeyTTL time.Duration
+
+	// AllowPlaintext, if true, permits objects with no envelope metadata to
+	// be read as they are, as when encryption is enabled on an existing
+	// cache. Otherwise they are rejected, so that an object planted by a
+	// principal that can write to the bucket but not use the wrapping key is
+	// never read.
+	AllowPlaintext bool
+
+	mu        sync.Mutex
+	cur       *dataKey               // the key for new objects, or nil
+	unwrapped map[string]cipher.AEAD // recently used data keys, by wrapped key
+}
+
+// maxUnwrapped is the most unwrapped data keys an Envelope retains.
+const maxUnwrapped = 1024
+
+// Metadata keys recording the data key of an object written by an Envelope.
+const (
+	cseKeyIDMetadata   = "cse-key-id"
+	cseDataKeyMetadata = "cse-data-key"
+	cseETagMetadata    = "cse-etag"
+)
+
+// ErrDecrypt is reported when the contents of an object written by an
+// [Envelope] cannot be decrypted, or when an object was not written by an
+// Envelope and plaintext is not allowed.
+var ErrDecrypt = errors.New("cannot decrypt object")
+
+type dataKey struct {
+	keyID   string
+	wrapped string // base64
+	aead    cipher.AEAD
+	expires time.Time
+}
+
+// seal encrypts plain, the contents of the object at key, and returns the
+// encrypted contents and the metadata to store with them. If etag != "", it
+// is the MD5 digest of plain, which is recorded encrypted in the metadata so
+// that it can be checked by checkETag without revealing it.
+func (e *Envelope) seal(ctx context.Context, key, etag string, plain []byte) ([]byte, map[string]string, error) {
+	dk, err := e.currentKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := map[string]string{
+		cseKeyIDMetadata:   dk.keyID,
+		cseDataKeyMetadata: dk.wrapped,
+	}
+	if etag != "" {
+		sealed := sealData(dk.aead, additionalData("etag", dk.keyID, key), []byte(etag))
+		meta[cseETagMetadata] = base64.StdEncoding.EncodeToString(sealed)
+	}
+	return sealData(dk.aead, additionalData("data", dk.keyID, key), plain), meta, nil
+}
+
+// open decrypts the contents of the object at key with the given metadata.
+// If the metadata do not record a data key, the data are returned unchanged
+// if e.AllowPlaintext is set, and otherwise rejected.
+func (e *Envelope) open(ctx context.Context, key string, meta map[string]string, data []byte) ([]byte, error) {
+	keyID, wrapped := meta[cseKeyIDMetadata], meta[cseDataKeyMetadata]
+	if keyID == "" && wrapped == "" {
+		if e.AllowPlaintext {
+			return data, nil
+		}
+		return nil, fmt.Errorf("%w: object is not encrypted", ErrDecrypt)
+	}
+	aead, err := e.unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return openData(aead, additionalData("data", keyID, key), data)
+}
+
+// checkETag reports whether the metadata of the object at key record the
+// given etag, as written by seal.
+func (e *Envelope) checkETag(ctx context.Context, key string, meta map[string]string, etag string) bool {
+	sealed, err := base64.StdEncoding.DecodeString(meta[cseETagMetadata])
+	if err != nil || len(sealed) == 0 {
+		return false
+	}
+	keyID := meta[cseKeyIDMetadata]
+	aead, err := e.unwrap(ctx, keyID, meta[cseDataKeyMetadata])
+	if err != nil {
+		return false
+	}
+	got, err := openData(aead, additionalData("etag", keyID, key), sealed)
+	return err == nil && string(got) == etag
+}
+
+// additionalData returns the additional data authenticated with the named
+// field of the object at key, encrypted under a data key wrapped by keyID.
+// Binding the key and field means that contents or metadata copied from one
+// object to another, or from one field to another, are not decrypted.
+func additionalData(field, keyID, key string) []byte {
+	ad := append([]byte(field), 0)
+	ad = binary.AppendUvarint(ad, uint64(len(keyID)))
+	ad = append(ad, keyID...)
+	return append(ad, key...)
+}
+
+// sealData encrypts plain with aead and the additional data ad, and returns a
+// random nonce followed by the ciphertext.
+func sealData(aead cipher.AEAD, ad, plain []byte) []byte {
+	ns := aead.NonceSize()
+	out := make([]byte, ns, ns+len(plain)+aead.Overhead())
+	rand.Read(out)
+	return aead.Seal(out, out[:ns], plain, ad)
+}
+
+// openData decrypts data sealed by sealData.
+func openData(aead cipher.AEAD, ad, data []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(data) < ns {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, data[:ns], data[ns:], ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// currentKey returns the data key for new objects, generating a new one if
+// there is none or it has expired.
+func (e *Envelope) currentKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cur != nil && time.Now().Before(e.cur.expires) {
+		return e.cur, nil
+	}
+	keyID, plain, wrapped, err := e.Keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	aead, err := newGCM(plain)
+	if err != nil {
+		return nil, err
+	}
+	ttl := e.DataKeyTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	e.cur = &dataKey{
+		keyID:   keyID,
+		wrapped: base64.StdEncoding.EncodeToString(wrapped),
+		aead:    aead,
+		expires: time.Now().Add(ttl),
+	}
+	e.rememberLocked(e.cur.wrapped, aead)
+	return e.cur, nil
+}
+
+// unwrap returns the cipher for the given wrapped data key, unwrapping it if
+// it is not one recently used.
+func (e *Envelope) unwrap(ctx context.Context, keyID, wrapped string) (cipher.AEAD, error) {
+	e.mu.Lock()
+	aead, ok := e.unwrapped[wrapped]
+	e.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data key: %v", ErrDecrypt, err)
+	}
+	plain, err := e.Keys.UnwrapDataKey(ctx, keyID, blob)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key (key %q): %w", keyID, err)
+	}
+	aead, err = newGCM(plain)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rememberLocked(wrapped, aead)
+	return aead, nil
+}
+
+func (e *Envelope) rememberLocked(wrapped string, aead cipher.AEAD) {
+	if e.unwrapped == nil || len(e.unwrapped) >= maxUnwrapped {
+		e.unwrapped = make(map[string]cipher.AEAD)
+	}
+	e.unwrapped[wrapped] = aead
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key is %d bytes, want 32", len(key))
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
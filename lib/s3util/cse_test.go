@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+// fakeBucket is an S3 bucket supporting only the requests to put and get
+// whole objects, which it keeps in memory with their metadata.
+type fakeBucket struct {
+	mu   sync.Mutex
+	objs map[string]fakeObject
+}
+
+type fakeObject struct {
+	data []byte
+	meta http.Header
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		data, _ := io.ReadAll(r.Body)
+		meta := make(http.Header)
+		for k, v := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				meta[k] = v
+			}
+		}
+		if b.objs == nil {
+			b.objs = make(map[string]fakeObject)
+		}
+		b.objs[r.URL.Path] = fakeObject{data: data, meta: meta}
+	case "GET", "HEAD":
+		obj, ok := b.objs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Write(obj.data)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// testKeys is a KeyWrapper that "wraps" data keys by reversing them, and
+// counts the keys it generates and unwraps.
+type testKeys struct {
+	keyID         string
+	ngen, nunwrap int
+}
+
+func (k *testKeys) GenerateDataKey(context.Context) (string, []byte, []byte, error) {
+	k.ngen++
+	plain := bytes.Repeat([]byte{byte(k.ngen)}, 31)
+	plain = append(plain, 'k')
+	return k.keyID, plain, reversed(plain), nil
+}
+
+func (k *testKeys) UnwrapDataKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	k.nunwrap++
+	if !strings.HasPrefix(keyID, "test-") {
+		return nil, errors.New("unknown key")
+	}
+	return reversed(wrapped), nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func reversed(b []byte) []byte {
+	out := slices.Clone(b)
+	slices.Reverse(out)
+	return out
+}
+
+func TestEnvelope(t *testing.T) {
+	bucket := new(fakeBucket)
+	srv := httptest.NewServer(bucket)
+	defer srv.Close()
+
+	keys := &testKeys{keyID: "test-1"}
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:                     "us-east-1",
+			BaseEndpoint:               aws.String(srv.URL),
+			UsePathStyle:               true,
+			Credentials:                aws.AnonymousCredentials{},
+			HTTPClient:                 srv.Client(),
+			RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		}),
+		Bucket:   "test",
+		Envelope: &s3util.Envelope{Keys: keys},
+	}
+	ctx := context.Background()
+	check := func(key, want string) {
+		t.Helper()
+		rc, size, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get %q: %v", key, err)
+		}
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		if err != nil || string(got) != want || size != int64(len(want)) {
+			t.Errorf("Get %q: got %q (size %d), %v; want %q", key, got, size, err, want)
+		}
+	}
+
+	const secret = "proprietary build output"
+	if _, err := c.PutCond(ctx, "a", md5Hex(secret), strings.NewReader(secret)); err != nil {
+		t.Fatalf("PutCond: %v", err)
+	}
+	if err := c.Put(ctx, "b", strings.NewReader(secret+" 2")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	obj := bucket.objs["/test/a"]
+	if bytes.Contains(obj.data, []byte(secret)) {
+		t.Error("Stored object contains the plaintext")
+	}
+	if got := obj.meta.Get("X-Amz-Meta-Cse-Key-Id"); got != "test-1" {
+		t.Errorf("Key ID metadata: got %q, want test-1", got)
+	}
+	for name, vals := range obj.meta {
+		if slices.Contains(vals, md5Hex(secret)) {
+			t.Errorf("Metadata %s records the plaintext digest", name)
+		}
+	}
+	check("a", secret)
+	check("b", secret+" 2")
+	if keys.ngen != 1 || keys.nunwrap != 0 {
+		t.Errorf("Keys: generated %d, unwrapped %d; want 1, 0", keys.ngen, keys.nunwrap)
+	}
+
+	// A conditional put of the same contents is skipped, even though the
+	// contents stored differ from those given.
+	if ok, err := c.PutCond(ctx, "a", md5Hex(secret), strings.NewReader(secret)); err != nil || ok {
+		t.Errorf("PutCond: got %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := c.PutCond(ctx, "e", md5Hex(secret), strings.NewReader(secret)); err != nil || !ok {
+		t.Errorf("PutCond new key: got %v, %v; want true, nil", ok, err)
+	}
+
+	// A new client, as after the wrapping key was rotated, unwraps the data
+	// key of the existing objects.
+	c.Envelope = &s3util.Envelope{Keys: &testKeys{keyID: "test-2"}}
+	check("a", secret)
+	if err := c.Put(ctx, "c", strings.NewReader("new")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	check("c", "new")
+
+	// Objects written without an envelope are rejected, unless plaintext is
+	// allowed for a migration.
+	plain := &s3util.Client{Client: c.Client, Bucket: c.Bucket}
+	if err := plain.Put(ctx, "d", strings.NewReader("plain")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, _, err := c.Get(ctx, "d"); !errors.Is(err, s3util.ErrDecrypt) {
+		t.Errorf("Get plaintext: got %v, want %v", err, s3util.ErrDecrypt)
+	}
+	c.Envelope.AllowPlaintext = true
+	check("d", "plain")
+	c.Envelope.AllowPlaintext = false
+
+	// Contents copied to another key are not decrypted, nor is the digest
+	// copied with them recognized.
+	bucket.objs["/test/f"] = bucket.objs["/test/e"]
+	if _, _, err := c.Get(ctx, "f"); !errors.Is(err, s3util.ErrDecrypt) {
+		t.Errorf("Get copied: got %v, want %v", err, s3util.ErrDecrypt)
+	}
+	if ok, err := c.PutCond(ctx, "f", md5Hex(secret), strings.NewReader(secret)); err != nil || !ok {
+		t.Errorf("PutCond copied: got %v, %v; want true, nil", ok, err)
+	}
+	check("f", secret)
+
+	// A copy made by the client is sealed for its new key.
+	if err := c.CopyFrom(ctx, c, "e", "g"); err != nil {
+		t.Fatalf("CopyFrom: %v", err)
+	}
+	check("g", secret)
+
+	// Modified contents are not decrypted.
+	bucket.objs["/test/a"].data[20] ^= 1
+	if _, _, err := c.Get(ctx, "a"); !errors.Is(err, s3util.ErrDecrypt) {
+		t.Errorf("Get modified: got %v, want %v", err, s3util.ErrDecrypt)
+	}
+}
+
+func TestKMSKeys(t *testing.T) {
+	var ops []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+		ops = append(ops, op)
+		var req struct {
+			KeyID          string `json:"KeyId"`
+			CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch op {
+		case "GenerateDataKey":
+			json.NewEncoder(w).Encode(map[string]any{
+				"KeyId":          "arn:aws:kms:us-east-1:1:key/" + req.KeyID,
+				"Plaintext":      []byte("plain"),
+				"CiphertextBlob": []byte("wrapped"),
+			})
+		case "Decrypt":
+			if string(req.CiphertextBlob) != "wrapped" {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"__type":"InvalidCiphertextException","message":"bad blob"}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Plaintext": []byte("plain")})
+		}
+	}))
+	defer srv.Close()
+
+	k := &s3util.KMSKeys{
+		KeyID: "k1",
+		Config: aws.Config{
+			Region: "us-east-1",
+			Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+			}),
+		},
+		Endpoint: srv.URL,
+	}
+	ctx := context.Background()
+	id, plain, wrapped, err := k.GenerateDataKey(ctx)
+	if err != nil {
+		t.Fatalf("GenerateDataKey: %v", err)
+	}
+	if id != "arn:aws:kms:us-east-1:1:key/k1" || string(plain) != "plain" || string(wrapped) != "wrapped" {
+		t.Errorf("GenerateDataKey: got %q, %q, %q", id, plain, wrapped)
+	}
+	if got, err := k.UnwrapDataKey(ctx, id, wrapped); err != nil || string(got) != "plain" {
+		t.Errorf("UnwrapDataKey: got %q, %v; want plain", got, err)
+	}
+	if _, err := k.UnwrapDataKey(ctx, id, []byte("bogus")); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Errorf("UnwrapDataKey bogus: got %v, want InvalidCiphertextException", err)
+	}
+	if want := []string{"GenerateDataKey", "Decrypt", "Decrypt"}; !slices.Equal(ops, want) {
+		t.Errorf("Operations: got %q, want %q", ops, want)
+	}
+}
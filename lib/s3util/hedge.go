@@ -0,0 +1,214 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// hedgeSamples is the number of recent latencies from which a Hedge
+	// computes its delay.
+	hedgeSamples = 256
+
+	// hedgeMinSamples is the number of latencies a Hedge observes before it
+	// uses their percentile. Until then, it waits MaxDelay.
+	hedgeMinSamples = 32
+
+	// hedgeRecompute is how many latencies a Hedge observes between updates
+	// of its delay.
+	hedgeRecompute = 16
+)
+
+// A Hedge hedges reads from S3 against slow responses: if the response to a
+// read has not begun within a delay, a second request for the same object is
+// sent, and the first of the two to respond is used. The delay is the given
+// percentile of the latencies of recent reads, so that only the slowest reads
+// are hedged, at the cost of a few extra requests.
+//
+// A Hedge is safe for concurrent use, and may be shared by several clients.
+type Hedge struct {
+	// Percentile is the percentile of recent read latencies after which a
+	// read is hedged, as a fraction in (0, 1). If zero, 0.95 is used.
+	Percentile float64
+
+	// MinDelay is the least delay before a read is hedged, so that fast reads
+	// are not hedged even when their latency varies. If zero, 10ms is used.
+	MinDelay time.Duration
+
+	// MaxDelay is the greatest delay before a read is hedged, used until
+	// enough reads have been observed. If zero, 1s is used.
+	MaxDelay time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration // a ring of recent latencies
+	next    int             // the next position in samples
+	fresh   int             // latencies observed since delay was computed
+	delay   time.Duration   // the current delay, or 0 if not computed
+
+	hedged expvar.Int // count of reads hedged
+	won    expvar.Int // count of hedged reads answered first by the hedge
+}
+
+// Metrics returns a map of the metrics of h.
+func (h *Hedge) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("get_hedged", &h.hedged)
+	m.Set("get_hedge_won", &h.won)
+	m.Set("get_hedge_delay_ms", expvar.Func(func() any { return h.currentDelay().Milliseconds() }))
+	return m
+}
+
+// currentDelay reports how long a read waits before it is hedged.
+func (h *Hedge) currentDelay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.delayLocked()
+}
+
+func (h *Hedge) delayLocked() time.Duration {
+	minDelay := h.MinDelay
+	if minDelay <= 0 {
+		minDelay = 10 * time.Millisecond
+	}
+	maxDelay := h.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = time.Second
+	}
+	if len(h.samples) < hedgeMinSamples {
+		return max(maxDelay, minDelay)
+	}
+	if h.delay == 0 || h.fresh >= hedgeRecompute {
+		p := h.Percentile
+		if p <= 0 || p >= 1 {
+			p = 0.95
+		}
+		sorted := slices.Clone(h.samples)
+		slices.Sort(sorted)
+		h.delay = sorted[int(p*float64(len(sorted)-1))]
+		h.fresh = 0
+	}
+	return min(max(h.delay, minDelay), maxDelay)
+}
+
+// observe records the latency of a read.
+func (h *Hedge) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.fresh++
+}
+
+// hedgeResult is the outcome of one of the requests of a hedged read.
+type hedgeResult struct {
+	rsp    *s3.GetObjectOutput
+	err    error
+	cancel context.CancelFunc
+	hedge  bool // this is the second request
+}
+
+// get calls get to read an object, and again if the first call has not
+// returned within the delay of h, and reports the first successful result. If
+// both calls fail, or the first reports that the object does not exist, get
+// reports the first error. The body of the response must be closed.
+func (h *Hedge) get(ctx context.Context, get func(context.Context) (*s3.GetObjectOutput, error)) (*s3.GetObjectOutput, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc // of the first request and the hedge
+	start := func(hedge bool) {
+		rctx, cancel := context.WithCancel(ctx)
+		cancels[b2i(hedge)] = cancel
+		go func() {
+			begin := time.Now()
+			rsp, err := get(rctx)
+			if err == nil {
+				h.observe(time.Since(begin))
+			}
+			results <- hedgeResult{rsp: rsp, err: err, cancel: cancel, hedge: hedge}
+		}()
+	}
+
+	// discard cancels the outstanding request, and cleans up after it once it
+	// returns.
+	discard := func(winner bool) {
+		cancels[b2i(!winner)]()
+		go func() {
+			o := <-results
+			o.cancel()
+			if o.err == nil {
+				o.rsp.Body.Close()
+			}
+		}()
+	}
+
+	start(false)
+	timer := time.NewTimer(h.currentDelay())
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	var first error
+	for {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				h.hedged.Add(1)
+				start(true)
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				r.cancel()
+				if first == nil {
+					first = r.err
+				}
+				if pending > 0 && !IsNotExist(r.err) {
+					continue // the other request may yet succeed
+				} else if pending > 0 {
+					discard(r.hedge)
+				}
+				return nil, first
+			}
+			if r.hedge {
+				h.won.Add(1)
+			}
+			if pending > 0 {
+				discard(r.hedge)
+			}
+			r.rsp.Body = cancelBody{ReadCloser: r.rsp.Body, cancel: r.cancel}
+			return r.rsp, nil
+		}
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// cancelBody is a response body that cancels the context of its request when
+// it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelBody) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestHedge(t *testing.T) {
+	// The server stalls the first request until it is canceled, and answers
+	// the others at once.
+	var nreq atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nreq.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		io.WriteString(w, "data")
+	}))
+	defer srv.Close()
+
+	h := &s3util.Hedge{MinDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond}
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}),
+		Bucket: "test",
+		Hedge:  h,
+	}
+	start := time.Now()
+	data, err := c.GetData(context.Background(), "key")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("GetData: got %q, %v; want data", data, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("GetData took %v, want it hedged", d)
+	}
+	m := h.Metrics()
+	if got := m.Get("get_hedged").String(); got != "1" {
+		t.Errorf("Hedged: got %s, want 1", got)
+	}
+	if got := m.Get("get_hedge_won").String(); got != "1" {
+		t.Errorf("Hedge won: got %s, want 1", got)
+	}
+
+	// A fast read is not hedged.
+	if _, err := c.GetData(context.Background(), "key"); err != nil {
+		t.Fatalf("GetData: %v", err)
+	}
+	if got := m.Get("get_hedged").String(); got != "1" {
+		t.Errorf("Hedged: got %s, want 1", got)
+	}
+}
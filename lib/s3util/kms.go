@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// KMSKeys is a [KeyWrapper] that generates and unwraps data keys with AWS
+// KMS. It calls the GenerateDataKey and Decrypt operations of the KMS API, so
+// the credentials must permit kms:GenerateDataKey on KeyID for writing, and
+// kms:Decrypt on the keys that wrapped the objects for reading.
+type KMSKeys struct {
+	// KeyID is the ID, ARN, or alias of the KMS key that wraps new data keys.
+	// It must be non-empty.
+	KeyID string
+
+	// Config provides the region, credentials, and HTTP client used for
+	// requests to KMS.
+	Config aws.Config
+
+	// Endpoint, if non-empty, is the base URL of the KMS API. If empty, the
+	// endpoint for the region of Config is used.
+	Endpoint string
+}
+
+// GenerateDataKey implements a method of the [KeyWrapper] interface.
+func (k *KMSKeys) GenerateDataKey(ctx context.Context) (string, []byte, []byte, error) {
+	var rsp struct {
+		KeyID          string `json:"KeyId"`
+		Plaintext      []byte `json:"Plaintext"`
+		CiphertextBlob []byte `json:"CiphertextBlob"`
+	}
+	if err := k.call(ctx, "GenerateDataKey", map[string]any{
+		"KeyId":   k.KeyID,
+		"KeySpec": "AES_256",
+	}, &rsp); err != nil {
+		return "", nil, nil, err
+	}
+	return rsp.KeyID, rsp.Plaintext, rsp.CiphertextBlob, nil
+}
+
+// UnwrapDataKey implements a method of the [KeyWrapper] interface.
+func (k *KMSKeys) UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	var rsp struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := k.call(ctx, "Decrypt", map[string]any{
+		"KeyId":          keyID,
+		"CiphertextBlob": wrapped,
+	}, &rsp); err != nil {
+		return nil, err
+	}
+	return rsp.Plaintext, nil
+}
+
+// call sends a request for the given operation of the KMS API, and decodes
+// its response into rsp. Byte slices are encoded as base64 in both.
+func (k *KMSKeys) call(ctx context.Context, op string, req, rsp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := k.Endpoint
+	if url == "" {
+		if k.Config.Region == "" {
+			return errors.New("no region for KMS")
+		}
+		url = "https://kms." + k.Config.Region + ".amazonaws.com/"
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	hreq.Header.Set("X-Amz-Target", "TrentService."+op)
+
+	if k.Config.Credentials == nil {
+		return errors.New("no credentials for KMS")
+	}
+	creds, err := k.Config.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("get credentials: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, hreq, hex.EncodeToString(sum[:]),
+		"kms", k.Config.Region, time.Now()); err != nil {
+		return fmt.Errorf("sign request: %w", err)
+	}
+
+	var hc interface {
+		Do(*http.Request) (*http.Response, error)
+	} = http.DefaultClient
+	if k.Config.HTTPClient != nil {
+		hc = k.Config.HTTPClient
+	}
+	hrsp, err := hc.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	defer hrsp.Body.Close()
+	data, err := io.ReadAll(hrsp.Body)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	if hrsp.StatusCode != http.StatusOK {
+		var kerr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &kerr)
+		return fmt.Errorf("kms %s: %s: %s %s", op, hrsp.Status, kerr.Type, kerr.Message)
+	}
+	return json.Unmarshal(data, rsp)
+}
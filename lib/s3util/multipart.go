@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/creachadair/mds/value"
+	"github.com/creachadair/taskgroup"
+)
+
+// Limits imposed by the S3 multipart upload API.
+const (
+	minPartSize = 5 << 20
+	maxParts    = 10000
+)
+
+// MultipartOptions are settings for a multipart upload.
+type MultipartOptions struct {
+	// PartSize is the size in bytes of each part but the last. If zero, a
+	// default of 16 MiB is used. Values below the S3 minimum (5 MiB) are
+	// rounded up, and the size is increased as needed to keep within the S3
+	// limit of 10000 parts per object.
+	PartSize int64
+
+	// Concurrency is the maximum number of parts to upload concurrently.
+	// If zero or negative, a default of 4 is used.
+	Concurrency int
+}
+
+// partSize returns the effective part size for an object of the given size.
+// The result depends only on o and size, so that the multipart ETag of an
+// object is stable for a given configuration.
+func (o MultipartOptions) partSize(size int64) int64 {
+	ps := o.PartSize
+	if ps <= 0 {
+		ps = 16 << 20
+	}
+	ps = max(ps, minPartSize, (size+maxParts-1)/maxParts)
+	return ps
+}
+
+func (o MultipartOptions) concurrency() int {
+	if o.Concurrency > 0 {
+		return o.Concurrency
+	}
+	return 4
+}
+
+// MultipartETag returns the S3 ETag of an object consisting of the first size
+// bytes of r, if it is written by a multipart upload with the given options.
+// The result has the form "<hex>-<parts>", as reported by S3.
+func MultipartETag(r io.ReaderAt, size int64, opts MultipartOptions) (string, error) {
+	ps := opts.partSize(size)
+	all := md5.New()
+	var nparts int
+	for off := int64(0); off < size || nparts == 0; off += ps {
+		h := md5.New()
+		if _, err := io.Copy(h, io.NewSectionReader(r, off, min(ps, size-off))); err != nil {
+			return "", err
+		}
+		all.Write(h.Sum(nil))
+		nparts++
+	}
+	return fmt.Sprintf("%x-%d", all.Sum(nil), nparts), nil
+}
+
+// PutMultipart writes the first size bytes of r to S3 under the given key,
+// using a multipart upload. If the upload fails, PutMultipart attempts to
+// abort it so that the parts already uploaded are discarded.
+func (c *Client) PutMultipart(ctx context.Context, key string, r io.ReaderAt, size int64, opts MultipartOptions) error {
+	return c.putMultipart(ctx, key, "", r, size, opts)
+}
+
+// putMultipart implements PutMultipart. If etag != "", it is the multipart
+// ETag of the data, recorded as for [Client.put].
+func (c *Client) putMultipart(ctx context.Context, key, etag string, r io.ReaderAt, size int64, opts MultipartOptions) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	meta := c.etagMetadata(etag)
+	if c.Envelope != nil {
+		plain, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return err
+		}
+		sealed, cse, err := c.Envelope.seal(ctx, key, etag, plain)
+		if err != nil {
+			return err
+		}
+		r, size, meta = bytes.NewReader(sealed), int64(len(sealed)), mergeMetadata(meta, cse)
+	}
+	sse, kmsKey, bucketKey := c.Encryption.params()
+	mp, err := c.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               &c.Bucket,
+		RequestPayer:         c.payer(),
+		Key:                  &key,
+		Metadata:             meta,
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKey,
+		BucketKeyEnabled:     bucketKey,
+		StorageClass:         c.StorageClass,
+		Tagging:              c.tagging(),
+		ChecksumAlgorithm:    c.Checksum,
+	})
+	if err != nil {
+		return fmt.Errorf("create upload: %w", err)
+	}
+
+	ps := opts.partSize(size)
+	var mu sync.Mutex
+	var parts []types.CompletedPart
+
+	g, start := taskgroup.New(nil).Limit(opts.concurrency())
+	for i, off := int32(1), int64(0); off < size || i == 1; i, off = i+1, off+ps {
+		n := min(ps, size-off)
+		start(func() error {
+			rsp, err := c.Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:            &c.Bucket,
+				RequestPayer:      c.payer(),
+				Key:               &key,
+				UploadId:          mp.UploadId,
+				PartNumber:        value.Ptr(i),
+				Body:              io.NewSectionReader(r, off, n),
+				ContentLength:     value.Ptr(n),
+				ChecksumAlgorithm: c.Checksum,
+			})
+			if err != nil {
+				return fmt.Errorf("upload part %d: %w", i, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			parts = append(parts, types.CompletedPart{
+				ETag:           rsp.ETag,
+				PartNumber:     value.Ptr(i),
+				ChecksumCRC32:  rsp.ChecksumCRC32,
+				ChecksumCRC32C: rsp.ChecksumCRC32C,
+				ChecksumSHA1:   rsp.ChecksumSHA1,
+				ChecksumSHA256: rsp.ChecksumSHA256,
+			})
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		c.abortMultipart(ctx, key, mp.UploadId)
+		return err
+	}
+
+	slices.SortFunc(parts, func(a, b types.CompletedPart) int {
+		return int(*a.PartNumber - *b.PartNumber)
+	})
+	if _, err := c.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &c.Bucket,
+		RequestPayer:    c.payer(),
+		Key:             &key,
+		UploadId:        mp.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		c.abortMultipart(ctx, key, mp.UploadId)
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	return nil
+}
+
+// abortMultipart makes a best effort to abort the specified upload.
+// It ignores cancellation of ctx, since the upload may have failed for that
+// reason.
+func (c *Client) abortMultipart(ctx context.Context, key string, uploadID *string) {
+	c.Client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+		UploadId:     uploadID,
+	})
+}
+
+// PutMultipartCond writes the first size bytes of r to S3 under the given key
+// using a multipart upload, if the key does not already exist or its content
+// differs from r. On success, written reports whether the object was written.
+//
+// The check compares the multipart ETag of r, so it only matches objects that
+// were uploaded with the same part size.
+func (c *Client) PutMultipartCond(ctx context.Context, key string, r io.ReaderAt, size int64, opts MultipartOptions) (written bool, _ error) {
+	if c.ReadOnly {
+		return false, ErrReadOnly
+	}
+	etag, err := MultipartETag(r, size, opts)
+	if err != nil {
+		return false, err
+	}
+	if c.hasETag(ctx, key, etag) {
+		return false, nil
+	}
+	return true, c.putMultipart(ctx, key, etag, r, size, opts)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Retry modes for a [RetryPolicy].
+const (
+	// RetryStandard retries failed requests with exponential backoff and
+	// jitter.
+	RetryStandard = "standard"
+
+	// RetryAdaptive is as RetryStandard, but also limits the rate of requests
+	// sent by the client when S3 throttles them.
+	RetryAdaptive = "adaptive"
+)
+
+// ParseRetryMode checks that name is a valid retry mode, and returns it. An
+// empty name is [RetryStandard].
+func ParseRetryMode(name string) (string, error) {
+	switch name {
+	case "":
+		return RetryStandard, nil
+	case RetryStandard, RetryAdaptive:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown retry mode %q (want %s or %s)", name, RetryStandard, RetryAdaptive)
+}
+
+// A RetryPolicy are the settings for retrying failed requests to S3. The zero
+// value uses the defaults of the AWS SDK: the standard mode, 3 attempts, a
+// backoff of at most 20s, and a retry quota shared by the requests of the
+// client, which stops retries when many requests fail at once.
+//
+// During a brownout of S3, the default policy gives up quickly. To ride one
+// out, allow more attempts with a longer backoff, and disable the quota.
+type RetryPolicy struct {
+	// Mode is the retry mode: [RetryStandard] (the default, if empty) or
+	// [RetryAdaptive].
+	Mode string
+
+	// MaxAttempts, if positive, is the maximum number of attempts for a
+	// request, including the first.
+	MaxAttempts int
+
+	// MaxBackoff, if positive, is the longest delay between attempts.
+	MaxBackoff time.Duration
+
+	// Timeout, if positive, bounds how long each attempt waits for S3 to
+	// respond. An attempt that times out is retried. It does not limit the
+	// time taken to send a request body or read a response body, so it is
+	// safe to use with large objects.
+	Timeout time.Duration
+
+	// NoQuota, if true, disables the retry quota, so that every failed
+	// request is retried up to MaxAttempts.
+	NoQuota bool
+
+	// Stats, if non-nil, counts the retries made under the policy.
+	Stats *RetryStats
+}
+
+// Apply sets the retryer of o, and if Timeout is set, its HTTP client, to
+// implement p. Call it before wrapping the HTTP client, as with
+// [ThrottleClient].
+func (p RetryPolicy) Apply(o *s3.Options) {
+	std := func(so *retry.StandardOptions) {
+		if p.MaxAttempts > 0 {
+			so.MaxAttempts = p.MaxAttempts
+		}
+		if p.MaxBackoff > 0 {
+			so.MaxBackoff = p.MaxBackoff
+			so.Backoff = retry.NewExponentialJitterBackoff(p.MaxBackoff)
+		}
+		if p.NoQuota {
+			so.RateLimiter = ratelimit.None
+		}
+	}
+	var r aws.RetryerV2
+	if p.Mode == RetryAdaptive {
+		r = retry.NewAdaptiveMode(func(ao *retry.AdaptiveModeOptions) {
+			ao.StandardOptions = append(ao.StandardOptions, std)
+		})
+	} else {
+		r = retry.NewStandard(std)
+	}
+	if p.Stats != nil {
+		r = countingRetryer{RetryerV2: r, stats: p.Stats}
+	}
+	o.Retryer = r
+	o.RetryMaxAttempts = 0 // use the retryer as given
+
+	if p.Timeout > 0 {
+		switch c := o.HTTPClient.(type) {
+		case *awshttp.BuildableClient:
+			o.HTTPClient = c.WithTransportOptions(func(t *http.Transport) {
+				t.ResponseHeaderTimeout = p.Timeout
+			})
+		case nil:
+			o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+				t.ResponseHeaderTimeout = p.Timeout
+			})
+		}
+	}
+}
+
+// RetryStats count the retries of requests to S3 under a [RetryPolicy]. A
+// RetryStats may be shared by several policies. A zero RetryStats is ready for
+// use.
+type RetryStats struct {
+	retries   expvar.Int // count of failed attempts retried
+	throttled expvar.Int // count of attempts retried because S3 throttled them
+	delay     expvar.Int // total milliseconds of backoff before retries
+}
+
+// Metrics returns a map of the retry metrics.
+func (s *RetryStats) Metrics() *expvar.Map {
+	m := new(expvar.Map)
+	m.Set("retries", &s.retries)
+	m.Set("retries_throttled", &s.throttled)
+	m.Set("retry_delay_ms", &s.delay)
+	return m
+}
+
+// Retries reports the number of retries counted by s.
+func (s *RetryStats) Retries() int64 { return s.retries.Value() }
+
+// countingRetryer is a retryer that counts the retries of another in stats.
+type countingRetryer struct {
+	aws.RetryerV2
+	stats *RetryStats
+}
+
+// isThrottle reports whether an error reports that S3 throttled a request.
+var isThrottle = retry.IsErrorThrottles(retry.DefaultThrottles)
+
+func (c countingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	d, derr := c.RetryerV2.RetryDelay(attempt, err)
+	if derr == nil {
+		c.stats.retries.Add(1)
+		c.stats.delay.Add(d.Milliseconds())
+		if isThrottle.IsErrorThrottle(err) == aws.TrueTernary {
+			c.stats.throttled.Add(1)
+		}
+	}
+	return d, derr
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	// The server throttles the requests numbered up to 2, and stalls the
+	// third.
+	var nreq atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := nreq.Add(1); {
+		case n <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+		case n == 3:
+			time.Sleep(500 * time.Millisecond)
+			fallthrough
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+
+	stats := new(s3util.RetryStats)
+	policy := s3util.RetryPolicy{
+		MaxAttempts: 5,
+		MaxBackoff:  time.Millisecond,
+		Timeout:     100 * time.Millisecond,
+		NoQuota:     true,
+		Stats:       stats,
+	}
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+		}, policy.Apply),
+		Bucket: "test",
+	}
+	data, err := c.GetData(context.Background(), "key")
+	if err != nil || string(data) != "ok" {
+		t.Fatalf("GetData: got %q, %v; want ok", data, err)
+	}
+	if got := stats.Retries(); got != 3 {
+		t.Errorf("Retries: got %d, want 3", got)
+	}
+	if got := stats.Metrics().Get("retries_throttled").String(); got != "2" {
+		t.Errorf("Throttled retries: got %s, want 2", got)
+	}
+
+	// With the default policy, the request fails after 3 attempts.
+	nreq.Store(-10)
+	c.Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}, s3util.RetryPolicy{MaxBackoff: time.Millisecond}.Apply)
+	if _, err := c.GetData(context.Background(), "key"); err == nil {
+		t.Error("GetData: got nil, want error")
+	}
+}
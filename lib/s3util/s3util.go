@@ -5,6 +5,7 @@
 package s3util
 
 import (
+	"bytes"
 	"cmp"
 	"context"
 	"crypto/md5"
@@ -13,8 +14,10 @@ import (
 	"hash"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -32,14 +35,30 @@ func IsNotExist(err error) bool {
 	return errors.Is(err, os.ErrNotExist)
 }
 
+// IsARN reports whether bucket is an Amazon Resource Name (ARN) rather than a
+// plain bucket name, for example an S3 Access Point or Object Lambda Access
+// Point ARN. The S3 client accepts such ARNs wherever a bucket name is used.
+func IsARN(bucket string) bool { return arn.IsARN(bucket) }
+
 // BucketRegion reports the specified region for the given bucket using the
-// GetBucketLocation API.
+// GetBucketLocation API. If bucket is an access point ARN, its region is taken
+// from the ARN without calling the API.
 func BucketRegion(ctx context.Context, bucket string) (string, error) {
 	// The default AWS region, which we use for resolving the bucket location
 	// and also serves as the fallback if the API reports an empty region name.
 	// The API returns "" for buckets in this region for historical reasons.
 	const defaultRegion = "us-east-1"
 
+	if IsARN(bucket) {
+		a, err := arn.Parse(bucket)
+		if err != nil {
+			return "", err
+		} else if a.Region == "" {
+			return "", fmt.Errorf("ARN %q does not specify a region", bucket)
+		}
+		return a.Region, nil
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(defaultRegion))
 	if err != nil {
 		return "", err
@@ -80,10 +99,98 @@ func (e ETagReader) ETag() string { return fmt.Sprintf("%x", e.hash.Sum(nil)) }
 type Client struct {
 	Client *s3.Client
 	Bucket string
+
+	// Encryption are the server-side encryption settings for objects written
+	// by the client. The zero value uses the bucket default.
+	Encryption Encryption
+
+	// StorageClass, if non-empty, is the storage class of objects written by
+	// the client (see [ParseStorageClass]). Otherwise, the class is STANDARD.
+	StorageClass types.StorageClass
+
+	// Tags, if non-empty, are the tags of objects written by the client (see
+	// [ParseTags]), which lifecycle rules and cost allocation reports of the
+	// bucket may select on. Objects copied by CopyFrom keep their own tags.
+	// Writing tags requires the s3:PutObjectTagging permission.
+	Tags map[string]string
+
+	// Checksum, if non-empty, is the algorithm of the checksum sent with the
+	// contents of each object written by the client, which S3 verifies and
+	// stores with the object (see [ParseChecksum]). If empty, the default of
+	// the AWS SDK applies.
+	Checksum types.ChecksumAlgorithm
+
+	// VerifyChecksums, if true, means that Get requests the checksum stored
+	// with each object, and verifies the contents read against it, so that
+	// contents corrupted in transit are reported as [ErrCorrupt] rather than
+	// returned. Objects stored without a checksum, or with the checksum of
+	// the parts of a multipart upload, are read without verification.
+	VerifyChecksums bool
+
+	// ChecksumStats, if non-nil, counts the outcomes of the verification of
+	// checksums by Get.
+	ChecksumStats *ChecksumStats
+
+	// Envelope, if non-nil, encrypts the contents of objects written by the
+	// client before they are sent to S3, and decrypts those it reads (see
+	// [Envelope]). This is in addition to any server-side Encryption.
+	Envelope *Envelope
+
+	// ReadOnly, if true, means that the client does not write to or delete
+	// from the bucket: each method that would do so reports [ErrReadOnly]
+	// without sending a request. This suits a public bucket read with
+	// anonymous credentials.
+	ReadOnly bool
+
+	// RequesterPays, if true, means that requests by the client accept the
+	// charges for a bucket configured so that the requester pays, as when
+	// reading a bucket owned by another account. Requests to such a bucket
+	// fail without it.
+	RequesterPays bool
+
+	// Hedge, if non-nil, sends a second request for an object read by Get
+	// when the response to the first is slow, and uses the first to respond
+	// (see [Hedge]).
+	Hedge *Hedge
+}
+
+// ErrReadOnly is reported by the methods of a [Client] that would write to or
+// delete from its bucket, if the client is ReadOnly.
+var ErrReadOnly = errors.New("s3 client is read-only")
+
+// payer returns the RequestPayer of the requests of c.
+func (c *Client) payer() types.RequestPayer {
+	if c.RequesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
 }
 
 // Put writes the specified data to S3 under the given key.
 func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
+	return c.put(ctx, key, "", data)
+}
+
+// put writes the specified data to S3 under the given key. If etag != "", it
+// is the ETag of the data, recorded in the object metadata if necessary for a
+// later conditional put to recognize it.
+func (c *Client) put(ctx context.Context, key, etag string, data io.Reader) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	meta := c.etagMetadata(etag)
+	if c.Envelope != nil {
+		plain, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		sealed, cse, err := c.Envelope.seal(ctx, key, etag, plain)
+		if err != nil {
+			return err
+		}
+		data, meta = bytes.NewReader(sealed), mergeMetadata(meta, cse)
+	}
+
 	// Attempt to find the size of the input to send as a content length.
 	// If we can't do this, let the SDK figure it out.
 	var sizePtr *int64
@@ -108,11 +215,20 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 			}
 		}
 	}
+	sse, kmsKey, bucketKey := c.Encryption.params()
 	_, err := c.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:        &c.Bucket,
-		Key:           &key,
-		Body:          data,
-		ContentLength: sizePtr,
+		Bucket:               &c.Bucket,
+		RequestPayer:         c.payer(),
+		Key:                  &key,
+		Body:                 data,
+		ContentLength:        sizePtr,
+		Metadata:             meta,
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKey,
+		BucketKeyEnabled:     bucketKey,
+		StorageClass:         c.StorageClass,
+		Tagging:              c.tagging(),
+		ChecksumAlgorithm:    c.Checksum,
 	})
 	return err
 }
@@ -123,16 +239,40 @@ func (c *Client) Put(ctx context.Context, key string, data io.Reader) error {
 //
 // If the key is not found, the resulting error satisfies [fs.ErrNotExist].
 func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
-	rsp, err := c.Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &c.Bucket,
-		Key:    &key,
-	})
+	getObject := func(ctx context.Context) (*s3.GetObjectOutput, error) {
+		return c.Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:       &c.Bucket,
+			RequestPayer: c.payer(),
+			Key:          &key,
+			ChecksumMode: c.checksumMode(),
+		})
+	}
+	var rsp *s3.GetObjectOutput
+	var err error
+	if c.Hedge != nil {
+		rsp, err = c.Hedge.get(ctx, getObject)
+	} else {
+		rsp, err = getObject(ctx)
+	}
 	if err != nil {
 		if IsNotExist(err) {
 			return nil, -1, fmt.Errorf("key %q: %w", key, fs.ErrNotExist)
 		}
 		return nil, -1, err
 	}
+	rsp.Body = c.checkBody(key, rsp)
+	if c.Envelope != nil {
+		defer rsp.Body.Close()
+		data, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			return nil, -1, err
+		}
+		plain, err := c.Envelope.open(ctx, key, rsp.Metadata, data)
+		if err != nil {
+			return nil, -1, fmt.Errorf("key %q: %w", key, err)
+		}
+		return io.NopCloser(bytes.NewReader(plain)), int64(len(plain)), nil
+	}
 	return rsp.Body, *rsp.ContentLength, nil
 }
 
@@ -152,14 +292,65 @@ func (c *Client) GetData(ctx context.Context, key string) ([]byte, error) {
 // The etag is an MD5 of the expected contents, encoded as lowercase hex digits.
 // On success, written reports whether the object was written.
 func (c *Client) PutCond(ctx context.Context, key, etag string, data io.Reader) (written bool, _ error) {
-	if _, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket:  &c.Bucket,
-		Key:     &key,
-		IfMatch: &etag,
-	}); err == nil {
+	if c.ReadOnly {
+		return false, ErrReadOnly
+	}
+	if c.hasETag(ctx, key, etag) {
 		return false, nil
 	}
-	return true, c.Put(ctx, key, data)
+	return true, c.put(ctx, key, etag, data)
+}
+
+// hasETag reports whether key exists in S3 with the given etag.
+//
+// When the client uses KMS or client-side encryption, the ETag reported by S3
+// is not derived from the contents of the object, so instead the etag is
+// compared with the one recorded in the object metadata when it was written.
+func (c *Client) hasETag(ctx context.Context, key, etag string) bool {
+	if c.opaqueETags() {
+		rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       &c.Bucket,
+			RequestPayer: c.payer(),
+			Key:          &key,
+		})
+		if err != nil {
+			return false
+		} else if c.Envelope != nil {
+			return c.Envelope.checkETag(ctx, key, rsp.Metadata, etag)
+		}
+		return rsp.Metadata[etagMetadata] == etag
+	}
+	_, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+		IfMatch:      &etag,
+	})
+	return err == nil
+}
+
+// etagMetadata returns the object metadata to record etag, or nil if none is
+// needed. With an Envelope, the etag is recorded encrypted by its seal
+// instead, since the digest of the contents would reveal them to be equal to
+// a guess.
+func (c *Client) etagMetadata(etag string) map[string]string {
+	if etag == "" || !c.opaqueETags() || c.Envelope != nil {
+		return nil
+	}
+	return map[string]string{etagMetadata: etag}
+}
+
+// opaqueETags reports whether objects written by c have ETags that are not the
+// MD5 digest of their contents.
+func (c *Client) opaqueETags() bool { return c.Envelope != nil || c.Encryption.opaqueETags() }
+
+// mergeMetadata returns the union of the metadata a and b.
+func mergeMetadata(a, b map[string]string) map[string]string {
+	if a == nil {
+		return b
+	}
+	maps.Copy(a, b)
+	return a
 }
 
 // A sizer exports a Size method, e.g., [bytes.Reader] and similar.
@@ -5,12 +5,23 @@ package s3util_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/xml"
+	"errors"
 	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/grafana/go-cache-plugin/lib/s3util"
 )
 
@@ -40,3 +51,322 @@ func TestETagReader(t *testing.T) {
 		t.Errorf("Wrong result: got %x, want %x", got, want)
 	}
 }
+
+func TestBucketRegionARN(t *testing.T) {
+	tests := []struct {
+		bucket, want string
+	}{
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/build-cache", "us-west-2"},
+		{"arn:aws:s3-object-lambda:eu-west-1:123456789012:accesspoint/cache-olap", "eu-west-1"},
+	}
+	for _, tc := range tests {
+		if !s3util.IsARN(tc.bucket) {
+			t.Errorf("IsARN(%q): got false, want true", tc.bucket)
+		}
+		got, err := s3util.BucketRegion(context.Background(), tc.bucket)
+		if err != nil {
+			t.Errorf("BucketRegion(%q): unexpected error: %v", tc.bucket, err)
+		} else if got != tc.want {
+			t.Errorf("BucketRegion(%q): got %q, want %q", tc.bucket, got, tc.want)
+		}
+	}
+	if s3util.IsARN("plain-bucket-name") {
+		t.Error("IsARN(plain-bucket-name): got true, want false")
+	}
+}
+
+func TestMultipartETag(t *testing.T) {
+	// Two parts at the minimum part size: one full, one partial.
+	data := bytes.Repeat([]byte("x"), 5<<20+100)
+	p1, p2 := md5.Sum(data[:5<<20]), md5.Sum(data[5<<20:])
+	all := md5.Sum(append(p1[:], p2[:]...))
+	want := hex.EncodeToString(all[:]) + "-2"
+
+	got, err := s3util.MultipartETag(bytes.NewReader(data), int64(len(data)), s3util.MultipartOptions{PartSize: 1})
+	if err != nil {
+		t.Fatalf("MultipartETag: unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("MultipartETag: got %q, want %q", got, want)
+	}
+}
+
+func TestParseEncryption(t *testing.T) {
+	const key = "arn:aws:kms:us-west-2:123456789012:key/example"
+	tests := []struct {
+		mode, key string
+		bucket    bool
+		want      s3util.Encryption
+		ok        bool
+	}{
+		{"", "", false, s3util.Encryption{}, true},
+		{"none", "", false, s3util.Encryption{}, true},
+		{"s3", "", false, s3util.Encryption{Mode: types.ServerSideEncryptionAes256}, true},
+		{"kms", "", true, s3util.Encryption{Mode: types.ServerSideEncryptionAwsKms, BucketKey: true}, true},
+		{"", key, false, s3util.Encryption{Mode: types.ServerSideEncryptionAwsKms, KMSKeyID: key}, true},
+		{"dsse", key, false, s3util.Encryption{Mode: types.ServerSideEncryptionAwsKmsDsse, KMSKeyID: key}, true},
+		{"s3", key, false, s3util.Encryption{}, false},
+		{"none", "", true, s3util.Encryption{}, false},
+		{"bogus", "", false, s3util.Encryption{}, false},
+	}
+	for _, tc := range tests {
+		got, err := s3util.ParseEncryption(tc.mode, tc.key, tc.bucket)
+		if tc.ok && err != nil {
+			t.Errorf("ParseEncryption(%q, %q, %v): unexpected error: %v", tc.mode, tc.key, tc.bucket, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("ParseEncryption(%q, %q, %v): got %+v, want error", tc.mode, tc.key, tc.bucket, got)
+		} else if got != tc.want {
+			t.Errorf("ParseEncryption(%q, %q, %v): got %+v, want %+v", tc.mode, tc.key, tc.bucket, got, tc.want)
+		}
+	}
+}
+
+func TestParseStorageClass(t *testing.T) {
+	tests := []struct {
+		name string
+		want types.StorageClass
+		ok   bool
+	}{
+		{"", "", true},
+		{"STANDARD_IA", types.StorageClassStandardIa, true},
+		{"intelligent-tiering", types.StorageClassIntelligentTiering, true},
+		{"glacier_ir", types.StorageClassGlacierIr, true},
+		{"GLACIER", "", false},
+		{"deep-archive", "", false},
+		{"bogus", "", false},
+	}
+	for _, tc := range tests {
+		got, err := s3util.ParseStorageClass(tc.name)
+		if tc.ok && err != nil {
+			t.Errorf("ParseStorageClass(%q): unexpected error: %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("ParseStorageClass(%q): got %q, want error", tc.name, got)
+		} else if got != tc.want {
+			t.Errorf("ParseStorageClass(%q): got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestThrottleClient(t *testing.T) {
+	const rate, size = 100000, 150000
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+	defer srv.Close()
+
+	// Each limit admits a burst of one second's worth, so transferring the
+	// rest of the data must take about half a second more.
+	check := func(t *testing.T, c s3.HTTPClient, body io.Reader) {
+		t.Helper()
+		req, err := http.NewRequest("PUT", srv.URL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		rsp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		n, err := io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+		if err != nil || n != size {
+			t.Fatalf("Read body: got %d bytes, %v; want %d", n, err, size)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("Transfer took %v, want at least 400ms", elapsed)
+		}
+	}
+	t.Run("Upload", func(t *testing.T) {
+		c := s3util.ThrottleClient(srv.Client(), s3util.NewThrottle(rate), nil)
+		check(t, c, bytes.NewReader(make([]byte, size)))
+	})
+	t.Run("Download", func(t *testing.T) {
+		c := s3util.ThrottleClient(srv.Client(), nil, s3util.NewThrottle(rate))
+		check(t, c, http.NoBody)
+	})
+}
+
+func TestDeleteBatch(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["delete"]; r.Method != "POST" || !ok {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, obj := range req.Objects {
+			got = append(got, obj.Key)
+		}
+		io.WriteString(w, `<DeleteResult><Error><Key>b</Key><Code>AccessDenied</Code><Message>nope</Message></Error></DeleteResult>`)
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			HTTPClient:   srv.Client(),
+		}),
+		Bucket: "test",
+	}
+	failed, err := c.DeleteBatch(context.Background(), []string{"a", "b", "c/d"})
+	if err != nil {
+		t.Fatalf("DeleteBatch: unexpected error: %v", err)
+	}
+	if want := []string{"a", "b", "c/d"}; !slices.Equal(got, want) {
+		t.Errorf("Deleted keys: got %q, want %q", got, want)
+	}
+	if len(failed) != 1 || failed["b"] == nil {
+		t.Errorf("Failed: got %v, want only b", failed)
+	}
+
+	if _, err := c.DeleteBatch(context.Background(), make([]string, s3util.MaxDeleteBatch+1)); err == nil {
+		t.Error("DeleteBatch: got nil error for too many keys")
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	var payers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payers = append(payers, r.Header.Get("X-Amz-Request-Payer"))
+		if r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+			io.WriteString(w, `<ListBucketResult></ListBucketResult>`)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:                     "us-east-1",
+			BaseEndpoint:               aws.String(srv.URL),
+			UsePathStyle:               true,
+			Credentials:                aws.AnonymousCredentials{},
+			HTTPClient:                 srv.Client(),
+			RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		}),
+		Bucket:        "test",
+		RequesterPays: true,
+	}
+	ctx := context.Background()
+	if _, err := c.GetData(ctx, "a"); err != nil {
+		t.Fatalf("GetData: %v", err)
+	}
+	if err := c.Put(ctx, "b", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.List(ctx, "", func(s3util.ObjectInfo) error { return nil }); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"requester", "requester", "requester"}; !slices.Equal(payers, want) {
+		t.Errorf("Request payers: got %q, want %q", payers, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			t.Errorf("Unexpected %s request for %s", r.Method, r.URL.Path)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(srv.URL),
+			UsePathStyle: true,
+			Credentials:  aws.AnonymousCredentials{},
+			HTTPClient:   srv.Client(),
+		}),
+		Bucket:   "test",
+		ReadOnly: true,
+	}
+	ctx := context.Background()
+	if data, err := c.GetData(ctx, "a"); err != nil || string(data) != "ok" {
+		t.Errorf("GetData: got %q, %v; want ok", data, err)
+	}
+	if err := c.Put(ctx, "b", strings.NewReader("data")); !errors.Is(err, s3util.ErrReadOnly) {
+		t.Errorf("Put: got %v, want %v", err, s3util.ErrReadOnly)
+	}
+	if _, err := c.PutCond(ctx, "b", "etag", strings.NewReader("data")); !errors.Is(err, s3util.ErrReadOnly) {
+		t.Errorf("PutCond: got %v, want %v", err, s3util.ErrReadOnly)
+	}
+	if err := c.Delete(ctx, "a"); !errors.Is(err, s3util.ErrReadOnly) {
+		t.Errorf("Delete: got %v, want %v", err, s3util.ErrReadOnly)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		input string
+		want  map[string]string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"job=1234", map[string]string{"job": "1234"}, true},
+		{"repo=grafana/app, branch=main ,go=go1.24.1", map[string]string{
+			"repo": "grafana/app", "branch": "main", "go": "go1.24.1",
+		}, true},
+		{"empty=", map[string]string{"empty": ""}, true},
+		{"eq=a=b", map[string]string{"eq": "a=b"}, true},
+		{"novalue", nil, false},
+		{"=value", nil, false},
+		{"a=1,a=2", nil, false},
+		{"aws:team=x", nil, false},
+		{"bad=a;b", nil, false},
+		{"a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8,i=9,j=10,k=11", nil, false},
+		{"long=" + strings.Repeat("x", 257), nil, false},
+	}
+	for _, tc := range tests {
+		got, err := s3util.ParseTags(tc.input)
+		if tc.ok && err != nil {
+			t.Errorf("ParseTags(%q): unexpected error: %v", tc.input, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("ParseTags(%q): got %v, want error", tc.input, got)
+		} else if !maps.Equal(got, tc.want) {
+			t.Errorf("ParseTags(%q): got %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	var tagging []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			tagging = append(tagging, r.Header.Get("X-Amz-Tagging"))
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	c := &s3util.Client{
+		Client: s3.New(s3.Options{
+			Region:                     "us-east-1",
+			BaseEndpoint:               aws.String(srv.URL),
+			UsePathStyle:               true,
+			Credentials:                aws.AnonymousCredentials{},
+			HTTPClient:                 srv.Client(),
+			RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		}),
+		Bucket: "test",
+		Tags:   map[string]string{"repo": "grafana/app", "job": "build 7"},
+	}
+	if err := c.Put(context.Background(), "a", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if want := []string{"job=build%207&repo=grafana%2Fapp"}; !slices.Equal(tagging, want) {
+		t.Errorf("Tagging: got %q, want %q", tagging, want)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Encryption are the server-side encryption settings applied to each object
+// written by a [Client]. The zero value sends no encryption settings, so that
+// the default encryption configured for the bucket applies.
+//
+// The settings are sent explicitly with each request that creates an object,
+// so that they satisfy bucket policies that deny writes lacking them (for
+// example, by a condition on s3:x-amz-server-side-encryption).
+type Encryption struct {
+	// Mode is the server-side encryption algorithm: one of
+	// [types.ServerSideEncryptionAes256] (SSE-S3),
+	// [types.ServerSideEncryptionAwsKms] (SSE-KMS), or
+	// [types.ServerSideEncryptionAwsKmsDsse] (DSSE-KMS).
+	// If empty, the bucket default applies.
+	Mode types.ServerSideEncryption
+
+	// KMSKeyID is the ID or ARN of the KMS key used for SSE-KMS and DSSE-KMS.
+	// If empty, S3 uses the AWS managed key for S3. It is ignored for other
+	// modes.
+	KMSKeyID string
+
+	// BucketKey, if true, enables an S3 Bucket Key for SSE-KMS, which reduces
+	// the number of requests S3 makes to KMS. It is ignored for other modes.
+	BucketKey bool
+}
+
+// ParseEncryption returns encryption settings for the given mode name and KMS
+// key. The mode is "" or "none" (the bucket default), "s3" (SSE-S3), "kms"
+// (SSE-KMS), or "dsse" (DSSE-KMS). If a key is given with no mode, the mode
+// defaults to "kms".
+func ParseEncryption(mode, kmsKeyID string, bucketKey bool) (Encryption, error) {
+	var m types.ServerSideEncryption
+	switch mode {
+	case "", "none":
+		if kmsKeyID != "" {
+			m = types.ServerSideEncryptionAwsKms
+		}
+	case "s3", "AES256":
+		m = types.ServerSideEncryptionAes256
+	case "kms", "aws:kms":
+		m = types.ServerSideEncryptionAwsKms
+	case "dsse", "aws:kms:dsse":
+		m = types.ServerSideEncryptionAwsKmsDsse
+	default:
+		return Encryption{}, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+	if !usesKMS(m) && (kmsKeyID != "" || bucketKey) {
+		return Encryption{}, fmt.Errorf("a KMS key or bucket key requires KMS encryption (mode %q)", mode)
+	}
+	return Encryption{Mode: m, KMSKeyID: kmsKeyID, BucketKey: bucketKey}, nil
+}
+
+// opaqueETags reports whether objects written with e have ETags that are not
+// the MD5 digest of their contents. This is the case for SSE-KMS and DSSE-KMS.
+func (e Encryption) opaqueETags() bool { return usesKMS(e.Mode) }
+
+// params returns the request parameters for e, suitable for a PutObject or
+// CreateMultipartUpload request.
+func (e Encryption) params() (mode types.ServerSideEncryption, keyID *string, bucketKey *bool) {
+	if e.Mode == "" {
+		return "", nil, nil
+	}
+	if usesKMS(e.Mode) {
+		if e.KMSKeyID != "" {
+			keyID = &e.KMSKeyID
+		}
+		if e.BucketKey {
+			bucketKey = &e.BucketKey
+		}
+	}
+	return e.Mode, keyID, bucketKey
+}
+
+// usesKMS reports whether m is an encryption mode that uses KMS keys.
+func usesKMS(m types.ServerSideEncryption) bool {
+	return m == types.ServerSideEncryptionAwsKms || m == types.ServerSideEncryptionAwsKmsDsse
+}
+
+// etagMetadata is the user metadata key where a [Client] records the MD5
+// digest of an object's contents, when the ETag reported by S3 is not.
+const etagMetadata = "content-etag"
@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// archiveClasses are storage classes whose objects must be restored before
+// they can be read, which makes them unsuitable for a cache.
+var archiveClasses = []types.StorageClass{
+	types.StorageClassGlacier,
+	types.StorageClassDeepArchive,
+}
+
+// ParseStorageClass returns the storage class with the given name, such as
+// "STANDARD_IA" or "intelligent-tiering" (case and the choice of dashes or
+// underscores do not matter). An empty name returns "", meaning the bucket
+// default applies. Archive classes, whose objects cannot be read without a
+// restore, are rejected.
+func ParseStorageClass(name string) (types.StorageClass, error) {
+	if name == "" {
+		return "", nil
+	}
+	sc := types.StorageClass(strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+	if slices.Contains(archiveClasses, sc) {
+		return "", fmt.Errorf("storage class %q requires a restore to read objects", name)
+	} else if !slices.Contains(sc.Values(), sc) {
+		return "", fmt.Errorf("unknown storage class %q", name)
+	}
+	return sc, nil
+}
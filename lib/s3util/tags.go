@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits of S3 on the tags of an object.
+const (
+	maxTags        = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// ParseTags parses a comma-separated list of object tags of the form
+// "key=value", for [Client.Tags]. An empty list returns nil. Keys and values
+// may contain letters, digits, spaces, and the characters "+-=._:/@", within
+// the limits of S3 on their number and length. Keys beginning with "aws:" are
+// reserved by AWS.
+func ParseTags(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag %q (want key=value)", kv)
+		} else if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("duplicate tag key %q", k)
+		} else if strings.HasPrefix(k, "aws:") {
+			return nil, fmt.Errorf("tag key %q uses the reserved prefix aws:", k)
+		} else if utf8.RuneCountInString(k) > maxTagKeyLen {
+			return nil, fmt.Errorf("tag key %q is longer than %d characters", k, maxTagKeyLen)
+		} else if utf8.RuneCountInString(v) > maxTagValueLen {
+			return nil, fmt.Errorf("value of tag %q is longer than %d characters", k, maxTagValueLen)
+		} else if !validTag(k) || !validTag(v) {
+			return nil, fmt.Errorf("tag %q contains an invalid character", kv)
+		}
+		tags[k] = v
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("%d tags given, S3 allows at most %d", len(tags), maxTags)
+	}
+	return tags, nil
+}
+
+// validTag reports whether s contains only the characters S3 allows in the
+// key or value of a tag.
+func validTag(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r) && !strings.ContainsRune("+-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagging returns the tags of c encoded for a request, or nil if it has none.
+func (c *Client) tagging() *string {
+	if len(c.Tags) == 0 {
+		return nil
+	}
+	esc := func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	var parts []string
+	for _, k := range slices.Sorted(maps.Keys(c.Tags)) {
+		parts = append(parts, esc(k)+"="+esc(c.Tags[k]))
+	}
+	s := strings.Join(parts, "&")
+	return &s
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A Throttle limits the rate of data transfer with a token bucket. A Throttle
+// is safe for concurrent use, and transfers sharing it divide its rate.
+// A nil *Throttle imposes no limit.
+type Throttle struct {
+	rate  float64 // bytes per second
+	burst int     // largest transfer admitted at once
+
+	mu     sync.Mutex
+	tokens float64 // may be negative while transfers wait
+	last   time.Time
+}
+
+// NewThrottle returns a Throttle that admits up to rate bytes per second, in
+// bursts of up to one second's worth. If rate <= 0, it returns nil.
+func NewThrottle(rate int64) *Throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &Throttle{
+		rate:   float64(rate),
+		burst:  int(min(rate, 1<<30)),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a transfer of n bytes is admitted, or until ctx ends.
+func (t *Throttle) wait(ctx context.Context, n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens = min(t.tokens+now.Sub(t.last).Seconds()*t.rate, float64(t.burst))
+	t.last = now
+	t.tokens -= float64(n)
+	delay := time.Duration(-t.tokens / t.rate * float64(time.Second))
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	tm := time.NewTimer(delay)
+	defer tm.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-tm.C:
+		return nil
+	}
+}
+
+// Reader returns a reader that reads from r at the rate admitted by t.
+// If t == nil, it returns r unmodified.
+func (t *Throttle) Reader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return r
+	}
+	return throttledReader{ctx: ctx, r: r, t: t}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+	t   *Throttle
+}
+
+func (r throttledReader) Read(data []byte) (int, error) {
+	if len(data) > r.t.burst {
+		data = data[:r.t.burst]
+	}
+	n, err := r.r.Read(data)
+	if n > 0 {
+		if werr := r.t.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (r throttledReader) Close() error { return r.r.Close() }
+
+// ThrottleClient returns an HTTP client for S3 that sends requests with c,
+// limiting the rate at which request bodies are sent to up and the rate at
+// which response bodies are received to down. Either may be nil.
+//
+// Use it to set the HTTPClient field of the [s3.Options] for a client.
+func ThrottleClient(c s3.HTTPClient, up, down *Throttle) s3.HTTPClient {
+	if up == nil && down == nil {
+		return c
+	}
+	return throttledClient{c: c, up: up, down: down}
+}
+
+type throttledClient struct {
+	c        s3.HTTPClient
+	up, down *Throttle
+}
+
+func (c throttledClient) Do(req *http.Request) (*http.Response, error) {
+	if c.up != nil && req.Body != nil && req.Body != http.NoBody {
+		ctx := req.Context()
+		req = req.Clone(ctx)
+		req.Body = c.up.Reader(ctx, req.Body)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return c.up.Reader(ctx, body), nil
+			}
+		}
+	}
+	rsp, err := c.c.Do(req)
+	if err == nil && c.down != nil {
+		rsp.Body = c.down.Reader(req.Context(), rsp.Body)
+	}
+	return rsp, err
+}
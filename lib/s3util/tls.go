@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TLSFiles name the files of the TLS settings for an S3 endpoint, such as a
+// MinIO server, whose certificate is issued by a private CA, or that requires
+// clients to present a certificate. The zero value uses the defaults of the
+// AWS SDK.
+type TLSFiles struct {
+	// CAFile, if non-empty, is a file of PEM certificates of the CAs trusted
+	// to issue the certificate of the endpoint, in addition to those of the
+	// system.
+	CAFile string
+
+	// CertFile, if non-empty, is a file of the PEM certificate presented to
+	// the endpoint by the client.
+	CertFile string
+
+	// KeyFile is a file of the PEM private key of the client certificate. If
+	// empty, the key is read from CertFile.
+	KeyFile string
+}
+
+// Config returns a TLS configuration with the settings of t, or nil if t is
+// the zero value.
+func (t TLSFiles) Config() (*tls.Config, error) {
+	if t == (TLSFiles{}) {
+		return nil, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, cmp.Or(t.KeyFile, t.CertFile))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	} else if t.KeyFile != "" {
+		return nil, errors.New("a client key requires a client certificate")
+	}
+	return tc, nil
+}
+
+// UseTLS sets the HTTP client of o to connect with the TLS configuration tc.
+// If tc is nil, UseTLS does nothing. Call it before wrapping the HTTP client,
+// as with [ThrottleClient].
+func UseTLS(o *s3.Options, tc *tls.Config) {
+	if tc == nil {
+		return
+	}
+	set := func(t *http.Transport) { t.TLSClientConfig = tc }
+	switch c := o.HTTPClient.(type) {
+	case *awshttp.BuildableClient:
+		o.HTTPClient = c.WithTransportOptions(set)
+	case nil:
+		o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(set)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/creachadair/tlsutil"
+	"github.com/grafana/go-cache-plugin/lib/s3util"
+)
+
+func TestTLSFiles(t *testing.T) {
+	if tc, err := (s3util.TLSFiles{}).Config(); tc != nil || err != nil {
+		t.Fatalf("Config of zero TLSFiles: got %v, %v; want nil, nil", tc, err)
+	}
+
+	// A private CA issues the certificates of the server and the client.
+	ca, err := tlsutil.NewSigningCert(time.Hour, &x509.Certificate{
+		Subject: pkix.Name{Organization: []string{"test CA"}},
+	})
+	if err != nil {
+		t.Fatalf("NewSigningCert: %v", err)
+	}
+	issue := func(name string) tls.Certificate {
+		t.Helper()
+		c, err := tlsutil.NewServerCert(time.Hour, ca, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		})
+		if err != nil {
+			t.Fatalf("NewServerCert: %v", err)
+		}
+		tc, err := c.TLSCertificate()
+		if err != nil {
+			t.Fatalf("TLSCertificate: %v", err)
+		}
+		return tc
+	}
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM(ca.CertPEM())
+
+	srv := httptest.NewUnstartedServer(new(fakeBucket))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{issue("server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	client, err := tlsutil.NewServerCert(time.Hour, ca, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}})
+	if err != nil {
+		t.Fatalf("NewServerCert: %v", err)
+	}
+	caFile := writeFile("ca.pem", ca.CertPEM())
+	certFile := writeFile("client.pem", client.CertPEM())
+	keyFile := writeFile("client.key", client.PrivKeyPEM())
+	bothFile := writeFile("both.pem", append(client.CertPEM(), client.PrivKeyPEM()...))
+
+	newClient := func(files s3util.TLSFiles) *s3util.Client {
+		t.Helper()
+		tc, err := files.Config()
+		if err != nil {
+			t.Fatalf("Config: %v", err)
+		}
+		return &s3util.Client{
+			Client: s3.New(s3.Options{
+				Region:           "us-east-1",
+				BaseEndpoint:     aws.String(srv.URL),
+				UsePathStyle:     true,
+				Credentials:      aws.AnonymousCredentials{},
+				RetryMaxAttempts: 1,
+			}, func(o *s3.Options) { s3util.UseTLS(o, tc) }),
+			Bucket: "test",
+		}
+	}
+	ctx := context.Background()
+	for _, files := range []s3util.TLSFiles{
+		{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+		{CAFile: caFile, CertFile: bothFile},
+	} {
+		c := newClient(files)
+		if err := c.Put(ctx, "key", strings.NewReader("data")); err != nil {
+			t.Errorf("Put with %+v: %v", files, err)
+		}
+	}
+
+	// Without the CA, or without the client certificate, the connection fails.
+	for _, files := range []s3util.TLSFiles{
+		{CertFile: certFile, KeyFile: keyFile},
+		{CAFile: caFile},
+	} {
+		c := newClient(files)
+		if err := c.Put(ctx, "key", strings.NewReader("data")); err == nil {
+			t.Errorf("Put with %+v: got nil, want error", files)
+		}
+	}
+
+	if _, err := (s3util.TLSFiles{KeyFile: keyFile}).Config(); err == nil {
+		t.Error("Config with a key and no certificate: got nil, want error")
+	}
+	if _, err := (s3util.TLSFiles{CAFile: keyFile}).Config(); err == nil {
+		t.Error("Config with a CA file of no certificates: got nil, want error")
+	}
+}
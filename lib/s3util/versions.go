@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/creachadair/mds/value"
+)
+
+// Versioned reports whether versioning is enabled on the bucket.
+// A bucket whose versioning is suspended is reported as not versioned, since
+// deletes on such a bucket may permanently discard the current object.
+func (c *Client) Versioned(ctx context.Context) (bool, error) {
+	rsp, err := c.Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: &c.Bucket,
+	})
+	if err != nil {
+		return false, err
+	}
+	return rsp.Status == types.BucketVersioningStatusEnabled, nil
+}
+
+// ObjectInfo describes an object or object version in S3.
+type ObjectInfo struct {
+	Key       string
+	VersionID string // set only by ListDeleteMarkers
+	Size      int64
+	ModTime   time.Time
+}
+
+// List calls f for each object in the bucket whose key has the given prefix,
+// in lexicographic order by key. If f reports an error, List stops and
+// returns that error.
+func (c *Client) List(ctx context.Context, prefix string, f func(ObjectInfo) error) error {
+	return c.ListAfter(ctx, prefix, "", f)
+}
+
+// ListAfter is as [Client.List], but lists only the keys that sort after the
+// given key, so that a listing interrupted after that key can be resumed. If
+// after == "", all keys with the prefix are listed.
+func (c *Client) ListAfter(ctx context.Context, prefix, after string, f func(ObjectInfo) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Prefix:       &prefix,
+	}
+	if after != "" {
+		input.StartAfter = &after
+	}
+	pg := s3.NewListObjectsV2Paginator(c.Client, input)
+	for pg.HasMorePages() {
+		page, err := pg.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if err := f(ObjectInfo{
+				Key:     value.At(obj.Key),
+				Size:    value.At(obj.Size),
+				ModTime: value.At(obj.LastModified),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete deletes the specified key from S3. If versioning is enabled on the
+// bucket, this adds a delete marker, and the object can be restored by
+// deleting the marker (see [Client.DeleteVersion]).
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	_, err := c.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+	})
+	return err
+}
+
+// MaxDeleteBatch is the largest number of keys accepted by
+// [Client.DeleteBatch], a limit imposed by S3.
+const MaxDeleteBatch = 1000
+
+// DeleteBatch deletes the specified keys from S3 in a single request. At most
+// [MaxDeleteBatch] keys may be given. It reports an error if the request
+// fails; otherwise, failed maps each key that could not be deleted to the
+// reason. As for [Client.Delete], if versioning is enabled on the bucket,
+// this adds delete markers.
+func (c *Client) DeleteBatch(ctx context.Context, keys []string) (failed map[string]error, _ error) {
+	if len(keys) == 0 {
+		return nil, nil
+	} else if c.ReadOnly {
+		return nil, ErrReadOnly
+	} else if len(keys) > MaxDeleteBatch {
+		return nil, fmt.Errorf("too many keys (%d > %d)", len(keys), MaxDeleteBatch)
+	}
+	objs := make([]types.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objs[i].Key = &key
+	}
+	rsp, err := c.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Delete:       &types.Delete{Objects: objs, Quiet: value.Ptr(true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range rsp.Errors {
+		if failed == nil {
+			failed = make(map[string]error)
+		}
+		failed[value.At(e.Key)] = fmt.Errorf("%s: %s", value.At(e.Code), value.At(e.Message))
+	}
+	return failed, nil
+}
+
+// ListDeleteMarkers calls f for each key in the bucket with the given prefix
+// whose current version is a delete marker, that is, each object that has been
+// deleted but can be restored. The VersionID and ModTime of each result are
+// those of the delete marker. If f reports an error, ListDeleteMarkers stops
+// and returns that error.
+func (c *Client) ListDeleteMarkers(ctx context.Context, prefix string, f func(ObjectInfo) error) error {
+	pg := s3.NewListObjectVersionsPaginator(c.Client, &s3.ListObjectVersionsInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Prefix:       &prefix,
+	})
+	for pg.HasMorePages() {
+		page, err := pg.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, dm := range page.DeleteMarkers {
+			if !value.At(dm.IsLatest) {
+				continue
+			}
+			if err := f(ObjectInfo{
+				Key:       value.At(dm.Key),
+				VersionID: value.At(dm.VersionId),
+				ModTime:   value.At(dm.LastModified),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteVersion permanently deletes the specified version of key. If the
+// version is a delete marker, this restores the previous version of the
+// object.
+func (c *Client) DeleteVersion(ctx context.Context, key, versionID string) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	_, err := c.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+		VersionId:    &versionID,
+	})
+	return err
+}
+
+// Exists reports whether the specified key exists in the bucket.
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+	})
+	if IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and modification time of the object stored under key.
+// If the object does not exist, the error satisfies [IsNotExist].
+func (c *Client) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	rsp, err := c.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       &c.Bucket,
+		RequestPayer: c.payer(),
+		Key:          &key,
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:     key,
+		Size:    value.At(rsp.ContentLength),
+		ModTime: value.At(rsp.LastModified),
+	}, nil
+}
+
+// CopyFrom copies the object stored under srcKey in the bucket of src to key
+// in the bucket of c. The copy is made by S3, so the contents do not pass
+// through the client, but the credentials of c must permit reading from the
+// bucket of src. The metadata of the object is copied with it, and the copy
+// is encrypted and stored according to the settings of c.
+//
+// Contents encrypted by an [Envelope] are bound to their key, so if either
+// client has one and the keys differ, the contents are instead read through
+// src and written through c.
+func (c *Client) CopyFrom(ctx context.Context, src *Client, srcKey, key string) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	if (c.Envelope != nil || src.Envelope != nil) && srcKey != key {
+		data, err := src.GetData(ctx, srcKey)
+		if err != nil {
+			return err
+		}
+		return c.Put(ctx, key, bytes.NewReader(data))
+	}
+	sse, kmsKey, bucketKey := c.Encryption.params()
+	_, err := c.Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               &c.Bucket,
+		RequestPayer:         c.payer(),
+		Key:                  &key,
+		CopySource:           value.Ptr(url.PathEscape(src.Bucket + "/" + srcKey)),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKey,
+		BucketKeyEnabled:     bucketKey,
+		StorageClass:         c.StorageClass,
+	})
+	return err
+}
@@ -0,0 +1,453 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package sbom records the software components served by the cache proxies,
+// and generates software bills of materials (SBOMs) from those records.
+//
+// A [Log] records an [Event] for each component served, with the time and the
+// namespace of the client. The [Log.Modules] and [Log.Artifacts] methods wrap
+// a Go module proxy and a reverse proxy to record what they serve. The
+// [Generate] function renders the components recorded over a time window as a
+// CycloneDX or SPDX document.
+//
+// # Namespaces
+//
+// The namespace of a request is the user name of its HTTP basic
+// authentication, if any. The go command sends the user info of a GOPROXY URL
+// this way, so a build can label its requests by setting, for example:
+//
+//	GOPROXY=http://build-1234@localhost:5970/mod
+//
+// Requests without a user name have the empty namespace.
+package sbom
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/atomicfile"
+	"golang.org/x/mod/module"
+)
+
+// Kinds of component recorded in a [Log].
+const (
+	KindModule   = "go-module" // a Go module version
+	KindArtifact = "artifact"  // a file served by the reverse proxy
+)
+
+// Event records that a component was served.
+type Event struct {
+	Time      time.Time `json:"time"`              // when it was served
+	Namespace string    `json:"ns,omitempty"`      // the namespace of the client
+	Kind      string    `json:"kind"`              // the kind of component
+	Name      string    `json:"name"`              // the module path or artifact URL
+	Version   string    `json:"version,omitempty"` // the module version, if any
+}
+
+// A Log is a persistent record of events, stored as one JSON object per line
+// in a file. A Log is safe for concurrent use.
+type Log struct {
+	// Logger, if non-nil, is used to report errors recording events.
+	// If nil, errors are discarded.
+	Logger *slog.Logger
+
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	seen map[Event]bool // events already recorded for the current day
+	day  time.Time
+}
+
+// Open opens or creates a log at path. If keep > 0, events older than keep
+// are discarded from the file.
+func Open(path string, keep time.Duration) (*Log, error) {
+	if keep > 0 {
+		if err := prune(path, time.Now().Add(-keep)); err != nil {
+			return nil, fmt.Errorf("prune %q: %w", path, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// prune rewrites the log file at path to discard events before cutoff.
+func prune(path string, cutoff time.Time) error {
+	var keep []byte
+	nKeep, nDrop := 0, 0
+	err := scan(path, func(e Event, line []byte) {
+		if e.Time.Before(cutoff) {
+			nDrop++
+		} else {
+			keep = append(append(keep, line...), '\n')
+			nKeep++
+		}
+	})
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && nDrop == 0) {
+		return nil // nothing to do
+	} else if err != nil {
+		return err
+	}
+	return atomicfile.WriteData(path, keep, 0644)
+}
+
+// scan calls f for each event in the log file at path, with the line of text
+// it was decoded from. Lines that are not valid events are skipped.
+func scan(path string, f func(Event, []byte)) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		var e Event
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			f(e, sc.Bytes())
+		}
+	}
+	return sc.Err()
+}
+
+// Record adds e to the log. The time of e is truncated to the second. To keep
+// the log small, if an identical component was already recorded for the same
+// namespace on the same day (UTC), e is not recorded again.
+func (l *Log) Record(e Event) error {
+	e.Time = e.Time.UTC().Truncate(time.Second)
+	day := e.Time.Truncate(24 * time.Hour)
+	key := Event{Namespace: e.Namespace, Kind: e.Kind, Name: e.Name, Version: e.Version}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return errors.New("log is closed")
+	}
+	if !day.Equal(l.day) {
+		l.day, l.seen = day, make(map[Event]bool)
+	} else if l.seen[key] {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.seen[key] = true
+	return nil
+}
+
+// A Query selects events from a [Log].
+type Query struct {
+	Since, Until time.Time // if non-zero, the bounds of the time window
+	Namespace    string    // if non-empty, select only this namespace
+	Artifacts    bool      // if true, include artifacts as well as modules
+}
+
+// Events returns the events in l selected by q, in the order recorded.
+func (l *Log) Events(q Query) ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []Event
+	err := scan(l.path, func(e Event, _ []byte) {
+		switch {
+		case !q.Since.IsZero() && e.Time.Before(q.Since),
+			!q.Until.IsZero() && !e.Time.Before(q.Until),
+			q.Namespace != "" && e.Namespace != q.Namespace,
+			e.Kind == KindArtifact && !q.Artifacts:
+			return
+		}
+		out = append(out, e)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return out, err
+}
+
+// Close closes the log file. Further events are not recorded.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *Log) record(e Event) {
+	if err := l.Record(e); err != nil && l.Logger != nil {
+		l.Logger.Warn("record sbom event failed", "name", e.Name, "err", err)
+	}
+}
+
+// Modules returns a handler that serves requests with h, which must be a Go
+// module proxy mounted at the root, and records each module zip file that h
+// serves successfully. Other files (such as .info and .mod) are not recorded,
+// since the go command fetches them for modules it does not build.
+func (l *Log) Modules(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mod, ver, ok := parseZipPath(r.URL.Path)
+		if !ok || r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.ok() {
+			l.record(Event{
+				Time:      time.Now(),
+				Namespace: namespace(r),
+				Kind:      KindModule,
+				Name:      mod,
+				Version:   ver,
+			})
+		}
+	})
+}
+
+// parseZipPath parses a module proxy request path of the form
+// "/<module>/@v/<version>.zip", and reports the unescaped module path and
+// version.
+func parseZipPath(p string) (mod, ver string, ok bool) {
+	emod, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/@v/")
+	if !ok {
+		return "", "", false
+	}
+	ever, ok := strings.CutSuffix(rest, ".zip")
+	if !ok {
+		return "", "", false
+	}
+	mod, err := module.UnescapePath(emod)
+	if err != nil {
+		return "", "", false
+	}
+	ver, err = module.UnescapeVersion(ever)
+	if err != nil {
+		return "", "", false
+	}
+	return mod, ver, true
+}
+
+// Artifacts returns a handler that serves requests with h, which should be a
+// reverse proxy, and records the URL of each GET request that h serves
+// successfully.
+func (l *Log) Artifacts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.ok() {
+			l.record(Event{
+				Time:      time.Now(),
+				Namespace: namespace(r),
+				Kind:      KindArtifact,
+				Name:      requestURL(r),
+			})
+		}
+	})
+}
+
+// requestURL returns the URL of the target of r, without its query.
+func requestURL(r *http.Request) string {
+	u := url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host, Path: r.URL.Path}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	return u.String()
+}
+
+// namespace returns the namespace of r, the user name of its basic
+// authentication or "".
+func namespace(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+// statusWriter is an [http.ResponseWriter] that remembers the status code of
+// the response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *statusWriter) ok() bool { return w.code == http.StatusOK }
+
+// Formats supported by [Generate].
+const (
+	FormatCycloneDX = "cyclonedx" // CycloneDX 1.5 JSON
+	FormatSPDX      = "spdx"      // SPDX 2.3 JSON
+)
+
+// Generate returns an SBOM listing the distinct components of events, in the
+// given format. An empty format means [FormatCycloneDX]. The name labels the
+// document, for example with the namespace it describes.
+func Generate(events []Event, format, name string) (map[string]any, error) {
+	comps := components(events)
+	now := time.Now().UTC().Format(time.RFC3339)
+	id := newUUID()
+	switch format {
+	case "", FormatCycloneDX:
+		list := make([]any, 0, len(comps))
+		for _, c := range comps {
+			m := map[string]any{"bom-ref": c.ref(), "name": c.Name}
+			if c.Kind == KindModule {
+				m["type"], m["version"], m["purl"] = "library", c.Version, c.ref()
+			} else {
+				m["type"] = "file"
+				m["externalReferences"] = []any{map[string]any{"type": "distribution", "url": c.Name}}
+			}
+			list = append(list, m)
+		}
+		return map[string]any{
+			"bomFormat":    "CycloneDX",
+			"specVersion":  "1.5",
+			"serialNumber": "urn:uuid:" + id,
+			"version":      1,
+			"metadata": map[string]any{
+				"timestamp": now,
+				"tools": map[string]any{"components": []any{
+					map[string]any{"type": "application", "name": "go-cache-plugin"},
+				}},
+				"component": map[string]any{"type": "application", "name": name},
+			},
+			"components": list,
+		}, nil
+
+	case FormatSPDX:
+		pkgs := make([]any, 0, len(comps))
+		rels := make([]any, 0, len(comps))
+		for i, c := range comps {
+			spdxID := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+			m := map[string]any{
+				"SPDXID":           spdxID,
+				"name":             c.Name,
+				"downloadLocation": "NOASSERTION",
+				"filesAnalyzed":    false,
+			}
+			if c.Kind == KindModule {
+				m["versionInfo"] = c.Version
+				m["externalRefs"] = []any{map[string]any{
+					"referenceCategory": "PACKAGE-MANAGER",
+					"referenceType":     "purl",
+					"referenceLocator":  c.ref(),
+				}}
+			} else {
+				m["downloadLocation"] = c.Name
+			}
+			pkgs = append(pkgs, m)
+			rels = append(rels, map[string]any{
+				"spdxElementId":      "SPDXRef-DOCUMENT",
+				"relationshipType":   "DESCRIBES",
+				"relatedSpdxElement": spdxID,
+			})
+		}
+		return map[string]any{
+			"spdxVersion":       "SPDX-2.3",
+			"dataLicense":       "CC0-1.0",
+			"SPDXID":            "SPDXRef-DOCUMENT",
+			"name":              name,
+			"documentNamespace": "https://github.com/grafana/go-cache-plugin/sbom/" + id,
+			"creationInfo": map[string]any{
+				"created":  now,
+				"creators": []any{"Tool: go-cache-plugin"},
+			},
+			"packages":      pkgs,
+			"relationships": rels,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown SBOM format %q", format)
+	}
+}
+
+// A component is a distinct component named by one or more events.
+type component struct{ Kind, Name, Version string }
+
+// ref returns a reference for c: a package URL for a module, or the URL of an
+// artifact.
+func (c component) ref() string {
+	if c.Kind != KindModule {
+		return c.Name
+	}
+	// Per the purl spec, segments are percent-encoded, including "+" in
+	// versions such as "v2.0.0+incompatible".
+	segs := strings.Split(c.Name, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return "pkg:golang/" + strings.Join(segs, "/") + "@" + strings.ReplaceAll(url.PathEscape(c.Version), "+", "%2B")
+}
+
+// components returns the distinct components of events, sorted by kind, name,
+// and version.
+func components(events []Event) []component {
+	var out []component
+	for _, e := range events {
+		out = append(out, component{e.Kind, e.Name, e.Version})
+	}
+	slices.SortFunc(out, func(a, b component) int {
+		if v := strings.Compare(b.Kind, a.Kind); v != 0 {
+			return v // modules before artifacts
+		} else if v := strings.Compare(a.Name, b.Name); v != 0 {
+			return v
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+	return slices.Compact(out)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package sbom_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/sbom"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sbom.jsonl")
+	log, err := sbom.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer log.Close()
+
+	// A stand-in for a module proxy that serves everything but "missing".
+	proxy := httptest.NewServer(log.Modules(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/example.com/missing/@v/v1.0.0.zip" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	})))
+	defer proxy.Close()
+
+	get := func(ns, p string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+p, nil)
+		if ns != "" {
+			req.SetBasicAuth(ns, "")
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get %q: %v", p, err)
+		}
+		rsp.Body.Close()
+	}
+	get("build-1", "/github.com/!burnt!sushi/toml/@v/v1.2.0.zip")
+	get("build-1", "/github.com/!burnt!sushi/toml/@v/v1.2.0.zip") // duplicate
+	get("build-1", "/github.com/!burnt!sushi/toml/@v/v1.2.0.mod") // not a zip
+	get("build-1", "/example.com/missing/@v/v1.0.0.zip")          // not found
+	get("build-2", "/golang.org/x/mod/@v/v0.20.0.zip")
+
+	type mv struct{ NS, Name, Version string }
+	check := func(q sbom.Query, want []mv) {
+		t.Helper()
+		evs, err := log.Events(q)
+		if err != nil {
+			t.Fatalf("Events: %v", err)
+		}
+		var got []mv
+		for _, e := range evs {
+			got = append(got, mv{e.Namespace, e.Name, e.Version})
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Events(%+v): got %v, want %v", q, got, want)
+		}
+	}
+	check(sbom.Query{}, []mv{
+		{"build-1", "github.com/BurntSushi/toml", "v1.2.0"},
+		{"build-2", "golang.org/x/mod", "v0.20.0"},
+	})
+	check(sbom.Query{Namespace: "build-2"}, []mv{{"build-2", "golang.org/x/mod", "v0.20.0"}})
+	check(sbom.Query{Since: time.Now().Add(time.Hour)}, nil)
+
+	evs, _ := log.Events(sbom.Query{Namespace: "build-1"})
+	doc, err := sbom.Generate(evs, sbom.FormatCycloneDX, "build-1")
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	comps := doc["components"].([]any)
+	if len(comps) != 1 {
+		t.Fatalf("Got %d components, want 1", len(comps))
+	}
+	if got, want := comps[0].(map[string]any)["purl"], "pkg:golang/github.com/BurntSushi/toml@v1.2.0"; got != want {
+		t.Errorf("Component purl: got %q, want %q", got, want)
+	}
+	if _, err := sbom.Generate(evs, sbom.FormatSPDX, "build-1"); err != nil {
+		t.Errorf("Generate SPDX: %v", err)
+	}
+	if _, err := sbom.Generate(evs, "bogus", "build-1"); err == nil {
+		t.Error("Generate with an unknown format did not fail")
+	}
+}
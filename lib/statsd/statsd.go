@@ -0,0 +1,210 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package statsd exports the metrics published by the [expvar] package to a
+// StatsD or DogStatsD agent.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPacket is the largest UDP payload sent to the agent, chosen to fit in
+// the MTU of most networks, as the agents recommend.
+const maxPacket = 1432
+
+// An Exporter periodically sends the numeric metrics published by the expvar
+// package to a StatsD agent. Nested maps are flattened, so that the metric
+// "get_hit" in the map "gocache_host" is named "gocache_host.get_hit".
+//
+// Integer metrics are sent as counters, reporting the change since the last
+// flush, unless IsGauge reports they are gauges. Other numbers are sent as
+// gauges, reporting their current values.
+type Exporter struct {
+	// Addr is the UDP address of the agent ([host]:port). It must be set.
+	Addr string
+
+	// Prefix, if non-empty, is prepended to each metric name, with a dot.
+	Prefix string
+
+	// Tags, if non-empty, are DogStatsD tags ("key:value") sent with each
+	// metric. Plain StatsD agents do not understand tags, so set them only
+	// for a DogStatsD agent.
+	Tags []string
+
+	// Interval is the time between flushes. If zero, the default is 10s.
+	Interval time.Duration
+
+	// IsGauge, if non-nil, reports whether the integer metric with the given
+	// flattened name (without Prefix) is a gauge. If nil, [DefaultGauge] is
+	// used.
+	IsGauge func(name string) bool
+
+	// Logger, if non-nil, is used to write log messages. If nil, logs are
+	// discarded.
+	Logger *slog.Logger
+
+	mu   sync.Mutex
+	last map[string]int64 // counter values at the last flush
+}
+
+// DefaultGauge reports whether name is a gauge by the conventions of the
+// expvar metrics in this module: a component of the name begins with
+// "gauge_", or the name ends in "_ratio".
+func DefaultGauge(name string) bool {
+	return strings.HasPrefix(name, "gauge_") || strings.Contains(name, ".gauge_") ||
+		strings.HasSuffix(name, "_ratio")
+}
+
+// Run flushes the metrics to the agent every interval until ctx ends, then
+// flushes them once more and returns. Errors sending metrics are logged, and
+// do not stop the exporter.
+func (e *Exporter) Run(ctx context.Context) error {
+	conn, err := net.Dial("udp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	t := time.NewTicker(e.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.flush(conn)
+			return nil
+		case <-t.C:
+			e.flush(conn)
+		}
+	}
+}
+
+// flush sends the current metrics to conn, in as many packets as needed.
+func (e *Exporter) flush(conn net.Conn) {
+	var buf bytes.Buffer
+	send := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			e.logger().Warn("send metrics failed", "addr", e.Addr, "err", err)
+		}
+		buf.Reset()
+	}
+	for _, line := range e.Lines() {
+		if buf.Len() != 0 && buf.Len()+1+len(line) > maxPacket {
+			send()
+		}
+		if buf.Len() != 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	send()
+}
+
+// Lines returns the StatsD lines for the current values of the metrics, in
+// order by name, and records the values of counters for the next call.
+// Counters that have not changed since the last call are omitted.
+func (e *Exporter) Lines() []string {
+	vals := make(map[string]json.Number)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+		dec := json.NewDecoder(strings.NewReader(kv.Value.String()))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err == nil {
+			flatten(vals, kv.Key, v)
+		}
+	})
+
+	isGauge := e.IsGauge
+	if isGauge == nil {
+		isGauge = DefaultGauge
+	}
+	var tags string
+	if len(e.Tags) != 0 {
+		tags = "|#" + strings.Join(e.Tags, ",")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.last == nil {
+		e.last = make(map[string]int64)
+	}
+	var lines []string
+	for name, num := range vals {
+		stat := sanitize(name)
+		if e.Prefix != "" {
+			stat = e.Prefix + "." + stat
+		}
+		i, err := num.Int64()
+		if err != nil || isGauge(name) {
+			lines = append(lines, fmt.Sprintf("%s:%s|g%s", stat, num, tags))
+			continue
+		}
+		delta := i - e.last[name]
+		e.last[name] = i
+		if delta < 0 {
+			delta = i // the counter was reset
+		}
+		if delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d|c%s", stat, delta, tags))
+		}
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// flatten adds the numeric values in v to out, under dotted names beginning
+// with name.
+func flatten(out map[string]json.Number, name string, v any) {
+	switch t := v.(type) {
+	case map[string]any:
+		for key, val := range t {
+			flatten(out, name+"."+key, val)
+		}
+	case json.Number:
+		out[name] = t
+	}
+}
+
+// sanitize replaces the characters of name that have a special meaning in the
+// StatsD protocol.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func (e *Exporter) interval() time.Duration {
+	if e.Interval > 0 {
+		return e.Interval
+	}
+	return 10 * time.Second
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (e *Exporter) logger() *slog.Logger {
+	if e.Logger != nil {
+		return e.Logger
+	}
+	return discardLogger
+}
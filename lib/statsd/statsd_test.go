@@ -0,0 +1,85 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package statsd_test
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/go-cache-plugin/lib/statsd"
+)
+
+func TestExporter(t *testing.T) {
+	m := expvar.NewMap("test_cache")
+	var hits, depth expvar.Int
+	m.Set("get_hit", &hits)
+	m.Set("queue_depth", &depth)
+	m.Set("hit_ratio", expvar.Func(func() any { return 0.5 }))
+	m.Set("name", expvar.Func(func() any { return "not a number" }))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer pc.Close()
+
+	e := &statsd.Exporter{
+		Addr:     pc.LocalAddr().String(),
+		Prefix:   "gocache",
+		Tags:     []string{"env:test"},
+		Interval: time.Hour,
+		IsGauge: func(name string) bool {
+			return statsd.DefaultGauge(name) || strings.HasSuffix(name, "_depth")
+		},
+	}
+	check := func(want ...string) {
+		t.Helper()
+		if got := e.Lines(); !slices.Equal(got, want) {
+			t.Errorf("Lines:\n got %q\nwant %q", got, want)
+		}
+	}
+
+	hits.Set(3)
+	depth.Set(7)
+	check(
+		"gocache.test_cache.get_hit:3|c|#env:test",
+		"gocache.test_cache.hit_ratio:0.5|g|#env:test",
+		"gocache.test_cache.queue_depth:7|g|#env:test",
+	)
+
+	// Unchanged counters are omitted; gauges are always reported.
+	depth.Set(2)
+	check(
+		"gocache.test_cache.hit_ratio:0.5|g|#env:test",
+		"gocache.test_cache.queue_depth:2|g|#env:test",
+	)
+
+	// Counters report the change since the last flush, here on exit.
+	hits.Add(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := e.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	got := strings.Split(string(buf[:n]), "\n")
+	want := []string{
+		"gocache.test_cache.get_hit:4|c|#env:test",
+		"gocache.test_cache.hit_ratio:0.5|g|#env:test",
+		"gocache.test_cache.queue_depth:2|g|#env:test",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Packet:\n got %q\nwant %q", got, want)
+	}
+}